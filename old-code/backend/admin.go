@@ -0,0 +1,45 @@
+package main
+
+import (
+	"crypto/subtle"
+	"net/http"
+	"strings"
+
+	"github.com/labstack/echo/v4"
+)
+
+// Administrative endpoints require ADMIN_TOKEN, sent either as
+// "Authorization: Bearer <token>" or as the password of HTTP basic auth
+// (any user name), so that tools which only understand URLs such as
+// http://admin:<token>@pi:8080/debug/pprof/heap work too. A logged in user
+// with the admin role is let in as well.
+
+// requestToken is the bearer token or basic auth password of a request.
+func requestToken(r *http.Request) string {
+	if token, ok := strings.CutPrefix(r.Header.Get(echo.HeaderAuthorization), "Bearer "); ok {
+		return token
+	}
+	if _, password, ok := r.BasicAuth(); ok {
+		return password
+	}
+	return ""
+}
+
+func isAdminRequest(c echo.Context) bool {
+	if s := currentSession(c); s != nil && s.Role == "admin" {
+		return true
+	}
+	expected := envString("ADMIN_TOKEN", "")
+	token := requestToken(c.Request())
+	return expected != "" && subtle.ConstantTimeCompare([]byte(token), []byte(expected)) == 1
+}
+
+func requireAdmin(next echo.HandlerFunc) echo.HandlerFunc {
+	return func(c echo.Context) error {
+		if !isAdminRequest(c) {
+			c.Response().Header().Set(echo.HeaderWWWAuthenticate, `Basic realm="home-server"`)
+			return apiError(c, http.StatusUnauthorized, "admin token required")
+		}
+		return next(c)
+	}
+}
@@ -0,0 +1,230 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/labstack/echo/v4"
+)
+
+// Besides averages, extremes and counts, the aggregation endpoints compute
+// percentiles: a quiet night with a few loud trucks averages to a quiet
+// night, while its p99 shows the trucks. All of it is computed in SQL.
+//
+// GET /api/sensor-data/aggregate?metric=sound&agg=avg,p90,p99&step=15m
+// returns the aggregates per step bucket over the last 24 hours (or
+// ?from=&to=, RFC 3339), optionally for one &room=. With &histogram=5 every
+// bucket also carries a histogram of its values in bins 5 units wide.
+
+// aggregateFunctions are the SQL aggregates by name; %s is the value.
+var aggregateFunctions = map[string]string{
+	"avg":   "AVG(%s)",
+	"min":   "MIN(%s)",
+	"max":   "MAX(%s)",
+	"count": "COUNT(%s)",
+	"p50":   "percentile_cont(0.5) WITHIN GROUP (ORDER BY %s)",
+	"p90":   "percentile_cont(0.9) WITHIN GROUP (ORDER BY %s)",
+	"p99":   "percentile_cont(0.99) WITHIN GROUP (ORDER BY %s)",
+}
+
+// aggregateSQL returns the SQL of an aggregate function applied to value.
+func aggregateSQL(fn, value string) (string, error) {
+	f, ok := aggregateFunctions[fn]
+	if !ok {
+		names := make([]string, 0, len(aggregateFunctions))
+		for name := range aggregateFunctions {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		return "", fmt.Errorf("unknown aggregate %q, use one of %s", fn, strings.Join(names, ", "))
+	}
+	return fmt.Sprintf(f, value), nil
+}
+
+// metricSampleQuery selects the timestamp and value of a metric's samples in
+// [from, to) of the devices in room (all for ""). Built-in metrics come from
+// sensor_data, where 0 means no reading. Further placeholders of a query
+// around it start at len(args)+1.
+func metricSampleQuery(metric, room string, from, to time.Time) (string, []interface{}) {
+	args := []interface{}{serverTime(from), serverTime(to), room}
+	if column, ok := metricColumns[metric]; ok {
+		return `
+			SELECT s.timestamp, s.` + column + ` AS value
+			FROM sensor_data s LEFT JOIN devices d ON d.id = s.device_id
+			WHERE s.timestamp >= $1 AND s.timestamp < $2 AND ($3 = '' OR d.room = $3) AND s.` + column + ` != 0
+		`, args
+	}
+	return `
+		SELECT m.timestamp, m.value
+		FROM metric_samples m LEFT JOIN devices d ON d.id = m.device_id
+		WHERE m.timestamp >= $1 AND m.timestamp < $2 AND ($3 = '' OR d.room = $3) AND m.metric = $4
+	`, append(args, metric)
+}
+
+// bucketSQL truncates timestamps to steps of the seconds in placeholder n.
+func bucketSQL(n int) string {
+	return fmt.Sprintf("to_timestamp(floor(extract(epoch FROM timestamp) / $%[1]d) * $%[1]d) AT TIME ZONE 'UTC'", n)
+}
+
+type HistogramBin struct {
+	From  float64 `json:"from"`
+	To    float64 `json:"to"`
+	Count int     `json:"count"`
+}
+
+type AggregateBucket struct {
+	Timestamp time.Time           `json:"timestamp"`
+	Samples   int                 `json:"samples"`
+	Values    map[string]*float64 `json:"values"`
+	Histogram []HistogramBin      `json:"histogram,omitempty"`
+}
+
+// bucketedAggregates computes the functions over step buckets in [from, to).
+func bucketedAggregates(ctx context.Context, metric, room string, from, to time.Time, step time.Duration, funcs []string) ([]AggregateBucket, error) {
+	columns := []string{}
+	for _, fn := range funcs {
+		expr, err := aggregateSQL(fn, "value")
+		if err != nil {
+			return nil, err
+		}
+		columns = append(columns, expr)
+	}
+	samples, args := metricSampleQuery(metric, room, from, to)
+	query := `
+		SELECT ` + bucketSQL(len(args)+1) + ` AS bucket, COUNT(*), ` + strings.Join(columns, ", ") + `
+		FROM (` + samples + `) samples
+		GROUP BY bucket ORDER BY bucket
+	`
+	rows, err := db.QueryContext(ctx, query, append(args, step.Seconds())...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	buckets := []AggregateBucket{}
+	for rows.Next() {
+		b := AggregateBucket{Values: make(map[string]*float64, len(funcs))}
+		values := make([]*float64, len(funcs))
+		dest := []interface{}{&b.Timestamp, &b.Samples}
+		for i := range values {
+			dest = append(dest, &values[i])
+		}
+		if err := rows.Scan(dest...); err != nil {
+			return nil, err
+		}
+		for i, fn := range funcs {
+			b.Values[fn] = values[i]
+		}
+		buckets = append(buckets, b)
+	}
+	return buckets, rows.Err()
+}
+
+// addHistograms counts the values of each bucket in bins width wide.
+func addHistograms(ctx context.Context, buckets []AggregateBucket, metric, room string, from, to time.Time, step time.Duration, width float64) error {
+	samples, args := metricSampleQuery(metric, room, from, to)
+	n := len(args) + 2
+	query := `
+		SELECT ` + bucketSQL(n-1) + ` AS bucket, floor(value / $` + strconv.Itoa(n) + `) * $` + strconv.Itoa(n) + ` AS bin, COUNT(*)
+		FROM (` + samples + `) samples
+		GROUP BY bucket, bin ORDER BY bucket, bin
+	`
+	rows, err := db.QueryContext(ctx, query, append(args, step.Seconds(), width)...)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+
+	index := make(map[time.Time]int, len(buckets))
+	for i, b := range buckets {
+		index[b.Timestamp] = i
+	}
+	for rows.Next() {
+		var bucket time.Time
+		var bin HistogramBin
+		if err := rows.Scan(&bucket, &bin.From, &bin.Count); err != nil {
+			return err
+		}
+		bin.To = bin.From + width
+		if i, ok := index[bucket]; ok {
+			buckets[i].Histogram = append(buckets[i].Histogram, bin)
+		}
+	}
+	return rows.Err()
+}
+
+func getSensorAggregate(c echo.Context) error {
+	metric := c.QueryParam("metric")
+	if metric == "" {
+		metric = "co2"
+	}
+	if !knownMetric(metric) {
+		return apiError(c, http.StatusBadRequest, "unknown metric")
+	}
+	now := time.Now()
+	from, to := now.Add(-24*time.Hour), now
+	var err error
+	if v := c.QueryParam("from"); v != "" {
+		if from, err = time.Parse(time.RFC3339, v); err != nil {
+			return apiError(c, http.StatusBadRequest, "from must be an RFC 3339 time")
+		}
+	}
+	if v := c.QueryParam("to"); v != "" {
+		if to, err = time.Parse(time.RFC3339, v); err != nil {
+			return apiError(c, http.StatusBadRequest, "to must be an RFC 3339 time")
+		}
+	}
+	if !to.After(from) {
+		return apiError(c, http.StatusBadRequest, "to must be after from")
+	}
+	step := 15 * time.Minute
+	if v := c.QueryParam("step"); v != "" {
+		if step, err = time.ParseDuration(v); err != nil || step < time.Minute {
+			return apiError(c, http.StatusBadRequest, "step must be a duration of at least 1m")
+		}
+	}
+	if to.Sub(from)/step > 5000 {
+		return apiError(c, http.StatusBadRequest, "too many buckets, use a longer step")
+	}
+	funcs := []string{"avg", "min", "max"}
+	if v := c.QueryParam("agg"); v != "" {
+		funcs = strings.Split(v, ",")
+	}
+	for _, fn := range funcs {
+		if _, err := aggregateSQL(fn, "value"); err != nil {
+			return apiError(c, http.StatusBadRequest, err.Error())
+		}
+	}
+
+	ctx := c.Request().Context()
+	room := c.QueryParam("room")
+	buckets, err := bucketedAggregates(ctx, metric, room, from, to, step, funcs)
+	if err != nil {
+		return internalError(c, err)
+	}
+	if v := c.QueryParam("histogram"); v != "" {
+		width, err := strconv.ParseFloat(v, 64)
+		if err != nil || width <= 0 {
+			return apiError(c, http.StatusBadRequest, "histogram must be a positive bin width")
+		}
+		if err := addHistograms(ctx, buckets, metric, room, from, to, step, width); err != nil {
+			return internalError(c, err)
+		}
+	}
+	unit, err := metricUnit(ctx, metric)
+	if err != nil {
+		return internalError(c, err)
+	}
+	return c.JSON(http.StatusOK, map[string]interface{}{
+		"metric":  metric,
+		"unit":    unit,
+		"room":    room,
+		"step":    step.String(),
+		"buckets": buckets,
+	})
+}
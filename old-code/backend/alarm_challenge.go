@@ -0,0 +1,212 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"log"
+	"math/rand"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/labstack/echo/v4"
+)
+
+// In hard mode (the alarm_hard_mode setting) a ringing alarm can only be
+// stopped by answering a server generated arithmetic challenge. The device
+// keeps ringing until its update response carries "stop_alarm": true. The
+// challenge gets harder with alarm_challenge_difficulty (1-3).
+//
+// The ring in progress is the open row of alarm_rings, so a dismissal, a
+// snooze or the backup alarm on any replica sees it; only the replica
+// receiving the device's updates starts and ends rings.
+
+type Challenge struct {
+	ID       string `json:"id"`
+	Question string `json:"question"`
+	answer   int
+}
+
+type ringState struct {
+	recordID     int // the alarm_rings row
+	ringingSince time.Time
+	dismissed    bool
+	snoozed      bool // from the phone, see alarm_push.go
+	unattended   bool // stopped by the server after alarm_max_ring
+	challenge    *Challenge
+}
+
+// ringMu serializes this replica's reads and changes of the ring.
+var ringMu sync.Mutex
+
+// currentRing returns the ring in progress, nil while the alarm is not
+// ringing.
+func currentRing(ctx context.Context) (*ringState, error) {
+	r := &ringState{}
+	var id, question sql.NullString
+	var answer sql.NullInt64
+	err := db.QueryRowContext(ctx, `
+		SELECT id, started_at, dismissed, snoozed, unattended, challenge_id, challenge_question, challenge_answer
+		FROM alarm_rings WHERE ended_at IS NULL ORDER BY id DESC LIMIT 1
+	`).Scan(&r.recordID, &r.ringingSince, &r.dismissed, &r.snoozed, &r.unattended, &id, &question, &answer)
+	if err == sql.ErrNoRows {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	if id.Valid {
+		r.challenge = &Challenge{ID: id.String, Question: question.String, answer: int(answer.Int64)}
+	}
+	return r, nil
+}
+
+// observeRing tracks the device's alarm_active flag and alarm_active_time
+// (seconds) and reports whether the device should be told to stop ringing,
+// and for how long to snooze when the stop is a snooze.
+func observeRing(active bool, activeSeconds int64) (bool, time.Duration) {
+	ringMu.Lock()
+	defer ringMu.Unlock()
+	now := time.Now()
+	r, err := currentRing(context.Background())
+	if err != nil {
+		log.Printf("Failed to load the alarm ring: %v", err)
+		return false, 0
+	}
+	if !active {
+		if r != nil {
+			r.finishRecord(now)
+		}
+		return false, 0
+	}
+	if r == nil {
+		if r, err = startRing(now); err != nil {
+			log.Printf("Failed to record alarm ring: %v", err)
+			return false, 0
+		}
+		if settingBool("alarm_ring_push") {
+			go notify(ringNotification(r))
+		}
+	}
+	r.enforceMaxRing(now, activeSeconds)
+	if r.snoozed && !r.dismissed {
+		return true, settingDuration("alarm_snooze")
+	}
+	return r.dismissed, 0
+}
+
+// setChallenge replaces the ring's challenge, unless another replica has
+// replaced it already, and returns the one now in place.
+func (r *ringState) setChallenge(ctx context.Context, challenge *Challenge) (*Challenge, error) {
+	replaced := ""
+	if r.challenge != nil {
+		replaced = r.challenge.ID
+	}
+	_, err := db.ExecContext(ctx, `
+		UPDATE alarm_rings SET challenge_id = $2, challenge_question = $3, challenge_answer = $4
+		WHERE id = $1 AND COALESCE(challenge_id, '') = $5
+	`, r.recordID, challenge.ID, challenge.Question, challenge.answer, replaced)
+	if err != nil {
+		return nil, err
+	}
+	current, err := currentRing(ctx)
+	if err != nil || current == nil || current.challenge == nil {
+		return challenge, err
+	}
+	return current.challenge, nil
+}
+
+func newChallenge(difficulty int) *Challenge {
+	var question string
+	var answer int
+	switch {
+	case difficulty <= 1:
+		a, b := rand.Intn(90)+10, rand.Intn(90)+10
+		question, answer = fmt.Sprintf("%d + %d", a, b), a+b
+	case difficulty == 2:
+		a, b, c := rand.Intn(12)+3, rand.Intn(12)+3, rand.Intn(90)+10
+		question, answer = fmt.Sprintf("%d × %d + %d", a, b, c), a*b+c
+	default:
+		a, b, c, d := rand.Intn(20)+11, rand.Intn(8)+3, rand.Intn(20)+11, rand.Intn(8)+3
+		question, answer = fmt.Sprintf("%d × %d - %d × %d", a, b, c, d), a*b-c*d
+	}
+	return &Challenge{
+		ID:       strconv.FormatInt(time.Now().UnixNano(), 36),
+		Question: question,
+		answer:   answer,
+	}
+}
+
+func getAlarmChallenge(c echo.Context) error {
+	if !settingBool("alarm_hard_mode") {
+		return apiErrorCode(c, http.StatusNotFound, codeNotConfigured, "hard mode is not enabled")
+	}
+
+	ringMu.Lock()
+	defer ringMu.Unlock()
+	ctx := c.Request().Context()
+	r, err := currentRing(ctx)
+	if err != nil {
+		return internalError(c, err)
+	}
+	if r == nil {
+		return apiError(c, http.StatusConflict, "alarm is not ringing")
+	}
+	challenge := r.challenge
+	if challenge == nil {
+		if challenge, err = r.setChallenge(ctx, newChallenge(settingInt("alarm_challenge_difficulty"))); err != nil {
+			return internalError(c, err)
+		}
+	}
+	return c.JSON(http.StatusOK, challenge)
+}
+
+func dismissAlarm(c echo.Context) error {
+	var req struct {
+		ChallengeID string `json:"challenge_id"`
+		Answer      *int   `json:"answer"`
+	}
+	if err := c.Bind(&req); err != nil {
+		return invalidBody(c, err)
+	}
+
+	ringMu.Lock()
+	defer ringMu.Unlock()
+	ctx := c.Request().Context()
+	r, err := currentRing(ctx)
+	if err != nil {
+		return internalError(c, err)
+	}
+	if r == nil {
+		return apiError(c, http.StatusConflict, "alarm is not ringing")
+	}
+
+	if settingBool("alarm_hard_mode") {
+		if r.challenge == nil || req.ChallengeID != r.challenge.ID {
+			return apiError(c, http.StatusBadRequest, "unknown challenge, request a new one")
+		}
+		if req.Answer == nil || *req.Answer != r.challenge.answer {
+			// A wrong answer burns the challenge so it cannot be brute forced.
+			challenge, err := r.setChallenge(ctx, newChallenge(settingInt("alarm_challenge_difficulty")))
+			if err != nil {
+				return internalError(c, err)
+			}
+			return c.JSON(http.StatusForbidden, map[string]interface{}{
+				"code":      "wrong_answer",
+				"error":     "wrong answer",
+				"challenge": challenge,
+			})
+		}
+	}
+
+	if _, err := db.ExecContext(ctx, "UPDATE alarm_rings SET dismissed = true WHERE id = $1", r.recordID); err != nil {
+		return internalError(c, err)
+	}
+	publish(EventAlarmChanged, map[string]interface{}{"dismissed": true})
+	return c.JSON(http.StatusOK, map[string]interface{}{
+		"dismissed":     true,
+		"ringing_since": r.ringingSince,
+	})
+}
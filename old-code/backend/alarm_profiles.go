@@ -0,0 +1,219 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"time"
+
+	"github.com/labstack/echo/v4"
+)
+
+// Alarm schedule profiles set the alarm by the date, e.g. 06:30 during the
+// school term and 08:00 (or disarmed) in the holidays:
+//
+//	{"profiles": [
+//	  {"name": "summer holidays", "from": "07-01", "to": "08-31", "time": "08:00"},
+//	  {"name": "school term", "from": "2024-09-02", "to": "2025-06-27", "time": "06:30"}
+//	]}
+//
+// from and to are inclusive, either dates or MM-DD for a range that repeats
+// every year (it may wrap, e.g. 11-01 to 03-31). The first profile whose
+// range holds a day is active that day; "armed" (default true) is whether
+// it arms the alarm. The alarm_profiles job sets the alarm when the active
+// profile changes, at midnight, so the morning's alarm follows the new
+// profile; in between the alarm can be changed as usual. Days no profile
+// covers leave the alarm as it is.
+
+const maxAlarmProfiles = 20
+
+type AlarmScheduleProfile struct {
+	Name  string `json:"name"`
+	From  string `json:"from"`
+	To    string `json:"to"`
+	Time  string `json:"time"`
+	Armed *bool  `json:"armed,omitempty"`
+}
+
+// covers reports whether the profile's range holds day (YYYY-MM-DD).
+func (p AlarmScheduleProfile) covers(day string) bool {
+	if len(p.From) == len("2006-01-02") {
+		return p.From <= day && day <= p.To
+	}
+	md := day[5:]
+	if p.From <= p.To {
+		return p.From <= md && md <= p.To
+	}
+	return md >= p.From || md <= p.To
+}
+
+func (p AlarmScheduleProfile) armed() bool {
+	return p.Armed == nil || *p.Armed
+}
+
+func validateAlarmProfile(p AlarmScheduleProfile) error {
+	if p.Name == "" {
+		return fmt.Errorf("a profile needs a name")
+	}
+	if _, ok := parseAlarmTime(p.Time); !ok {
+		return fmt.Errorf("time must be HH:MM")
+	}
+	layout := "2006-01-02"
+	if len(p.From) == len("01-02") {
+		layout = "01-02"
+	}
+	from, errFrom := time.Parse(layout, p.From)
+	to, errTo := time.Parse(layout, p.To)
+	if errFrom != nil || errTo != nil || len(p.To) != len(p.From) {
+		return fmt.Errorf("from and to must both be YYYY-MM-DD or both MM-DD")
+	}
+	if layout == "2006-01-02" && to.Before(from) {
+		return fmt.Errorf("to must not be before from")
+	}
+	return nil
+}
+
+func loadAlarmProfiles(ctx context.Context) ([]AlarmScheduleProfile, *time.Time, error) {
+	profiles := []AlarmScheduleProfile{}
+	var raw string
+	var updated time.Time
+	err := db.QueryRowContext(ctx, "SELECT profiles::text, updated_at FROM alarm_profiles ORDER BY id DESC LIMIT 1").
+		Scan(&raw, &updated)
+	if err == sql.ErrNoRows {
+		return profiles, nil, nil
+	}
+	if err != nil {
+		return nil, nil, err
+	}
+	return profiles, &updated, json.Unmarshal([]byte(raw), &profiles)
+}
+
+// activeAlarmProfile returns the profile of day, or nil.
+func activeAlarmProfile(profiles []AlarmScheduleProfile, day time.Time) *AlarmScheduleProfile {
+	date := day.Format("2006-01-02")
+	for i, p := range profiles {
+		if p.covers(date) {
+			return &profiles[i]
+		}
+	}
+	return nil
+}
+
+// nextAlarmProfileChange returns the first midnight after now at which
+// another profile (or none) becomes active, within a year.
+func nextAlarmProfileChange(profiles []AlarmScheduleProfile, now time.Time) (time.Time, *AlarmScheduleProfile, bool) {
+	current := activeAlarmProfile(profiles, now)
+	day := time.Date(now.Year(), now.Month(), now.Day(), 0, 0, 0, 0, now.Location())
+	for i := 0; i < 366; i++ {
+		day = day.AddDate(0, 0, 1)
+		next := activeAlarmProfile(profiles, day)
+		if next == nil && current == nil {
+			continue
+		}
+		if next == nil || current == nil || next.Name != current.Name {
+			return day, next, true
+		}
+	}
+	return time.Time{}, nil, false
+}
+
+// applyAlarmProfiles is the alarm_profiles job: it sets the alarm when the
+// active profile differs from the one applied last. Days without a profile
+// are recorded too, so the same profile sets the alarm again next year.
+func applyAlarmProfiles() error {
+	ctx := context.Background()
+	profiles, _, err := loadAlarmProfiles(ctx)
+	if err != nil {
+		return err
+	}
+	now := time.Now().In(alarmLocation())
+	active := activeAlarmProfile(profiles, now)
+	var applied string
+	err = db.QueryRowContext(ctx, "SELECT profile FROM alarm_profile_changes ORDER BY id DESC LIMIT 1").Scan(&applied)
+	if err != nil && err != sql.ErrNoRows {
+		return err
+	}
+	name := ""
+	if active != nil {
+		name = active.Name
+	}
+	if name == applied {
+		return nil
+	}
+	if _, err := db.ExecContext(ctx, "INSERT INTO alarm_profile_changes (profile, at) VALUES ($1, $2)", name, now); err != nil {
+		return err
+	}
+	if active == nil {
+		return nil
+	}
+
+	alarm, _ := parseAlarmTime(active.Time)
+	if _, err := db.ExecContext(ctx, "INSERT INTO alarm_time (time, armed) VALUES ($1, $2)", alarm, active.armed()); err != nil {
+		return err
+	}
+	publish(EventAlarmChanged, AlarmTime{Time: alarm, Armed: active.armed(), Configured: true})
+	log.Printf("Alarm schedule profile %s: alarm set to %s (armed %t)", active.Name, alarm, active.armed())
+	return nil
+}
+
+// getAlarmProfile returns the profiles, the active one and the next change.
+func getAlarmProfile(c echo.Context) error {
+	profiles, updated, err := loadAlarmProfiles(c.Request().Context())
+	if err != nil {
+		return internalError(c, err)
+	}
+	now := time.Now().In(alarmLocation())
+	response := map[string]interface{}{
+		"profiles":        profiles,
+		"updated_at":      updated,
+		"active":          activeAlarmProfile(profiles, now),
+		"next_transition": nil,
+	}
+	if at, next, ok := nextAlarmProfileChange(profiles, now); ok {
+		response["next_transition"] = map[string]interface{}{"at": at, "profile": next}
+	}
+	return c.JSON(http.StatusOK, response)
+}
+
+// putAlarmProfile replaces the profiles and applies the one active today.
+func putAlarmProfile(c echo.Context) error {
+	var req struct {
+		Profiles []AlarmScheduleProfile `json:"profiles"`
+	}
+	if err := c.Bind(&req); err != nil {
+		return invalidBody(c, err)
+	}
+	if len(req.Profiles) > maxAlarmProfiles {
+		return apiError(c, http.StatusBadRequest, fmt.Sprintf("at most %d profiles", maxAlarmProfiles))
+	}
+	if req.Profiles == nil {
+		req.Profiles = []AlarmScheduleProfile{}
+	}
+	names := make(map[string]bool)
+	for i, p := range req.Profiles {
+		if err := validateAlarmProfile(p); err != nil {
+			return apiError(c, http.StatusBadRequest, fmt.Sprintf("profile %d: %v", i+1, err))
+		}
+		if names[p.Name] {
+			return apiError(c, http.StatusBadRequest, "duplicate profile "+p.Name)
+		}
+		names[p.Name] = true
+		req.Profiles[i].Time, _ = parseAlarmTime(p.Time)
+	}
+	raw, err := json.Marshal(req.Profiles)
+	if err != nil {
+		return internalError(c, err)
+	}
+	_, err = db.ExecContext(c.Request().Context(),
+		"INSERT INTO alarm_profiles (profiles, updated_at) VALUES ($1, $2)", string(raw), time.Now())
+	if err != nil {
+		return internalError(c, err)
+	}
+	if err := applyAlarmProfiles(); err != nil {
+		return internalError(c, err)
+	}
+	return getAlarmProfile(c)
+}
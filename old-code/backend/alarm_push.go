@@ -0,0 +1,127 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/labstack/echo/v4"
+)
+
+// When the alarm starts ringing (alarm_ring_push) the phones subscribed to
+// ntfy and the browsers subscribed to Web Push get a notification with
+// Snooze and Dismiss buttons. The buttons POST to /api/alarm/action with a
+// signed ?t= token instead of a login, valid for this ring of this
+// household only. A snooze tells the device "stop_alarm": true together
+// with "snooze_seconds" (alarm_snooze); firmware that knows the field rings
+// again after it, older firmware just stops. In hard mode there are no
+// Snooze and Dismiss buttons, only one opening the dashboard for the
+// challenge.
+// Buttons need DASHBOARD_URL, the address the phone reaches the server on.
+
+const alarmActionTTL = time.Hour
+
+type alarmActionToken struct {
+	Action    string    `json:"a"` // snooze | dismiss
+	Ring      int       `json:"r"` // the alarm_rings row of the ring
+	Expires   time.Time `json:"e"`
+	Household string    `json:"hh,omitempty"`
+}
+
+func alarmActionURL(base, action string, r *ringState) string {
+	payload, _ := json.Marshal(alarmActionToken{Action: action, Ring: r.recordID,
+		Expires: r.ringingSince.Add(alarmActionTTL), Household: household})
+	return base + "/api/alarm/action?t=" + url.QueryEscape(signValue("alarm-action", payload))
+}
+
+func verifyAlarmActionToken(token string) (alarmActionToken, bool) {
+	var t alarmActionToken
+	payload, err := verifyValue("alarm-action", token)
+	if err != nil || json.Unmarshal(payload, &t) != nil {
+		return t, false
+	}
+	return t, t.Household == household && time.Now().Before(t.Expires)
+}
+
+// signedAlarmActionRequest lets the notification buttons through
+// requireSession.
+func signedAlarmActionRequest(c echo.Context) bool {
+	if c.Request().URL.Path != "/api/alarm/action" {
+		return false
+	}
+	_, ok := verifyAlarmActionToken(c.QueryParam("t"))
+	return ok
+}
+
+// ringNotification is sent when a ring starts.
+func ringNotification(r *ringState) Notification {
+	n := Notification{
+		Event:    "alarm",
+		Title:    "Alarm ringing",
+		Message:  fmt.Sprintf("The alarm started ringing at %s.", r.ringingSince.Format("15:04")),
+		Priority: 4,
+		Tags:     []string{"alarm_clock"},
+		Channels: []string{"ntfy", "webpush"},
+	}
+	base := strings.TrimRight(envString("DASHBOARD_URL", ""), "/")
+	if base == "" {
+		return n
+	}
+	if settingBool("alarm_hard_mode") {
+		n.Actions = append(n.Actions, NotificationAction{Label: "Open challenge", URL: base})
+		return n
+	}
+	snooze := settingDuration("alarm_snooze")
+	n.Actions = append(n.Actions,
+		NotificationAction{Label: fmt.Sprintf("Snooze %d min", int(snooze.Minutes())),
+			URL: alarmActionURL(base, "snooze", r), Method: http.MethodPost},
+		NotificationAction{Label: "Dismiss", URL: alarmActionURL(base, "dismiss", r), Method: http.MethodPost})
+	return n
+}
+
+// alarmAction performs a notification button's action on the ring it was
+// sent for.
+func alarmAction(c echo.Context) error {
+	token, ok := verifyAlarmActionToken(c.QueryParam("t"))
+	if !ok {
+		return apiError(c, http.StatusUnauthorized, "invalid or expired link")
+	}
+
+	ringMu.Lock()
+	defer ringMu.Unlock()
+	ctx := c.Request().Context()
+	r, err := currentRing(ctx)
+	if err != nil {
+		return internalError(c, err)
+	}
+	if r == nil || r.recordID != token.Ring {
+		return apiError(c, http.StatusConflict, "this ring is over")
+	}
+	// A snooze stops older firmware, so it would get around the challenge too
+	if settingBool("alarm_hard_mode") && (token.Action == "snooze" || token.Action == "dismiss") {
+		return apiError(c, http.StatusForbidden, "hard mode: answer the challenge to stop the alarm")
+	}
+	switch token.Action {
+	case "snooze":
+		_, err = db.ExecContext(ctx, "UPDATE alarm_rings SET snoozed = true WHERE id = $1", r.recordID)
+	case "dismiss":
+		_, err = db.ExecContext(ctx, "UPDATE alarm_rings SET dismissed = true WHERE id = $1", r.recordID)
+	default:
+		return apiError(c, http.StatusBadRequest, "unknown action")
+	}
+	if err != nil {
+		return internalError(c, err)
+	}
+	if token.Action == "snooze" {
+		publish(EventAlarmChanged, map[string]interface{}{"snoozed": true, "ringing_since": r.ringingSince})
+	} else {
+		publish(EventAlarmChanged, map[string]interface{}{"dismissed": true})
+	}
+	return c.JSON(http.StatusOK, map[string]interface{}{
+		"action":        token.Action,
+		"ringing_since": r.ringingSince,
+	})
+}
@@ -0,0 +1,117 @@
+package main
+
+import (
+	"database/sql"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/labstack/echo/v4"
+)
+
+// Every ring of the alarm is recorded in alarm_rings with how it ended:
+// "dismissed" through /api/alarm/dismiss, "snoozed" from the phone (see
+// alarm_push.go), "stopped" on the device, or
+// "unattended" when it rang longer than alarm_max_ring and the server told
+// the device to stop. An unattended alarm is escalated, as nobody may be
+// home or someone slept through it.
+
+type AlarmRing struct {
+	ID          int        `json:"id"`
+	StartedAt   time.Time  `json:"started_at"`
+	EndedAt     *time.Time `json:"ended_at,omitempty"`
+	RingSeconds *int64     `json:"ring_seconds,omitempty"`
+	Outcome     string     `json:"outcome"` // ringing | dismissed | snoozed | stopped | unattended
+}
+
+// startRing, finishRecord and enforceMaxRing are called with ringMu held.
+func startRing(now time.Time) (*ringState, error) {
+	r := &ringState{ringingSince: now}
+	err := db.QueryRow("INSERT INTO alarm_rings (started_at, outcome) VALUES ($1, 'ringing') RETURNING id", now).
+		Scan(&r.recordID)
+	return r, err
+}
+
+// finishRecord ends the ring; the outcome is taken from the row, which
+// other replicas may have changed.
+func (r *ringState) finishRecord(now time.Time) {
+	_, err := db.Exec(`
+		UPDATE alarm_rings SET ended_at = $2, ring_seconds = $3, outcome = CASE
+			WHEN unattended THEN 'unattended' WHEN dismissed THEN 'dismissed' WHEN snoozed THEN 'snoozed' ELSE 'stopped'
+		END WHERE id = $1
+	`, r.recordID, now, int64(now.Sub(r.ringingSince).Seconds()))
+	if err != nil {
+		log.Printf("Failed to record alarm ring end: %v", err)
+	}
+}
+
+// enforceMaxRing stops an alarm that has rung longer than alarm_max_ring
+// (0 disables the limit). The device's own alarm_active_time counts, as the
+// server may have missed the start of the ring.
+func (r *ringState) enforceMaxRing(now time.Time, activeSeconds int64) {
+	limit := settingDuration("alarm_max_ring")
+	if limit <= 0 || r.dismissed || r.snoozed {
+		return
+	}
+	rang := max(now.Sub(r.ringingSince), time.Duration(activeSeconds)*time.Second)
+	if rang < limit {
+		return
+	}
+	res, err := db.Exec(`
+		UPDATE alarm_rings SET dismissed = true, unattended = true WHERE id = $1 AND NOT dismissed AND NOT snoozed
+	`, r.recordID)
+	if err != nil {
+		log.Printf("Failed to record unattended alarm: %v", err)
+		return
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		return // dismissed or snoozed in the meantime, seen on the next update
+	}
+	r.dismissed, r.unattended = true, true
+	publish(EventAlarmChanged, map[string]interface{}{"unattended": true, "ringing_since": r.ringingSince})
+	go escalate(Notification{
+		Event:   "alarm",
+		Title:   "Alarm unattended",
+		Message: fmt.Sprintf("The alarm rang for %s without being turned off and was stopped.", rang.Round(time.Second)),
+		Tags:    []string{"alarm_clock", "warning"},
+	})
+}
+
+// getAlarmRings lists the latest rings, newest first (?limit, default 30).
+func getAlarmRings(c echo.Context) error {
+	limit := 30
+	if v := c.QueryParam("limit"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 1 || n > 1000 {
+			return apiError(c, http.StatusBadRequest, "limit must be between 1 and 1000")
+		}
+		limit = n
+	}
+	rows, err := db.QueryContext(c.Request().Context(), `
+		SELECT id, started_at, ended_at, ring_seconds, outcome FROM alarm_rings ORDER BY id DESC LIMIT $1
+	`, limit)
+	if err != nil {
+		return internalError(c, err)
+	}
+	defer rows.Close()
+
+	rings := []AlarmRing{}
+	for rows.Next() {
+		var a AlarmRing
+		var ended sql.NullTime
+		var seconds sql.NullInt64
+		if err := rows.Scan(&a.ID, &a.StartedAt, &ended, &seconds, &a.Outcome); err != nil {
+			return internalError(c, err)
+		}
+		if ended.Valid {
+			a.EndedAt = &ended.Time
+		}
+		if seconds.Valid {
+			a.RingSeconds = &seconds.Int64
+		}
+		rings = append(rings, a)
+	}
+	return c.JSON(http.StatusOK, rings)
+}
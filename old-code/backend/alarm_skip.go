@@ -0,0 +1,142 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"net/http"
+	"time"
+
+	"github.com/labstack/echo/v4"
+)
+
+// AlarmSkip records that the alarm on a given day will not ring. Automatic
+// skips (e.g. from the geofence) may be lifted automatically again; manual
+// ones are overrides and are left alone by the automation.
+type AlarmSkip struct {
+	AlarmDate string `json:"alarm_date"` // YYYY-MM-DD
+	Skip      bool   `json:"skip"`
+	Reason    string `json:"reason"`
+	Manual    bool   `json:"manual"`
+}
+
+// nextAlarmAt returns the next occurrence of an "HH:MM" alarm after now, in
+// the alarm's timezone (see alarmLocation).
+func nextAlarmAt(alarm string, now time.Time) (time.Time, error) {
+	now = now.In(alarmLocation())
+	t, err := time.ParseInLocation("15:04", alarm, now.Location())
+	if err != nil {
+		return time.Time{}, err
+	}
+	next := time.Date(now.Year(), now.Month(), now.Day(), t.Hour(), t.Minute(), 0, 0, now.Location())
+	if !next.After(now) {
+		next = next.AddDate(0, 0, 1)
+	}
+	return next, nil
+}
+
+func currentAlarm() (AlarmTime, error) {
+	var alarmTime AlarmTime
+	err := db.QueryRow("SELECT time, armed FROM alarm_time ORDER BY id DESC LIMIT 1").
+		Scan(&alarmTime.Time, &alarmTime.Armed)
+	alarmTime.Configured = err == nil
+	return alarmTime, err
+}
+
+// setAlarmArmed keeps the alarm time and arms or disarms it.
+func setAlarmArmed(ctx context.Context, armed bool) (AlarmTime, error) {
+	alarmTime, err := currentAlarm()
+	if err != nil {
+		return alarmTime, err
+	}
+	alarmTime.Armed = armed
+	if _, err := db.ExecContext(ctx, "INSERT INTO alarm_time (time, armed) VALUES ($1, $2)", alarmTime.Time, armed); err != nil {
+		return alarmTime, err
+	}
+	publish(EventAlarmChanged, alarmTime)
+	return alarmTime, nil
+}
+
+// nextAlarmDate is the date of the next ring of the current alarm.
+func nextAlarmDate(now time.Time) (string, error) {
+	alarmTime, err := currentAlarm()
+	if err != nil {
+		return "", err
+	}
+	next, err := nextAlarmAt(alarmTime.Time, now)
+	if err != nil {
+		return "", err
+	}
+	return next.Format("2006-01-02"), nil
+}
+
+func loadAlarmSkip(date string) (AlarmSkip, error) {
+	skip := AlarmSkip{AlarmDate: date}
+	err := db.QueryRow("SELECT skip, reason, manual FROM alarm_skips WHERE alarm_date = $1", date).
+		Scan(&skip.Skip, &skip.Reason, &skip.Manual)
+	if err == sql.ErrNoRows {
+		return skip, nil
+	}
+	return skip, err
+}
+
+func saveAlarmSkip(skip AlarmSkip) error {
+	_, err := db.Exec(`
+		INSERT INTO alarm_skips (alarm_date, skip, reason, manual, updated_at)
+		VALUES ($1, $2, $3, $4, $5)
+		ON CONFLICT (alarm_date) DO UPDATE
+		SET skip = EXCLUDED.skip, reason = EXCLUDED.reason, manual = EXCLUDED.manual, updated_at = EXCLUDED.updated_at
+	`, skip.AlarmDate, skip.Skip, skip.Reason, skip.Manual, time.Now())
+	return err
+}
+
+// nextAlarmSkipped reports whether the upcoming alarm ring is skipped.
+func nextAlarmSkipped(now time.Time) (bool, error) {
+	date, err := nextAlarmDate(now)
+	if err == sql.ErrNoRows {
+		return false, nil
+	} else if err != nil {
+		return false, err
+	}
+	skip, err := loadAlarmSkip(date)
+	return skip.Skip, err
+}
+
+func getAlarmSkip(c echo.Context) error {
+	date, err := nextAlarmDate(time.Now())
+	if err == sql.ErrNoRows {
+		return apiErrorCode(c, http.StatusNotFound, codeNoAlarm, "no alarm is set")
+	} else if err != nil {
+		return internalError(c, err)
+	}
+
+	skip, err := loadAlarmSkip(date)
+	if err != nil {
+		return internalError(c, err)
+	}
+	return c.JSON(http.StatusOK, skip)
+}
+
+// setAlarmSkip manually skips or un-skips the next alarm, overriding any
+// automatic decision.
+func setAlarmSkip(c echo.Context) error {
+	var req struct {
+		Skip bool `json:"skip"`
+	}
+	if err := c.Bind(&req); err != nil {
+		return invalidBody(c, err)
+	}
+
+	date, err := nextAlarmDate(time.Now())
+	if err == sql.ErrNoRows {
+		return apiErrorCode(c, http.StatusNotFound, codeNoAlarm, "no alarm is set")
+	} else if err != nil {
+		return internalError(c, err)
+	}
+
+	skip := AlarmSkip{AlarmDate: date, Skip: req.Skip, Reason: "manual override", Manual: true}
+	if err := saveAlarmSkip(skip); err != nil {
+		return internalError(c, err)
+	}
+	publish(EventAlarmChanged, skip)
+	return c.JSON(http.StatusOK, skip)
+}
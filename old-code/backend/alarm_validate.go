@@ -0,0 +1,118 @@
+package main
+
+import (
+	"database/sql"
+	"math"
+	"net/http"
+	"time"
+
+	"github.com/labstack/echo/v4"
+)
+
+// Setting the alarm is checked for the mistakes that are easy to make on a
+// phone at night. POST /api/alarm answers with "warnings", each a stable
+// code and a message for people:
+//
+//   - duplicate: the alarm is already armed for that time; nothing changes
+//   - soon: it would ring within alarmSoonWindow
+//   - skipped: its next ring falls on a skipped day (a holiday, everyone
+//     away, see alarm_skip.go), so it stays silent until the skip ends
+//
+// soon and skipped need "confirm": true in the request; without it the
+// alarm is not stored and the answer is a 428 confirmation_required with
+// the warnings. POST /api/alarm/validate checks a time without storing it.
+
+const alarmSoonWindow = 10 * time.Minute
+
+type AlarmWarning struct {
+	Code              string `json:"code"` // duplicate | soon | skipped
+	Message           string `json:"message"`
+	NeedsConfirmation bool   `json:"needs_confirmation"`
+}
+
+// parseAlarmTime normalizes an HH:MM alarm time, e.g. 7:05 to 07:05.
+func parseAlarmTime(s string) (string, bool) {
+	t, err := time.Parse("15:04", s)
+	if err != nil {
+		return "", false
+	}
+	return t.Format("15:04"), true
+}
+
+// alarmWarnings checks an alarm time, already normalized, set at now.
+func alarmWarnings(lang, alarm string, now time.Time) ([]AlarmWarning, error) {
+	warnings := []AlarmWarning{}
+	current, err := currentAlarm()
+	if err != nil && err != sql.ErrNoRows {
+		return nil, err
+	}
+	if current.Configured && current.Armed && current.Time == alarm {
+		warnings = append(warnings, AlarmWarning{Code: "duplicate",
+			Message: translatef(lang, "The alarm is already set for %s", alarm)})
+	}
+
+	next, err := nextAlarmAt(alarm, now)
+	if err != nil {
+		return nil, err
+	}
+	if until := next.Sub(now); until < alarmSoonWindow {
+		warnings = append(warnings, AlarmWarning{Code: "soon", NeedsConfirmation: true,
+			Message: translatef(lang, "The alarm would ring in %d minutes", int(math.Ceil(until.Minutes())))})
+	}
+
+	skips, err := calendarSkips(next.Format("2006-01-02"))
+	if err != nil {
+		return nil, err
+	}
+	if _, skipped := skips[next.Format("2006-01-02")]; skipped {
+		ring := next
+		for i := 0; i < 366; i++ {
+			if _, ok := skips[ring.Format("2006-01-02")]; !ok {
+				break
+			}
+			ring = ring.AddDate(0, 0, 1)
+		}
+		warnings = append(warnings, AlarmWarning{Code: "skipped", NeedsConfirmation: true,
+			Message: translatef(lang, "The alarm is off on %s and rings next on %s", formatDay(lang, next), formatDay(lang, ring))})
+	}
+	return warnings, nil
+}
+
+func needsConfirmation(warnings []AlarmWarning) bool {
+	for _, w := range warnings {
+		if w.NeedsConfirmation {
+			return true
+		}
+	}
+	return false
+}
+
+// validateAlarmTime returns the warnings of {"time": "06:30"} and when the
+// alarm would ring.
+func validateAlarmTime(c echo.Context) error {
+	var req struct {
+		Time string `json:"time"`
+	}
+	if err := c.Bind(&req); err != nil {
+		return invalidBody(c, err)
+	}
+	alarm, ok := parseAlarmTime(req.Time)
+	if !ok {
+		return apiError(c, http.StatusBadRequest, "time must be HH:MM")
+	}
+	now := time.Now()
+	warnings, err := alarmWarnings(requestLanguage(c), alarm, now)
+	if err != nil {
+		return internalError(c, err)
+	}
+	next, err := nextAlarmAt(alarm, now)
+	if err != nil {
+		return internalError(c, err)
+	}
+	return c.JSON(http.StatusOK, map[string]interface{}{
+		"time":               alarm,
+		"next_ring":          next,
+		"warnings":           warnings,
+		"needs_confirmation": needsConfirmation(warnings),
+	})
+}
@@ -0,0 +1,235 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"slices"
+	"time"
+
+	"github.com/labstack/echo/v4"
+)
+
+// Alert routing decides which channels a notification goes to from what it
+// is about (its event), its severity and the time of day. PUT
+// /api/alerts/routing replaces the routes, e.g.
+//
+//	{"routes": [
+//	  {"severity": "critical", "channels": ["sms", "ntfy", "webpush"]},
+//	  {"severity": "warning", "when": "outside_quiet_hours", "channels": ["ntfy", "webpush"]},
+//	  {"severity": "info", "channels": ["digest"]}
+//	]}
+//
+// Severity follows the priority: 5 is critical, 4 warning and anything
+// lower info. A route matches a notification when its event and severity
+// match, or are left empty; the first matching route whose "when" holds
+// (anytime, quiet_hours, outside_quiet_hours or an HH:MM-HH:MM range)
+// picks the channels. A notification that matches routes but none of
+// their times, or a route without channels, is not sent. Without a
+// matching route the priorities and quiet hours of notify() apply.
+//
+// The "digest" channel keeps the notification for the weekly report
+// (reports.go) instead of sending it.
+
+const (
+	digestChannel   = "digest"
+	maxAlertRoutes  = 50
+	digestRetention = 8 * 7 * 24 * time.Hour
+)
+
+// notificationEvents are the events notifications are raised for.
+var notificationEvents = []string{
+	"alarm", "rule", "device.offline", "device.rebooted", "ventilation", "noise", "mold", "backup", "server", "report",
+}
+
+var alertSeverities = []string{"critical", "warning", "info"}
+
+type AlertRoute struct {
+	Event    string   `json:"event,omitempty"`    // any when empty
+	Severity string   `json:"severity,omitempty"` // critical | warning | info; any when empty
+	When     string   `json:"when,omitempty"`     // anytime | quiet_hours | outside_quiet_hours | HH:MM-HH:MM
+	Channels []string `json:"channels"`
+}
+
+type AlertRouting struct {
+	Routes    []AlertRoute `json:"routes"`
+	UpdatedAt *time.Time   `json:"updated_at,omitempty"`
+}
+
+// DigestItem is a notification kept for the weekly report.
+type DigestItem struct {
+	At       time.Time `json:"at"`
+	Event    string    `json:"event,omitempty"`
+	Severity string    `json:"severity"`
+	Title    string    `json:"title"`
+	Message  string    `json:"message"`
+}
+
+func notificationSeverity(priority int) string {
+	switch {
+	case priority >= 5:
+		return "critical"
+	case priority == 4:
+		return "warning"
+	}
+	return "info"
+}
+
+func (r AlertRoute) holds(now time.Time) bool {
+	switch r.When {
+	case "", "anytime":
+		return true
+	case "quiet_hours":
+		return inClockRange("quiet_hours", now)
+	case "outside_quiet_hours":
+		return !inClockRange("quiet_hours", now)
+	}
+	return clockRangeContains(r.When, now)
+}
+
+func loadAlertRouting(ctx context.Context) (AlertRouting, error) {
+	r := AlertRouting{Routes: []AlertRoute{}}
+	var routes string
+	var updated time.Time
+	err := db.QueryRowContext(ctx, "SELECT routes::text, updated_at FROM alert_routing ORDER BY id DESC LIMIT 1").
+		Scan(&routes, &updated)
+	if err == sql.ErrNoRows {
+		return r, nil
+	}
+	if err != nil {
+		return r, err
+	}
+	r.UpdatedAt = &updated
+	return r, json.Unmarshal([]byte(routes), &r.Routes)
+}
+
+// routeNotification returns the channels of a notification and whether a
+// route matched it at all. Routing that cannot be loaded is logged and
+// left out.
+func routeNotification(event string, priority int, now time.Time) ([]string, bool) {
+	routing, err := loadAlertRouting(context.Background())
+	if err != nil {
+		log.Printf("Loading the alert routing failed: %v", err)
+		return nil, false
+	}
+	severity := notificationSeverity(priority)
+	matched := false
+	for _, r := range routing.Routes {
+		if r.Event != "" && r.Event != event || r.Severity != "" && r.Severity != severity {
+			continue
+		}
+		matched = true
+		if r.holds(now) {
+			return r.Channels, true
+		}
+	}
+	return nil, matched
+}
+
+func addToDigest(n Notification, priority int, now time.Time) error {
+	_, err := db.Exec(`
+		INSERT INTO notification_digest (at, event, severity, title, message) VALUES ($1, $2, $3, $4, $5)
+	`, now, n.Event, notificationSeverity(priority), n.Title, n.Message)
+	return err
+}
+
+// loadDigest returns the notifications kept between from and to, oldest
+// first, and prunes those past digestRetention.
+func loadDigest(ctx context.Context, from, to time.Time) ([]DigestItem, error) {
+	if _, err := db.ExecContext(ctx, "DELETE FROM notification_digest WHERE at < $1", to.Add(-digestRetention)); err != nil {
+		return nil, err
+	}
+	rows, err := db.QueryContext(ctx, `
+		SELECT at, event, severity, title, message FROM notification_digest
+		WHERE at >= $1 AND at < $2 ORDER BY at
+	`, from, to)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	items := []DigestItem{}
+	for rows.Next() {
+		var d DigestItem
+		if err := rows.Scan(&d.At, &d.Event, &d.Severity, &d.Title, &d.Message); err != nil {
+			return nil, err
+		}
+		items = append(items, d)
+	}
+	return items, rows.Err()
+}
+
+func validateAlertRoute(r AlertRoute) error {
+	if r.Event != "" && !slices.Contains(notificationEvents, r.Event) {
+		return fmt.Errorf("unknown event %q", r.Event)
+	}
+	if r.Severity != "" && !slices.Contains(alertSeverities, r.Severity) {
+		return fmt.Errorf("severity must be critical, warning or info")
+	}
+	switch r.When {
+	case "", "anytime", "quiet_hours", "outside_quiet_hours":
+	default:
+		if _, _, err := parseClockRange(r.When); err != nil {
+			return fmt.Errorf("when must be anytime, quiet_hours, outside_quiet_hours or HH:MM-HH:MM")
+		}
+	}
+	for _, ch := range r.Channels {
+		if ch != digestChannel && !slices.Contains(notifyChannelNames, ch) {
+			return fmt.Errorf("unknown channel %q", ch)
+		}
+	}
+	return nil
+}
+
+// getAlertRouting returns the routes with the events, severities and
+// channels they can use.
+func getAlertRouting(c echo.Context) error {
+	routing, err := loadAlertRouting(c.Request().Context())
+	if err != nil {
+		return internalError(c, err)
+	}
+	return c.JSON(http.StatusOK, map[string]interface{}{
+		"routes":     routing.Routes,
+		"updated_at": routing.UpdatedAt,
+		"events":     notificationEvents,
+		"severities": alertSeverities,
+		"channels":   append(slices.Clone(notifyChannelNames), digestChannel),
+	})
+}
+
+// putAlertRouting replaces the routes; {"routes": []} goes back to routing
+// by priority alone.
+func putAlertRouting(c echo.Context) error {
+	var req AlertRouting
+	if err := c.Bind(&req); err != nil {
+		return invalidBody(c, err)
+	}
+	if len(req.Routes) > maxAlertRoutes {
+		return apiError(c, http.StatusBadRequest, fmt.Sprintf("at most %d routes", maxAlertRoutes))
+	}
+	if req.Routes == nil {
+		req.Routes = []AlertRoute{}
+	}
+	for i, r := range req.Routes {
+		if err := validateAlertRoute(r); err != nil {
+			return apiError(c, http.StatusBadRequest, fmt.Sprintf("route %d: %v", i+1, err))
+		}
+		if r.Channels == nil {
+			req.Routes[i].Channels = []string{}
+		}
+	}
+	routes, err := json.Marshal(req.Routes)
+	if err != nil {
+		return internalError(c, err)
+	}
+	now := time.Now()
+	_, err = db.ExecContext(c.Request().Context(),
+		"INSERT INTO alert_routing (routes, updated_at) VALUES ($1, $2)", string(routes), now)
+	if err != nil {
+		return internalError(c, err)
+	}
+	req.UpdatedAt = &now
+	return c.JSON(http.StatusOK, req)
+}
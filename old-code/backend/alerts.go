@@ -0,0 +1,272 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/labstack/echo/v4"
+)
+
+// A rule that matches opens an alert, which goes through
+//
+//	firing -> acknowledged -> resolved
+//
+// A firing alert is notified when it opens and again every cooldown while it
+// keeps firing; acknowledging it stops the repeats. The alert resolves on
+// its own once the rule's condition clears in the room it fired in. A rule
+// has at most one open (firing or acknowledged) alert per room, so readings
+// from other rooms neither resolve nor renotify it.
+
+const (
+	AlertFiring       = "firing"
+	AlertAcknowledged = "acknowledged"
+	AlertResolved     = "resolved"
+)
+
+type Alert struct {
+	ID             int        `json:"id"`
+	RuleID         *int       `json:"rule_id"`
+	RuleName       string     `json:"rule_name"`
+	Metric         string     `json:"metric"`
+	Room           string     `json:"room"`
+	State          string     `json:"state"`
+	Value          float64    `json:"value"`
+	PeakValue      float64    `json:"peak_value"`
+	FiredAt        time.Time  `json:"fired_at"`
+	AcknowledgedAt *time.Time `json:"acknowledged_at,omitempty"`
+	ResolvedAt     *time.Time `json:"resolved_at,omitempty"`
+	LastNotifiedAt time.Time  `json:"last_notified_at"`
+	Notifications  int        `json:"notifications"`
+}
+
+const alertColumns = `id, rule_id, rule_name, metric, room, state, value, peak_value, fired_at,
+	acknowledged_at, resolved_at, last_notified_at, notifications`
+
+func scanAlert(row interface{ Scan(...interface{}) error }) (Alert, error) {
+	var a Alert
+	var ruleID sql.NullInt64
+	var ackedAt, resolvedAt sql.NullTime
+	err := row.Scan(&a.ID, &ruleID, &a.RuleName, &a.Metric, &a.Room, &a.State, &a.Value, &a.PeakValue, &a.FiredAt,
+		&ackedAt, &resolvedAt, &a.LastNotifiedAt, &a.Notifications)
+	if ruleID.Valid {
+		id := int(ruleID.Int64)
+		a.RuleID = &id
+	}
+	if ackedAt.Valid {
+		a.AcknowledgedAt = &ackedAt.Time
+	}
+	if resolvedAt.Valid {
+		a.ResolvedAt = &resolvedAt.Time
+	}
+	return a, err
+}
+
+// alertsMu serialises rule evaluation so concurrent device updates cannot
+// open the same alert twice.
+var alertsMu sync.Mutex
+
+func openAlert(ruleID int, room string) (Alert, bool, error) {
+	a, err := scanAlert(db.QueryRow(`SELECT `+alertColumns+` FROM alerts
+		WHERE rule_id = $1 AND room = $2 AND state != 'resolved'`, ruleID, room))
+	if err == sql.ErrNoRows {
+		return a, false, nil
+	}
+	return a, err == nil, err
+}
+
+// Steps updateAlert takes for a new value of a rule's metric.
+const (
+	alertUnchanged = iota
+	alertOpen
+	alertUpdate   // still matching, no notification due
+	alertRenotify // still firing past the cooldown
+	alertResolve
+)
+
+// nextAlertStep decides what a new value does to a, the rule's open alert
+// in the room if open is set.
+func nextAlertStep(r Rule, a Alert, open, matches bool, now time.Time) int {
+	switch {
+	case matches && !open:
+		return alertOpen
+	case matches && a.State == AlertFiring && now.Sub(a.LastNotifiedAt) >= time.Duration(r.CooldownSeconds)*time.Second:
+		return alertRenotify
+	case matches:
+		return alertUpdate
+	case open:
+		return alertResolve
+	}
+	return alertUnchanged
+}
+
+// alertTitle names the rule, and the room for alerts raised in one.
+func alertTitle(r Rule, room string) string {
+	if room == "" {
+		return r.Name
+	}
+	return r.Name + " (" + room + ")"
+}
+
+// updateAlert moves the rule's alert in room along for a new value of its
+// metric there.
+func updateAlert(r Rule, room string, readings map[string]float64, matches bool, now time.Time) error {
+	value := readings[r.Metric]
+	a, open, err := openAlert(r.ID, room)
+	if err != nil {
+		return err
+	}
+	unit, err := metricUnit(context.Background(), r.Metric)
+	if err != nil {
+		return err
+	}
+
+	step := nextAlertStep(r, a, open, matches, now)
+	switch step {
+	case alertOpen:
+		a, err = scanAlert(db.QueryRow(`
+			INSERT INTO alerts (rule_id, rule_name, metric, room, state, value, peak_value, fired_at, last_notified_at, notifications)
+			VALUES ($1, $2, $3, $4, 'firing', $5, $5, $6, $6, 1)
+			RETURNING `+alertColumns, r.ID, r.Name, r.Metric, room, value, now))
+		if err != nil {
+			return err
+		}
+		publish(EventRuleTriggered, map[string]interface{}{"rule": r, "value": value, "alert": a})
+		publish(EventAlertChanged, a)
+		notify(Notification{
+			Event:    "rule",
+			Title:    alertTitle(r, room),
+			Message:  fmt.Sprintf("%s is %s (%s %s)", r.Metric, formatWithUnit(value, unit), r.Operator, formatWithUnit(r.Threshold, unit)),
+			Priority: r.Priority,
+			Tags:     []string{"warning"},
+			Readings: readings,
+			Channels: r.Channels,
+			Chart:    r.Metric,
+		})
+
+	case alertUpdate, alertRenotify:
+		peak := a.PeakValue
+		if r.Operator == ">" && value > peak || r.Operator == "<" && value < peak {
+			peak = value
+		}
+		renotify := step == alertRenotify
+		lastNotified := a.LastNotifiedAt
+		if renotify {
+			lastNotified = now
+			a.Notifications++
+		}
+		_, err = db.Exec(`
+			UPDATE alerts SET value = $2, peak_value = $3, last_notified_at = $4, notifications = $5 WHERE id = $1
+		`, a.ID, value, peak, lastNotified, a.Notifications)
+		if err != nil {
+			return err
+		}
+		if renotify {
+			publish(EventRuleTriggered, map[string]interface{}{"rule": r, "value": value, "alert": a})
+			notify(Notification{
+				Event: "rule",
+				Title: alertTitle(r, room),
+				Message: fmt.Sprintf("%s is still %s (%s %s) since %s", r.Metric, formatWithUnit(value, unit),
+					r.Operator, formatWithUnit(r.Threshold, unit), a.FiredAt.Format("15:04")),
+				Priority: r.Priority,
+				Tags:     []string{"warning"},
+				Readings: readings,
+				Channels: r.Channels,
+				Chart:    r.Metric,
+			})
+		}
+
+	case alertResolve:
+		a, err = scanAlert(db.QueryRow(`
+			UPDATE alerts SET state = 'resolved', value = $2, resolved_at = $3 WHERE id = $1
+			RETURNING `+alertColumns, a.ID, value, now))
+		if err != nil {
+			return err
+		}
+		publish(EventAlertChanged, a)
+		notify(Notification{
+			Event:    "rule",
+			Title:    alertTitle(r, room) + " resolved",
+			Message:  fmt.Sprintf("%s is back to %s after %s", r.Metric, formatWithUnit(value, unit), now.Sub(a.FiredAt).Round(time.Minute)),
+			Priority: 2,
+			Tags:     []string{"white_check_mark"},
+			Readings: readings,
+			Channels: r.Channels,
+		})
+	}
+	return nil
+}
+
+// getAlerts lists alerts, newest first. ?state= filters by state, or "open"
+// for firing and acknowledged ones; ?limit= defaults to 100.
+func getAlerts(c echo.Context) error {
+	limit := 100
+	if l := c.QueryParam("limit"); l != "" {
+		n, err := strconv.Atoi(l)
+		if err != nil || n <= 0 {
+			return apiError(c, http.StatusBadRequest, "invalid limit")
+		}
+		limit = n
+	}
+	state := c.QueryParam("state")
+	switch state {
+	case "", "open", AlertFiring, AlertAcknowledged, AlertResolved:
+	default:
+		return apiError(c, http.StatusBadRequest, "state must be open, firing, acknowledged or resolved")
+	}
+
+	rows, err := db.Query(`SELECT `+alertColumns+` FROM alerts
+		WHERE $1 = '' OR state = $1 OR ($1 = 'open' AND state != 'resolved')
+		ORDER BY fired_at DESC
+		LIMIT $2`, state, limit)
+	if err != nil {
+		return internalError(c, err)
+	}
+	defer rows.Close()
+
+	alerts := []Alert{}
+	for rows.Next() {
+		a, err := scanAlert(rows)
+		if err != nil {
+			return internalError(c, err)
+		}
+		alerts = append(alerts, a)
+	}
+
+	return c.JSON(http.StatusOK, alerts)
+}
+
+func ackAlert(c echo.Context) error {
+	id, err := strconv.Atoi(c.Param("id"))
+	if err != nil {
+		return apiError(c, http.StatusBadRequest, "invalid alert id")
+	}
+
+	alertsMu.Lock()
+	defer alertsMu.Unlock()
+	a, err := scanAlert(db.QueryRow(`SELECT `+alertColumns+` FROM alerts WHERE id = $1`, id))
+	if err == sql.ErrNoRows {
+		return apiError(c, http.StatusNotFound, "alert not found")
+	} else if err != nil {
+		return internalError(c, err)
+	}
+	if a.State != AlertFiring {
+		return apiError(c, http.StatusConflict, "alert is "+a.State)
+	}
+
+	a, err = scanAlert(db.QueryRow(`
+		UPDATE alerts SET state = 'acknowledged', acknowledged_at = $2 WHERE id = $1
+		RETURNING `+alertColumns, id, time.Now()))
+	if err != nil {
+		return internalError(c, err)
+	}
+	log.Printf("Alert %d (%s) acknowledged", a.ID, a.RuleName)
+	publish(EventAlertChanged, a)
+
+	return c.JSON(http.StatusOK, a)
+}
@@ -0,0 +1,49 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestNextAlertStep(t *testing.T) {
+	now := time.Date(2026, 1, 10, 8, 0, 0, 0, time.UTC)
+	r := Rule{ID: 1, Name: "CO2 high", Metric: "co2", Operator: ">", Threshold: 1200, CooldownSeconds: 1800}
+	firing := Alert{State: AlertFiring, FiredAt: now.Add(-time.Hour), LastNotifiedAt: now.Add(-10 * time.Minute)}
+	due := firing
+	due.LastNotifiedAt = now.Add(-30 * time.Minute)
+	acked := due
+	acked.State = AlertAcknowledged
+
+	tests := []struct {
+		name    string
+		a       Alert
+		open    bool
+		matches bool
+		want    int
+	}{
+		{"quiet", Alert{}, false, false, alertUnchanged},
+		{"starts matching", Alert{}, false, true, alertOpen},
+		{"within the cooldown", firing, true, true, alertUpdate},
+		{"cooldown over", due, true, true, alertRenotify},
+		{"acknowledged past the cooldown", acked, true, true, alertUpdate},
+		{"clears", firing, true, false, alertResolve},
+		{"acknowledged clears", acked, true, false, alertResolve},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := nextAlertStep(r, tt.a, tt.open, tt.matches, now); got != tt.want {
+				t.Errorf("nextAlertStep = %d, want %d", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestAlertTitle(t *testing.T) {
+	r := Rule{Name: "CO2 high"}
+	if got := alertTitle(r, ""); got != "CO2 high" {
+		t.Errorf("alertTitle without a room = %q", got)
+	}
+	if got := alertTitle(r, "bedroom"); got != "CO2 high (bedroom)" {
+		t.Errorf("alertTitle in bedroom = %q", got)
+	}
+}
@@ -0,0 +1,271 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"log"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/labstack/echo/v4"
+)
+
+// POST /api/alexa implements the Alexa Smart Home API. Smart home skills
+// only call AWS Lambda, so the skill's Lambda forwards each directive
+// unchanged as the request body and returns the response. Linking uses
+// /api/oauth (see linking.go) with ALEXA_CLIENT_ID and ALEXA_CLIENT_SECRET.
+//
+// Discovery reports one air quality monitor per room, named after the room,
+// with its CO2 and noise level as read-only range controllers ("Alexa,
+// what's the CO2 in the bedroom?"), and the alarm as a switch named
+// ALEXA_ALARM_NAME that arms and disarms it.
+
+type alexaHeader struct {
+	Namespace        string `json:"namespace"`
+	Name             string `json:"name"`
+	PayloadVersion   string `json:"payloadVersion"`
+	MessageID        string `json:"messageId"`
+	CorrelationToken string `json:"correlationToken,omitempty"`
+}
+
+type alexaScope struct {
+	Type  string `json:"type"`
+	Token string `json:"token"`
+}
+
+type alexaEndpointRef struct {
+	Scope      *alexaScope `json:"scope,omitempty"`
+	EndpointID string      `json:"endpointId"`
+}
+
+type alexaRequest struct {
+	Directive struct {
+		Header   alexaHeader       `json:"header"`
+		Endpoint *alexaEndpointRef `json:"endpoint"`
+		Payload  struct {
+			Scope *alexaScope `json:"scope"`
+		} `json:"payload"`
+	} `json:"directive"`
+}
+
+type alexaProperty struct {
+	Namespace    string      `json:"namespace"`
+	Instance     string      `json:"instance,omitempty"`
+	Name         string      `json:"name"`
+	Value        interface{} `json:"value"`
+	TimeOfSample time.Time   `json:"timeOfSample"`
+	Uncertainty  int64       `json:"uncertaintyInMilliseconds"`
+}
+
+const alexaAlarmEndpoint = "alarm"
+
+func alexaCapability(iface string, extra map[string]interface{}) map[string]interface{} {
+	c := map[string]interface{}{"type": "AlexaInterface", "interface": iface, "version": "3"}
+	for k, v := range extra {
+		c[k] = v
+	}
+	return c
+}
+
+func alexaFriendlyNames(names ...string) map[string]interface{} {
+	var list []interface{}
+	for _, n := range names {
+		list = append(list, map[string]interface{}{
+			"@type": "text", "value": map[string]string{"text": n, "locale": "en-US"},
+		})
+	}
+	return map[string]interface{}{"friendlyNames": list}
+}
+
+// alexaRange is a read-only range controller for a reading.
+func alexaRange(instance string, maximum float64, unit string, names ...string) map[string]interface{} {
+	config := map[string]interface{}{
+		"supportedRange": map[string]float64{"minimumValue": 0, "maximumValue": maximum, "precision": 1},
+	}
+	if unit != "" {
+		config["unitOfMeasure"] = unit
+	}
+	return alexaCapability("Alexa.RangeController", map[string]interface{}{
+		"instance":            instance,
+		"properties":          map[string]interface{}{"supported": []map[string]string{{"name": "rangeValue"}}, "retrievable": true, "nonControllable": true},
+		"capabilityResources": alexaFriendlyNames(names...),
+		"configuration":       config,
+	})
+}
+
+func alexaHealth() map[string]interface{} {
+	return alexaCapability("Alexa.EndpointHealth", map[string]interface{}{
+		"properties": map[string]interface{}{"supported": []map[string]string{{"name": "connectivity"}}, "retrievable": true},
+	})
+}
+
+func alexaDiscover(ctx context.Context) ([]interface{}, error) {
+	rooms, err := roomReadings(ctx, time.Now())
+	if err != nil {
+		return nil, err
+	}
+	endpoints := []interface{}{map[string]interface{}{
+		"endpointId":        alexaAlarmEndpoint,
+		"manufacturerName":  "home-server",
+		"friendlyName":      envString("ALEXA_ALARM_NAME", "Alarm"),
+		"description":       "Wake-up alarm",
+		"displayCategories": []string{"SWITCH"},
+		"capabilities": []interface{}{
+			alexaCapability("Alexa", nil),
+			alexaCapability("Alexa.PowerController", map[string]interface{}{
+				"properties": map[string]interface{}{"supported": []map[string]string{{"name": "powerState"}}, "retrievable": true},
+			}),
+		},
+	}}
+	for _, r := range rooms {
+		endpoints = append(endpoints, map[string]interface{}{
+			"endpointId":        roomEndpointID(r.Room),
+			"manufacturerName":  "home-server",
+			"friendlyName":      r.Room,
+			"description":       "Air quality and noise in the " + r.Room,
+			"displayCategories": []string{"AIR_QUALITY_MONITOR"},
+			"capabilities": []interface{}{
+				alexaCapability("Alexa", nil),
+				alexaRange("Air.CO2", 5000, "Alexa.Unit.PartsPerMillion", "CO2", "carbon dioxide", "air quality"),
+				alexaRange("Noise.Level", 130, "", "noise", "noise level", "sound level"),
+				alexaHealth(),
+			},
+		})
+	}
+	return endpoints, nil
+}
+
+// alexaState returns the properties of an endpoint, or nil if there is no
+// such endpoint.
+func alexaState(ctx context.Context, endpointID string) ([]alexaProperty, error) {
+	now := time.Now()
+	if endpointID == alexaAlarmEndpoint {
+		alarm, err := currentAlarm()
+		if err != nil && err != sql.ErrNoRows {
+			return nil, err
+		}
+		power := "OFF"
+		if alarm.Armed {
+			power = "ON"
+		}
+		return []alexaProperty{{Namespace: "Alexa.PowerController", Name: "powerState", Value: power, TimeOfSample: now}}, nil
+	}
+
+	rooms, err := roomReadings(ctx, now)
+	if err != nil {
+		return nil, err
+	}
+	for _, r := range rooms {
+		if roomEndpointID(r.Room) != endpointID {
+			continue
+		}
+		connectivity := "UNREACHABLE"
+		if r.Online {
+			connectivity = "OK"
+		}
+		sampled := r.LastSeen
+		if sampled.IsZero() {
+			sampled = now
+		}
+		return []alexaProperty{
+			{Namespace: "Alexa.RangeController", Instance: "Air.CO2", Name: "rangeValue", Value: r.CO2, TimeOfSample: sampled},
+			{Namespace: "Alexa.RangeController", Instance: "Noise.Level", Name: "rangeValue", Value: r.Sound, TimeOfSample: sampled},
+			{Namespace: "Alexa.EndpointHealth", Name: "connectivity", Value: map[string]string{"value": connectivity}, TimeOfSample: now},
+		}, nil
+	}
+	return nil, nil
+}
+
+func alexaEvent(req alexaRequest, namespace, name string, payload interface{}, properties []alexaProperty) map[string]interface{} {
+	header := alexaHeader{
+		Namespace:        namespace,
+		Name:             name,
+		PayloadVersion:   "3",
+		MessageID:        randomHex(16),
+		CorrelationToken: req.Directive.Header.CorrelationToken,
+	}
+	event := map[string]interface{}{"header": header, "payload": payload}
+	if ep := req.Directive.Endpoint; ep != nil {
+		event["endpoint"] = alexaEndpointRef{Scope: ep.Scope, EndpointID: ep.EndpointID}
+	}
+	resp := map[string]interface{}{"event": event}
+	if properties != nil {
+		resp["context"] = map[string]interface{}{"properties": properties}
+	}
+	return resp
+}
+
+func alexaError(req alexaRequest, kind, message string) map[string]interface{} {
+	return alexaEvent(req, "Alexa", "ErrorResponse", map[string]string{"type": kind, "message": message}, nil)
+}
+
+// Alexa expects every outcome, errors too, as a 200 response.
+func handleAlexa(c echo.Context) error {
+	var req alexaRequest
+	if err := c.Bind(&req); err != nil {
+		return invalidBody(c, err)
+	}
+	d := req.Directive
+	ctx := c.Request().Context()
+
+	scope := d.Payload.Scope
+	if d.Endpoint != nil && d.Endpoint.Scope != nil {
+		scope = d.Endpoint.Scope
+	}
+	if d.Header.Namespace == "Alexa.Authorization" && d.Header.Name == "AcceptGrant" {
+		// Nothing is reported proactively, so the grant is not needed
+		return c.JSON(http.StatusOK, alexaEvent(req, "Alexa.Authorization", "AcceptGrant.Response", struct{}{}, nil))
+	}
+	var session *Session
+	if scope != nil {
+		session = linkedSession(scope.Token, "alexa")
+	}
+	if session == nil {
+		return c.JSON(http.StatusOK, alexaError(req, "INVALID_AUTHORIZATION_CREDENTIAL", "the account link is invalid or has expired"))
+	}
+
+	switch d.Header.Namespace + "." + d.Header.Name {
+	case "Alexa.Discovery.Discover":
+		endpoints, err := alexaDiscover(ctx)
+		if err != nil {
+			log.Printf("Alexa discovery failed: %v", err)
+			return c.JSON(http.StatusOK, alexaError(req, "INTERNAL_ERROR", "internal error"))
+		}
+		return c.JSON(http.StatusOK, alexaEvent(req, "Alexa.Discovery", "Discover.Response",
+			map[string]interface{}{"endpoints": endpoints}, nil))
+
+	case "Alexa.ReportState":
+		if d.Endpoint == nil {
+			return c.JSON(http.StatusOK, alexaError(req, "INVALID_DIRECTIVE", "no endpoint"))
+		}
+		properties, err := alexaState(ctx, d.Endpoint.EndpointID)
+		if err != nil {
+			log.Printf("Alexa state report failed: %v", err)
+			return c.JSON(http.StatusOK, alexaError(req, "INTERNAL_ERROR", "internal error"))
+		}
+		if properties == nil {
+			return c.JSON(http.StatusOK, alexaError(req, "NO_SUCH_ENDPOINT", "unknown endpoint"))
+		}
+		return c.JSON(http.StatusOK, alexaEvent(req, "Alexa", "StateReport", struct{}{}, properties))
+
+	case "Alexa.PowerController.TurnOn", "Alexa.PowerController.TurnOff":
+		if d.Endpoint == nil || d.Endpoint.EndpointID != alexaAlarmEndpoint {
+			return c.JSON(http.StatusOK, alexaError(req, "NO_SUCH_ENDPOINT", "only the alarm can be switched"))
+		}
+		if session.Role != "admin" {
+			return c.JSON(http.StatusOK, alexaError(req, "INVALID_AUTHORIZATION_CREDENTIAL", "read-only access"))
+		}
+		alarm, err := setAlarmArmed(ctx, strings.HasSuffix(d.Header.Name, "On"))
+		if err == sql.ErrNoRows {
+			return c.JSON(http.StatusOK, alexaError(req, "NOT_SUPPORTED_IN_CURRENT_MODE", "no alarm is set"))
+		} else if err != nil {
+			log.Printf("Alexa failed to switch the alarm: %v", err)
+			return c.JSON(http.StatusOK, alexaError(req, "INTERNAL_ERROR", "internal error"))
+		}
+		log.Printf("Alarm %s armed=%t by %s via Alexa", alarm.Time, alarm.Armed, session.Subject)
+		properties, _ := alexaState(ctx, alexaAlarmEndpoint)
+		return c.JSON(http.StatusOK, alexaEvent(req, "Alexa", "Response", struct{}{}, properties))
+	}
+	return c.JSON(http.StatusOK, alexaError(req, "INVALID_DIRECTIVE", "unsupported directive "+d.Header.Namespace+"."+d.Header.Name))
+}
@@ -0,0 +1,141 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/labstack/echo/v4"
+)
+
+// Annotations explain what happened on a chart: "changed CO2 sensor",
+// "party", "windows open all day". Each has a time, optionally an end, a
+// text and tags. They are returned with /api/sensor-data?annotations=true
+// and as the "annotations" query of the Grafana datasource, where
+// "annotations:party" picks those tagged party.
+
+type Annotation struct {
+	ID        int        `json:"id"`
+	Time      time.Time  `json:"time"`
+	TimeEnd   *time.Time `json:"time_end,omitempty"`
+	Text      string     `json:"text"`
+	Tags      []string   `json:"tags"`
+	CreatedBy string     `json:"created_by"`
+}
+
+// loadAnnotations returns the annotations overlapping [from, to) that carry
+// all of tags.
+func loadAnnotations(ctx context.Context, from, to time.Time, tags []string) ([]Annotation, error) {
+	if tags == nil {
+		tags = []string{}
+	}
+	filter, _ := json.Marshal(tags)
+	rows, err := db.QueryContext(ctx, `
+		SELECT id, time, time_end, text, tags::text, created_by FROM annotations
+		WHERE time < $2 AND COALESCE(time_end, time) >= $1 AND tags @> $3::jsonb
+		ORDER BY time
+	`, from, to, string(filter))
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	annotations := []Annotation{}
+	for rows.Next() {
+		var a Annotation
+		var tags string
+		if err := rows.Scan(&a.ID, &a.Time, &a.TimeEnd, &a.Text, &tags, &a.CreatedBy); err != nil {
+			return nil, err
+		}
+		if err := json.Unmarshal([]byte(tags), &a.Tags); err != nil {
+			return nil, err
+		}
+		annotations = append(annotations, a)
+	}
+	return annotations, rows.Err()
+}
+
+// splitTags parses a comma separated tag list.
+func splitTags(s string) []string {
+	tags := []string{}
+	for _, t := range strings.Split(s, ",") {
+		if t = strings.TrimSpace(t); t != "" {
+			tags = append(tags, t)
+		}
+	}
+	return tags
+}
+
+// getAnnotations lists annotations of the last ?days= (7), optionally only
+// those with all ?tags=.
+func getAnnotations(c echo.Context) error {
+	days := 7
+	if v := c.QueryParam("days"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 1 || n > 3650 {
+			return apiError(c, http.StatusBadRequest, "days must be between 1 and 3650")
+		}
+		days = n
+	}
+	now := time.Now()
+	annotations, err := loadAnnotations(c.Request().Context(), now.AddDate(0, 0, -days), now.Add(time.Hour), splitTags(c.QueryParam("tags")))
+	if err != nil {
+		return internalError(c, err)
+	}
+	return c.JSON(http.StatusOK, annotations)
+}
+
+// createAnnotation adds one: {"time": "...", "text": "party", "tags":
+// ["guests"]}. The time defaults to now.
+func createAnnotation(c echo.Context) error {
+	var a Annotation
+	if err := c.Bind(&a); err != nil {
+		return invalidBody(c, err)
+	}
+	a.Text = strings.TrimSpace(a.Text)
+	if a.Text == "" {
+		return apiError(c, http.StatusBadRequest, "text is required")
+	}
+	if a.Time.IsZero() {
+		a.Time = time.Now()
+	}
+	if a.TimeEnd != nil && a.TimeEnd.Before(a.Time) {
+		return apiError(c, http.StatusBadRequest, "time_end is before time")
+	}
+	tags := []string{}
+	for _, t := range a.Tags {
+		if t = strings.TrimSpace(t); t != "" {
+			tags = append(tags, t)
+		}
+	}
+	a.Tags = tags
+	a.CreatedBy = correctionActor(c)
+
+	encoded, _ := json.Marshal(a.Tags)
+	err := db.QueryRowContext(c.Request().Context(), `
+		INSERT INTO annotations (time, time_end, text, tags, created_by) VALUES ($1, $2, $3, $4, $5)
+		RETURNING id
+	`, a.Time, a.TimeEnd, a.Text, string(encoded), a.CreatedBy).Scan(&a.ID)
+	if err != nil {
+		return internalError(c, err)
+	}
+	return c.JSON(http.StatusCreated, a)
+}
+
+func deleteAnnotation(c echo.Context) error {
+	id, err := strconv.Atoi(c.Param("id"))
+	if err != nil {
+		return apiError(c, http.StatusBadRequest, "invalid annotation id")
+	}
+	res, err := db.ExecContext(c.Request().Context(), "DELETE FROM annotations WHERE id = $1", id)
+	if err != nil {
+		return internalError(c, err)
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		return apiError(c, http.StatusNotFound, "annotation not found")
+	}
+	return c.NoContent(http.StatusNoContent)
+}
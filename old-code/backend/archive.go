@@ -0,0 +1,248 @@
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"encoding/csv"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/labstack/echo/v4"
+)
+
+// Sensor data and metric samples older than ARCHIVE_AFTER are exported one
+// day at a time as gzip-compressed CSV to an S3 compatible bucket (e.g.
+// MinIO on the NAS).
+// Every uploaded object is recorded in archive_manifest, with the highest
+// row ID it holds, and listed by GET /api/archive. Archiving deletes nothing:
+// the rows stay until the retention settings expire them (retention.go), so
+// "keep forever" keeps them in the database too, and retention only removes
+// rows that are archived. A day that receives late
+// data is archived again as an additional part with only the new rows, so
+// existing objects are never overwritten.
+
+type ArchiveEntry struct {
+	ID        int       `json:"id"`
+	Source    string    `json:"source"`
+	Day       string    `json:"day"`
+	Bucket    string    `json:"bucket"`
+	ObjectKey string    `json:"object_key"`
+	Rows      int       `json:"rows"`
+	Bytes     int64     `json:"bytes"`
+	SHA256    string    `json:"sha256"`
+	CreatedAt time.Time `json:"created_at"`
+}
+
+var archiveStore *s3Client
+
+func initArchive() {
+	bucket := envString("ARCHIVE_S3_BUCKET", "")
+	if bucket == "" {
+		return
+	}
+	archiveStore = newS3Client(bucket)
+	registerJob("sensor_archive", "30 3 * * *", archiveSensorData)
+}
+
+// archiveCutoff is the midnight at or before now minus after. The days
+// before it are archived.
+func archiveCutoff(now time.Time, after time.Duration) time.Time {
+	cutoff := now.Add(-after)
+	return time.Date(cutoff.Year(), cutoff.Month(), cutoff.Day(), 0, 0, 0, 0, cutoff.Location())
+}
+
+// archiveSource is a table that is archived. Its rows are exported as CSV
+// under <table>/ and recorded in archive_manifest with the table as source.
+type archiveSource struct {
+	table   string
+	header  []string
+	columns string // id, timestamp and then the CSV columns as text, of s and d
+}
+
+var archiveSources = []archiveSource{
+	{"sensor_data", []string{"timestamp", "device", "room", "co2_level", "sound_level", "co2_raw", "sound_raw"},
+		`s.id, s.timestamp, COALESCE(d.name, ''), COALESCE(d.room, ''), s.co2_level::text, s.sound_level::text,
+		COALESCE(s.co2_raw, s.co2_level)::text, COALESCE(s.sound_raw, s.sound_level)::text`},
+	{"metric_samples", []string{"timestamp", "device", "room", "metric", "value"},
+		`s.id, s.timestamp, COALESCE(d.name, ''), COALESCE(d.room, ''), s.metric, s.value::text`},
+}
+
+// archivedRows restricts a query on table to rows that are archived, when
+// archiving is enabled: retention must not delete history before it is in
+// the bucket.
+func archivedRows(table string) string {
+	if archiveStore == nil {
+		return ""
+	}
+	return ` AND id <= COALESCE((SELECT MAX(m.max_id) FROM archive_manifest m
+		WHERE m.source = '` + table + `' AND m.day = ` + table + `.timestamp::date), 0)`
+}
+
+// archiveSensorData archives the rows not archived yet of every full day
+// before the ARCHIVE_AFTER cutoff.
+func archiveSensorData() error {
+	cutoff := archiveCutoff(time.Now(), envDuration("ARCHIVE_AFTER", 90*24*time.Hour))
+	for _, src := range archiveSources {
+		if err := src.archive(cutoff); err != nil {
+			return fmt.Errorf("%s: %w", src.table, err)
+		}
+	}
+	return nil
+}
+
+func (src archiveSource) archive(cutoff time.Time) error {
+	rows, err := db.Query(`
+		WITH archived AS (
+			SELECT day, MAX(max_id) AS max_id FROM archive_manifest WHERE source = $2 GROUP BY day
+		)
+		SELECT DISTINCT s.timestamp::date FROM `+src.table+` s
+		LEFT JOIN archived a ON a.day = s.timestamp::date
+		WHERE s.timestamp < $1 AND s.id > COALESCE(a.max_id, 0)
+		ORDER BY 1
+	`, cutoff, src.table)
+	if err != nil {
+		return err
+	}
+	var days []time.Time
+	for rows.Next() {
+		var day time.Time
+		if err := rows.Scan(&day); err != nil {
+			rows.Close()
+			return err
+		}
+		days = append(days, day)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return err
+	}
+
+	for _, day := range days {
+		if err := src.archiveDay(day); err != nil {
+			return fmt.Errorf("archiving %s: %w", day.Format("2006-01-02"), err)
+		}
+	}
+	return nil
+}
+
+func (src archiveSource) archiveDay(day time.Time) error {
+	from := time.Date(day.Year(), day.Month(), day.Day(), 0, 0, 0, 0, time.Local)
+	to := from.AddDate(0, 0, 1)
+
+	rows, err := db.Query(`
+		SELECT `+src.columns+`
+		FROM `+src.table+` s
+		LEFT JOIN devices d ON d.id = s.device_id
+		WHERE s.timestamp >= $1 AND s.timestamp < $2
+		AND s.id > (SELECT COALESCE(MAX(max_id), 0) FROM archive_manifest WHERE source = $3 AND day = $1::date)
+		ORDER BY s.timestamp
+	`, from, to, src.table)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+
+	var buf bytes.Buffer
+	gz := gzip.NewWriter(&buf)
+	w := csv.NewWriter(gz)
+	w.Write(src.header)
+	record := make([]string, len(src.header))
+	dest := make([]interface{}, len(src.header)+1)
+	var id int
+	var ts time.Time
+	dest[0], dest[1] = &id, &ts
+	for i := 1; i < len(record); i++ {
+		dest[i+1] = &record[i]
+	}
+	var maxID, count int
+	for rows.Next() {
+		if err := rows.Scan(dest...); err != nil {
+			return err
+		}
+		record[0] = ts.Format(time.RFC3339)
+		w.Write(record)
+		maxID = max(maxID, id)
+		count++
+	}
+	if err := rows.Err(); err != nil {
+		return err
+	}
+	w.Flush()
+	if err := w.Error(); err != nil {
+		return err
+	}
+	if err := gz.Close(); err != nil {
+		return err
+	}
+	if count == 0 {
+		return nil
+	}
+
+	body := buf.Bytes()
+	key := fmt.Sprintf("%s/%s-%d.csv.gz", src.table, from.Format("2006/01/02"), time.Now().Unix())
+	if err := archiveStore.putObject(key, body, "application/gzip"); err != nil {
+		return err
+	}
+
+	// Rows inserted for this day after the export started go into the next part.
+	_, err = db.Exec(`
+		INSERT INTO archive_manifest (source, day, bucket, object_key, rows, bytes, sha256, max_id, created_at)
+		VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9)
+	`, src.table, from, archiveStore.bucket, key, count, len(body), sha256Hex(body), maxID, time.Now())
+	if err != nil {
+		return err
+	}
+
+	log.Printf("Archived %d %s rows from %s to %s", count, src.table, from.Format("2006-01-02"), key)
+	return nil
+}
+
+// getArchive lists archived objects, newest day first, optionally limited to
+// ?from=YYYY-MM-DD&to=YYYY-MM-DD.
+func getArchive(c echo.Context) error {
+	from, to := "0001-01-01", "9999-12-31"
+	for _, p := range []struct {
+		name string
+		dst  *string
+	}{{"from", &from}, {"to", &to}} {
+		if v := c.QueryParam(p.name); v != "" {
+			if _, err := time.Parse("2006-01-02", v); err != nil {
+				return apiError(c, http.StatusBadRequest, "invalid "+p.name+", expected YYYY-MM-DD")
+			}
+			*p.dst = v
+		}
+	}
+
+	rows, err := db.Query(`
+		SELECT id, source, day, bucket, object_key, rows, bytes, sha256, created_at
+		FROM archive_manifest
+		WHERE day BETWEEN $1 AND $2
+		ORDER BY day DESC, id DESC
+	`, from, to)
+	if err != nil {
+		return internalError(c, err)
+	}
+	defer rows.Close()
+
+	entries := []ArchiveEntry{}
+	for rows.Next() {
+		var e ArchiveEntry
+		var day time.Time
+		if err := rows.Scan(&e.ID, &e.Source, &day, &e.Bucket, &e.ObjectKey, &e.Rows, &e.Bytes, &e.SHA256, &e.CreatedAt); err != nil {
+			return internalError(c, err)
+		}
+		e.Day = day.Format("2006-01-02")
+		entries = append(entries, e)
+	}
+	if err := rows.Err(); err != nil {
+		return internalError(c, err)
+	}
+
+	return c.JSON(http.StatusOK, map[string]interface{}{
+		"configured": archiveStore != nil,
+		"entries":    entries,
+	})
+}
@@ -0,0 +1,28 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestArchiveCutoff(t *testing.T) {
+	loc := time.FixedZone("CET", 3600)
+	tests := []struct {
+		name  string
+		now   time.Time
+		after time.Duration
+		want  time.Time
+	}{
+		{"midday", time.Date(2026, 4, 10, 13, 30, 0, 0, loc), 90 * 24 * time.Hour, time.Date(2026, 1, 10, 0, 0, 0, 0, loc)},
+		{"just after midnight", time.Date(2026, 4, 10, 0, 5, 0, 0, loc), 24 * time.Hour, time.Date(2026, 4, 9, 0, 0, 0, 0, loc)},
+		{"hours", time.Date(2026, 4, 10, 3, 0, 0, 0, loc), 6 * time.Hour, time.Date(2026, 4, 9, 0, 0, 0, 0, loc)},
+		{"nothing kept back", time.Date(2026, 4, 10, 3, 0, 0, 0, loc), 0, time.Date(2026, 4, 10, 0, 0, 0, 0, loc)},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := archiveCutoff(tt.now, tt.after); !got.Equal(tt.want) {
+				t.Errorf("archiveCutoff = %s, want %s", got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,174 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/labstack/echo/v4"
+)
+
+// Devices that keep readings in a local buffer say how far back it reaches
+// with "buffer_seconds" in their updates. The server then looks for gaps
+// (see gaps.go) of the device within that window and asks for them in the
+// update response, a few at a time:
+//
+//	"backfill": [{"id": 7, "from": 1718000000, "to": 1718003600}]
+//
+// The device replays what it has of each range to POST
+// /api/device/backfill, {"device", "backfill_id", "device_time",
+// "samples", "done"}, with samples as in an update. A range too long for
+// one request is sent in several with "done": false on all but the last;
+// the request stays "partial" until the last one resolves it, also when the
+// device has nothing to send, so a gap is asked for only once. Without
+// "done" a request is the last one. Requests whose range fell out of the
+// buffer expire.
+
+const (
+	maxBackfillRequests = 3
+	maxBackfillSamples  = 5000
+)
+
+type BackfillRequest struct {
+	ID   int   `json:"id"`
+	From int64 `json:"from"` // unix seconds
+	To   int64 `json:"to"`
+}
+
+// requestBackfill records the gaps of the last buffer as backfill requests
+// and returns the oldest open ones.
+func requestBackfill(ctx context.Context, deviceID int, buffer time.Duration, now time.Time) ([]BackfillRequest, error) {
+	from := now.Add(-buffer)
+	_, err := db.ExecContext(ctx, `
+		UPDATE backfill_requests SET status = 'expired' WHERE device_id = $1 AND status = 'requested' AND gap_to < $2
+	`, deviceID, from)
+	if err != nil {
+		return nil, err
+	}
+	gaps, err := findGaps(ctx, "co2", deviceID, from, now)
+	if err != nil {
+		return nil, err
+	}
+	for _, g := range gaps {
+		if g.Ongoing {
+			continue // ends with this update
+		}
+		_, err := db.ExecContext(ctx, `
+			INSERT INTO backfill_requests (device_id, gap_from, gap_to) VALUES ($1, $2, $3)
+			ON CONFLICT (device_id, gap_from) DO NOTHING
+		`, deviceID, g.From, g.To)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	rows, err := db.QueryContext(ctx, `
+		SELECT id, gap_from, gap_to FROM backfill_requests
+		WHERE device_id = $1 AND status = 'requested' ORDER BY gap_from LIMIT $2
+	`, deviceID, maxBackfillRequests)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var requests []BackfillRequest
+	for rows.Next() {
+		var r BackfillRequest
+		var gapFrom, gapTo time.Time
+		if err := rows.Scan(&r.ID, &gapFrom, &gapTo); err != nil {
+			return nil, err
+		}
+		r.From, r.To = gapFrom.Unix(), gapTo.Unix()
+		requests = append(requests, r)
+	}
+	return requests, rows.Err()
+}
+
+// backfillStatuses returns the status of the backfill request of each gap,
+// keyed by device name and start.
+func backfillStatuses(ctx context.Context, from, to time.Time) (map[string]string, error) {
+	rows, err := db.QueryContext(ctx, `
+		SELECT d.name, b.gap_from, b.status FROM backfill_requests b JOIN devices d ON d.id = b.device_id
+		WHERE b.gap_to >= $1 AND b.gap_from <= $2
+	`, from, to)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	statuses := make(map[string]string)
+	for rows.Next() {
+		var name, status string
+		var at time.Time
+		if err := rows.Scan(&name, &at, &status); err != nil {
+			return nil, err
+		}
+		statuses[backfillKey(name, at)] = status
+	}
+	return statuses, rows.Err()
+}
+
+func backfillKey(device string, from time.Time) string {
+	return fmt.Sprintf("%s@%d", device, from.Unix())
+}
+
+// postDeviceBackfill stores the samples replayed for a backfill request
+// and resolves it.
+func postDeviceBackfill(c echo.Context) error {
+	var req struct {
+		Device     string           `json:"device"`
+		BackfillID int              `json:"backfill_id"`
+		DeviceTime *int64           `json:"device_time"`
+		Samples    []BufferedSample `json:"samples"`
+		Done       *bool            `json:"done"`
+	}
+	if err := c.Bind(&req); err != nil {
+		return invalidBody(c, err)
+	}
+	if len(req.Samples) > maxBackfillSamples {
+		return apiError(c, http.StatusRequestEntityTooLarge, fmt.Sprintf("at most %d samples per request", maxBackfillSamples))
+	}
+	if !deviceKeyValid(c, req.Device) {
+		return deviceKeyError(c)
+	}
+	device, err := deviceByName(req.Device)
+	if err != nil {
+		return internalError(c, err)
+	}
+
+	ctx := c.Request().Context()
+	var status string
+	err = db.QueryRowContext(ctx, "SELECT status FROM backfill_requests WHERE id = $1 AND device_id = $2",
+		req.BackfillID, device.ID).Scan(&status)
+	if err == sql.ErrNoRows {
+		return apiError(c, http.StatusNotFound, "no such backfill request")
+	} else if err != nil {
+		return internalError(c, err)
+	}
+	if status != "requested" && status != "partial" {
+		return apiError(c, http.StatusConflict, "backfill request is "+status)
+	}
+
+	cals, err := loadCalibration(device.ID)
+	if err != nil {
+		return internalError(c, err)
+	}
+	now := time.Now()
+	if err := storeBufferedSamples(ctx, device.ID, cals, req.Samples, clockOffset(req.DeviceTime, now), now); err != nil {
+		return internalError(c, err)
+	}
+	status = "resolved"
+	if req.Done != nil && !*req.Done {
+		status = "partial"
+	}
+	var samples int
+	err = db.QueryRowContext(ctx, `
+		UPDATE backfill_requests SET status = $2, resolved_at = CASE WHEN $2 = 'resolved' THEN $3::timestamp END,
+			samples = COALESCE(samples, 0) + $4
+		WHERE id = $1 RETURNING samples
+	`, req.BackfillID, status, now, len(req.Samples)).Scan(&samples)
+	if err != nil {
+		return internalError(c, err)
+	}
+	return c.JSON(http.StatusOK, map[string]interface{}{"backfill_id": req.BackfillID, "status": status, "samples": samples})
+}
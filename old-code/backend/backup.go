@@ -0,0 +1,442 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"context"
+	"encoding/hex"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+)
+
+// Backups are gzip-compressed SQL scripts named
+// backup-YYYYMMDD-HHMMSS.sql.gz (parents-backup-... with HOUSEHOLD=parents)
+// of the household's schema. They are made with pg_dump when it is
+// installed and otherwise by a built-in export of the data (the schema is
+// recreated by the server itself). A pg_dump backup is restored through psql,
+// which has to be installed then; a built-in one by the server. Run them by
+// hand:
+//
+//	home-server backup [-dir /mnt/nas/backups] [-upload]
+//	home-server restore backup-20240101-020000.sql.gz
+//
+// or on a schedule through the "backup" job, which is off unless
+// JOB_BACKUP_SCHEDULE is set. The job uploads to BACKUP_S3_BUCKET when
+// configured, keeps the newest BACKUP_KEEP backups and notifies on failure.
+
+// backupPrefix keeps the backups of households sharing a directory or
+// bucket apart.
+func backupPrefix() string {
+	if household != "" {
+		return household + "-backup-"
+	}
+	return "backup-"
+}
+
+// runCommand runs a subcommand and returns the process exit code.
+func runCommand(args []string) int {
+	switch args[0] {
+	case "backup":
+		fs := flag.NewFlagSet("backup", flag.ExitOnError)
+		dir := fs.String("dir", envString("BACKUP_DIR", "backups"), "directory to write the backup to")
+		upload := fs.Bool("upload", envString("BACKUP_S3_BUCKET", "") != "", "upload to BACKUP_S3_BUCKET")
+		fs.Parse(args[1:])
+
+		initDB()
+		path, err := writeBackup(*dir, *upload)
+		if err != nil {
+			log.Printf("Backup failed: %v", err)
+			return 1
+		}
+		fmt.Println(path)
+		return 0
+
+	case "restore":
+		fs := flag.NewFlagSet("restore", flag.ExitOnError)
+		fs.Parse(args[1:])
+		if fs.NArg() != 1 {
+			fmt.Fprintln(os.Stderr, "usage: home-server restore <backup.sql.gz>")
+			return 2
+		}
+
+		initDB()
+		createTables()
+		if err := restoreBackup(fs.Arg(0)); err != nil {
+			log.Printf("Restore failed: %v", err)
+			return 1
+		}
+		log.Printf("Restored %s", fs.Arg(0))
+		return 0
+
+	case "simulate":
+		return runSimulate(args[1:])
+
+	default:
+		fmt.Fprintf(os.Stderr, "unknown command %q (expected backup, restore or simulate)\n", args[0])
+		return 2
+	}
+}
+
+// writeBackup writes a backup into dir and optionally uploads it.
+func writeBackup(dir string, upload bool) (string, error) {
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return "", err
+	}
+
+	var sqlDump bytes.Buffer
+	if _, err := exec.LookPath("pg_dump"); err == nil {
+		if err := pgDump(&sqlDump); err != nil {
+			return "", err
+		}
+	} else if err := exportSQL(&sqlDump); err != nil {
+		return "", err
+	}
+
+	var buf bytes.Buffer
+	gz := gzip.NewWriter(&buf)
+	gz.Write(sqlDump.Bytes())
+	if err := gz.Close(); err != nil {
+		return "", err
+	}
+
+	name := backupPrefix() + time.Now().Format("20060102-150405") + ".sql.gz"
+	path := filepath.Join(dir, name)
+	if err := os.WriteFile(path, buf.Bytes(), 0o600); err != nil {
+		return "", err
+	}
+	if upload {
+		if err := newS3Client(envString("BACKUP_S3_BUCKET", "")).putObject("backups/"+name, buf.Bytes(), "application/gzip"); err != nil {
+			return path, fmt.Errorf("upload: %w", err)
+		}
+	}
+	return path, nil
+}
+
+func pgDump(w io.Writer) error {
+	cmd := exec.Command("pg_dump", "--clean", "--if-exists", "--inserts", "--no-owner", "--schema", householdSchema(),
+		"-h", os.Getenv("DB_HOST"), "-p", os.Getenv("DB_PORT"), "-U", os.Getenv("DB_USER"), os.Getenv("DB_NAME"))
+	cmd.Env = append(os.Environ(), "PGPASSWORD="+os.Getenv("DB_PASSWORD"))
+	var stderr bytes.Buffer
+	cmd.Stdout, cmd.Stderr = w, &stderr
+	if err := cmd.Run(); err != nil {
+		return fmt.Errorf("pg_dump: %v: %s", err, strings.TrimSpace(stderr.String()))
+	}
+	return nil
+}
+
+// exportHeader starts the first line of a built-in export.
+const exportHeader = "-- home-server backup"
+
+// exportSQL writes the data of every table in the household's schema as
+// INSERT statements, emptying the tables first and fixing up sequences
+// afterwards.
+func exportSQL(w io.Writer) error {
+	tables, err := publicTables()
+	if err != nil {
+		return err
+	}
+
+	bw := bufio.NewWriter(w)
+	fmt.Fprintf(bw, "%s %s\n", exportHeader, time.Now().Format(time.RFC3339))
+	fmt.Fprintf(bw, "TRUNCATE %s CASCADE;\n", strings.Join(quoteIdents(tables), ", "))
+	for _, table := range tables {
+		if err := exportTable(bw, table); err != nil {
+			return fmt.Errorf("%s: %w", table, err)
+		}
+	}
+	rows, err := db.Query(`
+		SELECT table_name, column_name, pg_get_serial_sequence(quote_ident(table_name), column_name)
+		FROM information_schema.columns
+		WHERE table_schema = $1 AND pg_get_serial_sequence(quote_ident(table_name), column_name) IS NOT NULL
+	`, householdSchema())
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var table, column, seq string
+		if err := rows.Scan(&table, &column, &seq); err != nil {
+			return err
+		}
+		fmt.Fprintf(bw, "SELECT setval(%s, COALESCE((SELECT MAX(%s) FROM %s), 0) + 1, false);\n",
+			quoteLiteral(seq), quoteIdent(column), quoteIdent(table))
+	}
+	if err := rows.Err(); err != nil {
+		return err
+	}
+	return bw.Flush()
+}
+
+// publicTables lists the tables, ordered so that referenced tables come
+// before the tables referencing them.
+func publicTables() ([]string, error) {
+	rows, err := db.Query(`
+		SELECT t.table_name, COALESCE(ccu.table_name, '')
+		FROM information_schema.tables t
+		LEFT JOIN information_schema.table_constraints tc
+			ON tc.table_name = t.table_name AND tc.table_schema = t.table_schema AND tc.constraint_type = 'FOREIGN KEY'
+		LEFT JOIN information_schema.constraint_column_usage ccu
+			ON ccu.constraint_name = tc.constraint_name AND ccu.table_schema = tc.table_schema
+		WHERE t.table_schema = $1 AND t.table_type = 'BASE TABLE'
+	`, householdSchema())
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	deps := make(map[string][]string)
+	for rows.Next() {
+		var table, ref string
+		if err := rows.Scan(&table, &ref); err != nil {
+			return nil, err
+		}
+		if _, ok := deps[table]; !ok {
+			deps[table] = nil
+		}
+		if ref != "" && ref != table {
+			deps[table] = append(deps[table], ref)
+		}
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	names := make([]string, 0, len(deps))
+	for name := range deps {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	var ordered []string
+	done := make(map[string]bool)
+	var visit func(string)
+	visit = func(name string) {
+		if done[name] {
+			return
+		}
+		done[name] = true
+		for _, ref := range deps[name] {
+			visit(ref)
+		}
+		ordered = append(ordered, name)
+	}
+	for _, name := range names {
+		visit(name)
+	}
+	return ordered, nil
+}
+
+func exportTable(w io.Writer, table string) error {
+	rows, err := db.Query("SELECT * FROM " + quoteIdent(table))
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+	columns, err := rows.Columns()
+	if err != nil {
+		return err
+	}
+	prefix := fmt.Sprintf("INSERT INTO %s (%s) VALUES (", quoteIdent(table), strings.Join(quoteIdents(columns), ", "))
+
+	values := make([]interface{}, len(columns))
+	ptrs := make([]interface{}, len(columns))
+	for i := range values {
+		ptrs[i] = &values[i]
+	}
+	literals := make([]string, len(columns))
+	for rows.Next() {
+		if err := rows.Scan(ptrs...); err != nil {
+			return err
+		}
+		for i, v := range values {
+			literals[i] = sqlLiteral(v)
+		}
+		fmt.Fprintf(w, "%s%s);\n", prefix, strings.Join(literals, ", "))
+	}
+	return rows.Err()
+}
+
+func sqlLiteral(v interface{}) string {
+	switch v := v.(type) {
+	case nil:
+		return "NULL"
+	case bool:
+		if v {
+			return "true"
+		}
+		return "false"
+	case int64, float64:
+		return fmt.Sprint(v)
+	case time.Time:
+		return quoteLiteral(v.Format("2006-01-02 15:04:05.999999"))
+	case []byte:
+		// pq returns text-like columns (numeric, jsonb, ...) as bytes
+		if isText(v) {
+			return quoteLiteral(string(v))
+		}
+		return `'\x` + hex.EncodeToString(v) + `'`
+	default:
+		return quoteLiteral(fmt.Sprint(v))
+	}
+}
+
+func isText(b []byte) bool {
+	for _, c := range b {
+		if c == 0 {
+			return false
+		}
+	}
+	return true
+}
+
+func quoteIdent(s string) string {
+	return `"` + strings.ReplaceAll(s, `"`, `""`) + `"`
+}
+
+func quoteIdents(names []string) []string {
+	quoted := make([]string, len(names))
+	for i, n := range names {
+		quoted[i] = quoteIdent(n)
+	}
+	return quoted
+}
+
+func quoteLiteral(s string) string {
+	return "'" + strings.ReplaceAll(s, "'", "''") + "'"
+}
+
+// restoreBackup replays a backup in a single transaction and rebuilds the
+// rollups from the restored data.
+func restoreBackup(path string) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	var r io.Reader = f
+	if strings.HasSuffix(path, ".gz") {
+		gz, err := gzip.NewReader(f)
+		if err != nil {
+			return err
+		}
+		defer gz.Close()
+		r = gz
+	}
+	script, err := io.ReadAll(r)
+	if err != nil {
+		return err
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Minute)
+	defer cancel()
+	if isExport(script) {
+		err = restoreExport(ctx, script)
+	} else {
+		err = psqlRestore(ctx, script)
+	}
+	if err != nil {
+		return err
+	}
+	return refreshRollupViews(false)
+}
+
+// isExport tells a built-in export from a pg_dump script.
+func isExport(script []byte) bool {
+	return bytes.HasPrefix(script, []byte(exportHeader+" "))
+}
+
+// restoreExport runs a built-in export, which is plain SQL statements.
+func restoreExport(ctx context.Context, script []byte) error {
+	tx, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	if _, err := tx.ExecContext(ctx, string(script)); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// psqlRestore feeds a pg_dump script, which may hold psql meta-commands and
+// COPY data, to psql.
+func psqlRestore(ctx context.Context, script []byte) error {
+	if _, err := exec.LookPath("psql"); err != nil {
+		return fmt.Errorf("the backup was made by pg_dump and restoring it needs psql: %w", err)
+	}
+	cmd := exec.CommandContext(ctx, "psql", "--no-psqlrc", "--quiet", "--single-transaction", "-v", "ON_ERROR_STOP=1",
+		"-h", os.Getenv("DB_HOST"), "-p", os.Getenv("DB_PORT"), "-U", os.Getenv("DB_USER"), "-d", os.Getenv("DB_NAME"))
+	cmd.Env = append(os.Environ(), "PGPASSWORD="+os.Getenv("DB_PASSWORD"))
+	var stderr bytes.Buffer
+	cmd.Stdin, cmd.Stdout, cmd.Stderr = bytes.NewReader(script), io.Discard, &stderr
+	if err := cmd.Run(); err != nil {
+		return fmt.Errorf("psql: %v: %s", err, strings.TrimSpace(stderr.String()))
+	}
+	return nil
+}
+
+// scheduledBackup is the "backup" job.
+func scheduledBackup() error {
+	bucket := envString("BACKUP_S3_BUCKET", "")
+	path, err := writeBackup(envString("BACKUP_DIR", "backups"), bucket != "")
+	if err == nil {
+		err = pruneBackups(bucket)
+	}
+	if err != nil {
+		notify(Notification{
+			Event:    "backup",
+			Title:    "Backup failed",
+			Message:  err.Error(),
+			Priority: 4,
+			Tags:     []string{"floppy_disk", "warning"},
+		})
+		return err
+	}
+	log.Printf("Backup written to %s", path)
+	return nil
+}
+
+// pruneBackups keeps the newest BACKUP_KEEP backups locally and in the bucket.
+func pruneBackups(bucket string) error {
+	keep := envInt("BACKUP_KEEP", 7)
+	if keep <= 0 {
+		return nil
+	}
+
+	local, err := filepath.Glob(filepath.Join(envString("BACKUP_DIR", "backups"), backupPrefix()+"*.sql.gz"))
+	if err != nil {
+		return err
+	}
+	sort.Strings(local) // timestamped names sort chronologically
+	for len(local) > keep {
+		if err := os.Remove(local[0]); err != nil {
+			return err
+		}
+		local = local[1:]
+	}
+
+	if bucket == "" {
+		return nil
+	}
+	store := newS3Client(bucket)
+	remote, err := store.listObjects("backups/" + backupPrefix())
+	if err != nil {
+		return err
+	}
+	for len(remote) > keep {
+		if err := store.deleteObject(remote[0]); err != nil {
+			return err
+		}
+		remote = remote[1:]
+	}
+	return nil
+}
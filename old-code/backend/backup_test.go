@@ -0,0 +1,44 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestIsExport(t *testing.T) {
+	tests := []struct {
+		script string
+		want   bool
+	}{
+		{exportHeader + " 2026-01-01T02:00:00Z\nTRUNCATE \"devices\" CASCADE;\n", true},
+		{"--\n-- PostgreSQL database dump\n--\n\nSET statement_timeout = 0;\n", false},
+		{"\\restrict abc\n-- home-server backup 2026-01-01T02:00:00Z\n", false},
+		{"", false},
+	}
+	for _, tt := range tests {
+		if got := isExport([]byte(tt.script)); got != tt.want {
+			t.Errorf("isExport(%q) = %v, want %v", tt.script, got, tt.want)
+		}
+	}
+}
+
+func TestSQLLiteral(t *testing.T) {
+	tests := []struct {
+		v    interface{}
+		want string
+	}{
+		{nil, "NULL"},
+		{true, "true"},
+		{int64(42), "42"},
+		{1.5, "1.5"},
+		{"it's", "'it''s'"},
+		{[]byte(`{"a":1}`), `'{"a":1}'`},
+		{[]byte{0, 1, 255}, `'\x0001ff'`},
+		{time.Date(2026, 1, 2, 3, 4, 5, 600000000, time.UTC), "'2026-01-02 03:04:05.6'"},
+	}
+	for _, tt := range tests {
+		if got := sqlLiteral(tt.v); got != tt.want {
+			t.Errorf("sqlLiteral(%#v) = %s, want %s", tt.v, got, tt.want)
+		}
+	}
+}
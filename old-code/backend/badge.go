@@ -0,0 +1,86 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"html"
+	"net/http"
+	"time"
+	"unicode/utf8"
+
+	"github.com/labstack/echo/v4"
+)
+
+// GET /api/badge/co2.svg is a shields-style badge with the current CO2 and
+// its air band (see airBand), to embed as a plain image in wiki pages:
+// ![CO2](https://home.example/api/badge/co2.svg?room=bedroom). Without
+// ?room= it shows the worst room. Like GET /status it needs no login, is
+// rate limited and is turned off with STATUS_PAGE=false; it is cached for
+// a minute, about how often devices report.
+
+var badgeColors = map[string]string{
+	"good":    "#4c1",
+	"fair":    "#dfb317",
+	"poor":    "#e05d44",
+	"unknown": "#9f9f9f",
+}
+
+// badgeTextWidth estimates the width of text at 11px sans-serif.
+func badgeTextWidth(s string) int {
+	return utf8.RuneCountInString(s)*7 + 10
+}
+
+func renderBadgeSVG(label, value, color string) []byte {
+	lw, vw := badgeTextWidth(label), badgeTextWidth(value)
+	w := lw + vw
+	label, value = html.EscapeString(label), html.EscapeString(value)
+	var b bytes.Buffer
+	fmt.Fprintf(&b, `<svg xmlns="http://www.w3.org/2000/svg" width="%d" height="20" role="img" aria-label="%s: %s">`, w, label, value)
+	fmt.Fprintf(&b, `<title>%s: %s</title>`, label, value)
+	fmt.Fprintf(&b, `<clipPath id="r"><rect width="%d" height="20" rx="3"/></clipPath><g clip-path="url(#r)">`, w)
+	fmt.Fprintf(&b, `<rect width="%d" height="20" fill="#555"/><rect x="%d" width="%d" height="20" fill="%s"/></g>`, lw, lw, vw, color)
+	b.WriteString(`<g fill="#fff" text-anchor="middle" font-family="Verdana,DejaVu Sans,sans-serif" font-size="11">`)
+	fmt.Fprintf(&b, `<text x="%d" y="14">%s</text><text x="%d" y="14">%s</text></g>`, lw/2, label, lw+vw/2, value)
+	b.WriteString(`</svg>`)
+	return b.Bytes()
+}
+
+func getCO2Badge(c echo.Context) error {
+	if !envBool("STATUS_PAGE", true) {
+		return c.NoContent(http.StatusNotFound)
+	}
+	now := time.Now()
+	if !statusAllowed(c.RealIP(), now) {
+		c.Response().Header().Set("Retry-After", "60")
+		return apiError(c, http.StatusTooManyRequests, "too many requests")
+	}
+	readings, err := roomReadings(c.Request().Context(), now)
+	if err != nil {
+		return apiError(c, http.StatusInternalServerError, "status unavailable")
+	}
+
+	label, co2 := "CO₂", 0.0
+	if room := c.QueryParam("room"); room != "" {
+		found := false
+		for _, r := range readings {
+			if r.Room == room {
+				found, co2 = true, r.CO2
+			}
+		}
+		if !found {
+			return apiError(c, http.StatusNotFound, "room not found")
+		}
+		label = room + " CO₂"
+	} else {
+		for _, r := range readings {
+			co2 = max(co2, r.CO2)
+		}
+	}
+
+	band, value := airBand(co2), "no data"
+	if co2 > 0 {
+		value = fmt.Sprintf("%.0f ppm", co2)
+	}
+	c.Response().Header().Set("Cache-Control", "public, max-age=60")
+	return c.Blob(http.StatusOK, "image/svg+xml", renderBadgeSVG(label, value, badgeColors[band]))
+}
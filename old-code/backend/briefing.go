@@ -0,0 +1,364 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/labstack/echo/v4"
+)
+
+// GET /api/briefing composes a short morning summary for the device or a
+// speaker to read out after the alarm is dismissed: the weather at
+// HOME_LAT/HOME_LON (Open-Meteo, no key needed), last night's indoor air,
+// the first event of the day from the iCalendar feed at BRIEFING_CALENDAR_URL
+// and how the alarm went. Sections without data are left out. With
+// ?format=audio the text is synthesized by the TTS backend (see tts.go).
+// With ?device= the weather is the device's and times are in its timezone
+// (see devices.go).
+
+type Briefing struct {
+	Text        string            `json:"text"`
+	Sections    map[string]string `json:"sections"`
+	GeneratedAt time.Time         `json:"generated_at"`
+}
+
+var briefingClient = &http.Client{Timeout: 10 * time.Second}
+
+func buildBriefing(ctx context.Context, now time.Time, meta DeviceMeta) Briefing {
+	now = now.In(meta.location())
+	b := Briefing{Sections: make(map[string]string), GeneratedAt: now}
+	sections := []struct {
+		name string
+		fn   func(context.Context, time.Time) (string, error)
+	}{
+		{"greeting", briefingGreeting},
+		{"weather", func(ctx context.Context, _ time.Time) (string, error) { return briefingWeather(ctx, meta) }},
+		{"indoor", briefingIndoor},
+		{"calendar", briefingCalendar},
+		{"alarm", briefingAlarm},
+	}
+	var parts []string
+	for _, s := range sections {
+		text, err := s.fn(ctx, now)
+		if err != nil {
+			log.Printf("Briefing %s section failed: %v", s.name, err)
+			continue
+		}
+		if text != "" {
+			b.Sections[s.name] = text
+			parts = append(parts, text)
+		}
+	}
+	b.Text = strings.Join(parts, " ")
+	return b
+}
+
+func briefingGreeting(_ context.Context, now time.Time) (string, error) {
+	return "Good morning. It is " + now.Format("Monday, January 2, 3:04 PM") + ".", nil
+}
+
+// weatherDescription groups the WMO weather codes Open-Meteo reports.
+func weatherDescription(code int) string {
+	switch {
+	case code == 0:
+		return "clear skies"
+	case code <= 3:
+		return "some clouds"
+	case code <= 48:
+		return "fog"
+	case code <= 67:
+		return "rain"
+	case code <= 77:
+		return "snow"
+	case code <= 82:
+		return "rain showers"
+	case code <= 86:
+		return "snow showers"
+	default:
+		return "thunderstorms"
+	}
+}
+
+// Weather is today's forecast at a device or HOME_LAT/HOME_LON.
+type Weather struct {
+	Temperature float64 `json:"temperature"`
+	Code        int     `json:"code"` // WMO weather code
+	Description string  `json:"description"`
+	High        float64 `json:"high"`
+	Low         float64 `json:"low"`
+	Precip      float64 `json:"precipitation_probability"`
+}
+
+// fetchWeather returns nil when neither the device nor the server has
+// coordinates.
+func fetchWeather(ctx context.Context, meta DeviceMeta) (*Weather, error) {
+	lat, lon, ok := meta.coordinates()
+	if !ok {
+		return nil, nil
+	}
+	q := url.Values{
+		"latitude":      {strconv.FormatFloat(lat, 'f', -1, 64)},
+		"longitude":     {strconv.FormatFloat(lon, 'f', -1, 64)},
+		"daily":         {"weather_code,temperature_2m_max,temperature_2m_min,precipitation_probability_max"},
+		"current":       {"temperature_2m"},
+		"timezone":      {"auto"},
+		"forecast_days": {"1"},
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, envString("WEATHER_URL", "https://api.open-meteo.com/v1/forecast")+"?"+q.Encode(), nil)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := briefingClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("weather service: %s", resp.Status)
+	}
+	var w struct {
+		Current struct {
+			Temperature float64 `json:"temperature_2m"`
+		} `json:"current"`
+		Daily struct {
+			Code   []int     `json:"weather_code"`
+			Max    []float64 `json:"temperature_2m_max"`
+			Min    []float64 `json:"temperature_2m_min"`
+			Precip []float64 `json:"precipitation_probability_max"`
+		} `json:"daily"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&w); err != nil {
+		return nil, err
+	}
+	d := w.Daily
+	if len(d.Code) == 0 || len(d.Max) == 0 || len(d.Min) == 0 {
+		return nil, fmt.Errorf("weather service returned no forecast")
+	}
+	weather := &Weather{Temperature: w.Current.Temperature, Code: d.Code[0],
+		Description: weatherDescription(d.Code[0]), High: d.Max[0], Low: d.Min[0]}
+	if len(d.Precip) > 0 {
+		weather.Precip = d.Precip[0]
+	}
+	return weather, nil
+}
+
+func briefingWeather(ctx context.Context, meta DeviceMeta) (string, error) {
+	w, err := fetchWeather(ctx, meta)
+	if w == nil || err != nil {
+		return "", err
+	}
+	text := fmt.Sprintf("Outside it is %.0f degrees, today brings %s with a high of %.0f and a low of %.0f.",
+		w.Temperature, w.Description, w.High, w.Low)
+	if w.Precip >= 30 {
+		text += fmt.Sprintf(" There is a %.0f percent chance of rain.", w.Precip)
+	}
+	return text, nil
+}
+
+// briefingIndoor summarises the night from 22:00 until now, using the same
+// night window as the weekly report.
+func briefingIndoor(ctx context.Context, now time.Time) (string, error) {
+	from := time.Date(now.Year(), now.Month(), now.Day()-1, 22, 0, 0, 0, now.Location())
+	var samples int
+	var avgCO2, maxCO2 float64
+	err := db.QueryRowContext(ctx, `
+		SELECT COUNT(NULLIF(co2_level, 0)), COALESCE(AVG(NULLIF(co2_level, 0)), 0), COALESCE(MAX(co2_level), 0)
+		FROM sensor_data
+		WHERE timestamp >= $1 AND timestamp < $2
+	`, serverTime(from), serverTime(now)).Scan(&samples, &avgCO2, &maxCO2)
+	if err != nil || samples == 0 {
+		return "", err
+	}
+	text := fmt.Sprintf("Overnight the bedroom CO2 averaged %.0f ppm and peaked at %.0f.", avgCO2, maxCO2)
+	if maxCO2 > settingFloat("co2_threshold") {
+		text += " That is above the limit, consider airing the room tonight."
+	} else if avgCO2 > settingFloat("report_poor_co2") {
+		text += " The air was a bit stuffy."
+	}
+	return text, nil
+}
+
+func briefingCalendar(ctx context.Context, now time.Time) (string, error) {
+	feed := envString("BRIEFING_CALENDAR_URL", "")
+	if feed == "" {
+		return "", nil
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, feed, nil)
+	if err != nil {
+		return "", err
+	}
+	resp, err := briefingClient.Do(req)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("calendar feed: %s", resp.Status)
+	}
+	scanner := bufio.NewScanner(resp.Body)
+	scanner.Buffer(make([]byte, 64*1024), 1024*1024)
+	events, err := parseICalEvents(scanner, now.Location())
+	if err != nil {
+		return "", err
+	}
+
+	endOfDay := time.Date(now.Year(), now.Month(), now.Day()+1, 0, 0, 0, 0, now.Location())
+	sort.Slice(events, func(i, j int) bool { return events[i].start.Before(events[j].start) })
+	for _, e := range events {
+		if e.allDay || e.start.Before(now) || !e.start.Before(endOfDay) {
+			continue
+		}
+		return fmt.Sprintf("Your first event today is %s at %s.", e.summary, e.start.Format("3:04 PM")), nil
+	}
+	return "Your calendar is free today.", nil
+}
+
+type icalEvent struct {
+	summary string
+	start   time.Time
+	allDay  bool
+}
+
+// parseICalEvents reads the SUMMARY and DTSTART of every VEVENT. Recurring
+// events only count with their first occurrence.
+func parseICalEvents(scanner *bufio.Scanner, loc *time.Location) ([]icalEvent, error) {
+	// Long lines are folded: continuation lines start with a space or tab
+	var lines []string
+	for scanner.Scan() {
+		line := strings.TrimRight(scanner.Text(), "\r")
+		if len(lines) > 0 && (strings.HasPrefix(line, " ") || strings.HasPrefix(line, "\t")) {
+			lines[len(lines)-1] += line[1:]
+			continue
+		}
+		lines = append(lines, line)
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+
+	var events []icalEvent
+	var cur *icalEvent
+	for _, line := range lines {
+		name, value, ok := strings.Cut(line, ":")
+		if !ok {
+			continue
+		}
+		name, params, _ := strings.Cut(name, ";")
+		switch {
+		case line == "BEGIN:VEVENT":
+			cur = &icalEvent{}
+		case line == "END:VEVENT" && cur != nil:
+			if !cur.start.IsZero() {
+				events = append(events, *cur)
+			}
+			cur = nil
+		case cur != nil && name == "SUMMARY":
+			cur.summary = strings.NewReplacer(`\,`, ",", `\;`, ";", `\n`, " ").Replace(value)
+		case cur != nil && name == "DTSTART":
+			cur.start, cur.allDay = parseICalTime(value, params, loc)
+		}
+	}
+	return events, nil
+}
+
+func parseICalTime(value, params string, loc *time.Location) (time.Time, bool) {
+	if strings.Contains(params, "VALUE=DATE") && !strings.Contains(params, "VALUE=DATE-TIME") {
+		t, _ := time.ParseInLocation("20060102", value, loc)
+		return t, true
+	}
+	if strings.HasSuffix(value, "Z") {
+		t, _ := time.Parse("20060102T150405Z", value)
+		return t.In(loc), false
+	}
+	for _, p := range strings.Split(params, ";") {
+		if tzid, ok := strings.CutPrefix(p, "TZID="); ok {
+			if l, err := time.LoadLocation(strings.Trim(tzid, `"`)); err == nil {
+				loc = l
+			}
+		}
+	}
+	t, _ := time.ParseInLocation("20060102T150405", value, loc)
+	return t, false
+}
+
+// briefingAlarm reports how long this morning's alarm rang and how that
+// compares to the last week.
+func briefingAlarm(ctx context.Context, now time.Time) (string, error) {
+	today := time.Date(now.Year(), now.Month(), now.Day(), 0, 0, 0, 0, now.Location())
+	var ring int64
+	err := db.QueryRowContext(ctx, `
+		SELECT COALESCE(MAX(alarm_active_time), 0) FROM device_status
+		WHERE last_seen >= $1 AND last_seen < $2 AND alarm_active
+	`, serverTime(today), serverTime(now)).Scan(&ring)
+	if err != nil || ring == 0 {
+		return "", err
+	}
+	var avg float64
+	err = db.QueryRowContext(ctx, `
+		SELECT COALESCE(AVG(ring), 0) FROM (
+			SELECT last_seen::date AS day, MAX(alarm_active_time) AS ring
+			FROM device_status
+			WHERE last_seen >= $1 AND last_seen < $2 AND alarm_active
+			GROUP BY day
+		) mornings
+	`, serverTime(today.AddDate(0, 0, -7)), serverTime(today)).Scan(&avg)
+	if err != nil {
+		return "", err
+	}
+	text := fmt.Sprintf("You got up after %s.", spokenDuration(ring))
+	if avg > 0 {
+		if float64(ring) < avg {
+			text += fmt.Sprintf(" That is faster than your weekly average of %s.", spokenDuration(int64(avg)))
+		} else {
+			text += fmt.Sprintf(" Your weekly average is %s.", spokenDuration(int64(avg)))
+		}
+	}
+	return text, nil
+}
+
+func spokenDuration(seconds int64) string {
+	if seconds < 60 {
+		return fmt.Sprintf("%d seconds", seconds)
+	}
+	if seconds < 120 {
+		return "one minute"
+	}
+	return fmt.Sprintf("%d minutes", seconds/60)
+}
+
+// getBriefing returns the briefing as JSON, as plain text with
+// ?format=text or as audio with ?format=audio.
+func getBriefing(c echo.Context) error {
+	meta, err := optionalDeviceMeta(c)
+	if err != nil {
+		return handlerError(c, err)
+	}
+	ctx := c.Request().Context()
+	b := buildBriefing(ctx, time.Now(), meta)
+	switch c.QueryParam("format") {
+	case "", "json":
+		return c.JSON(http.StatusOK, b)
+	case "text":
+		return c.String(http.StatusOK, b.Text)
+	case "audio":
+		if tts == nil {
+			return apiErrorCode(c, http.StatusNotFound, codeNotConfigured, "no TTS backend configured")
+		}
+		audio, contentType, err := synthesizeCached(ctx, b.Text)
+		if err != nil {
+			return upstreamError(c, "speech synthesis failed", err)
+		}
+		return c.Blob(http.StatusOK, contentType, audio)
+	default:
+		return apiError(c, http.StatusBadRequest, "format must be json, text or audio")
+	}
+}
@@ -0,0 +1,175 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/labstack/echo/v4"
+)
+
+// Expensive read endpoints (stats, heatmap, compare) are cached for
+// CACHE_TTL (60s, 0 turns caching off), so several open dashboards do not
+// run the same aggregates over and over. Responses are cached by URL in
+// memory, or in Redis with REDIS_URL set so that restarts and several
+// servers share them. Every refresh of the rollups and every sample
+// correction invalidates the whole cache. Responses carry X-Cache: HIT or
+// MISS, and /metrics counts both.
+
+type cachedResponse struct {
+	ContentType string    `json:"content_type"`
+	Body        []byte    `json:"body"`
+	Expires     time.Time `json:"expires"`
+}
+
+var responseCache = struct {
+	mu      sync.Mutex
+	entries map[string]cachedResponse
+	redis   *redisClient
+
+	hits, misses, invalidations atomic.Uint64
+}{entries: make(map[string]cachedResponse)}
+
+func initCache() {
+	rawURL := envString("REDIS_URL", "")
+	if rawURL == "" {
+		return
+	}
+	client, err := newRedisClient(rawURL)
+	if err != nil {
+		log.Printf("REDIS_URL is invalid, caching in memory: %v", err)
+		return
+	}
+	responseCache.redis = client
+}
+
+// redisCacheKey namespaces cache keys by household and generation.
+func redisCacheKey(parts ...string) string {
+	key := "home-server:" + household + ":cache"
+	for _, p := range parts {
+		key += ":" + p
+	}
+	return key
+}
+
+func cacheGet(key string) (cachedResponse, bool) {
+	if r := responseCache.redis; r != nil {
+		gen, err := r.get(redisCacheKey("gen"))
+		if err != nil && err != errRedisNil {
+			log.Printf("Cache lookup failed: %v", err)
+			return cachedResponse{}, false
+		}
+		value, err := r.get(redisCacheKey(gen, key))
+		var entry cachedResponse
+		if err != nil || json.Unmarshal([]byte(value), &entry) != nil {
+			return entry, false
+		}
+		return entry, true
+	}
+
+	responseCache.mu.Lock()
+	defer responseCache.mu.Unlock()
+	entry, ok := responseCache.entries[key]
+	return entry, ok && time.Now().Before(entry.Expires)
+}
+
+func cachePut(key string, entry cachedResponse) {
+	if r := responseCache.redis; r != nil {
+		gen, err := r.get(redisCacheKey("gen"))
+		if err == nil || err == errRedisNil {
+			value, _ := json.Marshal(entry)
+			ttl := strconv.FormatInt(time.Until(entry.Expires).Milliseconds(), 10)
+			_, err = r.do("SET", redisCacheKey(gen, key), string(value), "PX", ttl)
+		}
+		if err != nil {
+			log.Printf("Caching a response failed: %v", err)
+		}
+		return
+	}
+
+	responseCache.mu.Lock()
+	defer responseCache.mu.Unlock()
+	if len(responseCache.entries) >= 1000 {
+		now := time.Now()
+		for k, e := range responseCache.entries {
+			if now.After(e.Expires) {
+				delete(responseCache.entries, k)
+			}
+		}
+	}
+	responseCache.entries[key] = entry
+}
+
+// invalidateCache drops every cached response.
+func invalidateCache() {
+	responseCache.invalidations.Add(1)
+	if r := responseCache.redis; r != nil {
+		// Entries of older generations are never read again and expire
+		if _, err := r.do("INCR", redisCacheKey("gen")); err != nil {
+			log.Printf("Invalidating the cache failed: %v", err)
+		}
+		return
+	}
+	responseCache.mu.Lock()
+	responseCache.entries = make(map[string]cachedResponse)
+	responseCache.mu.Unlock()
+}
+
+// teeWriter keeps a copy of what a handler writes.
+type teeWriter struct {
+	http.ResponseWriter
+	body bytes.Buffer
+}
+
+func (w *teeWriter) Write(b []byte) (int, error) {
+	w.body.Write(b)
+	return w.ResponseWriter.Write(b)
+}
+
+// cacheResponse is the route middleware that caches successful responses.
+func cacheResponse(next echo.HandlerFunc) echo.HandlerFunc {
+	return func(c echo.Context) error {
+		ttl := envDuration("CACHE_TTL", time.Minute)
+		if ttl <= 0 || c.Request().Method != http.MethodGet {
+			return next(c)
+		}
+		key := c.Request().URL.RequestURI()
+		if entry, ok := cacheGet(key); ok {
+			responseCache.hits.Add(1)
+			c.Response().Header().Set("X-Cache", "HIT")
+			return c.Blob(http.StatusOK, entry.ContentType, entry.Body)
+		}
+		responseCache.misses.Add(1)
+		c.Response().Header().Set("X-Cache", "MISS")
+
+		tee := &teeWriter{ResponseWriter: c.Response().Writer}
+		c.Response().Writer = tee
+		err := next(c)
+		c.Response().Writer = tee.ResponseWriter
+		if err == nil && c.Response().Status == http.StatusOK {
+			cachePut(key, cachedResponse{
+				ContentType: c.Response().Header().Get(echo.HeaderContentType),
+				Body:        tee.body.Bytes(),
+				Expires:     time.Now().Add(ttl),
+			})
+		}
+		return err
+	}
+}
+
+func writeCacheMetrics(w io.Writer) {
+	fmt.Fprintln(w, "# HELP cache_requests_total Cacheable requests by result.")
+	fmt.Fprintln(w, "# TYPE cache_requests_total counter")
+	fmt.Fprintf(w, "cache_requests_total{result=\"hit\"} %d\n", responseCache.hits.Load())
+	fmt.Fprintf(w, "cache_requests_total{result=\"miss\"} %d\n", responseCache.misses.Load())
+	fmt.Fprintln(w, "# HELP cache_invalidations_total Times the response cache was invalidated.")
+	fmt.Fprintln(w, "# TYPE cache_invalidations_total counter")
+	fmt.Fprintf(w, "cache_invalidations_total %d\n", responseCache.invalidations.Load())
+}
@@ -0,0 +1,147 @@
+package main
+
+import (
+	"crypto/subtle"
+	"database/sql"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/labstack/echo/v4"
+)
+
+// GET /api/calendar.ics?token=CALENDAR_TOKEN is an iCalendar feed to
+// subscribe to from a phone: the rings of the armed alarm over the next
+// CALENDAR_DAYS, the days it is skipped (consecutive ones as one all-day
+// event, e.g. a holiday) and maintenance while it is on. Calendar apps
+// cannot log in, so the feed is protected by its token alone and is off
+// without CALENDAR_TOKEN.
+
+const calendarRingMinutes = 15
+
+// icsText escapes a TEXT value.
+func icsText(s string) string {
+	return strings.NewReplacer(`\`, `\\`, ";", `\;`, ",", `\,`, "\n", `\n`).Replace(s)
+}
+
+// icsWriter folds lines at 75 octets and ends them with CRLF.
+type icsWriter struct{ strings.Builder }
+
+func (w *icsWriter) line(format string, args ...interface{}) {
+	s := fmt.Sprintf(format, args...)
+	for len(s) > 75 {
+		cut := 75
+		for cut > 0 && s[cut]&0xc0 == 0x80 {
+			cut-- // keep UTF-8 sequences whole
+		}
+		w.WriteString(s[:cut] + "\r\n ")
+		s = s[cut:]
+	}
+	w.WriteString(s + "\r\n")
+}
+
+func (w *icsWriter) event(uid string, stamp time.Time, summary, description string, start, end string) {
+	w.line("BEGIN:VEVENT")
+	w.line("UID:%s@home-server", uid)
+	w.line("DTSTAMP:%s", stamp.UTC().Format("20060102T150405Z"))
+	w.line("%s", start)
+	w.line("%s", end)
+	w.line("SUMMARY:%s", icsText(summary))
+	if description != "" {
+		w.line("DESCRIPTION:%s", icsText(description))
+	}
+	w.line("END:VEVENT")
+}
+
+func icsTime(t time.Time) string { return t.UTC().Format("20060102T150405Z") }
+
+// calendarSkips returns the skipped alarm dates from today on, with their
+// reasons.
+func calendarSkips(today string) (map[string]string, error) {
+	rows, err := db.Query("SELECT to_char(alarm_date, 'YYYY-MM-DD'), reason FROM alarm_skips WHERE skip AND alarm_date >= $1", today)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	skips := make(map[string]string)
+	for rows.Next() {
+		var date, reason string
+		if err := rows.Scan(&date, &reason); err != nil {
+			return nil, err
+		}
+		skips[date] = reason
+	}
+	return skips, rows.Err()
+}
+
+func getCalendar(c echo.Context) error {
+	expected := envString("CALENDAR_TOKEN", "")
+	if expected == "" {
+		return apiErrorCode(c, http.StatusNotFound, codeNotConfigured, "no CALENDAR_TOKEN configured")
+	}
+	if subtle.ConstantTimeCompare([]byte(c.QueryParam("token")), []byte(expected)) != 1 {
+		return apiError(c, http.StatusUnauthorized, "invalid calendar token")
+	}
+
+	now := time.Now().In(alarmLocation())
+	days := envInt("CALENDAR_DAYS", 14)
+	today := time.Date(now.Year(), now.Month(), now.Day(), 0, 0, 0, 0, now.Location())
+	skips, err := calendarSkips(today.Format("2006-01-02"))
+	if err != nil {
+		return internalError(c, err)
+	}
+	alarm, err := currentAlarm()
+	if err != nil && err != sql.ErrNoRows {
+		return internalError(c, err)
+	}
+
+	var w icsWriter
+	w.line("BEGIN:VCALENDAR")
+	w.line("VERSION:2.0")
+	w.line("PRODID:-//home-server//alarms//EN")
+	w.line("CALSCALE:GREGORIAN")
+	w.line("X-WR-CALNAME:Alarms")
+	w.line("REFRESH-INTERVAL;VALUE=DURATION:PT1H")
+
+	var rangeStart time.Time
+	var rangeReason string
+	for i := 0; i <= days; i++ {
+		day := today.AddDate(0, 0, i)
+		date := day.Format("2006-01-02")
+		reason, skipped := skips[date]
+		if skipped && i < days {
+			if rangeStart.IsZero() {
+				rangeStart, rangeReason = day, reason
+			}
+			continue
+		}
+		if !rangeStart.IsZero() {
+			w.event("skip-"+rangeStart.Format("20060102"), now, "Alarm off", rangeReason,
+				"DTSTART;VALUE=DATE:"+rangeStart.Format("20060102"), "DTEND;VALUE=DATE:"+day.Format("20060102"))
+			rangeStart = time.Time{}
+		}
+		if skipped || !alarm.Configured || !alarm.Armed {
+			continue
+		}
+		t, err := time.ParseInLocation("15:04", alarm.Time, now.Location())
+		if err != nil {
+			break
+		}
+		ring := time.Date(day.Year(), day.Month(), day.Day(), t.Hour(), t.Minute(), 0, 0, now.Location())
+		if ring.Before(now) {
+			continue
+		}
+		w.event("alarm-"+ring.Format("20060102"), now, "Alarm "+alarm.Time, "",
+			"DTSTART:"+icsTime(ring), "DTEND:"+icsTime(ring.Add(calendarRingMinutes*time.Minute)))
+	}
+
+	if m := currentMaintenance(); m.Active {
+		w.event("maintenance-"+m.Until.UTC().Format("20060102T150405"), now, "Maintenance",
+			"Alerts and the alarm watchdog are paused", "DTSTART:"+icsTime(now), "DTEND:"+icsTime(*m.Until))
+	}
+	w.line("END:VCALENDAR")
+
+	c.Response().Header().Set("Cache-Control", "no-store")
+	return c.Blob(http.StatusOK, "text/calendar; charset=utf-8", []byte(w.String()))
+}
@@ -0,0 +1,227 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/labstack/echo/v4"
+)
+
+// Sensors drift, e.g. an MH-Z19 that reads ~80 ppm high. Each device can
+// have a calibration per metric that is applied on ingest as
+//
+//	value = raw*scale + offset
+//
+// The uncalibrated reading is kept in sensor_data.<metric>_raw so history can
+// be recalibrated later. Zero readings ("sensor not ready") stay zero.
+//
+// A sensor that is not linear gets a curve of [raw, value] points instead,
+// applied before scale and offset: between two points the value is
+// interpolated linearly, beyond the ends the outer segments are extended.
+// The sound sensor reports a raw amplitude; measuring a few levels with a
+// sound level meter next to it, e.g.
+//
+//	{"sound": {"curve": [[40, 30], [120, 45], [400, 60], [1000, 75]]}}
+//
+// turns its readings into approximate dBA.
+
+type Calibration struct {
+	Offset    float64      `json:"offset"`
+	Scale     float64      `json:"scale"`
+	Curve     [][2]float64 `json:"curve,omitempty"`
+	UpdatedAt time.Time    `json:"updated_at"`
+}
+
+func (cal Calibration) apply(raw float64) float64 {
+	if raw == 0 {
+		return 0
+	}
+	value := raw
+	if len(cal.Curve) >= 2 {
+		value = interpolateCurve(cal.Curve, raw)
+	}
+	return value*cal.Scale + cal.Offset
+}
+
+// interpolateCurve maps x through points sorted by their first element.
+func interpolateCurve(points [][2]float64, x float64) float64 {
+	i := 1
+	for i < len(points)-1 && x > points[i][0] {
+		i++
+	}
+	a, b := points[i-1], points[i]
+	return a[1] + (x-a[0])*(b[1]-a[1])/(b[0]-a[0])
+}
+
+// validateCurve checks that a curve has at least two points with
+// increasing raw values.
+func validateCurve(points [][2]float64) string {
+	if len(points) < 2 {
+		return "a curve needs at least two points"
+	}
+	for i := 1; i < len(points); i++ {
+		if points[i][0] <= points[i-1][0] {
+			return "curve points must be sorted by raw value, without duplicates"
+		}
+	}
+	return ""
+}
+
+func loadCalibration(deviceID int) (map[string]Calibration, error) {
+	rows, err := db.Query(`
+		SELECT metric, offset_value, scale, curve::text, updated_at FROM device_calibrations WHERE device_id = $1
+	`, deviceID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	cals := make(map[string]Calibration)
+	for rows.Next() {
+		var metric string
+		var cal Calibration
+		var curve sql.NullString
+		if err := rows.Scan(&metric, &cal.Offset, &cal.Scale, &curve, &cal.UpdatedAt); err != nil {
+			return nil, err
+		}
+		if curve.Valid {
+			if err := json.Unmarshal([]byte(curve.String), &cal.Curve); err != nil {
+				return nil, fmt.Errorf("calibration curve of %s: %w", metric, err)
+			}
+		}
+		cals[metric] = cal
+	}
+	return cals, rows.Err()
+}
+
+// calibrate returns the calibrated value of a metric for a device.
+func calibrate(cals map[string]Calibration, metric string, raw float64) float64 {
+	if cal, ok := cals[metric]; ok {
+		return cal.apply(raw)
+	}
+	return raw
+}
+
+func deviceFromParam(c echo.Context) (DeviceInfo, error) {
+	var d DeviceInfo
+	id, err := strconv.Atoi(c.Param("id"))
+	if err != nil {
+		return d, newRequestError(http.StatusBadRequest, "invalid_request", "invalid device id")
+	}
+	err = db.QueryRow("SELECT id, name, room FROM devices WHERE id = $1", id).Scan(&d.ID, &d.Name, &d.Room)
+	if err == sql.ErrNoRows {
+		return d, newRequestError(http.StatusNotFound, codeDeviceNotFound, "device not found")
+	}
+	return d, err
+}
+
+func getCalibration(c echo.Context) error {
+	device, err := deviceFromParam(c)
+	if err != nil {
+		return handlerError(c, err)
+	}
+	cals, err := loadCalibration(device.ID)
+	if err != nil {
+		return internalError(c, err)
+	}
+	return c.JSON(http.StatusOK, cals)
+}
+
+// putCalibration sets calibrations per metric, e.g.
+// {"co2": {"offset": -80}, "sound": {"curve": [[40, 30], [1000, 75]]}}. A
+// missing scale is 1 and a null metric removes its calibration.
+func putCalibration(c echo.Context) error {
+	device, err := deviceFromParam(c)
+	if err != nil {
+		return handlerError(c, err)
+	}
+
+	var req map[string]*struct {
+		Offset float64      `json:"offset"`
+		Scale  *float64     `json:"scale"`
+		Curve  [][2]float64 `json:"curve"`
+	}
+	if err := c.Bind(&req); err != nil {
+		return invalidBody(c, err)
+	}
+	for metric, cal := range req {
+		if _, ok := metricColumns[metric]; !ok {
+			return apiError(c, http.StatusBadRequest, "unknown metric "+metric)
+		}
+		if cal != nil && cal.Scale != nil && *cal.Scale <= 0 {
+			return apiError(c, http.StatusBadRequest, "scale must be positive")
+		}
+		if cal != nil && cal.Curve != nil {
+			if msg := validateCurve(cal.Curve); msg != "" {
+				return apiError(c, http.StatusBadRequest, msg)
+			}
+		}
+	}
+
+	tx, err := db.Begin()
+	if err != nil {
+		return internalError(c, err)
+	}
+	defer tx.Rollback()
+	for metric, cal := range req {
+		if cal == nil {
+			_, err = tx.Exec("DELETE FROM device_calibrations WHERE device_id = $1 AND metric = $2", device.ID, metric)
+		} else {
+			scale := 1.0
+			if cal.Scale != nil {
+				scale = *cal.Scale
+			}
+			var curve sql.NullString
+			if cal.Curve != nil {
+				data, _ := json.Marshal(cal.Curve)
+				curve = sql.NullString{String: string(data), Valid: true}
+			}
+			_, err = tx.Exec(`
+				INSERT INTO device_calibrations (device_id, metric, offset_value, scale, curve, updated_at)
+				VALUES ($1, $2, $3, $4, $5, $6)
+				ON CONFLICT (device_id, metric) DO UPDATE
+				SET offset_value = EXCLUDED.offset_value, scale = EXCLUDED.scale, curve = EXCLUDED.curve,
+					updated_at = EXCLUDED.updated_at
+			`, device.ID, metric, cal.Offset, scale, curve, time.Now())
+		}
+		if err != nil {
+			return internalError(c, err)
+		}
+	}
+	if err := tx.Commit(); err != nil {
+		return internalError(c, err)
+	}
+
+	return getCalibration(c)
+}
+
+// recalibrateDevice queues a "recalibrate" command asking the device to
+// recalibrate a sensor against a known reference, e.g. the MH-Z19 zero point
+// in fresh outdoor air: {"metric": "co2", "reference": 400}.
+func recalibrateDevice(c echo.Context) error {
+	device, err := deviceFromParam(c)
+	if err != nil {
+		return handlerError(c, err)
+	}
+
+	var req struct {
+		Metric    string   `json:"metric"`
+		Reference *float64 `json:"reference,omitempty"`
+	}
+	if err := c.Bind(&req); err != nil {
+		return invalidBody(c, err)
+	}
+	if _, ok := metricColumns[req.Metric]; !ok {
+		return apiError(c, http.StatusBadRequest, "unknown metric "+req.Metric)
+	}
+
+	cmd, err := queueCommand(device.ID, "recalibrate", req)
+	if err != nil {
+		return internalError(c, err)
+	}
+	return c.JSON(http.StatusAccepted, cmd)
+}
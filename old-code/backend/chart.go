@@ -0,0 +1,404 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"html"
+	"image"
+	"image/color"
+	"image/png"
+	"math"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/labstack/echo/v4"
+)
+
+// Charts are rendered on the server for what cannot run the SPA: chat
+// notifications, the weekly e-mail and e-ink displays.
+// GET /api/sensor-data/chart.png (or .svg) charts one metric,
+// ?metric=co2&from=...&to=... (RFC 3339, the last 24 hours by default),
+// averaged per bucket; &width= and &height= set the size. The PNG is black
+// on white with numeric labels only, for e-ink; the SVG is labelled fully.
+//
+// Images linked from messages cannot send a session, so chartURL signs
+// the chart into a ?t= token, valid for CHART_LINK_TTL, that is accepted
+// instead of a login. The token names the household, so a link works only
+// on the server of the household it was made for.
+
+type chartSpec struct {
+	Metric    string    `json:"m"`
+	From      time.Time `json:"f"`
+	To        time.Time `json:"t"`
+	Width     int       `json:"w"`
+	Height    int       `json:"h"`
+	Expires   time.Time `json:"e,omitempty"`
+	Household string    `json:"hh,omitempty"`
+}
+
+const chartPad = 44 // room for the labels around the plot
+
+func chartSpecFromRequest(c echo.Context) (chartSpec, string) {
+	if t := c.QueryParam("t"); t != "" {
+		spec, ok := verifyChartToken(t)
+		if !ok {
+			return spec, "invalid or expired chart link"
+		}
+		return spec, ""
+	}
+
+	now := time.Now()
+	spec := chartSpec{Metric: c.QueryParam("metric"), From: now.Add(-24 * time.Hour), To: now, Width: 600, Height: 300}
+	if spec.Metric == "" {
+		spec.Metric = "co2"
+	}
+	if !knownMetric(spec.Metric) {
+		return spec, "unknown metric"
+	}
+	var err error
+	if v := c.QueryParam("from"); v != "" {
+		if spec.From, err = time.Parse(time.RFC3339, v); err != nil {
+			return spec, "from must be an RFC 3339 time"
+		}
+	}
+	if v := c.QueryParam("to"); v != "" {
+		if spec.To, err = time.Parse(time.RFC3339, v); err != nil {
+			return spec, "to must be an RFC 3339 time"
+		}
+	}
+	if !spec.To.After(spec.From) {
+		return spec, "to must be after from"
+	}
+	for param, size := range map[string]*int{"width": &spec.Width, "height": &spec.Height} {
+		if v := c.QueryParam(param); v != "" {
+			n, err := strconv.Atoi(v)
+			if err != nil || n < 100 || n > 2000 {
+				return spec, param + " must be between 100 and 2000"
+			}
+			*size = n
+		}
+	}
+	return spec, ""
+}
+
+// chartURL links a signed PNG chart on DASHBOARD_URL, or is empty when
+// that is not set.
+func chartURL(metric string, from, to time.Time) string {
+	base := strings.TrimRight(envString("DASHBOARD_URL", ""), "/")
+	if base == "" {
+		return ""
+	}
+	spec := chartSpec{Metric: metric, From: from, To: to, Width: 600, Height: 300,
+		Expires: time.Now().Add(envDuration("CHART_LINK_TTL", 30*24*time.Hour)), Household: household}
+	payload, _ := json.Marshal(spec)
+	return base + "/api/sensor-data/chart.png?t=" + url.QueryEscape(signValue("chart", payload))
+}
+
+func verifyChartToken(token string) (chartSpec, bool) {
+	var spec chartSpec
+	payload, err := verifyValue("chart", token)
+	if err != nil || json.Unmarshal(payload, &spec) != nil {
+		return spec, false
+	}
+	return spec, spec.Household == household && time.Now().Before(spec.Expires)
+}
+
+// signedChartRequest lets a chart link through requireSession.
+func signedChartRequest(c echo.Context) bool {
+	if !strings.HasPrefix(c.Request().URL.Path, "/api/sensor-data/chart.") {
+		return false
+	}
+	_, ok := verifyChartToken(c.QueryParam("t"))
+	return ok
+}
+
+// chartPoints averages the metric into about one bucket per two pixels.
+func chartPoints(ctx context.Context, spec chartSpec) ([]Point, time.Duration, error) {
+	step := spec.To.Sub(spec.From) / time.Duration(max(spec.Width/2, 1))
+	step = max(step.Round(time.Minute), time.Minute)
+	points, err := bucketedSeries(ctx, spec.Metric, spec.From, spec.To, step)
+	return points, step, err
+}
+
+// chartScale returns the value range and the gridline step of the y axis.
+func chartScale(points []Point) (lo, hi, grid float64) {
+	lo, hi = math.Inf(1), math.Inf(-1)
+	for _, p := range points {
+		lo, hi = math.Min(lo, p.Value), math.Max(hi, p.Value)
+	}
+	if len(points) == 0 {
+		lo, hi = 0, 1
+	}
+	if hi-lo < 1e-9 {
+		lo, hi = lo-1, hi+1
+	}
+	// A 1, 2 or 5 step giving about four gridlines
+	raw := (hi - lo) / 4
+	mag := math.Pow(10, math.Floor(math.Log10(raw)))
+	grid = mag * 10
+	for _, m := range []float64{1, 2, 5} {
+		if raw <= m*mag {
+			grid = m * mag
+			break
+		}
+	}
+	return math.Floor(lo/grid) * grid, math.Ceil(hi/grid) * grid, grid
+}
+
+func formatTick(v float64) string {
+	return strconv.FormatFloat(v, 'f', -1, 64)
+}
+
+// chartPlot maps points to pixel coordinates, split where data is missing.
+func chartPlot(spec chartSpec, points []Point, step time.Duration, lo, hi float64) [][]image.Point {
+	w, h := float64(spec.Width-2*chartPad), float64(spec.Height-2*chartPad)
+	span := spec.To.Sub(spec.From).Seconds()
+	var lines [][]image.Point
+	var last time.Time
+	for _, p := range points {
+		pt := image.Point{
+			X: chartPad + int(p.Timestamp.Sub(spec.From).Seconds()/span*w),
+			Y: chartPad + int((hi-p.Value)/(hi-lo)*h),
+		}
+		if len(lines) == 0 || p.Timestamp.Sub(last) > 3*step {
+			lines = append(lines, nil)
+		}
+		lines[len(lines)-1] = append(lines[len(lines)-1], pt)
+		last = p.Timestamp
+	}
+	return lines
+}
+
+// chartTimeTicks are four evenly spaced times on the x axis.
+func chartTimeTicks(spec chartSpec) []time.Time {
+	ticks := make([]time.Time, 5)
+	for i := range ticks {
+		ticks[i] = spec.From.Add(spec.To.Sub(spec.From) * time.Duration(i) / 4)
+	}
+	return ticks
+}
+
+func chartTimeLayout(spec chartSpec) string {
+	if spec.To.Sub(spec.From) > 48*time.Hour {
+		return "01-02"
+	}
+	return "15:04"
+}
+
+// chartGapSpans maps gaps to the x ranges they cover in the plot.
+func chartGapSpans(spec chartSpec, gaps []Gap) [][2]int {
+	w := float64(spec.Width - 2*chartPad)
+	span := spec.To.Sub(spec.From).Seconds()
+	x := func(t time.Time) int {
+		return chartPad + int(math.Max(0, math.Min(1, t.Sub(spec.From).Seconds()/span))*w)
+	}
+	spans := make([][2]int, 0, len(gaps))
+	for _, g := range gaps {
+		if a, b := x(g.From), x(g.To); b > a {
+			spans = append(spans, [2]int{a, b})
+		}
+	}
+	return spans
+}
+
+func renderChartSVG(spec chartSpec, points []Point, step time.Duration, gaps []Gap) []byte {
+	lo, hi, grid := chartScale(points)
+	w, h := spec.Width, spec.Height
+	var b bytes.Buffer
+	fmt.Fprintf(&b, `<svg xmlns="http://www.w3.org/2000/svg" width="%d" height="%d" viewBox="0 0 %d %d" font-family="sans-serif" font-size="11">`, w, h, w, h)
+	fmt.Fprintf(&b, `<rect width="%d" height="%d" fill="#fff"/>`, w, h)
+	for _, s := range chartGapSpans(spec, gaps) {
+		fmt.Fprintf(&b, `<rect x="%d" y="%d" width="%d" height="%d" fill="#f3f3f3"><title>no data</title></rect>`,
+			s[0], chartPad, s[1]-s[0], h-2*chartPad)
+	}
+	fmt.Fprintf(&b, `<text x="%d" y="20" font-size="13">%s, %s – %s</text>`, chartPad, html.EscapeString(spec.Metric),
+		spec.From.Local().Format("2006-01-02 15:04"), spec.To.Local().Format("2006-01-02 15:04"))
+	plotH := float64(h - 2*chartPad)
+	for v := lo; v <= hi+grid/2; v += grid {
+		y := chartPad + int((hi-v)/(hi-lo)*plotH)
+		fmt.Fprintf(&b, `<line x1="%d" y1="%d" x2="%d" y2="%d" stroke="#ddd"/>`, chartPad, y, w-chartPad, y)
+		fmt.Fprintf(&b, `<text x="%d" y="%d" text-anchor="end">%s</text>`, chartPad-4, y+4, formatTick(v))
+	}
+	for i, t := range chartTimeTicks(spec) {
+		x := chartPad + (w-2*chartPad)*i/4
+		fmt.Fprintf(&b, `<text x="%d" y="%d" text-anchor="middle">%s</text>`, x, h-chartPad+16, t.Local().Format(chartTimeLayout(spec)))
+	}
+	for _, line := range chartPlot(spec, points, step, lo, hi) {
+		coords := make([]string, len(line))
+		for i, p := range line {
+			coords[i] = fmt.Sprintf("%d,%d", p.X, p.Y)
+		}
+		fmt.Fprintf(&b, `<polyline points="%s" fill="none" stroke="#1565c0" stroke-width="2"/>`, strings.Join(coords, " "))
+	}
+	if len(points) == 0 {
+		fmt.Fprintf(&b, `<text x="%d" y="%d" text-anchor="middle" fill="#888">no data</text>`, w/2, h/2)
+	}
+	b.WriteString(`</svg>`)
+	return b.Bytes()
+}
+
+// chartGlyphs is a 3x5 pixel font for the labels of the PNG charts and the
+// display image: digits and the few letters they need.
+var chartGlyphs = map[rune][5]string{
+	'0': {"111", "101", "101", "101", "111"},
+	'1': {"010", "110", "010", "010", "111"},
+	'2': {"111", "001", "111", "100", "111"},
+	'3': {"111", "001", "111", "001", "111"},
+	'4': {"101", "101", "111", "001", "001"},
+	'5': {"111", "100", "111", "001", "111"},
+	'6': {"111", "100", "111", "101", "111"},
+	'7': {"111", "001", "001", "001", "001"},
+	'8': {"111", "101", "111", "101", "111"},
+	'9': {"111", "101", "111", "001", "111"},
+	':': {"000", "010", "000", "010", "000"},
+	'.': {"000", "000", "000", "000", "010"},
+	'-': {"000", "000", "111", "000", "000"},
+	'%': {"101", "001", "010", "100", "101"},
+	'°': {"010", "101", "010", "000", "000"},
+	'A': {"010", "101", "111", "101", "101"},
+	'B': {"110", "101", "110", "101", "110"},
+	'C': {"011", "100", "100", "100", "011"},
+	'D': {"110", "101", "101", "101", "110"},
+	'F': {"111", "100", "110", "100", "100"},
+	'I': {"111", "010", "010", "010", "111"},
+	'K': {"101", "101", "110", "101", "101"},
+	'L': {"100", "100", "100", "100", "111"},
+	'M': {"101", "111", "111", "101", "101"},
+	'O': {"010", "101", "101", "101", "010"},
+	'P': {"110", "101", "110", "100", "100"},
+	'R': {"110", "101", "110", "101", "101"},
+	'S': {"011", "100", "010", "001", "110"},
+}
+
+// chartTextWidth is the width of s drawn at scale.
+func chartTextWidth(s string, scale int) int {
+	return len([]rune(s)) * 4 * scale
+}
+
+// drawChartText draws s in black with its top left corner at x, y, each
+// font pixel scale x scale pixels. Characters without a glyph are blank.
+func drawChartText(img *image.Gray, s string, x, y, scale int) {
+	for i, r := range []rune(s) {
+		for row, bits := range chartGlyphs[r] {
+			for col, bit := range bits {
+				if bit != '1' {
+					continue
+				}
+				px, py := x+(i*4+col)*scale, y+row*scale
+				for dy := 0; dy < scale; dy++ {
+					for dx := 0; dx < scale; dx++ {
+						img.SetGray(px+dx, py+dy, color.Gray{})
+					}
+				}
+			}
+		}
+	}
+}
+
+// drawChartLine draws a line (Bresenham) width pixels thick.
+func drawChartLine(img *image.Gray, a, b image.Point, c color.Gray, width int) {
+	dx, dy := abs(b.X-a.X), -abs(b.Y-a.Y)
+	sx, sy := 1, 1
+	if a.X > b.X {
+		sx = -1
+	}
+	if a.Y > b.Y {
+		sy = -1
+	}
+	e := dx + dy
+	for {
+		for i := 0; i < width; i++ {
+			for j := 0; j < width; j++ {
+				img.SetGray(a.X+i, a.Y+j, c)
+			}
+		}
+		if a == b {
+			return
+		}
+		if e2 := 2 * e; e2 >= dy {
+			e += dy
+			a.X += sx
+		} else {
+			e += dx
+			a.Y += sy
+		}
+	}
+}
+
+func abs(n int) int {
+	if n < 0 {
+		return -n
+	}
+	return n
+}
+
+// drawChartImage renders the chart in shades of grey.
+func drawChartImage(spec chartSpec, points []Point, step time.Duration, gaps []Gap) *image.Gray {
+	lo, hi, grid := chartScale(points)
+	w, h := spec.Width, spec.Height
+	img := image.NewGray(image.Rect(0, 0, w, h))
+	for i := range img.Pix {
+		img.Pix[i] = 0xff
+	}
+	// Gaps are hatched in the grey of the gridlines, so they show on e-ink.
+	for _, s := range chartGapSpans(spec, gaps) {
+		for x := s[0]; x < s[1]; x += 6 {
+			drawChartLine(img, image.Pt(x, chartPad), image.Pt(x, h-chartPad), color.Gray{Y: 0xc0}, 1)
+		}
+	}
+	plotH := float64(h - 2*chartPad)
+	for v := lo; v <= hi+grid/2; v += grid {
+		y := chartPad + int((hi-v)/(hi-lo)*plotH)
+		drawChartLine(img, image.Pt(chartPad, y), image.Pt(w-chartPad, y), color.Gray{Y: 0xc0}, 1)
+		label := formatTick(v)
+		drawChartText(img, label, chartPad-4-chartTextWidth(label, 2), y-5, 2)
+	}
+	for i, t := range chartTimeTicks(spec) {
+		x := chartPad + (w-2*chartPad)*i/4
+		label := t.Local().Format(chartTimeLayout(spec))
+		drawChartText(img, label, x-chartTextWidth(label, 2)/2, h-chartPad+8, 2)
+	}
+	for _, line := range chartPlot(spec, points, step, lo, hi) {
+		for i := range line {
+			drawChartLine(img, line[max(i-1, 0)], line[i], color.Gray{}, 2)
+		}
+	}
+	return img
+}
+
+func renderChartPNG(spec chartSpec, points []Point, step time.Duration, gaps []Gap) ([]byte, error) {
+	var b bytes.Buffer
+	if err := png.Encode(&b, drawChartImage(spec, points, step, gaps)); err != nil {
+		return nil, err
+	}
+	return b.Bytes(), nil
+}
+
+func getSensorChart(c echo.Context) error {
+	spec, msg := chartSpecFromRequest(c)
+	if msg != "" {
+		return apiError(c, http.StatusBadRequest, msg)
+	}
+	points, step, err := chartPoints(c.Request().Context(), spec)
+	if err != nil {
+		return internalError(c, err)
+	}
+	gaps, err := findGaps(c.Request().Context(), spec.Metric, 0, spec.From, spec.To)
+	if err != nil {
+		return internalError(c, err)
+	}
+	c.Response().Header().Set("Cache-Control", "max-age=60")
+	if strings.HasSuffix(c.Request().URL.Path, ".svg") {
+		return c.Blob(http.StatusOK, "image/svg+xml", renderChartSVG(spec, points, step, gaps))
+	}
+	img, err := renderChartPNG(spec, points, step, gaps)
+	if err != nil {
+		return internalError(c, err)
+	}
+	return c.Blob(http.StatusOK, "image/png", img)
+}
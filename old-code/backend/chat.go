@@ -0,0 +1,131 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"sort"
+	"time"
+)
+
+// Discord (DISCORD_WEBHOOK_URL) and Slack (SLACK_WEBHOOK_URL) incoming
+// webhooks get notifications as rich messages: an embed or block with the
+// readings the notification was raised with, a link to the charts on
+// DASHBOARD_URL and, for a notification about a metric, a chart of its last
+// six hours. The colour follows the priority.
+
+// notificationChart is the chart image URL of a notification, if any.
+func notificationChart(n Notification) string {
+	if n.Chart == "" {
+		return ""
+	}
+	now := time.Now()
+	return chartURL(n.Chart, now.Add(-6*time.Hour), now)
+}
+
+// readingFields lists the readings of a notification, sorted by metric,
+// at most ten (Slack's limit of fields in a section).
+func readingFields(n Notification) [][2]string {
+	metrics := make([]string, 0, len(n.Readings))
+	for m := range n.Readings {
+		metrics = append(metrics, m)
+	}
+	sort.Strings(metrics)
+	if len(metrics) > 10 {
+		metrics = metrics[:10]
+	}
+	fields := make([][2]string, len(metrics))
+	for i, m := range metrics {
+		fields[i] = [2]string{m, fmt.Sprintf("%.1f", n.Readings[m])}
+	}
+	return fields
+}
+
+// priorityColor is red for critical, orange for high and grey otherwise.
+func priorityColor(priority int) int {
+	switch {
+	case priority >= 5:
+		return 0xd32f2f
+	case priority == 4:
+		return 0xf57c00
+	default:
+		return 0x607d8b
+	}
+}
+
+func postWebhookJSON(url string, payload interface{}) error {
+	body, err := json.Marshal(payload)
+	if err != nil {
+		return err
+	}
+	resp, err := notifyClient.Post(url, "application/json", bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode >= 300 {
+		return fmt.Errorf("webhook returned %s", resp.Status)
+	}
+	return nil
+}
+
+func sendDiscord(url string, n Notification) error {
+	type field struct {
+		Name   string `json:"name"`
+		Value  string `json:"value"`
+		Inline bool   `json:"inline"`
+	}
+	embed := map[string]interface{}{
+		"title":       n.Title,
+		"description": n.Message,
+		"color":       priorityColor(n.Priority),
+		"timestamp":   time.Now().Format(time.RFC3339),
+	}
+	var fields []field
+	for _, f := range readingFields(n) {
+		fields = append(fields, field{f[0], f[1], true})
+	}
+	if len(fields) > 0 {
+		embed["fields"] = fields
+	}
+	if link := envString("DASHBOARD_URL", ""); link != "" {
+		embed["url"] = link
+	}
+	if chart := notificationChart(n); chart != "" {
+		embed["image"] = map[string]string{"url": chart}
+	}
+	return postWebhookJSON(url, map[string]interface{}{
+		"username": envString("DISCORD_USERNAME", "Home"),
+		"embeds":   []interface{}{embed},
+	})
+}
+
+func sendSlack(url string, n Notification) error {
+	text := func(s string) map[string]string { return map[string]string{"type": "mrkdwn", "text": s} }
+	blocks := []interface{}{
+		map[string]interface{}{"type": "section", "text": text("*" + n.Title + "*\n" + n.Message)},
+	}
+	var fields []interface{}
+	for _, f := range readingFields(n) {
+		fields = append(fields, text("*"+f[0]+"*\n"+f[1]))
+	}
+	if len(fields) > 0 {
+		blocks = append(blocks, map[string]interface{}{"type": "section", "fields": fields})
+	}
+	if chart := notificationChart(n); chart != "" {
+		blocks = append(blocks, map[string]interface{}{"type": "image", "image_url": chart, "alt_text": n.Chart + " chart"})
+	}
+	if link := envString("DASHBOARD_URL", ""); link != "" {
+		blocks = append(blocks, map[string]interface{}{
+			"type": "context", "elements": []interface{}{text("<" + link + "|Charts>")},
+		})
+	}
+	// Blocks inside an attachment get the priority colour bar
+	return postWebhookJSON(url, map[string]interface{}{
+		"text": n.Title + ": " + n.Message,
+		"attachments": []interface{}{map[string]interface{}{
+			"color":  fmt.Sprintf("#%06x", priorityColor(n.Priority)),
+			"blocks": blocks,
+		}},
+	})
+}
@@ -0,0 +1,181 @@
+package main
+
+import (
+	"encoding/json"
+	"log"
+	"net/http"
+	"sync/atomic"
+	"time"
+
+	"github.com/labstack/echo/v4"
+)
+
+// With REDIS_URL set, several replicas of the server can run side by side,
+// e.g. two behind the reverse proxy for zero-downtime deploys. They share
+// the response cache (see cache.go) and coordinate over a Redis channel:
+//
+//   - events published on one replica reach the WebSocket clients of all
+//   - settings changed on one replica are reloaded by the others
+//   - one replica is the leader: it runs the scheduled jobs and the presence
+//     scan, stores what the Zigbee2MQTT and ESPHome bridges receive, and
+//     evaluates the rules; the others forward their readings to it and
+//     follow its presence state
+//
+// Leadership is a Redis key held for 30 seconds and renewed every 10, so
+// another replica takes over within 30 seconds of the leader stopping.
+// The alarm ring, the backup alarm and the pre-flight result are kept in the
+// database, so the leader's jobs and every replica's API see them.
+// Ventilation tracking stays with the replica that receives a device's
+// updates, so route /api/device/ to one replica (sticky by client IP) when
+// running several. HomeKit should be enabled on one replica only.
+
+const (
+	clusterLeaderTTL   = 30 * time.Second
+	clusterRenewPeriod = 10 * time.Second
+)
+
+type clusterMessage struct {
+	Origin   string             `json:"origin"`
+	Kind     string             `json:"kind"` // event | settings | readings | presence
+	Event    *Event             `json:"event,omitempty"`
+	Readings map[string]float64 `json:"readings,omitempty"`
+	Room     string             `json:"room,omitempty"`
+	People   []Person           `json:"people,omitempty"`
+}
+
+type clusterNode struct {
+	redis    *redisClient
+	instance string
+	leader   atomic.Bool
+	renewed  time.Time
+}
+
+var cluster *clusterNode
+
+func initCluster() {
+	rawURL := envString("REDIS_URL", "")
+	if rawURL == "" {
+		return
+	}
+	client, err := newRedisClient(rawURL)
+	if err != nil {
+		log.Printf("REDIS_URL is invalid, running as a single instance: %v", err)
+		return
+	}
+	cluster = &clusterNode{redis: client, instance: randomHex(8)}
+	cluster.elect()
+	go cluster.keepLeadership()
+	go cluster.subscribe()
+}
+
+// isLeader reports whether this replica does the work that must run once.
+// A single instance always does.
+func isLeader() bool {
+	return cluster == nil || cluster.leader.Load()
+}
+
+func clusterKey(name string) string {
+	return "home-server:" + household + ":" + name
+}
+
+// renewLeaderScript extends the lease only while this replica still holds it.
+const renewLeaderScript = `if redis.call("GET", KEYS[1]) == ARGV[1] then return redis.call("PEXPIRE", KEYS[1], ARGV[2]) else return 0 end`
+
+// elect takes or renews the leadership.
+func (n *clusterNode) elect() {
+	ttl := "30000"
+	var reply interface{}
+	var err error
+	if n.leader.Load() {
+		reply, err = n.redis.do("EVAL", renewLeaderScript, "1", clusterKey("leader"), n.instance, ttl)
+	} else {
+		reply, err = n.redis.do("SET", clusterKey("leader"), n.instance, "NX", "PX", ttl)
+	}
+	if err != nil {
+		// Without Redis nobody can take over before the lease runs out
+		if n.leader.Load() && time.Since(n.renewed) >= clusterLeaderTTL {
+			n.leader.Store(false)
+			log.Printf("Cluster: leadership lost, Redis is unreachable: %v", err)
+		}
+		return
+	}
+	leader := reply == "OK" || reply == int64(1)
+	if leader {
+		n.renewed = time.Now()
+	}
+	if leader != n.leader.Swap(leader) {
+		log.Printf("Cluster: instance %s leader: %v", n.instance, leader)
+	}
+}
+
+func (n *clusterNode) keepLeadership() {
+	for range time.Tick(clusterRenewPeriod) {
+		n.elect()
+	}
+}
+
+// subscribe keeps the channel subscription open, reconnecting with backoff.
+func (n *clusterNode) subscribe() {
+	backoff := 5 * time.Second
+	for {
+		start := time.Now()
+		err := redisSubscribe(n.redis.url, clusterKey("events"), n.receive)
+		if time.Since(start) > time.Minute {
+			backoff = 5 * time.Second
+		}
+		log.Printf("Cluster: Redis subscription lost: %v, retrying in %s", err, backoff)
+		time.Sleep(backoff)
+		backoff = min(backoff*2, 5*time.Minute)
+	}
+}
+
+func (n *clusterNode) receive(payload string) {
+	var msg clusterMessage
+	if err := json.Unmarshal([]byte(payload), &msg); err != nil || msg.Origin == n.instance {
+		return
+	}
+	switch msg.Kind {
+	case "event":
+		if msg.Event != nil {
+			deliver(*msg.Event)
+		}
+	case "settings":
+		if err := reloadSettings(); err != nil {
+			log.Printf("Cluster: reloading settings failed: %v", err)
+		}
+	case "readings":
+		if isLeader() {
+			go evaluateRules(msg.Room, msg.Readings)
+		}
+	case "presence":
+		if presence != nil && !isLeader() {
+			presence.follow(msg.People)
+		}
+	}
+}
+
+// clusterSend tells the other replicas; a no-op for a single instance.
+func clusterSend(msg clusterMessage) {
+	if cluster == nil {
+		return
+	}
+	msg.Origin = cluster.instance
+	payload, err := json.Marshal(msg)
+	if err == nil {
+		_, err = cluster.redis.do("PUBLISH", clusterKey("events"), string(payload))
+	}
+	if err != nil {
+		log.Printf("Cluster: sending %s failed: %v", msg.Kind, err)
+	}
+}
+
+func getCluster(c echo.Context) error {
+	if cluster == nil {
+		return c.JSON(http.StatusOK, map[string]interface{}{"enabled": false, "leader": true})
+	}
+	return c.JSON(http.StatusOK, map[string]interface{}{
+		"enabled":  true,
+		"instance": cluster.instance,
+		"leader":   isLeader(),
+	})
+}
@@ -0,0 +1,398 @@
+// Command device-emulator behaves like one alarm clock device against a
+// running server: it sends updates and heartbeats, holds and acknowledges
+// the alarm configuration, executes and acknowledges commands, installs OTA
+// updates and rings the alarm.
+//
+//	go run ./cmd/device-emulator -url http://localhost:8080 -device bedroom
+//
+// It runs until interrupted, or for -updates updates or -duration. With
+// -json it writes what happens as one JSON object per line on stdout, so an
+// integration test can run it next to the server and check the events; the
+// exit status is 1 when the server answered with an error and 2 for bad
+// flags.
+//
+// An "ota" command, {"url": ..., "version": ...}, is checked by downloading
+// the firmware: when that fails, or the version is the one running, the
+// command fails; otherwise it is acknowledged and the device reboots into
+// the new version, reporting "reset_reason": "ota". "reboot" and
+// "factory_reset" reboot it too, the latter forgetting its configuration.
+// Commands listed in -fail are reported as failed.
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"math"
+	"math/rand"
+	"net/http"
+	"os"
+	"os/signal"
+	"strconv"
+	"strings"
+	"time"
+)
+
+type command struct {
+	ID      int             `json:"id"`
+	Command string          `json:"command"`
+	Args    json.RawMessage `json:"args,omitempty"`
+}
+
+type commandResult struct {
+	ID    int    `json:"id"`
+	OK    bool   `json:"ok"`
+	Error string `json:"error,omitempty"`
+}
+
+type updateResponse struct {
+	Time           *string   `json:"time"`
+	Armed          *bool     `json:"armed"`
+	Unchanged      bool      `json:"unchanged"`
+	ConfigVersion  string    `json:"config_version"`
+	CurrentTime    int64     `json:"current_time"`
+	StopAlarm      bool      `json:"stop_alarm"`
+	SnoozeSeconds  int64     `json:"snooze_seconds"`
+	ReportInterval int       `json:"report_interval"`
+	CO2Band        string    `json:"co2_band"`
+	CO2Bands       *co2Bands `json:"co2_bands"`
+	Commands       []command `json:"commands"`
+}
+
+type co2Bands struct {
+	Yellow float64 `json:"yellow"`
+	Red    float64 `json:"red"`
+}
+
+type heartbeatResponse struct {
+	ConfigVersion string `json:"config_version"`
+	ConfigChanged bool   `json:"config_changed"`
+}
+
+// device is the emulated device's state, as the firmware keeps it.
+type device struct {
+	name     string
+	firmware string
+	co2      float64
+	sound    float64
+
+	booted      time.Time
+	resetReason string
+	seq         uint64
+
+	// The configuration it holds and has applied
+	alarm         string
+	armed         bool
+	configVersion string
+
+	ringing   time.Time
+	snoozedTo time.Time
+	rang      string // the day and time that rang, so it rings once
+
+	results  []commandResult
+	interval time.Duration // the server's report interval
+}
+
+type emulator struct {
+	base   string
+	key    string
+	client *http.Client
+	fail   map[string]bool
+	json   bool
+	dev    *device
+	errors int
+}
+
+// event logs what happened, as a JSON line with -json.
+func (e *emulator) event(kind string, fields map[string]interface{}) {
+	if !e.json {
+		var parts []string
+		for k, v := range fields {
+			parts = append(parts, fmt.Sprintf("%s=%v", k, v))
+		}
+		log.Printf("%s: %s %s", e.dev.name, kind, strings.Join(parts, " "))
+		return
+	}
+	if fields == nil {
+		fields = map[string]interface{}{}
+	}
+	fields["at"] = time.Now().UTC().Format(time.RFC3339)
+	fields["event"] = kind
+	fields["device"] = e.dev.name
+	b, _ := json.Marshal(fields)
+	fmt.Println(string(b))
+}
+
+func (e *emulator) post(path string, body, answer interface{}) error {
+	payload, err := json.Marshal(body)
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequest(http.MethodPost, e.base+path, bytes.NewReader(payload))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	if e.key != "" {
+		req.Header.Set("X-Device-Key", e.key)
+	}
+	resp, err := e.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		msg, _ := io.ReadAll(io.LimitReader(resp.Body, 512))
+		return fmt.Errorf("%s returned %s: %s", path, resp.Status, bytes.TrimSpace(msg))
+	}
+	return json.NewDecoder(resp.Body).Decode(answer)
+}
+
+// update sends a full update and acts on the response.
+func (e *emulator) update(now time.Time) error {
+	d := e.dev
+	d.seq++
+	body := map[string]interface{}{
+		"device":            d.name,
+		"seq":               d.seq,
+		"boot_id":           strconv.FormatInt(d.booted.UnixNano(), 36),
+		"config_version":    d.configVersion,
+		"config_ack":        d.configVersion,
+		"device_time":       now.Unix(),
+		"co2_level":         math.Round(d.co2 + rand.NormFloat64()*10),
+		"sound_level":       math.Round((d.sound+rand.NormFloat64())*10) / 10,
+		"alarm_active":      !d.ringing.IsZero(),
+		"alarm_active_time": 0,
+		"rssi":              math.Round(-60 + rand.NormFloat64()*3),
+		"free_heap":         190000 + rand.Intn(10000),
+		"uptime_seconds":    int64(now.Sub(d.booted).Seconds()),
+	}
+	if !d.ringing.IsZero() {
+		body["alarm_active_time"] = int64(now.Sub(d.ringing).Seconds())
+	}
+	if d.resetReason != "" {
+		body["reset_reason"] = d.resetReason
+	}
+	if len(d.results) > 0 {
+		body["command_results"] = d.results
+	}
+
+	var resp updateResponse
+	if err := e.post("/api/device/update", body, &resp); err != nil {
+		return err
+	}
+	e.event("update", map[string]interface{}{"seq": d.seq, "co2_level": body["co2_level"],
+		"alarm_active": body["alarm_active"], "acked": len(d.results), "co2_band": resp.CO2Band})
+	d.results, d.resetReason = nil, ""
+	if resp.ReportInterval > 0 {
+		d.interval = time.Duration(resp.ReportInterval) * time.Second
+	}
+	if !resp.Unchanged && resp.Time != nil && resp.Armed != nil {
+		d.alarm, d.armed = *resp.Time, *resp.Armed
+		config := map[string]interface{}{"version": resp.ConfigVersion, "time": d.alarm, "armed": d.armed}
+		if resp.CO2Bands != nil {
+			config["co2_yellow"], config["co2_red"] = resp.CO2Bands.Yellow, resp.CO2Bands.Red
+		}
+		e.event("config", config)
+	}
+	d.configVersion = resp.ConfigVersion
+
+	for _, cmd := range resp.Commands {
+		e.execute(cmd, now)
+	}
+	e.ring(now, resp.StopAlarm, time.Duration(resp.SnoozeSeconds)*time.Second)
+	return nil
+}
+
+// heartbeat pings the server and reports whether the configuration changed.
+func (e *emulator) heartbeat(now time.Time) (bool, error) {
+	d := e.dev
+	var resp heartbeatResponse
+	err := e.post("/api/device/heartbeat", map[string]interface{}{
+		"device":         d.name,
+		"config_version": d.configVersion,
+		"config_ack":     d.configVersion,
+		"device_time":    now.Unix(),
+	}, &resp)
+	if err != nil {
+		return false, err
+	}
+	e.event("heartbeat", map[string]interface{}{"config_changed": resp.ConfigChanged})
+	return resp.ConfigChanged, nil
+}
+
+// execute runs a command; its result goes out with the next update.
+func (e *emulator) execute(cmd command, now time.Time) {
+	d := e.dev
+	result := commandResult{ID: cmd.ID, OK: true}
+	switch {
+	case e.fail[cmd.Command]:
+		result = commandResult{ID: cmd.ID, Error: "failed by -fail"}
+	case cmd.Command == "reboot":
+		d.booted, d.resetReason = now, "software"
+	case cmd.Command == "factory_reset":
+		d.booted, d.resetReason = now, "software"
+		d.alarm, d.armed, d.configVersion = "", false, ""
+	case cmd.Command == "zero_calibrate_co2":
+		d.co2 = 420
+	case cmd.Command == "play_stream":
+	case cmd.Command == "ota":
+		if err := e.checkOTA(cmd.Args); err != nil {
+			result = commandResult{ID: cmd.ID, Error: err.Error()}
+			break
+		}
+		d.booted, d.resetReason = now, "ota"
+	default:
+		result = commandResult{ID: cmd.ID, Error: "unknown command " + cmd.Command}
+	}
+	e.event("command", map[string]interface{}{"id": cmd.ID, "command": cmd.Command, "ok": result.OK, "error": result.Error})
+	d.results = append(d.results, result)
+}
+
+// checkOTA downloads the firmware of an ota command and switches to it.
+func (e *emulator) checkOTA(args json.RawMessage) error {
+	var ota struct {
+		URL     string `json:"url"`
+		Version string `json:"version"`
+	}
+	if err := json.Unmarshal(args, &ota); err != nil || ota.URL == "" {
+		return fmt.Errorf("ota without a firmware url")
+	}
+	if ota.Version != "" && ota.Version == e.dev.firmware {
+		return fmt.Errorf("already running %s", ota.Version)
+	}
+	resp, err := e.client.Get(ota.URL)
+	if err != nil {
+		return fmt.Errorf("download failed: %v", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("download failed: %s", resp.Status)
+	}
+	n, err := io.Copy(io.Discard, resp.Body)
+	if err != nil {
+		return fmt.Errorf("download failed: %v", err)
+	}
+	if n == 0 {
+		return fmt.Errorf("empty firmware image")
+	}
+	e.event("ota", map[string]interface{}{"from": e.dev.firmware, "to": ota.Version, "bytes": n})
+	e.dev.firmware = ota.Version
+	return nil
+}
+
+// ring starts the armed alarm when it is due and stops or snoozes it as the
+// server says.
+func (e *emulator) ring(now time.Time, stop bool, snooze time.Duration) {
+	d := e.dev
+	if !d.ringing.IsZero() {
+		switch {
+		case snooze > 0:
+			d.ringing, d.snoozedTo = time.Time{}, now.Add(snooze)
+			e.event("alarm", map[string]interface{}{"state": "snoozed", "until": d.snoozedTo.Format("15:04:05")})
+		case stop:
+			d.ringing = time.Time{}
+			e.event("alarm", map[string]interface{}{"state": "stopped"})
+		}
+		return
+	}
+	due := d.armed && d.alarm == now.Format("15:04") && d.rang != now.Format("2006-01-02 15:04")
+	if due || !d.snoozedTo.IsZero() && !now.Before(d.snoozedTo) {
+		d.ringing, d.snoozedTo = now, time.Time{}
+		if due {
+			d.rang = now.Format("2006-01-02 15:04")
+		}
+		e.event("alarm", map[string]interface{}{"state": "ringing"})
+	}
+}
+
+func main() {
+	base := flag.String("url", "http://localhost:8080", "server to connect to")
+	name := flag.String("device", "emulator", "device name")
+	key := flag.String("key", os.Getenv("DEVICE_KEY"), "device key, for servers that require one")
+	interval := flag.Duration("interval", 0, "time between updates; by default the server's report interval")
+	heartbeat := flag.Duration("heartbeat", 0, "time between heartbeats, 0 for none")
+	updates := flag.Int("updates", 0, "stop after this many updates, 0 to run until interrupted")
+	duration := flag.Duration("duration", 0, "stop after this long, 0 to run until interrupted")
+	firmware := flag.String("firmware", "1.0.0", "firmware version the device starts with")
+	co2 := flag.Float64("co2", 650, "CO2 level to report, ppm")
+	sound := flag.Float64("sound", 35, "sound level to report, dB")
+	fail := flag.String("fail", "", "comma-separated commands to report as failed")
+	jsonOut := flag.Bool("json", false, "write events as JSON lines on stdout")
+	flag.Parse()
+
+	if *updates < 0 || *interval < 0 || *heartbeat < 0 {
+		fmt.Fprintln(os.Stderr, "-updates, -interval and -heartbeat must not be negative")
+		os.Exit(2)
+	}
+	now := time.Now()
+	e := &emulator{
+		base:   strings.TrimRight(*base, "/"),
+		key:    *key,
+		client: &http.Client{Timeout: 30 * time.Second},
+		fail:   make(map[string]bool),
+		json:   *jsonOut,
+		dev: &device{name: *name, firmware: *firmware, co2: *co2, sound: *sound,
+			booted: now, resetReason: "power_on", interval: 10 * time.Second},
+	}
+	for _, c := range strings.Split(*fail, ",") {
+		if c = strings.TrimSpace(c); c != "" {
+			e.fail[c] = true
+		}
+	}
+
+	stop := make(chan os.Signal, 1)
+	signal.Notify(stop, os.Interrupt)
+	var deadline <-chan time.Time
+	if *duration > 0 {
+		deadline = time.After(*duration)
+	}
+	var beats <-chan time.Time
+	if *heartbeat > 0 {
+		ticker := time.NewTicker(*heartbeat)
+		defer ticker.Stop()
+		beats = ticker.C
+	}
+
+	sent := 0
+	next := time.NewTimer(0)
+	for {
+		select {
+		case <-stop:
+			os.Exit(e.exitCode())
+		case <-deadline:
+			os.Exit(e.exitCode())
+		case now := <-beats:
+			changed, err := e.heartbeat(now)
+			if err != nil {
+				e.errors++
+				e.event("error", map[string]interface{}{"error": err.Error()})
+			} else if changed && next.Stop() {
+				next.Reset(0) // fetch the new configuration right away
+			}
+		case now := <-next.C:
+			if err := e.update(now); err != nil {
+				e.errors++
+				e.event("error", map[string]interface{}{"error": err.Error()})
+			}
+			if sent++; *updates > 0 && sent >= *updates {
+				os.Exit(e.exitCode())
+			}
+			wait := e.dev.interval
+			if *interval > 0 {
+				wait = *interval
+			}
+			next.Reset(wait)
+		}
+	}
+}
+
+func (e *emulator) exitCode() int {
+	if e.errors > 0 {
+		return 1
+	}
+	return 0
+}
@@ -0,0 +1,263 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"sort"
+	"time"
+
+	"github.com/labstack/echo/v4"
+)
+
+// Commands are queued for a device on the server and handed out in the
+// response to its next update, under "commands". A command is delivered
+// once; the device is expected to act on it in order and report the outcome
+// in a later update under "command_results". A command moves from queued to
+// delivered to acked or failed; one that is not acknowledged within
+// COMMAND_ACK_TIMEOUT of delivery fails. Commands of a group rollout (see
+// groups.go) wait until their not_before time and are cancelled when the
+// rollout halts.
+
+type DeviceCommand struct {
+	ID      int             `json:"id"`
+	Command string          `json:"command"`
+	Args    json.RawMessage `json:"args,omitempty"`
+}
+
+// CommandRecord is a command with its delivery status, as the API shows it.
+type CommandRecord struct {
+	DeviceCommand
+	Status      string     `json:"status"` // queued | delivered | acked | failed | cancelled
+	Error       string     `json:"error,omitempty"`
+	CreatedAt   time.Time  `json:"created_at"`
+	DeliveredAt *time.Time `json:"delivered_at,omitempty"`
+	CompletedAt *time.Time `json:"completed_at,omitempty"`
+}
+
+// CommandResult is a device's report on a command it executed.
+type CommandResult struct {
+	ID    int    `json:"id"`
+	OK    bool   `json:"ok"`
+	Error string `json:"error,omitempty"`
+}
+
+// deviceCommandSpecs are the commands that can be sent through
+// POST /api/devices/:id/commands. Destructive ones must be confirmed by
+// repeating the device name in "confirm".
+var deviceCommandSpecs = map[string]struct{ destructive bool }{
+	"reboot":             {false},
+	"zero_calibrate_co2": {true}, // only valid in fresh outdoor air
+	"factory_reset":      {true},
+	"ota":                {false}, // {"url": "https://.../firmware.bin", "version": "1.4.0"}
+	"play_stream":        {false}, // {"url": "http://.../stream.mp3", "volume": 10}
+}
+
+// validateCommandArgs checks the arguments of commands that need some.
+func validateCommandArgs(command string, args json.RawMessage) error {
+	if command == "play_stream" {
+		var play struct {
+			URL    string `json:"url"`
+			Volume int    `json:"volume"`
+		}
+		if err := json.Unmarshal(args, &play); err != nil {
+			return fmt.Errorf("play_stream needs args with the stream url")
+		}
+		if u, err := url.Parse(play.URL); err != nil || u.Scheme != "http" && u.Scheme != "https" || u.Host == "" {
+			return fmt.Errorf("play_stream needs an http(s) stream url")
+		}
+		if play.Volume < 0 || play.Volume > 100 {
+			return fmt.Errorf("volume must be between 0 and 100")
+		}
+		return nil
+	}
+	if command != "ota" {
+		return nil
+	}
+	var ota struct {
+		URL     string `json:"url"`
+		Version string `json:"version"`
+	}
+	if err := json.Unmarshal(args, &ota); err != nil {
+		return fmt.Errorf("ota needs args with the firmware url")
+	}
+	if u, err := url.Parse(ota.URL); err != nil || u.Scheme != "http" && u.Scheme != "https" || u.Host == "" {
+		return fmt.Errorf("ota needs an http(s) firmware url")
+	}
+	return nil
+}
+
+func queueCommand(deviceID int, command string, args interface{}) (DeviceCommand, error) {
+	cmd := DeviceCommand{Command: command}
+	if args != nil {
+		b, err := json.Marshal(args)
+		if err != nil {
+			return cmd, err
+		}
+		cmd.Args = b
+	}
+	err := db.QueryRow(`
+		INSERT INTO device_commands (device_id, command, args, created_at, status)
+		VALUES ($1, $2, $3, $4, 'queued')
+		RETURNING id
+	`, deviceID, command, nullableJSON(cmd.Args), time.Now()).Scan(&cmd.ID)
+	return cmd, err
+}
+
+func nullableJSON(b json.RawMessage) interface{} {
+	if len(b) == 0 {
+		return nil
+	}
+	return string(b)
+}
+
+// takePendingCommands marks the device's queued commands delivered and
+// returns them, oldest first.
+func takePendingCommands(deviceID int) ([]DeviceCommand, error) {
+	rows, err := db.Query(`
+		UPDATE device_commands SET delivered_at = $2, status = 'delivered'
+		WHERE device_id = $1 AND status = 'queued' AND (not_before IS NULL OR not_before <= $2)
+		RETURNING id, command, COALESCE(args, '')
+	`, deviceID, time.Now())
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	commands := []DeviceCommand{}
+	for rows.Next() {
+		var cmd DeviceCommand
+		var args string
+		if err := rows.Scan(&cmd.ID, &cmd.Command, &args); err != nil {
+			return nil, err
+		}
+		if args != "" {
+			cmd.Args = json.RawMessage(args)
+		}
+		commands = append(commands, cmd)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	sort.Slice(commands, func(i, j int) bool { return commands[i].ID < commands[j].ID })
+	return commands, nil
+}
+
+// ackCommands records the results a device reported for delivered commands.
+func ackCommands(ctx context.Context, deviceID int, results []CommandResult) error {
+	for _, r := range results {
+		status := "acked"
+		if !r.OK {
+			status = "failed"
+		}
+		_, err := db.ExecContext(ctx, `
+			UPDATE device_commands SET status = $3, error = NULLIF($4, ''), completed_at = $5
+			WHERE id = $1 AND device_id = $2 AND status IN ('queued', 'delivered')
+		`, r.ID, deviceID, status, r.Error, time.Now())
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// expireCommands is the command_timeout job.
+func expireCommands() error {
+	timeout := envDuration("COMMAND_ACK_TIMEOUT", 10*time.Minute)
+	_, err := db.Exec(`
+		UPDATE device_commands SET status = 'failed', error = $2, completed_at = NOW()
+		WHERE status = 'delivered' AND delivered_at < $1
+	`, time.Now().Add(-timeout), fmt.Sprintf("not acknowledged within %s", timeout))
+	if err != nil {
+		return err
+	}
+	return haltFailedRollouts()
+}
+
+func loadCommandRecords(ctx context.Context, deviceID, limit int) ([]CommandRecord, error) {
+	rows, err := db.QueryContext(ctx, `
+		SELECT id, command, COALESCE(args, ''), status, COALESCE(error, ''), created_at, delivered_at, completed_at
+		FROM device_commands WHERE device_id = $1
+		ORDER BY id DESC LIMIT $2
+	`, deviceID, limit)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	records := []CommandRecord{}
+	for rows.Next() {
+		var r CommandRecord
+		var args string
+		var delivered, completed sql.NullTime
+		if err := rows.Scan(&r.ID, &r.Command, &args, &r.Status, &r.Error, &r.CreatedAt, &delivered, &completed); err != nil {
+			return nil, err
+		}
+		if args != "" {
+			r.Args = json.RawMessage(args)
+		}
+		if delivered.Valid {
+			r.DeliveredAt = &delivered.Time
+		}
+		if completed.Valid {
+			r.CompletedAt = &completed.Time
+		}
+		records = append(records, r)
+	}
+	return records, rows.Err()
+}
+
+func getDeviceCommands(c echo.Context) error {
+	device, err := deviceFromParam(c)
+	if err != nil {
+		return handlerError(c, err)
+	}
+	records, err := loadCommandRecords(c.Request().Context(), device.ID, 100)
+	if err != nil {
+		return internalError(c, err)
+	}
+	return c.JSON(http.StatusOK, records)
+}
+
+// postDeviceCommand queues one of deviceCommandSpecs:
+// {"command": "factory_reset", "confirm": "bedroom"}.
+func postDeviceCommand(c echo.Context) error {
+	device, err := deviceFromParam(c)
+	if err != nil {
+		return handlerError(c, err)
+	}
+	var req struct {
+		Command string          `json:"command"`
+		Args    json.RawMessage `json:"args"`
+		Confirm string          `json:"confirm"`
+	}
+	if err := c.Bind(&req); err != nil {
+		return invalidBody(c, err)
+	}
+	spec, ok := deviceCommandSpecs[req.Command]
+	if !ok {
+		return apiError(c, http.StatusBadRequest, "unknown command "+req.Command)
+	}
+	if err := validateCommandArgs(req.Command, req.Args); err != nil {
+		return apiError(c, http.StatusBadRequest, err.Error())
+	}
+	if spec.destructive && req.Confirm != device.Name {
+		return c.JSON(http.StatusPreconditionRequired, map[string]string{
+			"code":  "confirmation_required",
+			"error": fmt.Sprintf("%s cannot be undone, repeat the request with \"confirm\": %q", req.Command, device.Name),
+		})
+	}
+
+	var args interface{}
+	if len(req.Args) > 0 && string(req.Args) != "null" {
+		args = req.Args
+	}
+	cmd, err := queueCommand(device.ID, req.Command, args)
+	if err != nil {
+		return internalError(c, err)
+	}
+	return c.JSON(http.StatusAccepted, CommandRecord{DeviceCommand: cmd, Status: "queued", CreatedAt: time.Now()})
+}
@@ -0,0 +1,114 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"math"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/labstack/echo/v4"
+)
+
+// Aggregates summarises a metric over one period.
+type Aggregates struct {
+	From    time.Time `json:"from"`
+	To      time.Time `json:"to"`
+	Samples int       `json:"samples"`
+	Avg     *float64  `json:"avg"`
+	Min     *float64  `json:"min"`
+	Max     *float64  `json:"max"`
+	P50     *float64  `json:"p50,omitempty"`
+	P90     *float64  `json:"p90,omitempty"`
+	P99     *float64  `json:"p99,omitempty"`
+}
+
+// Comparison puts the current period next to the one before it. Deltas are
+// percentages and null when the previous period has no data.
+type Comparison struct {
+	Metric   string              `json:"metric"`
+	Unit     string              `json:"unit,omitempty"`
+	Period   string              `json:"period"`
+	Room     string              `json:"room,omitempty"`
+	Current  Aggregates          `json:"current"`
+	Previous Aggregates          `json:"previous"`
+	DeltaPct map[string]*float64 `json:"delta_pct"`
+}
+
+var comparePeriods = map[string]time.Duration{
+	"day":   24 * time.Hour,
+	"week":  7 * 24 * time.Hour,
+	"month": 30 * 24 * time.Hour,
+}
+
+// aggregate computes the aggregates of a metric in [from, to), optionally
+// for the devices of one room. Samples, avg, min and max come from the
+// rollups; percentiles need every sample and are only computed on request.
+func aggregate(ctx context.Context, metric, room string, from, to time.Time, percentiles bool) (Aggregates, error) {
+	a, err := rollupAggregates(ctx, metric, room, from, to)
+	if err != nil || !percentiles {
+		return a, err
+	}
+	samples, args := metricSampleQuery(metric, room, from, to)
+	columns := []string{}
+	for _, fn := range []string{"p50", "p90", "p99"} {
+		columns = append(columns, fmt.Sprintf(aggregateFunctions[fn], "value"))
+	}
+	query := `SELECT ` + strings.Join(columns, ", ") + ` FROM (` + samples + `) samples`
+	err = db.QueryRowContext(ctx, query, args...).Scan(&a.P50, &a.P90, &a.P99)
+	return a, err
+}
+
+func percentDelta(cur, prev *float64) *float64 {
+	if cur == nil || prev == nil || *prev == 0 {
+		return nil
+	}
+	d := math.Round((*cur-*prev)/math.Abs(*prev)*1000) / 10
+	return &d
+}
+
+// getSensorCompare compares the last ?period (day, week or month) of a
+// metric with the period before it: ?metric=co2&period=week&room=bedroom,
+// with &percentiles=true also p50, p90 and p99.
+func getSensorCompare(c echo.Context) error {
+	metric := c.QueryParam("metric")
+	if metric == "" {
+		metric = "co2"
+	}
+	if !knownMetric(metric) {
+		return apiError(c, http.StatusBadRequest, "unknown metric")
+	}
+	period := c.QueryParam("period")
+	if period == "" {
+		period = "week"
+	}
+	length, ok := comparePeriods[period]
+	if !ok {
+		return apiError(c, http.StatusBadRequest, "period must be day, week or month")
+	}
+
+	now := time.Now()
+	cmp := Comparison{Metric: metric, Period: period, Room: c.QueryParam("room")}
+	ctx := c.Request().Context()
+	percentiles := c.QueryParam("percentiles") == "true"
+	var err error
+	if cmp.Unit, err = metricUnit(ctx, metric); err != nil {
+		return internalError(c, err)
+	}
+	if cmp.Current, err = aggregate(ctx, metric, cmp.Room, now.Add(-length), now, percentiles); err != nil {
+		return internalError(c, err)
+	}
+	if cmp.Previous, err = aggregate(ctx, metric, cmp.Room, now.Add(-2*length), now.Add(-length), percentiles); err != nil {
+		return internalError(c, err)
+	}
+	cmp.DeltaPct = map[string]*float64{
+		"avg": percentDelta(cmp.Current.Avg, cmp.Previous.Avg),
+		"min": percentDelta(cmp.Current.Min, cmp.Previous.Min),
+		"max": percentDelta(cmp.Current.Max, cmp.Previous.Max),
+		"p50": percentDelta(cmp.Current.P50, cmp.Previous.P50),
+		"p90": percentDelta(cmp.Current.P90, cmp.Previous.P90),
+		"p99": percentDelta(cmp.Current.P99, cmp.Previous.P99),
+	}
+	return c.JSON(http.StatusOK, cmp)
+}
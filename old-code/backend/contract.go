@@ -0,0 +1,237 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"time"
+
+	"github.com/labstack/echo/v4"
+)
+
+// GET /api/contract/examples returns a canonical request and response for
+// every device-facing endpoint, for the firmware's CI to check its
+// serializer against the server it talks to instead of hardcoded copies.
+// The examples are built from the same types the handlers decode and
+// encode, so they change with the protocol. deviceProtocolVersion goes up
+// when a change would break firmware that is already deployed; adding an
+// optional field does not. The endpoint needs no session, as it holds
+// nothing but made-up values.
+
+const deviceProtocolVersion = 1
+
+type ContractExample struct {
+	Name        string      `json:"name"`
+	Method      string      `json:"method"`
+	Path        string      `json:"path"`
+	Description string      `json:"description"`
+	Headers     []string    `json:"headers,omitempty"` // request headers besides Content-Type
+	Request     interface{} `json:"request,omitempty"`
+	Status      int         `json:"status"`
+	ContentType string      `json:"content_type"`
+	Response    interface{} `json:"response,omitempty"`
+}
+
+func contractExamples() []ContractExample {
+	deviceTime := int64(1718006400)
+	errorCode := "SENSOR_TIMEOUT"
+	f := func(v float64) *float64 { return &v }
+	seq := uint64(1042)
+
+	update := DeviceUpdate{
+		Device:          "bedroom",
+		Seq:             &seq,
+		BootID:          "7f3a91c2",
+		ConfigVersion:   "1a2b3c4d",
+		ConfigAck:       "1a2b3c4d",
+		DeviceTime:      &deviceTime,
+		CO2Level:        812,
+		SoundLevel:      34.5,
+		AlarmActive:     false,
+		AlarmActiveTime: 0,
+		RSSI:            f(-61),
+		BatteryPct:      f(87),
+		FreeHeap:        f(182344),
+		UptimeSeconds:   f(86400),
+		CommandResults:  []CommandResult{{ID: 41, OK: true}, {ID: 42, Error: "sensor busy"}},
+		Samples: []BufferedSample{
+			{Time: deviceTime - 120, CO2Level: 805, SoundLevel: 33.9},
+			{Time: deviceTime - 60, CO2Level: 809, SoundLevel: 35.2, Metrics: map[string]float64{"temperature": 21.4}},
+		},
+		BufferSeconds: 86400,
+	}
+	alarm, armed, configured, sound := "06:30", true, true, "/api/device/alarm-sound?v=9c1e4a7b"
+	updated := DeviceUpdateResponse{
+		Time:            &alarm,
+		Armed:           &armed,
+		AlarmConfigured: &configured,
+		Sound:           &sound,
+		ConfigVersion:   "5e6f7a8b",
+		CurrentTime:     deviceTime + 1,
+		ReportInterval:  60,
+		SampleInterval:  10,
+		CO2Band:         "green",
+		CO2Bands:        &CO2Bands{Yellow: 1000, Red: 1400},
+		Commands: []DeviceCommand{
+			{ID: 43, Command: "reboot"},
+			{ID: 44, Command: "ota", Args: json.RawMessage(`{"url":"https://home.local/firmware/1.4.0.bin","version":"1.4.0"}`)},
+		},
+		Backfill: []BackfillRequest{{ID: 7, From: deviceTime - 7200, To: deviceTime - 3600}},
+	}
+
+	ringing := update
+	ringing.ConfigVersion, ringing.ConfigAck = "5e6f7a8b", "5e6f7a8b"
+	ringing.AlarmActive, ringing.AlarmActiveTime = true, 95
+	ringing.ErrorCode = &errorCode
+	ringing.CO2Level = 0
+	ringing.CommandResults, ringing.Samples, ringing.BufferSeconds = nil, nil, 0
+	ringing.RSSI, ringing.BatteryPct, ringing.FreeHeap, ringing.UptimeSeconds = nil, nil, nil, nil
+	unchanged := DeviceUpdateResponse{
+		Unchanged:      true,
+		ConfigVersion:  "5e6f7a8b",
+		CurrentTime:    deviceTime + 1,
+		StopAlarm:      true,
+		SnoozeSeconds:  540,
+		ReportInterval: 60,
+		SampleInterval: 10,
+		CO2Band:        "unknown",
+	}
+
+	return []ContractExample{
+		{
+			Name:        "update",
+			Method:      http.MethodPost,
+			Path:        "/api/device/update",
+			Description: "A full update with telemetry, command results and buffered samples, from a device holding an old configuration",
+			Headers:     []string{"X-Device-Key"},
+			Request:     update,
+			Status:      http.StatusOK,
+			ContentType: echo.MIMEApplicationJSON,
+			Response:    updated,
+		},
+		{
+			Name:        "update_unchanged",
+			Method:      http.MethodPost,
+			Path:        "/api/device/update",
+			Description: "An update while the alarm rings with a sensor error, from a device holding the current configuration; the alarm is snoozed",
+			Headers:     []string{"X-Device-Key"},
+			Request:     ringing,
+			Status:      http.StatusOK,
+			ContentType: echo.MIMEApplicationJSON,
+			Response:    unchanged,
+		},
+		{
+			Name:        "heartbeat",
+			Method:      http.MethodPost,
+			Path:        "/api/device/heartbeat",
+			Description: "A ping between updates; config_changed asks the device to send an update for the new configuration",
+			Headers:     []string{"X-Device-Key"},
+			Request: map[string]interface{}{
+				"device": "bedroom", "config_version": "1a2b3c4d", "config_ack": "1a2b3c4d", "device_time": deviceTime,
+			},
+			Status:      http.StatusOK,
+			ContentType: echo.MIMEApplicationJSON,
+			Response:    map[string]interface{}{"current_time": deviceTime + 1, "config_version": "5e6f7a8b", "config_changed": true},
+		},
+		{
+			Name:        "backfill",
+			Method:      http.MethodPost,
+			Path:        "/api/device/backfill",
+			Description: "The buffered samples of a backfill request from an update response",
+			Headers:     []string{"X-Device-Key"},
+			Request: map[string]interface{}{
+				"device": "bedroom", "backfill_id": 7, "device_time": deviceTime,
+				"samples": []BufferedSample{
+					{Time: deviceTime - 7140, CO2Level: 620, SoundLevel: 31.2},
+					{Time: deviceTime - 7080, CO2Level: 624, SoundLevel: 30.8},
+				},
+				"done": true,
+			},
+			Status:      http.StatusOK,
+			ContentType: echo.MIMEApplicationJSON,
+			Response:    map[string]interface{}{"backfill_id": 7, "status": "resolved", "samples": 2},
+		},
+		{
+			Name:        "logs",
+			Method:      http.MethodPost,
+			Path:        "/api/device/logs",
+			Description: "A batch of log lines",
+			Headers:     []string{"X-Device-Key"},
+			Request: map[string]interface{}{
+				"device": "bedroom",
+				"lines": []map[string]interface{}{
+					{"level": "info", "message": "wifi connected", "device_time": deviceTime - 30},
+					{"level": "warn", "message": "co2 sensor timeout, retrying", "device_time": deviceTime},
+				},
+			},
+			Status:      http.StatusAccepted,
+			ContentType: echo.MIMEApplicationJSON,
+			Response:    map[string]int{"stored": 2},
+		},
+		{
+			Name:        "claim",
+			Method:      http.MethodPost,
+			Path:        "/api/device/claim",
+			Description: "Pairing a new node with the code typed into its setup portal; it sends api_key as X-Device-Key from then on",
+			Request:     map[string]string{"code": "482913", "mac": "a4:cf:12:9b:3e:01"},
+			Status:      http.StatusOK,
+			ContentType: echo.MIMEApplicationJSON,
+			Response: map[string]interface{}{
+				"device_id": 3, "device": "node_9b3e01", "room": "bedroom", "api_key": "6f1d0c3b9a8e7d6c5b4a39281706f5e4d3c2b1a0f9e8d7c6",
+			},
+		},
+		{
+			Name:        "alarm_sound",
+			Method:      http.MethodGet,
+			Path:        "/api/device/alarm-sound?v=9c1e4a7b",
+			Description: "The selected alarm sound as audio; Range and If-None-Match requests are supported",
+			Headers:     []string{"X-Device-Key"},
+			Status:      http.StatusOK,
+			ContentType: "audio/mpeg",
+		},
+		{
+			Name:        "briefing",
+			Method:      http.MethodGet,
+			Path:        "/api/device/briefing?device=bedroom",
+			Description: "The morning briefing; ?format=text answers with the text only and ?format=audio with speech",
+			Headers:     []string{"X-Device-Key"},
+			Status:      http.StatusOK,
+			ContentType: echo.MIMEApplicationJSON,
+			Response: Briefing{
+				Text:        "Good morning. It is 6:30. Bedroom CO2 is 812 ppm.",
+				Sections:    map[string]string{"greeting": "Good morning. It is 6:30.", "indoor": "Bedroom CO2 is 812 ppm."},
+				GeneratedAt: time.Unix(deviceTime, 0).UTC(),
+			},
+		},
+		{
+			Name:        "error",
+			Method:      http.MethodPost,
+			Path:        "/api/device/update",
+			Description: "Every error has the same envelope: a stable code and a message for people",
+			Request:     map[string]interface{}{"device": "bedroom", "co2_level": 812, "sound_level": 34.5},
+			Status:      http.StatusUnauthorized,
+			ContentType: echo.MIMEApplicationJSON,
+			Response:    map[string]string{"code": statusCode(http.StatusUnauthorized), "error": "missing or invalid device key"},
+		},
+	}
+}
+
+// getContractExamples serves the examples, or only ?name=.
+func getContractExamples(c echo.Context) error {
+	examples := contractExamples()
+	if name := c.QueryParam("name"); name != "" {
+		var matched []ContractExample
+		for _, e := range examples {
+			if e.Name == name {
+				matched = append(matched, e)
+			}
+		}
+		if matched == nil {
+			return apiError(c, http.StatusNotFound, "no such example")
+		}
+		examples = matched
+	}
+	return c.JSON(http.StatusOK, map[string]interface{}{
+		"protocol_version": deviceProtocolVersion,
+		"examples":         examples,
+	})
+}
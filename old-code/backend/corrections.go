@@ -0,0 +1,340 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"log"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/labstack/echo/v4"
+)
+
+// Bad readings (a CO2 sensor glitching to 5000 ppm) can be taken out of
+// charts, aggregates and reports without losing them. A correction covers a
+// metric in [from, to), optionally one device and only values above a
+// limit. The affected values are copied to corrected_samples and hidden:
+// co2 and sound are zeroed in sensor_data, which every query already treats
+// as "no reading", other metrics are removed from metric_samples. Restoring
+// the correction puts them back, as far as retention (retention.go) has not
+// deleted their sensor_data rows in the meantime. Every correction is kept
+// as an audit trail in sample_corrections.
+
+type SampleCorrection struct {
+	ID         int        `json:"id"`
+	Action     string     `json:"action"` // deleted | invalid
+	Metric     string     `json:"metric"`
+	DeviceID   *int       `json:"device_id,omitempty"`
+	From       time.Time  `json:"from"`
+	To         time.Time  `json:"to"`
+	Above      *float64   `json:"above,omitempty"`
+	Reason     string     `json:"reason,omitempty"`
+	Samples    int64      `json:"samples"`
+	CreatedBy  string     `json:"created_by"`
+	CreatedAt  time.Time  `json:"created_at"`
+	RestoredAt *time.Time `json:"restored_at,omitempty"`
+}
+
+func correctionActor(c echo.Context) string {
+	if s := currentSession(c); s != nil {
+		if s.Email != "" {
+			return s.Email
+		}
+		return s.Subject
+	}
+	return "admin"
+}
+
+// applyCorrection hides the samples a correction covers and records it.
+func applyCorrection(ctx context.Context, corr *SampleCorrection) error {
+	tx, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	err = tx.QueryRowContext(ctx, `
+		INSERT INTO sample_corrections (action, metric, device_id, from_ts, to_ts, above, reason, samples, created_by, created_at)
+		VALUES ($1, $2, $3, $4, $5, $6, NULLIF($7, ''), 0, $8, $9)
+		RETURNING id
+	`, corr.Action, corr.Metric, corr.DeviceID, corr.From, corr.To, corr.Above, corr.Reason, corr.CreatedBy, corr.CreatedAt).Scan(&corr.ID)
+	if err != nil {
+		return err
+	}
+
+	args := []interface{}{corr.ID, corr.From, corr.To, corr.DeviceID, corr.Above}
+	var res sql.Result
+	if column, ok := metricColumns[corr.Metric]; ok {
+		filter := `timestamp >= $2 AND timestamp < $3 AND ($4::INTEGER IS NULL OR device_id = $4)
+			AND ($5::FLOAT IS NULL OR ` + column + ` > $5) AND ` + column + ` != 0`
+		if _, err := tx.ExecContext(ctx, `
+			INSERT INTO corrected_samples (correction_id, sample_id, device_id, timestamp, value)
+			SELECT $1, id, device_id, timestamp, `+column+` FROM sensor_data WHERE `+filter,
+			args...); err != nil {
+			return err
+		}
+		res, err = tx.ExecContext(ctx, `
+			UPDATE sensor_data SET `+column+` = 0
+			WHERE id IN (SELECT sample_id FROM corrected_samples WHERE correction_id = $1)
+		`, corr.ID)
+	} else {
+		args = append(args, corr.Metric)
+		filter := `metric = $6 AND timestamp >= $2 AND timestamp < $3 AND ($4::INTEGER IS NULL OR device_id = $4)
+			AND ($5::FLOAT IS NULL OR value > $5)`
+		if _, err := tx.ExecContext(ctx, `
+			INSERT INTO corrected_samples (correction_id, sample_id, device_id, timestamp, value)
+			SELECT $1, id, device_id, timestamp, value FROM metric_samples WHERE `+filter,
+			args...); err != nil {
+			return err
+		}
+		res, err = tx.ExecContext(ctx, `
+			DELETE FROM metric_samples
+			WHERE id IN (SELECT sample_id FROM corrected_samples WHERE correction_id = $1)
+		`, corr.ID)
+	}
+	if err != nil {
+		return err
+	}
+	corr.Samples, _ = res.RowsAffected()
+	if _, err := tx.ExecContext(ctx, "UPDATE sample_corrections SET samples = $2 WHERE id = $1", corr.ID, corr.Samples); err != nil {
+		return err
+	}
+	if err := tx.Commit(); err != nil {
+		return err
+	}
+	log.Printf("%s marked %d %s samples %s (%s - %s)", corr.CreatedBy, corr.Samples, corr.Metric, corr.Action, corr.From, corr.To)
+	samplesCorrected()
+	return nil
+}
+
+// errCorrectionGone means none of a correction's samples can be restored,
+// their rows were deleted since.
+var errCorrectionGone = errors.New("the corrected samples no longer exist")
+
+// restoreCorrection puts the samples of a correction back. It returns how
+// many were restored and how many had their rows deleted since; with none
+// left it restores nothing and fails with errCorrectionGone.
+func restoreCorrection(ctx context.Context, id int) (restored, missing int64, err error) {
+	tx, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		return 0, 0, err
+	}
+	defer tx.Rollback()
+
+	var metric string
+	var total int64
+	err = tx.QueryRowContext(ctx, `
+		SELECT metric, (SELECT COUNT(*) FROM corrected_samples WHERE correction_id = $1)
+		FROM sample_corrections WHERE id = $1 AND restored_at IS NULL FOR UPDATE
+	`, id).Scan(&metric, &total)
+	if err != nil {
+		return 0, 0, err
+	}
+	if column, ok := metricColumns[metric]; ok {
+		var res sql.Result
+		res, err = tx.ExecContext(ctx, `
+			UPDATE sensor_data s SET `+column+` = c.value
+			FROM corrected_samples c WHERE c.correction_id = $1 AND s.id = c.sample_id
+		`, id)
+		if err == nil {
+			restored, err = res.RowsAffected()
+		}
+	} else {
+		// The samples themselves were moved to corrected_samples
+		_, err = tx.ExecContext(ctx, `
+			INSERT INTO metric_samples (metric, device_id, timestamp, value)
+			SELECT $2, device_id, timestamp, value FROM corrected_samples WHERE correction_id = $1
+			ON CONFLICT DO NOTHING
+		`, id, metric)
+		restored = total
+	}
+	if err != nil {
+		return 0, 0, err
+	}
+	if total > 0 && restored == 0 {
+		return 0, total, errCorrectionGone
+	}
+	if _, err := tx.ExecContext(ctx, "DELETE FROM corrected_samples WHERE correction_id = $1", id); err != nil {
+		return 0, 0, err
+	}
+	if _, err := tx.ExecContext(ctx, "UPDATE sample_corrections SET restored_at = $2 WHERE id = $1", id, time.Now()); err != nil {
+		return 0, 0, err
+	}
+	if err := tx.Commit(); err != nil {
+		return 0, 0, err
+	}
+	if restored < total {
+		log.Printf("Restored %d samples of correction %d, %d were deleted since", restored, id, total-restored)
+	}
+	samplesCorrected()
+	return restored, total - restored, nil
+}
+
+// samplesCorrected drops cached stats and rebuilds the rollups, which still
+// hold the samples as they were.
+func samplesCorrected() {
+	invalidateCache()
+	triggerJob("rollup_refresh")
+}
+
+// correctionFromParams reads from, to, metric, device_id and above.
+func correctionFromParams(from, to, metric, deviceID, above string) (SampleCorrection, string) {
+	corr := SampleCorrection{Metric: metric}
+	var err error
+	if corr.From, err = time.Parse(time.RFC3339, from); err != nil {
+		return corr, "from must be an RFC 3339 time"
+	}
+	if corr.To, err = time.Parse(time.RFC3339, to); err != nil {
+		return corr, "to must be an RFC 3339 time"
+	}
+	if !corr.To.After(corr.From) {
+		return corr, "to must be after from"
+	}
+	if !knownMetric(metric) {
+		return corr, "unknown metric"
+	}
+	if deviceID != "" {
+		id, err := strconv.Atoi(deviceID)
+		if err != nil {
+			return corr, "invalid device_id"
+		}
+		corr.DeviceID = &id
+	}
+	if above != "" {
+		v, err := strconv.ParseFloat(above, 64)
+		if err != nil {
+			return corr, "invalid above"
+		}
+		corr.Above = &v
+	}
+	// Timestamps are stored in server local time
+	corr.From, corr.To = corr.From.Local(), corr.To.Local()
+	return corr, ""
+}
+
+// deleteSensorData soft-deletes samples:
+// ?metric=co2&from=...&to=...&device_id=1&above=3000&reason=glitch.
+func deleteSensorData(c echo.Context) error {
+	corr, msg := correctionFromParams(c.QueryParam("from"), c.QueryParam("to"), c.QueryParam("metric"),
+		c.QueryParam("device_id"), c.QueryParam("above"))
+	if msg != "" {
+		return apiError(c, http.StatusBadRequest, msg)
+	}
+	corr.Action, corr.Reason = "deleted", c.QueryParam("reason")
+	corr.CreatedBy, corr.CreatedAt = correctionActor(c), time.Now()
+	if err := applyCorrection(c.Request().Context(), &corr); err != nil {
+		return internalError(c, err)
+	}
+	return c.JSON(http.StatusOK, corr)
+}
+
+// patchSensorData marks a range invalid,
+// {"metric": "co2", "from": "...", "to": "...", "invalid": true, "reason": "..."},
+// or with "invalid": false restores the corrections of the metric that
+// overlap it. Corrections whose samples were deleted since are listed as
+// gone and stay unrestored.
+func patchSensorData(c echo.Context) error {
+	var req struct {
+		Metric   string   `json:"metric"`
+		From     string   `json:"from"`
+		To       string   `json:"to"`
+		DeviceID *int     `json:"device_id"`
+		Above    *float64 `json:"above"`
+		Invalid  *bool    `json:"invalid"`
+		Reason   string   `json:"reason"`
+	}
+	if err := c.Bind(&req); err != nil {
+		return invalidBody(c, err)
+	}
+	if req.Invalid == nil {
+		return apiError(c, http.StatusBadRequest, "invalid must be true or false")
+	}
+	corr, msg := correctionFromParams(req.From, req.To, req.Metric, "", "")
+	if msg != "" {
+		return apiError(c, http.StatusBadRequest, msg)
+	}
+	corr.DeviceID, corr.Above = req.DeviceID, req.Above
+	ctx := c.Request().Context()
+
+	if *req.Invalid {
+		corr.Action, corr.Reason = "invalid", req.Reason
+		corr.CreatedBy, corr.CreatedAt = correctionActor(c), time.Now()
+		if err := applyCorrection(ctx, &corr); err != nil {
+			return internalError(c, err)
+		}
+		return c.JSON(http.StatusOK, corr)
+	}
+
+	rows, err := db.QueryContext(ctx, `
+		SELECT id FROM sample_corrections
+		WHERE metric = $1 AND restored_at IS NULL AND from_ts < $3 AND to_ts > $2
+	`, corr.Metric, corr.From, corr.To)
+	if err != nil {
+		return internalError(c, err)
+	}
+	var ids []int
+	for rows.Next() {
+		var id int
+		if err := rows.Scan(&id); err != nil {
+			rows.Close()
+			return internalError(c, err)
+		}
+		ids = append(ids, id)
+	}
+	rows.Close()
+	restored, gone := []int{}, []int{}
+	for _, id := range ids {
+		_, _, err := restoreCorrection(ctx, id)
+		if err == errCorrectionGone {
+			gone = append(gone, id)
+			continue
+		} else if err != nil {
+			return internalError(c, err)
+		}
+		restored = append(restored, id)
+	}
+	return c.JSON(http.StatusOK, map[string][]int{"restored": restored, "gone": gone})
+}
+
+func getSampleCorrections(c echo.Context) error {
+	rows, err := db.QueryContext(c.Request().Context(), `
+		SELECT id, action, metric, device_id, from_ts, to_ts, above, COALESCE(reason, ''), samples, created_by, created_at, restored_at
+		FROM sample_corrections
+		ORDER BY id DESC
+		LIMIT 200
+	`)
+	if err != nil {
+		return internalError(c, err)
+	}
+	defer rows.Close()
+
+	list := []SampleCorrection{}
+	for rows.Next() {
+		var corr SampleCorrection
+		if err := rows.Scan(&corr.ID, &corr.Action, &corr.Metric, &corr.DeviceID, &corr.From, &corr.To, &corr.Above,
+			&corr.Reason, &corr.Samples, &corr.CreatedBy, &corr.CreatedAt, &corr.RestoredAt); err != nil {
+			return internalError(c, err)
+		}
+		list = append(list, corr)
+	}
+	return c.JSON(http.StatusOK, list)
+}
+
+func restoreSampleCorrection(c echo.Context) error {
+	id, err := strconv.Atoi(c.Param("id"))
+	if err != nil {
+		return apiError(c, http.StatusBadRequest, "invalid correction id")
+	}
+	restored, missing, err := restoreCorrection(c.Request().Context(), id)
+	switch {
+	case err == sql.ErrNoRows:
+		return apiError(c, http.StatusNotFound, "correction not found or already restored")
+	case err == errCorrectionGone:
+		return apiError(c, http.StatusConflict, err.Error())
+	case err != nil:
+		return internalError(c, err)
+	}
+	return c.JSON(http.StatusOK, map[string]int64{"restored": restored, "missing": missing})
+}
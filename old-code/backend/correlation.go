@@ -0,0 +1,206 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"math"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/labstack/echo/v4"
+)
+
+// The wake-up correlation pairs every morning (see wakeup.go) with the CO2
+// of the night before it, the ?night_hours= (8) before the first ring, and
+// computes Pearson correlation coefficients between the night's CO2 average,
+// maximum and minutes above report_poor_co2 and the morning's snoozes and
+// seconds to get up. A positive coefficient means worse air goes with more
+// snoozing. Nights with a ventilation event (see ventilation_events.go) in
+// the room during the evening before are compared with the rest, to see
+// whether airing before bed helps.
+
+const eveningBeforeNight = 3 * time.Hour
+
+type WakeupNight struct {
+	Date         string   `json:"date"` // of the morning
+	FirstRing    string   `json:"first_ring"`
+	Snoozes      int      `json:"snoozes"`
+	SecondsToUp  *int64   `json:"seconds_to_up"`
+	Samples      int      `json:"samples"`
+	AvgCO2       *float64 `json:"avg_co2"`
+	MaxCO2       *float64 `json:"max_co2"`
+	MinutesAbove *float64 `json:"minutes_above"` // above report_poor_co2
+	Ventilated   bool     `json:"ventilated"`
+}
+
+type Correlation struct {
+	CO2     string   `json:"co2"`    // avg_co2 | max_co2 | minutes_above
+	Wakeup  string   `json:"wakeup"` // snoozes | seconds_to_up
+	Pairs   int      `json:"pairs"`
+	Pearson *float64 `json:"pearson"` // nil with fewer than 3 pairs or no variation
+}
+
+type VentilationComparison struct {
+	Nights         int      `json:"nights"`
+	AvgCO2         *float64 `json:"avg_co2"`
+	AvgSnoozes     *float64 `json:"avg_snoozes"`
+	AvgSecondsToUp *float64 `json:"avg_seconds_to_up"`
+}
+
+type WakeupCorrelation struct {
+	Room          string                           `json:"room,omitempty"`
+	Days          int                              `json:"days"`
+	NightHours    int                              `json:"night_hours"`
+	PoorCO2       float64                          `json:"poor_co2"`
+	Correlations  []Correlation                    `json:"correlations"`
+	ByVentilation map[string]VentilationComparison `json:"by_ventilation"` // ventilated | not_ventilated
+	Nights        []WakeupNight                    `json:"nights"`
+}
+
+// pearson is the correlation coefficient of paired samples.
+func pearson(xs, ys []float64) *float64 {
+	n := float64(len(xs))
+	if len(xs) < 3 {
+		return nil
+	}
+	var sx, sy, sxx, syy, sxy float64
+	for i := range xs {
+		sx += xs[i]
+		sy += ys[i]
+		sxx += xs[i] * xs[i]
+		syy += ys[i] * ys[i]
+		sxy += xs[i] * ys[i]
+	}
+	denom := math.Sqrt(n*sxx-sx*sx) * math.Sqrt(n*syy-sy*sy)
+	if denom == 0 || math.IsNaN(denom) {
+		return nil
+	}
+	r := (n*sxy - sx*sy) / denom
+	return &r
+}
+
+// nightCO2 fills in the CO2 statistics of the night before a morning.
+func nightCO2(ctx context.Context, night *WakeupNight, room string, from, to time.Time, poor float64) error {
+	samples, args := metricSampleQuery("co2", room, from, to)
+	var avg, maxCO2 sql.NullFloat64
+	var above int
+	err := db.QueryRowContext(ctx, `
+		SELECT COUNT(*), AVG(value), MAX(value), COUNT(*) FILTER (WHERE value > $`+strconv.Itoa(len(args)+1)+`)
+		FROM (`+samples+`) samples
+	`, append(args, poor)...).Scan(&night.Samples, &avg, &maxCO2, &above)
+	if err != nil || night.Samples == 0 {
+		return err
+	}
+	minutes := float64(above) / float64(night.Samples) * to.Sub(from).Minutes()
+	night.AvgCO2, night.MaxCO2, night.MinutesAbove = &avg.Float64, &maxCO2.Float64, &minutes
+
+	var ventilated bool
+	err = db.QueryRowContext(ctx, `
+		SELECT EXISTS (SELECT 1 FROM ventilation_events WHERE ended_at >= $1 AND started_at < $2 AND ($3 = '' OR room = $3))
+	`, from.Add(-eveningBeforeNight), to, room).Scan(&ventilated)
+	night.Ventilated = ventilated
+	return err
+}
+
+// getWakeupCorrelation correlates the last ?days= (90) of mornings with the
+// night's CO2: ?room=bedroom&night_hours=8.
+func getWakeupCorrelation(c echo.Context) error {
+	days, nightHours := 90, 8
+	for _, p := range []struct {
+		name     string
+		dst      *int
+		min, max int
+	}{{"days", &days, 7, 730}, {"night_hours", &nightHours, 1, 16}} {
+		if v := c.QueryParam(p.name); v != "" {
+			n, err := strconv.Atoi(v)
+			if err != nil || n < p.min || n > p.max {
+				return apiError(c, http.StatusBadRequest, p.name+" must be between "+strconv.Itoa(p.min)+" and "+strconv.Itoa(p.max))
+			}
+			*p.dst = n
+		}
+	}
+	room := c.QueryParam("room")
+	ctx := c.Request().Context()
+	mornings, err := loadMornings(ctx, time.Now().AddDate(0, 0, -days))
+	if err != nil {
+		return internalError(c, err)
+	}
+
+	result := WakeupCorrelation{Room: room, Days: days, NightHours: nightHours, PoorCO2: settingFloat("report_poor_co2"),
+		Correlations: []Correlation{}, Nights: []WakeupNight{}}
+	for _, m := range mornings {
+		if m.Unattended {
+			continue // nobody was there to wake up
+		}
+		night := WakeupNight{Date: m.Date, FirstRing: m.FirstRing.Format(time.RFC3339), Snoozes: m.Snoozes, SecondsToUp: m.SecondsToUp}
+		from := m.FirstRing.Add(-time.Duration(nightHours) * time.Hour)
+		if err := nightCO2(ctx, &night, room, from, m.FirstRing, result.PoorCO2); err != nil {
+			return internalError(c, err)
+		}
+		result.Nights = append(result.Nights, night)
+	}
+
+	co2Stats := map[string]func(WakeupNight) *float64{
+		"avg_co2":       func(n WakeupNight) *float64 { return n.AvgCO2 },
+		"max_co2":       func(n WakeupNight) *float64 { return n.MaxCO2 },
+		"minutes_above": func(n WakeupNight) *float64 { return n.MinutesAbove },
+	}
+	wakeupStats := map[string]func(WakeupNight) *float64{
+		"snoozes": func(n WakeupNight) *float64 { v := float64(n.Snoozes); return &v },
+		"seconds_to_up": func(n WakeupNight) *float64 {
+			if n.SecondsToUp == nil {
+				return nil
+			}
+			v := float64(*n.SecondsToUp)
+			return &v
+		},
+	}
+	for _, co2 := range []string{"avg_co2", "max_co2", "minutes_above"} {
+		for _, wakeup := range []string{"snoozes", "seconds_to_up"} {
+			var xs, ys []float64
+			for _, n := range result.Nights {
+				x, y := co2Stats[co2](n), wakeupStats[wakeup](n)
+				if x != nil && y != nil {
+					xs, ys = append(xs, *x), append(ys, *y)
+				}
+			}
+			result.Correlations = append(result.Correlations, Correlation{CO2: co2, Wakeup: wakeup, Pairs: len(xs), Pearson: pearson(xs, ys)})
+		}
+	}
+
+	result.ByVentilation = map[string]VentilationComparison{}
+	for _, group := range []struct {
+		name       string
+		ventilated bool
+	}{{"ventilated", true}, {"not_ventilated", false}} {
+		var cmp VentilationComparison
+		var co2, snoozes, seconds []float64
+		for _, n := range result.Nights {
+			if n.Samples == 0 || n.Ventilated != group.ventilated {
+				continue
+			}
+			cmp.Nights++
+			co2 = append(co2, *n.AvgCO2)
+			snoozes = append(snoozes, float64(n.Snoozes))
+			if n.SecondsToUp != nil {
+				seconds = append(seconds, float64(*n.SecondsToUp))
+			}
+		}
+		cmp.AvgCO2, cmp.AvgSnoozes, cmp.AvgSecondsToUp = mean(co2), mean(snoozes), mean(seconds)
+		result.ByVentilation[group.name] = cmp
+	}
+	return c.JSON(http.StatusOK, result)
+}
+
+func mean(values []float64) *float64 {
+	if len(values) == 0 {
+		return nil
+	}
+	var sum float64
+	for _, v := range values {
+		sum += v
+	}
+	m := sum / float64(len(values))
+	return &m
+}
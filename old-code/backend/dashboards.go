@@ -0,0 +1,159 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"net/http"
+	"time"
+
+	"github.com/labstack/echo/v4"
+)
+
+// Dashboards are layouts the web UI stores on the server, so a customized
+// view follows its user from browser to browser. The server does not look
+// inside a layout (widgets, metrics, ranges are up to the UI); it only keeps
+// it per user and name. A dashboard saved with "shared": true is listed for
+// everyone in the household, who can view it but not change it.
+//
+// Every logged-in user may save dashboards, viewers included: they change
+// nothing but the user's own view. Without AUTH_REQUIRED there is only one
+// user, and all dashboards belong to them.
+
+type Dashboard struct {
+	Name      string          `json:"name"`
+	Owner     string          `json:"owner"`
+	OwnerName string          `json:"owner_name,omitempty"`
+	Layout    json.RawMessage `json:"layout"`
+	Shared    bool            `json:"shared"`
+	Editable  bool            `json:"editable"`
+	UpdatedAt time.Time       `json:"updated_at"`
+}
+
+// dashboardOwner is the user whose dashboards a request works on, "" without
+// a session.
+func dashboardOwner(c echo.Context) (owner, name string) {
+	if s := currentSession(c); s != nil {
+		name = s.Name
+		if name == "" {
+			name = s.Email
+		}
+		return s.Subject, name
+	}
+	return "", ""
+}
+
+func scanDashboards(rows *sql.Rows, owner string) ([]Dashboard, error) {
+	defer rows.Close()
+	dashboards := []Dashboard{}
+	for rows.Next() {
+		var d Dashboard
+		var layout string
+		if err := rows.Scan(&d.Name, &d.Owner, &d.OwnerName, &layout, &d.Shared, &d.UpdatedAt); err != nil {
+			return nil, err
+		}
+		d.Layout = json.RawMessage(layout)
+		d.Editable = d.Owner == owner
+		dashboards = append(dashboards, d)
+	}
+	return dashboards, rows.Err()
+}
+
+// getDashboards lists the user's dashboards and those others shared.
+func getDashboards(c echo.Context) error {
+	owner, _ := dashboardOwner(c)
+	rows, err := db.QueryContext(c.Request().Context(), `
+		SELECT name, owner, owner_name, layout::text, shared, updated_at
+		FROM dashboards
+		WHERE owner = $1 OR shared
+		ORDER BY owner != $1, name, owner
+	`, owner)
+	if err != nil {
+		return internalError(c, err)
+	}
+	dashboards, err := scanDashboards(rows, owner)
+	if err != nil {
+		return internalError(c, err)
+	}
+	return c.JSON(http.StatusOK, dashboards)
+}
+
+// getDashboard returns one dashboard: the user's own, or with ?owner= one
+// another user shared.
+func getDashboard(c echo.Context) error {
+	me, _ := dashboardOwner(c)
+	owner := me
+	if c.QueryParam("owner") != "" {
+		owner = c.QueryParam("owner")
+	}
+	rows, err := db.QueryContext(c.Request().Context(), `
+		SELECT name, owner, owner_name, layout::text, shared, updated_at
+		FROM dashboards
+		WHERE name = $1 AND owner = $2 AND (owner = $3 OR shared)
+	`, c.Param("name"), owner, me)
+	if err != nil {
+		return internalError(c, err)
+	}
+	dashboards, err := scanDashboards(rows, me)
+	if err != nil {
+		return internalError(c, err)
+	}
+	if len(dashboards) == 0 {
+		return apiError(c, http.StatusNotFound, "dashboard not found")
+	}
+	return c.JSON(http.StatusOK, dashboards[0])
+}
+
+// putDashboard saves one of the user's dashboards:
+// {"layout": {...}, "shared": false}.
+func putDashboard(c echo.Context) error {
+	name := c.Param("name")
+	if name == "" || len(name) > 100 {
+		return apiError(c, http.StatusBadRequest, "name must be 1 to 100 characters")
+	}
+	var req struct {
+		Layout json.RawMessage `json:"layout"`
+		Shared bool            `json:"shared"`
+	}
+	if err := c.Bind(&req); err != nil {
+		return invalidBody(c, err)
+	}
+	var layout interface{}
+	if len(req.Layout) == 0 || json.Unmarshal(req.Layout, &layout) != nil {
+		return apiError(c, http.StatusBadRequest, "layout must be a JSON object or array")
+	}
+	switch layout.(type) {
+	case map[string]interface{}, []interface{}:
+	default:
+		return apiError(c, http.StatusBadRequest, "layout must be a JSON object or array")
+	}
+	if len(req.Layout) > 256<<10 {
+		return apiError(c, http.StatusRequestEntityTooLarge, "layout is larger than 256 KiB")
+	}
+
+	owner, ownerName := dashboardOwner(c)
+	d := Dashboard{Name: name, Owner: owner, OwnerName: ownerName, Layout: req.Layout, Shared: req.Shared, Editable: true}
+	err := db.QueryRowContext(c.Request().Context(), `
+		INSERT INTO dashboards (owner, name, owner_name, layout, shared, updated_at)
+		VALUES ($1, $2, $3, $4, $5, $6)
+		ON CONFLICT (owner, name) DO UPDATE SET
+			owner_name = EXCLUDED.owner_name, layout = EXCLUDED.layout,
+			shared = EXCLUDED.shared, updated_at = EXCLUDED.updated_at
+		RETURNING updated_at
+	`, d.Owner, d.Name, d.OwnerName, string(d.Layout), d.Shared, time.Now()).Scan(&d.UpdatedAt)
+	if err != nil {
+		return internalError(c, err)
+	}
+	return c.JSON(http.StatusOK, d)
+}
+
+func deleteDashboard(c echo.Context) error {
+	owner, _ := dashboardOwner(c)
+	res, err := db.ExecContext(c.Request().Context(), "DELETE FROM dashboards WHERE owner = $1 AND name = $2", owner, c.Param("name"))
+	if err != nil {
+		return internalError(c, err)
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		return apiError(c, http.StatusNotFound, "dashboard not found")
+	}
+	return c.NoContent(http.StatusNoContent)
+}
@@ -0,0 +1,252 @@
+package main
+
+import (
+	"database/sql"
+	"fmt"
+	"log"
+	"net/http"
+	"regexp"
+	"time"
+
+	"github.com/labstack/echo/v4"
+)
+
+// Derived metrics are computed from a source metric of a device and stored
+// in metric_samples, so trend, forecast and rules can use them by name just
+// like co2 and sound. Kinds:
+//
+//	avg, min, max   over the last window_seconds, e.g. sound_5m_avg
+//	minutes_above   minutes the source spent above threshold since midnight
+//	                (or within window_seconds when set), e.g.
+//	                co2_above_1000_minutes_today
+//
+// A metric is computed either on every device update ("ingest") or once a
+// minute by the derived_metrics job ("schedule").
+
+type DerivedMetric struct {
+	Name          string  `json:"name"`
+	Kind          string  `json:"kind"`
+	Source        string  `json:"source"`
+	WindowSeconds int     `json:"window_seconds"`
+	Threshold     float64 `json:"threshold"`
+	Compute       string  `json:"compute"` // ingest | schedule
+}
+
+var derivedNamePattern = regexp.MustCompile(`^[a-z][a-z0-9_]*$`)
+
+func (m DerivedMetric) validate() error {
+	if !derivedNamePattern.MatchString(m.Name) {
+		return fmt.Errorf("name must be lower case letters, digits and underscores")
+	}
+	if _, ok := metricColumns[m.Name]; ok {
+		return fmt.Errorf("%q is a built-in metric", m.Name)
+	}
+	if _, ok := metricColumns[m.Source]; !ok {
+		return fmt.Errorf("unknown source metric %q", m.Source)
+	}
+	switch m.Kind {
+	case "avg", "min", "max":
+		if m.WindowSeconds <= 0 {
+			return fmt.Errorf("%s needs a positive window_seconds", m.Kind)
+		}
+	case "minutes_above":
+		if m.WindowSeconds < 0 {
+			return fmt.Errorf("window_seconds must not be negative")
+		}
+	default:
+		return fmt.Errorf("kind must be avg, min, max or minutes_above")
+	}
+	if m.Compute != "ingest" && m.Compute != "schedule" {
+		return fmt.Errorf("compute must be ingest or schedule")
+	}
+	return nil
+}
+
+func loadDerivedMetrics() ([]DerivedMetric, error) {
+	rows, err := db.Query(`
+		SELECT name, kind, source, window_seconds, threshold, compute FROM derived_metrics ORDER BY name
+	`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	metrics := []DerivedMetric{}
+	for rows.Next() {
+		var m DerivedMetric
+		if err := rows.Scan(&m.Name, &m.Kind, &m.Source, &m.WindowSeconds, &m.Threshold, &m.Compute); err != nil {
+			return nil, err
+		}
+		metrics = append(metrics, m)
+	}
+	return metrics, rows.Err()
+}
+
+func derivedMetric(name string) (DerivedMetric, bool, error) {
+	var m DerivedMetric
+	err := db.QueryRow(`
+		SELECT name, kind, source, window_seconds, threshold, compute FROM derived_metrics WHERE name = $1
+	`, name).Scan(&m.Name, &m.Kind, &m.Source, &m.WindowSeconds, &m.Threshold, &m.Compute)
+	if err == sql.ErrNoRows {
+		return m, false, nil
+	}
+	return m, err == nil, err
+}
+
+// compute evaluates the metric for one device at now. ok is false when the
+// window holds no readings.
+func (m DerivedMetric) compute(deviceID int, now time.Time) (value float64, ok bool, err error) {
+	column := metricColumns[m.Source]
+	from := now.Add(-time.Duration(m.WindowSeconds) * time.Second)
+
+	var v sql.NullFloat64
+	switch m.Kind {
+	case "avg", "min", "max":
+		err = db.QueryRow(`
+			SELECT `+m.Kind+`(`+column+`) FROM sensor_data
+			WHERE device_id = $1 AND timestamp > $2 AND timestamp <= $3 AND `+column+` != 0
+		`, deviceID, from, now).Scan(&v)
+	case "minutes_above":
+		if m.WindowSeconds == 0 {
+			from = time.Date(now.Year(), now.Month(), now.Day(), 0, 0, 0, 0, now.Location())
+		}
+		// Each reading above the threshold counts until the next one, but a
+		// gap longer than two report intervals (device offline) does not.
+		maxGap := 2 * envDuration("DEVICE_REPORT_INTERVAL", 5*time.Minute).Seconds()
+		err = db.QueryRow(`
+			SELECT SUM(LEAST(gap, $4)) / 60 FROM (
+				SELECT `+column+` AS value,
+					EXTRACT(EPOCH FROM LEAD(timestamp, 1, $3::timestamp) OVER (ORDER BY timestamp) - timestamp) AS gap
+				FROM sensor_data
+				WHERE device_id = $1 AND timestamp >= $2 AND timestamp <= $3
+			) s
+			WHERE value > $5
+		`, deviceID, from, now, maxGap, m.Threshold).Scan(&v)
+		if err == nil && !v.Valid {
+			v = sql.NullFloat64{Float64: 0, Valid: true}
+		}
+	}
+	if err != nil || !v.Valid {
+		return 0, false, err
+	}
+	return v.Float64, true, nil
+}
+
+// computeDerivedMetrics computes and stores the device's metrics of the
+// given compute mode, returning the values by name.
+func computeDerivedMetrics(deviceID int, mode string, now time.Time) map[string]float64 {
+	metrics, err := loadDerivedMetrics()
+	if err != nil {
+		log.Printf("Failed to load derived metrics: %v", err)
+		return nil
+	}
+
+	values := make(map[string]float64)
+	for _, m := range metrics {
+		if m.Compute != mode {
+			continue
+		}
+		v, ok, err := m.compute(deviceID, now)
+		if err != nil {
+			log.Printf("Failed to compute %s: %v", m.Name, err)
+			continue
+		}
+		if !ok {
+			continue
+		}
+		if _, err := db.Exec(`
+			INSERT INTO metric_samples (metric, device_id, timestamp, value) VALUES ($1, $2, $3, $4)
+			ON CONFLICT DO NOTHING
+		`, m.Name, deviceID, now, v); err != nil {
+			log.Printf("Failed to store %s: %v", m.Name, err)
+			continue
+		}
+		values[m.Name] = v
+	}
+	return values
+}
+
+// computeScheduledMetrics is the derived_metrics job. It covers devices that
+// reported within the last hour.
+func computeScheduledMetrics() error {
+	rows, err := db.Query(`
+		SELECT DISTINCT s.device_id, d.room FROM sensor_data s
+		JOIN devices d ON d.id = s.device_id
+		WHERE s.timestamp > $1
+	`, time.Now().Add(-time.Hour))
+	if err != nil {
+		return err
+	}
+	rooms := make(map[int]string)
+	for rows.Next() {
+		var id int
+		var room string
+		if err := rows.Scan(&id, &room); err != nil {
+			rows.Close()
+			return err
+		}
+		rooms[id] = room
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return err
+	}
+
+	now := time.Now()
+	for id, room := range rooms {
+		if values := computeDerivedMetrics(id, "schedule", now); len(values) > 0 {
+			evaluateRules(room, values)
+		}
+	}
+	return nil
+}
+
+func getDerivedMetrics(c echo.Context) error {
+	metrics, err := loadDerivedMetrics()
+	if err != nil {
+		return internalError(c, err)
+	}
+	return c.JSON(http.StatusOK, metrics)
+}
+
+func createDerivedMetric(c echo.Context) error {
+	m := DerivedMetric{Compute: "ingest"}
+	if err := c.Bind(&m); err != nil {
+		return invalidBody(c, err)
+	}
+	if err := m.validate(); err != nil {
+		return apiError(c, http.StatusBadRequest, err.Error())
+	}
+
+	_, err := db.Exec(`
+		INSERT INTO derived_metrics (name, kind, source, window_seconds, threshold, compute)
+		VALUES ($1, $2, $3, $4, $5, $6)
+		ON CONFLICT (name) DO UPDATE SET kind = EXCLUDED.kind, source = EXCLUDED.source,
+			window_seconds = EXCLUDED.window_seconds, threshold = EXCLUDED.threshold, compute = EXCLUDED.compute
+	`, m.Name, m.Kind, m.Source, m.WindowSeconds, m.Threshold, m.Compute)
+	if err != nil {
+		return internalError(c, err)
+	}
+
+	return c.JSON(http.StatusCreated, m)
+}
+
+// deleteDerivedMetric removes the definition together with its samples.
+func deleteDerivedMetric(c echo.Context) error {
+	name := c.Param("name")
+	tx, err := db.Begin()
+	if err != nil {
+		return internalError(c, err)
+	}
+	defer tx.Rollback()
+	if _, err := tx.Exec("DELETE FROM metric_samples WHERE metric = $1", name); err != nil {
+		return internalError(c, err)
+	}
+	if _, err := tx.Exec("DELETE FROM derived_metrics WHERE name = $1", name); err != nil {
+		return internalError(c, err)
+	}
+	if err := tx.Commit(); err != nil {
+		return internalError(c, err)
+	}
+	return c.NoContent(http.StatusNoContent)
+}
@@ -0,0 +1,200 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/labstack/echo/v4"
+)
+
+// Firmware can ship its log lines in batches, so flaky readings can be
+// debugged without a serial cable. Logs are kept for retention_device_logs.
+
+type DeviceLogLine struct {
+	Level      string     `json:"level"` // debug | info | warn | error
+	Message    string     `json:"message"`
+	DeviceTime *int64     `json:"device_time,omitempty"` // unix seconds on the device clock
+	Timestamp  *time.Time `json:"timestamp,omitempty"`   // device_time, as a time
+	ReceivedAt time.Time  `json:"received_at"`
+}
+
+var logLevels = map[string]int{"debug": 0, "info": 1, "warn": 2, "error": 3}
+
+// Limits of one batch, so a looping firmware cannot flood the database.
+const (
+	maxLogBatch   = 500
+	maxLogMessage = 1024
+)
+
+func storeDeviceLogs(ctx context.Context, deviceID int, lines []DeviceLogLine) error {
+	now := time.Now()
+	tx, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	for _, l := range lines {
+		var deviceTime *time.Time
+		if l.DeviceTime != nil {
+			t := time.Unix(*l.DeviceTime, 0)
+			deviceTime = &t
+		}
+		if _, err := tx.Exec(`
+			INSERT INTO device_logs (device_id, level, message, device_time, received_at) VALUES ($1, $2, $3, $4, $5)
+		`, deviceID, l.Level, l.Message, deviceTime, now); err != nil {
+			return err
+		}
+	}
+	return tx.Commit()
+}
+
+// validLogLines normalises levels and truncates long messages.
+func validLogLines(lines []DeviceLogLine) (string, bool) {
+	if len(lines) == 0 {
+		return "no log lines", false
+	}
+	if len(lines) > maxLogBatch {
+		return "at most " + strconv.Itoa(maxLogBatch) + " lines per batch", false
+	}
+	for i := range lines {
+		lines[i].Level = strings.ToLower(lines[i].Level)
+		if lines[i].Level == "warning" {
+			lines[i].Level = "warn"
+		}
+		if _, ok := logLevels[lines[i].Level]; !ok {
+			return "level must be debug, info, warn or error", false
+		}
+		if len(lines[i].Message) > maxLogMessage {
+			lines[i].Message = lines[i].Message[:maxLogMessage]
+		}
+	}
+	return "", true
+}
+
+// postDeviceLogs takes {"lines": [{"level", "message", "device_time"}]}.
+func postDeviceLogs(c echo.Context) error {
+	device, err := deviceFromParam(c)
+	if err != nil {
+		return handlerError(c, err)
+	}
+	var req struct {
+		Lines []DeviceLogLine `json:"lines"`
+	}
+	if err := c.Bind(&req); err != nil {
+		return invalidBody(c, err)
+	}
+	if msg, ok := validLogLines(req.Lines); !ok {
+		return apiError(c, http.StatusBadRequest, msg)
+	}
+	if err := storeDeviceLogs(c.Request().Context(), device.ID, req.Lines); err != nil {
+		return internalError(c, err)
+	}
+	return c.JSON(http.StatusAccepted, map[string]int{"stored": len(req.Lines)})
+}
+
+// postDeviceLogsByName is the firmware variant, which knows its name rather
+// than its ID: {"device": "bedroom", "lines": [...]}.
+func postDeviceLogsByName(c echo.Context) error {
+	var req struct {
+		Device string          `json:"device"`
+		Lines  []DeviceLogLine `json:"lines"`
+	}
+	if err := c.Bind(&req); err != nil {
+		return invalidBody(c, err)
+	}
+	if msg, ok := validLogLines(req.Lines); !ok {
+		return apiError(c, http.StatusBadRequest, msg)
+	}
+	if !deviceKeyValid(c, req.Device) {
+		return deviceKeyError(c)
+	}
+	device, err := deviceByName(req.Device)
+	if err != nil {
+		return internalError(c, err)
+	}
+	if err := storeDeviceLogs(c.Request().Context(), device.ID, req.Lines); err != nil {
+		return internalError(c, err)
+	}
+	return c.JSON(http.StatusAccepted, map[string]int{"stored": len(req.Lines)})
+}
+
+// getDeviceLogs lists a device's logs, newest first:
+// ?level=warn (that level and above), ?from/?to (RFC 3339), ?q (substring)
+// and ?limit (default 200, max 1000).
+func getDeviceLogs(c echo.Context) error {
+	device, err := deviceFromParam(c)
+	if err != nil {
+		return handlerError(c, err)
+	}
+
+	minLevel := 0
+	if level := c.QueryParam("level"); level != "" {
+		l, ok := logLevels[strings.ToLower(level)]
+		if !ok {
+			return apiError(c, http.StatusBadRequest, "level must be debug, info, warn or error")
+		}
+		minLevel = l
+	}
+	var levels []string
+	for name, l := range logLevels {
+		if l >= minLevel {
+			levels = append(levels, name)
+		}
+	}
+	from, to := time.Time{}, time.Now().Add(time.Minute)
+	for name, t := range map[string]*time.Time{"from": &from, "to": &to} {
+		if v := c.QueryParam(name); v != "" {
+			parsed, err := time.Parse(time.RFC3339, v)
+			if err != nil {
+				return apiError(c, http.StatusBadRequest, "invalid "+name)
+			}
+			*t = parsed
+		}
+	}
+	limit := 200
+	if v := c.QueryParam("limit"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 1 || n > 1000 {
+			return apiError(c, http.StatusBadRequest, "limit must be between 1 and 1000")
+		}
+		limit = n
+	}
+
+	rows, err := db.QueryContext(c.Request().Context(), `
+		SELECT level, message, device_time, received_at
+		FROM device_logs
+		WHERE device_id = $1 AND level = ANY(string_to_array($2, ',')) AND received_at >= $3 AND received_at < $4
+			AND ($5 = '' OR message ILIKE '%' || $5 || '%')
+		ORDER BY id DESC
+		LIMIT $6
+	`, device.ID, strings.Join(levels, ","), from, to, c.QueryParam("q"), limit)
+	if err != nil {
+		return internalError(c, err)
+	}
+	defer rows.Close()
+
+	lines := []DeviceLogLine{}
+	for rows.Next() {
+		var l DeviceLogLine
+		if err := rows.Scan(&l.Level, &l.Message, &l.Timestamp, &l.ReceivedAt); err != nil {
+			return internalError(c, err)
+		}
+		if l.Timestamp != nil {
+			unix := l.Timestamp.Unix()
+			l.DeviceTime = &unix
+		}
+		lines = append(lines, l)
+	}
+	return c.JSON(http.StatusOK, lines)
+}
+
+func pruneDeviceLogs(cutoff time.Time) (int64, error) {
+	res, err := db.Exec("DELETE FROM device_logs WHERE received_at < $1", cutoff)
+	if err != nil {
+		return 0, err
+	}
+	return res.RowsAffected()
+}
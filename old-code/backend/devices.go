@@ -0,0 +1,351 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+	"unicode/utf8"
+
+	"github.com/labstack/echo/v4"
+)
+
+// Devices identify themselves by name in their updates ("device"); firmware
+// that predates this sends nothing and is registered as "default". A device
+// is created on its first update, placed in DEFAULT_ROOM.
+//
+// A device can carry where it is: its timezone and coordinates, set with
+// PATCH /api/devices/:id. The briefing and the display read the weather at
+// the device's coordinates and tell the time in its timezone, and reports of
+// a room use the timezone of its devices. The alarm rings in the timezone of
+// the alarm devices (those the pre-flight check watches, see preflight.go)
+// and the geofence is centred on their coordinates. Without them
+// HOME_LAT/HOME_LON and the server's timezone apply.
+//
+// TIMESTAMP columns hold the server's wall clock, and Postgres drops the
+// offset of a time parameter, so times in a device's timezone go through
+// serverTime before they are compared with a column.
+
+type DeviceInfo struct {
+	ID       int        `json:"id"`
+	Name     string     `json:"name"`
+	Room     string     `json:"room"`
+	LastSeen *time.Time `json:"last_seen,omitempty"` // last update or heartbeat
+}
+
+func deviceByName(name string) (DeviceInfo, error) {
+	if name == "" {
+		name = "default"
+	}
+	d := DeviceInfo{Name: name}
+	err := db.QueryRow(`
+		INSERT INTO devices (name, room, last_seen) VALUES ($1, $2, $3)
+		ON CONFLICT (name) DO UPDATE SET last_seen = EXCLUDED.last_seen
+		RETURNING id, room, last_seen
+	`, name, envString("DEFAULT_ROOM", "bedroom"), time.Now()).Scan(&d.ID, &d.Room, &d.LastSeen)
+	return d, err
+}
+
+// DeviceMeta is where a device is. Unset fields are nil.
+type DeviceMeta struct {
+	Timezone  *string  `json:"timezone"` // IANA name, e.g. Europe/Prague
+	Latitude  *float64 `json:"latitude"`
+	Longitude *float64 `json:"longitude"`
+	Floor     *int     `json:"floor"`
+	Notes     *string  `json:"notes"`
+}
+
+const deviceMetaColumns = "timezone, latitude, longitude, floor, notes"
+
+func (m *DeviceMeta) scanDest() []any {
+	return []any{&m.Timezone, &m.Latitude, &m.Longitude, &m.Floor, &m.Notes}
+}
+
+// location is the device's timezone, the server's without one.
+func (m DeviceMeta) location() *time.Location {
+	if m.Timezone != nil {
+		if loc, err := time.LoadLocation(*m.Timezone); err == nil {
+			return loc
+		}
+	}
+	return time.Local
+}
+
+// coordinates are the device's, HOME_LAT/HOME_LON without them; ok is false
+// when neither is set.
+func (m DeviceMeta) coordinates() (lat, lon float64, ok bool) {
+	if m.Latitude != nil && m.Longitude != nil {
+		return *m.Latitude, *m.Longitude, true
+	}
+	if envString("HOME_LAT", "") == "" || envString("HOME_LON", "") == "" {
+		return 0, 0, false
+	}
+	return envFloat("HOME_LAT", 0), envFloat("HOME_LON", 0), true
+}
+
+// serverTime is t on the server's wall clock, for TIMESTAMP columns.
+func serverTime(t time.Time) time.Time {
+	return t.In(time.Local)
+}
+
+// alarmDeviceMeta returns the metadata of the first alarm device that has
+// a timezone or coordinates, or none.
+func alarmDeviceMeta(ctx context.Context) (DeviceMeta, error) {
+	var m DeviceMeta
+	query := "SELECT " + deviceMetaColumns + " FROM devices WHERE config_version IS NOT NULL AND (timezone IS NOT NULL OR latitude IS NOT NULL) ORDER BY id LIMIT 1"
+	var args []interface{}
+	if names := envString("PREFLIGHT_DEVICES", ""); names != "" {
+		query = "SELECT " + deviceMetaColumns + " FROM devices WHERE name = ANY(string_to_array($1, ',')) AND (timezone IS NOT NULL OR latitude IS NOT NULL) ORDER BY id LIMIT 1"
+		args = append(args, strings.ReplaceAll(names, " ", ""))
+	}
+	err := db.QueryRowContext(ctx, query, args...).Scan(m.scanDest()...)
+	if err == sql.ErrNoRows {
+		return DeviceMeta{}, nil
+	}
+	return m, err
+}
+
+// alarmRoom is the room of the alarm devices, "" without any.
+func alarmRoom(ctx context.Context) (string, error) {
+	query := "SELECT room FROM devices WHERE config_version IS NOT NULL ORDER BY id LIMIT 1"
+	var args []interface{}
+	if names := envString("PREFLIGHT_DEVICES", ""); names != "" {
+		query = "SELECT room FROM devices WHERE name = ANY(string_to_array($1, ',')) ORDER BY id LIMIT 1"
+		args = append(args, strings.ReplaceAll(names, " ", ""))
+	}
+	var room string
+	err := db.QueryRowContext(ctx, query, args...).Scan(&room)
+	if err == sql.ErrNoRows {
+		return "", nil
+	}
+	return room, err
+}
+
+// alarmZone caches the alarm's timezone for a minute, as every device
+// update asks for it.
+var alarmZone struct {
+	sync.Mutex
+	loc       *time.Location
+	checkedAt time.Time
+}
+
+// alarmLocation is the timezone the alarm rings in.
+func alarmLocation() *time.Location {
+	alarmZone.Lock()
+	defer alarmZone.Unlock()
+	if alarmZone.loc != nil && time.Since(alarmZone.checkedAt) < time.Minute {
+		return alarmZone.loc
+	}
+	m, err := alarmDeviceMeta(context.Background())
+	if err != nil {
+		log.Printf("Loading the alarm device's timezone failed: %v", err)
+		if alarmZone.loc != nil {
+			return alarmZone.loc
+		}
+	}
+	alarmZone.loc, alarmZone.checkedAt = m.location(), time.Now()
+	return alarmZone.loc
+}
+
+// homeCoordinates are where the alarm devices are, HOME_LAT/HOME_LON
+// without them.
+func homeCoordinates(ctx context.Context) (lat, lon float64, ok bool) {
+	m, err := alarmDeviceMeta(ctx)
+	if err != nil {
+		log.Printf("Loading the alarm device's coordinates failed: %v", err)
+	}
+	return m.coordinates()
+}
+
+// deviceMetaByName returns the metadata of a device; a missing device is a
+// request error.
+func deviceMetaByName(ctx context.Context, name string) (DeviceMeta, error) {
+	var m DeviceMeta
+	err := db.QueryRowContext(ctx, "SELECT "+deviceMetaColumns+" FROM devices WHERE name = $1", name).Scan(m.scanDest()...)
+	if err == sql.ErrNoRows {
+		return m, newRequestError(http.StatusNotFound, codeDeviceNotFound, "device not found")
+	}
+	return m, err
+}
+
+// roomMeta returns the metadata of the first device in a room that has a
+// timezone or coordinates. The whole house ("") and rooms without such a
+// device get the server's defaults.
+func roomMeta(ctx context.Context, room string) (DeviceMeta, error) {
+	var m DeviceMeta
+	if room == "" {
+		return m, nil
+	}
+	err := db.QueryRowContext(ctx, `
+		SELECT `+deviceMetaColumns+` FROM devices
+		WHERE room = $1 AND (timezone IS NOT NULL OR latitude IS NOT NULL)
+		ORDER BY id LIMIT 1
+	`, room).Scan(m.scanDest()...)
+	if err == sql.ErrNoRows {
+		return DeviceMeta{}, nil
+	}
+	return m, err
+}
+
+// optionalDeviceMeta reads ?device=, the name of the device a request is
+// for; without it the server's defaults apply.
+func optionalDeviceMeta(c echo.Context) (DeviceMeta, error) {
+	name := c.QueryParam("device")
+	if name == "" {
+		return DeviceMeta{}, nil
+	}
+	return deviceMetaByName(c.Request().Context(), name)
+}
+
+// DeviceSummary is a device in the device list.
+type DeviceSummary struct {
+	DeviceInfo
+	DeviceMeta
+}
+
+func getDevices(c echo.Context) error {
+	rows, err := db.Query("SELECT id, name, room, last_seen, " + deviceMetaColumns + " FROM devices ORDER BY id")
+	if err != nil {
+		return internalError(c, err)
+	}
+	defer rows.Close()
+
+	devices := []DeviceSummary{}
+	for rows.Next() {
+		var d DeviceSummary
+		if err := rows.Scan(append([]any{&d.ID, &d.Name, &d.Room, &d.LastSeen}, d.scanDest()...)...); err != nil {
+			return internalError(c, err)
+		}
+		devices = append(devices, d)
+	}
+
+	return c.JSON(http.StatusOK, devices)
+}
+
+// patchDevice sets a device's metadata, e.g. {"timezone": "Europe/Prague",
+// "latitude": 50.08, "longitude": 14.42, "floor": 1, "notes": "on the
+// bookshelf"}. Fields left out are kept, null clears one.
+func patchDevice(c echo.Context) error {
+	device, err := deviceFromParam(c)
+	if err != nil {
+		return handlerError(c, err)
+	}
+	var req map[string]json.RawMessage
+	if err := c.Bind(&req); err != nil {
+		return invalidBody(c, err)
+	}
+
+	var sets []string
+	var args []any
+	for _, field := range []string{"timezone", "latitude", "longitude", "floor", "notes"} {
+		raw, ok := req[field]
+		if !ok {
+			continue
+		}
+		delete(req, field)
+		value, msg := deviceMetaValue(field, raw)
+		if msg != "" {
+			return apiError(c, http.StatusBadRequest, msg)
+		}
+		args = append(args, value)
+		sets = append(sets, field+" = $"+strconv.Itoa(len(args)+1))
+	}
+	for field := range req {
+		return apiError(c, http.StatusBadRequest, "unknown field "+field)
+	}
+
+	ctx := c.Request().Context()
+	var meta DeviceMeta
+	if len(sets) == 0 {
+		err = db.QueryRowContext(ctx, "SELECT "+deviceMetaColumns+" FROM devices WHERE id = $1", device.ID).Scan(meta.scanDest()...)
+	} else {
+		err = db.QueryRowContext(ctx, "UPDATE devices SET "+strings.Join(sets, ", ")+" WHERE id = $1 RETURNING "+deviceMetaColumns,
+			append([]any{device.ID}, args...)...).Scan(meta.scanDest()...)
+	}
+	if err != nil {
+		return internalError(c, err)
+	}
+	return c.JSON(http.StatusOK, DeviceSummary{DeviceInfo: device, DeviceMeta: meta})
+}
+
+// deviceMetaValue validates one metadata field; null gives nil.
+func deviceMetaValue(field string, raw json.RawMessage) (any, string) {
+	if string(raw) == "null" {
+		return nil, ""
+	}
+	switch field {
+	case "timezone":
+		var tz string
+		if err := json.Unmarshal(raw, &tz); err != nil || tz == "" {
+			return nil, "timezone must be an IANA name, e.g. Europe/Prague"
+		}
+		if _, err := time.LoadLocation(tz); err != nil {
+			return nil, "unknown timezone " + tz
+		}
+		return tz, ""
+	case "latitude", "longitude":
+		limit := 90.0
+		if field == "longitude" {
+			limit = 180
+		}
+		var f float64
+		if err := json.Unmarshal(raw, &f); err != nil || f < -limit || f > limit {
+			return nil, field + " must be a number between -" + strconv.Itoa(int(limit)) + " and " + strconv.Itoa(int(limit))
+		}
+		return f, ""
+	case "floor":
+		var n int
+		if err := json.Unmarshal(raw, &n); err != nil {
+			return nil, "floor must be a whole number"
+		}
+		return n, ""
+	default: // notes
+		var s string
+		if err := json.Unmarshal(raw, &s); err != nil || utf8.RuneCountInString(s) > 1000 {
+			return nil, "notes must be text of at most 1000 characters"
+		}
+		return s, ""
+	}
+}
+
+// DeviceDetail is a device with its sync state and recent commands.
+type DeviceDetail struct {
+	DeviceInfo
+	DeviceMeta
+	ConfigVersion      *string            `json:"config_version"`
+	ConfigReportedAt   *time.Time         `json:"config_reported_at"`
+	ClockOffsetSeconds *int64             `json:"clock_offset_seconds"`
+	Telemetry          map[string]float64 `json:"telemetry"` // latest values
+	Commands           []CommandRecord    `json:"commands"`
+	RejectedSamples    map[string]int64   `json:"rejected_samples"` // by reason: duplicate | future | spike
+}
+
+func getDevice(c echo.Context) error {
+	device, err := deviceFromParam(c)
+	if err != nil {
+		return handlerError(c, err)
+	}
+	ctx := c.Request().Context()
+	d := DeviceDetail{DeviceInfo: device}
+	err = db.QueryRowContext(ctx, `
+		SELECT last_seen, config_version, config_reported_at, clock_offset_seconds, `+deviceMetaColumns+` FROM devices WHERE id = $1
+	`, device.ID).Scan(append([]any{&d.LastSeen, &d.ConfigVersion, &d.ConfigReportedAt, &d.ClockOffsetSeconds}, d.scanDest()...)...)
+	if err != nil {
+		return internalError(c, err)
+	}
+	if d.Telemetry, err = latestTelemetry(ctx, device.ID); err != nil {
+		return internalError(c, err)
+	}
+	if d.Commands, err = loadCommandRecords(ctx, device.ID, 20); err != nil {
+		return internalError(c, err)
+	}
+	if d.RejectedSamples, err = loadRejectedSamples(ctx, device.ID); err != nil {
+		return internalError(c, err)
+	}
+	return c.JSON(http.StatusOK, d)
+}
@@ -0,0 +1,214 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"database/sql"
+	"fmt"
+	"image"
+	"image/color"
+	"image/draw"
+	"image/png"
+	"log"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/labstack/echo/v4"
+)
+
+// GET /api/display is for low-power displays (e-ink, kiosks) that wake up,
+// fetch one thing and sleep again: the latest readings, the next alarm and
+// the weather as compact JSON, or with ?format=png a pre-rendered black and
+// white dashboard of ?width= x ?height= (800x480 by default, a 7.5" e-ink
+// panel) showing the same above the CO2 of the last 12 hours. Responses may
+// be cached for ?refresh= seconds (DISPLAY_REFRESH by default), the
+// device's refresh interval. The weather is fetched at most every 30
+// minutes. ?device= shows the weather at the display's own coordinates and
+// the time in its timezone (see devices.go).
+
+type DisplayAlarm struct {
+	Time    string     `json:"time"`
+	Armed   bool       `json:"armed"`
+	Skipped bool       `json:"skipped"`
+	At      *time.Time `json:"at,omitempty"` // the next ring, if armed and not skipped
+}
+
+type Display struct {
+	Time           time.Time     `json:"time"`
+	CO2            *float64      `json:"co2,omitempty"` // left out while no device is online
+	Sound          *float64      `json:"sound,omitempty"`
+	Air            string        `json:"air"` // good | fair | poor | unknown
+	UpdatedAt      *time.Time    `json:"updated_at,omitempty"`
+	Alarm          *DisplayAlarm `json:"alarm,omitempty"`
+	Weather        *Weather      `json:"weather,omitempty"`
+	RefreshSeconds int           `json:"refresh_seconds"`
+}
+
+type cachedForecast struct {
+	fetchedAt time.Time
+	weather   *Weather
+}
+
+// displayWeather holds the last forecast per location.
+var displayWeather = struct {
+	sync.Mutex
+	byPlace map[string]cachedForecast
+}{byPlace: make(map[string]cachedForecast)}
+
+// cachedWeather keeps the last forecast when the weather service fails.
+func cachedWeather(ctx context.Context, now time.Time, meta DeviceMeta) *Weather {
+	lat, lon, _ := meta.coordinates()
+	place := fmt.Sprintf("%.3f,%.3f", lat, lon)
+	displayWeather.Lock()
+	defer displayWeather.Unlock()
+	cached := displayWeather.byPlace[place]
+	if now.Sub(cached.fetchedAt) < 30*time.Minute {
+		return cached.weather
+	}
+	w, err := fetchWeather(ctx, meta)
+	if err != nil {
+		log.Printf("Failed to fetch the weather for the display: %v", err)
+		return cached.weather
+	}
+	displayWeather.byPlace[place] = cachedForecast{fetchedAt: now, weather: w}
+	return w
+}
+
+func loadDisplay(ctx context.Context, now time.Time, meta DeviceMeta) (Display, error) {
+	now = now.In(meta.location())
+	d := Display{Time: now, Air: "unknown"}
+
+	var lastSeen time.Time
+	var co2, sound float64
+	err := db.QueryRowContext(ctx, `
+		SELECT last_seen, co2_level, sound_level FROM device_status ORDER BY last_seen DESC LIMIT 1
+	`).Scan(&lastSeen, &co2, &sound)
+	if err != nil && err != sql.ErrNoRows {
+		return d, err
+	}
+	if err == nil && now.Sub(lastSeen) <= settingDuration("device_offline_after") {
+		d.UpdatedAt, d.Sound = &lastSeen, &sound
+		if co2 != 0 {
+			d.CO2 = &co2
+		}
+		d.Air = airBand(co2)
+	}
+
+	alarm, err := currentAlarm()
+	if err != nil && err != sql.ErrNoRows {
+		return d, err
+	}
+	if err == nil {
+		d.Alarm = &DisplayAlarm{Time: alarm.Time, Armed: alarm.Armed}
+		if d.Alarm.Skipped, err = nextAlarmSkipped(now); err != nil {
+			return d, err
+		}
+		if next, err := nextAlarmAt(alarm.Time, now); err == nil && alarm.Armed && !d.Alarm.Skipped {
+			d.Alarm.At = &next
+		}
+	}
+
+	d.Weather = cachedWeather(ctx, now, meta)
+	return d, nil
+}
+
+// renderDisplayPNG draws four big values (CO2, noise, alarm, outside) over
+// the CO2 chart, as a 1-bit PNG.
+func renderDisplayPNG(ctx context.Context, d Display, w, h int) ([]byte, error) {
+	img := image.NewGray(image.Rect(0, 0, w, h))
+	for i := range img.Pix {
+		img.Pix[i] = 0xff
+	}
+
+	type tile struct{ value, label string }
+	tiles := []tile{{"-", "CO2 PPM"}, {"-", "DB"}, {"OFF", "ALARM"}, {"", ""}}
+	if d.CO2 != nil {
+		tiles[0].value = fmt.Sprintf("%.0f", *d.CO2)
+	}
+	if d.Sound != nil {
+		tiles[1].value = fmt.Sprintf("%.0f", *d.Sound)
+	}
+	if d.Alarm != nil && d.Alarm.Armed {
+		tiles[2].value = d.Alarm.Time
+		if d.Alarm.Skipped {
+			tiles[2].label = "ALARM SKIP"
+		}
+	}
+	if d.Weather != nil {
+		tiles[3] = tile{fmt.Sprintf("%.0f°", d.Weather.Temperature), fmt.Sprintf("%.0f° %.0f°", d.Weather.Low, d.Weather.High)}
+	}
+	scale := max(min(h/60, w/100), 2)
+	small := max(scale/3, 2)
+	for i, t := range tiles {
+		center := w/len(tiles)*i + w/len(tiles)/2
+		y := h/4 - (5*scale+8+5*small)/2
+		drawChartText(img, t.value, center-chartTextWidth(t.value, scale)/2, y, scale)
+		drawChartText(img, t.label, center-chartTextWidth(t.label, small)/2, y+5*scale+8, small)
+	}
+
+	spec := chartSpec{Metric: "co2", From: d.Time.Add(-12 * time.Hour), To: d.Time, Width: w, Height: h - h/2}
+	points, step, err := chartPoints(ctx, spec)
+	if err != nil {
+		return nil, err
+	}
+	gaps, err := findGaps(ctx, spec.Metric, 0, spec.From, spec.To)
+	if err != nil {
+		return nil, err
+	}
+	chart := drawChartImage(spec, points, step, gaps)
+	draw.Draw(img, image.Rect(0, h/2, w, h), chart, image.Point{}, draw.Src)
+
+	// E-ink panels are black and white; light grey gridlines stay visible
+	mono := image.NewPaletted(img.Rect, color.Palette{color.Black, color.White})
+	for i, v := range img.Pix {
+		if v >= 0xd0 {
+			mono.Pix[i] = 1
+		}
+	}
+	var b bytes.Buffer
+	if err := png.Encode(&b, mono); err != nil {
+		return nil, err
+	}
+	return b.Bytes(), nil
+}
+
+func getDisplay(c echo.Context) error {
+	refresh := int(envDuration("DISPLAY_REFRESH", 5*time.Minute).Seconds())
+	w, h := 800, 480
+	for param, v := range map[string]*int{"refresh": &refresh, "width": &w, "height": &h} {
+		s := c.QueryParam(param)
+		if s == "" {
+			continue
+		}
+		n, err := strconv.Atoi(s)
+		if err != nil || n < 0 || param != "refresh" && (n < 100 || n > 2000) {
+			return apiError(c, http.StatusBadRequest, "invalid "+param)
+		}
+		*v = n
+	}
+
+	meta, err := optionalDeviceMeta(c)
+	if err != nil {
+		return handlerError(c, err)
+	}
+	ctx := c.Request().Context()
+	now := time.Now()
+	d, err := loadDisplay(ctx, now, meta)
+	if err != nil {
+		return internalError(c, err)
+	}
+	d.RefreshSeconds = refresh
+	c.Response().Header().Set("Cache-Control", fmt.Sprintf("max-age=%d", refresh))
+	c.Response().Header().Set("Expires", now.Add(time.Duration(refresh)*time.Second).UTC().Format(http.TimeFormat))
+
+	if c.QueryParam("format") != "png" {
+		return c.JSON(http.StatusOK, d)
+	}
+	img, err := renderDisplayPNG(ctx, d, w, h)
+	if err != nil {
+		return internalError(c, err)
+	}
+	return c.Blob(http.StatusOK, "image/png", img)
+}
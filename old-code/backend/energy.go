@@ -0,0 +1,339 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"math"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/labstack/echo/v4"
+)
+
+// Energy meters report power (W) and energy (kWh, a counter that only
+// grows) as metrics of a device named after the meter. Any device can send
+// them in "metrics"; two bridges read off-the-shelf meters:
+//
+//	SHELLY_METERS=house=http://192.168.1.60,garage=http://shelly-garage.local
+//
+// polls Shelly EMs and plugs every ENERGY_INTERVAL, first generation through
+// /status and second through /rpc/Shelly.GetStatus, summing their channels.
+// ENERGY_MQTT_URL subscribes to ENERGY_MQTT_TOPIC/<meter> for messages like
+// {"power": 230, "energy": 1520.4}.
+//
+// GET /api/energy/report adds up the energy counters per day, counting a
+// counter that went back (a meter reset) from zero, and prices it with the
+// energy_price setting, energy_night_price during energy_night_hours and
+// energy_daily_fee per day.
+
+type energyMeters struct {
+	mu     sync.Mutex
+	states map[string]map[string]float64 // meter -> power | energy -> latest
+}
+
+var meters = &energyMeters{states: make(map[string]map[string]float64)}
+
+var shellyClient = &http.Client{Timeout: 10 * time.Second}
+
+func initEnergy() {
+	shellies := parsePairs(envString("SHELLY_METERS", ""))
+	broker := envString("ENERGY_MQTT_URL", "")
+	if len(shellies) == 0 && broker == "" {
+		return
+	}
+	for name, u := range shellies {
+		go pollShelly(name, strings.TrimRight(u, "/"))
+	}
+	if broker != "" {
+		go subscribeEnergy(broker, strings.TrimRight(envString("ENERGY_MQTT_TOPIC", "energy"), "/"))
+	}
+	go meters.run(envDuration("ENERGY_INTERVAL", time.Minute))
+}
+
+func (m *energyMeters) observe(meter string, values map[string]float64) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.states[meter] == nil {
+		m.states[meter] = make(map[string]float64)
+	}
+	for name, v := range values {
+		if !math.IsNaN(v) {
+			m.states[meter][name] = v
+		}
+	}
+}
+
+// run stores the readings received since the last interval.
+func (m *energyMeters) run(interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for now := range ticker.C {
+		m.mu.Lock()
+		states := m.states
+		m.states = make(map[string]map[string]float64)
+		m.mu.Unlock()
+		if !isLeader() {
+			continue
+		}
+		for meter, values := range states {
+			if err := ingestMetrics(context.Background(), meter, values, now); err != nil {
+				log.Printf("Energy meter %s: storing readings failed: %v", meter, err)
+			}
+		}
+	}
+}
+
+func pollShelly(name, baseURL string) {
+	interval := envDuration("ENERGY_INTERVAL", time.Minute)
+	for {
+		values, err := readShelly(baseURL)
+		if err != nil {
+			log.Printf("Shelly %s: %v", name, err)
+		} else {
+			meters.observe(name, values)
+		}
+		time.Sleep(interval)
+	}
+}
+
+// readShelly returns a Shelly's power and energy, trying the first
+// generation API first.
+func readShelly(baseURL string) (map[string]float64, error) {
+	var gen1 struct {
+		EMeters []struct {
+			Power float64 `json:"power"`
+			Total float64 `json:"total"` // Wh
+		} `json:"emeters"`
+		Meters []struct {
+			Power float64 `json:"power"`
+			Total float64 `json:"total"` // watt-minutes
+		} `json:"meters"`
+	}
+	err := getShellyJSON(baseURL+"/status", &gen1)
+	if err == nil {
+		var power, energy float64
+		for _, e := range gen1.EMeters {
+			power, energy = power+e.Power, energy+e.Total/1000
+		}
+		for _, m := range gen1.Meters {
+			power, energy = power+m.Power, energy+m.Total/60000
+		}
+		return map[string]float64{"power": power, "energy": energy}, nil
+	}
+
+	var gen2 map[string]json.RawMessage
+	if err2 := getShellyJSON(baseURL+"/rpc/Shelly.GetStatus", &gen2); err2 != nil {
+		return nil, fmt.Errorf("%v; %v", err, err2)
+	}
+	var power, energy float64
+	for key, raw := range gen2 {
+		var c struct {
+			ActPower *float64 `json:"act_power"`
+			APower   *float64 `json:"apower"`
+			Total    *float64 `json:"total_act_energy"` // Wh
+			AEnergy  *struct {
+				Total float64 `json:"total"` // Wh
+			} `json:"aenergy"`
+		}
+		if json.Unmarshal(raw, &c) != nil {
+			continue
+		}
+		switch {
+		case strings.HasPrefix(key, "em1:") && c.ActPower != nil:
+			power += *c.ActPower
+		case strings.HasPrefix(key, "em1data:") && c.Total != nil:
+			energy += *c.Total / 1000
+		case strings.HasPrefix(key, "switch:"):
+			if c.APower != nil {
+				power += *c.APower
+			}
+			if c.AEnergy != nil {
+				energy += c.AEnergy.Total / 1000
+			}
+		}
+	}
+	return map[string]float64{"power": power, "energy": energy}, nil
+}
+
+func getShellyJSON(u string, v interface{}) error {
+	req, err := http.NewRequest(http.MethodGet, u, nil)
+	if err != nil {
+		return err
+	}
+	if user := envString("SHELLY_USERNAME", ""); user != "" {
+		req.SetBasicAuth(user, envString("SHELLY_PASSWORD", ""))
+	}
+	resp, err := shellyClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("GET %s: %s", u, resp.Status)
+	}
+	return json.NewDecoder(resp.Body).Decode(v)
+}
+
+// subscribeEnergy keeps the broker connection open, reconnecting with
+// backoff.
+func subscribeEnergy(broker, topic string) {
+	backoff := 5 * time.Second
+	for {
+		start := time.Now()
+		err := streamEnergy(broker, topic)
+		if time.Since(start) > time.Minute {
+			backoff = 5 * time.Second
+		}
+		log.Printf("Energy meter broker disconnected: %v, retrying in %s", err, backoff)
+		time.Sleep(backoff)
+		backoff = min(backoff*2, 5*time.Minute)
+	}
+}
+
+func streamEnergy(broker, topic string) error {
+	conn, err := mqttDial(broker, "home-server-"+randomHex(4))
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	if err := conn.subscribe(topic + "/+"); err != nil {
+		return err
+	}
+	log.Printf("Energy meters connected to %s", topic)
+	return conn.receive(func(t string, payload []byte) {
+		meter := strings.TrimPrefix(t, topic+"/")
+		var reading struct {
+			Power  *float64 `json:"power"`
+			Energy *float64 `json:"energy"`
+		}
+		if meter == "" || json.Unmarshal(payload, &reading) != nil {
+			return
+		}
+		values := make(map[string]float64)
+		if reading.Power != nil {
+			values["power"] = *reading.Power
+		}
+		if reading.Energy != nil {
+			values["energy"] = *reading.Energy
+		}
+		meters.observe(meter, values)
+	})
+}
+
+type EnergyDay struct {
+	Date     string             `json:"date"`
+	KWh      float64            `json:"kwh"`
+	NightKWh float64            `json:"night_kwh"`
+	Cost     float64            `json:"cost"` // including the daily fee
+	ByMeter  map[string]float64 `json:"by_meter"`
+}
+
+type EnergyReport struct {
+	Meter      string      `json:"meter,omitempty"`
+	Days       int         `json:"days"`
+	Currency   string      `json:"currency"`
+	Price      float64     `json:"price"`
+	NightPrice *float64    `json:"night_price,omitempty"`
+	NightHours string      `json:"night_hours,omitempty"`
+	DailyFee   float64     `json:"daily_fee"`
+	TotalKWh   float64     `json:"total_kwh"`
+	TotalCost  float64     `json:"total_cost"`
+	Daily      []EnergyDay `json:"daily"`
+}
+
+// getEnergyReport covers the last ?days= (30) days, oldest first, of every
+// meter or ?meter=house.
+func getEnergyReport(c echo.Context) error {
+	days := 30
+	if v := c.QueryParam("days"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 1 || n > 366 {
+			return apiError(c, http.StatusBadRequest, "days must be between 1 and 366")
+		}
+		days = n
+	}
+	meter := c.QueryParam("meter")
+	now := time.Now()
+	today := time.Date(now.Year(), now.Month(), now.Day(), 0, 0, 0, 0, now.Location())
+	from := today.AddDate(0, 0, 1-days)
+
+	report := EnergyReport{Meter: meter, Days: days, Currency: envString("ENERGY_CURRENCY", "EUR"),
+		Price: settingFloat("energy_price"), DailyFee: settingFloat("energy_daily_fee"), Daily: []EnergyDay{}}
+	nightPrice := report.Price
+	if hours := setting("energy_night_hours"); hours != "" && settingFloat("energy_night_price") > 0 {
+		nightPrice = settingFloat("energy_night_price")
+		report.NightPrice, report.NightHours = &nightPrice, hours
+	}
+
+	byDate := make(map[string]*EnergyDay)
+	for day := from; !day.After(today); day = day.AddDate(0, 0, 1) {
+		report.Daily = append(report.Daily, EnergyDay{Date: day.Format("2006-01-02"), ByMeter: map[string]float64{}})
+	}
+	for i := range report.Daily {
+		byDate[report.Daily[i].Date] = &report.Daily[i]
+	}
+
+	rows, err := db.QueryContext(c.Request().Context(), `
+		SELECT d.name, m.timestamp, m.value
+		FROM metric_samples m JOIN devices d ON d.id = m.device_id
+		WHERE m.metric = 'energy' AND m.timestamp >= $1 AND m.timestamp < $2 AND ($3 = '' OR d.name = $3)
+		ORDER BY d.name, m.timestamp
+	`, from, now, meter)
+	if err != nil {
+		return internalError(c, err)
+	}
+	defer rows.Close()
+	var last string
+	var previous float64
+	for rows.Next() {
+		var name string
+		var at time.Time
+		var value float64
+		if err := rows.Scan(&name, &at, &value); err != nil {
+			return internalError(c, err)
+		}
+		if name != last {
+			last, previous = name, value
+			continue
+		}
+		delta := value - previous
+		if delta < 0 {
+			delta = value // the meter was reset
+		}
+		previous = value
+		day := byDate[at.Format("2006-01-02")]
+		if day == nil || delta == 0 {
+			continue
+		}
+		day.KWh += delta
+		day.ByMeter[name] += delta
+		if report.NightPrice != nil && inClockRange("energy_night_hours", at) {
+			day.NightKWh += delta
+		}
+	}
+	if err := rows.Err(); err != nil {
+		return internalError(c, err)
+	}
+
+	for i := range report.Daily {
+		d := &report.Daily[i]
+		d.Cost = (d.KWh-d.NightKWh)*report.Price + d.NightKWh*nightPrice + report.DailyFee
+		d.KWh, d.NightKWh, d.Cost = round2(d.KWh), round2(d.NightKWh), round2(d.Cost)
+		for name, kwh := range d.ByMeter {
+			d.ByMeter[name] = round2(kwh)
+		}
+		report.TotalKWh += d.KWh
+		report.TotalCost += d.Cost
+	}
+	report.TotalKWh, report.TotalCost = round2(report.TotalKWh), round2(report.TotalCost)
+	return c.JSON(http.StatusOK, report)
+}
+
+func round2(v float64) float64 {
+	return math.Round(v*100) / 100
+}
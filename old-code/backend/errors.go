@@ -0,0 +1,148 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"strings"
+
+	"github.com/labstack/echo/v4"
+)
+
+// Every error response has the same shape:
+//
+//	{"code": "device_not_found", "error": "device not found"}
+//
+// code is stable and meant for programs, error is for people: it is
+// translated (see i18n.go) and may be reworded. Most codes follow the status
+// (invalid_request, not_found, conflict, ...); the specific ones are listed
+// below. Internal errors are logged and answered with a generic message, so
+// database details do not leak to clients.
+//
+// The OAuth token endpoint (linking.go) answers in the format RFC 6749
+// prescribes instead.
+
+const (
+	codeInvalidBody    = "invalid_body"     // the body is not valid JSON or form data for the endpoint
+	codeDeviceNotFound = "device_not_found" // no such device, or no device has reported yet
+	codeNotConfigured  = "not_configured"   // the feature needs configuration that is missing
+	codeReadOnly       = "read_only"        // the session may only read
+	codeNoAlarm        = "no_alarm"         // no alarm is set
+	codeInternal       = "internal"
+)
+
+// requestError is an error that a helper returns for the handler to send
+// as is, e.g. "device not found" from a lookup by id.
+type requestError struct {
+	Status  int
+	Code    string
+	Message string
+}
+
+func (e *requestError) Error() string { return e.Message }
+
+func newRequestError(status int, code, message string) *requestError {
+	return &requestError{Status: status, Code: code, Message: message}
+}
+
+// statusCode is the code of errors without a more specific one.
+func statusCode(status int) string {
+	switch status {
+	case http.StatusBadRequest:
+		return "invalid_request"
+	case http.StatusRequestEntityTooLarge:
+		return "body_too_large"
+	case http.StatusTooManyRequests:
+		return "rate_limited"
+	case http.StatusInternalServerError:
+		return codeInternal
+	case http.StatusBadGateway:
+		return "upstream_failed"
+	}
+	if text := http.StatusText(status); text != "" {
+		return strings.ToLower(strings.ReplaceAll(text, " ", "_"))
+	}
+	return codeInternal
+}
+
+// apiError sends an error response with the status's code.
+func apiError(c echo.Context, status int, message string) error {
+	return apiErrorCode(c, status, statusCode(status), message)
+}
+
+func apiErrorCode(c echo.Context, status int, code, message string) error {
+	return c.JSON(status, map[string]string{"code": code, "error": message})
+}
+
+// internalError logs err and sends a 500 that does not reveal it.
+func internalError(c echo.Context, err error) error {
+	log.Printf("%s %s: %v", c.Request().Method, c.Request().URL.Path, err)
+	return apiErrorCode(c, http.StatusInternalServerError, codeInternal, "internal server error")
+}
+
+// invalidBody answers a failed c.Bind.
+func invalidBody(c echo.Context, err error) error {
+	var tooLarge *http.MaxBytesError
+	if errors.As(err, &tooLarge) {
+		return apiError(c, http.StatusRequestEntityTooLarge, fmt.Sprintf("request body is limited to %d bytes", tooLarge.Limit))
+	}
+	message := "invalid request body"
+	var he *echo.HTTPError
+	if errors.As(err, &he) {
+		message = fmt.Sprint(he.Message)
+	}
+	return apiErrorCode(c, http.StatusBadRequest, codeInvalidBody, message)
+}
+
+// upstreamError logs why a service the request depends on failed and
+// sends a 502 with message.
+func upstreamError(c echo.Context, message string, err error) error {
+	log.Printf("%s %s: %v", c.Request().Method, c.Request().URL.Path, err)
+	return apiError(c, http.StatusBadGateway, message)
+}
+
+// handlerError sends a requestError or echo.HTTPError as is and anything
+// else as an internal error.
+func handlerError(c echo.Context, err error) error {
+	var re *requestError
+	if errors.As(err, &re) {
+		return apiErrorCode(c, re.Status, re.Code, re.Message)
+	}
+	var he *echo.HTTPError
+	if errors.As(err, &he) {
+		if he.Code >= http.StatusInternalServerError {
+			return internalError(c, err)
+		}
+		message := http.StatusText(he.Code)
+		if m, ok := he.Message.(string); ok && m != "" {
+			message = m
+		}
+		return apiError(c, he.Code, message)
+	}
+	return internalError(c, err)
+}
+
+// httpErrorHandler answers errors that reach echo, such as unknown routes,
+// with the same envelope.
+func httpErrorHandler(err error, c echo.Context) {
+	if c.Response().Committed {
+		return
+	}
+	if err := handlerError(c, err); err != nil {
+		log.Printf("Writing an error response failed: %v", err)
+	}
+}
+
+// errorStatus is the status an error returned by a handler is answered with.
+func errorStatus(err error) (int, bool) {
+	var re *requestError
+	if errors.As(err, &re) {
+		return re.Status, true
+	}
+	var he *echo.HTTPError
+	if errors.As(err, &he) {
+		return he.Code, true
+	}
+	return 0, false
+}
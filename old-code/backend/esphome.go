@@ -0,0 +1,157 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"math"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+// ESPHome nodes with the web_server component are subscribed to through
+// their /events server-sent event stream, so off-the-shelf nodes need no
+// custom firmware. ESPHOME_NODES lists name=url pairs, e.g.
+//
+//	ESPHOME_NODES=bedroom=http://192.168.1.50,garden=http://esphome-garden.local
+//
+// Every numeric sensor entity becomes a metric of the device with the node's
+// name, named after its object ID (sensor-co2_sensor -> co2_sensor) unless
+// ESPHOME_SENSOR_MAP renames it (co2_sensor=co2,noise=sound). The latest
+// state of each sensor is stored every ESPHOME_INTERVAL. The native API is
+// not supported as it needs protobuf and Noise encryption.
+
+type esphomeNode struct {
+	name    string
+	url     string
+	sensors map[string]string
+
+	mu     sync.Mutex
+	states map[string]float64
+}
+
+type esphomeState struct {
+	ID    string   `json:"id"`
+	Value *float64 `json:"value"`
+}
+
+func initESPHome() {
+	nodes := parsePairs(envString("ESPHOME_NODES", ""))
+	if len(nodes) == 0 {
+		return
+	}
+	sensors := parsePairs(envString("ESPHOME_SENSOR_MAP", ""))
+	interval := envDuration("ESPHOME_INTERVAL", time.Minute)
+	for name, url := range nodes {
+		node := &esphomeNode{
+			name:    name,
+			url:     strings.TrimRight(url, "/"),
+			sensors: sensors,
+			states:  make(map[string]float64),
+		}
+		go node.subscribe()
+		go node.run(interval)
+	}
+}
+
+// subscribe keeps the event stream open, reconnecting with backoff.
+func (n *esphomeNode) subscribe() {
+	backoff := 5 * time.Second
+	for {
+		start := time.Now()
+		err := n.stream()
+		if time.Since(start) > time.Minute {
+			backoff = 5 * time.Second
+		}
+		log.Printf("ESPHome node %s disconnected: %v, retrying in %s", n.name, err, backoff)
+		time.Sleep(backoff)
+		backoff = min(backoff*2, 5*time.Minute)
+	}
+}
+
+func (n *esphomeNode) stream() error {
+	req, err := http.NewRequest(http.MethodGet, n.url+"/events", nil)
+	if err != nil {
+		return err
+	}
+	if user := envString("ESPHOME_USERNAME", ""); user != "" {
+		req.SetBasicAuth(user, envString("ESPHOME_PASSWORD", ""))
+	}
+	req.Header.Set("Accept", "text/event-stream")
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("GET /events: %s", resp.Status)
+	}
+	log.Printf("ESPHome node %s connected", n.name)
+
+	scanner := bufio.NewScanner(resp.Body)
+	scanner.Buffer(make([]byte, 64*1024), 1024*1024)
+	var event, data string
+	for scanner.Scan() {
+		line := scanner.Text()
+		switch {
+		case line == "":
+			if event == "state" {
+				n.observe(data)
+			}
+			event, data = "", ""
+		case strings.HasPrefix(line, "event:"):
+			event = strings.TrimSpace(strings.TrimPrefix(line, "event:"))
+		case strings.HasPrefix(line, "data:"):
+			data += strings.TrimSpace(strings.TrimPrefix(line, "data:"))
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return err
+	}
+	return fmt.Errorf("stream closed")
+}
+
+// observe records a state event of a numeric sensor entity. Unavailable
+// sensors report a null value and are skipped.
+func (n *esphomeNode) observe(data string) {
+	var state esphomeState
+	if err := json.Unmarshal([]byte(data), &state); err != nil || state.Value == nil || math.IsNaN(*state.Value) {
+		return
+	}
+	id, ok := strings.CutPrefix(state.ID, "sensor-")
+	if !ok {
+		return
+	}
+	name, ok := n.sensors[id]
+	if !ok {
+		name = metricName(id)
+	}
+	if name == "" {
+		return
+	}
+	n.mu.Lock()
+	n.states[name] = *state.Value
+	n.mu.Unlock()
+}
+
+// run stores the states received since the last interval.
+func (n *esphomeNode) run(interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for now := range ticker.C {
+		n.mu.Lock()
+		values := n.states
+		n.states = make(map[string]float64)
+		n.mu.Unlock()
+		if len(values) == 0 || !isLeader() {
+			continue
+		}
+		if err := ingestMetrics(context.Background(), n.name, values, now); err != nil {
+			log.Printf("ESPHome node %s: storing readings failed: %v", n.name, err)
+		}
+	}
+}
@@ -0,0 +1,193 @@
+package main
+
+import (
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/labstack/echo/v4"
+	"golang.org/x/net/websocket"
+)
+
+// Dashboard widgets share one WebSocket at /api/ws. The server sends typed
+// events:
+//
+//	{"type": "sensor.update", "time": "...", "data": {...}}
+//
+// and a client narrows what it receives with
+//
+//	{"action": "subscribe", "types": ["sensor.update", "alarm.changed"]}
+//	{"action": "unsubscribe", "types": ["sensor.update"]}
+//
+// A client that has not subscribed to anything receives every event.
+
+const (
+	EventSensorUpdate       = "sensor.update"
+	EventAlarmChanged       = "alarm.changed"
+	EventAlarmPrewake       = "alarm.prewake"
+	EventDeviceOffline      = "device.offline"
+	EventDeviceOnline       = "device.online"
+	EventRuleTriggered      = "rule.triggered"
+	EventAlertChanged       = "alert.changed"
+	EventMuteChanged        = "mute.changed"
+	EventDeviceRebooted     = "device.rebooted"
+	EventMaintenanceChanged = "maintenance.changed"
+	EventProfileChanged     = "profile.changed"
+)
+
+type Event struct {
+	Type string      `json:"type"`
+	Time time.Time   `json:"time"`
+	Data interface{} `json:"data"`
+}
+
+type eventClient struct {
+	mu     sync.Mutex
+	types  map[string]bool
+	events chan Event
+}
+
+func (c *eventClient) wants(eventType string) bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return len(c.types) == 0 || c.types[eventType]
+}
+
+type eventHub struct {
+	mu      sync.Mutex
+	clients map[*eventClient]bool
+}
+
+var events = &eventHub{clients: make(map[*eventClient]bool)}
+
+// publish fans an event out to all interested clients, on every replica.
+func publish(eventType string, data interface{}) {
+	e := Event{Type: eventType, Time: time.Now(), Data: data}
+	deliver(e)
+	clusterSend(clusterMessage{Kind: "event", Event: &e})
+}
+
+// deliver hands an event to this replica's clients. A client whose buffer
+// is full misses the event rather than slowing down the publisher.
+func deliver(e Event) {
+	events.mu.Lock()
+	defer events.mu.Unlock()
+	for c := range events.clients {
+		if !c.wants(e.Type) {
+			continue
+		}
+		select {
+		case c.events <- e:
+		default:
+		}
+	}
+}
+
+func (h *eventHub) add(c *eventClient) {
+	h.mu.Lock()
+	h.clients[c] = true
+	h.mu.Unlock()
+}
+
+func (h *eventHub) remove(c *eventClient) {
+	h.mu.Lock()
+	delete(h.clients, c)
+	h.mu.Unlock()
+}
+
+func serveEvents(c echo.Context) error {
+	websocket.Handler(func(ws *websocket.Conn) {
+		defer ws.Close()
+		// The server's read and write timeouts do not apply to a stream
+		ws.SetDeadline(time.Time{})
+
+		client := &eventClient{types: make(map[string]bool), events: make(chan Event, 64)}
+		events.add(client)
+		defer events.remove(client)
+
+		done := make(chan struct{})
+		go func() {
+			defer close(done)
+			for {
+				var msg struct {
+					Action string   `json:"action"`
+					Types  []string `json:"types"`
+				}
+				if err := websocket.JSON.Receive(ws, &msg); err != nil {
+					return
+				}
+				client.mu.Lock()
+				for _, t := range msg.Types {
+					switch msg.Action {
+					case "subscribe":
+						client.types[t] = true
+					case "unsubscribe":
+						delete(client.types, t)
+					}
+				}
+				client.mu.Unlock()
+			}
+		}()
+
+		for {
+			select {
+			case e := <-client.events:
+				if err := websocket.JSON.Send(ws, e); err != nil {
+					return
+				}
+			case <-done:
+				return
+			}
+		}
+	}).ServeHTTP(c.Response(), c.Request())
+	return nil
+}
+
+// devicesOffline is the last known liveness of each device, by name.
+var devicesOffline = make(map[string]bool)
+
+// checkDeviceLiveness publishes device.offline once a device has not
+// reported or sent a heartbeat for DEVICE_OFFLINE_AFTER, and device.online
+// when it is back. A device going offline during OFFLINE_ALERT_HOURS, when
+// the alarm depends on it, is a critical notification.
+func checkDeviceLiveness() error {
+	offlineAfter := settingDuration("device_offline_after")
+	rows, err := db.Query(`
+		SELECT name, last_seen FROM devices WHERE last_seen IS NOT NULL
+	`)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var name string
+		var lastSeen time.Time
+		if err := rows.Scan(&name, &lastSeen); err != nil {
+			return err
+		}
+		offline := time.Since(lastSeen) > offlineAfter
+		if offline && maintenanceActive(time.Now()) {
+			// Reported once maintenance ends, if still offline
+			continue
+		}
+		if offline != devicesOffline[name] {
+			devicesOffline[name] = offline
+			eventType := EventDeviceOnline
+			if offline {
+				eventType = EventDeviceOffline
+			}
+			publish(eventType, map[string]interface{}{"device": name, "last_seen": lastSeen})
+			if offline && inClockRange("offline_alert_hours", time.Now()) {
+				go notify(Notification{
+					Event:    "device.offline",
+					Title:    fmt.Sprintf("%s offline", name),
+					Message:  fmt.Sprintf("%s has not reported since %s.", name, lastSeen.Format("15:04")),
+					Priority: 5,
+					Tags:     []string{"electric_plug", "warning"},
+				})
+			}
+		}
+	}
+	return rows.Err()
+}
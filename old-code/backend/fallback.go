@@ -0,0 +1,173 @@
+package main
+
+import (
+	"database/sql"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/labstack/echo/v4"
+)
+
+// The server is a backup alarm: if no device reports alarm_active within
+// alarm_fallback_after of an armed alarm, the alarm_fallback job pushes a
+// maximum priority notification instead. With PUSHOVER_TOKEN and
+// PUSHOVER_USER it is a Pushover emergency message, which repeats on the
+// phone until acknowledged there; otherwise the notification is repeated
+// every FALLBACK_REPEAT (at most FALLBACK_MAX_REPEATS times) until the
+// device starts ringing or POST /api/alarm/fallback/ack stops it. What was
+// sent for an alarm is kept in alarm_fallbacks, so the acknowledgement
+// reaches the leader whichever replica it arrives at.
+
+// lastAlarmAt returns the latest occurrence of an "HH:MM" alarm at or
+// before now.
+func lastAlarmAt(alarm string, now time.Time) (time.Time, error) {
+	next, err := nextAlarmAt(alarm, now)
+	if err != nil {
+		return next, err
+	}
+	return next.AddDate(0, 0, -1), nil
+}
+
+// alarmConfirmed reports whether a device is ringing or reported ringing
+// since the alarm.
+func alarmConfirmed(alarmAt time.Time) (bool, error) {
+	var confirmed bool
+	err := db.QueryRow(`
+		SELECT EXISTS (SELECT 1 FROM alarm_rings WHERE ended_at IS NULL OR started_at >= $1)
+			OR EXISTS (SELECT 1 FROM device_status WHERE alarm_active AND last_seen >= $1)
+	`, alarmAt.Add(-time.Minute)).Scan(&confirmed)
+	return confirmed, err
+}
+
+// checkAlarmFallback is the alarm_fallback job.
+func checkAlarmFallback() error {
+	now := time.Now()
+	alarm, err := currentAlarm()
+	if err == sql.ErrNoRows {
+		return nil
+	} else if err != nil {
+		return err
+	}
+	if !alarm.Armed || maintenanceActive(now) {
+		return nil
+	}
+	alarmAt, err := lastAlarmAt(alarm.Time, now)
+	if err != nil {
+		return err
+	}
+	// Only the first hour after the alarm is watched
+	since := now.Sub(alarmAt)
+	if since < settingDuration("alarm_fallback_after") || since > time.Hour {
+		return nil
+	}
+	skip, err := loadAlarmSkip(alarmAt.Format("2006-01-02"))
+	if err != nil || skip.Skip {
+		return err
+	}
+	alarmAt = serverTime(alarmAt) // compared with TIMESTAMP columns from here on
+
+	if _, err := db.Exec("DELETE FROM alarm_fallbacks WHERE alarm_at < $1", alarmAt.AddDate(0, 0, -7)); err != nil {
+		return err
+	}
+	if _, err := db.Exec("INSERT INTO alarm_fallbacks (alarm_at) VALUES ($1) ON CONFLICT (alarm_at) DO NOTHING", alarmAt); err != nil {
+		return err
+	}
+	// last_at is compared in SQL, as it comes back labelled UTC
+	var sent int
+	var recent, stopped bool
+	err = db.QueryRow(`
+		SELECT sent, COALESCE(last_at > $2, false), stopped FROM alarm_fallbacks WHERE alarm_at = $1
+	`, alarmAt, serverTime(now.Add(-envDuration("FALLBACK_REPEAT", time.Minute)))).Scan(&sent, &recent, &stopped)
+	if err != nil || stopped {
+		return err
+	}
+	confirmed, err := alarmConfirmed(alarmAt)
+	if err != nil {
+		return err
+	}
+	if confirmed {
+		if sent > 0 {
+			log.Printf("Alarm device started ringing, backup alarm stopped")
+		}
+		_, err := db.Exec("UPDATE alarm_fallbacks SET stopped = true WHERE alarm_at = $1", alarmAt)
+		return err
+	}
+
+	pushover := envString("PUSHOVER_TOKEN", "") != "" && envString("PUSHOVER_USER", "") != ""
+	if sent > 0 && (pushover || sent >= envInt("FALLBACK_MAX_REPEATS", 10) || recent) {
+		return nil
+	}
+	// Counted only while not acknowledged in the meantime
+	res, err := db.Exec(`
+		UPDATE alarm_fallbacks SET sent = sent + 1, last_at = $3 WHERE alarm_at = $1 AND sent = $2 AND NOT stopped
+	`, alarmAt, sent, serverTime(now))
+	if err != nil {
+		return err
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		return nil
+	}
+
+	n := Notification{
+		Event:    "alarm",
+		Title:    "Wake up! (backup alarm)",
+		Message:  fmt.Sprintf("The %s alarm did not start ringing on the device.", alarm.Time),
+		Priority: 5,
+		Tags:     []string{"alarm_clock", "rotating_light"},
+	}
+	publish(EventAlarmChanged, map[string]interface{}{"fallback": true, "alarm_at": alarmAt})
+	if pushover {
+		if sms != nil {
+			if err := sms.send(n); err != nil {
+				log.Printf("Failed to text the backup alarm: %v", err)
+			}
+		}
+		return sendPushoverEmergency(n)
+	}
+	notify(n)
+	return nil
+}
+
+func sendPushoverEmergency(n Notification) error {
+	form := url.Values{
+		"token":    {envString("PUSHOVER_TOKEN", "")},
+		"user":     {envString("PUSHOVER_USER", "")},
+		"title":    {n.Title},
+		"message":  {n.Message},
+		"priority": {"2"},
+		"retry":    {"60"},
+		"expire":   {"1800"},
+		"sound":    {envString("PUSHOVER_SOUND", "persistent")},
+	}
+	resp, err := notifyClient.Post("https://api.pushover.net/1/messages.json",
+		"application/x-www-form-urlencoded", strings.NewReader(form.Encode()))
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode >= 300 {
+		return fmt.Errorf("pushover returned %s", resp.Status)
+	}
+	return nil
+}
+
+// ackAlarmFallback stops the repeated backup alarm, e.g. from the phone.
+func ackAlarmFallback(c echo.Context) error {
+	var alarmAt time.Time
+	err := db.QueryRowContext(c.Request().Context(), `
+		UPDATE alarm_fallbacks SET stopped = true
+		WHERE alarm_at = (SELECT MAX(alarm_at) FROM alarm_fallbacks) AND sent > 0 AND NOT stopped
+		RETURNING alarm_at
+	`).Scan(&alarmAt)
+	if err == sql.ErrNoRows {
+		return apiError(c, http.StatusConflict, "the backup alarm is not active")
+	} else if err != nil {
+		return internalError(c, err)
+	}
+	publish(EventAlarmChanged, map[string]interface{}{"fallback": false, "alarm_at": alarmAt})
+	return c.NoContent(http.StatusNoContent)
+}
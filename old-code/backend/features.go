@@ -0,0 +1,46 @@
+package main
+
+import (
+	"context"
+	"net/http"
+
+	"github.com/labstack/echo/v4"
+)
+
+// features reports which optional subsystems this deployment was
+// configured with, so the frontend can hide the panels of the others.
+func features() map[string]bool {
+	_, _, home := homeCoordinates(context.Background())
+	return map[string]bool{
+		"oidc":          oidc != nil,
+		"tracing":       tracing != nil,
+		"presence":      presence != nil,
+		"geofence":      home,
+		"weather":       home,
+		"calendar":      envString("BRIEFING_CALENDAR_URL", "") != "",
+		"tts":           tts != nil,
+		"notifications": envString("NTFY_URL", "") != "",
+		"sms":           sms != nil,
+		"discord":       envString("DISCORD_WEBHOOK_URL", "") != "",
+		"slack":         envString("SLACK_WEBHOOK_URL", "") != "",
+		"pushover":      envString("PUSHOVER_TOKEN", "") != "" && envString("PUSHOVER_USER", "") != "",
+		"escalation":    envString("ESCALATION_WEBHOOK_URL", "") != "",
+		"archive":       archiveStore != nil,
+		"backup_upload": envString("BACKUP_S3_BUCKET", "") != "",
+		"ttn":           envString("TTN_WEBHOOK_SECRET", "") != "",
+		"esphome":       envString("ESPHOME_NODES", "") != "",
+		"influx":        envString("INFLUX_TOKEN", "") != "",
+		"alexa":         findLinkClient(envString("ALEXA_CLIENT_ID", "")) != nil,
+		"google_home":   findLinkClient(envString("GOOGLE_CLIENT_ID", "")) != nil,
+		"homekit":       homeKit != nil,
+		"zigbee2mqtt":   zigbee != nil,
+		"thermostat":    thermostat != nil,
+		"calendar_feed": envString("CALENDAR_TOKEN", "") != "",
+		"web_push":      envBool("WEB_PUSH", true),
+		"energy":        envString("SHELLY_METERS", "") != "" || envString("ENERGY_MQTT_URL", "") != "",
+	}
+}
+
+func getFeatures(c echo.Context) error {
+	return c.JSON(http.StatusOK, features())
+}
@@ -0,0 +1,197 @@
+package main
+
+import (
+	"math"
+	"net/http"
+	"sort"
+	"sync"
+
+	"github.com/labstack/echo/v4"
+)
+
+// MetricFilter cleans up a noisy metric on ingest, before it is stored or
+// checked against the rules. "median" replaces each reading with the median
+// of the device's last Window readings. "spike" drops a reading that jumps
+// more than MaxJumpPct percent from the previous accepted one; if the next
+// reading confirms the jump it is accepted, so real changes get through one
+// sample late. Dropped readings count as rejected samples ("spike"). Zero
+// readings (sensor not ready) are passed through untouched.
+type MetricFilter struct {
+	Metric     string  `json:"metric"`
+	Kind       string  `json:"kind"`                   // median | spike
+	Window     int     `json:"window,omitempty"`       // median: readings, 3 to 15
+	MaxJumpPct float64 `json:"max_jump_pct,omitempty"` // spike
+}
+
+type filterKey struct {
+	deviceID int
+	metric   string
+}
+
+type filterState struct {
+	recent   []float64 // median: last readings, oldest first
+	accepted float64   // spike: last accepted reading
+	rejected float64   // spike: the reading dropped last, if any
+}
+
+var (
+	filterMu     sync.Mutex
+	filterStates = make(map[filterKey]*filterState)
+)
+
+func loadMetricFilters() (map[string]MetricFilter, error) {
+	rows, err := db.Query("SELECT metric, kind, window_size, max_jump_pct FROM metric_filters")
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	filters := make(map[string]MetricFilter)
+	for rows.Next() {
+		var f MetricFilter
+		if err := rows.Scan(&f.Metric, &f.Kind, &f.Window, &f.MaxJumpPct); err != nil {
+			return nil, err
+		}
+		filters[f.Metric] = f
+	}
+	return filters, rows.Err()
+}
+
+func (f MetricFilter) apply(s *filterState, v float64) (float64, bool) {
+	switch f.Kind {
+	case "median":
+		s.recent = append(s.recent, v)
+		if len(s.recent) > f.Window {
+			s.recent = s.recent[len(s.recent)-f.Window:]
+		}
+		sorted := append([]float64(nil), s.recent...)
+		sort.Float64s(sorted)
+		n := len(sorted)
+		if n%2 == 1 {
+			return sorted[n/2], true
+		}
+		return (sorted[n/2-1] + sorted[n/2]) / 2, true
+	case "spike":
+		jumped := func(from float64) bool {
+			return from != 0 && math.Abs(v-from)/math.Abs(from)*100 > f.MaxJumpPct
+		}
+		if s.accepted != 0 && jumped(s.accepted) && (s.rejected == 0 || jumped(s.rejected)) {
+			s.rejected = v
+			return 0, false
+		}
+		s.accepted, s.rejected = v, 0
+	}
+	return v, true
+}
+
+// presentReadings leaves the metrics without a reading (0) out of values,
+// so they are neither filtered nor checked against the rules.
+func presentReadings(values map[string]float64) map[string]float64 {
+	present := make(map[string]float64, len(values))
+	for metric, v := range values {
+		if v != 0 {
+			present[metric] = v
+		}
+	}
+	return present
+}
+
+// applyFilters filters values of a device in place. Rejected readings are
+// removed and counted.
+func applyFilters(deviceID int, values map[string]float64) (rejected int, err error) {
+	filters, err := loadMetricFilters()
+	if err != nil || len(filters) == 0 {
+		return 0, err
+	}
+	filterMu.Lock()
+	defer filterMu.Unlock()
+	for metric, v := range values {
+		f, ok := filters[metric]
+		if !ok || v == 0 {
+			continue
+		}
+		key := filterKey{deviceID, metric}
+		s := filterStates[key]
+		if s == nil {
+			s = &filterState{}
+			filterStates[key] = s
+		}
+		if filtered, ok := f.apply(s, v); ok {
+			values[metric] = filtered
+		} else {
+			delete(values, metric)
+			rejected++
+		}
+	}
+	return rejected, nil
+}
+
+// resetFilterState forgets the history of a metric after its filter changed.
+func resetFilterState(metric string) {
+	filterMu.Lock()
+	defer filterMu.Unlock()
+	for key := range filterStates {
+		if key.metric == metric {
+			delete(filterStates, key)
+		}
+	}
+}
+
+func getMetricFilters(c echo.Context) error {
+	filters, err := loadMetricFilters()
+	if err != nil {
+		return internalError(c, err)
+	}
+	list := []MetricFilter{}
+	for _, f := range filters {
+		list = append(list, f)
+	}
+	sort.Slice(list, func(i, j int) bool { return list[i].Metric < list[j].Metric })
+	return c.JSON(http.StatusOK, list)
+}
+
+// putMetricFilter sets the filter of a metric, e.g. {"kind": "median",
+// "window": 5} or {"kind": "spike", "max_jump_pct": 50}.
+func putMetricFilter(c echo.Context) error {
+	var f MetricFilter
+	if err := c.Bind(&f); err != nil {
+		return invalidBody(c, err)
+	}
+	f.Metric = c.Param("metric")
+	if !knownMetric(f.Metric) {
+		return apiError(c, http.StatusBadRequest, "unknown metric")
+	}
+	switch f.Kind {
+	case "median":
+		if f.Window < 3 || f.Window > 15 {
+			return apiError(c, http.StatusBadRequest, "window must be between 3 and 15")
+		}
+		f.MaxJumpPct = 0
+	case "spike":
+		if f.MaxJumpPct <= 0 {
+			return apiError(c, http.StatusBadRequest, "max_jump_pct must be positive")
+		}
+		f.Window = 0
+	default:
+		return apiError(c, http.StatusBadRequest, "kind must be median or spike")
+	}
+
+	_, err := db.Exec(`
+		INSERT INTO metric_filters (metric, kind, window_size, max_jump_pct) VALUES ($1, $2, $3, $4)
+		ON CONFLICT (metric) DO UPDATE
+		SET kind = EXCLUDED.kind, window_size = EXCLUDED.window_size, max_jump_pct = EXCLUDED.max_jump_pct
+	`, f.Metric, f.Kind, f.Window, f.MaxJumpPct)
+	if err != nil {
+		return internalError(c, err)
+	}
+	resetFilterState(f.Metric)
+	return c.JSON(http.StatusOK, f)
+}
+
+func deleteMetricFilter(c echo.Context) error {
+	metric := c.Param("metric")
+	if _, err := db.Exec("DELETE FROM metric_filters WHERE metric = $1", metric); err != nil {
+		return internalError(c, err)
+	}
+	resetFilterState(metric)
+	return c.NoContent(http.StatusNoContent)
+}
@@ -0,0 +1,48 @@
+package main
+
+import "testing"
+
+func TestMetricFilterApply(t *testing.T) {
+	type step struct {
+		in   float64
+		want float64
+		ok   bool
+	}
+	spike := MetricFilter{Metric: "co2", Kind: "spike", MaxJumpPct: 50}
+	median := MetricFilter{Metric: "sound", Kind: "median", Window: 3}
+
+	tests := []struct {
+		name   string
+		filter MetricFilter
+		steps  []step
+	}{
+		{"spike: steady readings pass", spike, []step{{600, 600, true}, {650, 650, true}, {700, 700, true}}},
+		{"spike: a glitch is dropped", spike, []step{{600, 600, true}, {5000, 0, false}, {620, 620, true}}},
+		{"spike: a confirmed jump is accepted one late", spike, []step{{600, 600, true}, {1500, 0, false}, {1520, 1520, true}, {1510, 1510, true}}},
+		{"spike: two different glitches", spike, []step{{600, 600, true}, {5000, 0, false}, {100, 0, false}, {610, 610, true}}},
+		{"spike: the first reading passes", spike, []step{{5000, 5000, true}}},
+		{"median: fills up", median, []step{{40, 40, true}, {60, 50, true}, {90, 60, true}}},
+		{"median: a lone spike is flattened", median, []step{{40, 40, true}, {42, 41, true}, {95, 42, true}, {41, 42, true}, {43, 43, true}}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s := &filterState{}
+			for i, st := range tt.steps {
+				got, ok := tt.filter.apply(s, st.in)
+				if got != st.want || ok != st.ok {
+					t.Errorf("reading %d (%g) = %g, %v, want %g, %v", i, st.in, got, ok, st.want, st.ok)
+				}
+			}
+		})
+	}
+}
+
+func TestPresentReadings(t *testing.T) {
+	got := presentReadings(map[string]float64{"co2": 0, "sound": 42, "rssi": -60})
+	if len(got) != 2 || got["sound"] != 42 || got["rssi"] != -60 {
+		t.Errorf("presentReadings = %v", got)
+	}
+	if _, ok := got["co2"]; ok {
+		t.Error("a zero reading was kept")
+	}
+}
@@ -0,0 +1,154 @@
+package main
+
+import (
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/labstack/echo/v4"
+)
+
+// Forecasts resample the recent history into forecastStep buckets. With at
+// least two days of data an additive Holt-Winters model with a daily season
+// is used, which captures the bedroom filling up every night; otherwise the
+// forecast falls back to Holt's linear trend. Like the trend, a forecast is
+// of one device or room (see seriesScope).
+
+const (
+	forecastStep    = 15 * time.Minute
+	forecastHistory = 3 * 24 * time.Hour
+	forecastSeason  = int(24 * time.Hour / forecastStep)
+
+	forecastAlpha = 0.5 // level smoothing
+	forecastBeta  = 0.1 // trend smoothing
+	forecastGamma = 0.1 // seasonal smoothing
+)
+
+type Forecast struct {
+	Metric    string     `json:"metric"`
+	Horizon   string     `json:"horizon"`
+	Model     string     `json:"model"` // holt-winters | holt
+	Threshold float64    `json:"threshold"`
+	ExceedsAt *time.Time `json:"exceeds_threshold_at,omitempty"`
+	Points    []Point    `json:"points"`
+	SeriesScope
+}
+
+// holt forecasts steps values ahead with double exponential smoothing.
+func holt(values []float64, steps int) []float64 {
+	level, trend := values[0], values[1]-values[0]
+	for _, y := range values[1:] {
+		lastLevel := level
+		level = forecastAlpha*y + (1-forecastAlpha)*(level+trend)
+		trend = forecastBeta*(level-lastLevel) + (1-forecastBeta)*trend
+	}
+
+	out := make([]float64, steps)
+	for h := range out {
+		out[h] = level + float64(h+1)*trend
+	}
+	return out
+}
+
+// holtWinters forecasts steps values ahead with additive seasonality of the
+// given period. It needs at least two full periods of values.
+func holtWinters(values []float64, period, steps int) []float64 {
+	mean := func(vs []float64) float64 {
+		var sum float64
+		for _, v := range vs {
+			sum += v
+		}
+		return sum / float64(len(vs))
+	}
+	first, second := mean(values[:period]), mean(values[period:2*period])
+	level, trend := first, (second-first)/float64(period)
+	season := make([]float64, period)
+	for i := range season {
+		season[i] = values[i] - first
+	}
+
+	for t, y := range values {
+		s := season[t%period]
+		lastLevel := level
+		level = forecastAlpha*(y-s) + (1-forecastAlpha)*(level+trend)
+		trend = forecastBeta*(level-lastLevel) + (1-forecastBeta)*trend
+		season[t%period] = forecastGamma*(y-level) + (1-forecastGamma)*s
+	}
+
+	n := len(values)
+	out := make([]float64, steps)
+	for h := range out {
+		out[h] = level + float64(h+1)*trend + season[(n+h)%period]
+	}
+	return out
+}
+
+func getSensorForecast(c echo.Context) error {
+	metric := c.QueryParam("metric")
+	if metric == "" {
+		metric = "co2"
+	}
+	if !knownMetric(metric) {
+		return apiError(c, http.StatusBadRequest, "unknown metric")
+	}
+
+	horizon := 2 * time.Hour
+	if h := c.QueryParam("horizon"); h != "" {
+		d, err := time.ParseDuration(h)
+		if err != nil || d < forecastStep || d > 24*time.Hour {
+			return apiError(c, http.StatusBadRequest, "horizon must be between 15m and 24h")
+		}
+		horizon = d
+	}
+
+	threshold := metricThreshold(metric)
+	if t := c.QueryParam("threshold"); t != "" {
+		f, err := strconv.ParseFloat(t, 64)
+		if err != nil {
+			return apiError(c, http.StatusBadRequest, "invalid threshold")
+		}
+		threshold = f
+	}
+
+	scope, err := seriesScope(c)
+	if err != nil {
+		return handlerError(c, err)
+	}
+	now := time.Now()
+	points, err := querySeries(metric, scope, now.Add(-forecastHistory), now)
+	if err != nil {
+		return internalError(c, err)
+	}
+	buckets := bucketAverages(points, forecastStep)
+	if len(buckets) < 2 {
+		return apiError(c, http.StatusConflict, "not enough recent data to forecast")
+	}
+
+	values := make([]float64, len(buckets))
+	for i, b := range buckets {
+		values[i] = b.Value
+	}
+	steps := int(horizon / forecastStep)
+
+	forecast := Forecast{Metric: metric, SeriesScope: scope, Horizon: horizon.String(), Threshold: threshold, Points: []Point{}}
+	var predicted []float64
+	if len(values) >= 2*forecastSeason {
+		forecast.Model = "holt-winters"
+		predicted = holtWinters(values, forecastSeason, steps)
+	} else {
+		forecast.Model = "holt"
+		predicted = holt(values, steps)
+	}
+
+	last := buckets[len(buckets)-1].Timestamp
+	for i, v := range predicted {
+		p := Point{Timestamp: last.Add(time.Duration(i+1) * forecastStep), Value: v}
+		forecast.Points = append(forecast.Points, p)
+		if forecast.ExceedsAt == nil && v >= threshold {
+			at := p.Timestamp
+			forecast.ExceedsAt = &at
+		}
+	}
+
+	return c.JSON(http.StatusOK, forecast)
+}
@@ -0,0 +1,170 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/labstack/echo/v4"
+)
+
+// A gap is a stretch without samples of a metric from a device: it was
+// offline, rebooting or its reports got lost. Two samples further apart
+// than gapFactor report intervals (the device's reporting config, see
+// reporting.go) bound a gap, and so do the last sample and the end of the
+// range when the device stopped reporting. GET /api/sensor-data/gaps lists
+// them, and charts mark them, so that a line drawn across one is not taken
+// for real readings.
+
+const gapFactor = 3
+
+type Gap struct {
+	Device  string    `json:"device,omitempty"`
+	Metric  string    `json:"metric"`
+	From    time.Time `json:"from"` // the last sample before the gap
+	To      time.Time `json:"to"`   // the first sample after it, or the end of the range
+	Seconds int64     `json:"seconds"`
+	Missing int64     `json:"missing"` // reports expected in between
+	Ongoing bool      `json:"ongoing,omitempty"`
+	// requested | resolved | expired, when the device was asked to backfill it
+	Backfill string `json:"backfill,omitempty"`
+}
+
+// findGaps returns the gaps of metric between from and to, oldest first,
+// of one device or of all of them (deviceID 0).
+func findGaps(ctx context.Context, metric string, deviceID int, from, to time.Time) ([]Gap, error) {
+	defaultInterval := defaultReportingConfig(0).ReportIntervalSeconds
+	// A metric stored only on change has a sample at least every
+	// max_interval_seconds (see storage_policy.go)
+	var minGap int64
+	if p, ok := storagePolicies()[metric]; ok {
+		minGap = int64(p.MaxIntervalSeconds)
+	}
+	table, filter := "metric_samples", "metric = $6"
+	args := []interface{}{from, to, deviceID, defaultInterval, minGap, metric}
+	if column, ok := metricColumns[metric]; ok {
+		table, filter = "sensor_data", column+" != 0"
+		args = args[:5]
+	}
+	rows, err := db.QueryContext(ctx, fmt.Sprintf(`
+		WITH s AS (
+			SELECT device_id, timestamp,
+				LAG(timestamp) OVER w AS prev,
+				LEAD(timestamp) OVER w IS NULL AS last
+			FROM %s
+			WHERE timestamp >= $1 AND timestamp < $2 AND %s AND ($3 = 0 OR device_id = $3)
+			WINDOW w AS (PARTITION BY device_id ORDER BY timestamp)
+		)
+		SELECT COALESCE(d.name, ''), COALESCE(r.report_interval_seconds, $4), s.prev, s.timestamp, s.last
+		FROM s
+		LEFT JOIN devices d ON d.id = s.device_id
+		LEFT JOIN device_reporting r ON r.device_id = s.device_id
+		WHERE s.last OR s.timestamp - s.prev > make_interval(secs => GREATEST(COALESCE(r.report_interval_seconds, $4) * %d, $5))
+		ORDER BY s.timestamp
+	`, table, filter, gapFactor), args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	now := time.Now()
+	gaps := []Gap{}
+	var trailing []Gap
+	for rows.Next() {
+		var g Gap
+		var interval int64
+		var prev *time.Time
+		var at time.Time
+		var last bool
+		if err := rows.Scan(&g.Device, &interval, &prev, &at, &last); err != nil {
+			return nil, err
+		}
+		g.Metric = metric
+		limit := time.Duration(max(interval*gapFactor, minGap)) * time.Second
+		if prev != nil && at.Sub(*prev) > limit {
+			gaps = append(gaps, g.between(*prev, at, interval))
+		}
+		if last && to.Sub(at) > limit {
+			t := g.between(at, to, interval)
+			t.Ongoing = !to.Before(now.Add(-time.Minute))
+			trailing = append(trailing, t)
+		}
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	return append(gaps, trailing...), nil
+}
+
+func (g Gap) between(from, to time.Time, interval int64) Gap {
+	g.From, g.To = from, to
+	g.Seconds = int64(to.Sub(from).Seconds())
+	if interval > 0 {
+		g.Missing = max(g.Seconds/interval-1, 0)
+	}
+	return g
+}
+
+// getSensorGaps lists the gaps of ?metric= (co2) over the last 24 hours or
+// ?from=&to= (RFC 3339), of every device or ?device=.
+func getSensorGaps(c echo.Context) error {
+	metric := c.QueryParam("metric")
+	if metric == "" {
+		metric = "co2"
+	}
+	if !knownMetric(metric) {
+		return apiError(c, http.StatusBadRequest, "unknown metric")
+	}
+	now := time.Now()
+	from, to := now.Add(-24*time.Hour), now
+	var err error
+	if v := c.QueryParam("from"); v != "" {
+		if from, err = time.Parse(time.RFC3339, v); err != nil {
+			return apiError(c, http.StatusBadRequest, "from must be an RFC 3339 time")
+		}
+	}
+	if v := c.QueryParam("to"); v != "" {
+		if to, err = time.Parse(time.RFC3339, v); err != nil {
+			return apiError(c, http.StatusBadRequest, "to must be an RFC 3339 time")
+		}
+	}
+	if !to.After(from) {
+		return apiError(c, http.StatusBadRequest, "to must be after from")
+	}
+	deviceID := 0
+	if name := c.QueryParam("device"); name != "" {
+		err := db.QueryRowContext(c.Request().Context(), "SELECT id FROM devices WHERE name = $1", name).Scan(&deviceID)
+		if err == sql.ErrNoRows {
+			return apiErrorCode(c, http.StatusNotFound, codeDeviceNotFound, "device not found")
+		} else if err != nil {
+			return internalError(c, err)
+		}
+	}
+
+	gaps, err := findGaps(c.Request().Context(), metric, deviceID, from, to)
+	if err != nil {
+		return internalError(c, err)
+	}
+	statuses, err := backfillStatuses(c.Request().Context(), from, to)
+	if err != nil {
+		return internalError(c, err)
+	}
+	for i, g := range gaps {
+		gaps[i].Backfill = statuses[backfillKey(g.Device, g.From)]
+	}
+	var missing, seconds int64
+	for _, g := range gaps {
+		missing += g.Missing
+		seconds += g.Seconds
+	}
+	return c.JSON(http.StatusOK, map[string]interface{}{
+		"metric":          metric,
+		"from":            from,
+		"to":              to,
+		"gaps":            gaps,
+		"missing_samples": missing,
+		"gap_seconds":     seconds,
+	})
+}
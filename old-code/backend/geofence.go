@@ -0,0 +1,256 @@
+package main
+
+import (
+	"context"
+	"crypto/subtle"
+	"fmt"
+	"log"
+	"math"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/labstack/echo/v4"
+)
+
+// Phones report their location to POST /api/presence/location, either as an
+// OwnTracks HTTP payload (user taken from the X-Limit-U header or ?person=)
+// or as a plain {"person", "lat", "lon"} body from a shortcut. Every evening
+// the geofence_check job checks whether everyone is farther than HOME_RADIUS
+// metres from home and if so skips the next alarm. Home is where the alarm
+// devices are (see devices.go), or HOME_LAT/HOME_LON; the geofence is
+// disabled without either.
+//
+// Location reports need GEOFENCE_TOKEN, sent as "Authorization: Bearer" or
+// as the basic auth password, which is what OwnTracks' HTTP mode sends.
+// Only the people in GEOFENCE_PEOPLE (by default those in PRESENCE_PEOPLE)
+// may report.
+
+type LocationReport struct {
+	Type     string  `json:"_type"`
+	Person   string  `json:"person"`
+	Lat      float64 `json:"lat"`
+	Lon      float64 `json:"lon"`
+	Accuracy float64 `json:"acc"`
+}
+
+type PersonLocation struct {
+	Person     string    `json:"person"`
+	Lat        float64   `json:"lat"`
+	Lon        float64   `json:"lon"`
+	Accuracy   float64   `json:"accuracy"`
+	DistanceM  float64   `json:"distance_m"`
+	Home       bool      `json:"home"`
+	ReportedAt time.Time `json:"reported_at"`
+}
+
+type geofenceConfig struct {
+	lat, lon float64
+	radius   float64
+}
+
+func initGeofence() {
+	registerJob("geofence_check", "0 22 * * *", func() error {
+		g := loadGeofence(context.Background())
+		if g == nil {
+			return nil
+		}
+		return g.checkOvernight(time.Now())
+	})
+}
+
+// loadGeofence returns the geofence around home, nil without coordinates.
+func loadGeofence(ctx context.Context) *geofenceConfig {
+	lat, lon, ok := homeCoordinates(ctx)
+	if !ok {
+		return nil
+	}
+	return &geofenceConfig{lat: lat, lon: lon, radius: envFloat("HOME_RADIUS", 200)}
+}
+
+// geofencePerson reports whether person may post locations.
+func geofencePerson(person string) bool {
+	spec := envString("GEOFENCE_PEOPLE", "")
+	if spec == "" {
+		spec = envString("PRESENCE_PEOPLE", "")
+	}
+	for _, entry := range strings.Split(spec, ",") {
+		name, _, _ := strings.Cut(strings.TrimSpace(entry), "=")
+		if name != "" && name == person {
+			return true
+		}
+	}
+	return false
+}
+
+// distanceMeters is the haversine distance between two coordinates.
+func distanceMeters(lat1, lon1, lat2, lon2 float64) float64 {
+	const earthRadius = 6371000.0
+	rad := math.Pi / 180
+	dLat := (lat2 - lat1) * rad
+	dLon := (lon2 - lon1) * rad
+	a := math.Sin(dLat/2)*math.Sin(dLat/2) +
+		math.Cos(lat1*rad)*math.Cos(lat2*rad)*math.Sin(dLon/2)*math.Sin(dLon/2)
+	return 2 * earthRadius * math.Asin(math.Sqrt(a))
+}
+
+func (g *geofenceConfig) locate(l *PersonLocation) {
+	l.DistanceM = distanceMeters(g.lat, g.lon, l.Lat, l.Lon)
+	l.Home = l.DistanceM <= g.radius+l.Accuracy
+}
+
+func (g *geofenceConfig) loadLocations() ([]PersonLocation, error) {
+	rows, err := db.Query("SELECT person, lat, lon, accuracy, reported_at FROM person_locations ORDER BY person")
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	locations := []PersonLocation{}
+	for rows.Next() {
+		var l PersonLocation
+		if err := rows.Scan(&l.Person, &l.Lat, &l.Lon, &l.Accuracy, &l.ReportedAt); err != nil {
+			return nil, err
+		}
+		g.locate(&l)
+		locations = append(locations, l)
+	}
+	return locations, rows.Err()
+}
+
+// checkOvernight skips the next alarm when everybody is away from home.
+func (g *geofenceConfig) checkOvernight(now time.Time) error {
+	locations, err := g.loadLocations()
+	if err != nil {
+		return err
+	}
+	if len(locations) == 0 || presence != nil && presence.AnyoneHome() {
+		return nil
+	}
+
+	var away []string
+	for _, l := range locations {
+		if l.Home {
+			return nil
+		}
+		away = append(away, fmt.Sprintf("%s %.0f km away", l.Person, l.DistanceM/1000))
+	}
+
+	date, err := nextAlarmDate(now)
+	if err != nil {
+		return err
+	}
+	skip, err := loadAlarmSkip(date)
+	if err != nil || skip.Manual || skip.Skip {
+		return err
+	}
+
+	skip = AlarmSkip{AlarmDate: date, Skip: true, Reason: "nobody home: " + strings.Join(away, ", ")}
+	if err := saveAlarmSkip(skip); err != nil {
+		return err
+	}
+	publish(EventAlarmChanged, skip)
+	notify(Notification{
+		Event:   "alarm",
+		Title:   "Alarm skipped",
+		Message: fmt.Sprintf("The alarm on %s will not ring, %s. POST /api/alarm/skip {\"skip\": false} to re-arm it.", date, skip.Reason),
+		Tags:    []string{"alarm_clock"},
+	})
+	return nil
+}
+
+// reArmIfHome lifts an automatic skip once somebody is back home.
+func reArmIfHome(person string) {
+	date, err := nextAlarmDate(time.Now())
+	if err != nil {
+		return
+	}
+	skip, err := loadAlarmSkip(date)
+	if err != nil || !skip.Skip || skip.Manual {
+		return
+	}
+
+	skip = AlarmSkip{AlarmDate: date, Skip: false, Reason: person + " came home"}
+	if err := saveAlarmSkip(skip); err != nil {
+		log.Printf("Failed to re-arm alarm: %v", err)
+		return
+	}
+	publish(EventAlarmChanged, skip)
+	notify(Notification{
+		Event:   "alarm",
+		Title:   "Alarm re-armed",
+		Message: fmt.Sprintf("%s is home, the alarm on %s will ring as usual.", person, date),
+		Tags:    []string{"alarm_clock"},
+	})
+}
+
+func reportLocation(c echo.Context) error {
+	geofence := loadGeofence(c.Request().Context())
+	if geofence == nil {
+		return apiErrorCode(c, http.StatusNotFound, codeNotConfigured, "geofence is not configured")
+	}
+	token := envString("GEOFENCE_TOKEN", "")
+	if token == "" {
+		return apiErrorCode(c, http.StatusNotFound, codeNotConfigured, "no GEOFENCE_TOKEN configured")
+	}
+	if subtle.ConstantTimeCompare([]byte(requestToken(c.Request())), []byte(token)) != 1 {
+		c.Response().Header().Set(echo.HeaderWWWAuthenticate, `Basic realm="home-server"`)
+		return apiError(c, http.StatusUnauthorized, "invalid geofence token")
+	}
+
+	var report LocationReport
+	if err := c.Bind(&report); err != nil {
+		return invalidBody(c, err)
+	}
+	person := report.Person
+	if person == "" {
+		person = c.QueryParam("person")
+	}
+	if person == "" {
+		person = c.Request().Header.Get("X-Limit-U")
+	}
+	if person == "" {
+		return apiError(c, http.StatusBadRequest, "person is required")
+	}
+	if !geofencePerson(person) {
+		return apiError(c, http.StatusForbidden, "unknown person")
+	}
+	// OwnTracks also posts waypoints, transitions etc.; only locations matter.
+	if report.Type != "" && report.Type != "location" {
+		return c.JSON(http.StatusOK, []interface{}{})
+	}
+
+	loc := PersonLocation{Person: person, Lat: report.Lat, Lon: report.Lon, Accuracy: report.Accuracy, ReportedAt: time.Now()}
+	geofence.locate(&loc)
+	_, err := db.Exec(`
+		INSERT INTO person_locations (person, lat, lon, accuracy, reported_at)
+		VALUES ($1, $2, $3, $4, $5)
+		ON CONFLICT (person) DO UPDATE
+		SET lat = EXCLUDED.lat, lon = EXCLUDED.lon, accuracy = EXCLUDED.accuracy, reported_at = EXCLUDED.reported_at
+	`, loc.Person, loc.Lat, loc.Lon, loc.Accuracy, loc.ReportedAt)
+	if err != nil {
+		return internalError(c, err)
+	}
+
+	if loc.Home {
+		go reArmIfHome(person)
+	}
+
+	if report.Type != "" {
+		// OwnTracks expects a JSON array of messages in the response.
+		return c.JSON(http.StatusOK, []interface{}{})
+	}
+	return c.JSON(http.StatusOK, loc)
+}
+
+func getLocations(c echo.Context) error {
+	geofence := loadGeofence(c.Request().Context())
+	if geofence == nil {
+		return apiErrorCode(c, http.StatusNotFound, codeNotConfigured, "geofence is not configured")
+	}
+	locations, err := geofence.loadLocations()
+	if err != nil {
+		return internalError(c, err)
+	}
+	return c.JSON(http.StatusOK, locations)
+}
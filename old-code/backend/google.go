@@ -0,0 +1,199 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"log"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/labstack/echo/v4"
+)
+
+// POST /api/google is the fulfillment webhook of a Google Home cloud-to-cloud
+// integration (SYNC, QUERY, EXECUTE and DISCONNECT intents). Google sends
+// the access token from account linking (/api/oauth with GOOGLE_CLIENT_ID
+// and GOOGLE_CLIENT_SECRET) as a bearer token.
+//
+// Every room is a sensor reporting its CO2 level and air quality, and the
+// alarm is a switch named GOOGLE_ALARM_NAME that arms and disarms it.
+
+const googleAlarmDevice = "alarm"
+
+type googleRequest struct {
+	RequestID string `json:"requestId"`
+	Inputs    []struct {
+		Intent  string `json:"intent"`
+		Payload struct {
+			Devices []struct {
+				ID string `json:"id"`
+			} `json:"devices"`
+			Commands []googleCommand `json:"commands"`
+		} `json:"payload"`
+	} `json:"inputs"`
+}
+
+type googleCommand struct {
+	Devices []struct {
+		ID string `json:"id"`
+	} `json:"devices"`
+	Execution []struct {
+		Command string `json:"command"`
+		Params  struct {
+			On *bool `json:"on"`
+		} `json:"params"`
+	} `json:"execution"`
+}
+
+// googleAirQuality maps airBand to the descriptive states of Google's
+// sensors.
+var googleAirQuality = map[string]string{"good": "healthy", "fair": "moderate", "poor": "unhealthy", "unknown": "unknown"}
+
+func googleSync(ctx context.Context, s *Session) (map[string]interface{}, error) {
+	rooms, err := roomReadings(ctx, time.Now())
+	if err != nil {
+		return nil, err
+	}
+	devices := []interface{}{map[string]interface{}{
+		"id":              googleAlarmDevice,
+		"type":            "action.devices.types.SWITCH",
+		"traits":          []string{"action.devices.traits.OnOff"},
+		"name":            map[string]string{"name": envString("GOOGLE_ALARM_NAME", "Alarm")},
+		"willReportState": false,
+	}}
+	for _, r := range rooms {
+		devices = append(devices, map[string]interface{}{
+			"id":     roomEndpointID(r.Room),
+			"type":   "action.devices.types.SENSOR",
+			"traits": []string{"action.devices.traits.SensorState"},
+			"name":   map[string]interface{}{"name": r.Room + " air", "nicknames": []string{r.Room}},
+			"attributes": map[string]interface{}{"sensorStatesSupported": []interface{}{
+				map[string]interface{}{
+					"name":                    "CarbonDioxideLevel",
+					"numericCapabilities":     map[string]string{"rawValueUnit": "PARTS_PER_MILLION"},
+					"descriptiveCapabilities": map[string][]string{"availableStates": {"healthy", "moderate", "unhealthy", "unknown"}},
+				},
+				map[string]interface{}{
+					"name":                    "AirQuality",
+					"descriptiveCapabilities": map[string][]string{"availableStates": {"healthy", "moderate", "unhealthy", "unknown"}},
+				},
+			}},
+			"roomHint":        r.Room,
+			"willReportState": false,
+		})
+	}
+	return map[string]interface{}{"agentUserId": s.Subject, "devices": devices}, nil
+}
+
+func googleAlarmState(armed bool) map[string]interface{} {
+	return map[string]interface{}{"online": true, "status": "SUCCESS", "on": armed}
+}
+
+func googleQuery(ctx context.Context, ids []string) (map[string]interface{}, error) {
+	alarm, err := currentAlarm()
+	if err != nil && err != sql.ErrNoRows {
+		return nil, err
+	}
+	rooms, err := roomReadings(ctx, time.Now())
+	if err != nil {
+		return nil, err
+	}
+	states := make(map[string]interface{})
+	for _, id := range ids {
+		states[id] = map[string]interface{}{"online": false, "status": "ERROR", "errorCode": "deviceNotFound"}
+		if id == googleAlarmDevice {
+			states[id] = googleAlarmState(alarm.Armed)
+			continue
+		}
+		for _, r := range rooms {
+			if roomEndpointID(r.Room) != id {
+				continue
+			}
+			quality := googleAirQuality[airBand(r.CO2)]
+			sensors := []interface{}{map[string]interface{}{"name": "AirQuality", "currentSensorState": quality}}
+			co2 := map[string]interface{}{"name": "CarbonDioxideLevel", "currentSensorState": quality}
+			if r.CO2 > 0 {
+				co2["rawValue"] = r.CO2
+			}
+			states[id] = map[string]interface{}{
+				"online": r.Online, "status": "SUCCESS", "currentSensorStateData": append(sensors, co2),
+			}
+		}
+	}
+	return map[string]interface{}{"devices": states}, nil
+}
+
+func googleExecute(ctx context.Context, s *Session, commands []googleCommand) []interface{} {
+	var results []interface{}
+	for _, cmd := range commands {
+		var ids []string
+		targetsAlarm := false
+		for _, d := range cmd.Devices {
+			ids = append(ids, d.ID)
+			targetsAlarm = targetsAlarm || d.ID == googleAlarmDevice
+		}
+		result := map[string]interface{}{"ids": ids, "status": "ERROR", "errorCode": "notSupported"}
+		for _, ex := range cmd.Execution {
+			if ex.Command != "action.devices.commands.OnOff" || ex.Params.On == nil || !targetsAlarm || len(ids) != 1 {
+				break
+			}
+			if s.Role != "admin" {
+				result["errorCode"] = "authFailure"
+				break
+			}
+			alarm, err := setAlarmArmed(ctx, *ex.Params.On)
+			if err != nil {
+				log.Printf("Failed to switch the alarm from Google: %v", err)
+				result["errorCode"] = "hardError"
+				break
+			}
+			log.Printf("Alarm %s armed=%t by %s via Google", alarm.Time, alarm.Armed, s.Subject)
+			result = map[string]interface{}{"ids": ids, "status": "SUCCESS", "states": googleAlarmState(alarm.Armed)}
+		}
+		results = append(results, result)
+	}
+	return results
+}
+
+func handleGoogle(c echo.Context) error {
+	token, _ := strings.CutPrefix(c.Request().Header.Get(echo.HeaderAuthorization), "Bearer ")
+	s := linkedSession(token, "google")
+	if s == nil {
+		// Google asks the user to link again
+		return apiError(c, http.StatusUnauthorized, "invalid or expired access token")
+	}
+	var req googleRequest
+	if err := c.Bind(&req); err != nil || len(req.Inputs) == 0 {
+		return apiError(c, http.StatusBadRequest, "invalid intent request")
+	}
+	ctx := c.Request().Context()
+	input := req.Inputs[0]
+
+	var payload interface{}
+	var err error
+	switch input.Intent {
+	case "action.devices.SYNC":
+		payload, err = googleSync(ctx, s)
+	case "action.devices.QUERY":
+		var ids []string
+		for _, d := range input.Payload.Devices {
+			ids = append(ids, d.ID)
+		}
+		payload, err = googleQuery(ctx, ids)
+	case "action.devices.EXECUTE":
+		payload = map[string]interface{}{"commands": googleExecute(ctx, s, input.Payload.Commands)}
+	case "action.devices.DISCONNECT":
+		// Tokens are stateless; they simply stop being used
+		return c.JSON(http.StatusOK, struct{}{})
+	default:
+		return apiError(c, http.StatusBadRequest, "unsupported intent "+input.Intent)
+	}
+	if err != nil {
+		log.Printf("Google %s failed: %v", input.Intent, err)
+		return c.JSON(http.StatusOK, map[string]interface{}{
+			"requestId": req.RequestID, "payload": map[string]string{"errorCode": "hardError", "debugString": "internal error"},
+		})
+	}
+	return c.JSON(http.StatusOK, map[string]interface{}{"requestId": req.RequestID, "payload": payload})
+}
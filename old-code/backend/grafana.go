@@ -0,0 +1,300 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"net/http"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/labstack/echo/v4"
+)
+
+// /api/grafana speaks the Grafana JSON (SimpleJSON) datasource protocol, so
+// dashboards can be built directly on the sensor store. Point the
+// datasource at http://<host>/api/grafana; with AUTH_REQUIRED add the
+// ADMIN_TOKEN as an Authorization: Bearer header. Targets are metric names
+// (co2, sound, telemetry, derived and ingested metrics), averaged per
+// interval, or with another aggregate after a colon: "sound:p99", "co2:max". Annotation queries are "alarms", "reboots", "alerts" or
+// "annotations" (those added with /api/annotations; "annotations:party,guests"
+// only those with all the tags); an empty query returns all four.
+
+type grafanaRange struct {
+	From time.Time `json:"from"`
+	To   time.Time `json:"to"`
+}
+
+type grafanaQuery struct {
+	Range         grafanaRange `json:"range"`
+	IntervalMs    int64        `json:"intervalMs"`
+	MaxDataPoints int          `json:"maxDataPoints"`
+	Targets       []struct {
+		Target string `json:"target"`
+		RefID  string `json:"refId"`
+		Type   string `json:"type"` // timeserie (default) | table
+	} `json:"targets"`
+}
+
+type grafanaAnnotation struct {
+	Annotation interface{} `json:"annotation"`
+	Time       int64       `json:"time"`
+	TimeEnd    int64       `json:"timeEnd,omitempty"`
+	Title      string      `json:"title"`
+	Text       string      `json:"text"`
+	Tags       []string    `json:"tags"`
+}
+
+// grafanaTestDatasource answers the "Save & test" of the datasource.
+func grafanaTestDatasource(c echo.Context) error {
+	return c.NoContent(http.StatusOK)
+}
+
+// grafanaSearch lists the metrics matching the search term.
+func grafanaSearch(c echo.Context) error {
+	var req struct {
+		Target string `json:"target"`
+	}
+	if err := c.Bind(&req); err != nil {
+		return invalidBody(c, err)
+	}
+
+	names := map[string]bool{}
+	for name := range metricColumns {
+		names[name] = true
+	}
+	for _, name := range telemetryMetrics {
+		names[name] = true
+	}
+	rows, err := db.QueryContext(c.Request().Context(), "SELECT DISTINCT metric FROM metric_samples")
+	if err != nil {
+		return internalError(c, err)
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var name string
+		if err := rows.Scan(&name); err != nil {
+			return internalError(c, err)
+		}
+		names[name] = true
+	}
+
+	list := []string{}
+	for name := range names {
+		if strings.Contains(name, req.Target) {
+			list = append(list, name)
+		}
+	}
+	sort.Strings(list)
+	return c.JSON(http.StatusOK, list)
+}
+
+// bucketedSeries averages a metric over step buckets in [from, to).
+func bucketedSeries(ctx context.Context, metric string, from, to time.Time, step time.Duration) ([]Point, error) {
+	bucket := "to_timestamp(floor(extract(epoch FROM timestamp) / $3) * $3) AT TIME ZONE 'UTC'"
+	query := `
+		SELECT ` + bucket + ` AS bucket, AVG(value)
+		FROM metric_samples
+		WHERE timestamp >= $1 AND timestamp < $2 AND metric = $4
+		GROUP BY bucket ORDER BY bucket
+	`
+	args := []interface{}{from, to, step.Seconds(), metric}
+	if column, ok := metricColumns[metric]; ok {
+		query = `
+			SELECT ` + bucket + ` AS bucket, AVG(` + column + `)
+			FROM sensor_data
+			WHERE timestamp >= $1 AND timestamp < $2 AND ` + column + ` != 0
+			GROUP BY bucket ORDER BY bucket
+		`
+		args = args[:3]
+	}
+	rows, err := db.QueryContext(ctx, query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var points []Point
+	for rows.Next() {
+		var p Point
+		if err := rows.Scan(&p.Timestamp, &p.Value); err != nil {
+			return nil, err
+		}
+		points = append(points, p)
+	}
+	return points, rows.Err()
+}
+
+func grafanaQueryData(c echo.Context) error {
+	var req grafanaQuery
+	if err := c.Bind(&req); err != nil {
+		return invalidBody(c, err)
+	}
+	if !req.Range.To.After(req.Range.From) {
+		return apiError(c, http.StatusBadRequest, "invalid range")
+	}
+	step := time.Duration(req.IntervalMs) * time.Millisecond
+	if req.MaxDataPoints > 0 {
+		step = max(step, req.Range.To.Sub(req.Range.From)/time.Duration(req.MaxDataPoints))
+	}
+	step = max(step, time.Minute).Truncate(time.Second)
+
+	result := []interface{}{}
+	for _, t := range req.Targets {
+		if t.Target == "" {
+			continue
+		}
+		metric, fn, _ := strings.Cut(t.Target, ":")
+		if !knownMetric(metric) {
+			return apiError(c, http.StatusBadRequest, "unknown metric "+metric)
+		}
+		if fn == "" {
+			fn = "avg"
+		}
+		if _, err := aggregateSQL(fn, "value"); err != nil {
+			return apiError(c, http.StatusBadRequest, err.Error())
+		}
+		buckets, err := bucketedAggregates(c.Request().Context(), metric, "", req.Range.From, req.Range.To, step, []string{fn})
+		if err != nil {
+			return internalError(c, err)
+		}
+		var points []Point
+		for _, b := range buckets {
+			if v := b.Values[fn]; v != nil {
+				points = append(points, Point{Timestamp: b.Timestamp, Value: *v})
+			}
+		}
+		if t.Type == "table" {
+			rows := [][]interface{}{}
+			for _, p := range points {
+				rows = append(rows, []interface{}{p.Timestamp.UnixMilli(), p.Value})
+			}
+			result = append(result, map[string]interface{}{
+				"type": "table",
+				"columns": []map[string]string{
+					{"text": "Time", "type": "time"},
+					{"text": t.Target, "type": "number"},
+				},
+				"rows": rows,
+			})
+			continue
+		}
+		datapoints := [][2]float64{}
+		for _, p := range points {
+			datapoints = append(datapoints, [2]float64{p.Value, float64(p.Timestamp.UnixMilli())})
+		}
+		result = append(result, map[string]interface{}{"target": t.Target, "refId": t.RefID, "datapoints": datapoints})
+	}
+	return c.JSON(http.StatusOK, result)
+}
+
+func grafanaAnnotations(c echo.Context) error {
+	var req struct {
+		Range      grafanaRange `json:"range"`
+		Annotation struct {
+			Name  string `json:"name"`
+			Query string `json:"query"`
+		} `json:"annotation"`
+	}
+	if err := c.Bind(&req); err != nil {
+		return invalidBody(c, err)
+	}
+	query, tags, _ := strings.Cut(strings.TrimSpace(req.Annotation.Query), ":")
+	if query != "" && query != "alarms" && query != "reboots" && query != "alerts" && query != "annotations" {
+		return apiError(c, http.StatusBadRequest, "query must be alarms, reboots, alerts or annotations")
+	}
+
+	ctx := c.Request().Context()
+	from, to := req.Range.From, req.Range.To
+	annotations := []grafanaAnnotation{}
+	add := func(start time.Time, end sql.NullTime, title, text string, tags ...string) {
+		a := grafanaAnnotation{Annotation: req.Annotation, Time: start.UnixMilli(), Title: title, Text: text, Tags: tags}
+		if end.Valid {
+			a.TimeEnd = end.Time.UnixMilli()
+		}
+		annotations = append(annotations, a)
+	}
+
+	if query == "" || query == "alarms" {
+		rows, err := db.QueryContext(ctx, `
+			SELECT started_at, ended_at, outcome, ring_seconds FROM alarm_rings
+			WHERE started_at >= $1 AND started_at < $2
+		`, from, to)
+		if err != nil {
+			return internalError(c, err)
+		}
+		defer rows.Close()
+		for rows.Next() {
+			var start time.Time
+			var end sql.NullTime
+			var outcome string
+			var seconds sql.NullInt64
+			if err := rows.Scan(&start, &end, &outcome, &seconds); err != nil {
+				return internalError(c, err)
+			}
+			add(start, end, "Alarm "+outcome, fmt.Sprintf("Rang %ds", seconds.Int64), "alarm", outcome)
+		}
+	}
+
+	if query == "" || query == "reboots" {
+		rows, err := db.QueryContext(ctx, `
+			SELECT r.at, d.name, r.expected, COALESCE(r.reason, '') FROM device_reboots r JOIN devices d ON d.id = r.device_id
+			WHERE r.at >= $1 AND r.at < $2
+		`, from, to)
+		if err != nil {
+			return internalError(c, err)
+		}
+		defer rows.Close()
+		for rows.Next() {
+			var at time.Time
+			var name, reason string
+			var expected bool
+			if err := rows.Scan(&at, &name, &expected, &reason); err != nil {
+				return internalError(c, err)
+			}
+			tags := []string{"reboot", name}
+			if !expected {
+				tags = append(tags, "unexpected")
+			}
+			add(at, sql.NullTime{}, name+" rebooted", reason, tags...)
+		}
+	}
+
+	if query == "" || query == "alerts" {
+		rows, err := db.QueryContext(ctx, `
+			SELECT fired_at, resolved_at, rule_name, metric, peak_value FROM alerts
+			WHERE fired_at < $2 AND (resolved_at IS NULL OR resolved_at >= $1)
+		`, from, to)
+		if err != nil {
+			return internalError(c, err)
+		}
+		defer rows.Close()
+		for rows.Next() {
+			var fired time.Time
+			var resolved sql.NullTime
+			var rule, metric string
+			var peak float64
+			if err := rows.Scan(&fired, &resolved, &rule, &metric, &peak); err != nil {
+				return internalError(c, err)
+			}
+			add(fired, resolved, rule, fmt.Sprintf("%s peaked at %.1f", metric, peak), "alert", metric)
+		}
+	}
+
+	if query == "" || query == "annotations" {
+		list, err := loadAnnotations(ctx, from, to, splitTags(tags))
+		if err != nil {
+			return internalError(c, err)
+		}
+		for _, a := range list {
+			end := sql.NullTime{}
+			if a.TimeEnd != nil {
+				end = sql.NullTime{Time: *a.TimeEnd, Valid: true}
+			}
+			add(a.Time, end, a.Text, a.CreatedBy, append([]string{"annotation"}, a.Tags...)...)
+		}
+	}
+
+	return c.JSON(http.StatusOK, annotations)
+}
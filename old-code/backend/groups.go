@@ -0,0 +1,348 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/labstack/echo/v4"
+)
+
+// Device groups ("upstairs", "sensors") name sets of devices for bulk
+// operations. PUT /api/device-groups/:name sets a group's members, and
+//
+//	PUT  /api/device-groups/:name/reporting  applies a reporting config to all
+//	POST /api/device-groups/:name/commands   queues a command for all
+//
+// A group command is a rollout: the members get the command one after the
+// other, stagger_seconds apart (e.g. an OTA update going to one node every
+// ten minutes), and with halt_on_failure the members still waiting are
+// cancelled as soon as one fails. GET /api/device-groups/rollouts/:id shows
+// where the rollout is, device by device.
+
+type DeviceGroup struct {
+	Name    string       `json:"name"`
+	Devices []DeviceInfo `json:"devices"`
+}
+
+type Rollout struct {
+	ID             int             `json:"id"`
+	Group          string          `json:"group"`
+	Command        string          `json:"command"`
+	Args           json.RawMessage `json:"args,omitempty"`
+	StaggerSeconds int             `json:"stagger_seconds"`
+	HaltOnFailure  bool            `json:"halt_on_failure"`
+	CreatedAt      time.Time       `json:"created_at"`
+	Status         map[string]int  `json:"status"` // devices by command status
+	Devices        []RolloutDevice `json:"devices"`
+}
+
+type RolloutDevice struct {
+	Device    DeviceInfo    `json:"device"`
+	NotBefore time.Time     `json:"not_before"`
+	Command   CommandRecord `json:"command"`
+}
+
+func loadGroupMembers(ctx context.Context, name string) ([]DeviceInfo, error) {
+	rows, err := db.QueryContext(ctx, `
+		SELECT d.id, d.name, d.room
+		FROM device_group_members m JOIN devices d ON d.id = m.device_id
+		WHERE m.group_name = $1
+		ORDER BY d.id
+	`, name)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	devices := []DeviceInfo{}
+	for rows.Next() {
+		var d DeviceInfo
+		if err := rows.Scan(&d.ID, &d.Name, &d.Room); err != nil {
+			return nil, err
+		}
+		devices = append(devices, d)
+	}
+	return devices, rows.Err()
+}
+
+// groupFromParam loads the group named in the path with its members.
+func groupFromParam(c echo.Context) (DeviceGroup, error) {
+	g := DeviceGroup{Name: c.Param("name")}
+	ctx := c.Request().Context()
+	var exists bool
+	if err := db.QueryRowContext(ctx, "SELECT EXISTS (SELECT 1 FROM device_groups WHERE name = $1)", g.Name).Scan(&exists); err != nil {
+		return g, err
+	}
+	if !exists {
+		return g, newRequestError(http.StatusNotFound, "device_group_not_found", "device group not found")
+	}
+	var err error
+	g.Devices, err = loadGroupMembers(ctx, g.Name)
+	return g, err
+}
+
+func getDeviceGroups(c echo.Context) error {
+	ctx := c.Request().Context()
+	rows, err := db.QueryContext(ctx, "SELECT name FROM device_groups ORDER BY name")
+	if err != nil {
+		return internalError(c, err)
+	}
+	var names []string
+	for rows.Next() {
+		var name string
+		if err := rows.Scan(&name); err != nil {
+			rows.Close()
+			return internalError(c, err)
+		}
+		names = append(names, name)
+	}
+	rows.Close()
+
+	groups := []DeviceGroup{}
+	for _, name := range names {
+		devices, err := loadGroupMembers(ctx, name)
+		if err != nil {
+			return internalError(c, err)
+		}
+		groups = append(groups, DeviceGroup{Name: name, Devices: devices})
+	}
+	return c.JSON(http.StatusOK, groups)
+}
+
+// putDeviceGroup creates a group or replaces its members:
+// {"devices": [1, 2, 3]}.
+func putDeviceGroup(c echo.Context) error {
+	name := c.Param("name")
+	if !derivedNamePattern.MatchString(name) {
+		return apiError(c, http.StatusBadRequest, "name must be lower case letters, digits and underscores")
+	}
+	var req struct {
+		Devices []int `json:"devices"`
+	}
+	if err := c.Bind(&req); err != nil {
+		return invalidBody(c, err)
+	}
+
+	ctx := c.Request().Context()
+	tx, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		return internalError(c, err)
+	}
+	defer tx.Rollback()
+	if _, err := tx.ExecContext(ctx, "INSERT INTO device_groups (name) VALUES ($1) ON CONFLICT DO NOTHING", name); err != nil {
+		return internalError(c, err)
+	}
+	if _, err := tx.ExecContext(ctx, "DELETE FROM device_group_members WHERE group_name = $1", name); err != nil {
+		return internalError(c, err)
+	}
+	for _, id := range req.Devices {
+		res, err := tx.ExecContext(ctx, `
+			INSERT INTO device_group_members (group_name, device_id)
+			SELECT $1, id FROM devices WHERE id = $2
+			ON CONFLICT DO NOTHING
+		`, name, id)
+		if err != nil {
+			return internalError(c, err)
+		}
+		if n, _ := res.RowsAffected(); n == 0 {
+			return apiError(c, http.StatusBadRequest, fmt.Sprintf("device %d not found", id))
+		}
+	}
+	if err := tx.Commit(); err != nil {
+		return internalError(c, err)
+	}
+
+	g, err := groupFromParam(c)
+	if err != nil {
+		return handlerError(c, err)
+	}
+	return c.JSON(http.StatusOK, g)
+}
+
+func deleteDeviceGroup(c echo.Context) error {
+	if _, err := db.Exec("DELETE FROM device_groups WHERE name = $1", c.Param("name")); err != nil {
+		return internalError(c, err)
+	}
+	return c.NoContent(http.StatusNoContent)
+}
+
+// putGroupReporting applies one reporting config to every member.
+func putGroupReporting(c echo.Context) error {
+	g, err := groupFromParam(c)
+	if err != nil {
+		return handlerError(c, err)
+	}
+	cfg := defaultReportingConfig(0)
+	if err := c.Bind(&cfg); err != nil {
+		return invalidBody(c, err)
+	}
+	if err := cfg.validate(); err != nil {
+		return apiError(c, http.StatusBadRequest, err.Error())
+	}
+	configs := []ReportingConfig{}
+	for _, d := range g.Devices {
+		cfg.DeviceID = d.ID
+		if err := storeReportingConfig(cfg); err != nil {
+			return internalError(c, err)
+		}
+		configs = append(configs, cfg)
+	}
+	return c.JSON(http.StatusOK, configs)
+}
+
+// postGroupCommand starts a rollout of one of deviceCommandSpecs:
+// {"command": "ota", "args": {"url": "..."}, "stagger_seconds": 600,
+// "halt_on_failure": true}. Destructive commands are confirmed with the
+// group name.
+func postGroupCommand(c echo.Context) error {
+	g, err := groupFromParam(c)
+	if err != nil {
+		return handlerError(c, err)
+	}
+	var req struct {
+		Command        string          `json:"command"`
+		Args           json.RawMessage `json:"args"`
+		Confirm        string          `json:"confirm"`
+		StaggerSeconds int             `json:"stagger_seconds"`
+		HaltOnFailure  bool            `json:"halt_on_failure"`
+	}
+	if err := c.Bind(&req); err != nil {
+		return invalidBody(c, err)
+	}
+	spec, ok := deviceCommandSpecs[req.Command]
+	if !ok {
+		return apiError(c, http.StatusBadRequest, "unknown command "+req.Command)
+	}
+	if err := validateCommandArgs(req.Command, req.Args); err != nil {
+		return apiError(c, http.StatusBadRequest, err.Error())
+	}
+	if spec.destructive && req.Confirm != g.Name {
+		return c.JSON(http.StatusPreconditionRequired, map[string]string{
+			"code":  "confirmation_required",
+			"error": fmt.Sprintf("%s cannot be undone, repeat the request with \"confirm\": %q", req.Command, g.Name),
+		})
+	}
+	if req.StaggerSeconds < 0 || req.StaggerSeconds > 24*3600 {
+		return apiError(c, http.StatusBadRequest, "stagger_seconds must be between 0 and 86400")
+	}
+	if len(g.Devices) == 0 {
+		return apiError(c, http.StatusBadRequest, "the group has no devices")
+	}
+	var args json.RawMessage
+	if len(req.Args) > 0 && string(req.Args) != "null" {
+		args = req.Args
+	}
+
+	ctx := c.Request().Context()
+	tx, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		return internalError(c, err)
+	}
+	defer tx.Rollback()
+	now := time.Now()
+	var id int
+	err = tx.QueryRowContext(ctx, `
+		INSERT INTO command_rollouts (group_name, command, args, stagger_seconds, halt_on_failure, created_at)
+		VALUES ($1, $2, $3, $4, $5, $6)
+		RETURNING id
+	`, g.Name, req.Command, nullableJSON(args), req.StaggerSeconds, req.HaltOnFailure, now).Scan(&id)
+	if err != nil {
+		return internalError(c, err)
+	}
+	for i, d := range g.Devices {
+		_, err := tx.ExecContext(ctx, `
+			INSERT INTO device_commands (device_id, command, args, created_at, status, not_before, rollout_id)
+			VALUES ($1, $2, $3, $4, 'queued', $5, $6)
+		`, d.ID, req.Command, nullableJSON(args), now, now.Add(time.Duration(i*req.StaggerSeconds)*time.Second), id)
+		if err != nil {
+			return internalError(c, err)
+		}
+	}
+	if err := tx.Commit(); err != nil {
+		return internalError(c, err)
+	}
+
+	rollout, err := loadRollout(ctx, id)
+	if err != nil {
+		return internalError(c, err)
+	}
+	return c.JSON(http.StatusAccepted, rollout)
+}
+
+func loadRollout(ctx context.Context, id int) (Rollout, error) {
+	r := Rollout{ID: id, Status: make(map[string]int), Devices: []RolloutDevice{}}
+	var args string
+	err := db.QueryRowContext(ctx, `
+		SELECT group_name, command, COALESCE(args::text, ''), stagger_seconds, halt_on_failure, created_at
+		FROM command_rollouts WHERE id = $1
+	`, id).Scan(&r.Group, &r.Command, &args, &r.StaggerSeconds, &r.HaltOnFailure, &r.CreatedAt)
+	if err == sql.ErrNoRows {
+		return r, newRequestError(http.StatusNotFound, "rollout_not_found", "rollout not found")
+	} else if err != nil {
+		return r, err
+	}
+	if args != "" {
+		r.Args = json.RawMessage(args)
+	}
+
+	rows, err := db.QueryContext(ctx, `
+		SELECT d.id, d.name, d.room, c.not_before,
+			c.id, c.command, c.status, COALESCE(c.error, ''), c.created_at, c.delivered_at, c.completed_at
+		FROM device_commands c JOIN devices d ON d.id = c.device_id
+		WHERE c.rollout_id = $1
+		ORDER BY c.not_before, c.id
+	`, id)
+	if err != nil {
+		return r, err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var rd RolloutDevice
+		var delivered, completed sql.NullTime
+		cmd := &rd.Command
+		if err := rows.Scan(&rd.Device.ID, &rd.Device.Name, &rd.Device.Room, &rd.NotBefore,
+			&cmd.ID, &cmd.Command, &cmd.Status, &cmd.Error, &cmd.CreatedAt, &delivered, &completed); err != nil {
+			return r, err
+		}
+		if delivered.Valid {
+			cmd.DeliveredAt = &delivered.Time
+		}
+		if completed.Valid {
+			cmd.CompletedAt = &completed.Time
+		}
+		r.Status[cmd.Status]++
+		r.Devices = append(r.Devices, rd)
+	}
+	return r, rows.Err()
+}
+
+func getRollout(c echo.Context) error {
+	id, err := strconv.Atoi(c.Param("id"))
+	if err != nil {
+		return apiError(c, http.StatusBadRequest, "invalid rollout id")
+	}
+	r, err := loadRollout(c.Request().Context(), id)
+	if err != nil {
+		return handlerError(c, err)
+	}
+	return c.JSON(http.StatusOK, r)
+}
+
+// haltFailedRollouts cancels the waiting commands of halt_on_failure
+// rollouts in which a device failed. It runs with the command_timeout job.
+func haltFailedRollouts() error {
+	_, err := db.Exec(`
+		UPDATE device_commands SET status = 'cancelled', error = 'rollout halted after a failure', completed_at = $1
+		WHERE status = 'queued' AND rollout_id IN (
+			SELECT r.id FROM command_rollouts r
+			WHERE r.halt_on_failure
+			AND EXISTS (SELECT 1 FROM device_commands f WHERE f.rollout_id = r.id AND f.status = 'failed')
+		)
+	`, time.Now())
+	return err
+}
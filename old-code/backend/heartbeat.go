@@ -0,0 +1,147 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/labstack/echo/v4"
+)
+
+// DeviceConfig is the configuration a device acts on, as delivered in the
+// update response. Its version is a short hash of the content, so a device
+// can tell the server which configuration it holds.
+type DeviceConfig struct {
+	Time  string `json:"time"`
+	Armed bool   `json:"armed"`
+	Sound string `json:"sound,omitempty"`
+
+	Configured bool `json:"configured"` // whether an alarm has been set at all
+
+	Stream         string `json:"stream,omitempty"`
+	StreamFallback string `json:"stream_fallback,omitempty"`
+
+	CO2Bands CO2Bands `json:"co2_bands"`
+}
+
+// CO2Bands are where the yellow and red bands of the device's CO2 indicator
+// start, in ppm; below yellow it is green.
+type CO2Bands struct {
+	Yellow float64 `json:"yellow"`
+	Red    float64 `json:"red"`
+}
+
+var deviceCO2Bands = map[string]string{"good": "green", "fair": "yellow", "poor": "red", "unknown": "unknown"}
+
+// deviceCO2Band is the indicator color of a reading.
+func deviceCO2Band(co2 float64) string {
+	return deviceCO2Bands[airBand(co2)]
+}
+
+func (cfg DeviceConfig) version() string {
+	content := fmt.Sprintf("%s|%t", cfg.Time, cfg.Armed)
+	if cfg.Sound != "" {
+		content += "|" + cfg.Sound
+	}
+	if cfg.Stream != "" {
+		content += "|" + cfg.Stream + "|" + cfg.StreamFallback
+	}
+	content += fmt.Sprintf("|%g|%g", cfg.CO2Bands.Yellow, cfg.CO2Bands.Red)
+	sum := sha256.Sum256([]byte(content))
+	return hex.EncodeToString(sum[:4])
+}
+
+// currentDeviceConfig returns the latest alarm, sound, stream and CO2 bands;
+// a skipped alarm is reported to the device as disarmed.
+func currentDeviceConfig(ctx context.Context, now time.Time) (DeviceConfig, error) {
+	var cfg DeviceConfig
+	err := db.QueryRowContext(ctx, "SELECT time, armed FROM alarm_time ORDER BY id DESC LIMIT 1").
+		Scan(&cfg.Time, &cfg.Armed)
+	if err != nil && err != sql.ErrNoRows {
+		return cfg, err
+	}
+	cfg.Configured = err == nil
+	skipped, err := nextAlarmSkipped(now)
+	if err != nil {
+		return cfg, err
+	}
+	cfg.Armed = cfg.Armed && !skipped
+	cfg.CO2Bands = CO2Bands{Yellow: settingFloat("co2_band_yellow"), Red: settingFloat("co2_band_red")}
+	if cfg.Sound, err = activeSoundURL(ctx); err != nil {
+		return cfg, err
+	}
+	cfg.Stream, cfg.StreamFallback, err = deviceStreams(ctx)
+	return cfg, err
+}
+
+// touchDevice records that a device was heard from.
+func touchDevice(ctx context.Context, deviceID int, at time.Time) error {
+	_, err := db.ExecContext(ctx, "UPDATE devices SET last_seen = $2 WHERE id = $1", deviceID, at)
+	return err
+}
+
+// recordDeviceSync stores the configuration version a device reported, the
+// one it acknowledged having applied (config_ack) and, when it sent its
+// clock (unix seconds), how far that is off. config_acked_at is when the
+// acknowledged version first arrived.
+func recordDeviceSync(ctx context.Context, deviceID int, configVersion, configAck string, deviceTime *int64, now time.Time) error {
+	var offset sql.NullInt64
+	if deviceTime != nil {
+		offset = sql.NullInt64{Int64: *deviceTime - now.Unix(), Valid: true}
+	}
+	_, err := db.ExecContext(ctx, `
+		UPDATE devices SET
+			config_version = COALESCE(NULLIF($2, ''), config_version),
+			config_reported_at = CASE WHEN $2 = '' THEN config_reported_at ELSE $4 END,
+			clock_offset_seconds = COALESCE($3, clock_offset_seconds),
+			config_acked_at = CASE WHEN $5 = '' OR config_acked_version = $5 THEN config_acked_at ELSE $4 END,
+			config_acked_version = COALESCE(NULLIF($5, ''), config_acked_version)
+		WHERE id = $1
+	`, deviceID, configVersion, offset, now, configAck)
+	return err
+}
+
+// deviceHeartbeat lets a device ping often without sending a full update:
+// {"device": "bedroom", "config_version": "1a2b3c4d", "config_ack": "1a2b3c4d"}. It only marks the
+// device as seen and tells it whether it should fetch its configuration.
+func deviceHeartbeat(c echo.Context) error {
+	var req struct {
+		Device        string `json:"device"`
+		ConfigVersion string `json:"config_version"`
+		ConfigAck     string `json:"config_ack"`
+		DeviceTime    *int64 `json:"device_time"`
+	}
+	if err := c.Bind(&req); err != nil {
+		return invalidBody(c, err)
+	}
+
+	ctx := c.Request().Context()
+	now := time.Now()
+	if !deviceKeyValid(c, req.Device) {
+		return deviceKeyError(c)
+	}
+	device, err := deviceByName(req.Device)
+	if err != nil {
+		return internalError(c, err)
+	}
+	if err := touchDevice(ctx, device.ID, now); err != nil {
+		return internalError(c, err)
+	}
+	if err := recordDeviceSync(ctx, device.ID, req.ConfigVersion, req.ConfigAck, req.DeviceTime, now); err != nil {
+		return internalError(c, err)
+	}
+	cfg, err := currentDeviceConfig(ctx, now)
+	if err != nil {
+		return internalError(c, err)
+	}
+
+	return c.JSON(http.StatusOK, map[string]interface{}{
+		"current_time":   now.Unix(),
+		"config_version": cfg.version(),
+		"config_changed": req.ConfigVersion != cfg.version(),
+	})
+}
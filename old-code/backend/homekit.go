@@ -0,0 +1,217 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"database/sql"
+	"fmt"
+	"hash/fnv"
+	"log"
+	"math/big"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/brutella/hap"
+	"github.com/brutella/hap/accessory"
+	"github.com/brutella/hap/characteristic"
+	"github.com/brutella/hap/service"
+	"github.com/labstack/echo/v4"
+)
+
+// With HOMEKIT=true the server is also a HomeKit bridge on the local
+// network, so the rooms and the alarm show up in the iOS Home app without
+// any cloud account. Every room is an accessory with a CO2 sensor (level,
+// and "detected" above co2_threshold), an air quality sensor and a light
+// sensor whose lux are the noise level in dB, since HomeKit has no noise
+// sensor. The alarm is a switch that arms and disarms it.
+//
+// Pairing data lives in HOMEKIT_STORE. The setup code is HOMEKIT_PIN, or a
+// random one kept in the store; it is logged at startup and served to
+// admins at GET /api/homekit. Rooms are read at startup: restart after
+// adding one.
+
+type homeKitRoom struct {
+	co2     *service.CarbonDioxideSensor
+	level   *characteristic.CarbonDioxideLevel
+	quality *service.AirQualitySensor
+	noise   *service.LightSensor
+}
+
+type homeKitBridge struct {
+	server *hap.Server
+	alarm  *accessory.Switch
+
+	mu    sync.Mutex
+	rooms map[string]*homeKitRoom
+}
+
+var homeKit *homeKitBridge
+
+// homeKitAirQuality maps airBand to HomeKit's air quality scale.
+var homeKitAirQuality = map[string]int{
+	"good":    characteristic.AirQualityGood,
+	"fair":    characteristic.AirQualityFair,
+	"poor":    characteristic.AirQualityPoor,
+	"unknown": characteristic.AirQualityUnknown,
+}
+
+func initHomeKit() {
+	if !envBool("HOMEKIT", false) {
+		return
+	}
+	store := hap.NewFsStore(envString("HOMEKIT_STORE", "./homekit"))
+	pin, err := homeKitPin(store)
+	if err != nil {
+		log.Printf("HomeKit bridge is disabled: %v", err)
+		return
+	}
+
+	b := &homeKitBridge{rooms: make(map[string]*homeKitRoom)}
+	bridge := accessory.NewBridge(accessory.Info{Name: envString("HOMEKIT_NAME", "Home Server"), Manufacturer: "home-server"})
+	bridge.Id = 1
+	b.alarm = accessory.NewSwitch(accessory.Info{Name: envString("HOMEKIT_ALARM_NAME", "Alarm"), Manufacturer: "home-server"})
+	b.alarm.Id = 2
+	b.alarm.Switch.On.OnValueRemoteUpdate(b.switchAlarm)
+
+	accessories := []*accessory.A{b.alarm.A}
+	rooms, err := roomReadings(context.Background(), time.Now())
+	if err != nil {
+		log.Printf("HomeKit bridge is disabled: %v", err)
+		return
+	}
+	for _, r := range rooms {
+		a := accessory.New(accessory.Info{Name: r.Room, Manufacturer: "home-server", Model: "Air sensor"}, accessory.TypeSensor)
+		a.Id = homeKitAccessoryID(r.Room)
+		room := &homeKitRoom{
+			co2:     service.NewCarbonDioxideSensor(),
+			level:   characteristic.NewCarbonDioxideLevel(),
+			quality: service.NewAirQualitySensor(),
+			noise:   service.NewLightSensor(),
+		}
+		room.co2.AddC(room.level.C)
+		a.AddS(room.co2.S)
+		a.AddS(room.quality.S)
+		a.AddS(room.noise.S)
+		b.rooms[r.Room] = room
+		accessories = append(accessories, a)
+	}
+
+	b.server, err = hap.NewServer(store, bridge.A, accessories...)
+	if err != nil {
+		log.Printf("HomeKit bridge is disabled: %v", err)
+		return
+	}
+	b.server.Pin = pin
+	b.server.Addr = envString("HOMEKIT_ADDR", "")
+	homeKit = b
+	b.refresh(context.Background())
+
+	go func() {
+		if err := b.server.ListenAndServe(context.Background()); err != nil {
+			log.Printf("HomeKit bridge stopped: %v", err)
+		}
+	}()
+	go b.follow()
+	log.Printf("HomeKit bridge with %d rooms, setup code %s", len(rooms), formatHomeKitPin(pin))
+}
+
+// homeKitPin returns HOMEKIT_PIN, or the code generated on the first start.
+func homeKitPin(store hap.Store) (string, error) {
+	if pin := envString("HOMEKIT_PIN", ""); pin != "" {
+		if len(pin) != 8 {
+			return "", fmt.Errorf("HOMEKIT_PIN must have 8 digits")
+		}
+		return pin, nil
+	}
+	if pin, err := store.Get("setup-pin"); err == nil && len(pin) == 8 {
+		return string(pin), nil
+	}
+	n, err := rand.Int(rand.Reader, big.NewInt(100000000))
+	if err != nil {
+		return "", err
+	}
+	pin := fmt.Sprintf("%08d", n.Int64())
+	return pin, store.Set("setup-pin", []byte(pin))
+}
+
+// formatHomeKitPin writes a setup code the way the Home app asks for it.
+func formatHomeKitPin(pin string) string {
+	return pin[:3] + "-" + pin[3:5] + "-" + pin[5:]
+}
+
+// homeKitAccessoryID keeps a room's accessory ID stable across restarts, so
+// the Home app keeps its room assignment and name.
+func homeKitAccessoryID(room string) uint64 {
+	h := fnv.New64a()
+	h.Write([]byte(room))
+	return h.Sum64()>>1 | 1<<8 // clear of the bridge and alarm IDs
+}
+
+func (b *homeKitBridge) switchAlarm(on bool) {
+	alarm, err := setAlarmArmed(context.Background(), on)
+	if err != nil {
+		log.Printf("Failed to switch the alarm from HomeKit: %v", err)
+		// Show the switch as it really is
+		b.alarm.Switch.On.SetValue(alarm.Armed)
+		return
+	}
+	log.Printf("Alarm %s armed=%t via HomeKit", alarm.Time, alarm.Armed)
+}
+
+// follow keeps the accessories current with the server's own events.
+func (b *homeKitBridge) follow() {
+	client := &eventClient{
+		types:  map[string]bool{EventSensorUpdate: true, EventAlarmChanged: true},
+		events: make(chan Event, 64),
+	}
+	events.add(client)
+	defer events.remove(client)
+	for range client.events {
+		b.refresh(context.Background())
+	}
+}
+
+func (b *homeKitBridge) refresh(ctx context.Context) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	alarm, err := currentAlarm()
+	if err != nil && err != sql.ErrNoRows {
+		log.Printf("HomeKit: %v", err)
+		return
+	}
+	b.alarm.Switch.On.SetValue(alarm.Armed)
+
+	rooms, err := roomReadings(ctx, time.Now())
+	if err != nil {
+		log.Printf("HomeKit: %v", err)
+		return
+	}
+	for _, r := range rooms {
+		room := b.rooms[r.Room]
+		if room == nil {
+			continue
+		}
+		detected := characteristic.CarbonDioxideDetectedCO2LevelsNormal
+		if r.CO2 >= settingFloat("co2_threshold") {
+			detected = characteristic.CarbonDioxideDetectedCO2LevelsAbnormal
+		}
+		room.co2.CarbonDioxideDetected.SetValue(detected)
+		room.level.SetValue(r.CO2)
+		room.quality.AirQuality.SetValue(homeKitAirQuality[airBand(r.CO2)])
+		// The lowest light level HomeKit accepts
+		room.noise.CurrentAmbientLightLevel.SetValue(max(r.Sound, 0.0001))
+	}
+}
+
+func getHomeKit(c echo.Context) error {
+	if homeKit == nil {
+		return c.JSON(http.StatusOK, map[string]interface{}{"enabled": false})
+	}
+	return c.JSON(http.StatusOK, map[string]interface{}{
+		"enabled":    true,
+		"setup_code": formatHomeKitPin(homeKit.server.Pin),
+		"rooms":      len(homeKit.rooms),
+	})
+}
@@ -0,0 +1,290 @@
+package main
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"net/http/httputil"
+	"net/url"
+	"os"
+	"os/exec"
+	"os/signal"
+	"regexp"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+)
+
+// Several households can share one server and database. With
+// HOUSEHOLDS=home,parents the server serves both: every household keeps all
+// of its tables in its own Postgres schema (household_home,
+// household_parents), and each request is handled against the schema of
+// the household it is for. Devices, users, alarms, settings and readings of
+// one household are never visible to another, as no query can reach
+// another schema. Without HOUSEHOLDS the server uses the public schema as
+// before.
+//
+// The household of a request is, in this order: the /h/<household>/ prefix
+// of its path (stripped before it is handled; devices, webhooks and the
+// calendar use it), ?household=, the household cookie these two set, the
+// household of the request's session, and otherwise the first one listed.
+//
+// Every household has its own jobs, rules, caches and bridges, so the
+// server runs one worker process per household on a loopback port, with
+// HOUSEHOLD set to it, and passes each request to the household's worker.
+// A worker gets the environment with HOUSEHOLD_<NAME>_<VAR> overriding
+// <VAR>, e.g. HOUSEHOLD_PARENTS_PRESENCE_PEOPLE. Workers that exit are
+// restarted.
+//
+// Sessions and account links carry the household they were issued for and
+// are only accepted by that household, even with a shared SESSION_SECRET
+// and domain. With OIDC a user may only log in to the households listed in
+// their OIDC_HOUSEHOLDS_CLAIM claim.
+
+var householdPattern = regexp.MustCompile(`^[a-z][a-z0-9_]*$`)
+
+const householdCookie = "household"
+
+// household is the household this process serves, "" for a single one.
+var household string
+
+func initHousehold() error {
+	household = envString("HOUSEHOLD", "")
+	if household != "" && !householdPattern.MatchString(household) {
+		return fmt.Errorf("HOUSEHOLD must be lower case letters, digits and underscores")
+	}
+	return nil
+}
+
+// householdSchema is where the household's tables live.
+func householdSchema() string {
+	if household == "" {
+		return "public"
+	}
+	return "household_" + household
+}
+
+// householdMember reports whether an OIDC user may log in to this
+// household.
+func householdMember(claims map[string]interface{}) bool {
+	if household == "" {
+		return true
+	}
+	return slices.Contains(claimStrings(claims[envString("OIDC_HOUSEHOLDS_CLAIM", "households")]), household)
+}
+
+// householdList parses HOUSEHOLDS; nil means a single household.
+func householdList() ([]string, error) {
+	spec := envString("HOUSEHOLDS", "")
+	if spec == "" || envString("HOUSEHOLD", "") != "" {
+		return nil, nil
+	}
+	var names []string
+	for _, name := range strings.Split(spec, ",") {
+		name = strings.TrimSpace(name)
+		if !householdPattern.MatchString(name) {
+			return nil, fmt.Errorf("HOUSEHOLDS: %q must be lower case letters, digits and underscores", name)
+		}
+		if !slices.Contains(names, name) {
+			names = append(names, name)
+		}
+	}
+	return names, nil
+}
+
+type householdWorker struct {
+	name string
+	addr string
+	stop chan struct{} // closed to stop the worker
+	done chan struct{} // closed once it has stopped
+
+	mu       sync.Mutex
+	cmd      *exec.Cmd
+	stopping bool
+}
+
+// workerEnv is the environment of a household's worker.
+func (w *householdWorker) workerEnv() []string {
+	prefix := "HOUSEHOLD_" + strings.ToUpper(w.name) + "_"
+	vars := map[string]string{}
+	var overrides []string
+	for _, kv := range os.Environ() {
+		k, v, _ := strings.Cut(kv, "=")
+		if name, ok := strings.CutPrefix(k, prefix); ok && name != "" {
+			overrides = append(overrides, name+"="+v)
+			continue
+		}
+		vars[k] = v
+	}
+	for _, kv := range overrides {
+		k, v, _ := strings.Cut(kv, "=")
+		vars[k] = v
+	}
+	delete(vars, "HOUSEHOLDS")
+	vars["HOUSEHOLD"] = w.name
+	vars["LISTEN_ADDR"] = w.addr
+	// The worker sees the router's address; the client's is in X-Forwarded-For
+	trusted := "127.0.0.1/32"
+	if t := vars["TRUSTED_PROXIES"]; t != "" {
+		trusted = t + "," + trusted
+	}
+	vars["TRUSTED_PROXIES"] = trusted
+
+	env := make([]string, 0, len(vars))
+	for k, v := range vars {
+		env = append(env, k+"="+v)
+	}
+	return env
+}
+
+// run keeps the worker running until it is stopped.
+func (w *householdWorker) run(exe string) {
+	defer close(w.done)
+	for backoff := time.Second; ; {
+		w.mu.Lock()
+		if w.stopping {
+			w.mu.Unlock()
+			return
+		}
+		cmd := exec.Command(exe)
+		cmd.Env = w.workerEnv()
+		cmd.Stdout, cmd.Stderr = os.Stdout, os.Stderr
+		started := time.Now()
+		err := cmd.Start()
+		w.cmd = cmd
+		w.mu.Unlock()
+		if err == nil {
+			err = cmd.Wait()
+		}
+
+		w.mu.Lock()
+		stopping := w.stopping
+		w.mu.Unlock()
+		if stopping {
+			return
+		}
+		if time.Since(started) > time.Minute {
+			backoff = time.Second
+		}
+		log.Printf("Household %s: worker exited (%v), restarting in %s", w.name, err, backoff)
+		select {
+		case <-time.After(backoff):
+		case <-w.stop:
+			return
+		}
+		backoff = min(2*backoff, time.Minute)
+	}
+}
+
+// shutdown stops the worker and waits up to timeout for it to exit.
+func (w *householdWorker) shutdown(timeout time.Duration) {
+	w.mu.Lock()
+	w.stopping = true
+	close(w.stop)
+	if w.cmd != nil && w.cmd.Process != nil {
+		w.cmd.Process.Signal(syscall.SIGTERM)
+	}
+	w.mu.Unlock()
+	select {
+	case <-w.done:
+	case <-time.After(timeout):
+		log.Printf("Household %s: worker did not stop in time", w.name)
+	}
+}
+
+// requestHousehold picks the household a request is for and strips the
+// /h/<household>/ prefix from its path.
+func requestHousehold(r *http.Request, names []string) (name string, selected bool) {
+	if rest, ok := strings.CutPrefix(r.URL.Path, "/h/"); ok {
+		name, path, _ := strings.Cut(rest, "/")
+		if slices.Contains(names, name) {
+			r.URL.Path, r.URL.RawPath = "/"+path, ""
+			return name, true
+		}
+	}
+	if name := r.URL.Query().Get("household"); slices.Contains(names, name) {
+		return name, true
+	}
+	if cookie, err := r.Cookie(householdCookie); err == nil && slices.Contains(names, cookie.Value) {
+		return cookie.Value, false
+	}
+	if cookie, err := r.Cookie(sessionCookie); err == nil {
+		var s sessionPayload
+		if payload, err := verifyValue(sessionCookie, cookie.Value); err == nil && json.Unmarshal(payload, &s) == nil && s.valid() && slices.Contains(names, s.Household) {
+			return s.Household, false
+		}
+	}
+	return names[0], false
+}
+
+// runHouseholds serves every household in names through its own worker.
+func runHouseholds(names []string) {
+	// Workers and the router must sign sessions with the same key
+	if envString("SESSION_SECRET", "") == "" {
+		secret := make([]byte, 32)
+		rand.Read(secret)
+		os.Setenv("SESSION_SECRET", hex.EncodeToString(secret))
+	}
+	initSessions()
+
+	exe, err := os.Executable()
+	if err != nil {
+		log.Fatal(err)
+	}
+	basePort := envInt("HOUSEHOLD_WORKER_PORT", 18080)
+	workers := make(map[string]*householdWorker, len(names))
+	proxies := make(map[string]*httputil.ReverseProxy, len(names))
+	for i, name := range names {
+		w := &householdWorker{name: name, addr: net.JoinHostPort("127.0.0.1", strconv.Itoa(basePort+i)),
+			stop: make(chan struct{}), done: make(chan struct{})}
+		workers[name] = w
+		proxies[name] = httputil.NewSingleHostReverseProxy(&url.URL{Scheme: "http", Host: w.addr})
+		go w.run(exe)
+	}
+
+	handler := http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+		name, selected := requestHousehold(r, names)
+		if selected {
+			http.SetCookie(rw, &http.Cookie{Name: householdCookie, Value: name, Path: "/",
+				MaxAge: int((365 * 24 * time.Hour).Seconds()), HttpOnly: true, SameSite: http.SameSiteLaxMode})
+		}
+		// The dashboard's household switcher
+		if r.URL.Path == "/api/households" {
+			rw.Header().Set("Content-Type", "application/json")
+			json.NewEncoder(rw).Encode(map[string]interface{}{"households": names, "current": name})
+			return
+		}
+		proxies[name].ServeHTTP(rw, r)
+	})
+
+	server := &http.Server{Addr: envString("LISTEN_ADDR", ":8080"), Handler: handler}
+	configureServer(server)
+	log.Printf("Serving households %s on %s", strings.Join(names, ", "), server.Addr)
+	go func() {
+		if err := server.ListenAndServe(); err != nil && err != http.ErrServerClosed {
+			log.Fatal(err)
+		}
+	}()
+
+	stop := make(chan os.Signal, 1)
+	signal.Notify(stop, os.Interrupt, syscall.SIGTERM)
+	<-stop
+	log.Printf("Shutting down")
+	server.Close()
+	var wg sync.WaitGroup
+	for _, w := range workers {
+		wg.Add(1)
+		go func(w *householdWorker) {
+			defer wg.Done()
+			w.shutdown(15 * time.Second)
+		}(w)
+	}
+	wg.Wait()
+}
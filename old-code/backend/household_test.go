@@ -0,0 +1,53 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestRequestHousehold(t *testing.T) {
+	sessionKey = []byte("test-secret")
+	names := []string{"home", "parents"}
+	session := func(household string, expires time.Time) *http.Cookie {
+		payload, _ := json.Marshal(Session{Subject: "u", Role: "admin", Household: household, Expires: expires})
+		return &http.Cookie{Name: sessionCookie, Value: signValue(sessionCookie, payload)}
+	}
+	later := time.Now().Add(time.Hour)
+
+	tests := []struct {
+		name         string
+		target       string
+		cookies      []*http.Cookie
+		want         string
+		wantSelected bool
+		wantPath     string
+	}{
+		{"default", "/api/alarm", nil, "home", false, "/api/alarm"},
+		{"prefix", "/h/parents/api/device/update", nil, "parents", true, "/api/device/update"},
+		{"unknown prefix", "/h/nobody/api/alarm", nil, "home", false, "/h/nobody/api/alarm"},
+		{"query", "/api/alarm?household=parents", nil, "parents", true, "/api/alarm"},
+		{"cookie", "/api/alarm", []*http.Cookie{{Name: householdCookie, Value: "parents"}}, "parents", false, "/api/alarm"},
+		{"prefix over cookie", "/h/home/api/alarm", []*http.Cookie{{Name: householdCookie, Value: "parents"}}, "home", true, "/api/alarm"},
+		{"session", "/api/alarm", []*http.Cookie{session("parents", later)}, "parents", false, "/api/alarm"},
+		{"expired session", "/api/alarm", []*http.Cookie{session("parents", time.Now().Add(-time.Minute))}, "home", false, "/api/alarm"},
+		{"forged session", "/api/alarm", []*http.Cookie{{Name: sessionCookie, Value: "e30.AAAA"}}, "home", false, "/api/alarm"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := httptest.NewRequest(http.MethodGet, tt.target, nil)
+			for _, c := range tt.cookies {
+				r.AddCookie(c)
+			}
+			got, selected := requestHousehold(r, names)
+			if got != tt.want || selected != tt.wantSelected {
+				t.Errorf("requestHousehold = %q, %v, want %q, %v", got, selected, tt.want, tt.wantSelected)
+			}
+			if r.URL.Path != tt.wantPath {
+				t.Errorf("path = %q, want %q", r.URL.Path, tt.wantPath)
+			}
+		})
+	}
+}
@@ -0,0 +1,259 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/labstack/echo/v4"
+)
+
+// User-facing strings are written in English and translated through
+// translations, keyed by the English text. A key may contain one %s for a
+// variable part, e.g. "unknown metric %s". Untranslated strings stay in
+// English.
+//
+// The language of a request is ?lang=, else the "lang" cookie set by
+// PUT /api/language, else the best supported Accept-Language, else the
+// language setting. Things without a request, like the weekly report, use
+// the language setting.
+
+var languages = map[string]bool{"en": true, "pl": true}
+
+const langCookie = "lang"
+
+var translations = map[string]map[string]string{
+	"pl": {
+		// API errors
+		"admin token required":                 "wymagany token administratora",
+		"alarm is not ringing":                 "budzik nie dzwoni",
+		"alert not found":                      "nie znaleziono alertu",
+		"days must be between 1 and 90":        "days musi wynosić od 1 do 90",
+		"days must be between 1 and 365":       "days musi wynosić od 1 do 365",
+		"device not found":                     "nie znaleziono urządzenia",
+		"duration must be between 0 and 24h":   "czas trwania musi wynosić od 0 do 24h",
+		"duration must be between 0 and 168h":  "czas trwania musi wynosić od 0 do 168h",
+		"geofence is not configured":           "geofencing nie jest skonfigurowany",
+		"hard mode is not enabled":             "tryb trudny nie jest włączony",
+		"invalid %s":                           "nieprawidłowa wartość %s",
+		"invalid geofence token":               "nieprawidłowy token geofencingu",
+		"invalid device id":                    "nieprawidłowy identyfikator urządzenia",
+		"invalid threshold":                    "nieprawidłowy próg",
+		"invalid webhook secret":               "nieprawidłowy sekret webhooka",
+		"job is already running":               "zadanie już działa",
+		"language must be en or pl":            "language musi mieć wartość en lub pl",
+		"limit must be between 1 and 1000":     "limit musi wynosić od 1 do 1000",
+		"login expired, try again":             "logowanie wygasło, spróbuj ponownie",
+		"login required":                       "wymagane logowanie",
+		"missing file":                         "brak pliku",
+		"no TTS backend configured":            "nie skonfigurowano syntezy mowy",
+		"no alarm is set":                      "nie ustawiono budzika",
+		"no alarm sound selected":              "nie wybrano dźwięku budzika",
+		"none of your groups has access":       "żadna z twoich grup nie ma dostępu",
+		"not enough recent data to forecast":   "za mało aktualnych danych do prognozy",
+		"only MP3 and WAV files are supported": "obsługiwane są tylko pliki MP3 i WAV",
+		"period must be day, week or month":    "period musi mieć wartość day, week lub month",
+		"presence detection is not configured": "wykrywanie obecności nie jest skonfigurowane",
+		"read-only access":                     "dostęp tylko do odczytu",
+		"sound file missing":                   "brak pliku dźwięku",
+		"sound not found":                      "nie znaleziono dźwięku",
+		"stream not found":                     "nie znaleziono strumienia",
+		"the alarm needs confirmation":         "budzik wymaga potwierdzenia",
+		"the backup alarm is not active":       "zapasowy budzik nie jest aktywny",
+		"time must be HH:MM":                   "time musi mieć format GG:MM",
+		"unknown challenge, request a new one": "nieznane zadanie, poproś o nowe",
+		"unknown command %s":                   "nieznane polecenie %s",
+		"unknown job":                          "nieznane zadanie",
+		"unknown metric":                       "nieznana metryka",
+		"unknown metric %s":                    "nieznana metryka %s",
+		"unknown person":                       "nieznana osoba",
+		"unknown setting %s":                   "nieznane ustawienie %s",
+		"Internal Server Error":                "Wewnętrzny błąd serwera",
+		"Not Found":                            "Nie znaleziono",
+		"Method Not Allowed":                   "Niedozwolona metoda",
+
+		// Weekly report
+		"Weekly home report":       "Tygodniowy raport domowy",
+		"Home report":              "Raport domowy",
+		"Air quality":              "Jakość powietrza",
+		"Average CO2":              "Średnie CO2",
+		"Peak CO2":                 "Maksymalne CO2",
+		"Nights with poor air":     "Noce ze złym powietrzem",
+		"%d of %d":                 "%d z %d",
+		"%.0f ppm average":         "średnio %.0f ppm",
+		"Noise":                    "Hałas",
+		"Average":                  "Średnio",
+		"Peak":                     "Maksimum",
+		"Alarm":                    "Budzik",
+		"Mornings rung":            "Poranki z budzikiem",
+		"Average time to dismiss":  "Średni czas do wyłączenia",
+		"Longest":                  "Najdłużej",
+		"Devices":                  "Urządzenia",
+		"(%+.0f%% vs last week)":   "(%+.0f%% wobec poprzedniego tygodnia)",
+		"CO2: avg %.0f ppm":        "CO2: średnio %.0f ppm",
+		"peak %.0f ppm":            "maksymalnie %.0f ppm",
+		"Poor air %d of %d nights": "Złe powietrze przez %d z %d nocy",
+		"Noise: avg %.1f":          "Hałas: średnio %.1f",
+		"peak %.1f":                "maksymalnie %.1f",
+		"Alarm: %d mornings, %.0f s to dismiss on average": "Budzik: %d poranków, średnio %.0f s do wyłączenia",
+		"Snoozes":                "Drzemki",
+		"Average time to get up": "Średni czas do wstania",
+		"No-snooze streak":       "Seria poranków bez drzemki",
+		"best %d":                "rekord %d",
+		"Snoozes: %d, %.0f s to get up on average, no-snooze streak %d (best %d)": "Drzemki: %d, średnio %.0f s do wstania, seria bez drzemki %d (rekord %d)",
+		"Notifications":               "Powiadomienia",
+		"Notifications this week: %d": "Powiadomienia w tym tygodniu: %d",
+
+		// Alarm warnings
+		"The alarm is already set for %s":             "Budzik jest już ustawiony na %s",
+		"The alarm would ring in %d minutes":          "Budzik zadzwoniłby za %d min",
+		"The alarm is off on %s and rings next on %s": "Budzik jest wyłączony %s i zadzwoni dopiero %s",
+	},
+}
+
+var monthsPL = []string{"sty", "lut", "mar", "kwi", "maj", "cze", "lip", "sie", "wrz", "paź", "lis", "gru"}
+
+// translate returns msg in lang, filling the %s of a matching pattern.
+func translate(lang, msg string) string {
+	catalog := translations[lang]
+	if catalog == nil {
+		return msg
+	}
+	if t, ok := catalog[msg]; ok {
+		return t
+	}
+	for key, t := range catalog {
+		prefix, suffix, ok := strings.Cut(key, "%s")
+		if !ok || strings.Contains(suffix, "%s") {
+			continue
+		}
+		if len(msg) > len(prefix)+len(suffix) && strings.HasPrefix(msg, prefix) && strings.HasSuffix(msg, suffix) {
+			return strings.Replace(t, "%s", msg[len(prefix):len(msg)-len(suffix)], 1)
+		}
+	}
+	return msg
+}
+
+// translatef translates a format string, then formats it.
+func translatef(lang, format string, args ...interface{}) string {
+	if t, ok := translations[lang][format]; ok {
+		format = t
+	}
+	return fmt.Sprintf(format, args...)
+}
+
+// formatDay formats a date as "Jan 2", or "2 sty" in Polish.
+func formatDay(lang string, t time.Time) string {
+	if lang == "pl" {
+		return strconv.Itoa(t.Day()) + " " + monthsPL[t.Month()-1]
+	}
+	return t.Format("Jan 2")
+}
+
+func requestLanguage(c echo.Context) string {
+	if lang := c.QueryParam("lang"); languages[lang] {
+		return lang
+	}
+	if cookie, err := c.Cookie(langCookie); err == nil && languages[cookie.Value] {
+		return cookie.Value
+	}
+	if lang := acceptLanguage(c.Request().Header.Get("Accept-Language")); lang != "" {
+		return lang
+	}
+	return setting("language")
+}
+
+// acceptLanguage picks the supported language with the highest q value
+// from an Accept-Language header, e.g. "pl-PL,pl;q=0.9,en;q=0.8".
+func acceptLanguage(header string) string {
+	type candidate struct {
+		lang string
+		q    float64
+	}
+	var candidates []candidate
+	for _, part := range strings.Split(header, ",") {
+		tag, params, _ := strings.Cut(strings.TrimSpace(part), ";")
+		base, _, _ := strings.Cut(strings.ToLower(tag), "-")
+		if !languages[base] {
+			continue
+		}
+		q := 1.0
+		if v, ok := strings.CutPrefix(strings.TrimSpace(params), "q="); ok {
+			if parsed, err := strconv.ParseFloat(v, 64); err == nil {
+				q = parsed
+			}
+		}
+		if q > 0 {
+			candidates = append(candidates, candidate{base, q})
+		}
+	}
+	if len(candidates) == 0 {
+		return ""
+	}
+	sort.SliceStable(candidates, func(i, j int) bool { return candidates[i].q > candidates[j].q })
+	return candidates[0].lang
+}
+
+// localizedJSON translates the "error" (and echo's "message") of error
+// responses into the request's language, so handlers keep writing English.
+type localizedJSON struct {
+	echo.DefaultJSONSerializer
+}
+
+func (s localizedJSON) Serialize(c echo.Context, i interface{}, indent string) error {
+	lang := requestLanguage(c)
+	if lang != "en" {
+		switch v := i.(type) {
+		case map[string]string:
+			if msg, ok := v["error"]; ok {
+				out := make(map[string]string, len(v))
+				for k, val := range v {
+					out[k] = val
+				}
+				out["error"] = translate(lang, msg)
+				i = out
+			}
+		case map[string]interface{}:
+			out := make(map[string]interface{}, len(v))
+			for k, val := range v {
+				if msg, ok := val.(string); ok && (k == "error" || k == "message") {
+					val = translate(lang, msg)
+				}
+				out[k] = val
+			}
+			i = out
+		}
+	}
+	return s.DefaultJSONSerializer.Serialize(c, i, indent)
+}
+
+func getLanguage(c echo.Context) error {
+	return c.JSON(http.StatusOK, map[string]interface{}{
+		"language":  requestLanguage(c),
+		"supported": []string{"en", "pl"},
+	})
+}
+
+// putLanguage stores {"language": "pl"} as this browser's preference.
+func putLanguage(c echo.Context) error {
+	var req struct {
+		Language string `json:"language"`
+	}
+	if err := c.Bind(&req); err != nil {
+		return invalidBody(c, err)
+	}
+	if !languages[req.Language] {
+		return apiError(c, http.StatusBadRequest, "language must be en or pl")
+	}
+	c.SetCookie(&http.Cookie{
+		Name:     langCookie,
+		Value:    req.Language,
+		Path:     "/",
+		MaxAge:   365 * 24 * 60 * 60,
+		SameSite: http.SameSiteLaxMode,
+	})
+	return c.JSON(http.StatusOK, map[string]string{"language": req.Language})
+}
@@ -0,0 +1,102 @@
+package main
+
+import (
+	"bytes"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/labstack/echo/v4"
+)
+
+// Devices retry an update when the response times out, which used to insert
+// the same readings twice. An update may carry an Idempotency-Key header or
+// a "seq" number in its body. Firmware restarts its sequence after a reboot,
+// so seq only counts together with the "boot_id" the device picks at every
+// boot; a seq without one is ignored. A repeated key from the same device within
+// IDEMPOTENCY_WINDOW is not processed again; it gets the original response,
+// marked with an Idempotent-Replayed header. A retry that arrives while the
+// original is still being processed waits for it.
+
+type idempotentResponse struct {
+	done    chan struct{}
+	ok      bool
+	status  int
+	body    []byte
+	expires time.Time
+}
+
+var (
+	idempotencyMu sync.Mutex
+	idempotency   = make(map[string]*idempotentResponse)
+)
+
+// idempotencyKey scopes a key to the device whose key the request carried.
+func idempotencyKey(c echo.Context, deviceID int, update DeviceUpdate) string {
+	key := c.Request().Header.Get("Idempotency-Key")
+	if key == "" && update.Seq != nil && update.BootID != "" {
+		key = "seq:" + update.BootID + ":" + strconv.FormatUint(*update.Seq, 10)
+	}
+	if key == "" {
+		return ""
+	}
+	return strconv.Itoa(deviceID) + "|" + key
+}
+
+// responseRecorder keeps a copy of what a handler writes.
+type responseRecorder struct {
+	http.ResponseWriter
+	body bytes.Buffer
+}
+
+func (r *responseRecorder) Write(b []byte) (int, error) {
+	r.body.Write(b)
+	return r.ResponseWriter.Write(b)
+}
+
+// beginIdempotent either replays the stored response for key (replayed is
+// true) or reserves key and returns a finish function to call once the
+// response has been written.
+func beginIdempotent(c echo.Context, key string) (replayed bool, finish func(), err error) {
+	now := time.Now()
+	idempotencyMu.Lock()
+	for k, r := range idempotency {
+		if r.ok && now.After(r.expires) {
+			delete(idempotency, k)
+		}
+	}
+	prev, found := idempotency[key]
+	if !found {
+		entry := &idempotentResponse{done: make(chan struct{})}
+		idempotency[key] = entry
+		idempotencyMu.Unlock()
+
+		rec := &responseRecorder{ResponseWriter: c.Response().Writer}
+		c.Response().Writer = rec
+		return false, func() {
+			status := c.Response().Status
+			idempotencyMu.Lock()
+			if c.Response().Committed && status == http.StatusOK {
+				entry.ok, entry.status, entry.body = true, status, rec.body.Bytes()
+				entry.expires = time.Now().Add(envDuration("IDEMPOTENCY_WINDOW", 10*time.Minute))
+			} else {
+				delete(idempotency, key) // let a retry try again
+			}
+			idempotencyMu.Unlock()
+			close(entry.done)
+		}, nil
+	}
+	idempotencyMu.Unlock()
+
+	select {
+	case <-prev.done:
+	case <-c.Request().Context().Done():
+		return true, nil, c.Request().Context().Err()
+	}
+	if !prev.ok {
+		return true, nil, apiError(c, http.StatusConflict, "original request failed, retry")
+	}
+	c.Response().Header().Set("Idempotent-Replayed", "true")
+	return true, nil, c.Blob(prev.status, echo.MIMEApplicationJSON, prev.body)
+}
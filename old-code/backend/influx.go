@@ -0,0 +1,228 @@
+package main
+
+import (
+	"compress/gzip"
+	"crypto/subtle"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/labstack/echo/v4"
+)
+
+// POST /api/ingest/influx accepts InfluxDB line protocol, so Telegraf and
+// firmware that already speak it can write here unchanged. It also answers
+// on the paths the InfluxDB clients append: /write (v1) and /api/v2/write.
+//
+// The device is the "device" tag, else the "host" tag. Each field becomes
+// the metric <measurement>_<field> ("value" fields just <measurement>),
+// renamed by INFLUX_FIELD_MAP, e.g. INFLUX_FIELD_MAP=scd30_co2=co2.
+// Integers and booleans are stored as numbers, strings are ignored.
+// Clients authenticate with INFLUX_TOKEN as "Authorization: Token ..." (v2),
+// a bearer token or the v1 password (?p= or basic auth).
+
+const maxInfluxBody = 10 << 20
+
+type influxPoint struct {
+	measurement string
+	tags        map[string]string
+	fields      map[string]float64
+	at          time.Time
+}
+
+var influxPrecisions = map[string]time.Duration{
+	"": time.Nanosecond, "n": time.Nanosecond, "ns": time.Nanosecond,
+	"u": time.Microsecond, "us": time.Microsecond,
+	"ms": time.Millisecond,
+	"s":  time.Second,
+}
+
+// splitUnescaped splits s at sep, honouring backslash escapes and, when
+// quotes is set, double-quoted strings.
+func splitUnescaped(s string, sep byte, quotes bool, limit int) []string {
+	var parts []string
+	start, quoted := 0, false
+	for i := 0; i < len(s); i++ {
+		switch {
+		case s[i] == '\\':
+			i++
+		case quotes && s[i] == '"':
+			quoted = !quoted
+		case s[i] == sep && !quoted && (limit <= 0 || len(parts) < limit-1):
+			parts = append(parts, s[start:i])
+			start = i + 1
+		}
+	}
+	return append(parts, s[start:])
+}
+
+func unescapeInflux(s string) string {
+	if !strings.Contains(s, `\`) {
+		return s
+	}
+	var sb strings.Builder
+	for i := 0; i < len(s); i++ {
+		if s[i] == '\\' && i+1 < len(s) {
+			i++
+		}
+		sb.WriteByte(s[i])
+	}
+	return sb.String()
+}
+
+func parseInfluxLine(line string, unit time.Duration, now time.Time) (influxPoint, error) {
+	p := influxPoint{tags: map[string]string{}, fields: map[string]float64{}, at: now}
+	parts := splitUnescaped(line, ' ', true, 3)
+	if len(parts) < 2 {
+		return p, fmt.Errorf("missing fields")
+	}
+
+	key := splitUnescaped(parts[0], ',', false, 0)
+	p.measurement = unescapeInflux(key[0])
+	if p.measurement == "" {
+		return p, fmt.Errorf("missing measurement")
+	}
+	for _, tag := range key[1:] {
+		kv := splitUnescaped(tag, '=', false, 2)
+		if len(kv) != 2 {
+			return p, fmt.Errorf("invalid tag %q", tag)
+		}
+		p.tags[unescapeInflux(kv[0])] = unescapeInflux(kv[1])
+	}
+
+	for _, field := range splitUnescaped(parts[1], ',', true, 0) {
+		kv := splitUnescaped(field, '=', true, 2)
+		if len(kv) != 2 || kv[0] == "" {
+			return p, fmt.Errorf("invalid field %q", field)
+		}
+		name, raw := unescapeInflux(kv[0]), kv[1]
+		switch {
+		case strings.HasPrefix(raw, `"`):
+			continue
+		case raw == "t" || raw == "T" || raw == "true" || raw == "True" || raw == "TRUE":
+			p.fields[name] = 1
+		case raw == "f" || raw == "F" || raw == "false" || raw == "False" || raw == "FALSE":
+			p.fields[name] = 0
+		default:
+			v, err := strconv.ParseFloat(strings.TrimRight(raw, "iu"), 64)
+			if err != nil {
+				return p, fmt.Errorf("invalid value of field %q", name)
+			}
+			p.fields[name] = v
+		}
+	}
+
+	if len(parts) == 3 && strings.TrimSpace(parts[2]) != "" {
+		ts, err := strconv.ParseInt(strings.TrimSpace(parts[2]), 10, 64)
+		if err != nil {
+			return p, fmt.Errorf("invalid timestamp")
+		}
+		p.at = time.Unix(0, 0).Add(time.Duration(ts) * unit)
+	}
+	return p, nil
+}
+
+func influxAuthorized(r *http.Request, token string) bool {
+	got := r.URL.Query().Get("p")
+	if auth := r.Header.Get("Authorization"); auth != "" {
+		if _, pass, ok := r.BasicAuth(); ok {
+			got = pass
+		} else if scheme, value, ok := strings.Cut(auth, " "); ok && (scheme == "Token" || scheme == "Bearer") {
+			got = value
+		}
+	}
+	return subtle.ConstantTimeCompare([]byte(got), []byte(token)) == 1
+}
+
+func ingestInflux(c echo.Context) error {
+	token := envString("INFLUX_TOKEN", "")
+	if token == "" {
+		return apiErrorCode(c, http.StatusNotFound, codeNotConfigured, "InfluxDB ingestion is not configured")
+	}
+	if !influxAuthorized(c.Request(), token) {
+		return apiError(c, http.StatusUnauthorized, "invalid token")
+	}
+	unit, ok := influxPrecisions[c.QueryParam("precision")]
+	if !ok {
+		return apiError(c, http.StatusBadRequest, "precision must be ns, us, ms or s")
+	}
+
+	var body io.Reader = c.Request().Body
+	if c.Request().Header.Get("Content-Encoding") == "gzip" {
+		gz, err := gzip.NewReader(body)
+		if err != nil {
+			return apiError(c, http.StatusBadRequest, err.Error())
+		}
+		defer gz.Close()
+		body = gz
+	}
+	data, err := io.ReadAll(io.LimitReader(body, maxInfluxBody+1))
+	if err != nil {
+		return invalidBody(c, err)
+	}
+	if len(data) > maxInfluxBody {
+		return apiError(c, http.StatusRequestEntityTooLarge, "body too large")
+	}
+
+	// Points are grouped by device and time, so each group is one ingest.
+	type groupKey struct {
+		device string
+		at     time.Time
+	}
+	groups := make(map[groupKey]map[string]float64)
+	var order []groupKey
+	fieldMap := parsePairs(envString("INFLUX_FIELD_MAP", ""))
+	now := time.Now()
+	for i, line := range strings.Split(string(data), "\n") {
+		line = strings.TrimSpace(line)
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		p, err := parseInfluxLine(line, unit, now)
+		if err != nil {
+			return apiError(c, http.StatusBadRequest, fmt.Sprintf("line %d: %v", i+1, err))
+		}
+		device := p.tags["device"]
+		if device == "" {
+			device = p.tags["host"]
+		}
+		if device == "" {
+			return apiError(c, http.StatusBadRequest, fmt.Sprintf("line %d: missing device or host tag", i+1))
+		}
+
+		key := groupKey{device, p.at}
+		values, ok := groups[key]
+		if !ok {
+			values = make(map[string]float64)
+			groups[key] = values
+			order = append(order, key)
+		}
+		for field, v := range p.fields {
+			name := p.measurement + "_" + field
+			if field == "value" {
+				name = p.measurement
+			}
+			if mapped, ok := fieldMap[name]; ok {
+				name = mapped
+			} else {
+				name = metricName(name)
+			}
+			if name != "" {
+				values[name] = v
+			}
+		}
+	}
+
+	for _, key := range order {
+		if len(groups[key]) == 0 {
+			continue
+		}
+		if err := ingestMetrics(c.Request().Context(), key.device, groups[key], key.at.Local()); err != nil {
+			return internalError(c, err)
+		}
+	}
+	return c.NoContent(http.StatusNoContent)
+}
@@ -0,0 +1,270 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"maps"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Device updates are written to device_status and sensor_data in one
+// transaction per update by default. With INGEST_FLUSH_INTERVAL set (e.g.
+// 10s) they are buffered instead and written in batches, every interval or
+// once INGEST_BATCH_SIZE readings are waiting, which saves the SD card when
+// devices report every few seconds. Buffered readings become visible to
+// queries only after the flush; the buffer is flushed on shutdown.
+
+type reading struct {
+	deviceID        int
+	at              time.Time
+	errorCode       *string
+	co2, sound      float64
+	co2Raw          float64
+	soundRaw        float64
+	alarmActive     bool
+	alarmActiveTime int64
+	statusOnly      bool // every metric was filtered out, no sensor_data row
+}
+
+type ingestBuffer struct {
+	mu        sync.Mutex
+	pending   []reading
+	batchSize int
+	full      chan struct{}
+}
+
+var ingest *ingestBuffer
+
+func initIngest() {
+	interval := envDuration("INGEST_FLUSH_INTERVAL", 0)
+	if interval <= 0 {
+		return
+	}
+	ingest = &ingestBuffer{
+		batchSize: max(envInt("INGEST_BATCH_SIZE", 500), 1),
+		full:      make(chan struct{}, 1),
+	}
+	go ingest.run(interval)
+}
+
+// storeReading writes a reading, or queues it when batching is enabled,
+// unless its storage policies skip it (see storage_policy.go).
+func storeReading(ctx context.Context, r reading) error {
+	if !readingDue(r) {
+		return nil
+	}
+	if ingest == nil {
+		return writeReadings(ctx, []reading{r})
+	}
+	ingest.mu.Lock()
+	ingest.pending = append(ingest.pending, r)
+	full := len(ingest.pending) >= ingest.batchSize
+	ingest.mu.Unlock()
+	if full {
+		select {
+		case ingest.full <- struct{}{}:
+		default:
+		}
+	}
+	return nil
+}
+
+func (b *ingestBuffer) run(interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+		case <-b.full:
+		}
+		b.flush()
+	}
+}
+
+// flush writes everything pending, batchSize readings per transaction;
+// writeReadings splits a batch over several statements when it has more
+// parameters than Postgres takes. On failure the readings are kept for the
+// next attempt, up to ten batches, so a database outage cannot exhaust memory.
+func (b *ingestBuffer) flush() {
+	if b == nil {
+		return
+	}
+	b.mu.Lock()
+	batch := b.pending
+	b.pending = nil
+	b.mu.Unlock()
+
+	for len(batch) > 0 {
+		n := min(len(batch), b.batchSize)
+		if err := writeReadings(context.Background(), batch[:n]); err != nil {
+			log.Printf("Failed to write %d buffered readings: %v", len(batch), err)
+			b.mu.Lock()
+			b.pending = append(batch, b.pending...)
+			if limit := 10 * b.batchSize; len(b.pending) > limit {
+				log.Printf("Ingest buffer full, dropping %d oldest readings", len(b.pending)-limit)
+				b.pending = b.pending[len(b.pending)-limit:]
+			}
+			b.mu.Unlock()
+			return
+		}
+		batch = batch[n:]
+	}
+}
+
+// ingestMetrics stores readings from other sources than the firmware
+// (LoRaWAN, ESPHome) for a device. co2 and sound go to sensor_data like a
+// device update; any other metric is stored in metric_samples under its name,
+// which makes it queryable and usable in rules like a derived metric.
+func ingestMetrics(ctx context.Context, deviceName string, values map[string]float64, at time.Time) error {
+	device, err := deviceByName(deviceName)
+	if err != nil {
+		return err
+	}
+	cals, err := loadCalibration(device.ID)
+	if err != nil {
+		return err
+	}
+	now := time.Now()
+	if sampleInFuture(at, now) {
+		recordRejectedSamples(ctx, device.ID, "future", len(values))
+		return nil
+	}
+	if sampleLate(at, now) {
+		sample := BufferedSample{Time: at.Unix(), CO2Level: values["co2"], SoundLevel: values["sound"], Metrics: values}
+		return storeBufferedSamples(ctx, device.ID, cals, []BufferedSample{sample}, 0, now)
+	}
+
+	calibrated := make(map[string]float64, len(values))
+	for name, v := range values {
+		calibrated[name] = calibrate(cals, name, v)
+	}
+	spikes, err := applyFilters(device.ID, calibrated)
+	if err != nil {
+		return err
+	}
+	recordRejectedSamples(ctx, device.ID, "spike", spikes)
+	co2, hasCO2 := calibrated["co2"]
+	sound, hasSound := calibrated["sound"]
+	if hasCO2 || hasSound {
+		err := storeReading(ctx, reading{
+			deviceID: device.ID, at: at,
+			co2: co2, sound: sound, co2Raw: values["co2"], soundRaw: values["sound"],
+		})
+		if err != nil {
+			return err
+		}
+	}
+	if err := storeMetricSamples(ctx, device.ID, calibrated, at); err != nil {
+		return err
+	}
+
+	publish(EventSensorUpdate, map[string]interface{}{"device": device.Name, "room": device.Room, "metrics": calibrated})
+	go evaluateRules(device.Room, withRoomSensors(device.Room, maps.Clone(calibrated)))
+	return nil
+}
+
+var metricNamePattern = regexp.MustCompile(`[^a-z0-9_]+`)
+
+// metricName turns an external field name ("Temperature C") into a metric
+// name ("temperature_c").
+func metricName(field string) string {
+	return strings.Trim(metricNamePattern.ReplaceAllString(strings.ToLower(field), "_"), "_")
+}
+
+// postgresMaxParams is the most bind parameters one statement can have.
+const postgresMaxParams = 65535
+
+// splitRows cuts rows of equal width into chunks that each fit one
+// insertRows statement.
+func splitRows(rows [][]interface{}) [][][]interface{} {
+	if len(rows) == 0 {
+		return nil
+	}
+	size := max(postgresMaxParams/max(len(rows[0]), 1), 1)
+	chunks := make([][][]interface{}, 0, (len(rows)+size-1)/size)
+	for len(rows) > size {
+		chunks = append(chunks, rows[:size])
+		rows = rows[size:]
+	}
+	return append(chunks, rows)
+}
+
+// insertRows builds a multi-row INSERT for rows of equal width. Use splitRows
+// for more rows than fit the parameter limit.
+func insertRows(table string, columns []string, rows [][]interface{}) (string, []interface{}) {
+	var sb strings.Builder
+	args := make([]interface{}, 0, len(rows)*len(columns))
+	fmt.Fprintf(&sb, "INSERT INTO %s (%s) VALUES ", table, strings.Join(columns, ", "))
+	for i, row := range rows {
+		if i > 0 {
+			sb.WriteString(", ")
+		}
+		sb.WriteString("(")
+		for j, v := range row {
+			if j > 0 {
+				sb.WriteString(", ")
+			}
+			args = append(args, v)
+			fmt.Fprintf(&sb, "$%d", len(args))
+		}
+		sb.WriteString(")")
+	}
+	return sb.String(), args
+}
+
+func writeReadings(ctx context.Context, readings []reading) error {
+	status := make([][]interface{}, len(readings))
+	var samples [][]interface{}
+	sent := make(map[int]int)
+	for i, r := range readings {
+		status[i] = []interface{}{r.deviceID, r.at, r.errorCode, r.co2, r.sound, r.alarmActive, r.alarmActiveTime}
+		if r.statusOnly {
+			continue
+		}
+		samples = append(samples, []interface{}{r.deviceID, r.at, r.co2, r.sound, r.co2Raw, r.soundRaw})
+		sent[r.deviceID]++
+	}
+
+	tx, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	for _, chunk := range splitRows(status) {
+		query, args := insertRows("device_status", []string{"device_id", "last_seen", "error_code", "co2_level", "sound_level", "alarm_active", "alarm_active_time"}, chunk)
+		if _, err := tx.ExecContext(ctx, query, args...); err != nil {
+			return err
+		}
+	}
+	// Samples already stored are skipped and counted as duplicates
+	for _, chunk := range splitRows(samples) {
+		query, args := insertRows("sensor_data", []string{"device_id", "timestamp", "co2_level", "sound_level", "co2_raw", "sound_raw"}, chunk)
+		rows, err := tx.QueryContext(ctx, query+" ON CONFLICT DO NOTHING RETURNING device_id", args...)
+		if err != nil {
+			return err
+		}
+		for rows.Next() {
+			var id int
+			if err := rows.Scan(&id); err != nil {
+				rows.Close()
+				return err
+			}
+			sent[id]--
+		}
+		rows.Close()
+		if err := rows.Err(); err != nil {
+			return err
+		}
+	}
+	if err := tx.Commit(); err != nil {
+		return err
+	}
+	for id, duplicates := range sent {
+		recordRejectedSamples(ctx, id, "duplicate", duplicates)
+	}
+	return nil
+}
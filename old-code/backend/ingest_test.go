@@ -0,0 +1,53 @@
+package main
+
+import "testing"
+
+func testRows(n, width int) [][]interface{} {
+	rows := make([][]interface{}, n)
+	for i := range rows {
+		rows[i] = make([]interface{}, width)
+	}
+	return rows
+}
+
+func TestSplitRows(t *testing.T) {
+	tests := []struct {
+		name  string
+		rows  int
+		width int
+		want  []int // rows per chunk
+	}{
+		{"empty", 0, 7, nil},
+		{"one row", 1, 7, []int{1}},
+		{"default batch", 500, 7, []int{500}},
+		{"at the limit", 9362, 7, []int{9362}},
+		{"over the limit", 9363, 7, []int{9362, 1}},
+		{"several chunks", 25000, 6, []int{10922, 10922, 3156}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			chunks := splitRows(testRows(tt.rows, tt.width))
+			if len(chunks) != len(tt.want) {
+				t.Fatalf("got %d chunks, want %d", len(chunks), len(tt.want))
+			}
+			for i, chunk := range chunks {
+				if len(chunk) != tt.want[i] {
+					t.Errorf("chunk %d has %d rows, want %d", i, len(chunk), tt.want[i])
+				}
+				if _, args := insertRows("t", make([]string, tt.width), chunk); len(args) > postgresMaxParams {
+					t.Errorf("chunk %d has %d parameters", i, len(args))
+				}
+			}
+		})
+	}
+}
+
+func TestInsertRows(t *testing.T) {
+	query, args := insertRows("sensor_data", []string{"device_id", "co2_level"}, [][]interface{}{{1, 400.0}, {2, 500.0}})
+	if want := "INSERT INTO sensor_data (device_id, co2_level) VALUES ($1, $2), ($3, $4)"; query != want {
+		t.Errorf("query = %q, want %q", query, want)
+	}
+	if len(args) != 4 || args[2] != 2 {
+		t.Errorf("args = %v", args)
+	}
+}
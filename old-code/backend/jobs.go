@@ -0,0 +1,173 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"net/http"
+	"runtime/debug"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/labstack/echo/v4"
+)
+
+// Background work (reports, watchdogs, scans) runs as named jobs. Each job has
+// a default schedule that can be overridden with JOB_<NAME>_SCHEDULE, e.g.
+// JOB_WEEKLY_REPORT_SCHEDULE="0 9 * * 0", or set to "off" to disable it. A job
+// never overlaps with itself: a run that is due while the previous one is
+// still going is skipped. A job that panics fails that run with the panic as
+// its error and is reported like a panicking handler (panics.go). With
+// several replicas only the leader runs jobs on schedule.
+
+type JobStatus struct {
+	Name         string     `json:"name"`
+	Schedule     string     `json:"schedule"`
+	Running      bool       `json:"running"`
+	NextRun      *time.Time `json:"next_run,omitempty"`
+	LastStart    *time.Time `json:"last_start,omitempty"`
+	LastDuration string     `json:"last_duration,omitempty"`
+	LastError    string     `json:"last_error,omitempty"`
+	Runs         int        `json:"runs"`
+	Skipped      int        `json:"skipped"`
+}
+
+type job struct {
+	mu       sync.Mutex
+	fn       func() error
+	schedule schedule
+	status   JobStatus
+}
+
+var (
+	jobsMu sync.Mutex
+	jobs   = make(map[string]*job)
+)
+
+// registerJob adds a job; it starts running on its schedule in startJobs.
+func registerJob(name, defaultSchedule string, fn func() error) {
+	spec := envString("JOB_"+strings.ToUpper(name)+"_SCHEDULE", defaultSchedule)
+	j := &job{fn: fn, status: JobStatus{Name: name, Schedule: spec}}
+	if spec != "off" {
+		s, err := parseSchedule(spec)
+		if err != nil {
+			log.Printf("Job %s disabled: %v", name, err)
+		} else {
+			j.schedule = s
+		}
+	}
+
+	jobsMu.Lock()
+	jobs[name] = j
+	jobsMu.Unlock()
+}
+
+func startJobs() {
+	jobsMu.Lock()
+	defer jobsMu.Unlock()
+	for _, j := range jobs {
+		if j.schedule != nil {
+			go j.loop()
+		}
+	}
+}
+
+func (j *job) loop() {
+	for {
+		next := j.schedule.Next(time.Now())
+		if next.IsZero() {
+			return
+		}
+		j.mu.Lock()
+		j.status.NextRun = &next
+		j.mu.Unlock()
+
+		time.Sleep(time.Until(next))
+		if isLeader() {
+			go j.run()
+		}
+	}
+}
+
+// run executes the job unless it is already running.
+func (j *job) run() {
+	j.mu.Lock()
+	if j.status.Running {
+		j.status.Skipped++
+		j.mu.Unlock()
+		log.Printf("Job %s is still running, skipping", j.status.Name)
+		return
+	}
+	start := time.Now()
+	j.status.Running = true
+	j.status.LastStart = &start
+	j.mu.Unlock()
+
+	err := j.call()
+
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	j.status.Running = false
+	j.status.Runs++
+	j.status.LastDuration = time.Since(start).Round(time.Millisecond).String()
+	j.status.LastError = ""
+	if err != nil {
+		j.status.LastError = err.Error()
+		log.Printf("Job %s failed: %v", j.status.Name, err)
+	}
+}
+
+// call runs the job's function, turning a panic into an error.
+func (j *job) call() (err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			reportJobPanic(j.status.Name, r, string(debug.Stack()))
+			err = fmt.Errorf("panic: %v", r)
+		}
+	}()
+	return j.fn()
+}
+
+// triggerJob runs a registered job now, in the background.
+func triggerJob(name string) {
+	jobsMu.Lock()
+	j, ok := jobs[name]
+	jobsMu.Unlock()
+	if ok {
+		go j.run()
+	}
+}
+
+func getJobs(c echo.Context) error {
+	jobsMu.Lock()
+	statuses := make([]JobStatus, 0, len(jobs))
+	for _, j := range jobs {
+		j.mu.Lock()
+		statuses = append(statuses, j.status)
+		j.mu.Unlock()
+	}
+	jobsMu.Unlock()
+
+	sort.Slice(statuses, func(i, k int) bool { return statuses[i].Name < statuses[k].Name })
+	return c.JSON(http.StatusOK, statuses)
+}
+
+func runJob(c echo.Context) error {
+	jobsMu.Lock()
+	j, ok := jobs[c.Param("name")]
+	jobsMu.Unlock()
+	if !ok {
+		return apiError(c, http.StatusNotFound, "unknown job")
+	}
+
+	j.mu.Lock()
+	running := j.status.Running
+	j.mu.Unlock()
+	if running {
+		return apiError(c, http.StatusConflict, "job is already running")
+	}
+
+	go j.run()
+	return c.NoContent(http.StatusAccepted)
+}
@@ -0,0 +1,41 @@
+package main
+
+import (
+	"errors"
+	"testing"
+	"time"
+)
+
+func TestJobRun(t *testing.T) {
+	tests := []struct {
+		name    string
+		fn      func() error
+		wantErr string
+	}{
+		{"succeeds", func() error { return nil }, ""},
+		{"fails", func() error { return errors.New("disk full") }, "disk full"},
+		{"panics", func() error { panic("nil map") }, "panic: nil map"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			// Counts as just notified, so the panic is not sent anywhere
+			panicsMu.Lock()
+			panicsNotified["job:"+tt.name] = time.Now()
+			panicsMu.Unlock()
+
+			j := &job{fn: tt.fn, status: JobStatus{Name: tt.name}}
+			j.run()
+			j.run()
+
+			if j.status.Running {
+				t.Error("job is still marked running")
+			}
+			if j.status.Runs != 2 {
+				t.Errorf("Runs = %d, want 2", j.status.Runs)
+			}
+			if j.status.LastError != tt.wantErr {
+				t.Errorf("LastError = %q, want %q", j.status.LastError, tt.wantErr)
+			}
+		})
+	}
+}
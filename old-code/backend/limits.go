@@ -0,0 +1,87 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/labstack/echo/v4"
+)
+
+// Request bodies are limited so that a broken or hostile client cannot make
+// the server buffer more than the Pi can spare. Device endpoints take at most
+// DEVICE_MAX_BODY (16 KiB, updates are a few hundred bytes), everything else
+// HTTP_MAX_BODY (1 MiB), except the endpoints that take imports: InfluxDB
+// line protocol, alarm sound uploads and device log batches have limits of
+// their own. A larger body is refused with 413.
+//
+// The server also drops clients that are too slow: headers must arrive
+// within HTTP_READ_HEADER_TIMEOUT and the whole request within
+// HTTP_READ_TIMEOUT, a response must be written within HTTP_WRITE_TIMEOUT,
+// and idle keep-alive connections are closed after HTTP_IDLE_TIMEOUT.
+// WebSockets are exempt once upgraded.
+//
+// Rate limits go by the client's address. X-Forwarded-For is only believed
+// when the connection comes from one of TRUSTED_PROXIES (CIDRs, e.g. the
+// reverse proxy's 172.18.0.0/16); otherwise anyone could pick a new address
+// for every request.
+
+// clientIPExtractor returns how c.RealIP() finds the client's address.
+func clientIPExtractor() (echo.IPExtractor, error) {
+	spec := envString("TRUSTED_PROXIES", "")
+	if spec == "" {
+		return echo.ExtractIPDirect(), nil
+	}
+	options := []echo.TrustOption{echo.TrustLoopback(false), echo.TrustLinkLocal(false), echo.TrustPrivateNet(false)}
+	for _, cidr := range strings.Split(spec, ",") {
+		_, ipNet, err := net.ParseCIDR(strings.TrimSpace(cidr))
+		if err != nil {
+			return nil, fmt.Errorf("TRUSTED_PROXIES: %w", err)
+		}
+		options = append(options, echo.TrustIPRange(ipNet))
+	}
+	return echo.ExtractIPFromXFFHeader(options...), nil
+}
+
+// bodyLimit returns the largest body accepted for a path.
+func bodyLimit(path string) int64 {
+	switch {
+	case strings.HasPrefix(path, "/api/ingest/influx"):
+		return maxInfluxBody
+	case path == "/api/alarm/sounds":
+		// The file plus the multipart framing
+		return int64(envInt("ALARM_SOUND_MAX_BYTES", 10<<20)) + 64<<10
+	case path == "/api/device/logs" || strings.HasPrefix(path, "/api/devices/") && strings.HasSuffix(path, "/logs"):
+		return maxLogBatch * (maxLogMessage + 256)
+	case path == "/api/device/backfill":
+		return maxBackfillSamples * 256
+	case strings.HasPrefix(path, "/api/device/"):
+		return int64(envInt("DEVICE_MAX_BODY", 16<<10))
+	}
+	return int64(envInt("HTTP_MAX_BODY", 1<<20))
+}
+
+// limitBodies enforces bodyLimit on every request.
+func limitBodies(next echo.HandlerFunc) echo.HandlerFunc {
+	return func(c echo.Context) error {
+		req := c.Request()
+		limit := bodyLimit(req.URL.Path)
+		if req.ContentLength > limit {
+			return apiError(c, http.StatusRequestEntityTooLarge, fmt.Sprintf("request body is limited to %d bytes", limit))
+		}
+		// Bodies without a Content-Length fail once they reach the limit
+		req.Body = http.MaxBytesReader(c.Response(), req.Body, limit)
+		return next(c)
+	}
+}
+
+// configureServer sets the timeouts that protect against slow clients.
+func configureServer(s *http.Server) {
+	s.ReadHeaderTimeout = envDuration("HTTP_READ_HEADER_TIMEOUT", 5*time.Second)
+	s.ReadTimeout = envDuration("HTTP_READ_TIMEOUT", 30*time.Second)
+	s.WriteTimeout = envDuration("HTTP_WRITE_TIMEOUT", 60*time.Second)
+	s.IdleTimeout = envDuration("HTTP_IDLE_TIMEOUT", 2*time.Minute)
+	s.MaxHeaderBytes = envInt("HTTP_MAX_HEADER_BYTES", 64<<10)
+}
@@ -0,0 +1,160 @@
+package main
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"net/http"
+	"net/url"
+	"slices"
+	"time"
+
+	"github.com/labstack/echo/v4"
+)
+
+// Voice assistants link to the server with OAuth 2.0 (authorization code
+// grant). The assistant's app sends the user to GET /api/oauth/authorize,
+// which needs a login with AUTH_REQUIRED and hands back a code for the
+// session; the assistant then exchanges it at POST /api/oauth/token for an
+// access token (an hour) and a refresh token (LINK_REFRESH_TTL). The tokens
+// are stateless like sessions, signed with SESSION_SECRET for their kind
+// only (a code never passes as a token or a session), and carry the
+// role of the user who linked: viewers can ask, only admins can switch the
+// alarm. Codes and tokens name the household and are refused by the servers
+// of other households. Changing SESSION_SECRET unlinks every assistant.
+
+type linkClient struct {
+	name          string
+	id, secret    string
+	redirectHosts []string // where the assistant may have codes sent
+}
+
+// linkClients are the assistants with a client ID and secret configured.
+func linkClients() []linkClient {
+	candidates := []linkClient{
+		{name: "alexa", id: envString("ALEXA_CLIENT_ID", ""), secret: envString("ALEXA_CLIENT_SECRET", ""),
+			redirectHosts: []string{"pitangui.amazon.com", "layla.amazon.com", "alexa.amazon.co.jp"}},
+		{name: "google", id: envString("GOOGLE_CLIENT_ID", ""), secret: envString("GOOGLE_CLIENT_SECRET", ""),
+			redirectHosts: []string{"oauth-redirect.googleusercontent.com", "oauth-redirect-sandbox.googleusercontent.com"}},
+	}
+	var clients []linkClient
+	for _, client := range candidates {
+		if client.id != "" && client.secret != "" {
+			clients = append(clients, client)
+		}
+	}
+	return clients
+}
+
+func findLinkClient(id string) *linkClient {
+	for _, client := range linkClients() {
+		if client.id == id {
+			return &client
+		}
+	}
+	return nil
+}
+
+// linkToken is an authorization code, access or refresh token.
+type linkToken struct {
+	Kind     string `json:"kind"` // code | access | refresh
+	Client   string `json:"client"`
+	Redirect string `json:"redirect,omitempty"` // the redirect_uri a code was issued for
+	Session
+}
+
+func signLinkToken(t linkToken) string {
+	payload, _ := json.Marshal(t)
+	return signValue("link-"+t.Kind, payload)
+}
+
+func verifyLinkToken(token, kind, client string) (linkToken, bool) {
+	var t linkToken
+	payload, err := verifyValue("link-"+kind, token)
+	if err != nil || json.Unmarshal(payload, &t) != nil {
+		return t, false
+	}
+	return t, t.Kind == kind && t.Client == client && t.Household == household && time.Now().Before(t.Expires)
+}
+
+// linkedSession returns the session an assistant's access token stands for.
+func linkedSession(token, client string) *Session {
+	t, ok := verifyLinkToken(token, "access", client)
+	if !ok {
+		return nil
+	}
+	return &t.Session
+}
+
+func oauthAuthorize(c echo.Context) error {
+	client := findLinkClient(c.QueryParam("client_id"))
+	if client == nil {
+		return apiError(c, http.StatusBadRequest, "unknown client_id")
+	}
+	redirect, err := url.Parse(c.QueryParam("redirect_uri"))
+	if err != nil || redirect.Scheme != "https" || !slices.Contains(client.redirectHosts, redirect.Host) {
+		return apiError(c, http.StatusBadRequest, "redirect_uri is not allowed for this client")
+	}
+	q := redirect.Query()
+	q.Set("state", c.QueryParam("state"))
+	if c.QueryParam("response_type") != "code" {
+		q.Set("error", "unsupported_response_type")
+		redirect.RawQuery = q.Encode()
+		return c.Redirect(http.StatusFound, redirect.String())
+	}
+
+	s := currentSession(c)
+	if s == nil && envBool("AUTH_REQUIRED", false) {
+		if oidc == nil {
+			return apiError(c, http.StatusUnauthorized, "login required")
+		}
+		return c.Redirect(http.StatusFound, "/api/auth/login?return="+url.QueryEscape(c.Request().URL.RequestURI()))
+	}
+	if s == nil {
+		// Without AUTH_REQUIRED everyone on the network is an admin anyway
+		s = &Session{Subject: "home", Role: "admin", Household: household}
+	}
+
+	code := linkToken{Kind: "code", Client: client.name, Redirect: redirect.String(), Session: *s}
+	code.Household = household
+	code.Expires = time.Now().Add(5 * time.Minute)
+	q.Set("code", signLinkToken(code))
+	redirect.RawQuery = q.Encode()
+	return c.Redirect(http.StatusFound, redirect.String())
+}
+
+func oauthToken(c echo.Context) error {
+	id, secret, ok := c.Request().BasicAuth()
+	if !ok {
+		id, secret = c.FormValue("client_id"), c.FormValue("client_secret")
+	}
+	client := findLinkClient(id)
+	if client == nil || subtle.ConstantTimeCompare([]byte(secret), []byte(client.secret)) != 1 {
+		return c.JSON(http.StatusUnauthorized, map[string]string{"error": "invalid_client"})
+	}
+
+	var grant linkToken
+	switch c.FormValue("grant_type") {
+	case "authorization_code":
+		grant, ok = verifyLinkToken(c.FormValue("code"), "code", client.name)
+		ok = ok && grant.Redirect == c.FormValue("redirect_uri")
+	case "refresh_token":
+		grant, ok = verifyLinkToken(c.FormValue("refresh_token"), "refresh", client.name)
+	default:
+		return c.JSON(http.StatusBadRequest, map[string]string{"error": "unsupported_grant_type"})
+	}
+	if !ok {
+		return c.JSON(http.StatusBadRequest, map[string]string{"error": "invalid_grant"})
+	}
+
+	now := time.Now()
+	access, refresh := grant, grant
+	access.Kind, access.Redirect, access.Expires = "access", "", now.Add(time.Hour)
+	refresh.Kind, refresh.Redirect, refresh.Expires = "refresh", "", now.Add(envDuration("LINK_REFRESH_TTL", 365*24*time.Hour))
+	c.Response().Header().Set("Cache-Control", "no-store")
+	return c.JSON(http.StatusOK, map[string]interface{}{
+		"access_token":  signLinkToken(access),
+		"token_type":    "Bearer",
+		"expires_in":    int(time.Hour.Seconds()),
+		"refresh_token": signLinkToken(refresh),
+	})
+}
@@ -1,11 +1,15 @@
 package main
 
 import (
+	"context"
 	"database/sql"
 	"fmt"
 	"log"
+	"maps"
 	"net/http"
 	"os"
+	"os/signal"
+	"syscall"
 	"time"
 
 	"github.com/labstack/echo/v4"
@@ -22,11 +26,24 @@ type Device struct {
 	AlarmActive     bool      `json:"alarm_active"`
 	AlarmActiveTime int64     `json:"alarm_active_time"` // in seconds
 	CurrentTime     int64     `json:"current_time"`      // Unix timestamp for Arduino
+
+	Maintenance MaintenanceState `json:"maintenance"`
+
+	// When a room was last aired, and the whole minutes since
+	LastVentilation         *time.Time `json:"last_ventilation,omitempty"`
+	MinutesSinceVentilation *int       `json:"minutes_since_ventilation,omitempty"`
+
+	// The alarm configuration and what the device acknowledged of it
+	ConfigVersion      string     `json:"config_version"`
+	AckedConfigVersion *string    `json:"acked_config_version"`
+	AckedAt            *time.Time `json:"acked_at"`
+	ConfigPending      bool       `json:"config_pending"` // the device has not acknowledged the current configuration
 }
 
 type AlarmTime struct {
-	Time  string `json:"time"`
-	Armed bool   `json:"armed"`
+	Time       string `json:"time"`
+	Armed      bool   `json:"armed"`
+	Configured bool   `json:"configured"` // false until an alarm has been set
 }
 
 type SensorData struct {
@@ -38,54 +55,286 @@ type SensorData struct {
 var db *sql.DB
 
 func main() {
+	if len(os.Args) > 1 {
+		os.Exit(runCommand(os.Args[1:]))
+	}
+	if names, err := householdList(); err != nil {
+		log.Fatal(err)
+	} else if names != nil {
+		runHouseholds(names)
+		return
+	}
+
+	initTracing()
+	if err := initOIDC(); err != nil {
+		log.Fatal(err)
+	}
 	initDB()
 	createTables()
+	loadSettings()
+	initPresence()
+	initGeofence()
+	initArchive()
+	initIngest()
+	initESPHome()
+	initTTS()
+	initSMS()
+	initHomeKit()
+	initZigbee()
+	initThermostat()
+	initEnergy()
+	initCache()
+	initCluster()
+	initPGNotify()
+	registerJob("weekly_report", "0 8 * * 1", sendWeeklyReport)
+	registerJob("device_liveness", "@every 1m", checkDeviceLiveness)
+	registerJob("retention_prune", "0 4 * * *", pruneExpiredData)
+	registerJob("derived_metrics", "@every 1m", computeScheduledMetrics)
+	registerJob("backup", "off", scheduledBackup)
+	registerJob("stream_check", "@every 5m", checkStreams)
+	registerJob("mold_risk", "@every 15m", checkMoldRisk)
+	registerJob("alarm_preflight", "@every 1m", checkAlarmPreflight)
+	registerJob("alarm_prewake", "@every 1m", startAlarmPrewake)
+	registerJob("alarm_fallback", "@every 15s", checkAlarmFallback)
+	registerJob("command_timeout", "@every 1m", expireCommands)
+	registerJob("rollup_refresh", "@every 15m", refreshRollups)
+	registerJob("noise_report", "off", sendNoiseSummary)
+	registerJob("profile_schedule", "@every 1m", activateScheduledProfiles)
+	registerJob("alarm_profiles", "@every 1m", applyAlarmProfiles)
+	startJobs()
 
 	e := echo.New()
+	e.JSONSerializer = localizedJSON{}
+	e.HTTPErrorHandler = httpErrorHandler
+	extractor, err := clientIPExtractor()
+	if err != nil {
+		log.Fatal(err)
+	}
+	e.IPExtractor = extractor
 
 	// Middleware
 	e.Use(middleware.Logger())
-	e.Use(middleware.Recover())
+	e.Use(traceRequests)
+	e.Use(requestMetrics)
+	e.Use(recoverPanics)
+	e.Use(limitBodies)
 	e.Use(middleware.CORS())
 
 	// API routes
-	api := e.Group("/api")
+	api := e.Group("/api", requireSession)
+	api.GET("/auth/login", oidcLoginStart)
+	api.GET("/auth/callback", oidcCallback)
+	api.GET("/auth/me", getAuthMe)
+	api.POST("/auth/logout", logout)
 	api.GET("/device/status", getDeviceStatus)
 	api.GET("/alarm", getAlarmTime)
 	api.POST("/alarm", setAlarmTime)
+	api.POST("/alarm/validate", validateAlarmTime)
+	api.GET("/stats/http", getHTTPStats)
+	api.GET("/stats/wakeup", getWakeupStats)
+	api.GET("/stats/wakeup/correlation", getWakeupCorrelation)
+	api.GET("/stats/daily", getDailyStats, cacheResponse)
+	api.GET("/stats/heatmap", getHeatmap, cacheResponse)
 	api.GET("/sensor-data", getSensorData)
+	api.DELETE("/sensor-data", deleteSensorData)
+	api.PATCH("/sensor-data", patchSensorData)
+	api.GET("/sensor-data/corrections", getSampleCorrections)
+	api.GET("/sensor-data/chart.png", getSensorChart)
+	api.GET("/sensor-data/chart.svg", getSensorChart)
+	api.GET("/badge/co2.svg", getCO2Badge)
+	api.POST("/sensor-data/corrections/:id/restore", restoreSampleCorrection)
+	api.GET("/sensor-data/trend", getSensorTrend)
+	api.GET("/sensor-data/forecast", getSensorForecast)
+	api.GET("/sensor-data/compare", getSensorCompare, cacheResponse)
+	api.GET("/sensor-data/aggregate", getSensorAggregate)
+	api.GET("/sensor-data/gaps", getSensorGaps)
+	api.GET("/grafana", grafanaTestDatasource)
+	api.POST("/grafana/search", grafanaSearch)
+	api.POST("/grafana/query", grafanaQueryData)
+	api.POST("/grafana/annotations", grafanaAnnotations)
 	api.POST("/device/update", handleDeviceUpdate)
+	api.POST("/device/heartbeat", deviceHeartbeat)
+	api.POST("/device/backfill", postDeviceBackfill)
+	api.POST("/ingest/ttn", ingestTTN)
+	api.POST("/ingest/influx", ingestInflux)
+	api.POST("/ingest/influx/write", ingestInflux)
+	api.POST("/ingest/influx/api/v2/write", ingestInflux)
+	api.GET("/ws", serveEvents)
+	api.GET("/alarm/challenge", getAlarmChallenge)
+	api.POST("/alarm/dismiss", dismissAlarm)
+	api.POST("/alarm/action", alarmAction)
+	api.GET("/alarm/skip", getAlarmSkip)
+	api.POST("/alarm/skip", setAlarmSkip)
+	api.GET("/alarm/preflight", getAlarmPreflight)
+	api.GET("/alarm/routine", getAlarmRoutine)
+	api.GET("/energy/report", getEnergyReport)
+	api.GET("/calendar.ics", getCalendar)
+	api.GET("/thermostat", getThermostat)
+	api.PUT("/thermostat/:room", putThermostatTarget)
+	api.GET("/heating/rules", getHeatingRules)
+	api.POST("/heating/rules", createHeatingRule)
+	api.DELETE("/heating/rules/:id", deleteHeatingRule)
+	api.PUT("/alarm/routine", putAlarmRoutine)
+	api.GET("/alarms/profile", getAlarmProfile)
+	api.PUT("/alarms/profile", putAlarmProfile)
+	api.GET("/alarm/rings", getAlarmRings)
+	api.POST("/alarm/fallback/ack", ackAlarmFallback)
+	api.GET("/alarm/sounds", getAlarmSounds)
+	api.POST("/alarm/sounds", uploadAlarmSound)
+	api.PUT("/alarm/sounds/active", selectAlarmSound)
+	api.GET("/alarm/sounds/:id/file", getAlarmSoundFile)
+	api.DELETE("/alarm/sounds/:id", deleteAlarmSound)
+	api.GET("/device/alarm-sound", getDeviceAlarmSound, requireDeviceKey)
+	api.GET("/alarm/streams", getAlarmStreams)
+	api.POST("/alarm/streams", createAlarmStream)
+	api.PUT("/alarm/streams/active", selectAlarmStream)
+	api.DELETE("/alarm/streams/:id", deleteAlarmStream)
+	api.GET("/briefing", getBriefing)
+	api.GET("/device/briefing", getBriefing, requireDeviceKey)
+	api.GET("/devices", getDevices)
+	api.POST("/devices/provision", provisionDevice)
+	api.POST("/device/claim", claimDevice)
+	api.GET("/devices/:id/calibration", getCalibration)
+	api.PUT("/devices/:id/calibration", putCalibration)
+	api.POST("/devices/:id/recalibrate", recalibrateDevice)
+	api.GET("/devices/:id", getDevice)
+	api.PATCH("/devices/:id", patchDevice)
+	api.GET("/push/key", getPushKey)
+	api.POST("/push/key/rotate", rotatePushKey)
+	api.POST("/push/subscribe", subscribePush)
+	api.POST("/push/unsubscribe", unsubscribePush)
+	api.POST("/push/test", testPush)
+	api.GET("/devices/:id/commands", getDeviceCommands)
+	api.POST("/devices/:id/commands", postDeviceCommand)
+	api.GET("/devices/:id/reporting", getReportingConfig)
+	api.PUT("/devices/:id/reporting", putReportingConfig)
+	api.GET("/device-groups", getDeviceGroups)
+	api.PUT("/device-groups/:name", putDeviceGroup)
+	api.DELETE("/device-groups/:name", deleteDeviceGroup)
+	api.PUT("/device-groups/:name/reporting", putGroupReporting)
+	api.POST("/device-groups/:name/commands", postGroupCommand)
+	api.GET("/device-groups/rollouts/:id", getRollout)
+	api.GET("/dashboards", getDashboards)
+	api.GET("/dashboards/:name", getDashboard)
+	api.PUT("/dashboards/:name", putDashboard)
+	api.DELETE("/dashboards/:name", deleteDashboard)
+	api.GET("/annotations", getAnnotations)
+	api.POST("/annotations", createAnnotation)
+	api.DELETE("/annotations/:id", deleteAnnotation)
+	api.GET("/devices/:id/telemetry", getDeviceTelemetry)
+	api.GET("/devices/:id/reboots", getDeviceReboots)
+	api.GET("/devices/:id/timeline", getDeviceTimeline)
+	api.GET("/devices/:id/logs", getDeviceLogs)
+	api.POST("/devices/:id/logs", postDeviceLogs)
+	api.POST("/device/logs", postDeviceLogsByName)
+	api.GET("/cluster", getCluster)
+	api.GET("/jobs", getJobs)
+	api.POST("/jobs/:name/run", runJob)
+	api.GET("/presence", getPresence)
+	api.GET("/presence/location", getLocations)
+	api.POST("/presence/location", reportLocation)
+	api.POST("/reports/weekly", generateWeeklyReport)
+	api.GET("/reports/noise", getNoiseReport)
+	api.GET("/reports/noise/evidence", getNoiseEvidence)
+	api.GET("/rooms/:room/ventilation", getVentilationSettings)
+	api.PUT("/rooms/:room/ventilation", putVentilationSettings)
+	api.GET("/ventilation-events", getVentilationEvents)
+	api.GET("/rooms/:room/mold-risk", getMoldRisk)
+	api.GET("/settings", getSettings)
+	api.PUT("/settings", putSettings)
+	api.GET("/archive", getArchive)
+	api.GET("/retention", getRetention)
+	api.GET("/metrics/derived", getDerivedMetrics)
+	api.POST("/metrics/derived", createDerivedMetric)
+	api.DELETE("/metrics/derived/:name", deleteDerivedMetric)
+	api.GET("/metrics/units", getMetricUnits)
+	api.PUT("/metrics/units/:metric", putMetricUnit)
+	api.GET("/alerts", getAlerts)
+	api.POST("/alerts/:id/ack", ackAlert)
+	api.GET("/alerts/mute", getMute)
+	api.POST("/alerts/mute", muteAlerts)
+	api.DELETE("/alerts/mute", unmuteAlerts)
+	api.GET("/alerts/routing", getAlertRouting)
+	api.PUT("/alerts/routing", putAlertRouting)
+	api.GET("/profiles", getProfiles)
+	api.PUT("/profiles/:name", putProfile)
+	api.DELETE("/profiles/:name", deleteProfile)
+	api.POST("/profiles/:name/activate", activateProfile)
+	api.GET("/features", getFeatures)
+	api.GET("/display", getDisplay)
+	api.GET("/oauth/authorize", oauthAuthorize)
+	api.POST("/oauth/token", oauthToken)
+	api.POST("/alexa", handleAlexa)
+	api.POST("/google", handleGoogle)
+	api.GET("/homekit", getHomeKit, requireAdmin)
+	api.GET("/version", getVersion)
+	api.GET("/openapi.yaml", getOpenAPI)
+	api.GET("/contract/examples", getContractExamples)
+	api.GET("/language", getLanguage)
+	api.PUT("/language", putLanguage)
+	api.GET("/maintenance", getMaintenance)
+	api.POST("/maintenance", setMaintenance)
+	api.GET("/filters", getMetricFilters)
+	api.PUT("/filters/:metric", putMetricFilter)
+	api.DELETE("/filters/:metric", deleteMetricFilter)
+	api.GET("/storage-policies", getStoragePolicies)
+	api.PUT("/storage-policies/:metric", putStoragePolicy)
+	api.DELETE("/storage-policies/:metric", deleteStoragePolicy)
+	api.GET("/rules", getRules)
+	api.POST("/rules", createRule)
+	api.DELETE("/rules/:id", deleteRule)
 
-	// Serve static files
-	e.Static("/static", "static/static")
+	e.GET("/metrics", getMetrics)
+	e.GET("/status", getPublicStatus)
+	registerPprof(e)
 
-	// Serve other static files from the root of the static directory
-	e.File("/favicon.ico", "static/favicon.ico")
-	e.File("/logo192.png", "static/logo192.png")
-	e.File("/logo512.png", "static/logo512.png")
-	e.File("/manifest.json", "static/manifest.json")
-	e.File("/robots.txt", "static/robots.txt")
+	// Serve the embedded frontend, with index.html for any unmatched routes
+	initStatic()
+	e.GET("/*", serveStatic)
 
-	// Handle SPA routing - serve index.html for any unmatched routes
-	e.GET("/*", func(c echo.Context) error {
-		return c.File("static/index.html")
-	})
-
-	port := ":8080"
+	configureServer(e.Server)
+	port := envString("LISTEN_ADDR", ":8080")
 	log.Printf("Server starting on port %s", port)
-	log.Fatal(e.Start(port))
+	go func() {
+		if err := e.Start(port); err != nil && err != http.ErrServerClosed {
+			log.Fatal(err)
+		}
+	}()
+
+	// Finish in-flight requests and flush buffered readings on shutdown
+	stop := make(chan os.Signal, 1)
+	signal.Notify(stop, os.Interrupt, syscall.SIGTERM)
+	<-stop
+	log.Printf("Shutting down")
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	if err := e.Shutdown(ctx); err != nil {
+		log.Printf("Shutdown: %v", err)
+	}
+	ingest.flush()
 }
 
 func initDB() {
 	var err error
-	dbInfo := fmt.Sprintf("host=%s port=%s user=%s password=%s dbname=%s sslmode=disable",
+	if err = initHousehold(); err != nil {
+		log.Fatal(err)
+	}
+	dbInfo := fmt.Sprintf("host=%s port=%s user=%s password=%s dbname=%s sslmode=disable search_path=%s application_name=%s",
 		os.Getenv("DB_HOST"),
 		os.Getenv("DB_PORT"),
 		os.Getenv("DB_USER"),
 		os.Getenv("DB_PASSWORD"),
-		os.Getenv("DB_NAME"))
+		os.Getenv("DB_NAME"),
+		householdSchema(),
+		pgApplicationName)
+	dbConnInfo = dbInfo
 
-	db, err = sql.Open("postgres", dbInfo)
+	driverName := "postgres"
+	if tracing != nil {
+		sql.Register("postgres-traced", newTracedPostgresDriver())
+		driverName = "postgres-traced"
+	}
+	db, err = sql.Open(driverName, dbInfo)
 	if err != nil {
 		log.Fatal(err)
 	}
@@ -93,6 +342,12 @@ func initDB() {
 	if err = db.Ping(); err != nil {
 		log.Fatal(err)
 	}
+	if household == "" {
+		return
+	}
+	if _, err = db.Exec("CREATE SCHEMA IF NOT EXISTS " + householdSchema()); err != nil {
+		log.Fatal(err)
+	}
 }
 
 func createTables() {
@@ -122,135 +377,812 @@ func createTables() {
 
 		-- Index for faster time-based queries
 		CREATE INDEX IF NOT EXISTS idx_sensor_data_timestamp ON sensor_data(timestamp);
+
+		CREATE TABLE IF NOT EXISTS devices (
+			id SERIAL PRIMARY KEY,
+			name TEXT NOT NULL UNIQUE,
+			room TEXT NOT NULL DEFAULT ''
+		);
+
+		ALTER TABLE device_status ADD COLUMN IF NOT EXISTS device_id INTEGER REFERENCES devices(id);
+		ALTER TABLE sensor_data ADD COLUMN IF NOT EXISTS device_id INTEGER REFERENCES devices(id);
+
+		CREATE TABLE IF NOT EXISTS ventilation_settings (
+			room TEXT PRIMARY KEY,
+			enabled BOOLEAN NOT NULL DEFAULT true,
+			soft_threshold FLOAT NOT NULL,
+			clear_threshold FLOAT NOT NULL,
+			min_slope FLOAT NOT NULL,
+			rising_minutes INTEGER NOT NULL,
+			reminder_minutes INTEGER NOT NULL
+		);
+
+		CREATE TABLE IF NOT EXISTS ventilation_events (
+			id BIGSERIAL PRIMARY KEY,
+			room TEXT NOT NULL,
+			started_at TIMESTAMP NOT NULL,
+			ended_at TIMESTAMP NOT NULL,
+			co2_start FLOAT NOT NULL,
+			co2_end FLOAT NOT NULL,
+			temperature_drop FLOAT,
+			source TEXT NOT NULL
+		);
+		CREATE INDEX IF NOT EXISTS ventilation_events_started_at ON ventilation_events (started_at);
+
+		CREATE TABLE IF NOT EXISTS settings (
+			key TEXT PRIMARY KEY,
+			value TEXT NOT NULL,
+			updated_at TIMESTAMP NOT NULL
+		);
+
+		CREATE TABLE IF NOT EXISTS rules (
+			id SERIAL PRIMARY KEY,
+			name TEXT NOT NULL,
+			metric TEXT NOT NULL,
+			operator TEXT NOT NULL,
+			threshold FLOAT NOT NULL,
+			presence TEXT NOT NULL DEFAULT 'any',
+			cooldown_seconds INTEGER NOT NULL DEFAULT 1800,
+			enabled BOOLEAN NOT NULL DEFAULT true
+		);
+
+		CREATE TABLE IF NOT EXISTS person_locations (
+			person TEXT PRIMARY KEY,
+			lat FLOAT NOT NULL,
+			lon FLOAT NOT NULL,
+			accuracy FLOAT NOT NULL DEFAULT 0,
+			reported_at TIMESTAMP NOT NULL
+		);
+
+		CREATE TABLE IF NOT EXISTS alarm_skips (
+			alarm_date DATE PRIMARY KEY,
+			skip BOOLEAN NOT NULL,
+			reason TEXT NOT NULL DEFAULT '',
+			manual BOOLEAN NOT NULL DEFAULT false,
+			updated_at TIMESTAMP NOT NULL
+		);
+
+		CREATE TABLE IF NOT EXISTS archive_manifest (
+			id SERIAL PRIMARY KEY,
+			source TEXT NOT NULL,
+			day DATE NOT NULL,
+			bucket TEXT NOT NULL,
+			object_key TEXT NOT NULL,
+			rows INTEGER NOT NULL,
+			bytes BIGINT NOT NULL,
+			sha256 TEXT NOT NULL,
+			created_at TIMESTAMP NOT NULL
+		);
+
+		-- Parts written before archiving stopped deleting rows have no max_id:
+		-- their rows are gone, what is left of the day was never archived.
+		ALTER TABLE archive_manifest ADD COLUMN IF NOT EXISTS max_id INTEGER;
+
+		ALTER TABLE devices ADD COLUMN IF NOT EXISTS last_seen TIMESTAMP;
+		ALTER TABLE devices ADD COLUMN IF NOT EXISTS config_version TEXT;
+		ALTER TABLE devices ADD COLUMN IF NOT EXISTS config_reported_at TIMESTAMP;
+		ALTER TABLE devices ADD COLUMN IF NOT EXISTS clock_offset_seconds BIGINT;
+		ALTER TABLE devices ADD COLUMN IF NOT EXISTS config_acked_version TEXT;
+		ALTER TABLE devices ADD COLUMN IF NOT EXISTS config_acked_at TIMESTAMP;
+		ALTER TABLE devices ADD COLUMN IF NOT EXISTS mac TEXT UNIQUE;
+		ALTER TABLE devices ADD COLUMN IF NOT EXISTS api_key_hash TEXT;
+		ALTER TABLE devices ADD COLUMN IF NOT EXISTS timezone TEXT;
+		ALTER TABLE devices ADD COLUMN IF NOT EXISTS latitude FLOAT;
+		ALTER TABLE devices ADD COLUMN IF NOT EXISTS longitude FLOAT;
+		ALTER TABLE devices ADD COLUMN IF NOT EXISTS floor INTEGER;
+		ALTER TABLE devices ADD COLUMN IF NOT EXISTS notes TEXT;
+
+		CREATE TABLE IF NOT EXISTS device_pairing_codes (
+			code_hash TEXT PRIMARY KEY,
+			name TEXT NOT NULL DEFAULT '',
+			room TEXT NOT NULL DEFAULT '',
+			expires_at TIMESTAMP NOT NULL
+		);
+		ALTER TABLE rules ADD COLUMN IF NOT EXISTS priority INTEGER NOT NULL DEFAULT 3;
+		ALTER TABLE rules ADD COLUMN IF NOT EXISTS channels TEXT NOT NULL DEFAULT '';
+		ALTER TABLE rules ADD COLUMN IF NOT EXISTS also_metric TEXT NOT NULL DEFAULT '';
+		ALTER TABLE rules ADD COLUMN IF NOT EXISTS also_operator TEXT NOT NULL DEFAULT '';
+		ALTER TABLE rules ADD COLUMN IF NOT EXISTS also_threshold FLOAT NOT NULL DEFAULT 0;
+
+		ALTER TABLE sensor_data ADD COLUMN IF NOT EXISTS co2_raw FLOAT;
+		ALTER TABLE sensor_data ADD COLUMN IF NOT EXISTS sound_raw FLOAT;
+
+		CREATE TABLE IF NOT EXISTS device_calibrations (
+			device_id INTEGER NOT NULL REFERENCES devices(id),
+			metric TEXT NOT NULL,
+			offset_value FLOAT NOT NULL DEFAULT 0,
+			scale FLOAT NOT NULL DEFAULT 1,
+			updated_at TIMESTAMP NOT NULL,
+			PRIMARY KEY (device_id, metric)
+		);
+		ALTER TABLE device_calibrations ADD COLUMN IF NOT EXISTS curve JSONB;
+
+		CREATE TABLE IF NOT EXISTS metric_units (
+			metric TEXT PRIMARY KEY,
+			unit TEXT NOT NULL,
+			updated_at TIMESTAMP NOT NULL
+		);
+
+		CREATE TABLE IF NOT EXISTS derived_metrics (
+			name TEXT PRIMARY KEY,
+			kind TEXT NOT NULL,
+			source TEXT NOT NULL,
+			window_seconds INTEGER NOT NULL DEFAULT 0,
+			threshold FLOAT NOT NULL DEFAULT 0,
+			compute TEXT NOT NULL DEFAULT 'ingest'
+		);
+
+		CREATE TABLE IF NOT EXISTS metric_samples (
+			id SERIAL PRIMARY KEY,
+			metric TEXT NOT NULL,
+			device_id INTEGER REFERENCES devices(id),
+			timestamp TIMESTAMP NOT NULL,
+			value FLOAT NOT NULL
+		);
+
+		CREATE INDEX IF NOT EXISTS idx_metric_samples_metric_timestamp ON metric_samples(metric, timestamp);
+
+		CREATE TABLE IF NOT EXISTS alerts (
+			id SERIAL PRIMARY KEY,
+			rule_id INTEGER REFERENCES rules(id) ON DELETE SET NULL,
+			rule_name TEXT NOT NULL,
+			metric TEXT NOT NULL,
+			state TEXT NOT NULL,
+			value FLOAT NOT NULL,
+			peak_value FLOAT NOT NULL,
+			fired_at TIMESTAMP NOT NULL,
+			acknowledged_at TIMESTAMP,
+			resolved_at TIMESTAMP,
+			last_notified_at TIMESTAMP NOT NULL,
+			notifications INTEGER NOT NULL DEFAULT 0
+		);
+
+		ALTER TABLE alerts ADD COLUMN IF NOT EXISTS room TEXT NOT NULL DEFAULT '';
+		DROP INDEX IF EXISTS idx_alerts_open_rule;
+		CREATE UNIQUE INDEX IF NOT EXISTS idx_alerts_open_rule_room ON alerts(rule_id, room) WHERE state != 'resolved';
+
+		CREATE TABLE IF NOT EXISTS device_commands (
+			id SERIAL PRIMARY KEY,
+			device_id INTEGER NOT NULL REFERENCES devices(id),
+			command TEXT NOT NULL,
+			args JSONB,
+			created_at TIMESTAMP NOT NULL,
+			delivered_at TIMESTAMP
+		);
+
+		ALTER TABLE device_commands ADD COLUMN IF NOT EXISTS status TEXT NOT NULL DEFAULT 'queued';
+		ALTER TABLE device_commands ADD COLUMN IF NOT EXISTS error TEXT;
+		ALTER TABLE device_commands ADD COLUMN IF NOT EXISTS completed_at TIMESTAMP;
+		UPDATE device_commands SET status = 'delivered' WHERE status = 'queued' AND delivered_at IS NOT NULL;
+
+		CREATE TABLE IF NOT EXISTS device_groups (
+			name TEXT PRIMARY KEY
+		);
+		CREATE TABLE IF NOT EXISTS device_group_members (
+			group_name TEXT NOT NULL REFERENCES device_groups(name) ON DELETE CASCADE,
+			device_id INTEGER NOT NULL REFERENCES devices(id) ON DELETE CASCADE,
+			PRIMARY KEY (group_name, device_id)
+		);
+		CREATE TABLE IF NOT EXISTS command_rollouts (
+			id SERIAL PRIMARY KEY,
+			group_name TEXT NOT NULL,
+			command TEXT NOT NULL,
+			args JSONB,
+			stagger_seconds INTEGER NOT NULL,
+			halt_on_failure BOOLEAN NOT NULL,
+			created_at TIMESTAMP NOT NULL
+		);
+		ALTER TABLE device_commands ADD COLUMN IF NOT EXISTS not_before TIMESTAMP;
+		ALTER TABLE device_commands ADD COLUMN IF NOT EXISTS rollout_id INTEGER REFERENCES command_rollouts(id) ON DELETE SET NULL;
+
+		CREATE TABLE IF NOT EXISTS alarm_sounds (
+			id SERIAL PRIMARY KEY,
+			name TEXT NOT NULL,
+			content_type TEXT NOT NULL,
+			size BIGINT NOT NULL,
+			sha256 TEXT NOT NULL,
+			active BOOLEAN NOT NULL DEFAULT false,
+			created_at TIMESTAMP NOT NULL DEFAULT NOW()
+		);
+
+		CREATE UNIQUE INDEX IF NOT EXISTS idx_alarm_sounds_active ON alarm_sounds(active) WHERE active;
+
+		CREATE TABLE IF NOT EXISTS alarm_streams (
+			id SERIAL PRIMARY KEY,
+			name TEXT NOT NULL,
+			url TEXT NOT NULL,
+			active BOOLEAN NOT NULL DEFAULT false,
+			reachable BOOLEAN,
+			last_error TEXT,
+			last_checked TIMESTAMP
+		);
+
+		CREATE TABLE IF NOT EXISTS heating_rules (
+			id SERIAL PRIMARY KEY,
+			room TEXT NOT NULL,
+			below FLOAT NOT NULL,
+			lead_minutes INTEGER NOT NULL,
+			target FLOAT NOT NULL,
+			boost_minutes INTEGER NOT NULL,
+			enabled BOOLEAN NOT NULL DEFAULT true,
+			checked_alarm TIMESTAMP,
+			boosted_at TIMESTAMP
+		);
+
+		CREATE TABLE IF NOT EXISTS alarm_routine (
+			id SERIAL PRIMARY KEY,
+			enabled BOOLEAN NOT NULL,
+			lead_minutes INTEGER NOT NULL,
+			steps JSONB NOT NULL,
+			updated_at TIMESTAMP NOT NULL
+		);
+
+		CREATE UNIQUE INDEX IF NOT EXISTS idx_alarm_streams_active ON alarm_streams(active) WHERE active;
+
+		CREATE TABLE IF NOT EXISTS device_logs (
+			id BIGSERIAL PRIMARY KEY,
+			device_id INTEGER NOT NULL REFERENCES devices(id),
+			level TEXT NOT NULL,
+			message TEXT NOT NULL,
+			device_time TIMESTAMP,
+			received_at TIMESTAMP NOT NULL
+		);
+
+		CREATE INDEX IF NOT EXISTS idx_device_logs_device ON device_logs(device_id, received_at);
+
+		CREATE TABLE IF NOT EXISTS alarm_rings (
+			id SERIAL PRIMARY KEY,
+			started_at TIMESTAMP NOT NULL,
+			ended_at TIMESTAMP,
+			ring_seconds BIGINT,
+			outcome TEXT NOT NULL
+		);
+
+		ALTER TABLE alarm_rings ADD COLUMN IF NOT EXISTS dismissed BOOLEAN NOT NULL DEFAULT false;
+		ALTER TABLE alarm_rings ADD COLUMN IF NOT EXISTS snoozed BOOLEAN NOT NULL DEFAULT false;
+		ALTER TABLE alarm_rings ADD COLUMN IF NOT EXISTS unattended BOOLEAN NOT NULL DEFAULT false;
+		ALTER TABLE alarm_rings ADD COLUMN IF NOT EXISTS challenge_id TEXT;
+		ALTER TABLE alarm_rings ADD COLUMN IF NOT EXISTS challenge_question TEXT;
+		ALTER TABLE alarm_rings ADD COLUMN IF NOT EXISTS challenge_answer INTEGER;
+		-- Rings left open by a server that stopped before the device did
+		UPDATE alarm_rings SET ended_at = started_at, outcome = 'stopped' WHERE ended_at IS NULL AND started_at < LOCALTIMESTAMP - INTERVAL '1 day';
+
+		CREATE TABLE IF NOT EXISTS alarm_fallbacks (
+			alarm_at TIMESTAMP PRIMARY KEY,
+			sent INTEGER NOT NULL DEFAULT 0,
+			last_at TIMESTAMP,
+			stopped BOOLEAN NOT NULL DEFAULT false
+		);
+
+		CREATE TABLE IF NOT EXISTS alarm_preflights (
+			alarm_at TIMESTAMP PRIMARY KEY,
+			result JSONB NOT NULL
+		);
+
+		CREATE TABLE IF NOT EXISTS device_reboots (
+			id SERIAL PRIMARY KEY,
+			device_id INTEGER NOT NULL REFERENCES devices(id),
+			at TIMESTAMP NOT NULL,
+			uptime_before FLOAT NOT NULL,
+			expected BOOLEAN NOT NULL,
+			reason TEXT
+		);
+
+		CREATE INDEX IF NOT EXISTS idx_device_reboots_device ON device_reboots(device_id, at);
+
+		CREATE TABLE IF NOT EXISTS device_reporting (
+			device_id INTEGER PRIMARY KEY REFERENCES devices(id),
+			report_interval_seconds INTEGER NOT NULL,
+			sample_interval_seconds INTEGER NOT NULL,
+			fast_interval_seconds INTEGER NOT NULL,
+			fast_metric TEXT NOT NULL,
+			fast_above FLOAT NOT NULL
+		);
+
+		CREATE TABLE IF NOT EXISTS sample_rejections (
+			device_id INTEGER NOT NULL REFERENCES devices(id),
+			reason TEXT NOT NULL,
+			count BIGINT NOT NULL,
+			last_at TIMESTAMP NOT NULL,
+			PRIMARY KEY (device_id, reason)
+		);
+
+		-- One sample per device, metric and time; duplicates stored before
+		-- the constraint existed are removed once
+		DO $$
+		BEGIN
+			IF NOT EXISTS (SELECT 1 FROM pg_indexes WHERE schemaname = current_schema() AND indexname = 'uq_sensor_data_device_timestamp') THEN
+				DELETE FROM sensor_data a USING sensor_data b
+				WHERE a.id > b.id AND a.device_id = b.device_id AND a.timestamp = b.timestamp;
+				CREATE UNIQUE INDEX uq_sensor_data_device_timestamp ON sensor_data(device_id, timestamp);
+			END IF;
+			IF NOT EXISTS (SELECT 1 FROM pg_indexes WHERE schemaname = current_schema() AND indexname = 'uq_metric_samples_device_metric_timestamp') THEN
+				DELETE FROM metric_samples a USING metric_samples b
+				WHERE a.id > b.id AND a.device_id = b.device_id AND a.metric = b.metric AND a.timestamp = b.timestamp;
+				CREATE UNIQUE INDEX uq_metric_samples_device_metric_timestamp ON metric_samples(device_id, metric, timestamp);
+			END IF;
+		END $$;
+
+		CREATE TABLE IF NOT EXISTS sample_corrections (
+			id SERIAL PRIMARY KEY,
+			action TEXT NOT NULL,
+			metric TEXT NOT NULL,
+			device_id INTEGER REFERENCES devices(id),
+			from_ts TIMESTAMP NOT NULL,
+			to_ts TIMESTAMP NOT NULL,
+			above FLOAT,
+			reason TEXT,
+			samples BIGINT NOT NULL,
+			created_by TEXT NOT NULL,
+			created_at TIMESTAMP NOT NULL,
+			restored_at TIMESTAMP
+		);
+
+		CREATE TABLE IF NOT EXISTS corrected_samples (
+			correction_id INTEGER NOT NULL REFERENCES sample_corrections(id),
+			sample_id INTEGER NOT NULL,
+			device_id INTEGER,
+			timestamp TIMESTAMP NOT NULL,
+			value FLOAT NOT NULL
+		);
+
+		CREATE INDEX IF NOT EXISTS idx_corrected_samples_correction ON corrected_samples(correction_id);
+
+		CREATE TABLE IF NOT EXISTS metric_filters (
+			metric TEXT PRIMARY KEY,
+			kind TEXT NOT NULL,
+			window_size INTEGER NOT NULL,
+			max_jump_pct FLOAT NOT NULL
+		);
+
+		CREATE TABLE IF NOT EXISTS dashboards (
+			owner TEXT NOT NULL,
+			name TEXT NOT NULL,
+			owner_name TEXT NOT NULL DEFAULT '',
+			layout JSONB NOT NULL,
+			shared BOOLEAN NOT NULL DEFAULT false,
+			updated_at TIMESTAMP NOT NULL,
+			PRIMARY KEY (owner, name)
+		);
+
+		CREATE TABLE IF NOT EXISTS annotations (
+			id SERIAL PRIMARY KEY,
+			time TIMESTAMP NOT NULL,
+			time_end TIMESTAMP,
+			text TEXT NOT NULL,
+			tags JSONB NOT NULL DEFAULT '[]',
+			created_by TEXT NOT NULL
+		);
+
+		CREATE INDEX IF NOT EXISTS idx_annotations_time ON annotations(time);
+
+		CREATE MATERIALIZED VIEW IF NOT EXISTS metric_hourly AS
+			SELECT date_trunc('hour', s.timestamp) AS hour, COALESCE(d.room, '') AS room, s.metric,
+				COUNT(*) AS samples, SUM(s.value) AS total, MIN(s.value) AS min, MAX(s.value) AS max
+			FROM (
+				SELECT timestamp, device_id, 'co2' AS metric, co2_level AS value FROM sensor_data WHERE co2_level != 0
+				UNION ALL
+				SELECT timestamp, device_id, 'sound', sound_level FROM sensor_data WHERE sound_level != 0
+				UNION ALL
+				SELECT timestamp, device_id, metric, value FROM metric_samples
+			) s LEFT JOIN devices d ON d.id = s.device_id
+			GROUP BY 1, 2, 3;
+
+		CREATE UNIQUE INDEX IF NOT EXISTS idx_metric_hourly ON metric_hourly(metric, hour, room);
+
+		CREATE MATERIALIZED VIEW IF NOT EXISTS metric_daily AS
+			SELECT hour::date AS day, room, metric,
+				SUM(samples) AS samples, SUM(total) AS total, MIN(min) AS min, MAX(max) AS max
+			FROM metric_hourly
+			GROUP BY 1, 2, 3;
+
+		CREATE UNIQUE INDEX IF NOT EXISTS idx_metric_daily ON metric_daily(metric, day, room);
+
+		CREATE TABLE IF NOT EXISTS rollup_state (
+			name TEXT PRIMARY KEY,
+			refreshed_until TIMESTAMP NOT NULL,
+			refreshed_at TIMESTAMP NOT NULL
+		);
+
+		CREATE TABLE IF NOT EXISTS web_push_keys (
+			id INTEGER PRIMARY KEY,
+			private_key TEXT NOT NULL,
+			created_at TIMESTAMP NOT NULL DEFAULT NOW()
+		);
+
+		CREATE TABLE IF NOT EXISTS push_subscriptions (
+			id SERIAL PRIMARY KEY,
+			endpoint TEXT NOT NULL UNIQUE,
+			p256dh TEXT NOT NULL,
+			auth TEXT NOT NULL,
+			subject TEXT,
+			user_agent TEXT,
+			created_at TIMESTAMP NOT NULL DEFAULT NOW(),
+			last_sent TIMESTAMP
+		);
+
+		CREATE TABLE IF NOT EXISTS backfill_requests (
+			id SERIAL PRIMARY KEY,
+			device_id INTEGER NOT NULL REFERENCES devices(id),
+			gap_from TIMESTAMP NOT NULL,
+			gap_to TIMESTAMP NOT NULL,
+			status TEXT NOT NULL DEFAULT 'requested',
+			requested_at TIMESTAMP NOT NULL DEFAULT NOW(),
+			resolved_at TIMESTAMP,
+			samples INTEGER,
+			UNIQUE (device_id, gap_from)
+		);
+
+		CREATE TABLE IF NOT EXISTS alert_routing (
+			id SERIAL PRIMARY KEY,
+			routes JSONB NOT NULL,
+			updated_at TIMESTAMP NOT NULL
+		);
+
+		CREATE TABLE IF NOT EXISTS notification_digest (
+			id SERIAL PRIMARY KEY,
+			at TIMESTAMP NOT NULL,
+			event TEXT NOT NULL,
+			severity TEXT NOT NULL,
+			title TEXT NOT NULL,
+			message TEXT NOT NULL
+		);
+		CREATE INDEX IF NOT EXISTS idx_notification_digest_at ON notification_digest(at);
+
+		CREATE TABLE IF NOT EXISTS profiles (
+			name TEXT PRIMARY KEY,
+			settings JSONB NOT NULL,
+			alarm_armed BOOLEAN,
+			routes JSONB,
+			schedule TEXT NOT NULL DEFAULT '',
+			updated_at TIMESTAMP NOT NULL
+		);
+
+		CREATE TABLE IF NOT EXISTS profile_activations (
+			id SERIAL PRIMARY KEY,
+			profile TEXT NOT NULL,
+			at TIMESTAMP NOT NULL,
+			source TEXT NOT NULL
+		);
+
+		CREATE TABLE IF NOT EXISTS alarm_profiles (
+			id SERIAL PRIMARY KEY,
+			profiles JSONB NOT NULL,
+			updated_at TIMESTAMP NOT NULL
+		);
+
+		CREATE TABLE IF NOT EXISTS alarm_profile_changes (
+			id SERIAL PRIMARY KEY,
+			profile TEXT NOT NULL,
+			at TIMESTAMP NOT NULL
+		);
+
+		CREATE TABLE IF NOT EXISTS metric_storage_policies (
+			metric TEXT PRIMARY KEY,
+			delta FLOAT NOT NULL,
+			max_interval_seconds INTEGER NOT NULL
+		);
+
+		CREATE TABLE IF NOT EXISTS schema_version (
+			version INTEGER PRIMARY KEY,
+			applied_at TIMESTAMP NOT NULL
+		);
 	`)
 	if err != nil {
 		log.Fatal(err)
 	}
+	if err := recordSchemaVersion(); err != nil {
+		log.Fatal(err)
+	}
 }
 
 func getDeviceStatus(c echo.Context) error {
 	var device Device
-	err := db.QueryRow(`
-		SELECT id, last_seen, error_code, co2_level, sound_level, alarm_active, alarm_active_time 
-		FROM device_status 
-		ORDER BY last_seen DESC LIMIT 1
+	ctx := c.Request().Context()
+	err := db.QueryRowContext(ctx, `
+		SELECT s.id, GREATEST(s.last_seen, d.last_seen), s.error_code, s.co2_level, s.sound_level, s.alarm_active, s.alarm_active_time,
+			d.config_acked_version, d.config_acked_at
+		FROM device_status s LEFT JOIN devices d ON d.id = s.device_id
+		ORDER BY s.last_seen DESC LIMIT 1
 	`).Scan(&device.ID, &device.LastSeen, &device.ErrorCode, &device.CO2Level,
-		&device.SoundLevel, &device.AlarmActive, &device.AlarmActiveTime)
+		&device.SoundLevel, &device.AlarmActive, &device.AlarmActiveTime, &device.AckedConfigVersion, &device.AckedAt)
 
-	if err != nil && err != sql.ErrNoRows {
-		return c.JSON(http.StatusInternalServerError, map[string]string{"error": err.Error()})
+	if err == sql.ErrNoRows {
+		return apiErrorCode(c, http.StatusNotFound, codeDeviceNotFound, "no device has reported yet")
+	}
+	if err != nil {
+		return internalError(c, err)
+	}
+	cfg, err := currentDeviceConfig(ctx, time.Now())
+	if err != nil {
+		return internalError(c, err)
 	}
+	device.ConfigVersion = cfg.version()
+	device.ConfigPending = device.AckedConfigVersion == nil || *device.AckedConfigVersion != device.ConfigVersion
 
 	// Add current time to response
 	device.CurrentTime = time.Now().Unix()
+	device.Maintenance = currentMaintenance()
+	if device.LastVentilation, err = lastVentilation(ctx); err != nil {
+		return internalError(c, err)
+	}
+	if device.LastVentilation != nil {
+		minutes := int(time.Since(*device.LastVentilation).Minutes())
+		device.MinutesSinceVentilation = &minutes
+	}
 
 	return c.JSON(http.StatusOK, device)
 }
 
 type DeviceUpdate struct {
+	Device          string  `json:"device"`
+	Seq             *uint64 `json:"seq,omitempty"`     // optional, for deduplicating retries
+	BootID          string  `json:"boot_id,omitempty"` // chosen at every boot, seq is only used with it
+	ConfigVersion   string  `json:"config_version"`    // the configuration the device holds
+	ConfigAck       string  `json:"config_ack"`        // the configuration it has applied
+	DeviceTime      *int64  `json:"device_time"`       // the device clock, unix seconds
 	ErrorCode       *string `json:"error_code"`
 	CO2Level        float64 `json:"co2_level"`
 	SoundLevel      float64 `json:"sound_level"`
 	AlarmActive     bool    `json:"alarm_active"`
 	AlarmActiveTime int64   `json:"alarm_active_time"`
+
+	RSSI          *float64 `json:"rssi,omitempty"`
+	BatteryPct    *float64 `json:"battery_pct,omitempty"`
+	FreeHeap      *float64 `json:"free_heap,omitempty"`
+	UptimeSeconds *float64 `json:"uptime_seconds,omitempty"`
+	ResetReason   string   `json:"reset_reason,omitempty"` // e.g. "ota", "watchdog", "brownout"
+
+	CommandResults []CommandResult `json:"command_results,omitempty"`
+
+	// Readings buffered while the device could not report, oldest first
+	Samples []BufferedSample `json:"samples,omitempty"`
+	// How far back the device's local buffer reaches, to ask for gaps
+	BufferSeconds int64 `json:"buffer_seconds,omitempty"`
+}
+
+// DeviceUpdateResponse answers an update with the current time and the
+// configuration. A device that already holds the current configuration
+// gets it left out, with "unchanged": true.
+type DeviceUpdateResponse struct {
+	Time            *string           `json:"time,omitempty"`
+	Armed           *bool             `json:"armed,omitempty"`
+	AlarmConfigured *bool             `json:"alarm_configured,omitempty"`
+	Sound           *string           `json:"sound,omitempty"`
+	Stream          *string           `json:"stream,omitempty"`
+	StreamFallback  *string           `json:"stream_fallback,omitempty"`
+	Unchanged       bool              `json:"unchanged,omitempty"`
+	ConfigVersion   string            `json:"config_version"`
+	CurrentTime     int64             `json:"current_time"`
+	StopAlarm       bool              `json:"stop_alarm"`
+	SnoozeSeconds   int64             `json:"snooze_seconds,omitempty"`
+	ReportInterval  int               `json:"report_interval"`
+	SampleInterval  int               `json:"sample_interval"`
+	CO2Band         string            `json:"co2_band"` // green | yellow | red | unknown, for the reading just sent
+	CO2Bands        *CO2Bands         `json:"co2_bands,omitempty"`
+	Commands        []DeviceCommand   `json:"commands,omitempty"`
+	Backfill        []BackfillRequest `json:"backfill,omitempty"`
 }
 
 func handleDeviceUpdate(c echo.Context) error {
 	var update DeviceUpdate
 	if err := c.Bind(&update); err != nil {
-		return c.JSON(http.StatusBadRequest, map[string]string{"error": err.Error()})
+		return invalidBody(c, err)
 	}
 
-	// Start a transaction
-	tx, err := db.Begin()
+	ctx := c.Request().Context()
+	spanFromContext(ctx).SetAttr("device.name", update.Device)
+
+	if !deviceKeyValid(c, update.Device) {
+		return deviceKeyError(c)
+	}
+	device, err := deviceByName(update.Device)
 	if err != nil {
-		return c.JSON(http.StatusInternalServerError, map[string]string{"error": err.Error()})
+		return internalError(c, err)
+	}
+
+	// A retried update gets the original response instead of being stored twice
+	if key := idempotencyKey(c, device.ID, update); key != "" {
+		replayed, finish, err := beginIdempotent(c, key)
+		if replayed {
+			return err
+		}
+		defer finish()
+	}
+	if err := recordDeviceSync(ctx, device.ID, update.ConfigVersion, update.ConfigAck, update.DeviceTime, time.Now()); err != nil {
+		return internalError(c, err)
+	}
+	if err := ackCommands(ctx, device.ID, update.CommandResults); err != nil {
+		return internalError(c, err)
 	}
-	defer tx.Rollback()
 
-	// Insert device status
-	_, err = tx.Exec(`
-		INSERT INTO device_status 
-		(last_seen, error_code, co2_level, sound_level, alarm_active, alarm_active_time)
-		VALUES ($1, $2, $3, $4, $5, $6)
-	`, time.Now(), update.ErrorCode, update.CO2Level, update.SoundLevel,
-		update.AlarmActive, update.AlarmActiveTime)
+	// Everything downstream sees calibrated values; the raw ones are kept
+	cals, err := loadCalibration(device.ID)
 	if err != nil {
-		return c.JSON(http.StatusInternalServerError, map[string]string{"error": err.Error()})
+		return internalError(c, err)
 	}
+	rawCO2, rawSound := update.CO2Level, update.SoundLevel
+	update.CO2Level = calibrate(cals, "co2", rawCO2)
+	update.SoundLevel = calibrate(cals, "sound", rawSound)
+	telemetry := update.telemetry()
 
-	// Insert sensor data
-	_, err = tx.Exec(`
-		INSERT INTO sensor_data (timestamp, co2_level, sound_level)
-		VALUES ($1, $2, $3)
-	`, time.Now(), update.CO2Level, update.SoundLevel)
+	// Filtered readings are what gets stored and alerted on. A rejected spike
+	// is left out: it is stored as "no reading" (0) next to a metric that
+	// was kept, not stored at all when both were dropped, and never published
+	// or checked against the rules.
+	readings := presentReadings(map[string]float64{"co2": update.CO2Level, "sound": update.SoundLevel})
+	measured := len(readings) > 0
+	for _, values := range []map[string]float64{readings, telemetry} {
+		spikes, err := applyFilters(device.ID, values)
+		if err != nil {
+			return internalError(c, err)
+		}
+		recordRejectedSamples(ctx, device.ID, "spike", spikes)
+	}
+	update.CO2Level, update.SoundLevel = readings["co2"], readings["sound"]
+
+	// Store device status and sensor data, possibly batched
+	now := time.Now()
+	if len(update.Samples) > 0 {
+		err := storeBufferedSamples(ctx, device.ID, cals, update.Samples, clockOffset(update.DeviceTime, now), now)
+		if err != nil {
+			return internalError(c, err)
+		}
+	}
+	err = storeReading(ctx, reading{
+		deviceID:        device.ID,
+		at:              now,
+		errorCode:       update.ErrorCode,
+		co2:             update.CO2Level,
+		sound:           update.SoundLevel,
+		co2Raw:          rawCO2,
+		soundRaw:        rawSound,
+		alarmActive:     update.AlarmActive,
+		alarmActiveTime: update.AlarmActiveTime,
+		statusOnly:      measured && len(readings) == 0,
+	})
 	if err != nil {
-		return c.JSON(http.StatusInternalServerError, map[string]string{"error": err.Error()})
+		return internalError(c, err)
+	}
+	if update.UptimeSeconds != nil {
+		if err := detectReboot(ctx, device, *update.UptimeSeconds, update.ResetReason, now); err != nil {
+			log.Printf("Reboot detection failed for %s: %v", device.Name, err)
+		}
+	}
+	if err := storeMetricSamples(ctx, device.ID, telemetry, now); err != nil {
+		return internalError(c, err)
 	}
 
-	if err = tx.Commit(); err != nil {
-		return c.JSON(http.StatusInternalServerError, map[string]string{"error": err.Error()})
+	event := map[string]interface{}{
+		"device":       device.Name,
+		"room":         device.Room,
+		"alarm_active": update.AlarmActive,
+		"error_code":   update.ErrorCode,
 	}
+	if co2, ok := readings["co2"]; ok {
+		event["co2_level"] = co2
+	}
+	if sound, ok := readings["sound"]; ok {
+		event["sound_level"] = sound
+	}
+	publish(EventSensorUpdate, event)
+	go func(readings map[string]float64) {
+		for name, v := range computeDerivedMetrics(device.ID, "ingest", time.Now()) {
+			readings[name] = v
+		}
+		for name, v := range telemetry {
+			readings[name] = v
+		}
+		evaluateRules(device.Room, withRoomSensors(device.Room, readings))
+	}(maps.Clone(readings))
+	go checkVentilation(device.Room, update.CO2Level)
+	go trackVentilation(device.Room, update.CO2Level)
+
+	stopAlarm, snooze := observeRing(update.AlarmActive, update.AlarmActiveTime)
 
 	// Return current alarm configuration
-	var alarmTime AlarmTime
-	err = db.QueryRow("SELECT time, armed FROM alarm_time ORDER BY id DESC LIMIT 1").
-		Scan(&alarmTime.Time, &alarmTime.Armed)
-	if err != nil && err != sql.ErrNoRows {
-		return c.JSON(http.StatusInternalServerError, map[string]string{"error": err.Error()})
+	cfg, err := currentDeviceConfig(ctx, time.Now())
+	if err != nil {
+		return internalError(c, err)
 	}
 
-	// Create response with current time
-	response := struct {
-		Time        string `json:"time"`
-		Armed       bool   `json:"armed"`
-		CurrentTime int64  `json:"current_time"`
-	}{
-		Time:        alarmTime.Time,
-		Armed:       alarmTime.Armed,
-		CurrentTime: time.Now().Unix(),
+	commands, err := takePendingCommands(device.ID)
+	if err != nil {
+		return internalError(c, err)
 	}
 
-	return c.JSON(http.StatusOK, response)
-}
+	reporting, err := loadReportingConfig(device.ID)
+	if err != nil {
+		return internalError(c, err)
+	}
 
-func getAlarmTime(c echo.Context) error {
-	var alarmTime AlarmTime
-	err := db.QueryRow("SELECT time, armed FROM alarm_time ORDER BY id DESC LIMIT 1").
-		Scan(&alarmTime.Time, &alarmTime.Armed)
+	var backfill []BackfillRequest
+	if update.BufferSeconds > 0 {
+		backfill, err = requestBackfill(ctx, device.ID, time.Duration(update.BufferSeconds)*time.Second, now)
+		if err != nil {
+			return internalError(c, err)
+		}
+	}
 
-	if err == sql.ErrNoRows {
-		// Set default alarm time to 10:30
-		alarmTime = AlarmTime{
-			Time:  "10:30",
-			Armed: true,
+	response := DeviceUpdateResponse{
+		ConfigVersion:  cfg.version(),
+		CurrentTime:    time.Now().Unix(),
+		StopAlarm:      stopAlarm,
+		SnoozeSeconds:  int64(snooze.Seconds()),
+		ReportInterval: reporting.reportInterval(map[string]float64{"co2": update.CO2Level, "sound": update.SoundLevel}),
+		SampleInterval: reporting.SampleIntervalSeconds,
+		CO2Band:        deviceCO2Band(update.CO2Level),
+		Commands:       commands,
+		Backfill:       backfill,
+	}
+	if update.ConfigVersion == response.ConfigVersion {
+		response.Unchanged = true
+	} else {
+		response.Time, response.Armed, response.AlarmConfigured = &cfg.Time, &cfg.Armed, &cfg.Configured
+		response.CO2Bands = &cfg.CO2Bands
+		if cfg.Sound != "" {
+			response.Sound = &cfg.Sound
 		}
-		// Save the default time to database
-		_, err := db.Exec("INSERT INTO alarm_time (time, armed) VALUES ($1, $2)",
-			alarmTime.Time, alarmTime.Armed)
-		if err != nil {
-			log.Printf("Failed to save default alarm time: %v", err)
+		if cfg.Stream != "" {
+			response.Stream = &cfg.Stream
+		}
+		if cfg.StreamFallback != "" {
+			response.StreamFallback = &cfg.StreamFallback
 		}
-	} else if err != nil {
-		return c.JSON(http.StatusInternalServerError, map[string]string{"error": err.Error()})
 	}
 
+	return c.JSON(http.StatusOK, response)
+}
+
+// getAlarmTime returns the alarm, with "configured": false and an empty
+// time until one has been set.
+func getAlarmTime(c echo.Context) error {
+	alarmTime, err := currentAlarm()
+	if err != nil && err != sql.ErrNoRows {
+		return internalError(c, err)
+	}
 	return c.JSON(http.StatusOK, alarmTime)
 }
 
+// setAlarmTime sets and arms the alarm, {"time": "06:30"}, after the
+// checks of alarm_validate.go; "confirm": true accepts their warnings.
 func setAlarmTime(c echo.Context) error {
-	var alarmTime AlarmTime
-	if err := c.Bind(&alarmTime); err != nil {
-		return c.JSON(http.StatusBadRequest, map[string]string{"error": err.Error()})
+	var req struct {
+		Time    string `json:"time"`
+		Confirm bool   `json:"confirm"`
+	}
+	if err := c.Bind(&req); err != nil {
+		return invalidBody(c, err)
+	}
+	alarm, ok := parseAlarmTime(req.Time)
+	if !ok {
+		return apiError(c, http.StatusBadRequest, "time must be HH:MM")
+	}
+
+	warnings, err := alarmWarnings(requestLanguage(c), alarm, time.Now())
+	if err != nil {
+		return internalError(c, err)
+	}
+	if needsConfirmation(warnings) && !req.Confirm {
+		return c.JSON(http.StatusPreconditionRequired, map[string]interface{}{
+			"code":     "confirmation_required",
+			"error":    "the alarm needs confirmation",
+			"warnings": warnings,
+		})
+	}
+	response := map[string]interface{}{"time": alarm, "armed": true, "configured": true, "warnings": warnings}
+	if len(warnings) > 0 && warnings[0].Code == "duplicate" {
+		return c.JSON(http.StatusOK, response)
 	}
 
-	_, err := db.Exec("INSERT INTO alarm_time (time, armed) VALUES ($1, $2)",
-		alarmTime.Time, true)
+	_, err = db.Exec("INSERT INTO alarm_time (time, armed) VALUES ($1, $2)", alarm, true)
 	if err != nil {
-		return c.JSON(http.StatusInternalServerError, map[string]string{"error": err.Error()})
+		return internalError(c, err)
 	}
 
-	return c.NoContent(http.StatusCreated)
+	publish(EventAlarmChanged, AlarmTime{Time: alarm, Armed: true, Configured: true})
+
+	return c.JSON(http.StatusCreated, response)
 }
 
 func getSensorData(c echo.Context) error {
@@ -272,7 +1204,7 @@ func getSensorData(c echo.Context) error {
 		FROM time_buckets
 	`)
 	if err != nil {
-		return c.JSON(http.StatusInternalServerError, map[string]string{"error": err.Error()})
+		return internalError(c, err)
 	}
 	defer rows.Close()
 
@@ -280,10 +1212,34 @@ func getSensorData(c echo.Context) error {
 	for rows.Next() {
 		var d SensorData
 		if err := rows.Scan(&d.Timestamp, &d.CO2Level); err != nil {
-			return c.JSON(http.StatusInternalServerError, map[string]string{"error": err.Error()})
+			return internalError(c, err)
 		}
 		data = append(data, d)
 	}
 
+	// With ?annotations=true the readings come with the annotations of the
+	// same 24 hours, optionally only those with all ?tags=, and with
+	// ?gaps=true with the gaps in them (see gaps.go)
+	withAnnotations, withGaps := c.QueryParam("annotations") == "true", c.QueryParam("gaps") == "true"
+	if withAnnotations || withGaps {
+		now := time.Now()
+		body := map[string]interface{}{"data": data}
+		if withAnnotations {
+			annotations, err := loadAnnotations(c.Request().Context(), now.Add(-24*time.Hour), now, splitTags(c.QueryParam("tags")))
+			if err != nil {
+				return internalError(c, err)
+			}
+			body["annotations"] = annotations
+		}
+		if withGaps {
+			gaps, err := findGaps(c.Request().Context(), "co2", 0, now.Add(-24*time.Hour), now)
+			if err != nil {
+				return internalError(c, err)
+			}
+			body["gaps"] = gaps
+		}
+		return c.JSON(http.StatusOK, body)
+	}
+
 	return c.JSON(http.StatusOK, data)
 }
@@ -0,0 +1,68 @@
+package main
+
+import (
+	"net/http"
+	"time"
+
+	"github.com/labstack/echo/v4"
+)
+
+// Maintenance mode is for work on the devices, e.g. reflashing firmware.
+// While it is on, devices going offline publish no device.offline, the
+// notification rules are not evaluated, reboots count as expected and the
+// alarm watchdog (pre-flight checks and the backup alarm) stands down. It
+// ends by itself at maintenance_until.
+
+type MaintenanceState struct {
+	Active bool       `json:"active"`
+	Until  *time.Time `json:"until,omitempty"`
+}
+
+func maintenanceActive(now time.Time) bool {
+	return now.Before(settingTime("maintenance_until"))
+}
+
+func currentMaintenance() MaintenanceState {
+	until := settingTime("maintenance_until")
+	if !time.Now().Before(until) {
+		return MaintenanceState{}
+	}
+	return MaintenanceState{Active: true, Until: &until}
+}
+
+func getMaintenance(c echo.Context) error {
+	return c.JSON(http.StatusOK, currentMaintenance())
+}
+
+// setMaintenance takes {"enabled": true, "duration": "2h"}. The duration
+// defaults to maintenance_duration and is at most a day; {"enabled": false}
+// ends maintenance early.
+func setMaintenance(c echo.Context) error {
+	var req struct {
+		Enabled  bool   `json:"enabled"`
+		Duration string `json:"duration"`
+	}
+	if err := c.Bind(&req); err != nil {
+		return invalidBody(c, err)
+	}
+
+	value := ""
+	if req.Enabled {
+		duration := settingDuration("maintenance_duration")
+		if req.Duration != "" {
+			parsed, err := time.ParseDuration(req.Duration)
+			if err != nil || parsed <= 0 || parsed > 24*time.Hour {
+				return apiError(c, http.StatusBadRequest, "duration must be between 0 and 24h")
+			}
+			duration = parsed
+		}
+		value = time.Now().Add(duration).Truncate(time.Second).Format(time.RFC3339)
+	}
+	if err := storeSetting("maintenance_until", value); err != nil {
+		return internalError(c, err)
+	}
+	state := currentMaintenance()
+	publish(EventMaintenanceChanged, state)
+
+	return c.JSON(http.StatusOK, state)
+}
@@ -0,0 +1,168 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/labstack/echo/v4"
+)
+
+// Request metrics are kept per route (the registered path, not the URL) and
+// exposed in Prometheus text format at /metrics and as JSON at
+// /api/stats/http.
+
+var latencyBuckets = []float64{0.005, 0.01, 0.025, 0.05, 0.1, 0.25, 0.5, 1, 2.5, 5, 10}
+
+type routeStats struct {
+	method, route string
+	count         uint64
+	statusClasses [6]uint64 // index 2 is 2xx etc.
+	sum, max      float64   // seconds
+	buckets       []uint64  // cumulative, per latencyBuckets
+}
+
+var (
+	httpStatsMu sync.Mutex
+	httpStats   = make(map[string]*routeStats)
+)
+
+func recordRequest(method, route string, status int, d time.Duration) {
+	seconds := d.Seconds()
+	key := method + " " + route
+
+	httpStatsMu.Lock()
+	defer httpStatsMu.Unlock()
+	s, ok := httpStats[key]
+	if !ok {
+		s = &routeStats{method: method, route: route, buckets: make([]uint64, len(latencyBuckets))}
+		httpStats[key] = s
+	}
+	s.count++
+	if class := status / 100; class >= 1 && class <= 5 {
+		s.statusClasses[class]++
+	}
+	s.sum += seconds
+	s.max = max(s.max, seconds)
+	for i, le := range latencyBuckets {
+		if seconds <= le {
+			s.buckets[i]++
+		}
+	}
+}
+
+// requestMetrics records the duration and status class of every request.
+func requestMetrics(next echo.HandlerFunc) echo.HandlerFunc {
+	return func(c echo.Context) error {
+		start := time.Now()
+		err := next(c)
+
+		status := c.Response().Status
+		if err != nil {
+			if s, ok := errorStatus(err); ok {
+				status = s
+			} else if !c.Response().Committed {
+				status = http.StatusInternalServerError
+			}
+		}
+		route := c.Path()
+		if route == "" {
+			route = "unmatched"
+		}
+		recordRequest(c.Request().Method, route, status, time.Since(start))
+		return err
+	}
+}
+
+func snapshotHTTPStats() []routeStats {
+	httpStatsMu.Lock()
+	defer httpStatsMu.Unlock()
+	stats := make([]routeStats, 0, len(httpStats))
+	for _, s := range httpStats {
+		cp := *s
+		cp.buckets = append([]uint64(nil), s.buckets...)
+		stats = append(stats, cp)
+	}
+	return stats
+}
+
+func writeHTTPMetrics(w io.Writer) {
+	stats := snapshotHTTPStats()
+	sort.Slice(stats, func(i, j int) bool {
+		return stats[i].route+stats[i].method < stats[j].route+stats[j].method
+	})
+
+	fmt.Fprintln(w, "# HELP http_requests_total HTTP requests by route and status class.")
+	fmt.Fprintln(w, "# TYPE http_requests_total counter")
+	for _, s := range stats {
+		for class := 1; class <= 5; class++ {
+			if s.statusClasses[class] > 0 {
+				fmt.Fprintf(w, "http_requests_total{method=%q,route=%q,code=\"%dxx\"} %d\n",
+					s.method, s.route, class, s.statusClasses[class])
+			}
+		}
+	}
+
+	fmt.Fprintln(w, "# HELP http_request_duration_seconds HTTP request latency by route.")
+	fmt.Fprintln(w, "# TYPE http_request_duration_seconds histogram")
+	for _, s := range stats {
+		for i, le := range latencyBuckets {
+			fmt.Fprintf(w, "http_request_duration_seconds_bucket{method=%q,route=%q,le=\"%g\"} %d\n",
+				s.method, s.route, le, s.buckets[i])
+		}
+		fmt.Fprintf(w, "http_request_duration_seconds_bucket{method=%q,route=%q,le=\"+Inf\"} %d\n", s.method, s.route, s.count)
+		fmt.Fprintf(w, "http_request_duration_seconds_sum{method=%q,route=%q} %g\n", s.method, s.route, s.sum)
+		fmt.Fprintf(w, "http_request_duration_seconds_count{method=%q,route=%q} %d\n", s.method, s.route, s.count)
+	}
+}
+
+func getMetrics(c echo.Context) error {
+	c.Response().Header().Set(echo.HeaderContentType, "text/plain; version=0.0.4")
+	c.Response().WriteHeader(http.StatusOK)
+	writeHTTPMetrics(c.Response())
+	writePanicMetrics(c.Response())
+	writeCacheMetrics(c.Response())
+	return nil
+}
+
+type RouteStats struct {
+	Method       string            `json:"method"`
+	Route        string            `json:"route"`
+	Count        uint64            `json:"count"`
+	Status       map[string]uint64 `json:"status"`
+	ErrorRate    float64           `json:"error_rate"` // share of 5xx responses
+	AvgMs        float64           `json:"avg_ms"`
+	MaxMs        float64           `json:"max_ms"`
+	TotalSeconds float64           `json:"total_seconds"`
+}
+
+// getHTTPStats lists routes by the total time spent serving them, so the
+// most expensive endpoint comes first.
+func getHTTPStats(c echo.Context) error {
+	stats := snapshotHTTPStats()
+	list := make([]RouteStats, 0, len(stats))
+	for _, s := range stats {
+		r := RouteStats{
+			Method:       s.method,
+			Route:        s.route,
+			Count:        s.count,
+			Status:       make(map[string]uint64),
+			AvgMs:        s.sum / float64(s.count) * 1000,
+			MaxMs:        s.max * 1000,
+			TotalSeconds: s.sum,
+			ErrorRate:    float64(s.statusClasses[5]) / float64(s.count),
+		}
+		for class := 1; class <= 5; class++ {
+			if s.statusClasses[class] > 0 {
+				r.Status[fmt.Sprintf("%dxx", class)] = s.statusClasses[class]
+			}
+		}
+		list = append(list, r)
+	}
+	sort.Slice(list, func(i, j int) bool { return list[i].TotalSeconds > list[j].TotalSeconds })
+
+	return c.JSON(http.StatusOK, list)
+}
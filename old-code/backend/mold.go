@@ -0,0 +1,218 @@
+package main
+
+import (
+	"fmt"
+	"math"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/labstack/echo/v4"
+)
+
+// Mold grows where relative humidity stays high for long. For every room
+// with humidity readings (the humidity metric from ESPHome or TTN sensors,
+// and temperature for the dew point) GET /api/rooms/:room/mold-risk lists
+// the windows in which humidity stayed at or above mold_humidity_threshold.
+// The mold_risk job notifies once per window when it lasts longer than
+// mold_risk_after.
+
+type HumidityWindow struct {
+	Start       time.Time `json:"start"`
+	End         time.Time `json:"end"`
+	Minutes     int       `json:"minutes"`
+	MaxHumidity float64   `json:"max_humidity"`
+	Ongoing     bool      `json:"ongoing"`
+}
+
+type MoldRisk struct {
+	Room        string           `json:"room"`
+	Risk        string           `json:"risk"` // unknown | low | elevated | high
+	Humidity    *float64         `json:"humidity"`
+	Temperature *float64         `json:"temperature"`
+	DewPoint    *float64         `json:"dew_point"`
+	Threshold   float64          `json:"threshold"`
+	RiskAfter   string           `json:"risk_after"`
+	Windows     []HumidityWindow `json:"windows"`
+}
+
+// A gap in the readings longer than this ends a window.
+const humidityMaxGap = time.Hour
+
+// dewPoint uses the Magnus formula (°C, relative humidity in %).
+func dewPoint(temperature, humidity float64) float64 {
+	const a, b = 17.62, 243.12
+	gamma := math.Log(humidity/100) + a*temperature/(b+temperature)
+	return b * gamma / (a - gamma)
+}
+
+func roomMetricSince(room, metric string, since time.Time) ([]Point, error) {
+	rows, err := db.Query(`
+		SELECT m.timestamp, m.value
+		FROM metric_samples m
+		JOIN devices d ON d.id = m.device_id
+		WHERE d.room = $1 AND m.metric = $2 AND m.timestamp > $3
+		ORDER BY m.timestamp
+	`, room, metric, since)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var points []Point
+	for rows.Next() {
+		var p Point
+		if err := rows.Scan(&p.Timestamp, &p.Value); err != nil {
+			return nil, err
+		}
+		points = append(points, p)
+	}
+	return points, rows.Err()
+}
+
+// humidityWindows finds the runs of readings at or above threshold.
+func humidityWindows(points []Point, threshold float64, now time.Time) []HumidityWindow {
+	windows := []HumidityWindow{}
+	var cur *HumidityWindow
+	var last time.Time
+	closeWindow := func() {
+		if cur != nil {
+			cur.Minutes = int(cur.End.Sub(cur.Start).Minutes())
+			windows = append(windows, *cur)
+			cur = nil
+		}
+	}
+	for _, p := range points {
+		if cur != nil && p.Timestamp.Sub(last) > humidityMaxGap {
+			closeWindow()
+		}
+		last = p.Timestamp
+		if p.Value < threshold {
+			closeWindow()
+			continue
+		}
+		if cur == nil {
+			cur = &HumidityWindow{Start: p.Timestamp}
+		}
+		cur.End = p.Timestamp
+		cur.MaxHumidity = max(cur.MaxHumidity, p.Value)
+	}
+	if cur != nil && now.Sub(last) <= humidityMaxGap {
+		cur.Ongoing = true
+	}
+	closeWindow()
+	return windows
+}
+
+func assessMoldRisk(room string, since, now time.Time) (*MoldRisk, error) {
+	threshold := settingFloat("mold_humidity_threshold")
+	riskAfter := settingDuration("mold_risk_after")
+	r := &MoldRisk{Room: room, Risk: "unknown", Threshold: threshold, RiskAfter: riskAfter.String()}
+
+	humidity, err := roomMetricSince(room, "humidity", since)
+	if err != nil {
+		return nil, err
+	}
+	r.Windows = humidityWindows(humidity, threshold, now)
+	if len(humidity) == 0 || now.Sub(humidity[len(humidity)-1].Timestamp) > humidityMaxGap {
+		return r, nil
+	}
+	current := humidity[len(humidity)-1].Value
+	r.Humidity = &current
+
+	temperature, err := roomMetricSince(room, "temperature", now.Add(-humidityMaxGap))
+	if err != nil {
+		return nil, err
+	}
+	if len(temperature) > 0 && current > 0 {
+		t := temperature[len(temperature)-1].Value
+		dp := math.Round(dewPoint(t, current)*10) / 10
+		r.Temperature, r.DewPoint = &t, &dp
+	}
+
+	r.Risk = "low"
+	for _, w := range r.Windows {
+		if !w.Ongoing {
+			continue
+		}
+		r.Risk = "elevated"
+		if now.Sub(w.Start) >= riskAfter {
+			r.Risk = "high"
+		}
+	}
+	return r, nil
+}
+
+// getMoldRisk reports the current risk and the humidity windows of the
+// last ?days (default 7).
+func getMoldRisk(c echo.Context) error {
+	days := 7
+	if v := c.QueryParam("days"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 1 || n > 90 {
+			return apiError(c, http.StatusBadRequest, "days must be between 1 and 90")
+		}
+		days = n
+	}
+	now := time.Now()
+	r, err := assessMoldRisk(c.Param("room"), now.AddDate(0, 0, -days), now)
+	if err != nil {
+		return internalError(c, err)
+	}
+	return c.JSON(http.StatusOK, r)
+}
+
+// moldNotified holds the rooms notified about their current window.
+var (
+	moldMu       sync.Mutex
+	moldNotified = make(map[string]bool)
+)
+
+// checkMoldRisk is the mold_risk job.
+func checkMoldRisk() error {
+	rows, err := db.Query(`
+		SELECT DISTINCT d.room FROM metric_samples m JOIN devices d ON d.id = m.device_id
+		WHERE m.metric = 'humidity' AND m.timestamp > $1
+	`, time.Now().Add(-humidityMaxGap))
+	if err != nil {
+		return err
+	}
+	var rooms []string
+	for rows.Next() {
+		var room string
+		if err := rows.Scan(&room); err != nil {
+			rows.Close()
+			return err
+		}
+		rooms = append(rooms, room)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return err
+	}
+
+	now := time.Now()
+	riskAfter := settingDuration("mold_risk_after")
+	for _, room := range rooms {
+		r, err := assessMoldRisk(room, now.Add(-riskAfter-humidityMaxGap), now)
+		if err != nil {
+			return err
+		}
+		moldMu.Lock()
+		notified := moldNotified[room]
+		moldNotified[room] = r.Risk == "high"
+		moldMu.Unlock()
+		if r.Risk != "high" || notified {
+			continue
+		}
+		w := r.Windows[len(r.Windows)-1]
+		msg := fmt.Sprintf("Humidity has been above %.0f%% for %s (now %.0f%%).",
+			r.Threshold, now.Sub(w.Start).Round(time.Minute), *r.Humidity)
+		if r.DewPoint != nil {
+			msg += fmt.Sprintf(" Dew point %.1f°C, cold walls may get damp.", *r.DewPoint)
+		}
+		notify(Notification{Event: "mold", Title: fmt.Sprintf("Mold risk in %s", room), Message: msg, Priority: 4, Tags: []string{"droplet"}})
+	}
+	return nil
+}
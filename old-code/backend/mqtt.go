@@ -0,0 +1,189 @@
+package main
+
+import (
+	"bufio"
+	"crypto/tls"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"net"
+	"net/url"
+	"sync"
+	"time"
+)
+
+// mqttConn is a minimal MQTT 3.1.1 client: it connects, subscribes and
+// publishes at QoS 0 and receives messages, which is all the bridges need. URLs are
+// mqtt://host:1883 or mqtts://host:8883, with optional user:password.
+
+const mqttKeepAlive = 60 * time.Second
+
+type mqttConn struct {
+	conn net.Conn
+	r    *bufio.Reader
+
+	mu     sync.Mutex // serializes writes
+	nextID uint16
+}
+
+func mqttDial(rawURL, clientID string) (*mqttConn, error) {
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return nil, err
+	}
+	var conn net.Conn
+	dialer := &net.Dialer{Timeout: 10 * time.Second}
+	switch u.Scheme {
+	case "mqtt", "tcp":
+		conn, err = dialer.Dial("tcp", hostWithPort(u, "1883"))
+	case "mqtts", "ssl", "tls":
+		conn, err = tls.DialWithDialer(dialer, "tcp", hostWithPort(u, "8883"), &tls.Config{ServerName: u.Hostname()})
+	default:
+		return nil, fmt.Errorf("unsupported MQTT scheme %q", u.Scheme)
+	}
+	if err != nil {
+		return nil, err
+	}
+	c := &mqttConn{conn: conn, r: bufio.NewReader(conn)}
+
+	flags := byte(0x02) // clean session
+	payload := mqttString(clientID)
+	if u.User != nil {
+		flags |= 0x80
+		payload = append(payload, mqttString(u.User.Username())...)
+		if password, ok := u.User.Password(); ok {
+			flags |= 0x40
+			payload = append(payload, mqttString(password)...)
+		}
+	}
+	header := append(mqttString("MQTT"), 4, flags)
+	header = binary.BigEndian.AppendUint16(header, uint16(mqttKeepAlive.Seconds()))
+	if err := c.write(0x10, append(header, payload...)); err != nil {
+		conn.Close()
+		return nil, err
+	}
+
+	conn.SetReadDeadline(time.Now().Add(10 * time.Second))
+	kind, body, err := c.read()
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	if kind != 2 || len(body) != 2 || body[1] != 0 {
+		conn.Close()
+		return nil, fmt.Errorf("connection refused by the broker (%v)", body)
+	}
+	go c.keepAlive()
+	return c, nil
+}
+
+func hostWithPort(u *url.URL, port string) string {
+	if u.Port() != "" {
+		return u.Host
+	}
+	return net.JoinHostPort(u.Hostname(), port)
+}
+
+func mqttString(s string) []byte {
+	return append(binary.BigEndian.AppendUint16(nil, uint16(len(s))), s...)
+}
+
+func (c *mqttConn) write(header byte, body []byte) error {
+	packet := []byte{header}
+	// Remaining length, 7 bits per byte
+	n := len(body)
+	for {
+		b := byte(n % 128)
+		n /= 128
+		if n > 0 {
+			b |= 0x80
+		}
+		packet = append(packet, b)
+		if n == 0 {
+			break
+		}
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.conn.SetWriteDeadline(time.Now().Add(10 * time.Second))
+	_, err := c.conn.Write(append(packet, body...))
+	return err
+}
+
+// read returns the type and body of the next packet.
+func (c *mqttConn) read() (byte, []byte, error) {
+	header, err := c.r.ReadByte()
+	if err != nil {
+		return 0, nil, err
+	}
+	n, shift := 0, 0
+	for {
+		b, err := c.r.ReadByte()
+		if err != nil {
+			return 0, nil, err
+		}
+		n |= int(b&0x7f) << shift
+		if b&0x80 == 0 {
+			break
+		}
+		if shift += 7; shift > 21 {
+			return 0, nil, fmt.Errorf("malformed packet length")
+		}
+	}
+	body := make([]byte, n)
+	if _, err := io.ReadFull(c.r, body); err != nil {
+		return 0, nil, err
+	}
+	return header >> 4, body, nil
+}
+
+func (c *mqttConn) subscribe(topics ...string) error {
+	c.mu.Lock()
+	c.nextID++
+	id := c.nextID
+	c.mu.Unlock()
+	body := binary.BigEndian.AppendUint16(nil, id)
+	for _, t := range topics {
+		body = append(append(body, mqttString(t)...), 0)
+	}
+	return c.write(0x82, body)
+}
+
+// send publishes a message at QoS 0.
+func (c *mqttConn) send(topic string, payload []byte) error {
+	return c.write(0x30, append(mqttString(topic), payload...))
+}
+
+// receive calls fn for every message until the connection fails.
+func (c *mqttConn) receive(fn func(topic string, payload []byte)) error {
+	for {
+		c.conn.SetReadDeadline(time.Now().Add(mqttKeepAlive * 3 / 2))
+		kind, body, err := c.read()
+		if err != nil {
+			return err
+		}
+		if kind != 3 || len(body) < 2 {
+			continue // SUBACK, PINGRESP
+		}
+		n := int(binary.BigEndian.Uint16(body))
+		if len(body) < 2+n {
+			return fmt.Errorf("malformed PUBLISH")
+		}
+		fn(string(body[2:2+n]), body[2+n:])
+	}
+}
+
+func (c *mqttConn) keepAlive() {
+	ticker := time.NewTicker(mqttKeepAlive / 2)
+	defer ticker.Stop()
+	for range ticker.C {
+		if err := c.write(0xc0, nil); err != nil {
+			return
+		}
+	}
+}
+
+func (c *mqttConn) Close() error {
+	c.write(0xe0, nil)
+	return c.conn.Close()
+}
@@ -0,0 +1,66 @@
+package main
+
+import (
+	"net/http"
+	"time"
+
+	"github.com/labstack/echo/v4"
+)
+
+// Alerts can be muted for a while, e.g. during a party that will trip the
+// noise rules. While muted, only critical (priority 5) notifications are
+// pushed; everything else is still logged and alerts keep their state. The
+// mute ends by itself at alerts_muted_until.
+
+type MuteState struct {
+	Muted bool       `json:"muted"`
+	Until *time.Time `json:"until,omitempty"`
+}
+
+func alertsMuted(now time.Time) bool {
+	return now.Before(settingTime("alerts_muted_until"))
+}
+
+func currentMute() MuteState {
+	until := settingTime("alerts_muted_until")
+	if !time.Now().Before(until) {
+		return MuteState{}
+	}
+	return MuteState{Muted: true, Until: &until}
+}
+
+func getMute(c echo.Context) error {
+	return c.JSON(http.StatusOK, currentMute())
+}
+
+// muteAlerts mutes for ?duration= (default 1h, at most a week). A new mute
+// replaces the previous one, so it can also shorten it.
+func muteAlerts(c echo.Context) error {
+	duration := time.Hour
+	if d := c.QueryParam("duration"); d != "" {
+		parsed, err := time.ParseDuration(d)
+		if err != nil || parsed <= 0 || parsed > 7*24*time.Hour {
+			return apiError(c, http.StatusBadRequest, "duration must be between 0 and 168h")
+		}
+		duration = parsed
+	}
+
+	until := time.Now().Add(duration).Truncate(time.Second)
+	if err := storeSetting("alerts_muted_until", until.Format(time.RFC3339)); err != nil {
+		return internalError(c, err)
+	}
+	state := currentMute()
+	publish(EventMuteChanged, state)
+
+	return c.JSON(http.StatusOK, state)
+}
+
+func unmuteAlerts(c echo.Context) error {
+	if err := storeSetting("alerts_muted_until", ""); err != nil {
+		return internalError(c, err)
+	}
+	state := currentMute()
+	publish(EventMuteChanged, state)
+
+	return c.JSON(http.StatusOK, state)
+}
@@ -0,0 +1,306 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/csv"
+	"encoding/hex"
+	"fmt"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/labstack/echo/v4"
+)
+
+// The noise report documents, night by night, how long the sound level was
+// above noise_limit (dBA once the sound sensor is calibrated, see
+// calibration.go) during noise_quiet_hours, the hours a local noise
+// ordinance protects. Each sample stands for the time until the next one,
+// at most noiseMaxSampleGap, so gaps in the data are not counted as noise.
+// Consecutive samples above the limit form an episode. Quiet hours are in the
+// room's timezone when one of its devices has one (see devices.go).
+//
+// The noise_report job (off by default, set JOB_NOISE_REPORT_SCHEDULE, e.g.
+// "30 7 * * *") sends a summary
+// of the last night when it was above the limit.
+//
+// For evidence, GET /api/reports/noise/evidence returns the timestamped
+// samples of one night as CSV, with its SHA-256 in X-Content-SHA256 so a copy
+// handed over can be checked against the server.
+
+const noiseMaxSampleGap = 5 * time.Minute
+
+type NoiseEpisode struct {
+	Start   time.Time `json:"start"`
+	End     time.Time `json:"end"`
+	Minutes float64   `json:"minutes"`
+	Peak    float64   `json:"peak"`
+}
+
+type NoiseNight struct {
+	Date             string         `json:"date"` // the evening the night starts
+	From             time.Time      `json:"from"`
+	To               time.Time      `json:"to"`
+	Samples          int            `json:"samples"`
+	MonitoredMinutes float64        `json:"monitored_minutes"`
+	MinutesAbove     float64        `json:"minutes_above"`
+	Peak             *float64       `json:"peak"`
+	Episodes         []NoiseEpisode `json:"episodes"`
+}
+
+type NoiseReport struct {
+	Room       string       `json:"room,omitempty"`
+	QuietHours string       `json:"quiet_hours"`
+	Limit      float64      `json:"limit"`
+	Unit       string       `json:"unit"`
+	Nights     []NoiseNight `json:"nights"`
+}
+
+// quietHoursOf returns the quiet hours of the night starting on day.
+func quietHoursOf(day time.Time, hours string) (time.Time, time.Time, error) {
+	start, end, err := parseClockRange(hours)
+	if err != nil {
+		return time.Time{}, time.Time{}, err
+	}
+	midnight := time.Date(day.Year(), day.Month(), day.Day(), 0, 0, 0, 0, day.Location())
+	from := midnight.Add(time.Duration(start) * time.Minute)
+	to := midnight.Add(time.Duration(end) * time.Minute)
+	if end <= start {
+		to = to.AddDate(0, 0, 1)
+	}
+	return from, to, nil
+}
+
+// noiseNight evaluates the sound samples in [from, to).
+func noiseNight(ctx context.Context, room string, from, to time.Time, limit float64) (NoiseNight, error) {
+	night := NoiseNight{Date: from.Format("2006-01-02"), From: from, To: to, Episodes: []NoiseEpisode{}}
+	samples, args := metricSampleQuery("sound", room, from, to)
+	rows, err := db.QueryContext(ctx, samples+" ORDER BY 1", args...)
+	if err != nil {
+		return night, err
+	}
+	defer rows.Close()
+	var points []Point
+	for rows.Next() {
+		var p Point
+		if err := rows.Scan(&p.Timestamp, &p.Value); err != nil {
+			return night, err
+		}
+		points = append(points, p)
+	}
+	if err := rows.Err(); err != nil {
+		return night, err
+	}
+
+	night.Samples = len(points)
+	var episode *NoiseEpisode
+	for i, p := range points {
+		next := to
+		if i+1 < len(points) {
+			next = points[i+1].Timestamp
+		}
+		minutes := min(next.Sub(p.Timestamp), noiseMaxSampleGap).Minutes()
+		night.MonitoredMinutes += minutes
+		if night.Peak == nil || p.Value > *night.Peak {
+			peak := p.Value
+			night.Peak = &peak
+		}
+		if p.Value <= limit {
+			episode = nil
+			continue
+		}
+		night.MinutesAbove += minutes
+		if episode == nil {
+			night.Episodes = append(night.Episodes, NoiseEpisode{Start: p.Timestamp, Peak: p.Value})
+			episode = &night.Episodes[len(night.Episodes)-1]
+		}
+		episode.End = p.Timestamp.Add(time.Duration(minutes * float64(time.Minute)))
+		episode.Minutes += minutes
+		episode.Peak = max(episode.Peak, p.Value)
+	}
+	return night, nil
+}
+
+// sendNoiseSummary is the noise_report job.
+func sendNoiseSummary() error {
+	now := time.Now()
+	from, to, err := quietHoursOf(now, setting("noise_quiet_hours"))
+	if err != nil {
+		return err
+	}
+	if to.After(now) {
+		from, to = from.AddDate(0, 0, -1), to.AddDate(0, 0, -1)
+	}
+	limit := settingFloat("noise_limit")
+	night, err := noiseNight(context.Background(), "", from, to, limit)
+	if err != nil || night.MinutesAbove == 0 {
+		return err
+	}
+	unit, err := metricUnit(context.Background(), "sound")
+	if err != nil {
+		return err
+	}
+	notify(Notification{
+		Event: "noise",
+		Title: "Noise during quiet hours",
+		Message: fmt.Sprintf("%.0f min above %s in the night of %s (%d episodes, peak %s)",
+			night.MinutesAbove, formatWithUnit(limit, unit), night.Date, len(night.Episodes), formatWithUnit(*night.Peak, unit)),
+		Priority: 2,
+		Tags:     []string{"loud_sound"},
+	})
+	return nil
+}
+
+// noiseParams reads the shared ?room=, ?limit= and ?hours= parameters.
+func noiseParams(c echo.Context) (room, hours string, limit float64, msg string) {
+	room = c.QueryParam("room")
+	hours = setting("noise_quiet_hours")
+	if v := c.QueryParam("hours"); v != "" {
+		hours = v
+	}
+	if _, _, err := parseClockRange(hours); err != nil {
+		return "", "", 0, "hours must be HH:MM-HH:MM"
+	}
+	limit = settingFloat("noise_limit")
+	if v := c.QueryParam("limit"); v != "" {
+		f, err := strconv.ParseFloat(v, 64)
+		if err != nil {
+			return "", "", 0, "limit must be a number"
+		}
+		limit = f
+	}
+	return room, hours, limit, ""
+}
+
+// getNoiseReport covers the last ?days= (14) nights, newest first:
+// ?room=bedroom&limit=40&hours=22:00-06:00, defaults from the settings.
+// ?format=csv returns one row per night.
+func getNoiseReport(c echo.Context) error {
+	room, hours, limit, msg := noiseParams(c)
+	if msg != "" {
+		return apiError(c, http.StatusBadRequest, msg)
+	}
+	days := 14
+	if v := c.QueryParam("days"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 1 || n > 366 {
+			return apiError(c, http.StatusBadRequest, "days must be between 1 and 366")
+		}
+		days = n
+	}
+	ctx := c.Request().Context()
+	unit, err := metricUnit(ctx, "sound")
+	if err != nil {
+		return internalError(c, err)
+	}
+
+	meta, err := roomMeta(ctx, room)
+	if err != nil {
+		return internalError(c, err)
+	}
+
+	report := NoiseReport{Room: room, QuietHours: hours, Limit: limit, Unit: unit, Nights: []NoiseNight{}}
+	now := time.Now().In(meta.location())
+	for day := now; len(report.Nights) < days; day = day.AddDate(0, 0, -1) {
+		from, to, _ := quietHoursOf(day, hours)
+		if from.After(now) {
+			continue // tonight has not started yet
+		}
+		if to.After(now) {
+			to = now
+		}
+		night, err := noiseNight(ctx, room, from, to, limit)
+		if err != nil {
+			return internalError(c, err)
+		}
+		report.Nights = append(report.Nights, night)
+	}
+
+	if c.QueryParam("format") != "csv" {
+		return c.JSON(http.StatusOK, report)
+	}
+	var buf bytes.Buffer
+	w := csv.NewWriter(&buf)
+	w.Write([]string{"date", "from", "to", "limit", "unit", "samples", "monitored_minutes", "minutes_above", "episodes", "peak"})
+	for _, n := range report.Nights {
+		peak := ""
+		if n.Peak != nil {
+			peak = strconv.FormatFloat(*n.Peak, 'f', 1, 64)
+		}
+		w.Write([]string{n.Date, n.From.Format(time.RFC3339), n.To.Format(time.RFC3339),
+			strconv.FormatFloat(limit, 'f', -1, 64), unit, strconv.Itoa(n.Samples),
+			strconv.FormatFloat(n.MonitoredMinutes, 'f', 1, 64), strconv.FormatFloat(n.MinutesAbove, 'f', 1, 64),
+			strconv.Itoa(len(n.Episodes)), peak})
+	}
+	w.Flush()
+	return sendCSV(c, fmt.Sprintf("noise-report-%s.csv", now.Format("2006-01-02")), buf.Bytes())
+}
+
+// getNoiseEvidence returns every sound sample of the night starting on
+// ?date=YYYY-MM-DD as CSV, with the device, the raw reading and whether it
+// was above the limit.
+func getNoiseEvidence(c echo.Context) error {
+	room, hours, limit, msg := noiseParams(c)
+	if msg != "" {
+		return apiError(c, http.StatusBadRequest, msg)
+	}
+	ctx := c.Request().Context()
+	meta, err := roomMeta(ctx, room)
+	if err != nil {
+		return internalError(c, err)
+	}
+	day, err := time.ParseInLocation("2006-01-02", c.QueryParam("date"), meta.location())
+	if err != nil {
+		return apiError(c, http.StatusBadRequest, "date must be YYYY-MM-DD")
+	}
+	from, to, _ := quietHoursOf(day, hours)
+	unit, err := metricUnit(ctx, "sound")
+	if err != nil {
+		return internalError(c, err)
+	}
+
+	rows, err := db.QueryContext(ctx, `
+		SELECT s.timestamp, COALESCE(d.name, ''), COALESCE(d.room, ''), s.sound_level, s.sound_raw
+		FROM sensor_data s LEFT JOIN devices d ON d.id = s.device_id
+		WHERE s.timestamp >= $1 AND s.timestamp < $2 AND ($3 = '' OR d.room = $3) AND s.sound_level != 0
+		ORDER BY s.timestamp
+	`, serverTime(from), serverTime(to), room)
+	if err != nil {
+		return internalError(c, err)
+	}
+	defer rows.Close()
+
+	var buf bytes.Buffer
+	w := csv.NewWriter(&buf)
+	w.Write([]string{"timestamp", "device", "room", "sound_level", "unit", "sound_raw", "limit", "above_limit"})
+	for rows.Next() {
+		var at time.Time
+		var device, deviceRoom string
+		var level float64
+		var raw *float64
+		if err := rows.Scan(&at, &device, &deviceRoom, &level, &raw); err != nil {
+			return internalError(c, err)
+		}
+		rawText := ""
+		if raw != nil {
+			rawText = strconv.FormatFloat(*raw, 'f', -1, 64)
+		}
+		w.Write([]string{at.Format(time.RFC3339), device, deviceRoom, strconv.FormatFloat(level, 'f', 1, 64), unit,
+			rawText, strconv.FormatFloat(limit, 'f', -1, 64), strconv.FormatBool(level > limit)})
+	}
+	if err := rows.Err(); err != nil {
+		return internalError(c, err)
+	}
+	w.Flush()
+	return sendCSV(c, fmt.Sprintf("noise-evidence-%s.csv", day.Format("2006-01-02")), buf.Bytes())
+}
+
+// sendCSV sends data as a download with its SHA-256.
+func sendCSV(c echo.Context, filename string, data []byte) error {
+	sum := sha256.Sum256(data)
+	c.Response().Header().Set("Content-Disposition", `attachment; filename="`+filename+`"`)
+	c.Response().Header().Set("X-Content-SHA256", hex.EncodeToString(sum[:]))
+	return c.Blob(http.StatusOK, "text/csv; charset=utf-8", data)
+}
@@ -0,0 +1,176 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"slices"
+	"strings"
+	"time"
+)
+
+// Notification is a message for the household, e.g. a fired rule.
+type Notification struct {
+	Event    string // what it is about, for routing (see alert_routing.go)
+	Title    string
+	Message  string
+	Priority int // 1 (min) .. 5 (max), ntfy semantics; 0 means default (3)
+	Tags     []string
+	Readings map[string]float64 // the readings it was raised with, shown by Discord and Slack
+	Channels []string           // only these channels; all of them when empty
+	Chart    string             // metric whose last hours Discord and Slack show as a chart
+	Actions  []NotificationAction
+}
+
+// NotificationAction is a button on an ntfy notification. It opens URL, or
+// with Method set calls it from the phone without opening anything.
+type NotificationAction struct {
+	Label  string
+	URL    string
+	Method string
+}
+
+// notifyChannelNames are the channels a rule can select.
+var notifyChannelNames = []string{"ntfy", "sms", "discord", "slack", "webpush"}
+
+var notifyClient = &http.Client{Timeout: 10 * time.Second}
+
+// notifyChannel is a configured delivery driver. It only gets
+// notifications of at least minPriority.
+type notifyChannel struct {
+	name        string
+	minPriority int
+	send        func(Notification) error
+}
+
+// notifyChannels are ntfy, when NTFY_URL is set (e.g.
+// https://ntfy.sh/my-topic), from NTFY_MIN_PRIORITY, SMS from
+// SMS_MIN_PRIORITY, Discord and Slack webhooks from DISCORD_MIN_PRIORITY
+// and SLACK_MIN_PRIORITY, and the browsers subscribed to Web Push from
+// WEBPUSH_MIN_PRIORITY.
+func notifyChannels() []notifyChannel {
+	var channels []notifyChannel
+	if url := envString("NTFY_URL", ""); url != "" {
+		channels = append(channels, notifyChannel{"ntfy", envInt("NTFY_MIN_PRIORITY", 1),
+			func(n Notification) error { return sendNtfy(url, n) }})
+	}
+	if sms != nil {
+		channels = append(channels, notifyChannel{"sms", envInt("SMS_MIN_PRIORITY", 5), sms.send})
+	}
+	if url := envString("DISCORD_WEBHOOK_URL", ""); url != "" {
+		channels = append(channels, notifyChannel{"discord", envInt("DISCORD_MIN_PRIORITY", 1),
+			func(n Notification) error { return sendDiscord(url, n) }})
+	}
+	if url := envString("SLACK_WEBHOOK_URL", ""); url != "" {
+		channels = append(channels, notifyChannel{"slack", envInt("SLACK_MIN_PRIORITY", 1),
+			func(n Notification) error { return sendSlack(url, n) }})
+	}
+	if envBool("WEB_PUSH", true) {
+		channels = append(channels, notifyChannel{"webpush", envInt("WEBPUSH_MIN_PRIORITY", 1), sendWebPush})
+	}
+	return channels
+}
+
+// notify always logs the notification and sends it to the channels the
+// alert routing (alert_routing.go) picks for it. Without a matching route
+// its priority decides: during quiet hours only high priority (4+)
+// notifications are sent, each channel from its own minimum. While alerts
+// are muted only critical (5) ones go out. Delivery errors are logged,
+// never returned: a failing push service must not break device updates.
+func notify(n Notification) {
+	log.Printf("Notification: %s: %s", n.Title, n.Message)
+
+	now := time.Now()
+	priority := n.Priority
+	if priority == 0 {
+		priority = 3
+	}
+	if priority < 5 && alertsMuted(now) {
+		return
+	}
+	routes, routed := routeNotification(n.Event, priority, now)
+	if !routed && priority < 4 && inClockRange("quiet_hours", now) {
+		return
+	}
+	for _, ch := range notifyChannels() {
+		if len(n.Channels) > 0 && !slices.Contains(n.Channels, ch.name) {
+			continue
+		}
+		if routed && !slices.Contains(routes, ch.name) || !routed && priority < ch.minPriority {
+			continue
+		}
+		if err := ch.send(n); err != nil {
+			log.Printf("Failed to send notification via %s: %v", ch.name, err)
+		}
+	}
+	// The weekly report is where the digest goes, so it is never held for it
+	if routed && slices.Contains(routes, digestChannel) && n.Event != "report" {
+		if err := addToDigest(n, priority, now); err != nil {
+			log.Printf("Failed to keep notification for the digest: %v", err)
+		}
+	}
+}
+
+// escalate is for failures that could make someone oversleep. The
+// notification goes out at maximum priority, so it passes quiet hours and
+// mutes, and is also POSTed as JSON {"title", "message"} to
+// ESCALATION_WEBHOOK_URL, e.g. a phone-call or SMS gateway.
+func escalate(n Notification) {
+	n.Priority = 5
+	notify(n)
+
+	url := envString("ESCALATION_WEBHOOK_URL", "")
+	if url == "" {
+		return
+	}
+	body, _ := json.Marshal(map[string]string{"title": n.Title, "message": n.Message})
+	resp, err := notifyClient.Post(url, "application/json", bytes.NewReader(body))
+	if err != nil {
+		log.Printf("Failed to send escalation: %v", err)
+		return
+	}
+	resp.Body.Close()
+	if resp.StatusCode >= 300 {
+		log.Printf("Escalation webhook returned %s", resp.Status)
+	}
+}
+
+func sendNtfy(url string, n Notification) error {
+	req, err := http.NewRequest(http.MethodPost, url, bytes.NewBufferString(n.Message))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Title", n.Title)
+	if n.Priority > 0 {
+		req.Header.Set("Priority", fmt.Sprint(n.Priority))
+	}
+	if len(n.Tags) > 0 {
+		req.Header.Set("Tags", strings.Join(n.Tags, ","))
+	}
+	if len(n.Actions) > 0 {
+		actions := make([]string, len(n.Actions))
+		for i, a := range n.Actions {
+			if a.Method == "" {
+				actions[i] = fmt.Sprintf("view, %s, %s", a.Label, a.URL)
+			} else {
+				actions[i] = fmt.Sprintf("http, %s, %s, method=%s, clear=true", a.Label, a.URL, a.Method)
+			}
+		}
+		req.Header.Set("Actions", strings.Join(actions, "; "))
+	}
+	if token := envString("NTFY_TOKEN", ""); token != "" {
+		req.Header.Set("Authorization", "Bearer "+token)
+	}
+
+	resp, err := notifyClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode >= 300 {
+		return fmt.Errorf("ntfy returned %s", resp.Status)
+	}
+	return nil
+}
@@ -0,0 +1,433 @@
+package main
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math/big"
+	"net/http"
+	"net/url"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/labstack/echo/v4"
+)
+
+// OpenID Connect login against the home SSO (Authelia, Keycloak, Google).
+// Configure OIDC_ISSUER, OIDC_CLIENT_ID, OIDC_CLIENT_SECRET and
+// OIDC_REDIRECT_URL (https://home.example/api/auth/callback). Users get the
+// admin role when one of their groups (the OIDC_GROUPS_CLAIM claim) is in
+// OIDC_ADMIN_GROUPS, the viewer role when it is in OIDC_VIEWER_GROUPS or
+// that list is empty, and are refused otherwise. With HOUSEHOLD set (see
+// household.go) they must also be a member of the household.
+//
+// With AUTH_REQUIRED=true the API needs a session (or the admin token):
+// viewers may only read, admins may do everything. Device, ingestion,
+// OwnTracks and auth endpoints stay open, as do the voice assistant ones,
+// which take their own tokens.
+
+type oidcProvider struct {
+	issuer, clientID, clientSecret, redirectURL string
+	authURL, tokenURL, jwksURL                  string
+
+	keysMu      sync.Mutex
+	keys        map[string]crypto.PublicKey
+	keysFetched time.Time
+}
+
+var oidc *oidcProvider
+
+var oidcClient = &http.Client{Timeout: 10 * time.Second}
+
+func initOIDC() error {
+	initSessions()
+	issuer := strings.TrimSuffix(envString("OIDC_ISSUER", ""), "/")
+	if issuer == "" {
+		return nil
+	}
+
+	resp, err := oidcClient.Get(issuer + "/.well-known/openid-configuration")
+	if err != nil {
+		return fmt.Errorf("OIDC discovery: %w", err)
+	}
+	defer resp.Body.Close()
+	var discovery struct {
+		Issuer                string `json:"issuer"`
+		AuthorizationEndpoint string `json:"authorization_endpoint"`
+		TokenEndpoint         string `json:"token_endpoint"`
+		JWKSURI               string `json:"jwks_uri"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&discovery); err != nil {
+		return fmt.Errorf("OIDC discovery: %w", err)
+	}
+	if discovery.Issuer != issuer {
+		return fmt.Errorf("OIDC discovery: issuer %q does not match %q", discovery.Issuer, issuer)
+	}
+
+	oidc = &oidcProvider{
+		issuer:       issuer,
+		clientID:     envString("OIDC_CLIENT_ID", ""),
+		clientSecret: envString("OIDC_CLIENT_SECRET", ""),
+		redirectURL:  envString("OIDC_REDIRECT_URL", ""),
+		authURL:      discovery.AuthorizationEndpoint,
+		tokenURL:     discovery.TokenEndpoint,
+		jwksURL:      discovery.JWKSURI,
+	}
+	return nil
+}
+
+// oidcLogin is stored in a short-lived cookie between login and callback.
+type oidcLogin struct {
+	State    string `json:"state"`
+	Nonce    string `json:"nonce"`
+	Verifier string `json:"verifier"`
+	Return   string `json:"return"`
+}
+
+const oidcLoginCookie = "home_oidc_login"
+
+func oidcLoginStart(c echo.Context) error {
+	if oidc == nil {
+		return apiErrorCode(c, http.StatusNotFound, codeNotConfigured, "OIDC is not configured")
+	}
+
+	login := oidcLogin{State: randomHex(16), Nonce: randomHex(16), Verifier: randomHex(32), Return: "/"}
+	if r := c.QueryParam("return"); strings.HasPrefix(r, "/") && !strings.HasPrefix(r, "//") {
+		login.Return = r
+	}
+	if err := setSignedCookie(c, oidcLoginCookie, login, 10*time.Minute); err != nil {
+		return internalError(c, err)
+	}
+
+	challenge := sha256.Sum256([]byte(login.Verifier))
+	q := url.Values{
+		"response_type":         {"code"},
+		"client_id":             {oidc.clientID},
+		"redirect_uri":          {oidc.redirectURL},
+		"scope":                 {envString("OIDC_SCOPES", "openid profile email groups")},
+		"state":                 {login.State},
+		"nonce":                 {login.Nonce},
+		"code_challenge":        {base64.RawURLEncoding.EncodeToString(challenge[:])},
+		"code_challenge_method": {"S256"},
+	}
+	sep := "?"
+	if strings.Contains(oidc.authURL, "?") {
+		sep = "&"
+	}
+	return c.Redirect(http.StatusFound, oidc.authURL+sep+q.Encode())
+}
+
+func oidcCallback(c echo.Context) error {
+	if oidc == nil {
+		return apiErrorCode(c, http.StatusNotFound, codeNotConfigured, "OIDC is not configured")
+	}
+	if e := c.QueryParam("error"); e != "" {
+		return apiError(c, http.StatusUnauthorized, e+": "+c.QueryParam("error_description"))
+	}
+
+	var login oidcLogin
+	if err := readSignedCookie(c, oidcLoginCookie, &login); err != nil {
+		return apiError(c, http.StatusBadRequest, "login expired, try again")
+	}
+	clearCookie(c, oidcLoginCookie)
+	if c.QueryParam("state") != login.State {
+		return apiError(c, http.StatusBadRequest, "state mismatch")
+	}
+
+	idToken, err := oidc.exchange(c.QueryParam("code"), login.Verifier)
+	if err != nil {
+		return upstreamError(c, "the identity provider did not accept the login", err)
+	}
+	claims, err := oidc.verify(idToken)
+	if err != nil {
+		return apiError(c, http.StatusUnauthorized, err.Error())
+	}
+	if nonce, _ := claims["nonce"].(string); nonce != login.Nonce {
+		return apiError(c, http.StatusUnauthorized, "nonce mismatch")
+	}
+
+	role := roleForGroups(claimStrings(claims[envString("OIDC_GROUPS_CLAIM", "groups")]))
+	if role == "" {
+		return apiError(c, http.StatusForbidden, "none of your groups has access")
+	}
+	if !householdMember(claims) {
+		return apiError(c, http.StatusForbidden, "you are not a member of this household")
+	}
+	s := Session{Role: role, Household: household, Expires: time.Now().Add(envDuration("SESSION_DURATION", 7*24*time.Hour))}
+	s.Subject, _ = claims["sub"].(string)
+	s.Name, _ = claims["name"].(string)
+	s.Email, _ = claims["email"].(string)
+	if err := setSignedCookie(c, sessionCookie, s, time.Until(s.Expires)); err != nil {
+		return internalError(c, err)
+	}
+
+	return c.Redirect(http.StatusFound, login.Return)
+}
+
+func claimStrings(v interface{}) []string {
+	switch v := v.(type) {
+	case string:
+		return []string{v}
+	case []interface{}:
+		out := make([]string, 0, len(v))
+		for _, item := range v {
+			if s, ok := item.(string); ok {
+				out = append(out, s)
+			}
+		}
+		return out
+	}
+	return nil
+}
+
+func roleForGroups(groups []string) string {
+	inList := func(list string) bool {
+		for _, g := range strings.Split(list, ",") {
+			for _, have := range groups {
+				if g = strings.TrimSpace(g); g != "" && g == have {
+					return true
+				}
+			}
+		}
+		return false
+	}
+	switch viewers := envString("OIDC_VIEWER_GROUPS", ""); {
+	case inList(envString("OIDC_ADMIN_GROUPS", "")):
+		return "admin"
+	case viewers == "" || inList(viewers):
+		return "viewer"
+	}
+	return ""
+}
+
+func (p *oidcProvider) exchange(code, verifier string) (string, error) {
+	form := url.Values{
+		"grant_type":    {"authorization_code"},
+		"code":          {code},
+		"redirect_uri":  {p.redirectURL},
+		"code_verifier": {verifier},
+	}
+	req, err := http.NewRequest(http.MethodPost, p.tokenURL, strings.NewReader(form.Encode()))
+	if err != nil {
+		return "", err
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	req.SetBasicAuth(url.QueryEscape(p.clientID), url.QueryEscape(p.clientSecret))
+
+	resp, err := oidcClient.Do(req)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+	var token struct {
+		IDToken          string `json:"id_token"`
+		Error            string `json:"error"`
+		ErrorDescription string `json:"error_description"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&token); err != nil {
+		return "", fmt.Errorf("token response: %w", err)
+	}
+	if token.Error != "" {
+		return "", fmt.Errorf("token exchange: %s %s", token.Error, token.ErrorDescription)
+	}
+	if token.IDToken == "" {
+		return "", errors.New("token response has no id_token")
+	}
+	return token.IDToken, nil
+}
+
+// verify checks an ID token's signature, issuer, audience and expiry and
+// returns its claims.
+func (p *oidcProvider) verify(token string) (map[string]interface{}, error) {
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		return nil, errors.New("malformed ID token")
+	}
+	headerJSON, err := base64.RawURLEncoding.DecodeString(parts[0])
+	if err != nil {
+		return nil, err
+	}
+	var header struct {
+		Alg string `json:"alg"`
+		Kid string `json:"kid"`
+	}
+	if err := json.Unmarshal(headerJSON, &header); err != nil {
+		return nil, err
+	}
+	sig, err := base64.RawURLEncoding.DecodeString(parts[2])
+	if err != nil {
+		return nil, err
+	}
+	key, err := p.key(header.Kid)
+	if err != nil {
+		return nil, err
+	}
+	digest := sha256.Sum256([]byte(parts[0] + "." + parts[1]))
+	switch k := key.(type) {
+	case *rsa.PublicKey:
+		if header.Alg != "RS256" {
+			return nil, fmt.Errorf("unsupported algorithm %s", header.Alg)
+		}
+		if err := rsa.VerifyPKCS1v15(k, crypto.SHA256, digest[:], sig); err != nil {
+			return nil, errors.New("invalid ID token signature")
+		}
+	case *ecdsa.PublicKey:
+		if header.Alg != "ES256" || len(sig) != 64 {
+			return nil, fmt.Errorf("unsupported algorithm %s", header.Alg)
+		}
+		r, s := new(big.Int).SetBytes(sig[:32]), new(big.Int).SetBytes(sig[32:])
+		if !ecdsa.Verify(k, digest[:], r, s) {
+			return nil, errors.New("invalid ID token signature")
+		}
+	default:
+		return nil, errors.New("unsupported key type")
+	}
+
+	payload, err := base64.RawURLEncoding.DecodeString(parts[1])
+	if err != nil {
+		return nil, err
+	}
+	var claims map[string]interface{}
+	if err := json.Unmarshal(payload, &claims); err != nil {
+		return nil, err
+	}
+	if iss, _ := claims["iss"].(string); iss != p.issuer {
+		return nil, errors.New("ID token from another issuer")
+	}
+	audOK := false
+	for _, aud := range claimStrings(claims["aud"]) {
+		audOK = audOK || aud == p.clientID
+	}
+	if !audOK {
+		return nil, errors.New("ID token for another client")
+	}
+	if exp, _ := claims["exp"].(float64); time.Now().After(time.Unix(int64(exp), 0).Add(time.Minute)) {
+		return nil, errors.New("ID token expired")
+	}
+	return claims, nil
+}
+
+// key returns the signing key with the given ID, refetching the JWKS when
+// the key is unknown (the provider rotated its keys) at most once a minute.
+func (p *oidcProvider) key(kid string) (crypto.PublicKey, error) {
+	p.keysMu.Lock()
+	defer p.keysMu.Unlock()
+	if k, ok := p.keys[kid]; ok {
+		return k, nil
+	}
+	if time.Since(p.keysFetched) < time.Minute {
+		return nil, fmt.Errorf("unknown signing key %q", kid)
+	}
+	p.keysFetched = time.Now()
+
+	resp, err := oidcClient.Get(p.jwksURL)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	var jwks struct {
+		Keys []struct {
+			Kid, Kty, Crv, N, E, X, Y string
+		} `json:"keys"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&jwks); err != nil {
+		return nil, err
+	}
+	p.keys = make(map[string]crypto.PublicKey)
+	for _, k := range jwks.Keys {
+		switch {
+		case k.Kty == "RSA":
+			n, err1 := base64.RawURLEncoding.DecodeString(k.N)
+			e, err2 := base64.RawURLEncoding.DecodeString(k.E)
+			if err1 != nil || err2 != nil {
+				continue
+			}
+			p.keys[k.Kid] = &rsa.PublicKey{N: new(big.Int).SetBytes(n), E: int(new(big.Int).SetBytes(e).Int64())}
+		case k.Kty == "EC" && k.Crv == "P-256":
+			x, err1 := base64.RawURLEncoding.DecodeString(k.X)
+			y, err2 := base64.RawURLEncoding.DecodeString(k.Y)
+			if err1 != nil || err2 != nil {
+				continue
+			}
+			p.keys[k.Kid] = &ecdsa.PublicKey{Curve: elliptic.P256(), X: new(big.Int).SetBytes(x), Y: new(big.Int).SetBytes(y)}
+		}
+	}
+	if k, ok := p.keys[kid]; ok {
+		return k, nil
+	}
+	return nil, fmt.Errorf("unknown signing key %q", kid)
+}
+
+func getAuthMe(c echo.Context) error {
+	s := currentSession(c)
+	if s == nil {
+		return c.JSON(http.StatusUnauthorized, map[string]interface{}{
+			"code":      "unauthorized",
+			"error":     "not logged in",
+			"oidc":      oidc != nil,
+			"login_url": "/api/auth/login",
+		})
+	}
+	return c.JSON(http.StatusOK, s)
+}
+
+func logout(c echo.Context) error {
+	clearCookie(c, sessionCookie)
+	return c.NoContent(http.StatusNoContent)
+}
+
+// publicAPIPaths stay reachable without a session when AUTH_REQUIRED is set.
+// The OAuth, assistant and calendar endpoints check their own credentials.
+// Device endpoints are listed one by one: GET /api/device/status is the
+// dashboard's and needs a session.
+var publicAPIPaths = []string{"/api/auth/", "/api/ingest/", "/api/oauth/", "/api/alexa", "/api/google", "/api/calendar.ics", "/api/contract/", "/api/badge/"}
+
+// deviceAPIPaths are the endpoints the firmware calls; they check the
+// device key instead of a session.
+var deviceAPIPaths = []string{
+	"/api/device/update", "/api/device/heartbeat", "/api/device/backfill", "/api/device/logs",
+	"/api/device/claim", "/api/device/alarm-sound", "/api/device/briefing",
+}
+
+// requireSession enforces AUTH_REQUIRED on the API group.
+func requireSession(next echo.HandlerFunc) echo.HandlerFunc {
+	return func(c echo.Context) error {
+		if !envBool("AUTH_REQUIRED", false) {
+			return next(c)
+		}
+		path := c.Request().URL.Path
+		if slices.Contains(deviceAPIPaths, path) {
+			return next(c)
+		}
+		// Phones post their location with GEOFENCE_TOKEN; reading the
+		// locations back needs a session.
+		if path == "/api/presence/location" && c.Request().Method == http.MethodPost {
+			return next(c)
+		}
+		for _, p := range publicAPIPaths {
+			if strings.HasPrefix(path, p) {
+				return next(c)
+			}
+		}
+		if isAdminRequest(c) || signedChartRequest(c) || signedAlarmActionRequest(c) {
+			return next(c)
+		}
+		s := currentSession(c)
+		if s == nil {
+			return apiError(c, http.StatusUnauthorized, "login required")
+		}
+		// Viewers may save their own dashboards, nothing else
+		if s.Role != "admin" && c.Request().Method != http.MethodGet && c.Request().Method != http.MethodHead && !strings.HasPrefix(path, "/api/dashboards/") {
+			return apiErrorCode(c, http.StatusForbidden, codeReadOnly, "read-only access")
+		}
+		return next(c)
+	}
+}
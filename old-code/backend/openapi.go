@@ -0,0 +1,18 @@
+package main
+
+import (
+	_ "embed"
+	"net/http"
+
+	"github.com/labstack/echo/v4"
+)
+
+// openAPISpec documents the error envelope (errors.go) and the core device
+// endpoints.
+//
+//go:embed openapi.yaml
+var openAPISpec []byte
+
+func getOpenAPI(c echo.Context) error {
+	return c.Blob(http.StatusOK, "application/yaml", openAPISpec)
+}
@@ -0,0 +1,117 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"runtime/debug"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/labstack/echo/v4"
+)
+
+// recoverPanics turns a panicking handler into a 500 like echo's Recover
+// middleware, and additionally counts the panic per route and reports it
+// through notify with the request and the top of the stack. Repeated panics
+// on the same route are reported at most once per PANIC_NOTIFY_INTERVAL;
+// the count in /metrics still includes every one of them. A panicking job
+// (jobs.go) is reported the same way, throttled per job.
+
+var (
+	panicsMu       sync.Mutex
+	panicCounts    = make(map[string]uint64) // by route
+	panicsNotified = make(map[string]time.Time)
+)
+
+const panicStackLines = 20
+
+func recoverPanics(next echo.HandlerFunc) echo.HandlerFunc {
+	return func(c echo.Context) (err error) {
+		defer func() {
+			r := recover()
+			if r == nil {
+				return
+			}
+			if r == http.ErrAbortHandler {
+				panic(r) // deliberate connection abort, let net/http handle it
+			}
+			stack := string(debug.Stack())
+			reportPanic(c, r, stack)
+			err = echo.NewHTTPError(http.StatusInternalServerError, "internal server error")
+		}()
+		return next(c)
+	}
+}
+
+func reportPanic(c echo.Context, r interface{}, stack string) {
+	req := c.Request()
+	route := c.Path()
+	if route == "" {
+		route = "unmatched"
+	}
+	log.Printf("PANIC in %s %s: %v\n%s", req.Method, req.URL.RequestURI(), r, stack)
+	spanFromContext(req.Context()).SetError(fmt.Errorf("panic: %v", r))
+
+	panicsMu.Lock()
+	panicCounts[route]++
+	panicsMu.Unlock()
+	notifyPanic(route, "Server panic: "+req.Method+" "+route,
+		fmt.Sprintf("%s %s from %s (%s)", req.Method, req.URL.RequestURI(), c.RealIP(), req.UserAgent()), r, stack)
+}
+
+// reportJobPanic reports a panic recovered from a job's run.
+func reportJobPanic(name string, r interface{}, stack string) {
+	log.Printf("PANIC in job %s: %v\n%s", name, r, stack)
+	notifyPanic("job:"+name, "Job panic: "+name, "job "+name, r, stack)
+}
+
+// notifyPanic sends a panic with the top of its stack, unless one with the
+// same key was sent within PANIC_NOTIFY_INTERVAL.
+func notifyPanic(key, title, where string, r interface{}, stack string) {
+	now := time.Now()
+	panicsMu.Lock()
+	notifyNow := now.Sub(panicsNotified[key]) >= envDuration("PANIC_NOTIFY_INTERVAL", 10*time.Minute)
+	if notifyNow {
+		panicsNotified[key] = now
+	}
+	panicsMu.Unlock()
+	if !notifyNow {
+		return
+	}
+
+	lines := strings.Split(stack, "\n")
+	if len(lines) > panicStackLines {
+		lines = append(lines[:panicStackLines], "...")
+	}
+	go notify(Notification{
+		Event:    "server",
+		Title:    title,
+		Message:  fmt.Sprintf("%v\n\n%s\n\n%s", r, where, strings.Join(lines, "\n")),
+		Priority: 4,
+		Tags:     []string{"rotating_light"},
+	})
+}
+
+func writePanicMetrics(w io.Writer) {
+	panicsMu.Lock()
+	routes := make([]string, 0, len(panicCounts))
+	for route := range panicCounts {
+		routes = append(routes, route)
+	}
+	sort.Strings(routes)
+	counts := make([]uint64, len(routes))
+	for i, route := range routes {
+		counts[i] = panicCounts[route]
+	}
+	panicsMu.Unlock()
+
+	fmt.Fprintln(w, "# HELP http_panics_total Recovered handler panics by route.")
+	fmt.Fprintln(w, "# TYPE http_panics_total counter")
+	for i, route := range routes {
+		fmt.Fprintf(w, "http_panics_total{route=%q} %d\n", route, counts[i])
+	}
+}
@@ -0,0 +1,155 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"log"
+	"time"
+
+	"github.com/lib/pq"
+)
+
+// With PG_NOTIFY=true readings written by another process, e.g. a separate
+// MQTT ingester writing straight to sensor_data or metric_samples, reach
+// the WebSocket clients and the rules as if a device had sent them. A
+// trigger on both tables sends each inserted row with pg_notify and every
+// replica LISTENs: each delivers sensor.update to its own clients, and the
+// leader evaluates the rules.
+//
+// The server connects as application_name home-server and skips the rows it
+// wrote itself, which it handled already; other writers must use another
+// name. Rows older than notifyMaxAge (imports, restores, backfills) are not
+// fanned out. Notifications sent while the listener reconnects are lost.
+// Without PG_NOTIFY the triggers are dropped.
+
+const (
+	pgApplicationName = "home-server"
+	readingsChannel   = "home_server_readings"
+	notifyMaxAge      = 5 * time.Minute
+)
+
+// dbConnInfo is the connection string of db, for the listener.
+var dbConnInfo string
+
+var notifyTriggerTables = []string{"sensor_data", "metric_samples"}
+
+type readingNotification struct {
+	Schema     string  `json:"schema"`
+	Table      string  `json:"table"`
+	App        string  `json:"app"`
+	AgeSeconds float64 `json:"age_seconds"`
+	Row        struct {
+		DeviceID   int     `json:"device_id"`
+		CO2Level   float64 `json:"co2_level"`   // sensor_data
+		SoundLevel float64 `json:"sound_level"` // sensor_data
+		Metric     string  `json:"metric"`      // metric_samples
+		Value      float64 `json:"value"`       // metric_samples
+	} `json:"row"`
+}
+
+func initPGNotify() {
+	if !envBool("PG_NOTIFY", false) {
+		for _, table := range notifyTriggerTables {
+			if _, err := db.Exec("DROP TRIGGER IF EXISTS reading_notify ON " + table); err != nil {
+				log.Printf("PG_NOTIFY: dropping the trigger on %s failed: %v", table, err)
+			}
+		}
+		return
+	}
+	_, err := db.Exec(`
+		CREATE OR REPLACE FUNCTION notify_reading() RETURNS trigger AS $$
+		BEGIN
+			PERFORM pg_notify('` + readingsChannel + `', json_build_object(
+				'schema', TG_TABLE_SCHEMA,
+				'table', TG_TABLE_NAME,
+				'app', current_setting('application_name'),
+				'age_seconds', EXTRACT(EPOCH FROM LOCALTIMESTAMP - NEW.timestamp),
+				'row', row_to_json(NEW))::text);
+			RETURN NULL;
+		END
+		$$ LANGUAGE plpgsql
+	`)
+	if err != nil {
+		log.Printf("PG_NOTIFY: creating the trigger function failed: %v", err)
+		return
+	}
+	for _, table := range notifyTriggerTables {
+		_, err := db.Exec(`
+			DROP TRIGGER IF EXISTS reading_notify ON ` + table + `;
+			CREATE TRIGGER reading_notify AFTER INSERT ON ` + table + ` FOR EACH ROW EXECUTE PROCEDURE notify_reading()
+		`)
+		if err != nil {
+			log.Printf("PG_NOTIFY: creating the trigger on %s failed: %v", table, err)
+			return
+		}
+	}
+
+	listener := pq.NewListener(dbConnInfo, 10*time.Second, time.Minute, func(ev pq.ListenerEventType, err error) {
+		if err != nil {
+			log.Printf("PG_NOTIFY: listener: %v", err)
+		}
+	})
+	if err := listener.Listen(readingsChannel); err != nil {
+		log.Printf("PG_NOTIFY: listening failed: %v", err)
+		return
+	}
+	go listenReadings(listener)
+}
+
+func listenReadings(l *pq.Listener) {
+	for {
+		select {
+		case n := <-l.Notify:
+			if n == nil {
+				continue // reconnected
+			}
+			var r readingNotification
+			if err := json.Unmarshal([]byte(n.Extra), &r); err != nil {
+				log.Printf("PG_NOTIFY: invalid notification: %v", err)
+				continue
+			}
+			if err := r.handle(context.Background()); err != nil {
+				log.Printf("PG_NOTIFY: handling a %s row failed: %v", r.Table, err)
+			}
+		case <-time.After(90 * time.Second):
+			go l.Ping()
+		}
+	}
+}
+
+// handle fans out a row another process inserted.
+func (r readingNotification) handle(ctx context.Context) error {
+	if r.Schema != householdSchema() || r.App == pgApplicationName || r.AgeSeconds > notifyMaxAge.Seconds() {
+		return nil
+	}
+	var name, room string
+	err := db.QueryRowContext(ctx, "SELECT name, COALESCE(room, '') FROM devices WHERE id = $1", r.Row.DeviceID).
+		Scan(&name, &room)
+	if err != nil {
+		return err
+	}
+
+	var readings map[string]float64
+	data := map[string]interface{}{"device": name, "room": room}
+	switch r.Table {
+	case "sensor_data":
+		// 0 is no reading, e.g. a filtered spike, and not a value for the rules
+		readings = presentReadings(map[string]float64{"co2": r.Row.CO2Level, "sound": r.Row.SoundLevel})
+		if len(readings) == 0 {
+			return nil
+		}
+		for metric, v := range readings {
+			data[metric+"_level"] = v
+		}
+	case "metric_samples":
+		readings = map[string]float64{r.Row.Metric: r.Row.Value}
+		data["metrics"] = readings
+	default:
+		return nil
+	}
+	deliver(Event{Type: EventSensorUpdate, Time: time.Now(), Data: data})
+	if isLeader() {
+		go evaluateRules(room, withRoomSensors(room, readings))
+	}
+	return nil
+}
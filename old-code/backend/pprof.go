@@ -0,0 +1,31 @@
+package main
+
+import (
+	"net/http"
+	"net/http/pprof"
+
+	"github.com/labstack/echo/v4"
+)
+
+// registerPprof mounts the Go profiler under /debug/pprof when PPROF_ENABLED
+// is set. It is admin only, since profiles expose memory contents and the
+// command line. Grab a heap profile with
+//
+//	go tool pprof http://admin:$ADMIN_TOKEN@pi:8080/debug/pprof/heap
+func registerPprof(e *echo.Echo) {
+	if !envBool("PPROF_ENABLED", false) {
+		return
+	}
+
+	g := e.Group("/debug/pprof", requireAdmin)
+	g.GET("", func(c echo.Context) error {
+		return c.Redirect(http.StatusMovedPermanently, "/debug/pprof/")
+	})
+	g.GET("/cmdline", echo.WrapHandler(http.HandlerFunc(pprof.Cmdline)))
+	g.GET("/profile", echo.WrapHandler(http.HandlerFunc(pprof.Profile)))
+	g.GET("/symbol", echo.WrapHandler(http.HandlerFunc(pprof.Symbol)))
+	g.POST("/symbol", echo.WrapHandler(http.HandlerFunc(pprof.Symbol)))
+	g.GET("/trace", echo.WrapHandler(http.HandlerFunc(pprof.Trace)))
+	// Index also serves the named profiles: heap, goroutine, allocs, ...
+	g.GET("/*", echo.WrapHandler(http.HandlerFunc(pprof.Index)))
+}
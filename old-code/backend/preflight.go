@@ -0,0 +1,208 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"math"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/labstack/echo/v4"
+)
+
+// The alarm_preflight job runs preflight_lead before every armed alarm and
+// checks each alarm device: it must be online, its clock (device_time in
+// updates and heartbeats) must be within PREFLIGHT_MAX_CLOCK_SKEW of the
+// server's and it must hold the current alarm configuration (have
+// acknowledged it, for firmware that sends config_ack). Failures are
+// escalated. Alarm devices are those listed in PREFLIGHT_DEVICES, or else
+// every device that reports a config_version. The scheduled result is kept
+// in alarm_preflights, one per alarm.
+
+type PreflightCheck struct {
+	Device string `json:"device"`
+	Check  string `json:"check"` // online | clock | config
+	OK     bool   `json:"ok"`
+	Detail string `json:"detail,omitempty"`
+}
+
+type PreflightResult struct {
+	AlarmAt   time.Time        `json:"alarm_at"`
+	CheckedAt time.Time        `json:"checked_at"`
+	OK        bool             `json:"ok"`
+	Checks    []PreflightCheck `json:"checks"`
+}
+
+// lastPreflight returns the result of the last scheduled check, nil if
+// there was none.
+func lastPreflight(ctx context.Context) (*PreflightResult, error) {
+	var raw string
+	err := db.QueryRowContext(ctx, "SELECT result::text FROM alarm_preflights ORDER BY alarm_at DESC LIMIT 1").Scan(&raw)
+	if err == sql.ErrNoRows {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	var r PreflightResult
+	return &r, json.Unmarshal([]byte(raw), &r)
+}
+
+func runPreflight(ctx context.Context, now time.Time) (*PreflightResult, error) {
+	alarm, err := currentAlarm()
+	if err != nil {
+		return nil, err
+	}
+	alarmAt, err := nextAlarmAt(alarm.Time, now)
+	if err != nil {
+		return nil, err
+	}
+	cfg, err := currentDeviceConfig(ctx, now)
+	if err != nil {
+		return nil, err
+	}
+	r := &PreflightResult{AlarmAt: alarmAt, CheckedAt: now, OK: true, Checks: []PreflightCheck{}}
+
+	query := "SELECT name, last_seen, COALESCE(config_acked_version, config_version), clock_offset_seconds FROM devices WHERE config_version IS NOT NULL ORDER BY name"
+	var args []interface{}
+	if names := envString("PREFLIGHT_DEVICES", ""); names != "" {
+		query = "SELECT name, last_seen, COALESCE(config_acked_version, config_version), clock_offset_seconds FROM devices WHERE name = ANY(string_to_array($1, ',')) ORDER BY name"
+		args = append(args, strings.ReplaceAll(names, " ", ""))
+	}
+	rows, err := db.QueryContext(ctx, query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	offlineAfter := settingDuration("device_offline_after")
+	maxSkew := envDuration("PREFLIGHT_MAX_CLOCK_SKEW", time.Minute)
+	add := func(device, check string, ok bool, detail string) {
+		r.Checks = append(r.Checks, PreflightCheck{Device: device, Check: check, OK: ok, Detail: detail})
+		r.OK = r.OK && ok
+	}
+	for rows.Next() {
+		var name string
+		var lastSeen sql.NullTime
+		var version sql.NullString
+		var offset sql.NullInt64
+		if err := rows.Scan(&name, &lastSeen, &version, &offset); err != nil {
+			return nil, err
+		}
+
+		switch {
+		case !lastSeen.Valid:
+			add(name, "online", false, "never seen")
+		case now.Sub(lastSeen.Time) > offlineAfter:
+			add(name, "online", false, fmt.Sprintf("last seen %s ago", now.Sub(lastSeen.Time).Round(time.Minute)))
+		default:
+			add(name, "online", true, "")
+		}
+
+		if offset.Valid {
+			skew := time.Duration(math.Abs(float64(offset.Int64))) * time.Second
+			detail := ""
+			if offset.Int64 != 0 {
+				detail = fmt.Sprintf("clock is %ds off", offset.Int64)
+			}
+			add(name, "clock", skew <= maxSkew, detail)
+		}
+
+		if version.String == cfg.version() {
+			add(name, "config", true, "")
+		} else {
+			add(name, "config", false, fmt.Sprintf("holds configuration %q, current is %q", version.String, cfg.version()))
+		}
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	if len(r.Checks) == 0 {
+		add("", "online", false, "no alarm device has fetched the configuration")
+	}
+	return r, nil
+}
+
+// checkAlarmPreflight is the alarm_preflight job. It runs every minute and
+// checks each armed alarm once, as soon as it is less than preflight_lead
+// away.
+func checkAlarmPreflight() error {
+	now := time.Now()
+	alarm, err := currentAlarm()
+	if err == sql.ErrNoRows {
+		return nil
+	} else if err != nil {
+		return err
+	}
+	alarmAt, err := nextAlarmAt(alarm.Time, now)
+	if err != nil {
+		return err
+	}
+	skipped, err := nextAlarmSkipped(now)
+	if err != nil {
+		return err
+	}
+	if !alarm.Armed || skipped || maintenanceActive(now) || alarmAt.Sub(now) > settingDuration("preflight_lead") {
+		return nil
+	}
+	ctx := context.Background()
+	var done bool
+	if err := db.QueryRowContext(ctx, "SELECT EXISTS (SELECT 1 FROM alarm_preflights WHERE alarm_at = $1)", serverTime(alarmAt)).
+		Scan(&done); err != nil || done {
+		return err
+	}
+
+	r, err := runPreflight(ctx, now)
+	if err != nil {
+		return err
+	}
+	raw, err := json.Marshal(r)
+	if err != nil {
+		return err
+	}
+	if _, err := db.ExecContext(ctx, "DELETE FROM alarm_preflights WHERE alarm_at < $1", serverTime(alarmAt.AddDate(0, 0, -7))); err != nil {
+		return err
+	}
+	res, err := db.ExecContext(ctx, `
+		INSERT INTO alarm_preflights (alarm_at, result) VALUES ($1, $2) ON CONFLICT (alarm_at) DO NOTHING
+	`, serverTime(alarmAt), string(raw))
+	if err != nil {
+		return err
+	}
+	if n, _ := res.RowsAffected(); n == 0 || r.OK {
+		return nil
+	}
+
+	var failed []string
+	for _, check := range r.Checks {
+		if !check.OK {
+			failed = append(failed, strings.TrimSpace(check.Device+" "+check.Check+": "+check.Detail))
+		}
+	}
+	escalate(Notification{
+		Event:   "alarm",
+		Title:   "Alarm pre-flight check failed",
+		Message: fmt.Sprintf("The alarm at %s may not ring: %s", alarmAt.Format("15:04"), strings.Join(failed, "; ")),
+		Tags:    []string{"rotating_light"},
+	})
+	return nil
+}
+
+// getAlarmPreflight runs the checks now and returns them together with the
+// result of the last scheduled run.
+func getAlarmPreflight(c echo.Context) error {
+	r, err := runPreflight(c.Request().Context(), time.Now())
+	if err == sql.ErrNoRows {
+		return apiErrorCode(c, http.StatusNotFound, codeNoAlarm, "no alarm is set")
+	} else if err != nil {
+		return internalError(c, err)
+	}
+	last, err := lastPreflight(c.Request().Context())
+	if err != nil {
+		return internalError(c, err)
+	}
+	return c.JSON(http.StatusOK, map[string]interface{}{"current": r, "last_scheduled": last})
+}
@@ -0,0 +1,238 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"net"
+	"net/http"
+	"os"
+	"os/exec"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/labstack/echo/v4"
+)
+
+// Presence detection scans the LAN for the household's phones. Configure it
+// with PRESENCE_PEOPLE, a comma separated list of name=target pairs where the
+// target is an IP address or a MAC address, e.g.
+//
+//	PRESENCE_PEOPLE=marek=192.168.1.23,anna=aa:bb:cc:dd:ee:ff
+//
+// MAC targets are resolved through the kernel ARP table, so the container
+// needs to share the host network (network_mode: host) to see the LAN. The
+// entry of a sleeping phone expires, so when a MAC is missing from the
+// table the scan first sends a datagram to every address of the local
+// subnets, which makes the kernel ARP for them.
+// Phones drop off Wi-Fi while asleep, so a person is only marked away after
+// not being seen for PRESENCE_AWAY_AFTER.
+
+type Person struct {
+	Name     string    `json:"name"`
+	Home     bool      `json:"home"`
+	LastSeen time.Time `json:"last_seen"`
+	Since    time.Time `json:"since"` // when the current state began
+	target   string
+}
+
+type presenceTracker struct {
+	mu     sync.RWMutex
+	people map[string]*Person
+}
+
+var presence *presenceTracker
+
+func initPresence() {
+	spec := envString("PRESENCE_PEOPLE", "")
+	if spec == "" {
+		return
+	}
+
+	presence = &presenceTracker{people: make(map[string]*Person)}
+	now := time.Now()
+	for _, entry := range strings.Split(spec, ",") {
+		name, target, ok := strings.Cut(strings.TrimSpace(entry), "=")
+		if !ok || name == "" || target == "" {
+			continue
+		}
+		presence.people[name] = &Person{Name: name, Since: now, target: strings.ToLower(target)}
+	}
+
+	registerJob("presence_scan", "@every "+envDuration("PRESENCE_INTERVAL", 30*time.Second).String(), presence.scan)
+}
+
+func (p *presenceTracker) scan() error {
+	p.mu.RLock()
+	targets := make(map[string]string, len(p.people))
+	for name, person := range p.people {
+		targets[name] = person.target
+	}
+	p.mu.RUnlock()
+
+	arp := readARPTable()
+	for _, target := range targets {
+		if _, err := net.ParseMAC(target); err == nil && arp[target] == "" {
+			sweepSubnets()
+			arp = readARPTable()
+			break
+		}
+	}
+
+	seen := make(map[string]bool, len(targets))
+	for name, target := range targets {
+		ip := target
+		if _, err := net.ParseMAC(target); err == nil {
+			ip = arp[target]
+		}
+		seen[name] = ip != "" && ping(ip)
+	}
+
+	now := time.Now()
+	awayAfter := settingDuration("presence_away_after")
+	p.mu.Lock()
+	for name, ok := range seen {
+		person := p.people[name]
+		if ok {
+			person.LastSeen = now
+			if !person.Home {
+				person.Home = true
+				person.Since = now
+			}
+		} else if person.Home && now.Sub(person.LastSeen) > awayAfter {
+			person.Home = false
+			person.Since = now
+		}
+	}
+	p.mu.Unlock()
+	clusterSend(clusterMessage{Kind: "presence", People: p.People()})
+	return nil
+}
+
+// follow takes over the state the leader's scan found.
+func (p *presenceTracker) follow(people []Person) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	for _, state := range people {
+		if person, ok := p.people[state.Name]; ok {
+			person.Home, person.LastSeen, person.Since = state.Home, state.LastSeen, state.Since
+		}
+	}
+}
+
+// readARPTable maps MAC addresses to IPs from complete /proc/net/arp entries.
+func readARPTable() map[string]string {
+	table := make(map[string]string)
+	f, err := os.Open("/proc/net/arp")
+	if err != nil {
+		return table
+	}
+	defer f.Close()
+
+	scanner := bufio.NewScanner(f)
+	scanner.Scan() // header
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		// IP address, HW type, Flags, HW address, Mask, Device
+		if len(fields) < 4 || fields[2] == "0x0" {
+			continue
+		}
+		table[strings.ToLower(fields[3])] = fields[0]
+	}
+	return table
+}
+
+// sweepSubnets sends a datagram to the discard port of every address in the
+// local IPv4 subnets (up to /22) and gives the kernel a moment to resolve
+// them, so that the ARP table lists every device that answers ARP.
+func sweepSubnets() {
+	conn, err := net.ListenPacket("udp4", ":0")
+	if err != nil {
+		return
+	}
+	defer conn.Close()
+
+	ifaces, err := net.Interfaces()
+	if err != nil {
+		return
+	}
+	for _, iface := range ifaces {
+		if iface.Flags&net.FlagUp == 0 || iface.Flags&net.FlagLoopback != 0 {
+			continue
+		}
+		addrs, err := iface.Addrs()
+		if err != nil {
+			continue
+		}
+		for _, addr := range addrs {
+			ipNet, ok := addr.(*net.IPNet)
+			if !ok || ipNet.IP.To4() == nil {
+				continue
+			}
+			if ones, bits := ipNet.Mask.Size(); bits != 32 || ones < 22 || ones > 30 {
+				continue
+			}
+			network := ipNet.IP.To4().Mask(ipNet.Mask)
+			for ip := nextIP(network); ipNet.Contains(ip); ip = nextIP(ip) {
+				conn.WriteTo([]byte{0}, &net.UDPAddr{IP: ip, Port: 9})
+			}
+		}
+	}
+	time.Sleep(2 * time.Second)
+}
+
+func nextIP(ip net.IP) net.IP {
+	next := make(net.IP, len(ip))
+	copy(next, ip)
+	for i := len(next) - 1; i >= 0; i-- {
+		next[i]++
+		if next[i] != 0 {
+			break
+		}
+	}
+	return next
+}
+
+func ping(ip string) bool {
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+	return exec.CommandContext(ctx, "ping", "-c", "1", "-W", "2", ip).Run() == nil
+}
+
+// AnyoneHome reports whether at least one tracked person is home. Without
+// presence detection configured the house is assumed occupied.
+func (p *presenceTracker) AnyoneHome() bool {
+	if p == nil {
+		return true
+	}
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+	for _, person := range p.people {
+		if person.Home {
+			return true
+		}
+	}
+	return false
+}
+
+func (p *presenceTracker) People() []Person {
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+	people := make([]Person, 0, len(p.people))
+	for _, person := range p.people {
+		people = append(people, *person)
+	}
+	sort.Slice(people, func(i, j int) bool { return people[i].Name < people[j].Name })
+	return people
+}
+
+func getPresence(c echo.Context) error {
+	if presence == nil {
+		return apiErrorCode(c, http.StatusNotFound, codeNotConfigured, "presence detection is not configured")
+	}
+	return c.JSON(http.StatusOK, map[string]interface{}{
+		"anyone_home": presence.AnyoneHome(),
+		"people":      presence.People(),
+	})
+}
@@ -0,0 +1,343 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"sync"
+	"time"
+
+	"github.com/labstack/echo/v4"
+)
+
+// The pre-wake routine prepares the room before an armed alarm rings: the
+// alarm_prewake job starts it lead_minutes before the alarm and runs its
+// enabled steps in order, each delay_seconds after the previous one. A step
+// is one of
+//
+//   - webhook: POSTs body (JSON) to url, e.g. a Home Assistant webhook that
+//     ramps up a light or raises the thermostat
+//   - command: queues a device command (see commands.go), delivered with the
+//     device's next update
+//   - radio: queues play_stream on the device with the alarm stream (see
+//     streams.go) at volume percent, to start it quietly
+//
+// A routine stops when the alarm is disarmed or skipped in the meantime.
+// Routines are kept like alarm times, the latest one applies.
+
+const maxRoutineSteps = 20
+
+type RoutineStep struct {
+	Name         string          `json:"name"`
+	Action       string          `json:"action"` // webhook | command | radio
+	Enabled      bool            `json:"enabled"`
+	DelaySeconds int             `json:"delay_seconds"` // after the previous step
+	URL          string          `json:"url,omitempty"`
+	Body         json.RawMessage `json:"body,omitempty"`
+	Device       string          `json:"device,omitempty"`
+	Command      string          `json:"command,omitempty"`
+	Args         json.RawMessage `json:"args,omitempty"`
+	Volume       int             `json:"volume,omitempty"`
+}
+
+type AlarmRoutine struct {
+	Enabled     bool          `json:"enabled"`
+	LeadMinutes int           `json:"lead_minutes"`
+	Steps       []RoutineStep `json:"steps"`
+	UpdatedAt   *time.Time    `json:"updated_at,omitempty"`
+}
+
+type RoutineStepResult struct {
+	Name   string     `json:"name"`
+	Action string     `json:"action"`
+	At     *time.Time `json:"at,omitempty"`
+	OK     bool       `json:"ok"`
+	Error  string     `json:"error,omitempty"`
+}
+
+type RoutineRun struct {
+	AlarmAt   time.Time           `json:"alarm_at"`
+	StartedAt time.Time           `json:"started_at"`
+	Finished  bool                `json:"finished"`
+	Stopped   string              `json:"stopped,omitempty"` // why the routine did not finish
+	Steps     []RoutineStepResult `json:"steps"`
+}
+
+var (
+	routineMu      sync.Mutex
+	lastRoutineRun *RoutineRun
+)
+
+var routineClient = &http.Client{Timeout: 10 * time.Second}
+
+func loadAlarmRoutine(ctx context.Context) (AlarmRoutine, error) {
+	r := AlarmRoutine{LeadMinutes: 15, Steps: []RoutineStep{}}
+	var steps string
+	var updated time.Time
+	err := db.QueryRowContext(ctx, `
+		SELECT enabled, lead_minutes, steps::text, updated_at FROM alarm_routine ORDER BY id DESC LIMIT 1
+	`).Scan(&r.Enabled, &r.LeadMinutes, &steps, &updated)
+	if err == sql.ErrNoRows {
+		return r, nil
+	}
+	if err != nil {
+		return r, err
+	}
+	r.UpdatedAt = &updated
+	return r, json.Unmarshal([]byte(steps), &r.Steps)
+}
+
+// validateRoutineStep checks that a step has what its action needs.
+func validateRoutineStep(s RoutineStep) error {
+	if s.DelaySeconds < 0 || s.DelaySeconds > 3600 {
+		return fmt.Errorf("delay_seconds must be between 0 and 3600")
+	}
+	switch s.Action {
+	case "webhook":
+		if u, err := url.Parse(s.URL); err != nil || u.Scheme != "http" && u.Scheme != "https" || u.Host == "" {
+			return fmt.Errorf("a webhook step needs an http(s) url")
+		}
+		if len(s.Body) > 0 && !json.Valid(s.Body) {
+			return fmt.Errorf("the body of a webhook step must be JSON")
+		}
+	case "command":
+		spec, ok := deviceCommandSpecs[s.Command]
+		if !ok {
+			return fmt.Errorf("unknown command %q", s.Command)
+		}
+		if spec.destructive {
+			return fmt.Errorf("%s cannot be part of a routine", s.Command)
+		}
+		if err := validateCommandArgs(s.Command, s.Args); err != nil {
+			return err
+		}
+	case "radio":
+		if s.Volume < 0 || s.Volume > 100 {
+			return fmt.Errorf("volume must be between 0 and 100")
+		}
+	default:
+		return fmt.Errorf("action must be webhook, command or radio")
+	}
+	if s.Action != "webhook" && s.Device == "" {
+		return fmt.Errorf("a %s step needs a device", s.Action)
+	}
+	return nil
+}
+
+// runRoutineStep performs one step.
+func runRoutineStep(ctx context.Context, s RoutineStep) error {
+	if s.Action == "webhook" {
+		body := s.Body
+		if len(body) == 0 {
+			body = json.RawMessage("{}")
+		}
+		req, err := http.NewRequestWithContext(ctx, http.MethodPost, s.URL, bytes.NewReader(body))
+		if err != nil {
+			return err
+		}
+		req.Header.Set("Content-Type", "application/json")
+		resp, err := routineClient.Do(req)
+		if err != nil {
+			return err
+		}
+		resp.Body.Close()
+		if resp.StatusCode >= 300 {
+			return fmt.Errorf("webhook returned %s", resp.Status)
+		}
+		return nil
+	}
+
+	device, err := deviceIDByName(ctx, s.Device)
+	if err != nil {
+		return err
+	}
+	if s.Action == "command" {
+		var args interface{}
+		if len(s.Args) > 0 && string(s.Args) != "null" {
+			args = s.Args
+		}
+		_, err = queueCommand(device, s.Command, args)
+		return err
+	}
+	stream, _, err := deviceStreams(ctx)
+	if err != nil {
+		return err
+	}
+	if stream == "" {
+		return fmt.Errorf("no reachable alarm stream")
+	}
+	_, err = queueCommand(device, "play_stream", map[string]interface{}{"url": stream, "volume": s.Volume})
+	return err
+}
+
+// deviceIDByName returns the ID of a device by name.
+func deviceIDByName(ctx context.Context, name string) (int, error) {
+	var id int
+	err := db.QueryRowContext(ctx, "SELECT id FROM devices WHERE name = $1", name).Scan(&id)
+	if err == sql.ErrNoRows {
+		return 0, fmt.Errorf("no device %q", name)
+	}
+	return id, err
+}
+
+// alarmStillDue reports why the routine for alarmAt should stop, "" if it
+// should go on.
+func alarmStillDue(alarmAt, now time.Time) (string, error) {
+	alarm, err := currentAlarm()
+	if err != nil {
+		return "", err
+	}
+	if !alarm.Armed {
+		return "alarm disarmed", nil
+	}
+	next, err := nextAlarmAt(alarm.Time, now)
+	if err != nil {
+		return "", err
+	}
+	if !next.Equal(alarmAt) {
+		return "alarm changed or already rang", nil
+	}
+	skipped, err := nextAlarmSkipped(now)
+	if err != nil || !skipped {
+		return "", err
+	}
+	return "alarm skipped", nil
+}
+
+// runAlarmRoutine runs the enabled steps of a routine for the alarm at
+// alarmAt, recording the outcome in run.
+func runAlarmRoutine(ctx context.Context, routine AlarmRoutine, run *RoutineRun) {
+	for _, s := range routine.Steps {
+		if !s.Enabled {
+			continue
+		}
+		select {
+		case <-time.After(time.Duration(s.DelaySeconds) * time.Second):
+		case <-ctx.Done():
+			return
+		}
+		stop, err := alarmStillDue(run.AlarmAt, time.Now())
+		if err != nil {
+			log.Printf("Pre-wake routine: %v", err)
+		}
+		if stop != "" {
+			routineMu.Lock()
+			run.Stopped = stop
+			routineMu.Unlock()
+			return
+		}
+
+		at := time.Now()
+		result := RoutineStepResult{Name: s.Name, Action: s.Action, At: &at, OK: true}
+		if err := runRoutineStep(ctx, s); err != nil {
+			log.Printf("Pre-wake step %q failed: %v", s.Name, err)
+			result.OK, result.Error = false, err.Error()
+		}
+		routineMu.Lock()
+		run.Steps = append(run.Steps, result)
+		routineMu.Unlock()
+	}
+	routineMu.Lock()
+	run.Finished = true
+	routineMu.Unlock()
+}
+
+// startAlarmPrewake is the alarm_prewake job. It runs every minute and
+// starts the routine once per alarm, as soon as the alarm is less than
+// lead_minutes away.
+func startAlarmPrewake() error {
+	now := time.Now()
+	ctx := context.Background()
+	routine, err := loadAlarmRoutine(ctx)
+	if err != nil || !routine.Enabled {
+		return err
+	}
+	alarm, err := currentAlarm()
+	if err == sql.ErrNoRows {
+		return nil
+	} else if err != nil {
+		return err
+	}
+	alarmAt, err := nextAlarmAt(alarm.Time, now)
+	if err != nil {
+		return err
+	}
+	if !alarm.Armed || maintenanceActive(now) || alarmAt.Sub(now) > time.Duration(routine.LeadMinutes)*time.Minute {
+		return nil
+	}
+	if skipped, err := nextAlarmSkipped(now); err != nil || skipped {
+		return err
+	}
+
+	routineMu.Lock()
+	if lastRoutineRun != nil && lastRoutineRun.AlarmAt.Equal(alarmAt) {
+		routineMu.Unlock()
+		return nil
+	}
+	run := &RoutineRun{AlarmAt: alarmAt, StartedAt: now, Steps: []RoutineStepResult{}}
+	lastRoutineRun = run
+	routineMu.Unlock()
+
+	publish(EventAlarmPrewake, map[string]interface{}{"alarm_at": alarmAt, "steps": len(routine.Steps)})
+	runCtx, cancel := context.WithDeadline(ctx, alarmAt.Add(time.Hour))
+	go func() {
+		defer cancel()
+		runAlarmRoutine(runCtx, routine, run)
+	}()
+	return nil
+}
+
+// getAlarmRoutine returns the routine and how its last run went.
+func getAlarmRoutine(c echo.Context) error {
+	routine, err := loadAlarmRoutine(c.Request().Context())
+	if err != nil {
+		return internalError(c, err)
+	}
+	routineMu.Lock()
+	defer routineMu.Unlock()
+	return c.JSON(http.StatusOK, map[string]interface{}{"routine": routine, "last_run": lastRoutineRun})
+}
+
+// putAlarmRoutine replaces the routine, e.g. {"enabled": true,
+// "lead_minutes": 20, "steps": [{"name": "light", "action": "webhook",
+// "enabled": true, "url": "http://ha.local:8123/api/webhook/sunrise"},
+// {"name": "radio", "action": "radio", "enabled": true, "delay_seconds": 600,
+// "device": "bedroom", "volume": 10}]}.
+func putAlarmRoutine(c echo.Context) error {
+	var req AlarmRoutine
+	if err := c.Bind(&req); err != nil {
+		return invalidBody(c, err)
+	}
+	if req.LeadMinutes < 1 || req.LeadMinutes > 120 {
+		return apiError(c, http.StatusBadRequest, "lead_minutes must be between 1 and 120")
+	}
+	if len(req.Steps) > maxRoutineSteps {
+		return apiError(c, http.StatusBadRequest, fmt.Sprintf("a routine has at most %d steps", maxRoutineSteps))
+	}
+	if req.Steps == nil {
+		req.Steps = []RoutineStep{}
+	}
+	for i, s := range req.Steps {
+		if err := validateRoutineStep(s); err != nil {
+			return apiError(c, http.StatusBadRequest, fmt.Sprintf("step %d: %v", i+1, err))
+		}
+	}
+	steps, err := json.Marshal(req.Steps)
+	if err != nil {
+		return internalError(c, err)
+	}
+	now := time.Now()
+	_, err = db.ExecContext(c.Request().Context(), `
+		INSERT INTO alarm_routine (enabled, lead_minutes, steps, updated_at) VALUES ($1, $2, $3, $4)
+	`, req.Enabled, req.LeadMinutes, string(steps), now)
+	if err != nil {
+		return internalError(c, err)
+	}
+	req.UpdatedAt = &now
+	return c.JSON(http.StatusOK, req)
+}
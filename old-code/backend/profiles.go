@@ -0,0 +1,311 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"regexp"
+	"sort"
+	"time"
+
+	"github.com/labstack/echo/v4"
+)
+
+// A profile bundles settings (alarm, thresholds, quiet hours, ...), whether
+// the alarm is armed and the alert routing (alert_routing.go), for
+// situations like a guest staying over or a baby asleep in the bedroom.
+// POST /api/profiles/:name/activate applies it in one go; a profile with a
+// cron "schedule" is also activated by the profile_schedule job, e.g.
+// "0 19 * * *" for baby-sleeping every evening.
+//
+// normal, guest and baby-sleeping are built in and can be changed with PUT
+// /api/profiles/:name; deleting one of them restores its built-in version.
+// The built-in normal profile resets what the other two change to the
+// defaults, so edit it if the household's usual settings differ.
+// Activating a profile only applies it: settings changed afterwards stay
+// changed, and the active profile is the last one activated.
+
+var profileNamePattern = regexp.MustCompile(`^[a-z0-9][a-z0-9_-]{0,31}$`)
+
+type Profile struct {
+	Name       string                 `json:"name"`
+	Settings   map[string]interface{} `json:"settings"` // as PUT /api/settings; null resets one
+	AlarmArmed *bool                  `json:"alarm_armed,omitempty"`
+	Routes     []AlertRoute           `json:"routes,omitempty"` // replaces the alert routing when set
+	Schedule   string                 `json:"schedule,omitempty"`
+	BuiltIn    bool                   `json:"built_in"`
+	Active     bool                   `json:"active"`
+}
+
+type ProfileActivation struct {
+	Profile string    `json:"profile"`
+	At      time.Time `json:"at"`
+	Source  string    `json:"source"` // manual | schedule
+}
+
+func builtinProfiles() map[string]Profile {
+	armed := true
+	return map[string]Profile{
+		"normal": {Name: "normal", AlarmArmed: &armed, Settings: map[string]interface{}{
+			"quiet_hours": nil, "alarm_hard_mode": nil, "alarm_ring_push": nil, "noise_limit": nil, "sound_threshold": nil,
+		}},
+		"guest": {Name: "guest", Settings: map[string]interface{}{
+			"quiet_hours": "22:00-09:00", "alarm_hard_mode": false, "alarm_ring_push": false,
+		}},
+		"baby-sleeping": {Name: "baby-sleeping", Settings: map[string]interface{}{
+			"quiet_hours": "19:00-07:00", "alarm_ring_push": false, "noise_limit": 55, "sound_threshold": 85,
+		}},
+	}
+}
+
+// loadProfiles returns the built-in profiles with the stored ones over
+// them, by name.
+func loadProfiles(ctx context.Context) (map[string]Profile, error) {
+	profiles := builtinProfiles()
+	for name, p := range profiles {
+		p.BuiltIn = true
+		profiles[name] = p
+	}
+	rows, err := db.QueryContext(ctx, "SELECT name, settings::text, alarm_armed, routes::text, schedule FROM profiles")
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var p Profile
+		var settings string
+		var armed sql.NullBool
+		var routes sql.NullString
+		if err := rows.Scan(&p.Name, &settings, &armed, &routes, &p.Schedule); err != nil {
+			return nil, err
+		}
+		if err := json.Unmarshal([]byte(settings), &p.Settings); err != nil {
+			return nil, err
+		}
+		if armed.Valid {
+			p.AlarmArmed = &armed.Bool
+		}
+		if routes.Valid {
+			if err := json.Unmarshal([]byte(routes.String), &p.Routes); err != nil {
+				return nil, err
+			}
+		}
+		_, p.BuiltIn = profiles[p.Name]
+		profiles[p.Name] = p
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	last, err := lastProfileActivation(ctx)
+	if err != nil {
+		return nil, err
+	}
+	if p, ok := profiles[last.Profile]; ok {
+		p.Active = true
+		profiles[last.Profile] = p
+	}
+	return profiles, nil
+}
+
+func lastProfileActivation(ctx context.Context) (ProfileActivation, error) {
+	var a ProfileActivation
+	err := db.QueryRowContext(ctx, "SELECT profile, at, source FROM profile_activations ORDER BY id DESC LIMIT 1").
+		Scan(&a.Profile, &a.At, &a.Source)
+	if err == sql.ErrNoRows {
+		return a, nil
+	}
+	return a, err
+}
+
+// applyProfile applies a profile and records that it is active.
+func applyProfile(ctx context.Context, p Profile, source string, now time.Time) error {
+	values, err := parseSettingValues(p.Settings)
+	if err != nil {
+		return err
+	}
+	if err := saveSettings(values); err != nil {
+		return err
+	}
+	if p.AlarmArmed != nil {
+		current, err := currentAlarm()
+		if err != nil && err != sql.ErrNoRows {
+			return err
+		}
+		// Without an alarm set there is nothing to arm
+		if current.Configured && current.Armed != *p.AlarmArmed {
+			if _, err := setAlarmArmed(ctx, *p.AlarmArmed); err != nil {
+				return err
+			}
+		}
+	}
+	if p.Routes != nil {
+		routes, err := json.Marshal(p.Routes)
+		if err != nil {
+			return err
+		}
+		if _, err := db.ExecContext(ctx, "INSERT INTO alert_routing (routes, updated_at) VALUES ($1, $2)", string(routes), now); err != nil {
+			return err
+		}
+	}
+	_, err = db.ExecContext(ctx, "INSERT INTO profile_activations (profile, at, source) VALUES ($1, $2, $3)", p.Name, now, source)
+	if err != nil {
+		return err
+	}
+	publish(EventProfileChanged, ProfileActivation{Profile: p.Name, At: now, Source: source})
+	return nil
+}
+
+// activateScheduledProfiles is the profile_schedule job: it activates the
+// profiles whose schedule is due this minute.
+func activateScheduledProfiles() error {
+	ctx := context.Background()
+	profiles, err := loadProfiles(ctx)
+	if err != nil {
+		return err
+	}
+	now := time.Now()
+	for _, p := range profiles {
+		if p.Schedule == "" {
+			continue
+		}
+		s, err := parseSchedule(p.Schedule)
+		if err != nil {
+			continue // validated when stored
+		}
+		if cron, ok := s.(*cronSchedule); !ok || !cron.matches(now) {
+			continue
+		}
+		if err := applyProfile(ctx, p, "schedule", now); err != nil {
+			return fmt.Errorf("profile %s: %w", p.Name, err)
+		}
+		log.Printf("Activated profile %s on schedule", p.Name)
+	}
+	return nil
+}
+
+func validateProfile(p Profile) error {
+	if _, err := parseSettingValues(p.Settings); err != nil {
+		return err
+	}
+	for i, r := range p.Routes {
+		if err := validateAlertRoute(r); err != nil {
+			return fmt.Errorf("route %d: %v", i+1, err)
+		}
+	}
+	if p.Schedule != "" {
+		s, err := parseSchedule(p.Schedule)
+		if err != nil {
+			return err
+		}
+		if _, ok := s.(*cronSchedule); !ok {
+			return fmt.Errorf("schedule must be a cron expression")
+		}
+	}
+	return nil
+}
+
+// getProfiles lists the profiles, by name, and the last activation.
+func getProfiles(c echo.Context) error {
+	ctx := c.Request().Context()
+	profiles, err := loadProfiles(ctx)
+	if err != nil {
+		return internalError(c, err)
+	}
+	list := make([]Profile, 0, len(profiles))
+	for _, p := range profiles {
+		list = append(list, p)
+	}
+	sort.Slice(list, func(i, j int) bool { return list[i].Name < list[j].Name })
+	last, err := lastProfileActivation(ctx)
+	if err != nil {
+		return internalError(c, err)
+	}
+	response := map[string]interface{}{"profiles": list}
+	if last.Profile != "" {
+		response["last_activation"] = last
+	}
+	return c.JSON(http.StatusOK, response)
+}
+
+// putProfile creates or replaces a profile, e.g. {"settings":
+// {"quiet_hours": "19:00-07:00", "noise_limit": 55}, "alarm_armed": true,
+// "schedule": "0 19 * * *"}.
+func putProfile(c echo.Context) error {
+	name := c.Param("name")
+	if !profileNamePattern.MatchString(name) {
+		return apiError(c, http.StatusBadRequest, "name must be lower case letters, digits, - and _")
+	}
+	var req Profile
+	if err := c.Bind(&req); err != nil {
+		return invalidBody(c, err)
+	}
+	req.Name = name
+	if req.Settings == nil {
+		req.Settings = map[string]interface{}{}
+	}
+	if err := validateProfile(req); err != nil {
+		return apiError(c, http.StatusBadRequest, err.Error())
+	}
+	settings, err := json.Marshal(req.Settings)
+	if err != nil {
+		return internalError(c, err)
+	}
+	var routes interface{}
+	if req.Routes != nil {
+		b, err := json.Marshal(req.Routes)
+		if err != nil {
+			return internalError(c, err)
+		}
+		routes = string(b)
+	}
+	_, err = db.ExecContext(c.Request().Context(), `
+		INSERT INTO profiles (name, settings, alarm_armed, routes, schedule, updated_at) VALUES ($1, $2, $3, $4, $5, $6)
+		ON CONFLICT (name) DO UPDATE SET settings = EXCLUDED.settings, alarm_armed = EXCLUDED.alarm_armed,
+			routes = EXCLUDED.routes, schedule = EXCLUDED.schedule, updated_at = EXCLUDED.updated_at
+	`, name, string(settings), req.AlarmArmed, routes, req.Schedule, time.Now())
+	if err != nil {
+		return internalError(c, err)
+	}
+	profiles, err := loadProfiles(c.Request().Context())
+	if err != nil {
+		return internalError(c, err)
+	}
+	return c.JSON(http.StatusOK, profiles[name])
+}
+
+// deleteProfile removes a profile; a built-in one goes back to its
+// built-in version.
+func deleteProfile(c echo.Context) error {
+	res, err := db.ExecContext(c.Request().Context(), "DELETE FROM profiles WHERE name = $1", c.Param("name"))
+	if err != nil {
+		return internalError(c, err)
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		if _, builtIn := builtinProfiles()[c.Param("name")]; !builtIn {
+			return apiError(c, http.StatusNotFound, "profile not found")
+		}
+	}
+	return c.NoContent(http.StatusNoContent)
+}
+
+// activateProfile applies a profile now.
+func activateProfile(c echo.Context) error {
+	ctx := c.Request().Context()
+	profiles, err := loadProfiles(ctx)
+	if err != nil {
+		return internalError(c, err)
+	}
+	p, ok := profiles[c.Param("name")]
+	if !ok {
+		return apiError(c, http.StatusNotFound, "profile not found")
+	}
+	if err := applyProfile(ctx, p, "manual", time.Now()); err != nil {
+		return internalError(c, err)
+	}
+	p.Active = true
+	return c.JSON(http.StatusOK, p)
+}
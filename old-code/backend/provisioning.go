@@ -0,0 +1,217 @@
+package main
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"database/sql"
+	"encoding/hex"
+	"fmt"
+	"math/big"
+	"net"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/labstack/echo/v4"
+)
+
+// Adding a device: an admin asks for a pairing code with
+// POST /api/devices/provision ({"name": "kitchen", "room": "kitchen"}, both
+// optional), types it into the new node's setup portal, and the firmware
+// claims its device record with POST /api/device/claim
+// ({"code": "12345678", "mac": "24:6f:28:aa:bb:cc"}). The response carries
+// the device's name and its API key, which the firmware sends from then on
+// as an X-Device-Key header. A code is valid for DEVICE_PAIRING_TTL and
+// can be used once; claiming again from the same MAC with a new code
+// replaces the key.
+//
+// Devices with a key must send it on updates, heartbeats and logs, and
+// when they fetch the alarm sound or the briefing. With
+// DEVICE_KEYS_REQUIRED=true, devices without one are refused too. Claims
+// are limited to DEVICE_CLAIM_RATE_LIMIT a minute per client address, which
+// comes from X-Forwarded-For only behind TRUSTED_PROXIES, so pairing codes
+// cannot be guessed.
+
+type PairingCode struct {
+	Code      string    `json:"code"`
+	Name      string    `json:"name,omitempty"`
+	Room      string    `json:"room,omitempty"`
+	ExpiresAt time.Time `json:"expires_at"`
+}
+
+func hashDeviceKey(key string) string {
+	sum := sha256.Sum256([]byte(key))
+	return hex.EncodeToString(sum[:])
+}
+
+// deviceKeyValid checks the key a device request carries against the
+// device it names.
+func deviceKeyValid(c echo.Context, name string) bool {
+	if name == "" {
+		name = "default"
+	}
+	var hash sql.NullString
+	err := db.QueryRowContext(c.Request().Context(), "SELECT api_key_hash FROM devices WHERE name = $1", name).Scan(&hash)
+	if err != nil && err != sql.ErrNoRows {
+		return false
+	}
+	if !hash.Valid {
+		return !envBool("DEVICE_KEYS_REQUIRED", false)
+	}
+	return subtle.ConstantTimeCompare([]byte(hashDeviceKey(requestDeviceKey(c))), []byte(hash.String)) == 1
+}
+
+func requestDeviceKey(c echo.Context) string {
+	key := c.Request().Header.Get("X-Device-Key")
+	if key == "" {
+		key, _ = strings.CutPrefix(c.Request().Header.Get(echo.HeaderAuthorization), "Bearer ")
+	}
+	return key
+}
+
+// requireDeviceKey guards the device endpoints without a body: the key must
+// be that of the device in ?device=, or of any device without it. A request
+// without a key passes only while no device has one and
+// DEVICE_KEYS_REQUIRED is off, like an unpaired device's update.
+func requireDeviceKey(next echo.HandlerFunc) echo.HandlerFunc {
+	return func(c echo.Context) error {
+		if name := c.QueryParam("device"); name != "" {
+			if !deviceKeyValid(c, name) {
+				return deviceKeyError(c)
+			}
+			return next(c)
+		}
+		var valid bool
+		var err error
+		if key := requestDeviceKey(c); key != "" {
+			err = db.QueryRowContext(c.Request().Context(),
+				"SELECT EXISTS (SELECT 1 FROM devices WHERE api_key_hash = $1)", hashDeviceKey(key)).Scan(&valid)
+		} else if !envBool("DEVICE_KEYS_REQUIRED", false) {
+			err = db.QueryRowContext(c.Request().Context(),
+				"SELECT NOT EXISTS (SELECT 1 FROM devices WHERE api_key_hash IS NOT NULL)").Scan(&valid)
+		}
+		if err != nil {
+			return internalError(c, err)
+		}
+		if !valid {
+			return deviceKeyError(c)
+		}
+		return next(c)
+	}
+}
+
+func deviceKeyError(c echo.Context) error {
+	return apiError(c, http.StatusUnauthorized, "missing or invalid device key")
+}
+
+func provisionDevice(c echo.Context) error {
+	var req struct {
+		Name string `json:"name"`
+		Room string `json:"room"`
+	}
+	if err := c.Bind(&req); err != nil {
+		return invalidBody(c, err)
+	}
+	if req.Name != "" && !derivedNamePattern.MatchString(req.Name) {
+		return apiError(c, http.StatusBadRequest, "name must be lower case letters, digits and underscores")
+	}
+	n, err := rand.Int(rand.Reader, big.NewInt(100000000))
+	if err != nil {
+		return internalError(c, err)
+	}
+	p := PairingCode{
+		Code:      fmt.Sprintf("%08d", n.Int64()),
+		Name:      req.Name,
+		Room:      req.Room,
+		ExpiresAt: time.Now().Add(envDuration("DEVICE_PAIRING_TTL", 15*time.Minute)),
+	}
+	ctx := c.Request().Context()
+	if _, err := db.ExecContext(ctx, "DELETE FROM device_pairing_codes WHERE expires_at < $1", time.Now()); err != nil {
+		return internalError(c, err)
+	}
+	_, err = db.ExecContext(ctx, `
+		INSERT INTO device_pairing_codes (code_hash, name, room, expires_at) VALUES ($1, $2, $3, $4)
+	`, hashDeviceKey(p.Code), p.Name, p.Room, p.ExpiresAt)
+	if err != nil {
+		return internalError(c, err)
+	}
+	return c.JSON(http.StatusCreated, p)
+}
+
+var claimLimiter clientLimiter
+
+func claimDevice(c echo.Context) error {
+	if !claimLimiter.allow(c.RealIP(), time.Now(), envInt("DEVICE_CLAIM_RATE_LIMIT", 10)) {
+		c.Response().Header().Set("Retry-After", "60")
+		return apiError(c, http.StatusTooManyRequests, "too many requests")
+	}
+	var req struct {
+		Code string `json:"code"`
+		MAC  string `json:"mac"`
+	}
+	if err := c.Bind(&req); err != nil {
+		return invalidBody(c, err)
+	}
+	hw, err := net.ParseMAC(req.MAC)
+	if err != nil {
+		return apiError(c, http.StatusBadRequest, "invalid mac")
+	}
+	mac := hw.String()
+	ctx := c.Request().Context()
+	now := time.Now()
+
+	tx, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		return internalError(c, err)
+	}
+	defer tx.Rollback()
+
+	var name, room string
+	err = tx.QueryRowContext(ctx, `
+		DELETE FROM device_pairing_codes WHERE code_hash = $1 AND expires_at > $2
+		RETURNING name, room
+	`, hashDeviceKey(req.Code), now).Scan(&name, &room)
+	if err == sql.ErrNoRows {
+		return apiError(c, http.StatusForbidden, "invalid or expired pairing code")
+	} else if err != nil {
+		return internalError(c, err)
+	}
+	if name == "" {
+		name = "node_" + strings.ReplaceAll(mac[9:], ":", "")
+	}
+	if room == "" {
+		room = envString("DEFAULT_ROOM", "bedroom")
+	}
+
+	// A node that was paired before keeps its record and history
+	key := randomHex(24)
+	device := DeviceInfo{Name: name, Room: room}
+	err = tx.QueryRowContext(ctx, `
+		UPDATE devices SET api_key_hash = $2 WHERE mac = $1 RETURNING id, name, room
+	`, mac, hashDeviceKey(key)).Scan(&device.ID, &device.Name, &device.Room)
+	if err == sql.ErrNoRows {
+		err = tx.QueryRowContext(ctx, `
+			INSERT INTO devices (name, room, mac, api_key_hash) VALUES ($1, $2, $3, $4)
+			ON CONFLICT (name) DO UPDATE SET mac = EXCLUDED.mac, api_key_hash = EXCLUDED.api_key_hash
+				WHERE devices.mac IS NULL
+			RETURNING id, room
+		`, name, room, mac, hashDeviceKey(key)).Scan(&device.ID, &device.Room)
+		if err == sql.ErrNoRows {
+			return apiError(c, http.StatusConflict, fmt.Sprintf("device %s belongs to another node", name))
+		}
+	}
+	if err != nil {
+		return internalError(c, err)
+	}
+	if err := tx.Commit(); err != nil {
+		return internalError(c, err)
+	}
+
+	return c.JSON(http.StatusOK, map[string]interface{}{
+		"device_id": device.ID,
+		"device":    device.Name,
+		"room":      device.Room,
+		"api_key":   key,
+	})
+}
@@ -0,0 +1,167 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"encoding/hex"
+	htmltemplate "html/template"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/labstack/echo/v4"
+)
+
+// GET /status is a glance for guests and embeddable widgets: per room
+// whether the sensors are online and a coarse air quality band, nothing
+// else. It needs no login, is served as JSON or, to browsers, as a small
+// page, and is rate limited to STATUS_RATE_LIMIT requests a minute per
+// client. STATUS_PAGE=false turns it off.
+
+type PublicRoomStatus struct {
+	Room   string `json:"room"`
+	Online bool   `json:"online"`
+	Air    string `json:"air"` // good | fair | poor | unknown
+}
+
+type PublicStatus struct {
+	Rooms     []PublicRoomStatus `json:"rooms"`
+	UpdatedAt time.Time          `json:"updated_at"`
+}
+
+var statusPage = htmltemplate.Must(htmltemplate.New("status.html").ParseFS(templates, "templates/status.html"))
+
+// airBand buckets a CO2 reading: good below co2_band_yellow, poor from
+// co2_band_red. Devices get the same bands as traffic light colors (see
+// deviceCO2Band).
+func airBand(co2 float64) string {
+	switch {
+	case co2 <= 0:
+		return "unknown"
+	case co2 < settingFloat("co2_band_yellow"):
+		return "good"
+	case co2 < settingFloat("co2_band_red"):
+		return "fair"
+	default:
+		return "poor"
+	}
+}
+
+// A clientLimiter counts requests per client in fixed one minute windows.
+type clientLimiter struct {
+	sync.Mutex
+	window time.Time
+	counts map[string]int
+}
+
+func (l *clientLimiter) allow(client string, now time.Time, limit int) bool {
+	l.Lock()
+	defer l.Unlock()
+	if window := now.Truncate(time.Minute); !window.Equal(l.window) || l.counts == nil {
+		l.window = window
+		l.counts = make(map[string]int)
+	}
+	l.counts[client]++
+	return l.counts[client] <= limit
+}
+
+var statusLimiter clientLimiter
+
+func statusAllowed(client string, now time.Time) bool {
+	return statusLimiter.allow(client, now, envInt("STATUS_RATE_LIMIT", 30))
+}
+
+// RoomReading is the latest state of a room: online if any of its devices
+// is, with the worst CO2 and loudest sound among them. Rooms without a
+// reading from the last device_offline_after have zero values.
+type RoomReading struct {
+	Room     string
+	Online   bool
+	CO2      float64
+	Sound    float64
+	LastSeen time.Time
+}
+
+// roomEndpointID identifies a room to voice assistants, whose device IDs
+// may not contain spaces or most punctuation; room names may.
+func roomEndpointID(room string) string {
+	return "room-" + hex.EncodeToString([]byte(room))
+}
+
+// roomReadings lists the rooms by name; devices without one are "home".
+func roomReadings(ctx context.Context, now time.Time) ([]RoomReading, error) {
+	offlineAfter := settingDuration("device_offline_after")
+	rows, err := db.QueryContext(ctx, `
+		SELECT COALESCE(NULLIF(d.room, ''), 'home'), d.last_seen,
+			(SELECT co2_level FROM sensor_data s
+			 WHERE s.device_id = d.id AND s.co2_level != 0 AND s.timestamp >= $1
+			 ORDER BY s.timestamp DESC LIMIT 1),
+			(SELECT sound_level FROM sensor_data s
+			 WHERE s.device_id = d.id AND s.timestamp >= $1
+			 ORDER BY s.timestamp DESC LIMIT 1)
+		FROM devices d
+		ORDER BY 1
+	`, now.Add(-offlineAfter))
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var readings []RoomReading
+	for rows.Next() {
+		var room string
+		var lastSeen sql.NullTime
+		var co2, sound sql.NullFloat64
+		if err := rows.Scan(&room, &lastSeen, &co2, &sound); err != nil {
+			return nil, err
+		}
+		n := len(readings)
+		if n == 0 || readings[n-1].Room != room {
+			readings = append(readings, RoomReading{Room: room})
+			n++
+		}
+		r := &readings[n-1]
+		r.Online = r.Online || lastSeen.Valid && now.Sub(lastSeen.Time) <= offlineAfter
+		r.CO2, r.Sound = max(r.CO2, co2.Float64), max(r.Sound, sound.Float64)
+		if lastSeen.Time.After(r.LastSeen) {
+			r.LastSeen = lastSeen.Time
+		}
+	}
+	return readings, rows.Err()
+}
+
+func loadPublicStatus(c echo.Context, now time.Time) (PublicStatus, error) {
+	readings, err := roomReadings(c.Request().Context(), now)
+	if err != nil {
+		return PublicStatus{}, err
+	}
+	status := PublicStatus{Rooms: []PublicRoomStatus{}, UpdatedAt: now.Truncate(time.Minute)}
+	for _, r := range readings {
+		status.Rooms = append(status.Rooms, PublicRoomStatus{Room: r.Room, Online: r.Online, Air: airBand(r.CO2)})
+	}
+	return status, nil
+}
+
+func getPublicStatus(c echo.Context) error {
+	if !envBool("STATUS_PAGE", true) {
+		return c.NoContent(http.StatusNotFound)
+	}
+	now := time.Now()
+	if !statusAllowed(c.RealIP(), now) {
+		c.Response().Header().Set("Retry-After", "60")
+		return apiError(c, http.StatusTooManyRequests, "too many requests")
+	}
+
+	status, err := loadPublicStatus(c, now)
+	if err != nil {
+		return apiError(c, http.StatusInternalServerError, "status unavailable")
+	}
+	c.Response().Header().Set("Cache-Control", "public, max-age=60")
+	if strings.Contains(c.Request().Header.Get("Accept"), "text/html") {
+		c.Response().Header().Set(echo.HeaderContentType, echo.MIMETextHTMLCharsetUTF8)
+		c.Response().WriteHeader(http.StatusOK)
+		return statusPage.Execute(c.Response(), status)
+	}
+	return c.JSON(http.StatusOK, status)
+}
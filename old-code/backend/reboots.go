@@ -0,0 +1,167 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/labstack/echo/v4"
+)
+
+// A device rebooted when its uptime_seconds is lower than the previous
+// report plus the time since. The reboot is expected when a reboot or
+// factory_reset command was delivered since the previous report, or the
+// firmware reports "reset_reason": "ota". REBOOT_FLAP_COUNT unexpected
+// reboots within an hour mean the device is boot-looping, which is
+// notified at most once an hour.
+
+type Reboot struct {
+	At           time.Time `json:"at"`
+	UptimeBefore float64   `json:"uptime_before"` // seconds, at the last report before the reboot
+	Expected     bool      `json:"expected"`
+	Reason       string    `json:"reason,omitempty"`
+}
+
+// Allowed drift between the device's uptime and the server clock.
+const uptimeSlack = 60 * time.Second
+
+var (
+	rebootFlapMu       sync.Mutex
+	rebootFlapNotified = make(map[int]time.Time)
+)
+
+// detectReboot compares a reported uptime with the previous one. It must
+// run before the new uptime sample is stored.
+func detectReboot(ctx context.Context, device DeviceInfo, uptime float64, resetReason string, now time.Time) error {
+	var prev float64
+	var prevAt time.Time
+	err := db.QueryRowContext(ctx, `
+		SELECT value, timestamp FROM metric_samples
+		WHERE device_id = $1 AND metric = 'uptime_seconds'
+		ORDER BY timestamp DESC LIMIT 1
+	`, device.ID).Scan(&prev, &prevAt)
+	if err == sql.ErrNoRows {
+		return nil
+	} else if err != nil {
+		return err
+	}
+	expectedUptime := prev + now.Sub(prevAt).Seconds()
+	if uptime >= expectedUptime-uptimeSlack.Seconds() {
+		return nil
+	}
+
+	r := Reboot{At: now.Add(-time.Duration(uptime) * time.Second), UptimeBefore: prev, Reason: resetReason}
+	var commanded bool
+	err = db.QueryRowContext(ctx, `
+		SELECT EXISTS (
+			SELECT 1 FROM device_commands
+			WHERE device_id = $1 AND command IN ('reboot', 'factory_reset') AND delivered_at >= $2
+		)
+	`, device.ID, prevAt).Scan(&commanded)
+	if err != nil {
+		return err
+	}
+	switch {
+	case commanded:
+		r.Expected, r.Reason = true, "command"
+	case resetReason == "ota":
+		r.Expected = true
+	case maintenanceActive(now):
+		r.Expected, r.Reason = true, "maintenance"
+	}
+	if _, err := db.ExecContext(ctx, `
+		INSERT INTO device_reboots (device_id, at, uptime_before, expected, reason) VALUES ($1, $2, $3, $4, NULLIF($5, ''))
+	`, device.ID, r.At, r.UptimeBefore, r.Expected, r.Reason); err != nil {
+		return err
+	}
+	publish(EventDeviceRebooted, map[string]interface{}{"device": device.Name, "at": r.At, "expected": r.Expected, "reason": r.Reason})
+	if r.Expected {
+		return nil
+	}
+	log.Printf("Device %s rebooted unexpectedly (reason %q)", device.Name, resetReason)
+	return checkRebootFlapping(ctx, device, now)
+}
+
+func checkRebootFlapping(ctx context.Context, device DeviceInfo, now time.Time) error {
+	var n int
+	err := db.QueryRowContext(ctx, `
+		SELECT COUNT(*) FROM device_reboots WHERE device_id = $1 AND NOT expected AND at > $2
+	`, device.ID, now.Add(-time.Hour)).Scan(&n)
+	if err != nil {
+		return err
+	}
+	if n < envInt("REBOOT_FLAP_COUNT", 3) {
+		return nil
+	}
+	rebootFlapMu.Lock()
+	recent := now.Sub(rebootFlapNotified[device.ID]) < time.Hour
+	if !recent {
+		rebootFlapNotified[device.ID] = now
+	}
+	rebootFlapMu.Unlock()
+	if recent {
+		return nil
+	}
+	notify(Notification{
+		Event:    "device.rebooted",
+		Title:    fmt.Sprintf("%s is boot-looping", device.Name),
+		Message:  fmt.Sprintf("The device rebooted unexpectedly %d times in the last hour.", n),
+		Priority: 4,
+		Tags:     []string{"warning", "repeat"},
+	})
+	return nil
+}
+
+// getDeviceReboots lists the reboots of the last ?days (default 7) with
+// counts for the last hour and day.
+func getDeviceReboots(c echo.Context) error {
+	device, err := deviceFromParam(c)
+	if err != nil {
+		return handlerError(c, err)
+	}
+	days := 7
+	if v := c.QueryParam("days"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 1 || n > 365 {
+			return apiError(c, http.StatusBadRequest, "days must be between 1 and 365")
+		}
+		days = n
+	}
+
+	now := time.Now()
+	rows, err := db.QueryContext(c.Request().Context(), `
+		SELECT at, uptime_before, expected, COALESCE(reason, '')
+		FROM device_reboots WHERE device_id = $1 AND at > $2
+		ORDER BY at DESC
+	`, device.ID, now.AddDate(0, 0, -days))
+	if err != nil {
+		return internalError(c, err)
+	}
+	defer rows.Close()
+
+	reboots := []Reboot{}
+	counts := map[string]int{"last_hour": 0, "last_day": 0, "unexpected": 0, "total": 0}
+	for rows.Next() {
+		var r Reboot
+		if err := rows.Scan(&r.At, &r.UptimeBefore, &r.Expected, &r.Reason); err != nil {
+			return internalError(c, err)
+		}
+		reboots = append(reboots, r)
+		counts["total"]++
+		if !r.Expected {
+			counts["unexpected"]++
+		}
+		if now.Sub(r.At) < time.Hour {
+			counts["last_hour"]++
+		}
+		if now.Sub(r.At) < 24*time.Hour {
+			counts["last_day"]++
+		}
+	}
+	return c.JSON(http.StatusOK, map[string]interface{}{"device": device.Name, "counts": counts, "reboots": reboots})
+}
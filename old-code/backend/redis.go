@@ -0,0 +1,206 @@
+package main
+
+import (
+	"bufio"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// redisClient is a minimal Redis (RESP2) client over one connection, which
+// is redialled after an error. It sends commands one at a time, which is all
+// the cache and the cluster need. URLs are redis://[:password@]host:6379[/db] or rediss://
+// for TLS.
+
+var errRedisNil = errors.New("redis: nil")
+
+type redisClient struct {
+	url *url.URL
+
+	mu   sync.Mutex
+	conn net.Conn
+	r    *bufio.Reader
+}
+
+func newRedisClient(rawURL string) (*redisClient, error) {
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return nil, err
+	}
+	if u.Scheme != "redis" && u.Scheme != "rediss" {
+		return nil, fmt.Errorf("unsupported Redis scheme %q", u.Scheme)
+	}
+	return &redisClient{url: u}, nil
+}
+
+// redisDial connects and authenticates a new connection.
+func redisDial(u *url.URL) (net.Conn, *bufio.Reader, error) {
+	dialer := &net.Dialer{Timeout: 5 * time.Second}
+	var conn net.Conn
+	var err error
+	if u.Scheme == "rediss" {
+		conn, err = tls.DialWithDialer(dialer, "tcp", hostWithPort(u, "6379"), &tls.Config{ServerName: u.Hostname()})
+	} else {
+		conn, err = dialer.Dial("tcp", hostWithPort(u, "6379"))
+	}
+	if err != nil {
+		return nil, nil, err
+	}
+	r := bufio.NewReader(conn)
+	var setup [][]string
+	if u.User != nil {
+		if password, ok := u.User.Password(); ok {
+			if name := u.User.Username(); name != "" {
+				setup = append(setup, []string{"AUTH", name, password})
+			} else {
+				setup = append(setup, []string{"AUTH", password})
+			}
+		}
+	}
+	if db := strings.Trim(u.Path, "/"); db != "" {
+		setup = append(setup, []string{"SELECT", db})
+	}
+	for _, args := range setup {
+		conn.SetDeadline(time.Now().Add(5 * time.Second))
+		if err := redisWrite(conn, args); err == nil {
+			_, err = redisRead(r)
+		}
+		if err != nil {
+			conn.Close()
+			return nil, nil, fmt.Errorf("redis %s: %w", args[0], err)
+		}
+	}
+	return conn, r, nil
+}
+
+// do sends a command and returns its reply: a string, an int64, nil for a
+// nil reply or a []interface{} for arrays.
+func (c *redisClient) do(args ...string) (interface{}, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.conn == nil {
+		conn, r, err := redisDial(c.url)
+		if err != nil {
+			return nil, err
+		}
+		c.conn, c.r = conn, r
+	}
+	c.conn.SetDeadline(time.Now().Add(2 * time.Second))
+	err := redisWrite(c.conn, args)
+	var reply interface{}
+	if err == nil {
+		reply, err = redisRead(c.r)
+	}
+	var replyErr redisError
+	if err != nil && !errors.As(err, &replyErr) {
+		c.conn.Close()
+		c.conn = nil
+	}
+	return reply, err
+}
+
+// get returns a key's value, errRedisNil if it does not exist.
+func (c *redisClient) get(key string) (string, error) {
+	reply, err := c.do("GET", key)
+	if err != nil {
+		return "", err
+	}
+	s, ok := reply.(string)
+	if !ok {
+		return "", errRedisNil
+	}
+	return s, nil
+}
+
+type redisError string
+
+func (e redisError) Error() string { return "redis: " + string(e) }
+
+func redisWrite(w io.Writer, args []string) error {
+	var b strings.Builder
+	fmt.Fprintf(&b, "*%d\r\n", len(args))
+	for _, a := range args {
+		fmt.Fprintf(&b, "$%d\r\n%s\r\n", len(a), a)
+	}
+	_, err := io.WriteString(w, b.String())
+	return err
+}
+
+func redisRead(r *bufio.Reader) (interface{}, error) {
+	line, err := r.ReadString('\n')
+	if err != nil {
+		return nil, err
+	}
+	line = strings.TrimSuffix(line, "\r\n")
+	if line == "" {
+		return nil, fmt.Errorf("redis: empty reply")
+	}
+	switch line[0] {
+	case '+':
+		return line[1:], nil
+	case '-':
+		return nil, redisError(line[1:])
+	case ':':
+		return strconv.ParseInt(line[1:], 10, 64)
+	case '$':
+		n, err := strconv.Atoi(line[1:])
+		if err != nil || n < 0 {
+			return nil, err
+		}
+		buf := make([]byte, n+2)
+		if _, err := io.ReadFull(r, buf); err != nil {
+			return nil, err
+		}
+		return string(buf[:n]), nil
+	case '*':
+		n, err := strconv.Atoi(line[1:])
+		if err != nil || n < 0 {
+			return nil, err
+		}
+		items := make([]interface{}, n)
+		for i := range items {
+			if items[i], err = redisRead(r); err != nil {
+				var replyErr redisError
+				if !errors.As(err, &replyErr) {
+					return nil, err
+				}
+			}
+		}
+		return items, nil
+	}
+	return nil, fmt.Errorf("redis: unexpected reply %q", line)
+}
+
+// redisSubscribe listens on a channel over a connection of its own and
+// calls fn with each message until the connection fails.
+func redisSubscribe(u *url.URL, channel string, fn func(payload string)) error {
+	conn, r, err := redisDial(u)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Time{})
+	if err := redisWrite(conn, []string{"SUBSCRIBE", channel}); err != nil {
+		return err
+	}
+	for {
+		reply, err := redisRead(r)
+		if err != nil {
+			return err
+		}
+		msg, ok := reply.([]interface{})
+		if !ok || len(msg) != 3 || msg[0] != "message" {
+			continue
+		}
+		if payload, ok := msg[2].(string); ok {
+			fn(payload)
+		}
+	}
+}
@@ -0,0 +1,120 @@
+package main
+
+import (
+	"database/sql"
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/labstack/echo/v4"
+)
+
+// ReportingConfig sets how often a device samples its sensors and reports.
+// It is sent in every update response as "report_interval" and
+// "sample_interval" (seconds). While the latest reading of FastMetric is
+// above FastAbove the device reports every FastIntervalSeconds instead, so
+// the data gets finer while something is happening. A zero fast interval
+// disables that.
+type ReportingConfig struct {
+	DeviceID              int     `json:"device_id"`
+	ReportIntervalSeconds int     `json:"report_interval_seconds"`
+	SampleIntervalSeconds int     `json:"sample_interval_seconds"`
+	FastIntervalSeconds   int     `json:"fast_interval_seconds"`
+	FastMetric            string  `json:"fast_metric"`
+	FastAbove             float64 `json:"fast_above"`
+}
+
+func defaultReportingConfig(deviceID int) ReportingConfig {
+	report := int(envDuration("DEVICE_REPORT_INTERVAL", 5*time.Minute).Seconds())
+	return ReportingConfig{
+		DeviceID:              deviceID,
+		ReportIntervalSeconds: report,
+		SampleIntervalSeconds: min(report, 10),
+		FastIntervalSeconds:   0,
+		FastMetric:            "co2",
+		FastAbove:             900,
+	}
+}
+
+func loadReportingConfig(deviceID int) (ReportingConfig, error) {
+	cfg := defaultReportingConfig(deviceID)
+	err := db.QueryRow(`
+		SELECT report_interval_seconds, sample_interval_seconds, fast_interval_seconds, fast_metric, fast_above
+		FROM device_reporting WHERE device_id = $1
+	`, deviceID).Scan(&cfg.ReportIntervalSeconds, &cfg.SampleIntervalSeconds, &cfg.FastIntervalSeconds,
+		&cfg.FastMetric, &cfg.FastAbove)
+	if err == sql.ErrNoRows {
+		return cfg, nil
+	}
+	return cfg, err
+}
+
+// reportInterval picks the interval for the device's latest readings.
+func (cfg ReportingConfig) reportInterval(readings map[string]float64) int {
+	if cfg.FastIntervalSeconds > 0 && readings[cfg.FastMetric] > cfg.FastAbove {
+		return cfg.FastIntervalSeconds
+	}
+	return cfg.ReportIntervalSeconds
+}
+
+func getReportingConfig(c echo.Context) error {
+	device, err := deviceFromParam(c)
+	if err != nil {
+		return handlerError(c, err)
+	}
+	cfg, err := loadReportingConfig(device.ID)
+	if err != nil {
+		return internalError(c, err)
+	}
+	return c.JSON(http.StatusOK, cfg)
+}
+
+func putReportingConfig(c echo.Context) error {
+	device, err := deviceFromParam(c)
+	if err != nil {
+		return handlerError(c, err)
+	}
+	cfg := defaultReportingConfig(device.ID)
+	if err := c.Bind(&cfg); err != nil {
+		return invalidBody(c, err)
+	}
+	cfg.DeviceID = device.ID
+	if err := cfg.validate(); err != nil {
+		return apiError(c, http.StatusBadRequest, err.Error())
+	}
+	if err := storeReportingConfig(cfg); err != nil {
+		return internalError(c, err)
+	}
+	return c.JSON(http.StatusOK, cfg)
+}
+
+func (cfg ReportingConfig) validate() error {
+	if cfg.ReportIntervalSeconds < 5 || cfg.SampleIntervalSeconds < 1 {
+		return fmt.Errorf("report_interval_seconds must be at least 5 and sample_interval_seconds at least 1")
+	}
+	if cfg.SampleIntervalSeconds > cfg.ReportIntervalSeconds {
+		return fmt.Errorf("sample_interval_seconds must not exceed report_interval_seconds")
+	}
+	if cfg.FastIntervalSeconds != 0 && (cfg.FastIntervalSeconds < 5 || cfg.FastIntervalSeconds > cfg.ReportIntervalSeconds) {
+		return fmt.Errorf("fast_interval_seconds must be 0 or between 5 and report_interval_seconds")
+	}
+	if _, ok := metricColumns[cfg.FastMetric]; !ok {
+		return fmt.Errorf("unknown fast_metric %s", cfg.FastMetric)
+	}
+	return nil
+}
+
+func storeReportingConfig(cfg ReportingConfig) error {
+	_, err := db.Exec(`
+		INSERT INTO device_reporting
+		(device_id, report_interval_seconds, sample_interval_seconds, fast_interval_seconds, fast_metric, fast_above)
+		VALUES ($1, $2, $3, $4, $5, $6)
+		ON CONFLICT (device_id) DO UPDATE
+		SET report_interval_seconds = EXCLUDED.report_interval_seconds,
+			sample_interval_seconds = EXCLUDED.sample_interval_seconds,
+			fast_interval_seconds = EXCLUDED.fast_interval_seconds,
+			fast_metric = EXCLUDED.fast_metric, fast_above = EXCLUDED.fast_above
+	`, cfg.DeviceID, cfg.ReportIntervalSeconds, cfg.SampleIntervalSeconds, cfg.FastIntervalSeconds,
+		cfg.FastMetric, cfg.FastAbove)
+	return err
+}
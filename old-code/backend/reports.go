@@ -0,0 +1,245 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"embed"
+	htmltemplate "html/template"
+	"mime"
+	"net/http"
+	"net/smtp"
+	"strings"
+	"text/template"
+	"time"
+
+	"github.com/labstack/echo/v4"
+)
+
+// The weekly report covers the last seven days. It is e-mailed as HTML when
+// SMTP_HOST and REPORT_EMAIL_TO are set and pushed as a text digest through
+// the notification channel otherwise. The weekly_report job sends it every
+// Monday morning; POST /api/reports/weekly generates it on demand. It is
+// written in the language setting, or the caller's language on demand, and
+// lists the notifications the alert routing held for the digest.
+
+//go:embed templates
+var templates embed.FS
+
+func reportFuncs(lang string) map[string]interface{} {
+	return map[string]interface{}{
+		"t": func(format string, args ...interface{}) string {
+			return translatef(lang, format, args...)
+		},
+		"date": func(t time.Time) string {
+			return formatDay(lang, t)
+		},
+		"delta": func(cur, prev float64) string {
+			if prev == 0 {
+				return ""
+			}
+			return translatef(lang, "(%+.0f%% vs last week)", (cur-prev)/prev*100)
+		},
+	}
+}
+
+var (
+	weeklyHTML = htmltemplate.Must(htmltemplate.New("weekly_report.html").Funcs(reportFuncs("en")).ParseFS(templates, "templates/weekly_report.html"))
+	weeklyText = template.Must(template.New("weekly_report.txt").Funcs(reportFuncs("en")).ParseFS(templates, "templates/weekly_report.txt"))
+)
+
+type MetricSummary struct {
+	Avg     float64 `json:"avg"`
+	Max     float64 `json:"max"`
+	PrevAvg float64 `json:"prev_avg"`
+}
+
+type NightSummary struct {
+	Date   string  `json:"date"`
+	AvgCO2 float64 `json:"avg_co2"`
+}
+
+type AlarmSummary struct {
+	Mornings       int     `json:"mornings"`
+	AvgRingSeconds float64 `json:"avg_ring_seconds"`
+	MaxRingSeconds int64   `json:"max_ring_seconds"`
+}
+
+type DeviceUptime struct {
+	Name      string  `json:"name"`
+	UptimePct float64 `json:"uptime_pct"`
+}
+
+type WeeklyReport struct {
+	From       time.Time      `json:"from"`
+	To         time.Time      `json:"to"`
+	CO2        MetricSummary  `json:"co2"`
+	Sound      MetricSummary  `json:"sound"`
+	Nights     int            `json:"nights"`
+	PoorNights []NightSummary `json:"poor_nights"`
+	Alarm      AlarmSummary   `json:"alarm"`
+	Wakeup     WakeupStats    `json:"wakeup"`
+	CO2Chart   string         `json:"co2_chart,omitempty"` // signed chart link, with DASHBOARD_URL
+	Devices    []DeviceUptime `json:"devices"`
+	Digest     []DigestItem   `json:"digest"` // notifications routed to the digest
+}
+
+func buildWeeklyReport(to time.Time) (*WeeklyReport, error) {
+	from := to.AddDate(0, 0, -7)
+	r := &WeeklyReport{From: from, To: to, PoorNights: []NightSummary{}, Devices: []DeviceUptime{},
+		CO2Chart: chartURL("co2", from, to)}
+
+	summary := `
+		SELECT COALESCE(AVG(NULLIF(co2_level, 0)), 0), COALESCE(MAX(co2_level), 0),
+			COALESCE(AVG(NULLIF(sound_level, 0)), 0), COALESCE(MAX(sound_level), 0)
+		FROM sensor_data
+		WHERE timestamp >= $1 AND timestamp < $2
+	`
+	if err := db.QueryRow(summary, from, to).
+		Scan(&r.CO2.Avg, &r.CO2.Max, &r.Sound.Avg, &r.Sound.Max); err != nil {
+		return nil, err
+	}
+	var prevCO2Max, prevSoundMax float64
+	if err := db.QueryRow(summary, from.AddDate(0, 0, -7), from).
+		Scan(&r.CO2.PrevAvg, &prevCO2Max, &r.Sound.PrevAvg, &prevSoundMax); err != nil {
+		return nil, err
+	}
+
+	// A night runs from 22:00 to 07:00 and is named after the evening's date.
+	rows, err := db.Query(`
+		SELECT (timestamp - INTERVAL '12 hours')::date AS night, AVG(co2_level)
+		FROM sensor_data
+		WHERE timestamp >= $1 AND timestamp < $2 AND co2_level != 0
+			AND (EXTRACT(HOUR FROM timestamp) >= 22 OR EXTRACT(HOUR FROM timestamp) < 7)
+		GROUP BY night
+		ORDER BY night
+	`, from, to)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	poor := settingFloat("report_poor_co2")
+	for rows.Next() {
+		var night time.Time
+		var avg float64
+		if err := rows.Scan(&night, &avg); err != nil {
+			return nil, err
+		}
+		r.Nights++
+		if avg > poor {
+			r.PoorNights = append(r.PoorNights, NightSummary{Date: night.Format("Mon Jan 2"), AvgCO2: avg})
+		}
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	// The longest alarm_active_time of a morning is how long it took to dismiss.
+	err = db.QueryRow(`
+		SELECT COUNT(*), COALESCE(AVG(ring), 0), COALESCE(MAX(ring), 0)
+		FROM (
+			SELECT last_seen::date AS day, MAX(alarm_active_time) AS ring
+			FROM device_status
+			WHERE last_seen >= $1 AND last_seen < $2 AND alarm_active
+			GROUP BY day
+		) mornings
+	`, from, to).Scan(&r.Alarm.Mornings, &r.Alarm.AvgRingSeconds, &r.Alarm.MaxRingSeconds)
+	if err != nil {
+		return nil, err
+	}
+
+	if r.Wakeup, err = computeWakeupStats(context.Background(), from, to); err != nil {
+		return nil, err
+	}
+	if r.Digest, err = loadDigest(context.Background(), from, to); err != nil {
+		return nil, err
+	}
+
+	// Uptime is the share of report intervals in which the device checked in.
+	interval := envDuration("DEVICE_REPORT_INTERVAL", 5*time.Minute)
+	devRows, err := db.Query(`
+		SELECT d.name, COUNT(DISTINCT FLOOR(EXTRACT(EPOCH FROM s.last_seen) / $3))
+		FROM devices d
+		LEFT JOIN device_status s ON s.device_id = d.id AND s.last_seen >= $1 AND s.last_seen < $2
+		GROUP BY d.name
+		ORDER BY d.name
+	`, from, to, interval.Seconds())
+	if err != nil {
+		return nil, err
+	}
+	defer devRows.Close()
+	expected := float64(to.Sub(from) / interval)
+	for devRows.Next() {
+		var d DeviceUptime
+		var seen int
+		if err := devRows.Scan(&d.Name, &seen); err != nil {
+			return nil, err
+		}
+		d.UptimePct = min(100, float64(seen)/expected*100)
+		r.Devices = append(r.Devices, d)
+	}
+	return r, devRows.Err()
+}
+
+func deliverWeeklyReport(r *WeeklyReport, lang string) error {
+	host, to := envString("SMTP_HOST", ""), envString("REPORT_EMAIL_TO", "")
+	if host == "" || to == "" {
+		tmpl, err := weeklyText.Clone()
+		if err != nil {
+			return err
+		}
+		var text bytes.Buffer
+		if err := tmpl.Funcs(reportFuncs(lang)).Execute(&text, r); err != nil {
+			return err
+		}
+		notify(Notification{Event: "report", Title: translate(lang, "Weekly home report"), Message: text.String(), Tags: []string{"bar_chart"}})
+		return nil
+	}
+
+	tmpl, err := weeklyHTML.Clone()
+	if err != nil {
+		return err
+	}
+	var body bytes.Buffer
+	if err := tmpl.Funcs(reportFuncs(lang)).Execute(&body, r); err != nil {
+		return err
+	}
+	from := envString("REPORT_EMAIL_FROM", "home-server@localhost")
+	msg := "From: " + from + "\r\n" +
+		"To: " + to + "\r\n" +
+		"Subject: " + mime.QEncoding.Encode("utf-8", translate(lang, "Home report")+" "+formatDay(lang, r.From)+" - "+formatDay(lang, r.To)) + "\r\n" +
+		"MIME-Version: 1.0\r\n" +
+		"Content-Type: text/html; charset=UTF-8\r\n\r\n" +
+		body.String()
+
+	var auth smtp.Auth
+	if user := envString("SMTP_USER", ""); user != "" {
+		auth = smtp.PlainAuth("", user, envString("SMTP_PASS", ""), host)
+	}
+	addr := host + ":" + envString("SMTP_PORT", "587")
+	return smtp.SendMail(addr, auth, from, strings.Split(to, ","), []byte(msg))
+}
+
+func sendWeeklyReport() error {
+	r, err := buildWeeklyReport(time.Now())
+	if err != nil {
+		return err
+	}
+	return deliverWeeklyReport(r, setting("language"))
+}
+
+// generateWeeklyReport builds the report for the last seven days and sends
+// it, unless ?send=false is given for a preview.
+func generateWeeklyReport(c echo.Context) error {
+	r, err := buildWeeklyReport(time.Now())
+	if err != nil {
+		return internalError(c, err)
+	}
+
+	if c.QueryParam("send") != "false" {
+		if err := deliverWeeklyReport(r, requestLanguage(c)); err != nil {
+			return upstreamError(c, "sending the report failed", err)
+		}
+	}
+
+	return c.JSON(http.StatusOK, r)
+}
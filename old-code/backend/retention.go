@@ -0,0 +1,196 @@
+package main
+
+import (
+	"log"
+	"net/http"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/labstack/echo/v4"
+	"github.com/lib/pq"
+)
+
+// Retention is configured per metric and per table through the
+// retention_<target> settings, e.g. {"retention_sound": "168h"} keeps raw
+// sound levels for a week. "0" keeps data forever. The retention_prune job
+// enforces the policies nightly. Metrics share sensor_data rows, so an
+// expired metric is zeroed (zero already means "no reading") and a row is
+// only deleted once all of its metrics have expired. Samples in
+// metric_samples are deleted: derived metrics under retention_derived,
+// device telemetry under retention_telemetry and everything else under
+// retention_metrics.
+//
+// Pruning is the only thing that deletes sensor data. It runs after the
+// archive job, but data that expires before ARCHIVE_AFTER is removed without
+// being archived.
+
+type retentionTarget struct {
+	name  string
+	prune func(cutoff time.Time) (int64, error)
+}
+
+func pruneMetric(metric, column string) func(time.Time) (int64, error) {
+	return func(cutoff time.Time) (int64, error) {
+		res, err := db.Exec(`
+			UPDATE sensor_data SET `+column+` = 0, `+metric+`_raw = NULL
+			WHERE timestamp < $1 AND `+column+` != 0
+		`, cutoff)
+		if err != nil {
+			return 0, err
+		}
+		return res.RowsAffected()
+	}
+}
+
+// pruneDeviceStatus keeps the latest status of every device regardless of age.
+func pruneDeviceStatus(cutoff time.Time) (int64, error) {
+	res, err := db.Exec(`
+		DELETE FROM device_status
+		WHERE last_seen < $1
+		AND id NOT IN (SELECT MAX(id) FROM device_status GROUP BY device_id)
+	`, cutoff)
+	if err != nil {
+		return 0, err
+	}
+	return res.RowsAffected()
+}
+
+// pruneDerivedSamples removes old samples of the derived metrics only; the
+// other metrics in metric_samples have retention_telemetry and
+// retention_metrics.
+func pruneDerivedSamples(cutoff time.Time) (int64, error) {
+	res, err := db.Exec(`
+		DELETE FROM metric_samples WHERE timestamp < $1 AND metric IN (SELECT name FROM derived_metrics)
+	`, cutoff)
+	if err != nil {
+		return 0, err
+	}
+	return res.RowsAffected()
+}
+
+// pruneTelemetrySamples removes old device telemetry (rssi, battery_pct,
+// free_heap, uptime_seconds), four rows per update and device.
+func pruneTelemetrySamples(cutoff time.Time) (int64, error) {
+	res, err := db.Exec(`
+		DELETE FROM metric_samples WHERE timestamp < $1 AND metric = ANY($2)
+	`, cutoff, pq.Array(telemetryMetrics))
+	if err != nil {
+		return 0, err
+	}
+	return res.RowsAffected()
+}
+
+// pruneMetricSamples removes old samples of the other metrics in
+// metric_samples: TTN, Zigbee, ESPHome, energy meters, the thermostat.
+func pruneMetricSamples(cutoff time.Time) (int64, error) {
+	res, err := db.Exec(`
+		DELETE FROM metric_samples
+		WHERE timestamp < $1 AND metric != ALL($2) AND metric NOT IN (SELECT name FROM derived_metrics)
+	`, cutoff, pq.Array(telemetryMetrics))
+	if err != nil {
+		return 0, err
+	}
+	return res.RowsAffected()
+}
+
+func retentionTargets() []retentionTarget {
+	targets := make([]retentionTarget, 0, len(metricColumns)+5)
+	for metric, column := range metricColumns {
+		targets = append(targets, retentionTarget{metric, pruneMetric(metric, column)})
+	}
+	targets = append(targets, retentionTarget{"device_status", pruneDeviceStatus})
+	targets = append(targets, retentionTarget{"derived", pruneDerivedSamples})
+	targets = append(targets, retentionTarget{"telemetry", pruneTelemetrySamples})
+	targets = append(targets, retentionTarget{"metrics", pruneMetricSamples})
+	targets = append(targets, retentionTarget{"device_logs", pruneDeviceLogs})
+	sort.Slice(targets, func(i, j int) bool { return targets[i].name < targets[j].name })
+	return targets
+}
+
+type pruneResult struct {
+	at   time.Time
+	rows int64
+	err  string
+}
+
+var (
+	lastPruneMu sync.Mutex
+	lastPrune   = make(map[string]pruneResult)
+)
+
+func pruneExpiredData() error {
+	now := time.Now()
+	var firstErr error
+	var metricCutoff time.Time // latest cutoff of any sensor metric
+	for _, t := range retentionTargets() {
+		keep := settingDuration("retention_" + t.name)
+		if keep <= 0 {
+			continue
+		}
+		if _, ok := metricColumns[t.name]; ok && now.Add(-keep).After(metricCutoff) {
+			metricCutoff = now.Add(-keep)
+		}
+		n, err := t.prune(now.Add(-keep))
+		result := pruneResult{at: now, rows: n}
+		if err != nil {
+			result.err = err.Error()
+			if firstErr == nil {
+				firstErr = err
+			}
+		} else if n > 0 {
+			log.Printf("Retention: pruned %d %s rows older than %s", n, t.name, keep)
+		}
+		lastPruneMu.Lock()
+		lastPrune[t.name] = result
+		lastPruneMu.Unlock()
+	}
+
+	// Old rows whose metrics have all expired carry no data any more.
+	if !metricCutoff.IsZero() {
+		_, err := db.Exec("DELETE FROM sensor_data WHERE timestamp < $1 AND co2_level = 0 AND sound_level = 0", metricCutoff)
+		if err != nil && firstErr == nil {
+			firstErr = err
+		}
+	}
+	return firstErr
+}
+
+type RetentionPolicy struct {
+	Target     string     `json:"target"`
+	Setting    string     `json:"setting"`
+	Retention  string     `json:"retention"`
+	Forever    bool       `json:"forever"`
+	Cutoff     *time.Time `json:"cutoff,omitempty"`
+	Archived   bool       `json:"archived"` // exported to object storage before removal
+	LastRun    *time.Time `json:"last_run,omitempty"`
+	LastPruned int64      `json:"last_pruned"`
+	LastError  string     `json:"last_error,omitempty"`
+}
+
+func getRetention(c echo.Context) error {
+	now := time.Now()
+	archiveAfter := envDuration("ARCHIVE_AFTER", 90*24*time.Hour)
+
+	lastPruneMu.Lock()
+	defer lastPruneMu.Unlock()
+
+	policies := []RetentionPolicy{}
+	for _, t := range retentionTargets() {
+		key := "retention_" + t.name
+		keep := settingDuration(key)
+		p := RetentionPolicy{Target: t.name, Setting: key, Retention: keep.String(), Forever: keep <= 0}
+		if !p.Forever {
+			cutoff := now.Add(-keep)
+			p.Cutoff = &cutoff
+			_, isMetric := metricColumns[t.name]
+			p.Archived = archiveStore != nil && isMetric && keep >= archiveAfter
+		}
+		if r, ok := lastPrune[t.name]; ok {
+			p.LastRun, p.LastPruned, p.LastError = &r.at, r.rows, r.err
+		}
+		policies = append(policies, p)
+	}
+
+	return c.JSON(http.StatusOK, policies)
+}
@@ -0,0 +1,243 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/labstack/echo/v4"
+)
+
+// Rollups keep the aggregates that dashboards ask for again and again out of
+// the raw tables: the materialized views metric_hourly and metric_daily hold
+// count, sum, min and max of every metric per room and hour or day. The
+// rollup_refresh job refreshes them every 15 minutes, concurrently so reads
+// never wait for it, and records up to which hour they are complete.
+//
+// Readers do not have to care: rollupAggregates takes the whole hours of a
+// range from metric_hourly and only the edges, and whatever came in since the
+// last refresh, from the raw samples.
+
+const (
+	rollupHourly = "metric_hourly"
+	rollupDaily  = "metric_daily"
+)
+
+// refreshRollups is the rollup_refresh job.
+func refreshRollups() error {
+	return refreshRollupViews(true)
+}
+
+// refreshRollupViews rebuilds the rollups. Only a concurrent refresh lets
+// reads through, but it fails on views that were never populated, as after
+// restoring a backup.
+func refreshRollupViews(concurrently bool) error {
+	now := time.Now()
+	until := time.Date(now.Year(), now.Month(), now.Day(), now.Hour(), 0, 0, 0, now.Location())
+	refresh := "REFRESH MATERIALIZED VIEW "
+	if concurrently {
+		refresh += "CONCURRENTLY "
+	}
+	for _, view := range []string{rollupHourly, rollupDaily} {
+		if _, err := db.Exec(refresh + view); err != nil {
+			return fmt.Errorf("refreshing %s: %w", view, err)
+		}
+	}
+	_, err := db.Exec(`
+		INSERT INTO rollup_state (name, refreshed_until, refreshed_at) VALUES ($1, $2, $3)
+		ON CONFLICT (name) DO UPDATE SET refreshed_until = EXCLUDED.refreshed_until, refreshed_at = EXCLUDED.refreshed_at
+	`, rollupHourly, until, now)
+	if err != nil {
+		return err
+	}
+	invalidateCache()
+	return nil
+}
+
+// rollupsUntil is the hour before which metric_hourly is complete, zero
+// before the first refresh.
+func rollupsUntil(ctx context.Context) (time.Time, error) {
+	var until time.Time
+	err := db.QueryRowContext(ctx, "SELECT refreshed_until FROM rollup_state WHERE name = $1", rollupHourly).Scan(&until)
+	if err == sql.ErrNoRows {
+		return time.Time{}, nil
+	}
+	return until, err
+}
+
+// rollupTotals are combinable aggregates: avg is total / samples.
+type rollupTotals struct {
+	samples  int64
+	total    float64
+	min, max sql.NullFloat64
+}
+
+func (t *rollupTotals) add(o rollupTotals) {
+	t.samples += o.samples
+	t.total += o.total
+	if o.min.Valid && (!t.min.Valid || o.min.Float64 < t.min.Float64) {
+		t.min = o.min
+	}
+	if o.max.Valid && (!t.max.Valid || o.max.Float64 > t.max.Float64) {
+		t.max = o.max
+	}
+}
+
+func rawTotals(ctx context.Context, metric, room string, from, to time.Time) (rollupTotals, error) {
+	var t rollupTotals
+	if !to.After(from) {
+		return t, nil
+	}
+	samples, args := metricSampleQuery(metric, room, from, to)
+	err := db.QueryRowContext(ctx, `
+		SELECT COUNT(value), COALESCE(SUM(value), 0), MIN(value), MAX(value) FROM (`+samples+`) samples
+	`, args...).Scan(&t.samples, &t.total, &t.min, &t.max)
+	return t, err
+}
+
+// rollupAggregates computes samples, avg, min and max of a metric in
+// [from, to), optionally for one room.
+func rollupAggregates(ctx context.Context, metric, room string, from, to time.Time) (Aggregates, error) {
+	a := Aggregates{From: from, To: to}
+	until, err := rollupsUntil(ctx)
+	if err != nil {
+		return a, err
+	}
+	start := time.Date(from.Year(), from.Month(), from.Day(), from.Hour(), 0, 0, 0, from.Location())
+	if start.Before(from) {
+		start = start.Add(time.Hour)
+	}
+	end := time.Date(to.Year(), to.Month(), to.Day(), to.Hour(), 0, 0, 0, to.Location())
+	if end.After(until) {
+		end = until
+	}
+
+	var t rollupTotals
+	if start.Before(end) {
+		var hourly rollupTotals
+		err := db.QueryRowContext(ctx, `
+			SELECT COALESCE(SUM(samples), 0), COALESCE(SUM(total), 0), MIN(min), MAX(max)
+			FROM metric_hourly
+			WHERE hour >= $1 AND hour < $2 AND ($3 = '' OR room = $3) AND metric = $4
+		`, start, end, room, metric).Scan(&hourly.samples, &hourly.total, &hourly.min, &hourly.max)
+		if err != nil {
+			return a, err
+		}
+		t.add(hourly)
+		for _, edge := range [][2]time.Time{{from, start}, {end, to}} {
+			raw, err := rawTotals(ctx, metric, room, edge[0], edge[1])
+			if err != nil {
+				return a, err
+			}
+			t.add(raw)
+		}
+	} else if t, err = rawTotals(ctx, metric, room, from, to); err != nil {
+		return a, err
+	}
+
+	a.Samples = int(t.samples)
+	if t.samples > 0 {
+		avg := t.total / float64(t.samples)
+		a.Avg, a.Min, a.Max = &avg, &t.min.Float64, &t.max.Float64
+	}
+	return a, nil
+}
+
+func statsMetricParams(c echo.Context, defaultDays int) (metric string, days int, msg string) {
+	metric = c.QueryParam("metric")
+	if metric == "" {
+		metric = "co2"
+	}
+	if !knownMetric(metric) {
+		return "", 0, "unknown metric"
+	}
+	days = defaultDays
+	if v := c.QueryParam("days"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 1 || n > 365 {
+			return "", 0, "days must be between 1 and 365"
+		}
+		days = n
+	}
+	return metric, days, ""
+}
+
+type DailyStats struct {
+	Date    string  `json:"date"`
+	Samples int64   `json:"samples"`
+	Avg     float64 `json:"avg"`
+	Min     float64 `json:"min"`
+	Max     float64 `json:"max"`
+}
+
+// getDailyStats returns a metric's aggregates per day from metric_daily:
+// ?metric=co2&days=30&room=bedroom. Today counts up to the last refresh.
+func getDailyStats(c echo.Context) error {
+	metric, days, msg := statsMetricParams(c, 30)
+	if msg != "" {
+		return apiError(c, http.StatusBadRequest, msg)
+	}
+	rows, err := db.QueryContext(c.Request().Context(), `
+		SELECT day, SUM(samples), SUM(total) / SUM(samples), MIN(min), MAX(max)
+		FROM metric_daily
+		WHERE day >= $1 AND ($2 = '' OR room = $2) AND metric = $3
+		GROUP BY day ORDER BY day
+	`, time.Now().AddDate(0, 0, -days), c.QueryParam("room"), metric)
+	if err != nil {
+		return internalError(c, err)
+	}
+	defer rows.Close()
+
+	stats := []DailyStats{}
+	for rows.Next() {
+		var s DailyStats
+		var day time.Time
+		if err := rows.Scan(&day, &s.Samples, &s.Avg, &s.Min, &s.Max); err != nil {
+			return internalError(c, err)
+		}
+		s.Date = day.Format("2006-01-02")
+		stats = append(stats, s)
+	}
+	return c.JSON(http.StatusOK, stats)
+}
+
+type HeatmapCell struct {
+	Weekday int     `json:"weekday"` // 1 Monday ... 7 Sunday
+	Hour    int     `json:"hour"`
+	Samples int64   `json:"samples"`
+	Avg     float64 `json:"avg"`
+	Max     float64 `json:"max"`
+}
+
+// getHeatmap averages a metric per weekday and hour of day over the last
+// ?days= (28) from metric_hourly, e.g. to see when the bedroom gets stuffy.
+func getHeatmap(c echo.Context) error {
+	metric, days, msg := statsMetricParams(c, 28)
+	if msg != "" {
+		return apiError(c, http.StatusBadRequest, msg)
+	}
+	rows, err := db.QueryContext(c.Request().Context(), `
+		SELECT EXTRACT(ISODOW FROM hour)::int AS weekday, EXTRACT(HOUR FROM hour)::int AS hour_of_day,
+			SUM(samples), SUM(total) / SUM(samples), MAX(max)
+		FROM metric_hourly
+		WHERE hour >= $1 AND ($2 = '' OR room = $2) AND metric = $3
+		GROUP BY weekday, hour_of_day ORDER BY weekday, hour_of_day
+	`, time.Now().AddDate(0, 0, -days), c.QueryParam("room"), metric)
+	if err != nil {
+		return internalError(c, err)
+	}
+	defer rows.Close()
+
+	cells := []HeatmapCell{}
+	for rows.Next() {
+		var cell HeatmapCell
+		if err := rows.Scan(&cell.Weekday, &cell.Hour, &cell.Samples, &cell.Avg, &cell.Max); err != nil {
+			return internalError(c, err)
+		}
+		cells = append(cells, cell)
+	}
+	return c.JSON(http.StatusOK, cells)
+}
@@ -0,0 +1,210 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"net/http"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/labstack/echo/v4"
+)
+
+// Rule is a threshold check evaluated against every device update, e.g.
+// "notify when sound_level > 70, but only while nobody is home". Also is an
+// optional second condition on another metric of the same update, which
+// includes the room's Zigbee sensors: co2 < 800 with open > 0 means the
+// window did its job.
+type Rule struct {
+	ID              int            `json:"id"`
+	Name            string         `json:"name"`
+	Metric          string         `json:"metric"`   // co2 | sound | telemetry | a derived metric
+	Operator        string         `json:"operator"` // > | <
+	Threshold       float64        `json:"threshold"`
+	Presence        string         `json:"presence"` // any | home | away
+	CooldownSeconds int            `json:"cooldown_seconds"`
+	Priority        int            `json:"priority"` // 1 .. 5; critical (5) alerts pass mutes and are texted
+	Channels        []string       `json:"channels"` // notification channels; all of them when empty
+	Also            *RuleCondition `json:"also,omitempty"`
+	Enabled         bool           `json:"enabled"`
+	Unit            string         `json:"unit,omitempty"` // of the metric and threshold, read-only
+}
+
+type RuleCondition struct {
+	Metric    string  `json:"metric"`
+	Operator  string  `json:"operator"` // > | <
+	Threshold float64 `json:"threshold"`
+}
+
+func (cond RuleCondition) holds(readings map[string]float64) bool {
+	value, ok := readings[cond.Metric]
+	if !ok {
+		return false
+	}
+	if cond.Operator == ">" {
+		return value > cond.Threshold
+	}
+	return value < cond.Threshold
+}
+
+func (r Rule) validate() error {
+	if !knownMetric(r.Metric) && !zigbeeMetric(r.Metric) && !thermostatMetric(r.Metric) {
+		return fmt.Errorf("unknown metric %q", r.Metric)
+	}
+	if r.Operator != ">" && r.Operator != "<" {
+		return fmt.Errorf("operator must be > or <")
+	}
+	if r.Also != nil {
+		if !knownMetric(r.Also.Metric) && !zigbeeMetric(r.Also.Metric) && !thermostatMetric(r.Also.Metric) {
+			return fmt.Errorf("unknown metric %q", r.Also.Metric)
+		}
+		if r.Also.Operator != ">" && r.Also.Operator != "<" {
+			return fmt.Errorf("operator must be > or <")
+		}
+	}
+	if r.Priority < 1 || r.Priority > 5 {
+		return fmt.Errorf("priority must be between 1 and 5")
+	}
+	for _, ch := range r.Channels {
+		if !slices.Contains(notifyChannelNames, ch) {
+			return fmt.Errorf("unknown channel %q", ch)
+		}
+	}
+	switch r.Presence {
+	case "any", "home", "away":
+	default:
+		return fmt.Errorf("presence must be any, home or away")
+	}
+	return nil
+}
+
+func (r Rule) matches(readings map[string]float64, anyoneHome bool) bool {
+	if r.Presence == "home" && !anyoneHome || r.Presence == "away" && anyoneHome {
+		return false
+	}
+	if r.Also != nil && !r.Also.holds(readings) {
+		return false
+	}
+	return RuleCondition{r.Metric, r.Operator, r.Threshold}.holds(readings)
+}
+
+// evaluateRules checks all enabled rules whose metric is among the readings
+// of a room and opens, renotifies or resolves their alerts in that room.
+func evaluateRules(room string, readings map[string]float64) {
+	if maintenanceActive(time.Now()) {
+		return
+	}
+	if !isLeader() {
+		clusterSend(clusterMessage{Kind: "readings", Readings: readings, Room: room})
+		return
+	}
+	rules, err := loadRules(true)
+	if err != nil {
+		log.Printf("Failed to load rules: %v", err)
+		return
+	}
+
+	alertsMu.Lock()
+	defer alertsMu.Unlock()
+	anyoneHome := presence.AnyoneHome()
+	now := time.Now()
+	for _, r := range rules {
+		if _, ok := readings[r.Metric]; !ok {
+			continue
+		}
+		if err := updateAlert(r, room, readings, r.matches(readings, anyoneHome), now); err != nil {
+			log.Printf("Failed to update alert for rule %d: %v", r.ID, err)
+		}
+	}
+}
+
+func loadRules(enabledOnly bool) ([]Rule, error) {
+	rows, err := db.Query(`
+		SELECT id, name, metric, operator, threshold, presence, cooldown_seconds, priority, channels,
+			also_metric, also_operator, also_threshold, enabled
+		FROM rules
+		WHERE enabled OR NOT $1
+		ORDER BY id
+	`, enabledOnly)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	rules := []Rule{}
+	for rows.Next() {
+		var r Rule
+		var channels string
+		var also RuleCondition
+		if err := rows.Scan(&r.ID, &r.Name, &r.Metric, &r.Operator, &r.Threshold,
+			&r.Presence, &r.CooldownSeconds, &r.Priority, &channels,
+			&also.Metric, &also.Operator, &also.Threshold, &r.Enabled); err != nil {
+			return nil, err
+		}
+		if also.Metric != "" {
+			r.Also = &also
+		}
+		r.Channels = []string{}
+		if channels != "" {
+			r.Channels = strings.Split(channels, ",")
+		}
+		rules = append(rules, r)
+	}
+	return rules, rows.Err()
+}
+
+func getRules(c echo.Context) error {
+	rules, err := loadRules(false)
+	if err != nil {
+		return internalError(c, err)
+	}
+	for i := range rules {
+		if rules[i].Unit, err = metricUnit(c.Request().Context(), rules[i].Metric); err != nil {
+			return internalError(c, err)
+		}
+	}
+	return c.JSON(http.StatusOK, rules)
+}
+
+func createRule(c echo.Context) error {
+	rule := Rule{Presence: "any", CooldownSeconds: 1800, Priority: 3, Channels: []string{}, Enabled: true}
+	if err := c.Bind(&rule); err != nil {
+		return invalidBody(c, err)
+	}
+	if err := rule.validate(); err != nil {
+		return apiError(c, http.StatusBadRequest, err.Error())
+	}
+	var also RuleCondition
+	if rule.Also != nil {
+		also = *rule.Also
+	}
+
+	err := db.QueryRow(`
+		INSERT INTO rules (name, metric, operator, threshold, presence, cooldown_seconds, priority, channels,
+			also_metric, also_operator, also_threshold, enabled)
+		VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10, $11, $12)
+		RETURNING id
+	`, rule.Name, rule.Metric, rule.Operator, rule.Threshold, rule.Presence,
+		rule.CooldownSeconds, rule.Priority, strings.Join(rule.Channels, ","),
+		also.Metric, also.Operator, also.Threshold, rule.Enabled).Scan(&rule.ID)
+	if err != nil {
+		return internalError(c, err)
+	}
+
+	return c.JSON(http.StatusCreated, rule)
+}
+
+func deleteRule(c echo.Context) error {
+	id, err := strconv.Atoi(c.Param("id"))
+	if err != nil {
+		return apiError(c, http.StatusBadRequest, "invalid rule id")
+	}
+
+	if _, err := db.Exec("DELETE FROM rules WHERE id = $1", id); err != nil {
+		return internalError(c, err)
+	}
+
+	return c.NoContent(http.StatusNoContent)
+}
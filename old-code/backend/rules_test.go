@@ -0,0 +1,58 @@
+package main
+
+import "testing"
+
+func TestRuleMatches(t *testing.T) {
+	loud := Rule{Metric: "sound", Operator: ">", Threshold: 70, Presence: "any"}
+	loudAway := loud
+	loudAway.Presence = "away"
+	quietHome := Rule{Metric: "sound", Operator: "<", Threshold: 30, Presence: "home"}
+	aired := Rule{Metric: "co2", Operator: "<", Threshold: 800, Presence: "any",
+		Also: &RuleCondition{Metric: "open", Operator: ">", Threshold: 0}}
+
+	tests := []struct {
+		name       string
+		rule       Rule
+		readings   map[string]float64
+		anyoneHome bool
+		want       bool
+	}{
+		{"above", loud, map[string]float64{"sound": 75}, true, true},
+		{"at the threshold", loud, map[string]float64{"sound": 70}, true, false},
+		{"metric missing", loud, map[string]float64{"co2": 900}, true, false},
+		{"away rule, nobody home", loudAway, map[string]float64{"sound": 75}, false, true},
+		{"away rule, someone home", loudAway, map[string]float64{"sound": 75}, true, false},
+		{"home rule, someone home", quietHome, map[string]float64{"sound": 20}, true, true},
+		{"home rule, nobody home", quietHome, map[string]float64{"sound": 20}, false, false},
+		{"both conditions", aired, map[string]float64{"co2": 650, "open": 1}, false, true},
+		{"window closed", aired, map[string]float64{"co2": 650, "open": 0}, false, false},
+		{"no contact sensor", aired, map[string]float64{"co2": 650}, false, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := tt.rule.matches(tt.readings, tt.anyoneHome); got != tt.want {
+				t.Errorf("matches = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestRuleValidate(t *testing.T) {
+	valid := Rule{Name: "CO2", Metric: "co2", Operator: ">", Threshold: 1200, Presence: "any", Priority: 3, Channels: []string{"ntfy"}}
+	if err := valid.validate(); err != nil {
+		t.Fatalf("valid rule: %v", err)
+	}
+	for name, change := range map[string]func(*Rule){
+		"operator":      func(r *Rule) { r.Operator = ">=" },
+		"priority":      func(r *Rule) { r.Priority = 6 },
+		"channel":       func(r *Rule) { r.Channels = []string{"fax"} },
+		"presence":      func(r *Rule) { r.Presence = "sometimes" },
+		"also operator": func(r *Rule) { r.Also = &RuleCondition{Metric: "sound", Operator: "="} },
+	} {
+		r := valid
+		change(&r)
+		if err := r.validate(); err == nil {
+			t.Errorf("rule with a bad %s passed", name)
+		}
+	}
+}
@@ -0,0 +1,163 @@
+package main
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+)
+
+// s3Client talks to S3 compatible storage (AWS, MinIO, Garage) using
+// path-style URLs and AWS Signature Version 4.
+type s3Client struct {
+	endpoint  string // e.g. http://nas:9000
+	region    string
+	bucket    string
+	accessKey string
+	secretKey string
+	http      *http.Client
+}
+
+// newS3Client returns a client for bucket on the storage configured by the
+// ARCHIVE_S3_* variables, which archives and backups share.
+func newS3Client(bucket string) *s3Client {
+	return &s3Client{
+		endpoint:  envString("ARCHIVE_S3_ENDPOINT", "https://s3.amazonaws.com"),
+		region:    envString("ARCHIVE_S3_REGION", "us-east-1"),
+		bucket:    bucket,
+		accessKey: envString("ARCHIVE_S3_ACCESS_KEY", ""),
+		secretKey: envString("ARCHIVE_S3_SECRET_KEY", ""),
+		http:      &http.Client{Timeout: 2 * time.Minute},
+	}
+}
+
+func sha256Hex(b []byte) string {
+	sum := sha256.Sum256(b)
+	return hex.EncodeToString(sum[:])
+}
+
+func hmacSHA256(key []byte, data string) []byte {
+	h := hmac.New(sha256.New, key)
+	h.Write([]byte(data))
+	return h.Sum(nil)
+}
+
+func (s *s3Client) objectPath(key string) string {
+	segments := strings.Split(key, "/")
+	for i, seg := range segments {
+		segments[i] = url.PathEscape(seg)
+	}
+	return "/" + url.PathEscape(s.bucket) + "/" + strings.Join(segments, "/")
+}
+
+// do sends a signed request and returns the response body of a successful one.
+func (s *s3Client) do(method, path string, query url.Values, body []byte, contentType string) ([]byte, error) {
+	u, err := url.Parse(strings.TrimSuffix(s.endpoint, "/") + path)
+	if err != nil {
+		return nil, err
+	}
+	// SigV4 wants %20 rather than + in the canonical query string.
+	u.RawQuery = strings.ReplaceAll(query.Encode(), "+", "%20")
+	req, err := http.NewRequest(method, u.String(), bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", contentType)
+	s.sign(req, sha256Hex(body), time.Now().UTC())
+
+	resp, err := s.http.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	data, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode >= 300 {
+		if len(data) > 512 {
+			data = data[:512]
+		}
+		return nil, fmt.Errorf("%s %s: %s: %s", method, path, resp.Status, strings.TrimSpace(string(data)))
+	}
+	return data, nil
+}
+
+func (s *s3Client) putObject(key string, body []byte, contentType string) error {
+	_, err := s.do(http.MethodPut, s.objectPath(key), nil, body, contentType)
+	return err
+}
+
+func (s *s3Client) deleteObject(key string) error {
+	_, err := s.do(http.MethodDelete, s.objectPath(key), nil, nil, "")
+	return err
+}
+
+// listObjects returns the keys under prefix, in lexical order.
+func (s *s3Client) listObjects(prefix string) ([]string, error) {
+	var keys []string
+	token := ""
+	for {
+		query := url.Values{"list-type": {"2"}, "prefix": {prefix}}
+		if token != "" {
+			query.Set("continuation-token", token)
+		}
+		data, err := s.do(http.MethodGet, "/"+url.PathEscape(s.bucket), query, nil, "")
+		if err != nil {
+			return nil, err
+		}
+		var result struct {
+			Contents []struct {
+				Key string `xml:"Key"`
+			} `xml:"Contents"`
+			IsTruncated           bool   `xml:"IsTruncated"`
+			NextContinuationToken string `xml:"NextContinuationToken"`
+		}
+		if err := xml.Unmarshal(data, &result); err != nil {
+			return nil, err
+		}
+		for _, c := range result.Contents {
+			keys = append(keys, c.Key)
+		}
+		if !result.IsTruncated {
+			return keys, nil
+		}
+		token = result.NextContinuationToken
+	}
+}
+
+// sign adds SigV4 headers to a request.
+func (s *s3Client) sign(req *http.Request, payloadHash string, now time.Time) {
+	amzDate := now.Format("20060102T150405Z")
+	day := now.Format("20060102")
+	req.Header.Set("X-Amz-Date", amzDate)
+	req.Header.Set("X-Amz-Content-Sha256", payloadHash)
+
+	signedHeaders := "content-type;host;x-amz-content-sha256;x-amz-date"
+	canonicalHeaders := "content-type:" + req.Header.Get("Content-Type") + "\n" +
+		"host:" + req.URL.Host + "\n" +
+		"x-amz-content-sha256:" + payloadHash + "\n" +
+		"x-amz-date:" + amzDate + "\n"
+	canonicalRequest := strings.Join([]string{
+		req.Method, req.URL.EscapedPath(), req.URL.RawQuery, canonicalHeaders, signedHeaders, payloadHash,
+	}, "\n")
+
+	scope := day + "/" + s.region + "/s3/aws4_request"
+	stringToSign := "AWS4-HMAC-SHA256\n" + amzDate + "\n" + scope + "\n" + sha256Hex([]byte(canonicalRequest))
+
+	key := hmacSHA256([]byte("AWS4"+s.secretKey), day)
+	key = hmacSHA256(key, s.region)
+	key = hmacSHA256(key, "s3")
+	key = hmacSHA256(key, "aws4_request")
+	signature := hex.EncodeToString(hmacSHA256(key, stringToSign))
+
+	req.Header.Set("Authorization", fmt.Sprintf("AWS4-HMAC-SHA256 Credential=%s/%s, SignedHeaders=%s, Signature=%s",
+		s.accessKey, scope, signedHeaders, signature))
+}
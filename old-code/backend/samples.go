@@ -0,0 +1,112 @@
+package main
+
+import (
+	"context"
+	"log"
+	"time"
+)
+
+// Samples are unique per device, metric and time: a sample that is already
+// stored (a retried upload, a replayed TTN uplink) is dropped. Devices that
+// buffered readings while offline send them as "samples" in their next
+// update; those, and timestamped readings from other sources, are stored
+// where they belong in time but do not move the device status, trigger
+// rules or reach the live event stream once they are older than
+// SAMPLE_LATE_AFTER. Samples more than SAMPLE_FUTURE_TOLERANCE ahead of the
+// server clock are rejected. Dropped samples are counted per device and
+// reason in sample_rejections, shown by GET /api/devices/:id.
+
+// BufferedSample is a reading a device took while it could not report.
+type BufferedSample struct {
+	Time       int64              `json:"time"` // unix seconds on the device clock
+	CO2Level   float64            `json:"co2_level"`
+	SoundLevel float64            `json:"sound_level"`
+	Metrics    map[string]float64 `json:"metrics,omitempty"`
+}
+
+func sampleInFuture(at, now time.Time) bool {
+	return at.After(now.Add(envDuration("SAMPLE_FUTURE_TOLERANCE", 5*time.Minute)))
+}
+
+func sampleLate(at, now time.Time) bool {
+	return at.Before(now.Add(-envDuration("SAMPLE_LATE_AFTER", 5*time.Minute)))
+}
+
+// recordRejectedSamples counts samples dropped for reason
+// (duplicate | future | spike).
+func recordRejectedSamples(ctx context.Context, deviceID int, reason string, n int) {
+	if n == 0 {
+		return
+	}
+	_, err := db.ExecContext(ctx, `
+		INSERT INTO sample_rejections (device_id, reason, count, last_at) VALUES ($1, $2, $3, $4)
+		ON CONFLICT (device_id, reason) DO UPDATE
+		SET count = sample_rejections.count + EXCLUDED.count, last_at = EXCLUDED.last_at
+	`, deviceID, reason, n, time.Now())
+	if err != nil {
+		log.Printf("Failed to count rejected samples of device %d: %v", deviceID, err)
+	}
+}
+
+func loadRejectedSamples(ctx context.Context, deviceID int) (map[string]int64, error) {
+	rows, err := db.QueryContext(ctx, "SELECT reason, count FROM sample_rejections WHERE device_id = $1", deviceID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	counts := make(map[string]int64)
+	for rows.Next() {
+		var reason string
+		var n int64
+		if err := rows.Scan(&reason, &n); err != nil {
+			return nil, err
+		}
+		counts[reason] = n
+	}
+	return counts, rows.Err()
+}
+
+// storeBufferedSamples stores the samples of an update. offset corrects
+// the device clock to the server's.
+func storeBufferedSamples(ctx context.Context, deviceID int, cals map[string]Calibration, samples []BufferedSample, offset time.Duration, now time.Time) error {
+	future, duplicate := 0, 0
+	for _, s := range samples {
+		at := time.Unix(s.Time, 0).Add(offset)
+		if sampleInFuture(at, now) {
+			future++
+			continue
+		}
+		if s.CO2Level != 0 || s.SoundLevel != 0 {
+			res, err := db.ExecContext(ctx, `
+				INSERT INTO sensor_data (device_id, timestamp, co2_level, sound_level, co2_raw, sound_raw)
+				VALUES ($1, $2, $3, $4, $5, $6)
+				ON CONFLICT DO NOTHING
+			`, deviceID, at, calibrate(cals, "co2", s.CO2Level), calibrate(cals, "sound", s.SoundLevel), s.CO2Level, s.SoundLevel)
+			if err != nil {
+				return err
+			}
+			if n, _ := res.RowsAffected(); n == 0 {
+				duplicate++
+			}
+		}
+		metrics := make(map[string]float64, len(s.Metrics))
+		for name, v := range s.Metrics {
+			metrics[metricName(name)] = calibrate(cals, name, v)
+		}
+		if err := storeMetricSamples(ctx, deviceID, metrics, at); err != nil {
+			return err
+		}
+	}
+	recordRejectedSamples(ctx, deviceID, "future", future)
+	recordRejectedSamples(ctx, deviceID, "duplicate", duplicate)
+	return nil
+}
+
+// clockOffset is how far the device clock is behind the server's, judged
+// from the device_time of the update.
+func clockOffset(deviceTime *int64, now time.Time) time.Duration {
+	if deviceTime == nil || *deviceTime <= 0 {
+		return 0
+	}
+	return now.Sub(time.Unix(*deviceTime, 0)).Round(time.Second)
+}
@@ -0,0 +1,166 @@
+package main
+
+import (
+	"database/sql"
+	"fmt"
+	"time"
+
+	"github.com/labstack/echo/v4"
+)
+
+// Point is a single timestamped sample of a metric.
+type Point struct {
+	Timestamp time.Time `json:"timestamp"`
+	Value     float64   `json:"value"`
+}
+
+// linearFit is an ordinary least-squares fit of value over time. The slope is
+// per second and the intercept is the fitted value at the first point.
+func linearFit(points []Point) (slope, intercept float64, ok bool) {
+	if len(points) < 2 {
+		return 0, 0, false
+	}
+	t0 := points[0].Timestamp
+	var sumX, sumY, sumXY, sumXX float64
+	for _, p := range points {
+		x := p.Timestamp.Sub(t0).Seconds()
+		sumX += x
+		sumY += p.Value
+		sumXY += x * p.Value
+		sumXX += x * x
+	}
+	n := float64(len(points))
+	denom := n*sumXX - sumX*sumX
+	if denom == 0 {
+		return 0, 0, false
+	}
+	slope = (n*sumXY - sumX*sumY) / denom
+	intercept = (sumY - slope*sumX) / n
+	return slope, intercept, true
+}
+
+// metricColumns maps the metric names used by the API to sensor_data columns.
+var metricColumns = map[string]string{
+	"co2":   "co2_level",
+	"sound": "sound_level",
+}
+
+// knownMetric reports whether name is a built-in, telemetry or derived
+// metric, or one that has been ingested from another source.
+func knownMetric(name string) bool {
+	if _, ok := metricColumns[name]; ok || isTelemetryMetric(name) {
+		return true
+	}
+	if _, ok, _ := derivedMetric(name); ok {
+		return true
+	}
+	var exists bool
+	db.QueryRow("SELECT EXISTS (SELECT 1 FROM metric_samples WHERE metric = $1)", name).Scan(&exists)
+	return exists
+}
+
+// metricThreshold is the default threshold trend and forecast project
+// against. Derived averages and extremes share their source's threshold.
+func metricThreshold(metric string) float64 {
+	if _, ok := metricColumns[metric]; ok {
+		return settingFloat(metric + "_threshold")
+	}
+	if m, ok, _ := derivedMetric(metric); ok && m.Kind != "minutes_above" {
+		return settingFloat(m.Source + "_threshold")
+	}
+	return 0
+}
+
+// SeriesScope limits a series to one device, or to the devices of a room.
+type SeriesScope struct {
+	Room   string `json:"room,omitempty"`
+	Device string `json:"device,omitempty"`
+}
+
+// seriesScope reads ?device= or ?room=. Without either it is the room of
+// the alarm devices: readings of different devices, e.g. an outdoor node
+// and the bedroom, do not make one series to fit.
+func seriesScope(c echo.Context) (SeriesScope, error) {
+	ctx := c.Request().Context()
+	if name := c.QueryParam("device"); name != "" {
+		if _, err := deviceMetaByName(ctx, name); err != nil {
+			return SeriesScope{}, err
+		}
+		return SeriesScope{Device: name}, nil
+	}
+	if room := c.QueryParam("room"); room != "" {
+		return SeriesScope{Room: room}, nil
+	}
+	room, err := alarmRoom(ctx)
+	return SeriesScope{Room: room}, err
+}
+
+// querySeries returns the raw samples of a metric in [from, to) within
+// scope, oldest first. Zero readings of built-in metrics are dropped as they
+// mean the sensor was not ready; other metrics come from metric_samples.
+func querySeries(metric string, scope SeriesScope, from, to time.Time) ([]Point, error) {
+	var rows *sql.Rows
+	var err error
+	if column, ok := metricColumns[metric]; ok {
+		rows, err = db.Query(`
+			SELECT s.timestamp, s.`+column+`
+			FROM sensor_data s LEFT JOIN devices d ON d.id = s.device_id
+			WHERE s.timestamp >= $1 AND s.timestamp < $2 AND s.`+column+` != 0
+				AND ($3 = '' OR d.room = $3) AND ($4 = '' OR d.name = $4)
+			ORDER BY s.timestamp
+		`, serverTime(from), serverTime(to), scope.Room, scope.Device)
+	} else if knownMetric(metric) {
+		rows, err = db.Query(`
+			SELECT m.timestamp, m.value
+			FROM metric_samples m LEFT JOIN devices d ON d.id = m.device_id
+			WHERE m.metric = $1 AND m.timestamp >= $2 AND m.timestamp < $3
+				AND ($4 = '' OR d.room = $4) AND ($5 = '' OR d.name = $5)
+			ORDER BY m.timestamp
+		`, metric, serverTime(from), serverTime(to), scope.Room, scope.Device)
+	} else {
+		return nil, fmt.Errorf("unknown metric %q", metric)
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var points []Point
+	for rows.Next() {
+		var p Point
+		if err := rows.Scan(&p.Timestamp, &p.Value); err != nil {
+			return nil, err
+		}
+		points = append(points, p)
+	}
+	return points, rows.Err()
+}
+
+// bucketAverages resamples points into fixed step buckets aligned to the
+// first point. Buckets without samples carry the previous value forward so
+// the result is evenly spaced.
+func bucketAverages(points []Point, step time.Duration) []Point {
+	if len(points) == 0 {
+		return nil
+	}
+	start := points[0].Timestamp.Truncate(step)
+	n := int(points[len(points)-1].Timestamp.Sub(start)/step) + 1
+	sums := make([]float64, n)
+	counts := make([]int, n)
+	for _, p := range points {
+		i := int(p.Timestamp.Sub(start) / step)
+		sums[i] += p.Value
+		counts[i]++
+	}
+
+	buckets := make([]Point, n)
+	for i := range buckets {
+		buckets[i].Timestamp = start.Add(time.Duration(i) * step)
+		if counts[i] > 0 {
+			buckets[i].Value = sums[i] / float64(counts[i])
+		} else if i > 0 {
+			buckets[i].Value = buckets[i-1].Value
+		}
+	}
+	return buckets
+}
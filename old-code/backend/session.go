@@ -0,0 +1,130 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"log"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/labstack/echo/v4"
+)
+
+// Sessions are stateless: the cookie holds the session as JSON, signed with
+// SESSION_SECRET. Without a configured secret a random one is used, so
+// sessions do not survive a restart. Every signed value names its purpose
+// (the cookie, or the kind of link or token) in the signature, so a value
+// signed for one purpose never verifies as another.
+
+const sessionCookie = "home_session"
+
+type Session struct {
+	Subject   string    `json:"sub"`
+	Name      string    `json:"name,omitempty"`
+	Email     string    `json:"email,omitempty"`
+	Role      string    `json:"role"` // admin | viewer
+	Household string    `json:"household,omitempty"`
+	Expires   time.Time `json:"exp"`
+}
+
+var sessionKey []byte
+
+func initSessions() {
+	if secret := envString("SESSION_SECRET", ""); secret != "" {
+		sessionKey = []byte(secret)
+		return
+	}
+	sessionKey = make([]byte, 32)
+	rand.Read(sessionKey)
+	log.Printf("SESSION_SECRET is not set, sessions end when the server restarts")
+}
+
+func signature(purpose string, payload []byte) []byte {
+	mac := hmac.New(sha256.New, sessionKey)
+	mac.Write([]byte(purpose))
+	mac.Write([]byte{0})
+	mac.Write(payload)
+	return mac.Sum(nil)
+}
+
+func signValue(purpose string, payload []byte) string {
+	return base64.RawURLEncoding.EncodeToString(payload) + "." + base64.RawURLEncoding.EncodeToString(signature(purpose, payload))
+}
+
+func verifyValue(purpose, value string) ([]byte, error) {
+	data, sig, ok := strings.Cut(value, ".")
+	if !ok {
+		return nil, errors.New("malformed value")
+	}
+	payload, err := base64.RawURLEncoding.DecodeString(data)
+	if err != nil {
+		return nil, err
+	}
+	got, err := base64.RawURLEncoding.DecodeString(sig)
+	if err != nil {
+		return nil, err
+	}
+	if !hmac.Equal(got, signature(purpose, payload)) {
+		return nil, errors.New("bad signature")
+	}
+	return payload, nil
+}
+
+// setSignedCookie stores v, signed, in a cookie readable only by the server.
+func setSignedCookie(c echo.Context, name string, v interface{}, maxAge time.Duration) error {
+	payload, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+	c.SetCookie(&http.Cookie{
+		Name:     name,
+		Value:    signValue(name, payload),
+		Path:     "/",
+		MaxAge:   int(maxAge.Seconds()),
+		HttpOnly: true,
+		Secure:   c.Request().TLS != nil || c.Request().Header.Get("X-Forwarded-Proto") == "https",
+		SameSite: http.SameSiteLaxMode,
+	})
+	return nil
+}
+
+func readSignedCookie(c echo.Context, name string, v interface{}) error {
+	cookie, err := c.Cookie(name)
+	if err != nil {
+		return err
+	}
+	payload, err := verifyValue(name, cookie.Value)
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(payload, v)
+}
+
+func clearCookie(c echo.Context, name string) {
+	c.SetCookie(&http.Cookie{Name: name, Value: "", Path: "/", MaxAge: -1, HttpOnly: true})
+}
+
+// sessionPayload is a session cookie as read. Kind is only ever set on link
+// tokens, which embed a Session; a payload carrying one is never a session.
+type sessionPayload struct {
+	Session
+	Kind string `json:"kind"`
+}
+
+func (p sessionPayload) valid() bool {
+	return p.Kind == "" && time.Now().Before(p.Expires)
+}
+
+// currentSession returns the request's valid session, or nil.
+func currentSession(c echo.Context) *Session {
+	var p sessionPayload
+	if err := readSignedCookie(c, sessionCookie, &p); err != nil || !p.valid() || p.Household != household {
+		return nil
+	}
+	return &p.Session
+}
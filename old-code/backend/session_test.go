@@ -0,0 +1,85 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/labstack/echo/v4"
+)
+
+func TestSignedValuePurpose(t *testing.T) {
+	sessionKey = []byte("test-secret")
+	payload := []byte(`{"a":1}`)
+	value := signValue("chart", payload)
+
+	if got, err := verifyValue("chart", value); err != nil || string(got) != string(payload) {
+		t.Fatalf("verifyValue(chart) = %q, %v", got, err)
+	}
+	for _, purpose := range []string{sessionCookie, "alarm-action", "link-access", ""} {
+		if _, err := verifyValue(purpose, value); err == nil {
+			t.Errorf("a chart value verified as %q", purpose)
+		}
+	}
+}
+
+func sessionRequest(value string) echo.Context {
+	req := httptest.NewRequest(http.MethodGet, "/api/alarm", nil)
+	req.AddCookie(&http.Cookie{Name: sessionCookie, Value: value})
+	return echo.New().NewContext(req, httptest.NewRecorder())
+}
+
+func TestCurrentSession(t *testing.T) {
+	sessionKey = []byte("test-secret")
+	household = ""
+	s := Session{Subject: "u", Role: "admin", Expires: time.Now().Add(time.Hour)}
+	sessionValue := func(v interface{}) string {
+		payload, _ := json.Marshal(v)
+		return signValue(sessionCookie, payload)
+	}
+
+	tests := []struct {
+		name  string
+		value string
+		ok    bool
+	}{
+		{"session", sessionValue(s), true},
+		{"expired", sessionValue(Session{Subject: "u", Role: "admin", Expires: time.Now().Add(-time.Minute)}), false},
+		{"other household", sessionValue(Session{Subject: "u", Role: "admin", Household: "other", Expires: s.Expires}), false},
+		{"access token", signLinkToken(linkToken{Kind: "access", Client: "alexa", Session: s}), false},
+		{"refresh token", signLinkToken(linkToken{Kind: "refresh", Client: "alexa", Session: s}), false},
+		{"code", signLinkToken(linkToken{Kind: "code", Client: "alexa", Session: s}), false},
+		{"link token signed as a session", sessionValue(linkToken{Kind: "refresh", Client: "alexa", Session: s}), false},
+		{"garbage", "not-a-value", false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := currentSession(sessionRequest(tt.value)); (got != nil) != tt.ok {
+				t.Errorf("currentSession = %v, want ok %v", got, tt.ok)
+			}
+		})
+	}
+}
+
+func TestVerifyLinkToken(t *testing.T) {
+	sessionKey = []byte("test-secret")
+	household = ""
+	s := Session{Subject: "u", Role: "viewer", Expires: time.Now().Add(time.Hour)}
+	refresh := signLinkToken(linkToken{Kind: "refresh", Client: "google", Session: s})
+
+	if _, ok := verifyLinkToken(refresh, "refresh", "google"); !ok {
+		t.Fatal("refresh token was refused")
+	}
+	if _, ok := verifyLinkToken(refresh, "access", "google"); ok {
+		t.Error("a refresh token passed as an access token")
+	}
+	if _, ok := verifyLinkToken(refresh, "refresh", "alexa"); ok {
+		t.Error("a token passed for another client")
+	}
+	payload, _ := json.Marshal(s)
+	if _, ok := verifyLinkToken(signValue(sessionCookie, payload), "access", ""); ok {
+		t.Error("a session cookie passed as an access token")
+	}
+}
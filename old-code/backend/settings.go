@@ -0,0 +1,412 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/labstack/echo/v4"
+)
+
+// Settings are configuration values that can be changed at runtime through
+// PUT /api/settings. Each setting's default comes from the environment
+// variable of the same name in upper case (alarm_hard_mode is
+// ALARM_HARD_MODE), falling back to the built-in default below. Values
+// stored in the settings table take precedence over both.
+
+type settingDef struct {
+	kind string // bool | int | float | duration | clock_range | time
+	def  string
+}
+
+var settingDefs = map[string]settingDef{
+	"alarm_hard_mode":            {"bool", "false"},
+	"alarm_challenge_difficulty": {"int", "2"},
+	"co2_threshold":              {"float", "1400"},
+	"co2_band_yellow":            {"float", "1000"},
+	"co2_band_red":               {"float", "1400"},
+	"sound_threshold":            {"float", "70"},
+	"report_poor_co2":            {"float", "1000"},
+	"device_offline_after":       {"duration", "15m"},
+	"presence_away_after":        {"duration", "10m"},
+	"quiet_hours":                {"clock_range", ""},
+	"noise_quiet_hours":          {"clock_range", "22:00-06:00"},
+	"noise_limit":                {"float", "40"},
+	"offline_alert_hours":        {"clock_range", "22:00-07:00"},
+	"alerts_muted_until":         {"time", ""},
+	"retention_co2":              {"duration", "8760h"},
+	"retention_sound":            {"duration", "8760h"},
+	"retention_device_status":    {"duration", "720h"},
+	"retention_derived":          {"duration", "720h"},
+	"retention_telemetry":        {"duration", "720h"},
+	"retention_metrics":          {"duration", "8760h"},
+	"retention_device_logs":      {"duration", "168h"},
+	"mold_humidity_threshold":    {"float", "70"},
+	"mold_risk_after":            {"duration", "12h"},
+	"ventilation_detect_slope":   {"float", "20"},
+	"ventilation_detect_window":  {"duration", "10m"},
+	"ventilation_min_drop":       {"float", "100"},
+	"preflight_lead":             {"duration", "30m"},
+	"alarm_fallback_after":       {"duration", "2m"},
+	"alarm_max_ring":             {"duration", "0"},
+	"alarm_ring_push":            {"bool", "true"},
+	"alarm_snooze":               {"duration", "9m"},
+	"maintenance_until":          {"time", ""},
+	"maintenance_duration":       {"duration", "1h"},
+	"language":                   {"language", "en"},
+	"energy_price":               {"float", "0.25"},
+	"energy_night_price":         {"float", "0"},
+	"energy_night_hours":         {"clock_range", ""},
+	"energy_daily_fee":           {"float", "0"},
+}
+
+// zeroDurations are the duration settings that take "0": it keeps data
+// forever, lifts the ring limit or sends the backup alarm right away. Every
+// other duration must be positive.
+var zeroDurations = map[string]bool{
+	"retention_co2":           true,
+	"retention_sound":         true,
+	"retention_device_status": true,
+	"retention_derived":       true,
+	"retention_telemetry":     true,
+	"retention_metrics":       true,
+	"retention_device_logs":   true,
+	"alarm_max_ring":          true,
+	"alarm_fallback_after":    true,
+}
+
+type Setting struct {
+	Key        string `json:"key"`
+	Kind       string `json:"kind"`
+	Value      string `json:"value"`
+	Default    string `json:"default"`
+	Overridden bool   `json:"overridden"`
+}
+
+var (
+	settingsMu sync.RWMutex
+	settings   = make(map[string]string)
+)
+
+func loadSettings() {
+	rows, err := db.Query("SELECT key, value FROM settings")
+	if err != nil {
+		log.Fatal(err)
+	}
+	defer rows.Close()
+
+	settingsMu.Lock()
+	defer settingsMu.Unlock()
+	for rows.Next() {
+		var key, value string
+		if err := rows.Scan(&key, &value); err != nil {
+			log.Fatal(err)
+		}
+		settings[key] = value
+	}
+}
+
+// reloadSettings replaces the stored settings with the database's, after
+// another replica changed them.
+func reloadSettings() error {
+	rows, err := db.Query("SELECT key, value FROM settings")
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+
+	loaded := make(map[string]string)
+	for rows.Next() {
+		var key, value string
+		if err := rows.Scan(&key, &value); err != nil {
+			return err
+		}
+		loaded[key] = value
+	}
+	if err := rows.Err(); err != nil {
+		return err
+	}
+	settingsMu.Lock()
+	settings = loaded
+	settingsMu.Unlock()
+	return nil
+}
+
+func settingDefault(key string) string {
+	return envString(strings.ToUpper(key), settingDefs[key].def)
+}
+
+func setting(key string) string {
+	settingsMu.RLock()
+	v, ok := settings[key]
+	settingsMu.RUnlock()
+	if ok {
+		return v
+	}
+	return settingDefault(key)
+}
+
+// The typed getters fall back to the default when a value does not parse;
+// values are validated on write, so that only happens with a bad env var.
+
+func settingBool(key string) bool {
+	b, err := strconv.ParseBool(setting(key))
+	if err != nil {
+		b, _ = strconv.ParseBool(settingDefs[key].def)
+	}
+	return b
+}
+
+func settingInt(key string) int {
+	n, err := strconv.Atoi(setting(key))
+	if err != nil {
+		n, _ = strconv.Atoi(settingDefs[key].def)
+	}
+	return n
+}
+
+func settingFloat(key string) float64 {
+	f, err := strconv.ParseFloat(setting(key), 64)
+	if err != nil {
+		f, _ = strconv.ParseFloat(settingDefs[key].def, 64)
+	}
+	return f
+}
+
+func settingDuration(key string) time.Duration {
+	v := setting(key)
+	d, err := time.ParseDuration(v)
+	if err != nil || validateSetting(key, v) != nil {
+		d, _ = time.ParseDuration(settingDefs[key].def)
+	}
+	return d
+}
+
+// settingTime returns a time setting; an empty or invalid one is zero.
+func settingTime(key string) time.Time {
+	t, _ := time.Parse(time.RFC3339, setting(key))
+	return t
+}
+
+// storeSetting persists a setting changed by the server itself.
+func storeSetting(key, value string) error {
+	_, err := db.Exec(`
+		INSERT INTO settings (key, value, updated_at) VALUES ($1, $2, $3)
+		ON CONFLICT (key) DO UPDATE SET value = EXCLUDED.value, updated_at = EXCLUDED.updated_at
+	`, key, value, time.Now())
+	if err != nil {
+		return err
+	}
+	settingsMu.Lock()
+	settings[key] = value
+	settingsMu.Unlock()
+	clusterSend(clusterMessage{Kind: "settings"})
+	return nil
+}
+
+// parseClockRange parses "22:00-07:00" into minutes after midnight.
+func parseClockRange(v string) (start, end int, err error) {
+	from, to, ok := strings.Cut(v, "-")
+	if !ok {
+		return 0, 0, fmt.Errorf("expected HH:MM-HH:MM")
+	}
+	f, err := time.Parse("15:04", strings.TrimSpace(from))
+	if err != nil {
+		return 0, 0, err
+	}
+	t, err := time.Parse("15:04", strings.TrimSpace(to))
+	if err != nil {
+		return 0, 0, err
+	}
+	return f.Hour()*60 + f.Minute(), t.Hour()*60 + t.Minute(), nil
+}
+
+// inClockRange reports whether t falls within a clock_range setting. The
+// range may wrap around midnight; an empty setting never matches.
+func inClockRange(key string, t time.Time) bool {
+	return clockRangeContains(setting(key), t)
+}
+
+// clockRangeContains reports whether t falls in an HH:MM-HH:MM range; an
+// empty or invalid range contains nothing.
+func clockRangeContains(v string, t time.Time) bool {
+	if v == "" {
+		return false
+	}
+	start, end, err := parseClockRange(v)
+	if err != nil {
+		return false
+	}
+	now := t.Hour()*60 + t.Minute()
+	if start <= end {
+		return now >= start && now < end
+	}
+	return now >= start || now < end
+}
+
+func validateSetting(key, value string) error {
+	var err error
+	switch settingDefs[key].kind {
+	case "bool":
+		_, err = strconv.ParseBool(value)
+	case "int":
+		_, err = strconv.Atoi(value)
+	case "float":
+		_, err = strconv.ParseFloat(value, 64)
+	case "duration":
+		var d time.Duration
+		d, err = time.ParseDuration(value)
+		switch {
+		case err != nil:
+		case d < 0:
+			err = fmt.Errorf("must not be negative")
+		case d == 0 && !zeroDurations[key]:
+			err = fmt.Errorf("must be positive")
+		}
+	case "clock_range":
+		if value != "" {
+			_, _, err = parseClockRange(value)
+		}
+	case "time":
+		if value != "" {
+			_, err = time.Parse(time.RFC3339, value)
+		}
+	case "language":
+		if !languages[value] {
+			err = fmt.Errorf("unsupported language %q", value)
+		}
+	}
+	return err
+}
+
+func getSettings(c echo.Context) error {
+	settingsMu.RLock()
+	defer settingsMu.RUnlock()
+
+	list := make([]Setting, 0, len(settingDefs))
+	for key, def := range settingDefs {
+		s := Setting{Key: key, Kind: def.kind, Default: settingDefault(key)}
+		s.Value, s.Overridden = settings[key]
+		if !s.Overridden {
+			s.Value = s.Default
+		}
+		list = append(list, s)
+	}
+	sort.Slice(list, func(i, j int) bool { return list[i].Key < list[j].Key })
+
+	return c.JSON(http.StatusOK, list)
+}
+
+// putSettings updates several settings at once, e.g.
+// {"co2_threshold": 1200, "quiet_hours": "22:00-07:00"}. A null value resets
+// the setting to its default.
+func putSettings(c echo.Context) error {
+	var req map[string]interface{}
+	if err := c.Bind(&req); err != nil {
+		return invalidBody(c, err)
+	}
+	values, err := parseSettingValues(req)
+	if err != nil {
+		return apiError(c, http.StatusBadRequest, err.Error())
+	}
+	if err := saveSettings(values); err != nil {
+		return internalError(c, err)
+	}
+	return getSettings(c)
+}
+
+// parseSettingValues validates settings as PUT /api/settings takes them;
+// a nil value stands for the default.
+func parseSettingValues(req map[string]interface{}) (map[string]*string, error) {
+	values := make(map[string]*string, len(req))
+	for key, raw := range req {
+		if _, ok := settingDefs[key]; !ok {
+			return nil, fmt.Errorf("unknown setting %s", key)
+		}
+		if raw == nil {
+			values[key] = nil
+			continue
+		}
+		value := fmt.Sprint(raw)
+		if f, ok := raw.(float64); ok {
+			value = strconv.FormatFloat(f, 'f', -1, 64) // not 1e+06
+		}
+		if err := validateSetting(key, value); err != nil {
+			return nil, fmt.Errorf("invalid %s: %v", key, err)
+		}
+		values[key] = &value
+	}
+	if err := validateCO2Bands(values); err != nil {
+		return nil, err
+	}
+	return values, nil
+}
+
+// validateCO2Bands checks that the red band starts above the yellow one,
+// with the values being set and the current ones for the rest.
+func validateCO2Bands(values map[string]*string) error {
+	_, yellowSet := values["co2_band_yellow"]
+	_, redSet := values["co2_band_red"]
+	if !yellowSet && !redSet {
+		return nil
+	}
+	band := func(key string) float64 {
+		value, set := values[key]
+		if !set {
+			return settingFloat(key)
+		}
+		v := settingDefault(key)
+		if value != nil {
+			v = *value
+		}
+		f, _ := strconv.ParseFloat(v, 64)
+		return f
+	}
+	if band("co2_band_red") <= band("co2_band_yellow") {
+		return fmt.Errorf("co2_band_red must be above co2_band_yellow")
+	}
+	return nil
+}
+
+// saveSettings stores settings in one transaction and tells the other
+// instances; nil resets a setting to its default.
+func saveSettings(values map[string]*string) error {
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	for key, value := range values {
+		if value == nil {
+			_, err = tx.Exec("DELETE FROM settings WHERE key = $1", key)
+		} else {
+			_, err = tx.Exec(`
+				INSERT INTO settings (key, value, updated_at) VALUES ($1, $2, $3)
+				ON CONFLICT (key) DO UPDATE SET value = EXCLUDED.value, updated_at = EXCLUDED.updated_at
+			`, key, *value, time.Now())
+		}
+		if err != nil {
+			return err
+		}
+	}
+	if err := tx.Commit(); err != nil {
+		return err
+	}
+
+	settingsMu.Lock()
+	for key, value := range values {
+		if value == nil {
+			delete(settings, key)
+		} else {
+			settings[key] = *value
+		}
+	}
+	settingsMu.Unlock()
+	clusterSend(clusterMessage{Kind: "settings"})
+	return nil
+}
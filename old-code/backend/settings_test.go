@@ -0,0 +1,66 @@
+package main
+
+import "testing"
+
+func TestValidateSetting(t *testing.T) {
+	tests := []struct {
+		key, value string
+		ok         bool
+	}{
+		{"device_offline_after", "15m", true},
+		{"device_offline_after", "0", false},
+		{"device_offline_after", "-5m", false},
+		{"device_offline_after", "soon", false},
+		{"retention_sound", "168h", true},
+		{"retention_sound", "0", true},
+		{"retention_sound", "-1h", false},
+		{"alarm_max_ring", "0", true},
+		{"alarm_snooze", "0s", false},
+		{"alarm_challenge_difficulty", "3", true},
+		{"alarm_challenge_difficulty", "1e+06", false},
+		{"co2_threshold", "1200.5", true},
+		{"alarm_hard_mode", "maybe", false},
+		{"quiet_hours", "", true},
+		{"quiet_hours", "22:00-07:00", true},
+		{"alerts_muted_until", "tomorrow", false},
+		{"language", "xx", false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.key+"="+tt.value, func(t *testing.T) {
+			if err := validateSetting(tt.key, tt.value); (err == nil) != tt.ok {
+				t.Errorf("validateSetting = %v, want ok %v", err, tt.ok)
+			}
+		})
+	}
+}
+
+func TestParseSettingValues(t *testing.T) {
+	values, err := parseSettingValues(map[string]interface{}{
+		"alarm_challenge_difficulty": float64(1000000), // as decoded from JSON
+		"co2_threshold":              1250.5,
+		"alarm_hard_mode":            true,
+		"quiet_hours":                nil,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := map[string]string{"alarm_challenge_difficulty": "1000000", "co2_threshold": "1250.5", "alarm_hard_mode": "true"}
+	for key, v := range want {
+		if values[key] == nil || *values[key] != v {
+			t.Errorf("%s = %v, want %q", key, values[key], v)
+		}
+	}
+	if v, ok := values["quiet_hours"]; !ok || v != nil {
+		t.Errorf("quiet_hours = %v, want a reset", v)
+	}
+
+	for _, req := range []map[string]interface{}{
+		{"no_such_setting": 1},
+		{"retention_co2": "-24h"},
+		{"presence_away_after": "0"},
+	} {
+		if _, err := parseSettingValues(req); err == nil {
+			t.Errorf("parseSettingValues(%v) succeeded", req)
+		}
+	}
+}
@@ -0,0 +1,257 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"log"
+	"math"
+	"math/rand"
+	"net/http"
+	"net/url"
+	"os"
+	"os/signal"
+	"strings"
+	"time"
+)
+
+// home-server simulate stands in for hardware during development: it posts
+// device updates to a running server the way the firmware does, with
+// readings that look real enough for charts and rules.
+//
+//	home-server simulate [-url http://localhost:8080] [-devices bedroom,kitchen]
+//	    [-interval 10s] [-history 24h] [-errors 0.02]
+//
+// CO2 follows the day, rising while a room is slept or worked in and
+// dropping when it is aired; sound has a quiet floor with the odd noise
+// event. With -history the first updates of each device carry that much
+// past data as buffered samples, in batches that fit DEVICE_MAX_BODY. An
+// -errors share of updates reports a sensor error, loses its CO2 reading or
+// is not sent at all. Commands are
+// acknowledged and an armed alarm rings until the server stops it. The
+// server must be a development one: anything but localhost needs -force.
+
+const simHistoryBatch = 150
+
+type simDevice struct {
+	name     string
+	co2      float64
+	noise    int // updates left of the current noise event
+	booted   time.Time
+	battery  float64
+	ringing  time.Time
+	rangAt   string // the alarm time that rang today, so it rings once
+	results  []CommandResult
+	lastAck  string
+	bedroom  bool
+	occupied func(time.Time) bool
+}
+
+func newSimDevice(name string, now time.Time) *simDevice {
+	d := &simDevice{name: name, co2: 450, booted: now, battery: 100}
+	d.bedroom = strings.Contains(name, "bed")
+	if d.bedroom {
+		d.occupied = func(t time.Time) bool { return t.Hour() >= 22 || t.Hour() < 7 }
+	} else {
+		d.occupied = func(t time.Time) bool { return t.Hour() >= 8 && t.Hour() < 18 && t.Weekday() != time.Sunday }
+	}
+	return d
+}
+
+// step advances the readings by dt at time t.
+func (d *simDevice) step(t time.Time, dt time.Duration) (co2, sound float64) {
+	target := 430.0
+	if d.occupied(t) {
+		target = 1500
+	}
+	// Aired every morning and now and then during the day
+	if t.Hour() == 7 && t.Minute() < 15 || rand.Float64() < dt.Hours()/6 {
+		target = 420
+	}
+	rate := 1 - math.Exp(-dt.Minutes()/90)
+	d.co2 += (target-d.co2)*rate + rand.NormFloat64()*8
+	d.co2 = math.Max(d.co2, 400)
+
+	sound = 31 + rand.NormFloat64()*2
+	if !d.occupied(t) && t.Hour() >= 7 && t.Hour() < 22 {
+		sound += 8
+	}
+	if d.noise == 0 && rand.Float64() < dt.Minutes()/120 {
+		d.noise = 1 + rand.Intn(4)
+	}
+	if d.noise > 0 {
+		d.noise--
+		sound = 60 + rand.Float64()*25
+	}
+	return math.Round(d.co2), math.Round(sound*10) / 10
+}
+
+// history returns buffered samples covering the span before now.
+func (d *simDevice) history(now time.Time, span, interval time.Duration) []BufferedSample {
+	var samples []BufferedSample
+	step := max(interval, time.Minute)
+	for t := now.Add(-span); t.Before(now); t = t.Add(step) {
+		co2, sound := d.step(t, step)
+		samples = append(samples, BufferedSample{Time: t.Unix(), CO2Level: co2, SoundLevel: sound})
+	}
+	return samples
+}
+
+type simulator struct {
+	base     string
+	key      string
+	interval time.Duration
+	errors   float64
+	client   *http.Client
+}
+
+// update sends one update of d and acts on the response.
+func (s *simulator) update(d *simDevice, now time.Time, samples []BufferedSample) error {
+	co2, sound := d.step(now, s.interval)
+	d.battery = math.Max(d.battery-s.interval.Hours()*0.2, 5)
+	body := map[string]interface{}{
+		"device":         d.name,
+		"device_time":    now.Unix(),
+		"co2_level":      co2,
+		"sound_level":    sound,
+		"alarm_active":   !d.ringing.IsZero(),
+		"rssi":           math.Round(-62 + rand.NormFloat64()*4),
+		"battery_pct":    math.Round(d.battery),
+		"free_heap":      180000 + rand.Intn(20000),
+		"uptime_seconds": int64(now.Sub(d.booted).Seconds()),
+		"config_ack":     d.lastAck,
+	}
+	if !d.ringing.IsZero() {
+		body["alarm_active_time"] = int64(now.Sub(d.ringing).Seconds())
+	}
+	if len(d.results) > 0 {
+		body["command_results"] = d.results
+	}
+	if len(samples) > 0 {
+		body["samples"] = samples
+	}
+	if rand.Float64() < s.errors {
+		switch rand.Intn(3) {
+		case 0:
+			body["error_code"] = "SENSOR_TIMEOUT"
+		case 1:
+			body["co2_level"] = 0
+		default:
+			return nil // a lost update, which shows up as a gap
+		}
+	}
+
+	payload, _ := json.Marshal(body)
+	req, err := http.NewRequest(http.MethodPost, s.base+"/api/device/update", bytes.NewReader(payload))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	if s.key != "" {
+		req.Header.Set("X-Device-Key", s.key)
+	}
+	resp, err := s.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("update returned %s", resp.Status)
+	}
+	var answer struct {
+		Time          *string         `json:"time"`
+		Armed         *bool           `json:"armed"`
+		ConfigVersion string          `json:"config_version"`
+		StopAlarm     bool            `json:"stop_alarm"`
+		Commands      []DeviceCommand `json:"commands"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&answer); err != nil {
+		return err
+	}
+	d.results = nil
+	d.lastAck = answer.ConfigVersion
+	for _, cmd := range answer.Commands {
+		log.Printf("%s: command %s", d.name, cmd.Command)
+		if cmd.Command == "reboot" {
+			d.booted = now
+		}
+		d.results = append(d.results, CommandResult{ID: cmd.ID, OK: true})
+	}
+
+	// Ring when the armed alarm is due, until stopped or for five minutes
+	switch {
+	case !d.ringing.IsZero() && (answer.StopAlarm || now.Sub(d.ringing) > 5*time.Minute):
+		log.Printf("%s: alarm stopped", d.name)
+		d.ringing = time.Time{}
+	case d.ringing.IsZero() && d.bedroom && answer.Armed != nil && *answer.Armed && answer.Time != nil &&
+		*answer.Time == now.Format("15:04") && d.rangAt != now.Format("2006-01-02 15:04"):
+		log.Printf("%s: alarm ringing", d.name)
+		d.ringing, d.rangAt = now, now.Format("2006-01-02 15:04")
+	}
+	return nil
+}
+
+func runSimulate(args []string) int {
+	fs := flag.NewFlagSet("simulate", flag.ExitOnError)
+	base := fs.String("url", "http://localhost:8080", "server to send the updates to")
+	devices := fs.String("devices", "bedroom", "comma-separated device names")
+	interval := fs.Duration("interval", 10*time.Second, "time between updates")
+	history := fs.Duration("history", 0, "past data to send with the first update, e.g. 24h")
+	errorRate := fs.Float64("errors", 0.02, "share of updates that fail in some way")
+	key := fs.String("key", os.Getenv("DEVICE_KEY"), "device key, for servers that require one")
+	force := fs.Bool("force", false, "allow a server that is not on localhost")
+	fs.Parse(args)
+
+	u, err := url.Parse(*base)
+	if err != nil || u.Host == "" {
+		fmt.Fprintln(os.Stderr, "-url must be a URL like http://localhost:8080")
+		return 2
+	}
+	if host := u.Hostname(); host != "localhost" && host != "127.0.0.1" && host != "::1" && !*force {
+		fmt.Fprintf(os.Stderr, "%s is not a local server; pass -force to simulate against it anyway\n", host)
+		return 2
+	}
+
+	s := &simulator{base: strings.TrimRight(*base, "/"), key: *key, interval: *interval, errors: *errorRate,
+		client: &http.Client{Timeout: 10 * time.Second}}
+	now := time.Now()
+	var sims []*simDevice
+	for _, name := range strings.Split(*devices, ",") {
+		if name = strings.TrimSpace(name); name != "" {
+			sims = append(sims, newSimDevice(name, now))
+		}
+	}
+	for _, d := range sims {
+		var samples []BufferedSample
+		if *history > 0 {
+			samples = d.history(now, *history, *interval)
+		}
+		for first := true; first || len(samples) > 0; first = false {
+			batch := samples[:min(len(samples), simHistoryBatch)]
+			samples = samples[len(batch):]
+			if err := s.update(d, now, batch); err != nil {
+				log.Printf("%s: %v", d.name, err)
+				return 1
+			}
+		}
+		log.Printf("Simulating %s against %s", d.name, s.base)
+	}
+
+	stop := make(chan os.Signal, 1)
+	signal.Notify(stop, os.Interrupt)
+	ticker := time.NewTicker(*interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-stop:
+			return 0
+		case now := <-ticker.C:
+			for _, d := range sims {
+				if err := s.update(d, now, nil); err != nil {
+					log.Printf("%s: %v", d.name, err)
+				}
+			}
+		}
+	}
+}
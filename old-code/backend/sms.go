@@ -0,0 +1,148 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"os/exec"
+	"strings"
+	"sync"
+	"time"
+)
+
+// SMS is the channel for what must reach someone even with the phone's data
+// off: by default only critical (priority 5) notifications are texted, see
+// SMS_MIN_PRIORITY. SMS_DRIVER selects one of smsDrivers:
+//
+//	twilio  the Twilio Messages API, as TWILIO_FROM with TWILIO_ACCOUNT_SID
+//	        and TWILIO_AUTH_TOKEN
+//	gammu   a GSM modem attached to this machine, through the gammu CLI
+//	        (GAMMU_CONFIG selects its config file)
+//
+// Messages go to every number in SMS_TO (comma-separated). A title is not
+// texted again within SMS_REPEAT, so a repeating backup alarm costs one
+// message, not ten.
+
+type smsDriver interface {
+	sendSMS(ctx context.Context, to, text string) error
+}
+
+var smsDrivers = map[string]func() (smsDriver, error){
+	"twilio": newTwilioSMS,
+	"gammu":  func() (smsDriver, error) { return gammuSMS{config: envString("GAMMU_CONFIG", "")}, nil },
+}
+
+type smsChannel struct {
+	driver smsDriver
+	to     []string
+
+	mu       sync.Mutex
+	lastSent map[string]time.Time // by title
+}
+
+var sms *smsChannel
+
+func initSMS() {
+	name := envString("SMS_DRIVER", "")
+	if name == "" {
+		return
+	}
+	var to []string
+	for _, n := range strings.Split(envString("SMS_TO", ""), ",") {
+		if n = strings.TrimSpace(n); n != "" {
+			to = append(to, n)
+		}
+	}
+	newDriver, ok := smsDrivers[name]
+	if !ok || len(to) == 0 {
+		log.Printf("SMS driver %q is unknown or SMS_TO is not set, SMS alerts are disabled", name)
+		return
+	}
+	driver, err := newDriver()
+	if err != nil {
+		log.Printf("SMS alerts are disabled: %v", err)
+		return
+	}
+	sms = &smsChannel{driver: driver, to: to, lastSent: make(map[string]time.Time)}
+}
+
+func (s *smsChannel) send(n Notification) error {
+	s.mu.Lock()
+	if last, ok := s.lastSent[n.Title]; ok && time.Since(last) < envDuration("SMS_REPEAT", 15*time.Minute) {
+		s.mu.Unlock()
+		return nil
+	}
+	s.lastSent[n.Title] = time.Now()
+	s.mu.Unlock()
+
+	text := n.Title + ": " + n.Message
+	if r := []rune(text); len(r) > 300 {
+		// Two concatenated messages at most
+		text = string(r[:299]) + "…"
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+	var failed []string
+	for _, to := range s.to {
+		if err := s.driver.sendSMS(ctx, to, text); err != nil {
+			failed = append(failed, fmt.Sprintf("%s: %v", to, err))
+		}
+	}
+	if len(failed) > 0 {
+		return fmt.Errorf("SMS failed for %s", strings.Join(failed, "; "))
+	}
+	return nil
+}
+
+type twilioSMS struct{ accountSID, authToken, from string }
+
+func newTwilioSMS() (smsDriver, error) {
+	t := twilioSMS{
+		accountSID: envString("TWILIO_ACCOUNT_SID", ""),
+		authToken:  envString("TWILIO_AUTH_TOKEN", ""),
+		from:       envString("TWILIO_FROM", ""),
+	}
+	if t.accountSID == "" || t.authToken == "" || t.from == "" {
+		return nil, fmt.Errorf("twilio needs TWILIO_ACCOUNT_SID, TWILIO_AUTH_TOKEN and TWILIO_FROM")
+	}
+	return t, nil
+}
+
+func (t twilioSMS) sendSMS(ctx context.Context, to, text string) error {
+	form := url.Values{"From": {t.from}, "To": {to}, "Body": {text}}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost,
+		"https://api.twilio.com/2010-04-01/Accounts/"+url.PathEscape(t.accountSID)+"/Messages.json",
+		strings.NewReader(form.Encode()))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	req.SetBasicAuth(t.accountSID, t.authToken)
+	resp, err := notifyClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode >= 300 {
+		return fmt.Errorf("twilio returned %s", resp.Status)
+	}
+	return nil
+}
+
+type gammuSMS struct{ config string }
+
+func (g gammuSMS) sendSMS(ctx context.Context, to, text string) error {
+	var args []string
+	if g.config != "" {
+		args = append(args, "-c", g.config)
+	}
+	// -autolen splits longer texts into a multipart message
+	args = append(args, "sendsms", "TEXT", to, "-unicode", "-autolen", fmt.Sprint(len([]rune(text))), "-text", text)
+	out, err := exec.CommandContext(ctx, "gammu", args...).CombinedOutput()
+	if err != nil {
+		return fmt.Errorf("gammu: %v: %s", err, strings.TrimSpace(string(out)))
+	}
+	return nil
+}
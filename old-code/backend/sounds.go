@@ -0,0 +1,262 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"time"
+
+	"github.com/labstack/echo/v4"
+)
+
+// Alarm sounds are MP3 or WAV files uploaded through POST /api/alarm/sounds
+// and stored in ALARM_SOUNDS_DIR under their content hash. The active sound
+// is part of the device configuration as the URL of
+// GET /api/device/alarm-sound, which always serves the active file and
+// supports range requests so a device can stream it. Without an active
+// sound the device uses its buzzer.
+
+type AlarmSound struct {
+	ID          int       `json:"id"`
+	Name        string    `json:"name"`
+	ContentType string    `json:"content_type"`
+	Size        int64     `json:"size"`
+	SHA256      string    `json:"sha256"`
+	Active      bool      `json:"active"`
+	CreatedAt   time.Time `json:"created_at"`
+}
+
+func soundsDir() string {
+	return envString("ALARM_SOUNDS_DIR", "sounds")
+}
+
+func (s AlarmSound) path() string {
+	ext := ".mp3"
+	if s.ContentType == "audio/wav" {
+		ext = ".wav"
+	}
+	return filepath.Join(soundsDir(), s.SHA256+ext)
+}
+
+// soundContentType recognises MP3 (ID3 tag or frame sync) and WAV files by
+// their first bytes.
+func soundContentType(head []byte) (string, bool) {
+	switch {
+	case len(head) >= 12 && bytes.Equal(head[:4], []byte("RIFF")) && bytes.Equal(head[8:12], []byte("WAVE")):
+		return "audio/wav", true
+	case len(head) >= 3 && bytes.Equal(head[:3], []byte("ID3")):
+		return "audio/mpeg", true
+	case len(head) >= 2 && head[0] == 0xFF && head[1]&0xE0 == 0xE0:
+		return "audio/mpeg", true
+	}
+	return "", false
+}
+
+const soundColumns = "id, name, content_type, size, sha256, active, created_at"
+
+func scanSound(row interface{ Scan(...interface{}) error }) (AlarmSound, error) {
+	var s AlarmSound
+	err := row.Scan(&s.ID, &s.Name, &s.ContentType, &s.Size, &s.SHA256, &s.Active, &s.CreatedAt)
+	return s, err
+}
+
+// activeSound returns the selected alarm sound, if any.
+func activeSound(ctx context.Context) (AlarmSound, bool, error) {
+	s, err := scanSound(db.QueryRowContext(ctx, "SELECT "+soundColumns+" FROM alarm_sounds WHERE active"))
+	if err == sql.ErrNoRows {
+		return s, false, nil
+	}
+	return s, err == nil, err
+}
+
+// activeSoundURL is the sound part of the device configuration. The hash
+// query parameter changes with the selection so devices re-download it.
+func activeSoundURL(ctx context.Context) (string, error) {
+	s, ok, err := activeSound(ctx)
+	if !ok {
+		return "", err
+	}
+	return "/api/device/alarm-sound?v=" + s.SHA256[:8], nil
+}
+
+func getAlarmSounds(c echo.Context) error {
+	rows, err := db.QueryContext(c.Request().Context(), "SELECT "+soundColumns+" FROM alarm_sounds ORDER BY id")
+	if err != nil {
+		return internalError(c, err)
+	}
+	defer rows.Close()
+
+	sounds := []AlarmSound{}
+	for rows.Next() {
+		s, err := scanSound(rows)
+		if err != nil {
+			return internalError(c, err)
+		}
+		sounds = append(sounds, s)
+	}
+	return c.JSON(http.StatusOK, sounds)
+}
+
+// uploadAlarmSound takes a multipart "file" and an optional "name".
+func uploadAlarmSound(c echo.Context) error {
+	header, err := c.FormFile("file")
+	if err != nil {
+		return apiError(c, http.StatusBadRequest, "missing file")
+	}
+	maxSize := int64(envInt("ALARM_SOUND_MAX_BYTES", 10<<20))
+	if header.Size > maxSize {
+		return apiError(c, http.StatusRequestEntityTooLarge, fmt.Sprintf("sound files are limited to %d bytes", maxSize))
+	}
+	f, err := header.Open()
+	if err != nil {
+		return internalError(c, err)
+	}
+	defer f.Close()
+	data, err := io.ReadAll(io.LimitReader(f, maxSize+1))
+	if err != nil {
+		return internalError(c, err)
+	}
+	if int64(len(data)) > maxSize {
+		return apiError(c, http.StatusRequestEntityTooLarge, fmt.Sprintf("sound files are limited to %d bytes", maxSize))
+	}
+	contentType, ok := soundContentType(data)
+	if !ok {
+		return apiError(c, http.StatusBadRequest, "only MP3 and WAV files are supported")
+	}
+
+	sum := sha256.Sum256(data)
+	s := AlarmSound{
+		Name:        c.FormValue("name"),
+		ContentType: contentType,
+		Size:        int64(len(data)),
+		SHA256:      hex.EncodeToString(sum[:]),
+	}
+	if s.Name == "" {
+		s.Name = header.Filename
+	}
+	if err := os.MkdirAll(soundsDir(), 0o755); err != nil {
+		return internalError(c, err)
+	}
+	if err := os.WriteFile(s.path(), data, 0o644); err != nil {
+		return internalError(c, err)
+	}
+
+	s, err = scanSound(db.QueryRowContext(c.Request().Context(), `
+		INSERT INTO alarm_sounds (name, content_type, size, sha256) VALUES ($1, $2, $3, $4)
+		RETURNING `+soundColumns,
+		s.Name, s.ContentType, s.Size, s.SHA256))
+	if err != nil {
+		return internalError(c, err)
+	}
+	return c.JSON(http.StatusCreated, s)
+}
+
+// selectAlarmSound sets the active sound: {"id": 3}, or {"id": null} to go
+// back to the buzzer.
+func selectAlarmSound(c echo.Context) error {
+	var req struct {
+		ID *int `json:"id"`
+	}
+	if err := c.Bind(&req); err != nil {
+		return invalidBody(c, err)
+	}
+
+	tx, err := db.BeginTx(c.Request().Context(), nil)
+	if err != nil {
+		return internalError(c, err)
+	}
+	defer tx.Rollback()
+	if _, err := tx.Exec("UPDATE alarm_sounds SET active = false WHERE active"); err != nil {
+		return internalError(c, err)
+	}
+	if req.ID != nil {
+		res, err := tx.Exec("UPDATE alarm_sounds SET active = true WHERE id = $1", *req.ID)
+		if err != nil {
+			return internalError(c, err)
+		}
+		if n, _ := res.RowsAffected(); n == 0 {
+			return apiErrorCode(c, http.StatusNotFound, "sound_not_found", "sound not found")
+		}
+	}
+	if err := tx.Commit(); err != nil {
+		return internalError(c, err)
+	}
+	publish(EventAlarmChanged, map[string]interface{}{"sound_id": req.ID})
+	return getAlarmSounds(c)
+}
+
+func soundFromParam(c echo.Context) (AlarmSound, error) {
+	id, err := strconv.Atoi(c.Param("id"))
+	if err != nil {
+		return AlarmSound{}, newRequestError(http.StatusBadRequest, "invalid_request", "invalid sound id")
+	}
+	s, err := scanSound(db.QueryRowContext(c.Request().Context(), "SELECT "+soundColumns+" FROM alarm_sounds WHERE id = $1", id))
+	if err == sql.ErrNoRows {
+		return s, newRequestError(http.StatusNotFound, "sound_not_found", "sound not found")
+	}
+	return s, err
+}
+
+func deleteAlarmSound(c echo.Context) error {
+	s, err := soundFromParam(c)
+	if err != nil {
+		return handlerError(c, err)
+	}
+	if _, err := db.Exec("DELETE FROM alarm_sounds WHERE id = $1", s.ID); err != nil {
+		return internalError(c, err)
+	}
+	// The same file may have been uploaded twice
+	var shared bool
+	db.QueryRow("SELECT EXISTS (SELECT 1 FROM alarm_sounds WHERE sha256 = $1)", s.SHA256).Scan(&shared)
+	if !shared {
+		os.Remove(s.path())
+	}
+	if s.Active {
+		publish(EventAlarmChanged, map[string]interface{}{"sound_id": nil})
+	}
+	return c.NoContent(http.StatusNoContent)
+}
+
+func getAlarmSoundFile(c echo.Context) error {
+	s, err := soundFromParam(c)
+	if err != nil {
+		return handlerError(c, err)
+	}
+	return serveSound(c, s)
+}
+
+// getDeviceAlarmSound serves the active sound to devices.
+func getDeviceAlarmSound(c echo.Context) error {
+	s, ok, err := activeSound(c.Request().Context())
+	if err != nil {
+		return internalError(c, err)
+	}
+	if !ok {
+		return apiError(c, http.StatusNotFound, "no alarm sound selected")
+	}
+	return serveSound(c, s)
+}
+
+// serveSound streams a sound file; http.ServeContent handles Range and
+// If-None-Match requests.
+func serveSound(c echo.Context, s AlarmSound) error {
+	f, err := os.Open(s.path())
+	if err != nil {
+		return apiError(c, http.StatusNotFound, "sound file missing")
+	}
+	defer f.Close()
+	header := c.Response().Header()
+	header.Set(echo.HeaderContentType, s.ContentType)
+	header.Set("ETag", `"`+s.SHA256+`"`)
+	header.Set("Cache-Control", "no-cache")
+	http.ServeContent(c.Response(), c.Request(), "", s.CreatedAt, f)
+	return nil
+}
@@ -0,0 +1,168 @@
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"crypto/sha256"
+	"embed"
+	"encoding/hex"
+	"io/fs"
+	"mime"
+	"net/http"
+	"path"
+	"regexp"
+	"strings"
+	"time"
+
+	"github.com/labstack/echo/v4"
+)
+
+// The built frontend is embedded into the binary: `make build-frontend`
+// copies frontend/build into backend/static before the backend is built.
+// Fingerprinted assets (main.6a165fb5.css) are cached for a year, other
+// files revalidate against their ETag and index.html is never cached, so a
+// deploy is picked up on the next page load. Any path that is not a file
+// serves index.html for client-side routing.
+//
+// Assets are sent Brotli or gzip compressed when the client accepts it,
+// preferring the .br/.gz variants made at build time and otherwise gzipping
+// text assets once at startup.
+
+//go:embed all:static
+var embeddedStatic embed.FS
+
+var fingerprinted = regexp.MustCompile(`\.[0-9a-f]{8,}\.(chunk\.)?[a-z0-9]+$`)
+
+type staticAsset struct {
+	data     []byte
+	etag     string
+	br, gz   []byte // compressed variants, if any
+	compress bool
+}
+
+var compressibleTypes = []string{".html", ".css", ".js", ".json", ".map", ".svg", ".txt", ".ico"}
+
+func compressible(name string) bool {
+	for _, ext := range compressibleTypes {
+		if strings.HasSuffix(name, ext) {
+			return true
+		}
+	}
+	return false
+}
+
+func gzipBytes(data []byte) []byte {
+	var buf bytes.Buffer
+	w, _ := gzip.NewWriterLevel(&buf, gzip.BestCompression)
+	w.Write(data)
+	w.Close()
+	return buf.Bytes()
+}
+
+// acceptsEncoding reports whether an Accept-Encoding header allows enc.
+func acceptsEncoding(header, enc string) bool {
+	for _, part := range strings.Split(header, ",") {
+		name, params, _ := strings.Cut(strings.TrimSpace(part), ";")
+		if strings.TrimSpace(name) != enc {
+			continue
+		}
+		q := strings.ReplaceAll(params, " ", "")
+		return q != "q=0" && q != "q=0.0" && q != "q=0.00" && q != "q=0.000"
+	}
+	return false
+}
+
+var (
+	staticFS     fs.FS
+	staticAssets = make(map[string]staticAsset) // by path without leading slash
+)
+
+func initStatic() {
+	sub, err := fs.Sub(embeddedStatic, "static")
+	if err != nil {
+		panic(err)
+	}
+	staticFS = sub
+	fs.WalkDir(staticFS, ".", func(p string, d fs.DirEntry, err error) error {
+		if err != nil || d.IsDir() || strings.HasPrefix(d.Name(), ".") {
+			return err
+		}
+		data, err := fs.ReadFile(staticFS, p)
+		if err != nil {
+			return err
+		}
+		sum := sha256.Sum256(data)
+		staticAssets[p] = staticAsset{data: data, etag: `"` + hex.EncodeToString(sum[:8]) + `"`}
+		return nil
+	})
+
+	// Attach the precompressed variants to their originals.
+	var variants []string
+	for p, asset := range staticAssets {
+		if strings.HasSuffix(p, ".br") || strings.HasSuffix(p, ".gz") {
+			continue
+		}
+		if v, ok := staticAssets[p+".br"]; ok {
+			asset.br = v.data
+			variants = append(variants, p+".br")
+		}
+		if v, ok := staticAssets[p+".gz"]; ok {
+			asset.gz = v.data
+			variants = append(variants, p+".gz")
+		} else if compressible(p) && len(asset.data) > 1024 {
+			asset.gz = gzipBytes(asset.data)
+		}
+		asset.compress = compressible(p) || asset.br != nil || asset.gz != nil
+		staticAssets[p] = asset
+	}
+	for _, p := range variants {
+		delete(staticAssets, p)
+	}
+}
+
+func cacheControl(name string) string {
+	switch {
+	case name == "index.html":
+		return "no-cache"
+	case fingerprinted.MatchString(name):
+		return "public, max-age=31536000, immutable"
+	default:
+		return "public, max-age=3600"
+	}
+}
+
+func serveStatic(c echo.Context) error {
+	name := strings.TrimPrefix(path.Clean("/"+c.Param("*")), "/")
+	asset, ok := staticAssets[name]
+	if !ok {
+		name = "index.html"
+		if asset, ok = staticAssets[name]; !ok {
+			return c.String(http.StatusNotFound, "frontend not built: run make build-frontend")
+		}
+	}
+
+	h := c.Response().Header()
+	h.Set(echo.HeaderCacheControl, cacheControl(name))
+	data, etag := asset.data, asset.etag
+	if asset.compress {
+		h.Add(echo.HeaderVary, echo.HeaderAcceptEncoding)
+		accept := c.Request().Header.Get(echo.HeaderAcceptEncoding)
+		switch {
+		case asset.br != nil && acceptsEncoding(accept, "br"):
+			data, etag = asset.br, strings.TrimSuffix(etag, `"`)+`-br"`
+			h.Set(echo.HeaderContentEncoding, "br")
+		case asset.gz != nil && acceptsEncoding(accept, "gzip"):
+			data, etag = asset.gz, strings.TrimSuffix(etag, `"`)+`-gz"`
+			h.Set(echo.HeaderContentEncoding, "gzip")
+		}
+	}
+	if h.Get(echo.HeaderContentType) == "" {
+		// Set from the original name, ServeContent would sniff the compressed bytes
+		if ctype := mime.TypeByExtension(path.Ext(name)); ctype != "" {
+			h.Set(echo.HeaderContentType, ctype)
+		}
+	}
+	h.Set("ETag", etag)
+	http.ServeContent(c.Response(), c.Request(), name, time.Time{}, bytes.NewReader(data))
+	return nil
+}
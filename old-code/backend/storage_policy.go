@@ -0,0 +1,224 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"math"
+	"net/http"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/labstack/echo/v4"
+)
+
+// A StoragePolicy stores a metric only when it changes: a reading is
+// written when it moved at least Delta from the last one stored for the
+// device, or MaxIntervalSeconds after it, and skipped otherwise. Rules,
+// events and the device response still see every reading, and the
+// device's last_seen is updated on every update as before.
+//
+// co2 and sound share a row of sensor_data and device_status, which is
+// skipped only while both have a policy, neither moved and the device's
+// error code and alarm state are unchanged. Their max_interval_seconds may
+// not exceed device_offline_after, or the device would look offline in
+// between (see timeline.go). Readings older than the last stored one, e.g.
+// buffered samples, are always stored. What was stored last is kept in
+// memory, so the first reading after a restart is always written.
+
+type StoragePolicy struct {
+	Metric             string  `json:"metric"`
+	Delta              float64 `json:"delta"`
+	MaxIntervalSeconds int     `json:"max_interval_seconds"`
+	Suppressed         int64   `json:"suppressed"` // readings skipped since the server started
+}
+
+type storageKey struct {
+	deviceID int
+	metric   string
+}
+
+type storedSample struct {
+	value float64
+	at    time.Time
+}
+
+type storedStatus struct {
+	errorCode string
+	alarm     bool
+}
+
+var (
+	storageMu         sync.Mutex
+	storedSamples     = make(map[storageKey]storedSample)
+	storedStatuses    = make(map[int]storedStatus)
+	storageSuppressed = make(map[string]int64)
+)
+
+func loadStoragePolicies() (map[string]StoragePolicy, error) {
+	rows, err := db.Query("SELECT metric, delta, max_interval_seconds FROM metric_storage_policies")
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	policies := make(map[string]StoragePolicy)
+	for rows.Next() {
+		var p StoragePolicy
+		if err := rows.Scan(&p.Metric, &p.Delta, &p.MaxIntervalSeconds); err != nil {
+			return nil, err
+		}
+		policies[p.Metric] = p
+	}
+	return policies, rows.Err()
+}
+
+// due reports whether v is to be stored after last; storageMu is held.
+func (p StoragePolicy) due(key storageKey, v float64, at time.Time) bool {
+	last, ok := storedSamples[key]
+	return !ok || at.Before(last.at) || math.Abs(v-last.value) >= p.Delta ||
+		at.Sub(last.at) >= time.Duration(p.MaxIntervalSeconds)*time.Second
+}
+
+// remember records v as stored; storageMu is held.
+func remember(key storageKey, v float64, at time.Time) {
+	if last, ok := storedSamples[key]; !ok || !at.Before(last.at) {
+		storedSamples[key] = storedSample{v, at}
+	}
+}
+
+// storagePolicies returns the policies; ones that cannot be loaded are
+// logged and left out, so everything is stored.
+func storagePolicies() map[string]StoragePolicy {
+	policies, err := loadStoragePolicies()
+	if err != nil {
+		log.Printf("Loading the storage policies failed: %v", err)
+	}
+	return policies
+}
+
+// readingDue reports whether a device reading is to be stored.
+func readingDue(r reading) bool {
+	policies := storagePolicies()
+	if len(policies) == 0 {
+		return true
+	}
+	status := storedStatus{alarm: r.alarmActive}
+	if r.errorCode != nil {
+		status.errorCode = *r.errorCode
+	}
+	values := map[string]float64{"co2": r.co2, "sound": r.sound}
+
+	storageMu.Lock()
+	defer storageMu.Unlock()
+	last, seen := storedStatuses[r.deviceID]
+	due := !seen || last != status
+	for metric, v := range values {
+		p, ok := policies[metric]
+		due = due || !ok || p.due(storageKey{r.deviceID, metric}, v, r.at)
+	}
+	if !due {
+		for metric := range values {
+			storageSuppressed[metric]++
+		}
+		return false
+	}
+	storedStatuses[r.deviceID] = status
+	for metric, v := range values {
+		remember(storageKey{r.deviceID, metric}, v, r.at)
+	}
+	return true
+}
+
+// dropUnchanged returns the values of a device that are to be stored.
+func dropUnchanged(deviceID int, values map[string]float64, at time.Time) map[string]float64 {
+	policies := storagePolicies()
+	if len(policies) == 0 {
+		return values
+	}
+	storageMu.Lock()
+	defer storageMu.Unlock()
+	kept := make(map[string]float64, len(values))
+	for metric, v := range values {
+		key := storageKey{deviceID, metric}
+		if p, ok := policies[metric]; ok && !p.due(key, v, at) {
+			storageSuppressed[metric]++
+			continue
+		}
+		remember(key, v, at)
+		kept[metric] = v
+	}
+	return kept
+}
+
+// resetStorageState forgets what was stored of a metric after its policy
+// changed.
+func resetStorageState(metric string) {
+	storageMu.Lock()
+	defer storageMu.Unlock()
+	for key := range storedSamples {
+		if key.metric == metric {
+			delete(storedSamples, key)
+		}
+	}
+	delete(storageSuppressed, metric)
+}
+
+func getStoragePolicies(c echo.Context) error {
+	policies, err := loadStoragePolicies()
+	if err != nil {
+		return internalError(c, err)
+	}
+	list := []StoragePolicy{}
+	storageMu.Lock()
+	for _, p := range policies {
+		p.Suppressed = storageSuppressed[p.Metric]
+		list = append(list, p)
+	}
+	storageMu.Unlock()
+	sort.Slice(list, func(i, j int) bool { return list[i].Metric < list[j].Metric })
+	return c.JSON(http.StatusOK, list)
+}
+
+// putStoragePolicy sets the policy of a metric, e.g. {"delta": 20,
+// "max_interval_seconds": 300}.
+func putStoragePolicy(c echo.Context) error {
+	var p StoragePolicy
+	if err := c.Bind(&p); err != nil {
+		return invalidBody(c, err)
+	}
+	p.Metric = c.Param("metric")
+	if !knownMetric(p.Metric) {
+		return apiError(c, http.StatusBadRequest, "unknown metric")
+	}
+	if p.Delta <= 0 {
+		return apiError(c, http.StatusBadRequest, "delta must be positive")
+	}
+	if p.MaxIntervalSeconds <= 0 {
+		return apiError(c, http.StatusBadRequest, "max_interval_seconds must be positive")
+	}
+	if _, builtin := metricColumns[p.Metric]; builtin {
+		if limit := settingDuration("device_offline_after"); time.Duration(p.MaxIntervalSeconds)*time.Second > limit {
+			return apiError(c, http.StatusBadRequest, fmt.Sprintf("max_interval_seconds must not exceed device_offline_after (%s)", limit))
+		}
+	}
+
+	_, err := db.Exec(`
+		INSERT INTO metric_storage_policies (metric, delta, max_interval_seconds) VALUES ($1, $2, $3)
+		ON CONFLICT (metric) DO UPDATE SET delta = EXCLUDED.delta, max_interval_seconds = EXCLUDED.max_interval_seconds
+	`, p.Metric, p.Delta, p.MaxIntervalSeconds)
+	if err != nil {
+		return internalError(c, err)
+	}
+	resetStorageState(p.Metric)
+	p.Suppressed = 0
+	return c.JSON(http.StatusOK, p)
+}
+
+func deleteStoragePolicy(c echo.Context) error {
+	metric := c.Param("metric")
+	if _, err := db.Exec("DELETE FROM metric_storage_policies WHERE metric = $1", metric); err != nil {
+		return internalError(c, err)
+	}
+	resetStorageState(metric)
+	return c.NoContent(http.StatusNoContent)
+}
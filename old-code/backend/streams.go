@@ -0,0 +1,263 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/labstack/echo/v4"
+)
+
+// Internet radio streams registered through POST /api/alarm/streams can be
+// selected as the wake-up source. The stream_check job probes every stream
+// so the device is never sent to a dead one: while the selected stream is
+// unreachable the device gets the first reachable other stream instead, and
+// the next reachable one as "stream_fallback". Without any reachable stream
+// the device falls back to the alarm sound or its buzzer.
+
+type AlarmStream struct {
+	ID          int        `json:"id"`
+	Name        string     `json:"name"`
+	URL         string     `json:"url"`
+	Active      bool       `json:"active"`
+	Reachable   *bool      `json:"reachable"` // null until checked
+	LastError   string     `json:"last_error,omitempty"`
+	LastChecked *time.Time `json:"last_checked,omitempty"`
+}
+
+const streamColumns = "id, name, url, active, reachable, COALESCE(last_error, ''), last_checked"
+
+func scanStream(row interface{ Scan(...interface{}) error }) (AlarmStream, error) {
+	var s AlarmStream
+	var reachable sql.NullBool
+	var checked sql.NullTime
+	err := row.Scan(&s.ID, &s.Name, &s.URL, &s.Active, &reachable, &s.LastError, &checked)
+	if reachable.Valid {
+		s.Reachable = &reachable.Bool
+	}
+	if checked.Valid {
+		s.LastChecked = &checked.Time
+	}
+	return s, err
+}
+
+func loadStreams(ctx context.Context) ([]AlarmStream, error) {
+	rows, err := db.QueryContext(ctx, "SELECT "+streamColumns+" FROM alarm_streams ORDER BY id")
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	streams := []AlarmStream{}
+	for rows.Next() {
+		s, err := scanStream(rows)
+		if err != nil {
+			return nil, err
+		}
+		streams = append(streams, s)
+	}
+	return streams, rows.Err()
+}
+
+// deviceStreams picks the stream and fallback for the device configuration.
+// Streams that were never checked count as reachable.
+func deviceStreams(ctx context.Context) (stream, fallback string, err error) {
+	streams, err := loadStreams(ctx)
+	if err != nil {
+		return "", "", err
+	}
+	var active *AlarmStream
+	var others []string
+	for i, s := range streams {
+		if s.Active {
+			active = &streams[i]
+		} else if s.Reachable == nil || *s.Reachable {
+			others = append(others, s.URL)
+		}
+	}
+	if active == nil {
+		return "", "", nil
+	}
+	candidates := others
+	if active.Reachable == nil || *active.Reachable {
+		candidates = append([]string{active.URL}, others...)
+	}
+	if len(candidates) > 0 {
+		stream = candidates[0]
+	}
+	if len(candidates) > 1 {
+		fallback = candidates[1]
+	}
+	return stream, fallback, nil
+}
+
+var streamClient = &http.Client{Timeout: 15 * time.Second}
+
+// probeStream connects to a stream and reads its first bytes. Servers that
+// answer with an HTML page (a dead station's landing page) don't count.
+func probeStream(ctx context.Context, streamURL string) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, streamURL, nil)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Icy-MetaData", "0")
+	resp, err := streamClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return fmt.Errorf("%s", resp.Status)
+	}
+	if strings.HasPrefix(resp.Header.Get("Content-Type"), "text/html") {
+		return fmt.Errorf("not an audio stream (text/html)")
+	}
+	n, err := io.CopyN(io.Discard, resp.Body, 16*1024)
+	if n == 0 && err != nil {
+		return fmt.Errorf("no data: %v", err)
+	}
+	return nil
+}
+
+func checkStream(ctx context.Context, s AlarmStream) error {
+	probeErr := probeStream(ctx, s.URL)
+	lastError := ""
+	if probeErr != nil {
+		lastError = probeErr.Error()
+	}
+	_, err := db.ExecContext(ctx, `
+		UPDATE alarm_streams SET reachable = $2, last_error = NULLIF($3, ''), last_checked = NOW() WHERE id = $1
+	`, s.ID, probeErr == nil, lastError)
+	if err != nil {
+		return err
+	}
+
+	wasReachable := s.Reachable == nil || *s.Reachable
+	if s.Active && wasReachable && probeErr != nil {
+		notify(Notification{
+			Event:   "alarm",
+			Title:   "Alarm stream unreachable",
+			Message: fmt.Sprintf("%s is not reachable (%v), the alarm will use a fallback", s.Name, probeErr),
+			Tags:    []string{"radio"},
+		})
+	}
+	if s.Reachable != nil && *s.Reachable != (probeErr == nil) {
+		publish(EventAlarmChanged, map[string]interface{}{"stream_id": s.ID, "reachable": probeErr == nil})
+	}
+	return nil
+}
+
+// checkStreams is the stream_check job.
+func checkStreams() error {
+	ctx := context.Background()
+	streams, err := loadStreams(ctx)
+	if err != nil {
+		return err
+	}
+	for _, s := range streams {
+		if err := checkStream(ctx, s); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func getAlarmStreams(c echo.Context) error {
+	streams, err := loadStreams(c.Request().Context())
+	if err != nil {
+		return internalError(c, err)
+	}
+	return c.JSON(http.StatusOK, streams)
+}
+
+// createAlarmStream registers {"name", "url"} and checks it right away.
+func createAlarmStream(c echo.Context) error {
+	var req struct {
+		Name string `json:"name"`
+		URL  string `json:"url"`
+	}
+	if err := c.Bind(&req); err != nil {
+		return invalidBody(c, err)
+	}
+	u, err := url.Parse(req.URL)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return apiError(c, http.StatusBadRequest, "url must be an http(s) URL")
+	}
+	if req.Name == "" {
+		req.Name = u.Host
+	}
+
+	ctx := c.Request().Context()
+	s, err := scanStream(db.QueryRowContext(ctx, `
+		INSERT INTO alarm_streams (name, url) VALUES ($1, $2) RETURNING `+streamColumns,
+		req.Name, req.URL))
+	if err != nil {
+		return internalError(c, err)
+	}
+	if err := checkStream(ctx, s); err != nil {
+		return internalError(c, err)
+	}
+	s, err = scanStream(db.QueryRowContext(ctx, "SELECT "+streamColumns+" FROM alarm_streams WHERE id = $1", s.ID))
+	if err != nil {
+		return internalError(c, err)
+	}
+	return c.JSON(http.StatusCreated, s)
+}
+
+// selectAlarmStream sets the wake-up stream: {"id": 2}, or {"id": null} to
+// wake up to the alarm sound.
+func selectAlarmStream(c echo.Context) error {
+	var req struct {
+		ID *int `json:"id"`
+	}
+	if err := c.Bind(&req); err != nil {
+		return invalidBody(c, err)
+	}
+
+	tx, err := db.BeginTx(c.Request().Context(), nil)
+	if err != nil {
+		return internalError(c, err)
+	}
+	defer tx.Rollback()
+	if _, err := tx.Exec("UPDATE alarm_streams SET active = false WHERE active"); err != nil {
+		return internalError(c, err)
+	}
+	if req.ID != nil {
+		res, err := tx.Exec("UPDATE alarm_streams SET active = true WHERE id = $1", *req.ID)
+		if err != nil {
+			return internalError(c, err)
+		}
+		if n, _ := res.RowsAffected(); n == 0 {
+			return apiError(c, http.StatusNotFound, "stream not found")
+		}
+	}
+	if err := tx.Commit(); err != nil {
+		return internalError(c, err)
+	}
+	publish(EventAlarmChanged, map[string]interface{}{"stream_id": req.ID})
+	return getAlarmStreams(c)
+}
+
+func deleteAlarmStream(c echo.Context) error {
+	id, err := strconv.Atoi(c.Param("id"))
+	if err != nil {
+		return apiError(c, http.StatusBadRequest, "invalid stream id")
+	}
+	var active bool
+	err = db.QueryRow("DELETE FROM alarm_streams WHERE id = $1 RETURNING active", id).Scan(&active)
+	if err == sql.ErrNoRows {
+		return apiError(c, http.StatusNotFound, "stream not found")
+	}
+	if err != nil {
+		return internalError(c, err)
+	}
+	if active {
+		publish(EventAlarmChanged, map[string]interface{}{"stream_id": nil})
+	}
+	return c.NoContent(http.StatusNoContent)
+}
@@ -0,0 +1,146 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/labstack/echo/v4"
+)
+
+// Devices may add their health to updates: rssi (dBm), battery_pct,
+// free_heap (bytes) and uptime_seconds. Each is stored as a metric of the
+// device, so it can be charted with GET /api/devices/:id/telemetry and used
+// in rules, e.g. battery_pct < 15, or uptime_seconds < 300 to hear about
+// reboots.
+
+var telemetryMetrics = []string{"rssi", "battery_pct", "free_heap", "uptime_seconds"}
+
+func isTelemetryMetric(name string) bool {
+	for _, m := range telemetryMetrics {
+		if m == name {
+			return true
+		}
+	}
+	return false
+}
+
+// telemetry returns the telemetry values the update carries.
+func (u DeviceUpdate) telemetry() map[string]float64 {
+	values := make(map[string]float64)
+	for name, v := range map[string]*float64{
+		"rssi":           u.RSSI,
+		"battery_pct":    u.BatteryPct,
+		"free_heap":      u.FreeHeap,
+		"uptime_seconds": u.UptimeSeconds,
+	} {
+		if v != nil {
+			values[name] = *v
+		}
+	}
+	return values
+}
+
+// storeMetricSamples writes values of non-built-in metrics for a device,
+// except those their storage policy skips.
+func storeMetricSamples(ctx context.Context, deviceID int, values map[string]float64, at time.Time) error {
+	duplicates := 0
+	for name, v := range dropUnchanged(deviceID, values, at) {
+		if _, builtin := metricColumns[name]; builtin {
+			continue
+		}
+		res, err := db.ExecContext(ctx, `
+			INSERT INTO metric_samples (metric, device_id, timestamp, value) VALUES ($1, $2, $3, $4)
+			ON CONFLICT DO NOTHING
+		`, name, deviceID, at, v)
+		if err != nil {
+			return err
+		}
+		if n, _ := res.RowsAffected(); n == 0 {
+			duplicates++
+		}
+	}
+	recordRejectedSamples(ctx, deviceID, "duplicate", duplicates)
+	return nil
+}
+
+// latestTelemetry returns the last reported value of each telemetry metric.
+func latestTelemetry(ctx context.Context, deviceID int) (map[string]float64, error) {
+	rows, err := db.QueryContext(ctx, `
+		SELECT DISTINCT ON (metric) metric, value
+		FROM metric_samples
+		WHERE device_id = $1 AND metric = ANY(string_to_array($2, ','))
+		ORDER BY metric, timestamp DESC
+	`, deviceID, strings.Join(telemetryMetrics, ","))
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	values := make(map[string]float64)
+	for rows.Next() {
+		var name string
+		var v float64
+		if err := rows.Scan(&name, &v); err != nil {
+			return nil, err
+		}
+		values[name] = v
+	}
+	return values, rows.Err()
+}
+
+// getDeviceTelemetry returns the telemetry series of a device over the last
+// ?hours (default 24), averaged into ?step buckets (default 5m).
+func getDeviceTelemetry(c echo.Context) error {
+	device, err := deviceFromParam(c)
+	if err != nil {
+		return handlerError(c, err)
+	}
+	hours := 24
+	if v := c.QueryParam("hours"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 1 || n > 24*31 {
+			return apiError(c, http.StatusBadRequest, "hours must be between 1 and 744")
+		}
+		hours = n
+	}
+	step := 5 * time.Minute
+	if v := c.QueryParam("step"); v != "" {
+		d, err := time.ParseDuration(v)
+		if err != nil || d < time.Minute {
+			return apiError(c, http.StatusBadRequest, "step must be a duration of at least 1m")
+		}
+		step = d
+	}
+
+	rows, err := db.QueryContext(c.Request().Context(), `
+		SELECT metric, timestamp, value
+		FROM metric_samples
+		WHERE device_id = $1 AND metric = ANY(string_to_array($2, ',')) AND timestamp > $3
+		ORDER BY timestamp
+	`, device.ID, strings.Join(telemetryMetrics, ","), time.Now().Add(-time.Duration(hours)*time.Hour))
+	if err != nil {
+		return internalError(c, err)
+	}
+	defer rows.Close()
+
+	series := make(map[string][]Point)
+	for _, m := range telemetryMetrics {
+		series[m] = []Point{}
+	}
+	for rows.Next() {
+		var name string
+		var p Point
+		if err := rows.Scan(&name, &p.Timestamp, &p.Value); err != nil {
+			return internalError(c, err)
+		}
+		series[name] = append(series[name], p)
+	}
+	for name, points := range series {
+		if len(points) > 0 {
+			series[name] = bucketAverages(points, step)
+		}
+	}
+	return c.JSON(http.StatusOK, series)
+}
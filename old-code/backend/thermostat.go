@@ -0,0 +1,475 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"log"
+	"maps"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/labstack/echo/v4"
+)
+
+// THERMOSTAT_URL connects the heating controller, one of
+//
+//	http(s)://...  polled every minute by the thermostat_poll job, it
+//	               answers GET with the rooms as JSON, [{"room": "bedroom",
+//	               "temperature": 18.5, "target": 20, "heating": true}], and
+//	               takes {"room", "target", "minutes"} POSTed to the same URL
+//	mqtt(s)://...  each room publishes {"temperature", "target", "heating"}
+//	               to THERMOSTAT_TOPIC/<room>/state and gets {"target",
+//	               "minutes"} on THERMOSTAT_TOPIC/<room>/set
+//
+// minutes > 0 asks for a boost, a target that holds for that long. Room
+// readings are stored as the temperature, heating_target and heating (1 or
+// 0) metrics of a device named thermostat_<room>, so they can be charted and
+// used in rules.
+//
+// Heating rules boost a room before the alarm: when the room is below
+// "below" lead_minutes before an armed alarm, the heating_boost job sets it
+// to "target" for boost_minutes. Each rule is checked once per alarm.
+
+const EventThermostatBoosted = "thermostat.boosted"
+
+type ThermostatState struct {
+	Room        string     `json:"room"`
+	Temperature *float64   `json:"temperature"`
+	Target      *float64   `json:"target"`
+	Heating     *bool      `json:"heating"`
+	BoostUntil  *time.Time `json:"boost_until,omitempty"`
+	UpdatedAt   time.Time  `json:"updated_at"`
+}
+
+type thermostatDriver interface {
+	setTarget(ctx context.Context, room string, target float64, minutes int) error
+}
+
+type thermostatController struct {
+	driver thermostatDriver
+
+	mu     sync.Mutex
+	states map[string]ThermostatState // room -> latest state
+}
+
+var thermostat *thermostatController
+
+var thermostatClient = &http.Client{Timeout: 10 * time.Second}
+
+func initThermostat() {
+	u := envString("THERMOSTAT_URL", "")
+	if u == "" {
+		return
+	}
+	thermostat = &thermostatController{states: make(map[string]ThermostatState)}
+	switch {
+	case strings.HasPrefix(u, "http://") || strings.HasPrefix(u, "https://"):
+		h := httpThermostat{url: u}
+		thermostat.driver = h
+		registerJob("thermostat_poll", "@every 1m", h.poll)
+	case strings.HasPrefix(u, "mqtt://") || strings.HasPrefix(u, "mqtts://"):
+		m := &mqttThermostat{topic: strings.TrimRight(envString("THERMOSTAT_TOPIC", "thermostat"), "/")}
+		thermostat.driver = m
+		go m.subscribe(u)
+	default:
+		log.Printf("THERMOSTAT_URL must be http(s) or mqtt(s), the thermostat is disabled")
+		thermostat = nil
+		return
+	}
+	registerJob("heating_boost", "@every 1m", checkHeatingRules)
+}
+
+// thermostatMetric reports whether the thermostat records a metric, so rules
+// can use it before the first reading.
+func thermostatMetric(name string) bool {
+	return thermostat != nil && (name == "temperature" || name == "heating_target" || name == "heating")
+}
+
+// thermostatStates returns the latest state of every room, nil without a
+// thermostat.
+func thermostatStates() []ThermostatState {
+	if thermostat == nil {
+		return nil
+	}
+	thermostat.mu.Lock()
+	defer thermostat.mu.Unlock()
+	states := make([]ThermostatState, 0, len(thermostat.states))
+	for _, s := range thermostat.states {
+		states = append(states, s)
+	}
+	sort.Slice(states, func(i, j int) bool { return states[i].Room < states[j].Room })
+	return states
+}
+
+// observe records a room's state, stores its readings and evaluates rules.
+func (t *thermostatController) observe(s ThermostatState) {
+	values := make(map[string]float64)
+	if s.Temperature != nil {
+		values["temperature"] = *s.Temperature
+	}
+	if s.Target != nil {
+		values["heating_target"] = *s.Target
+	}
+	if s.Heating != nil {
+		values["heating"] = boolFloat(*s.Heating)
+	}
+
+	t.mu.Lock()
+	s.BoostUntil = t.states[s.Room].BoostUntil
+	if s.BoostUntil != nil && s.BoostUntil.Before(s.UpdatedAt) {
+		s.BoostUntil = nil
+	}
+	t.states[s.Room] = s
+	t.mu.Unlock()
+	if len(values) == 0 || !isLeader() {
+		return
+	}
+
+	ctx := context.Background()
+	deviceID, err := sensorDevice(ctx, "thermostat_"+s.Room, s.Room)
+	if err == nil {
+		err = storeMetricSamples(ctx, deviceID, values, s.UpdatedAt)
+	}
+	if err != nil {
+		log.Printf("Thermostat %s: storing readings failed: %v", s.Room, err)
+		return
+	}
+	publish(EventSensorUpdate, map[string]interface{}{"device": "thermostat_" + s.Room, "room": s.Room, "metrics": values})
+	go evaluateRules(s.Room, withRoomSensors(s.Room, maps.Clone(values)))
+}
+
+// boost sets a room's target for minutes and remembers until when.
+func (t *thermostatController) boost(ctx context.Context, room string, target float64, minutes int) error {
+	if err := t.driver.setTarget(ctx, room, target, minutes); err != nil {
+		return err
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	s := t.states[room]
+	s.Room, s.Target = room, &target
+	if minutes > 0 {
+		until := time.Now().Add(time.Duration(minutes) * time.Minute)
+		s.BoostUntil = &until
+	} else {
+		s.BoostUntil = nil
+	}
+	t.states[room] = s
+	return nil
+}
+
+type thermostatReading struct {
+	Room        string   `json:"room"`
+	Temperature *float64 `json:"temperature"`
+	Target      *float64 `json:"target"`
+	Heating     *bool    `json:"heating"`
+}
+
+type httpThermostat struct{ url string }
+
+func (h httpThermostat) poll() error {
+	req, err := http.NewRequest(http.MethodGet, h.url, nil)
+	if err != nil {
+		return err
+	}
+	resp, err := thermostatClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("thermostat: %s", resp.Status)
+	}
+	var readings []thermostatReading
+	if err := json.NewDecoder(resp.Body).Decode(&readings); err != nil {
+		return err
+	}
+	now := time.Now()
+	for _, r := range readings {
+		if r.Room != "" {
+			thermostat.observe(ThermostatState{Room: r.Room, Temperature: r.Temperature, Target: r.Target, Heating: r.Heating, UpdatedAt: now})
+		}
+	}
+	return nil
+}
+
+func (h httpThermostat) setTarget(ctx context.Context, room string, target float64, minutes int) error {
+	body, err := json.Marshal(map[string]interface{}{"room": room, "target": target, "minutes": minutes})
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, h.url, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	resp, err := thermostatClient.Do(req)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode >= 300 {
+		return fmt.Errorf("thermostat returned %s", resp.Status)
+	}
+	return nil
+}
+
+type mqttThermostat struct {
+	topic string
+
+	mu   sync.Mutex
+	conn *mqttConn // nil while disconnected
+}
+
+// subscribe keeps the broker connection open, reconnecting with backoff.
+func (m *mqttThermostat) subscribe(broker string) {
+	backoff := 5 * time.Second
+	for {
+		start := time.Now()
+		err := m.stream(broker)
+		if time.Since(start) > time.Minute {
+			backoff = 5 * time.Second
+		}
+		log.Printf("Thermostat broker disconnected: %v, retrying in %s", err, backoff)
+		time.Sleep(backoff)
+		backoff = min(backoff*2, 5*time.Minute)
+	}
+}
+
+func (m *mqttThermostat) stream(broker string) error {
+	conn, err := mqttDial(broker, "home-server-"+randomHex(4))
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	if err := conn.subscribe(m.topic + "/+/state"); err != nil {
+		return err
+	}
+	m.mu.Lock()
+	m.conn = conn
+	m.mu.Unlock()
+	defer func() {
+		m.mu.Lock()
+		m.conn = nil
+		m.mu.Unlock()
+	}()
+	log.Printf("Thermostat connected to %s", m.topic)
+	return conn.receive(func(topic string, payload []byte) {
+		room, ok := strings.CutSuffix(strings.TrimPrefix(topic, m.topic+"/"), "/state")
+		if !ok || room == "" || strings.Contains(room, "/") {
+			return
+		}
+		var r thermostatReading
+		if err := json.Unmarshal(payload, &r); err != nil {
+			log.Printf("Thermostat %s: invalid state: %v", room, err)
+			return
+		}
+		thermostat.observe(ThermostatState{Room: room, Temperature: r.Temperature, Target: r.Target, Heating: r.Heating, UpdatedAt: time.Now()})
+	})
+}
+
+func (m *mqttThermostat) setTarget(_ context.Context, room string, target float64, minutes int) error {
+	m.mu.Lock()
+	conn := m.conn
+	m.mu.Unlock()
+	if conn == nil {
+		return fmt.Errorf("thermostat broker is not connected")
+	}
+	payload, err := json.Marshal(map[string]interface{}{"target": target, "minutes": minutes})
+	if err != nil {
+		return err
+	}
+	return conn.send(m.topic+"/"+room+"/set", payload)
+}
+
+type HeatingRule struct {
+	ID           int     `json:"id"`
+	Room         string  `json:"room"`
+	Below        float64 `json:"below"` // °C
+	LeadMinutes  int     `json:"lead_minutes"`
+	Target       float64 `json:"target"` // °C
+	BoostMinutes int     `json:"boost_minutes"`
+	Enabled      bool    `json:"enabled"`
+	// The alarm the rule was last checked for
+	CheckedAlarm *time.Time `json:"checked_alarm,omitempty"`
+	BoostedAt    *time.Time `json:"boosted_at,omitempty"`
+}
+
+const heatingRuleColumns = "id, room, below, lead_minutes, target, boost_minutes, enabled, checked_alarm, boosted_at"
+
+func (r HeatingRule) validate() error {
+	if r.Room == "" {
+		return fmt.Errorf("room is required")
+	}
+	if r.LeadMinutes < 5 || r.LeadMinutes > 240 {
+		return fmt.Errorf("lead_minutes must be between 5 and 240")
+	}
+	if r.Target < 5 || r.Target > 30 || r.Below < 0 || r.Below > 30 {
+		return fmt.Errorf("below and target must be temperatures between 5 and 30")
+	}
+	if r.BoostMinutes < 1 || r.BoostMinutes > 360 {
+		return fmt.Errorf("boost_minutes must be between 1 and 360")
+	}
+	return nil
+}
+
+func loadHeatingRules(ctx context.Context) ([]HeatingRule, error) {
+	rows, err := db.QueryContext(ctx, "SELECT "+heatingRuleColumns+" FROM heating_rules ORDER BY id")
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	rules := []HeatingRule{}
+	for rows.Next() {
+		var r HeatingRule
+		if err := rows.Scan(&r.ID, &r.Room, &r.Below, &r.LeadMinutes, &r.Target, &r.BoostMinutes, &r.Enabled, &r.CheckedAlarm, &r.BoostedAt); err != nil {
+			return nil, err
+		}
+		rules = append(rules, r)
+	}
+	return rules, rows.Err()
+}
+
+// checkHeatingRules is the heating_boost job. Each enabled rule is checked
+// once per armed alarm, as soon as the alarm is less than lead_minutes
+// away; a room without a temperature yet is checked again a minute later.
+func checkHeatingRules() error {
+	now := time.Now()
+	alarm, err := currentAlarm()
+	if err == sql.ErrNoRows {
+		return nil
+	} else if err != nil {
+		return err
+	}
+	alarmAt, err := nextAlarmAt(alarm.Time, now)
+	if err != nil {
+		return err
+	}
+	if !alarm.Armed || maintenanceActive(now) {
+		return nil
+	}
+	if skipped, err := nextAlarmSkipped(now); err != nil || skipped {
+		return err
+	}
+	ctx := context.Background()
+	rules, err := loadHeatingRules(ctx)
+	if err != nil {
+		return err
+	}
+
+	// checked_alarm is a TIMESTAMP, read back without its zone, so the alarm
+	// is stored and compared as the server's wall clock
+	checked := serverTime(alarmAt).Format(time.DateTime)
+	temperatures := make(map[string]float64)
+	for _, s := range thermostatStates() {
+		if s.Temperature != nil {
+			temperatures[s.Room] = *s.Temperature
+		}
+	}
+	for _, r := range rules {
+		if !r.Enabled || alarmAt.Sub(now) > time.Duration(r.LeadMinutes)*time.Minute ||
+			r.CheckedAlarm != nil && r.CheckedAlarm.Format(time.DateTime) == checked {
+			continue
+		}
+		temp, ok := temperatures[r.Room]
+		if !ok {
+			continue
+		}
+		if temp < r.Below {
+			if err := thermostat.boost(ctx, r.Room, r.Target, r.BoostMinutes); err != nil {
+				log.Printf("Heating rule %d: boost failed: %v", r.ID, err)
+				continue // tried again next minute
+			}
+			_, err = db.ExecContext(ctx, "UPDATE heating_rules SET checked_alarm = $2, boosted_at = $3 WHERE id = $1", r.ID, checked, now)
+			publish(EventThermostatBoosted, map[string]interface{}{"room": r.Room, "temperature": temp, "target": r.Target, "minutes": r.BoostMinutes})
+			log.Printf("Heating rule %d: %s is at %.1f °C, boosting to %.1f °C for %d min", r.ID, r.Room, temp, r.Target, r.BoostMinutes)
+		} else {
+			_, err = db.ExecContext(ctx, "UPDATE heating_rules SET checked_alarm = $2 WHERE id = $1", r.ID, checked)
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func getThermostat(c echo.Context) error {
+	if thermostat == nil {
+		return apiErrorCode(c, http.StatusNotFound, codeNotConfigured, "no thermostat configured")
+	}
+	return c.JSON(http.StatusOK, thermostatStates())
+}
+
+// putThermostatTarget sets a room's target: {"target": 21}, or boosts it
+// with {"target": 22, "minutes": 60}.
+func putThermostatTarget(c echo.Context) error {
+	if thermostat == nil {
+		return apiErrorCode(c, http.StatusNotFound, codeNotConfigured, "no thermostat configured")
+	}
+	var req struct {
+		Target  *float64 `json:"target"`
+		Minutes int      `json:"minutes"`
+	}
+	if err := c.Bind(&req); err != nil {
+		return invalidBody(c, err)
+	}
+	if req.Target == nil || *req.Target < 5 || *req.Target > 30 {
+		return apiError(c, http.StatusBadRequest, "target must be a temperature between 5 and 30")
+	}
+	if req.Minutes < 0 || req.Minutes > 360 {
+		return apiError(c, http.StatusBadRequest, "minutes must be between 0 and 360")
+	}
+	room := c.Param("room")
+	if err := thermostat.boost(c.Request().Context(), room, *req.Target, req.Minutes); err != nil {
+		return upstreamError(c, "thermostat request failed", err)
+	}
+	thermostat.mu.Lock()
+	defer thermostat.mu.Unlock()
+	return c.JSON(http.StatusOK, thermostat.states[room])
+}
+
+func getHeatingRules(c echo.Context) error {
+	rules, err := loadHeatingRules(c.Request().Context())
+	if err != nil {
+		return internalError(c, err)
+	}
+	return c.JSON(http.StatusOK, rules)
+}
+
+// createHeatingRule adds a rule, e.g. {"room": "bedroom", "below": 17,
+// "lead_minutes": 60, "target": 20, "boost_minutes": 90, "enabled": true}.
+func createHeatingRule(c echo.Context) error {
+	var r HeatingRule
+	if err := c.Bind(&r); err != nil {
+		return invalidBody(c, err)
+	}
+	if err := r.validate(); err != nil {
+		return apiError(c, http.StatusBadRequest, err.Error())
+	}
+	err := db.QueryRowContext(c.Request().Context(), `
+		INSERT INTO heating_rules (room, below, lead_minutes, target, boost_minutes, enabled)
+		VALUES ($1, $2, $3, $4, $5, $6) RETURNING id
+	`, r.Room, r.Below, r.LeadMinutes, r.Target, r.BoostMinutes, r.Enabled).Scan(&r.ID)
+	if err != nil {
+		return internalError(c, err)
+	}
+	r.CheckedAlarm, r.BoostedAt = nil, nil
+	return c.JSON(http.StatusCreated, r)
+}
+
+func deleteHeatingRule(c echo.Context) error {
+	id, err := strconv.Atoi(c.Param("id"))
+	if err != nil {
+		return apiError(c, http.StatusBadRequest, "invalid rule id")
+	}
+	if _, err := db.ExecContext(c.Request().Context(), "DELETE FROM heating_rules WHERE id = $1", id); err != nil {
+		return internalError(c, err)
+	}
+	return c.NoContent(http.StatusNoContent)
+}
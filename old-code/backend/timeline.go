@@ -0,0 +1,286 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"slices"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/labstack/echo/v4"
+)
+
+// GET /api/devices/:id/timeline is the history of a device in one feed,
+// oldest first, for the device detail page. Each event has a kind and what
+// happened:
+//
+//   - status: offline, device_offline_after past its last update, and online
+//   - error: error when the device reports an error code, cleared when it stops
+//   - alarm: ringing and stopped, as the device reported it
+//   - reboot: rebooted (see reboots.go)
+//   - command: delivered, then acked, failed or cancelled (see commands.go)
+//   - ventilation: aired, for the device's room (see ventilation_events.go)
+//
+// Status, errors and the alarm come from the device's updates, so a device
+// that only sends heartbeats shows as offline in between.
+
+const (
+	maxTimelineRange  = 31 * 24 * time.Hour
+	maxTimelineEvents = 5000
+)
+
+var timelineKinds = []string{"status", "error", "alarm", "reboot", "command", "ventilation"}
+
+type TimelineEvent struct {
+	At      time.Time              `json:"at"`
+	Kind    string                 `json:"kind"`
+	Event   string                 `json:"event"`
+	Details map[string]interface{} `json:"details,omitempty"`
+}
+
+// statusTimeline derives status, error and alarm changes from the updates
+// of a device.
+func statusTimeline(ctx context.Context, deviceID int, from, to time.Time) ([]TimelineEvent, error) {
+	offlineAfter := settingDuration("device_offline_after")
+	rows, err := db.QueryContext(ctx, `
+		WITH s AS (
+			SELECT last_seen, error_code, alarm_active, alarm_active_time,
+				LAG(last_seen) OVER w AS prev_seen,
+				LAG(error_code) OVER w AS prev_error,
+				LAG(alarm_active) OVER w AS prev_alarm,
+				LAG(alarm_active_time) OVER w AS prev_alarm_time,
+				LEAD(last_seen) OVER w IS NULL AS last
+			FROM device_status
+			WHERE device_id = $1 AND last_seen >= $2 AND last_seen < $3
+			WINDOW w AS (ORDER BY last_seen)
+		)
+		SELECT last_seen, COALESCE(error_code, ''), alarm_active, prev_seen, COALESCE(prev_error, ''),
+			COALESCE(prev_alarm, false), COALESCE(prev_alarm_time, 0), last
+		FROM s
+		WHERE last OR prev_seen IS NOT NULL AND (
+			last_seen - prev_seen > make_interval(secs => $4)
+			OR error_code IS DISTINCT FROM prev_error
+			OR alarm_active != prev_alarm
+		)
+		ORDER BY last_seen
+	`, deviceID, from, to, offlineAfter.Seconds())
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	events := []TimelineEvent{}
+	for rows.Next() {
+		var at time.Time
+		var prevSeen *time.Time
+		var errorCode, prevError string
+		var alarm, prevAlarm, last bool
+		var prevAlarmTime int64
+		if err := rows.Scan(&at, &errorCode, &alarm, &prevSeen, &prevError, &prevAlarm, &prevAlarmTime, &last); err != nil {
+			return nil, err
+		}
+		if prevSeen != nil {
+			if at.Sub(*prevSeen) > offlineAfter {
+				events = append(events,
+					TimelineEvent{At: prevSeen.Add(offlineAfter), Kind: "status", Event: "offline",
+						Details: map[string]interface{}{"last_seen": *prevSeen}},
+					TimelineEvent{At: at, Kind: "status", Event: "online",
+						Details: map[string]interface{}{"offline_seconds": int64(at.Sub(*prevSeen).Seconds())}})
+			}
+			switch {
+			case errorCode != "" && errorCode != prevError:
+				events = append(events, TimelineEvent{At: at, Kind: "error", Event: "error",
+					Details: map[string]interface{}{"error_code": errorCode}})
+			case errorCode == "" && prevError != "":
+				events = append(events, TimelineEvent{At: at, Kind: "error", Event: "cleared",
+					Details: map[string]interface{}{"error_code": prevError}})
+			}
+			switch {
+			case alarm && !prevAlarm:
+				events = append(events, TimelineEvent{At: at, Kind: "alarm", Event: "ringing"})
+			case !alarm && prevAlarm:
+				events = append(events, TimelineEvent{At: at, Kind: "alarm", Event: "stopped",
+					Details: map[string]interface{}{"ring_seconds": prevAlarmTime}})
+			}
+		}
+		if last && to.Sub(at) > offlineAfter {
+			events = append(events, TimelineEvent{At: at.Add(offlineAfter), Kind: "status", Event: "offline",
+				Details: map[string]interface{}{"last_seen": at}})
+		}
+	}
+	return events, rows.Err()
+}
+
+func rebootTimeline(ctx context.Context, deviceID int, from, to time.Time) ([]TimelineEvent, error) {
+	rows, err := db.QueryContext(ctx, `
+		SELECT at, uptime_before, expected, COALESCE(reason, '')
+		FROM device_reboots WHERE device_id = $1 AND at >= $2 AND at < $3
+	`, deviceID, from, to)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	events := []TimelineEvent{}
+	for rows.Next() {
+		var r Reboot
+		if err := rows.Scan(&r.At, &r.UptimeBefore, &r.Expected, &r.Reason); err != nil {
+			return nil, err
+		}
+		details := map[string]interface{}{"expected": r.Expected, "uptime_before": r.UptimeBefore}
+		if r.Reason != "" {
+			details["reason"] = r.Reason
+		}
+		events = append(events, TimelineEvent{At: r.At, Kind: "reboot", Event: "rebooted", Details: details})
+	}
+	return events, rows.Err()
+}
+
+func commandTimeline(ctx context.Context, deviceID int, from, to time.Time) ([]TimelineEvent, error) {
+	rows, err := db.QueryContext(ctx, `
+		SELECT id, command, status, COALESCE(error, ''), delivered_at, completed_at
+		FROM device_commands
+		WHERE device_id = $1 AND (delivered_at >= $2 AND delivered_at < $3 OR completed_at >= $2 AND completed_at < $3)
+	`, deviceID, from, to)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	events := []TimelineEvent{}
+	for rows.Next() {
+		var id int
+		var command, status, cmdErr string
+		var delivered, completed *time.Time
+		if err := rows.Scan(&id, &command, &status, &cmdErr, &delivered, &completed); err != nil {
+			return nil, err
+		}
+		details := map[string]interface{}{"id": id, "command": command}
+		if delivered != nil && !delivered.Before(from) && delivered.Before(to) {
+			events = append(events, TimelineEvent{At: *delivered, Kind: "command", Event: "delivered", Details: details})
+		}
+		if completed != nil && !completed.Before(from) && completed.Before(to) {
+			done := map[string]interface{}{"id": id, "command": command}
+			if cmdErr != "" {
+				done["error"] = cmdErr
+			}
+			events = append(events, TimelineEvent{At: *completed, Kind: "command", Event: status, Details: done})
+		}
+	}
+	return events, rows.Err()
+}
+
+func ventilationTimeline(ctx context.Context, room string, from, to time.Time) ([]TimelineEvent, error) {
+	rows, err := db.QueryContext(ctx, `
+		SELECT started_at, ended_at, co2_start, co2_end, source
+		FROM ventilation_events WHERE room = $1 AND started_at >= $2 AND started_at < $3
+	`, room, from, to)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	events := []TimelineEvent{}
+	for rows.Next() {
+		var started, ended time.Time
+		var co2Start, co2End float64
+		var source string
+		if err := rows.Scan(&started, &ended, &co2Start, &co2End, &source); err != nil {
+			return nil, err
+		}
+		events = append(events, TimelineEvent{At: started, Kind: "ventilation", Event: "aired", Details: map[string]interface{}{
+			"room": room, "ended_at": ended, "co2_start": co2Start, "co2_end": co2End, "source": source,
+		}})
+	}
+	return events, rows.Err()
+}
+
+// getDeviceTimeline returns the events of the last 24 hours or ?from=&to=
+// (RFC 3339, at most 31 days), optionally only ?kinds=reboot,command. Past
+// ?limit= (500) events the newest are kept, with "truncated": true.
+func getDeviceTimeline(c echo.Context) error {
+	device, err := deviceFromParam(c)
+	if err != nil {
+		return handlerError(c, err)
+	}
+	now := time.Now()
+	from, to := now.Add(-24*time.Hour), now
+	if v := c.QueryParam("from"); v != "" {
+		if from, err = time.Parse(time.RFC3339, v); err != nil {
+			return apiError(c, http.StatusBadRequest, "from must be an RFC 3339 time")
+		}
+	}
+	if v := c.QueryParam("to"); v != "" {
+		if to, err = time.Parse(time.RFC3339, v); err != nil {
+			return apiError(c, http.StatusBadRequest, "to must be an RFC 3339 time")
+		}
+	}
+	if !to.After(from) {
+		return apiError(c, http.StatusBadRequest, "to must be after from")
+	}
+	if to.Sub(from) > maxTimelineRange {
+		return apiError(c, http.StatusBadRequest, "the range is limited to 31 days")
+	}
+	limit := 500
+	if v := c.QueryParam("limit"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 1 || n > maxTimelineEvents {
+			return apiError(c, http.StatusBadRequest, "limit must be between 1 and 5000")
+		}
+		limit = n
+	}
+	kinds := make(map[string]bool)
+	if v := c.QueryParam("kinds"); v != "" {
+		for _, k := range strings.Split(v, ",") {
+			if !slices.Contains(timelineKinds, k) {
+				return apiError(c, http.StatusBadRequest, "unknown kind "+k)
+			}
+			kinds[k] = true
+		}
+	} else {
+		for _, k := range timelineKinds {
+			kinds[k] = true
+		}
+	}
+
+	ctx := c.Request().Context()
+	sources := []struct {
+		kinds []string
+		load  func() ([]TimelineEvent, error)
+	}{
+		{[]string{"status", "error", "alarm"}, func() ([]TimelineEvent, error) { return statusTimeline(ctx, device.ID, from, to) }},
+		{[]string{"reboot"}, func() ([]TimelineEvent, error) { return rebootTimeline(ctx, device.ID, from, to) }},
+		{[]string{"command"}, func() ([]TimelineEvent, error) { return commandTimeline(ctx, device.ID, from, to) }},
+		{[]string{"ventilation"}, func() ([]TimelineEvent, error) { return ventilationTimeline(ctx, device.Room, from, to) }},
+	}
+	events := []TimelineEvent{}
+	for _, s := range sources {
+		wanted := false
+		for _, k := range s.kinds {
+			wanted = wanted || kinds[k]
+		}
+		if !wanted {
+			continue
+		}
+		loaded, err := s.load()
+		if err != nil {
+			return internalError(c, err)
+		}
+		for _, e := range loaded {
+			if kinds[e.Kind] && !e.At.Before(from) && e.At.Before(to) {
+				events = append(events, e)
+			}
+		}
+	}
+	sort.SliceStable(events, func(i, j int) bool { return events[i].At.Before(events[j].At) })
+	truncated := len(events) > limit
+	if truncated {
+		events = events[len(events)-limit:]
+	}
+	return c.JSON(http.StatusOK, map[string]interface{}{
+		"device":    device.Name,
+		"from":      from,
+		"to":        to,
+		"events":    events,
+		"truncated": truncated,
+	})
+}
@@ -0,0 +1,245 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/labstack/echo/v4"
+)
+
+// A minimal OpenTelemetry compatible tracer. Every request gets a server span
+// (continuing an incoming W3C traceparent) and database calls made with the
+// request context become child spans. Spans are batched and exported as
+// OTLP/HTTP JSON to $OTEL_EXPORTER_OTLP_ENDPOINT/v1/traces, e.g. a Jaeger or
+// Tempo instance on http://nas:4318. Tracing is off when that variable is
+// unset, and all span methods are then no-ops on a nil *Span.
+
+const (
+	spanKindServer = 2
+	spanKindClient = 3
+
+	statusCodeError = 2
+)
+
+type Span struct {
+	traceID, spanID, parentID string
+	name                      string
+	kind                      int
+	start, end                time.Time
+	attrs                     map[string]interface{}
+	err                       error
+}
+
+type spanKey struct{}
+
+type tracer struct {
+	endpoint string
+	service  string
+	spans    chan *Span
+}
+
+var tracing *tracer
+
+func initTracing() {
+	endpoint := envString("OTEL_EXPORTER_OTLP_ENDPOINT", "")
+	if endpoint == "" {
+		return
+	}
+	tracing = &tracer{
+		endpoint: strings.TrimSuffix(endpoint, "/") + "/v1/traces",
+		service:  envString("OTEL_SERVICE_NAME", "home-server"),
+		spans:    make(chan *Span, 1024),
+	}
+	go tracing.export()
+}
+
+func randomHex(n int) string {
+	b := make([]byte, n)
+	rand.Read(b)
+	return hex.EncodeToString(b)
+}
+
+func spanFromContext(ctx context.Context) *Span {
+	s, _ := ctx.Value(spanKey{}).(*Span)
+	return s
+}
+
+// startSpan begins a span as a child of the span in ctx, or as a new trace.
+func startSpan(ctx context.Context, name string, kind int) (context.Context, *Span) {
+	if tracing == nil {
+		return ctx, nil
+	}
+	s := &Span{name: name, kind: kind, start: time.Now(), spanID: randomHex(8), attrs: make(map[string]interface{})}
+	if parent := spanFromContext(ctx); parent != nil {
+		s.traceID, s.parentID = parent.traceID, parent.spanID
+	} else {
+		s.traceID = randomHex(16)
+	}
+	return context.WithValue(ctx, spanKey{}, s), s
+}
+
+func (s *Span) SetAttr(key string, value interface{}) {
+	if s != nil {
+		s.attrs[key] = value
+	}
+}
+
+func (s *Span) SetError(err error) {
+	if s != nil && err != nil {
+		s.err = err
+	}
+}
+
+func (s *Span) End() {
+	if s == nil {
+		return
+	}
+	s.end = time.Now()
+	select {
+	case tracing.spans <- s:
+	default:
+		// Exporter is backed up; drop the span rather than block a request.
+	}
+}
+
+// parseTraceparent extracts trace and parent span IDs from a W3C
+// "00-<trace-id>-<span-id>-<flags>" header.
+func parseTraceparent(h string) (traceID, spanID string, ok bool) {
+	parts := strings.Split(h, "-")
+	if len(parts) != 4 || len(parts[1]) != 32 || len(parts[2]) != 16 {
+		return "", "", false
+	}
+	return parts[1], parts[2], true
+}
+
+// traceRequests wraps every request in a server span.
+func traceRequests(next echo.HandlerFunc) echo.HandlerFunc {
+	return func(c echo.Context) error {
+		if tracing == nil {
+			return next(c)
+		}
+
+		req := c.Request()
+		ctx, span := startSpan(req.Context(), req.Method+" "+c.Path(), spanKindServer)
+		if traceID, parentID, ok := parseTraceparent(req.Header.Get("traceparent")); ok {
+			span.traceID, span.parentID = traceID, parentID
+		}
+		span.SetAttr("http.method", req.Method)
+		span.SetAttr("http.route", c.Path())
+		span.SetAttr("http.target", req.URL.RequestURI())
+		span.SetAttr("net.peer.ip", c.RealIP())
+		c.SetRequest(req.WithContext(ctx))
+		c.Response().Header().Set("traceparent", "00-"+span.traceID+"-"+span.spanID+"-01")
+
+		err := next(c)
+		span.SetError(err)
+		span.SetAttr("http.status_code", c.Response().Status)
+		span.End()
+		return err
+	}
+}
+
+func (t *tracer) export() {
+	ticker := time.NewTicker(5 * time.Second)
+	var batch []*Span
+	for {
+		select {
+		case s := <-t.spans:
+			batch = append(batch, s)
+			if len(batch) < 256 {
+				continue
+			}
+		case <-ticker.C:
+			if len(batch) == 0 {
+				continue
+			}
+		}
+		if err := t.send(batch); err != nil {
+			log.Printf("Failed to export %d spans: %v", len(batch), err)
+		}
+		batch = nil
+	}
+}
+
+func otlpValue(v interface{}) map[string]interface{} {
+	switch v := v.(type) {
+	case string:
+		return map[string]interface{}{"stringValue": v}
+	case int:
+		return map[string]interface{}{"intValue": strconv.Itoa(v)}
+	case int64:
+		return map[string]interface{}{"intValue": strconv.FormatInt(v, 10)}
+	case bool:
+		return map[string]interface{}{"boolValue": v}
+	case float64:
+		return map[string]interface{}{"doubleValue": v}
+	default:
+		return map[string]interface{}{"stringValue": fmt.Sprint(v)}
+	}
+}
+
+func otlpAttributes(attrs map[string]interface{}) []map[string]interface{} {
+	list := make([]map[string]interface{}, 0, len(attrs))
+	for k, v := range attrs {
+		list = append(list, map[string]interface{}{"key": k, "value": otlpValue(v)})
+	}
+	return list
+}
+
+var exportClient = &http.Client{Timeout: 10 * time.Second}
+
+func (t *tracer) send(batch []*Span) error {
+	spans := make([]map[string]interface{}, 0, len(batch))
+	for _, s := range batch {
+		span := map[string]interface{}{
+			"traceId":           s.traceID,
+			"spanId":            s.spanID,
+			"name":              s.name,
+			"kind":              s.kind,
+			"startTimeUnixNano": strconv.FormatInt(s.start.UnixNano(), 10),
+			"endTimeUnixNano":   strconv.FormatInt(s.end.UnixNano(), 10),
+			"attributes":        otlpAttributes(s.attrs),
+		}
+		if s.parentID != "" {
+			span["parentSpanId"] = s.parentID
+		}
+		if s.err != nil {
+			span["status"] = map[string]interface{}{"code": statusCodeError, "message": s.err.Error()}
+		}
+		spans = append(spans, span)
+	}
+
+	body, err := json.Marshal(map[string]interface{}{
+		"resourceSpans": []interface{}{map[string]interface{}{
+			"resource": map[string]interface{}{
+				"attributes": otlpAttributes(map[string]interface{}{"service.name": t.service}),
+			},
+			"scopeSpans": []interface{}{map[string]interface{}{
+				"scope": map[string]interface{}{"name": "home-server"},
+				"spans": spans,
+			}},
+		}},
+	})
+	if err != nil {
+		return err
+	}
+
+	resp, err := exportClient.Post(t.endpoint, "application/json", bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode >= 300 {
+		return fmt.Errorf("collector returned %s", resp.Status)
+	}
+	return nil
+}
@@ -0,0 +1,117 @@
+package main
+
+import (
+	"context"
+	"database/sql/driver"
+	"strings"
+
+	"github.com/lib/pq"
+)
+
+// tracedDriver wraps the Postgres driver so that queries run with a traced
+// context (db.ExecContext(c.Request().Context(), ...)) show up as client
+// spans under the request. Calls without a span in their context are passed
+// straight through.
+type tracedDriver struct {
+	driver.Driver
+}
+
+func (d tracedDriver) Open(name string) (driver.Conn, error) {
+	conn, err := d.Driver.Open(name)
+	if err != nil {
+		return nil, err
+	}
+	return &tracedConn{conn}, nil
+}
+
+func newTracedPostgresDriver() driver.Driver {
+	return tracedDriver{&pq.Driver{}}
+}
+
+type tracedConn struct {
+	driver.Conn
+}
+
+func startQuerySpan(ctx context.Context, op, query string) (context.Context, *Span) {
+	if spanFromContext(ctx) == nil {
+		return ctx, nil
+	}
+	name := op
+	if fields := strings.Fields(query); len(fields) > 0 {
+		name += " " + strings.ToUpper(fields[0])
+	}
+	ctx, span := startSpan(ctx, name, spanKindClient)
+	span.SetAttr("db.system", "postgresql")
+	span.SetAttr("db.statement", strings.Join(strings.Fields(query), " "))
+	return ctx, span
+}
+
+func (c *tracedConn) ExecContext(ctx context.Context, query string, args []driver.NamedValue) (driver.Result, error) {
+	execer, ok := c.Conn.(driver.ExecerContext)
+	if !ok {
+		return nil, driver.ErrSkip
+	}
+	ctx, span := startQuerySpan(ctx, "db.exec", query)
+	res, err := execer.ExecContext(ctx, query, args)
+	if err != driver.ErrSkip {
+		span.SetError(err)
+	}
+	span.End()
+	return res, err
+}
+
+func (c *tracedConn) QueryContext(ctx context.Context, query string, args []driver.NamedValue) (driver.Rows, error) {
+	queryer, ok := c.Conn.(driver.QueryerContext)
+	if !ok {
+		return nil, driver.ErrSkip
+	}
+	ctx, span := startQuerySpan(ctx, "db.query", query)
+	rows, err := queryer.QueryContext(ctx, query, args)
+	if err != driver.ErrSkip {
+		span.SetError(err)
+	}
+	span.End()
+	return rows, err
+}
+
+func (c *tracedConn) PrepareContext(ctx context.Context, query string) (driver.Stmt, error) {
+	if preparer, ok := c.Conn.(driver.ConnPrepareContext); ok {
+		return preparer.PrepareContext(ctx, query)
+	}
+	return c.Conn.Prepare(query)
+}
+
+func (c *tracedConn) BeginTx(ctx context.Context, opts driver.TxOptions) (driver.Tx, error) {
+	if beginner, ok := c.Conn.(driver.ConnBeginTx); ok {
+		return beginner.BeginTx(ctx, opts)
+	}
+	return c.Conn.Begin() //nolint:staticcheck // fallback for drivers without BeginTx
+}
+
+func (c *tracedConn) Ping(ctx context.Context) error {
+	if pinger, ok := c.Conn.(driver.Pinger); ok {
+		return pinger.Ping(ctx)
+	}
+	return nil
+}
+
+func (c *tracedConn) ResetSession(ctx context.Context) error {
+	if resetter, ok := c.Conn.(driver.SessionResetter); ok {
+		return resetter.ResetSession(ctx)
+	}
+	return nil
+}
+
+func (c *tracedConn) IsValid() bool {
+	if validator, ok := c.Conn.(driver.Validator); ok {
+		return validator.IsValid()
+	}
+	return true
+}
+
+func (c *tracedConn) CheckNamedValue(nv *driver.NamedValue) error {
+	if checker, ok := c.Conn.(driver.NamedValueChecker); ok {
+		return checker.CheckNamedValue(nv)
+	}
+	return driver.ErrSkip
+}
@@ -0,0 +1,97 @@
+package main
+
+import (
+	"math"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/labstack/echo/v4"
+)
+
+// Trend describes where a metric is heading, fitted over a recent window.
+type Trend struct {
+	Metric         string     `json:"metric"`
+	Window         string     `json:"window"`
+	Samples        int        `json:"samples"`
+	Current        float64    `json:"current"`
+	SlopePerMinute float64    `json:"slope_per_minute"`
+	Direction      string     `json:"direction"` // rising | falling | stable
+	Threshold      float64    `json:"threshold"`
+	MinutesToReach *float64   `json:"minutes_to_threshold,omitempty"`
+	ReachesAt      *time.Time `json:"reaches_threshold_at,omitempty"`
+	SeriesScope
+}
+
+// trendStableSlopes are the slopes (per minute) below which a metric counts
+// as stable. The default threshold to project against is the metric's
+// <metric>_threshold setting.
+var trendStableSlopes = map[string]float64{"co2": 1, "sound": 0.1}
+
+func getSensorTrend(c echo.Context) error {
+	metric := c.QueryParam("metric")
+	if metric == "" {
+		metric = "co2"
+	}
+	if !knownMetric(metric) {
+		return apiError(c, http.StatusBadRequest, "unknown metric")
+	}
+
+	window := 30 * time.Minute
+	if w := c.QueryParam("window"); w != "" {
+		d, err := time.ParseDuration(w)
+		if err != nil || d <= 0 {
+			return apiError(c, http.StatusBadRequest, "invalid window")
+		}
+		window = d
+	}
+
+	threshold := metricThreshold(metric)
+	if t := c.QueryParam("threshold"); t != "" {
+		f, err := strconv.ParseFloat(t, 64)
+		if err != nil {
+			return apiError(c, http.StatusBadRequest, "invalid threshold")
+		}
+		threshold = f
+	}
+
+	scope, err := seriesScope(c)
+	if err != nil {
+		return handlerError(c, err)
+	}
+	now := time.Now()
+	points, err := querySeries(metric, scope, now.Add(-window), now)
+	if err != nil {
+		return internalError(c, err)
+	}
+
+	trend := Trend{Metric: metric, SeriesScope: scope, Window: window.String(), Samples: len(points), Threshold: threshold, Direction: "stable"}
+	slope, _, ok := linearFit(points)
+	if !ok {
+		if len(points) > 0 {
+			trend.Current = points[len(points)-1].Value
+		}
+		return c.JSON(http.StatusOK, trend)
+	}
+
+	trend.Current = points[len(points)-1].Value
+	trend.SlopePerMinute = slope * 60
+	if math.Abs(trend.SlopePerMinute) >= trendStableSlopes[metric] {
+		if trend.SlopePerMinute > 0 {
+			trend.Direction = "rising"
+		} else {
+			trend.Direction = "falling"
+		}
+	}
+
+	// Project only when the metric is moving towards the threshold.
+	if trend.Direction == "rising" && trend.Current < threshold ||
+		trend.Direction == "falling" && trend.Current > threshold {
+		minutes := (threshold - trend.Current) / trend.SlopePerMinute
+		at := now.Add(time.Duration(minutes * float64(time.Minute)))
+		trend.MinutesToReach = &minutes
+		trend.ReachesAt = &at
+	}
+
+	return c.JSON(http.StatusOK, trend)
+}
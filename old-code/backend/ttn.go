@@ -0,0 +1,106 @@
+package main
+
+import (
+	"crypto/subtle"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/labstack/echo/v4"
+)
+
+// The Things Network (LoRaWAN) uplinks arrive through a TTN webhook pointed
+// at POST /api/ingest/ttn. The numeric fields of the payload formatter output
+// (decoded_payload) become metrics of the device named by TTN_DEVICE_MAP
+// (ttn-device-id=name pairs, unmapped devices keep their TTN ID), renamed by
+// TTN_FIELD_MAP (field=metric pairs), e.g.
+//
+//	TTN_DEVICE_MAP=garden-node-1=garden
+//	TTN_FIELD_MAP=temperature=outdoor_temperature,humidity=outdoor_humidity
+//
+// The best gateway's signal strength is stored as rssi and snr. Set
+// TTN_WEBHOOK_SECRET and add it to the webhook as the X-Webhook-Secret
+// header.
+
+type ttnUplink struct {
+	EndDeviceIDs struct {
+		DeviceID string `json:"device_id"`
+	} `json:"end_device_ids"`
+	ReceivedAt    time.Time `json:"received_at"`
+	UplinkMessage *struct {
+		DecodedPayload map[string]interface{} `json:"decoded_payload"`
+		RxMetadata     []struct {
+			RSSI float64 `json:"rssi"`
+			SNR  float64 `json:"snr"`
+		} `json:"rx_metadata"`
+	} `json:"uplink_message"`
+}
+
+// parsePairs parses "a=b,c=d" configuration values.
+func parsePairs(spec string) map[string]string {
+	pairs := make(map[string]string)
+	for _, entry := range strings.Split(spec, ",") {
+		k, v, ok := strings.Cut(strings.TrimSpace(entry), "=")
+		if ok && k != "" && v != "" {
+			pairs[strings.TrimSpace(k)] = strings.TrimSpace(v)
+		}
+	}
+	return pairs
+}
+
+func ingestTTN(c echo.Context) error {
+	secret := envString("TTN_WEBHOOK_SECRET", "")
+	if secret == "" {
+		return apiErrorCode(c, http.StatusNotFound, codeNotConfigured, "TTN ingestion is not configured")
+	}
+	if subtle.ConstantTimeCompare([]byte(c.Request().Header.Get("X-Webhook-Secret")), []byte(secret)) != 1 {
+		return apiError(c, http.StatusUnauthorized, "invalid webhook secret")
+	}
+
+	var up ttnUplink
+	if err := c.Bind(&up); err != nil {
+		return invalidBody(c, err)
+	}
+	if up.UplinkMessage == nil || up.EndDeviceIDs.DeviceID == "" {
+		// Join accepts, downlink events etc. are acknowledged and ignored
+		return c.NoContent(http.StatusNoContent)
+	}
+
+	device := up.EndDeviceIDs.DeviceID
+	if name, ok := parsePairs(envString("TTN_DEVICE_MAP", ""))[device]; ok {
+		device = name
+	}
+	fields := parsePairs(envString("TTN_FIELD_MAP", ""))
+	values := make(map[string]float64)
+	for field, raw := range up.UplinkMessage.DecodedPayload {
+		v, ok := raw.(float64)
+		if !ok {
+			continue
+		}
+		name, ok := fields[field]
+		if !ok {
+			name = metricName(field)
+		}
+		if name != "" {
+			values[name] = v
+		}
+	}
+	if meta := up.UplinkMessage.RxMetadata; len(meta) > 0 {
+		best := meta[0]
+		for _, m := range meta[1:] {
+			if m.RSSI > best.RSSI {
+				best = m
+			}
+		}
+		values["rssi"], values["snr"] = best.RSSI, best.SNR
+	}
+
+	at := up.ReceivedAt
+	if at.IsZero() {
+		at = time.Now()
+	}
+	if err := ingestMetrics(c.Request().Context(), device, values, at.Local()); err != nil {
+		return internalError(c, err)
+	}
+	return c.NoContent(http.StatusNoContent)
+}
@@ -0,0 +1,126 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Text-to-speech backends turn the briefing into audio. TTS_BACKEND selects
+// one of ttsBackends:
+//
+//	http     POST the text as text/plain to TTS_URL and return the response
+//	         body (e.g. a Piper HTTP server)
+//	marytts  GET TTS_URL/process with MaryTTS parameters, voice TTS_VOICE
+//
+// Another backend only needs a constructor in ttsBackends.
+
+type ttsBackend interface {
+	synthesize(ctx context.Context, text string) (audio []byte, contentType string, err error)
+}
+
+var ttsBackends = map[string]func(baseURL string) ttsBackend{
+	"http":    func(u string) ttsBackend { return httpTTS{url: u} },
+	"marytts": func(u string) ttsBackend { return maryTTS{url: strings.TrimRight(u, "/")} },
+}
+
+var tts ttsBackend
+
+var ttsClient = &http.Client{Timeout: 30 * time.Second}
+
+func initTTS() {
+	name, u := envString("TTS_BACKEND", ""), envString("TTS_URL", "")
+	if name == "" {
+		return
+	}
+	newBackend, ok := ttsBackends[name]
+	if !ok || u == "" {
+		log.Printf("TTS backend %q is unknown or TTS_URL is not set, briefing audio is disabled", name)
+		return
+	}
+	tts = newBackend(u)
+}
+
+type httpTTS struct{ url string }
+
+func (t httpTTS) synthesize(ctx context.Context, text string) ([]byte, string, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, t.url, strings.NewReader(text))
+	if err != nil {
+		return nil, "", err
+	}
+	req.Header.Set("Content-Type", "text/plain; charset=utf-8")
+	return fetchAudio(req)
+}
+
+type maryTTS struct{ url string }
+
+func (t maryTTS) synthesize(ctx context.Context, text string) ([]byte, string, error) {
+	q := url.Values{
+		"INPUT_TEXT":  {text},
+		"INPUT_TYPE":  {"TEXT"},
+		"OUTPUT_TYPE": {"AUDIO"},
+		"AUDIO":       {"WAVE_FILE"},
+		"LOCALE":      {envString("TTS_LOCALE", "en_US")},
+	}
+	if voice := envString("TTS_VOICE", ""); voice != "" {
+		q.Set("VOICE", voice)
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, t.url+"/process?"+q.Encode(), nil)
+	if err != nil {
+		return nil, "", err
+	}
+	return fetchAudio(req)
+}
+
+func fetchAudio(req *http.Request) ([]byte, string, error) {
+	resp, err := ttsClient.Do(req)
+	if err != nil {
+		return nil, "", err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		body, _ := io.ReadAll(io.LimitReader(resp.Body, 512))
+		return nil, "", fmt.Errorf("TTS backend: %s: %s", resp.Status, bytes.TrimSpace(body))
+	}
+	audio, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return nil, "", err
+	}
+	contentType := resp.Header.Get("Content-Type")
+	if contentType == "" || strings.HasPrefix(contentType, "application/octet-stream") {
+		contentType = http.DetectContentType(audio)
+	}
+	return audio, contentType, nil
+}
+
+// The last synthesized text is cached, so the device and a speaker playing
+// the same briefing only synthesize it once.
+var ttsCache struct {
+	sync.Mutex
+	key         [32]byte
+	audio       []byte
+	contentType string
+}
+
+func synthesizeCached(ctx context.Context, text string) ([]byte, string, error) {
+	key := sha256.Sum256([]byte(text))
+	ttsCache.Lock()
+	defer ttsCache.Unlock()
+	if ttsCache.audio != nil && ttsCache.key == key {
+		return ttsCache.audio, ttsCache.contentType, nil
+	}
+	audio, contentType, err := tts.synthesize(ctx, text)
+	if err != nil {
+		return nil, "", err
+	}
+	ttsCache.key, ttsCache.audio, ttsCache.contentType = key, audio, contentType
+	return audio, contentType, nil
+}
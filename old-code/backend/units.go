@@ -0,0 +1,173 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"net/http"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/labstack/echo/v4"
+)
+
+// Every metric has a unit, shown next to its values in the API, the rules
+// and alert notifications: co2 is in ppm, sound in dBA (once the sound sensor
+// has a calibration curve, see calibration.go), telemetry in dBm, %, bytes
+// and seconds. Derived metrics share their source's unit, minutes_above ones
+// are in minutes. PUT /api/metrics/units/:metric sets the unit of any other
+// metric, e.g. one ingested from InfluxDB, or overrides a default.
+
+var defaultUnits = map[string]string{
+	"co2":            "ppm",
+	"sound":          "dBA",
+	"rssi":           "dBm",
+	"battery_pct":    "%",
+	"free_heap":      "B",
+	"uptime_seconds": "s",
+	"temperature":    "°C",
+	"humidity":       "%",
+	"heating_target": "°C",
+	"power":          "W",
+	"energy":         "kWh",
+}
+
+type MetricUnit struct {
+	Metric    string     `json:"metric"`
+	Unit      string     `json:"unit"`
+	Custom    bool       `json:"custom"` // set through the API rather than a default
+	UpdatedAt *time.Time `json:"updated_at,omitempty"`
+}
+
+// metricUnit returns a metric's unit, "" when it has none.
+func metricUnit(ctx context.Context, metric string) (string, error) {
+	var unit string
+	err := db.QueryRowContext(ctx, "SELECT unit FROM metric_units WHERE metric = $1", metric).Scan(&unit)
+	if err == nil {
+		return unit, nil
+	}
+	if err != sql.ErrNoRows {
+		return "", err
+	}
+	if unit, ok := defaultUnits[metric]; ok {
+		return unit, nil
+	}
+	m, ok, err := derivedMetric(metric)
+	if err != nil || !ok {
+		return "", err
+	}
+	if m.Kind == "minutes_above" {
+		return "min", nil
+	}
+	return metricUnit(ctx, m.Source)
+}
+
+// formatWithUnit formats a value for people, e.g. "1200 ppm".
+func formatWithUnit(value float64, unit string) string {
+	s := fmt.Sprintf("%.0f", value)
+	if unit != "" {
+		s += " " + unit
+	}
+	return s
+}
+
+// getMetricUnits lists the units of the built-in, telemetry, derived and
+// ingested metrics.
+func getMetricUnits(c echo.Context) error {
+	ctx := c.Request().Context()
+	names := make(map[string]bool)
+	for name := range defaultUnits {
+		names[name] = true
+	}
+	rows, err := db.QueryContext(ctx, `
+		SELECT metric FROM metric_units
+		UNION SELECT name FROM derived_metrics
+		UNION SELECT DISTINCT metric FROM metric_samples
+	`)
+	if err != nil {
+		return internalError(c, err)
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var name string
+		if err := rows.Scan(&name); err != nil {
+			return internalError(c, err)
+		}
+		names[name] = true
+	}
+	if err := rows.Err(); err != nil {
+		return internalError(c, err)
+	}
+
+	custom := make(map[string]MetricUnit)
+	rows, err = db.QueryContext(ctx, "SELECT metric, unit, updated_at FROM metric_units")
+	if err != nil {
+		return internalError(c, err)
+	}
+	defer rows.Close()
+	for rows.Next() {
+		u := MetricUnit{Custom: true}
+		var updated time.Time
+		if err := rows.Scan(&u.Metric, &u.Unit, &updated); err != nil {
+			return internalError(c, err)
+		}
+		u.UpdatedAt = &updated
+		custom[u.Metric] = u
+	}
+	if err := rows.Err(); err != nil {
+		return internalError(c, err)
+	}
+
+	units := []MetricUnit{}
+	for name := range names {
+		u, ok := custom[name]
+		if !ok {
+			unit, err := metricUnit(ctx, name)
+			if err != nil {
+				return internalError(c, err)
+			}
+			u = MetricUnit{Metric: name, Unit: unit}
+		}
+		units = append(units, u)
+	}
+	sort.Slice(units, func(i, j int) bool { return units[i].Metric < units[j].Metric })
+	return c.JSON(http.StatusOK, units)
+}
+
+// putMetricUnit sets a metric's unit: {"unit": "µg/m³"}. An empty unit
+// removes the override, so the default applies again.
+func putMetricUnit(c echo.Context) error {
+	metric := c.Param("metric")
+	if !knownMetric(metric) {
+		return apiError(c, http.StatusBadRequest, "unknown metric")
+	}
+	var req struct {
+		Unit string `json:"unit"`
+	}
+	if err := c.Bind(&req); err != nil {
+		return invalidBody(c, err)
+	}
+	req.Unit = strings.TrimSpace(req.Unit)
+	if len(req.Unit) > 16 {
+		return apiError(c, http.StatusBadRequest, "unit is limited to 16 characters")
+	}
+
+	var err error
+	if req.Unit == "" {
+		_, err = db.Exec("DELETE FROM metric_units WHERE metric = $1", metric)
+	} else {
+		_, err = db.Exec(`
+			INSERT INTO metric_units (metric, unit, updated_at) VALUES ($1, $2, $3)
+			ON CONFLICT (metric) DO UPDATE SET unit = EXCLUDED.unit, updated_at = EXCLUDED.updated_at
+		`, metric, req.Unit, time.Now())
+	}
+	if err != nil {
+		return internalError(c, err)
+	}
+	unit, err := metricUnit(c.Request().Context(), metric)
+	if err != nil {
+		return internalError(c, err)
+	}
+	return c.JSON(http.StatusOK, MetricUnit{Metric: metric, Unit: unit, Custom: req.Unit != ""})
+}
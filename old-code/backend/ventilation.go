@@ -0,0 +1,194 @@
+package main
+
+import (
+	"database/sql"
+	"fmt"
+	"log"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/labstack/echo/v4"
+)
+
+// VentilationSettings tunes the "open the window" reminders for one room.
+// A reminder is sent when CO2 is above SoftThreshold and has been rising by at
+// least MinSlope ppm/min over the last RisingMinutes, repeated at most every
+// ReminderMinutes. Once CO2 falls back below ClearThreshold a confirmation
+// reports how long ventilating took.
+type VentilationSettings struct {
+	Room            string  `json:"room"`
+	Enabled         bool    `json:"enabled"`
+	SoftThreshold   float64 `json:"soft_threshold"`
+	ClearThreshold  float64 `json:"clear_threshold"`
+	MinSlope        float64 `json:"min_slope"`
+	RisingMinutes   int     `json:"rising_minutes"`
+	ReminderMinutes int     `json:"reminder_minutes"`
+}
+
+func defaultVentilationSettings(room string) VentilationSettings {
+	return VentilationSettings{
+		Room:            room,
+		Enabled:         true,
+		SoftThreshold:   1000,
+		ClearThreshold:  700,
+		MinSlope:        1,
+		RisingMinutes:   20,
+		ReminderMinutes: 30,
+	}
+}
+
+// ventilationState follows one CO2 spike from the first reminder until the
+// room is aired out.
+type ventilationState struct {
+	lastReminder time.Time
+	peak         float64
+	peakAt       time.Time
+}
+
+var (
+	ventilationMu     sync.Mutex
+	ventilationStates = make(map[string]*ventilationState)
+)
+
+func loadVentilationSettings(room string) (VentilationSettings, error) {
+	s := defaultVentilationSettings(room)
+	err := db.QueryRow(`
+		SELECT enabled, soft_threshold, clear_threshold, min_slope, rising_minutes, reminder_minutes
+		FROM ventilation_settings WHERE room = $1
+	`, room).Scan(&s.Enabled, &s.SoftThreshold, &s.ClearThreshold, &s.MinSlope,
+		&s.RisingMinutes, &s.ReminderMinutes)
+	if err == sql.ErrNoRows {
+		return s, nil
+	}
+	return s, err
+}
+
+func roomCO2Since(room string, since time.Time) ([]Point, error) {
+	rows, err := db.Query(`
+		SELECT s.timestamp, s.co2_level
+		FROM sensor_data s
+		JOIN devices d ON d.id = s.device_id
+		WHERE d.room = $1 AND s.timestamp > $2 AND s.co2_level != 0
+		ORDER BY s.timestamp
+	`, room, since)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var points []Point
+	for rows.Next() {
+		var p Point
+		if err := rows.Scan(&p.Timestamp, &p.Value); err != nil {
+			return nil, err
+		}
+		points = append(points, p)
+	}
+	return points, rows.Err()
+}
+
+// checkVentilation runs after every device update for the device's room.
+func checkVentilation(room string, co2 float64) {
+	if co2 == 0 {
+		return
+	}
+	settings, err := loadVentilationSettings(room)
+	if err != nil {
+		log.Printf("Failed to load ventilation settings for %s: %v", room, err)
+		return
+	}
+	if !settings.Enabled {
+		return
+	}
+
+	now := time.Now()
+	ventilationMu.Lock()
+	defer ventilationMu.Unlock()
+	state := ventilationStates[room]
+
+	if state != nil {
+		if co2 > state.peak {
+			state.peak, state.peakAt = co2, now
+		}
+		if co2 <= settings.ClearThreshold {
+			delete(ventilationStates, room)
+			notify(Notification{
+				Event: "ventilation",
+				Title: fmt.Sprintf("%s aired out", room),
+				Message: fmt.Sprintf("CO2 dropped from %.0f to %.0f ppm in %s.",
+					state.peak, co2, now.Sub(state.peakAt).Round(time.Minute)),
+				Tags: []string{"white_check_mark"},
+			})
+			return
+		}
+	}
+
+	if co2 < settings.SoftThreshold {
+		return
+	}
+	if state != nil && now.Sub(state.lastReminder) < time.Duration(settings.ReminderMinutes)*time.Minute {
+		return
+	}
+
+	points, err := roomCO2Since(room, now.Add(-time.Duration(settings.RisingMinutes)*time.Minute))
+	if err != nil {
+		log.Printf("Failed to load CO2 history for %s: %v", room, err)
+		return
+	}
+	slope, _, ok := linearFit(points)
+	perMinute := slope * 60
+	if !ok || perMinute < settings.MinSlope {
+		return
+	}
+
+	if state == nil {
+		state = &ventilationState{peak: co2, peakAt: now}
+		ventilationStates[room] = state
+	}
+	state.lastReminder = now
+	notify(Notification{
+		Event:   "ventilation",
+		Title:   fmt.Sprintf("Open the window in the %s", room),
+		Message: fmt.Sprintf("CO2 is %.0f ppm and rising %.0f ppm/min.", co2, perMinute),
+		Tags:    []string{"window"},
+	})
+}
+
+func getVentilationSettings(c echo.Context) error {
+	settings, err := loadVentilationSettings(c.Param("room"))
+	if err != nil {
+		return internalError(c, err)
+	}
+	return c.JSON(http.StatusOK, settings)
+}
+
+func putVentilationSettings(c echo.Context) error {
+	settings := defaultVentilationSettings(c.Param("room"))
+	if err := c.Bind(&settings); err != nil {
+		return invalidBody(c, err)
+	}
+	settings.Room = c.Param("room")
+	if settings.ClearThreshold >= settings.SoftThreshold {
+		return apiError(c, http.StatusBadRequest, "clear_threshold must be below soft_threshold")
+	}
+	if settings.RisingMinutes <= 0 || settings.ReminderMinutes <= 0 {
+		return apiError(c, http.StatusBadRequest, "rising_minutes and reminder_minutes must be positive")
+	}
+
+	_, err := db.Exec(`
+		INSERT INTO ventilation_settings
+		(room, enabled, soft_threshold, clear_threshold, min_slope, rising_minutes, reminder_minutes)
+		VALUES ($1, $2, $3, $4, $5, $6, $7)
+		ON CONFLICT (room) DO UPDATE
+		SET enabled = EXCLUDED.enabled, soft_threshold = EXCLUDED.soft_threshold,
+			clear_threshold = EXCLUDED.clear_threshold, min_slope = EXCLUDED.min_slope,
+			rising_minutes = EXCLUDED.rising_minutes, reminder_minutes = EXCLUDED.reminder_minutes
+	`, settings.Room, settings.Enabled, settings.SoftThreshold, settings.ClearThreshold,
+		settings.MinSlope, settings.RisingMinutes, settings.ReminderMinutes)
+	if err != nil {
+		return internalError(c, err)
+	}
+
+	return c.JSON(http.StatusOK, settings)
+}
@@ -0,0 +1,185 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"log"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/labstack/echo/v4"
+)
+
+// Ventilation periods are detected from the readings of each room. With a
+// Zigbee contact sensor in the room (see zigbee.go) a period is the time a
+// window was open. Without one it starts when CO2 falls by at least
+// ventilation_detect_slope ppm/min over ventilation_detect_window, or by
+// half of that while the temperature falls too (cold air coming in), and
+// ends once CO2 levels off. Periods that lowered CO2 by less than
+// ventilation_min_drop are not logged.
+
+type VentilationEvent struct {
+	ID              int64     `json:"id"`
+	Room            string    `json:"room"`
+	StartedAt       time.Time `json:"started_at"`
+	EndedAt         time.Time `json:"ended_at"`
+	DurationSeconds int64     `json:"duration_seconds"`
+	CO2Start        float64   `json:"co2_start"`
+	CO2End          float64   `json:"co2_end"`
+	CO2Drop         float64   `json:"co2_drop"`
+	TemperatureDrop *float64  `json:"temperature_drop,omitempty"`
+	Source          string    `json:"source"` // contact | co2
+}
+
+// ventilationPeriod is a period in progress.
+type ventilationPeriod struct {
+	source    string
+	startedAt time.Time
+	co2Start  float64
+	co2Min    float64
+	tempStart *float64
+}
+
+var ventilationPeriods = make(map[string]*ventilationPeriod) // by room, guarded by ventilationMu
+
+// slopePerMinute fits points of the last window; ok is false with too few.
+func slopePerMinute(points []Point) (float64, bool) {
+	slope, _, ok := linearFit(points)
+	return slope * 60, ok
+}
+
+// trackVentilation runs after every device update for the device's room.
+func trackVentilation(room string, co2 float64) {
+	if co2 == 0 {
+		return
+	}
+	now := time.Now()
+	window := settingDuration("ventilation_detect_window")
+	rate := settingFloat("ventilation_detect_slope")
+	points, err := roomCO2Since(room, now.Add(-window))
+	if err != nil {
+		log.Printf("Failed to load CO2 history for %s: %v", room, err)
+		return
+	}
+	temperature, err := roomMetricSince(room, "temperature", now.Add(-window))
+	if err != nil {
+		log.Printf("Failed to load temperature history for %s: %v", room, err)
+		return
+	}
+	co2Slope, co2OK := slopePerMinute(points)
+	tempSlope, tempOK := slopePerMinute(temperature)
+	var temp *float64
+	if len(temperature) > 0 {
+		temp = &temperature[len(temperature)-1].Value
+	}
+	open, hasContact := withRoomSensors(room, map[string]float64{})["open"]
+
+	ventilationMu.Lock()
+	defer ventilationMu.Unlock()
+	p := ventilationPeriods[room]
+
+	if p == nil {
+		switch {
+		case hasContact && open == 1:
+			p = &ventilationPeriod{source: "contact", startedAt: now, co2Start: co2, co2Min: co2, tempStart: temp}
+		case !hasContact && co2OK && (co2Slope <= -rate || co2Slope <= -rate/2 && tempOK && tempSlope <= -0.1):
+			// The drop began at the start of the window
+			p = &ventilationPeriod{source: "co2", startedAt: points[0].Timestamp, co2Start: points[0].Value, co2Min: co2}
+			if len(temperature) > 0 {
+				p.tempStart = &temperature[0].Value
+			}
+		default:
+			return
+		}
+		ventilationPeriods[room] = p
+		return
+	}
+
+	p.co2Min = min(p.co2Min, co2)
+	ended := p.source == "contact" && open != 1 || p.source == "co2" && (!co2OK || co2Slope > -rate/4)
+	if !ended {
+		return
+	}
+	delete(ventilationPeriods, room)
+	if p.co2Start-p.co2Min < settingFloat("ventilation_min_drop") {
+		return
+	}
+	e := VentilationEvent{
+		Room:            room,
+		StartedAt:       p.startedAt,
+		EndedAt:         now,
+		DurationSeconds: int64(now.Sub(p.startedAt).Seconds()),
+		CO2Start:        p.co2Start,
+		CO2End:          p.co2Min,
+		CO2Drop:         p.co2Start - p.co2Min,
+		Source:          p.source,
+	}
+	if p.tempStart != nil && temp != nil {
+		drop := *p.tempStart - *temp
+		e.TemperatureDrop = &drop
+	}
+	err = db.QueryRow(`
+		INSERT INTO ventilation_events
+		(room, started_at, ended_at, co2_start, co2_end, temperature_drop, source)
+		VALUES ($1, $2, $3, $4, $5, $6, $7)
+		RETURNING id
+	`, e.Room, e.StartedAt, e.EndedAt, e.CO2Start, e.CO2End, e.TemperatureDrop, e.Source).Scan(&e.ID)
+	if err != nil {
+		log.Printf("Failed to log ventilation of %s: %v", room, err)
+	}
+}
+
+// lastVentilation is when a room was last aired, or now while it is; nil
+// if it never was.
+func lastVentilation(ctx context.Context) (*time.Time, error) {
+	ventilationMu.Lock()
+	ongoing := len(ventilationPeriods) > 0
+	ventilationMu.Unlock()
+	if ongoing {
+		now := time.Now()
+		return &now, nil
+	}
+	var last sql.NullTime
+	if err := db.QueryRowContext(ctx, "SELECT MAX(ended_at) FROM ventilation_events").Scan(&last); err != nil || !last.Valid {
+		return nil, err
+	}
+	return &last.Time, nil
+}
+
+func getVentilationEvents(c echo.Context) error {
+	days := 7
+	if v := c.QueryParam("days"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 1 || n > 365 {
+			return apiError(c, http.StatusBadRequest, "days must be between 1 and 365")
+		}
+		days = n
+	}
+	rows, err := db.QueryContext(c.Request().Context(), `
+		SELECT id, room, started_at, ended_at, co2_start, co2_end, temperature_drop, source
+		FROM ventilation_events
+		WHERE started_at >= $1 AND ($2 = '' OR room = $2)
+		ORDER BY started_at DESC
+	`, time.Now().AddDate(0, 0, -days), c.QueryParam("room"))
+	if err != nil {
+		return internalError(c, err)
+	}
+	defer rows.Close()
+
+	events := []VentilationEvent{}
+	for rows.Next() {
+		var e VentilationEvent
+		var tempDrop sql.NullFloat64
+		if err := rows.Scan(&e.ID, &e.Room, &e.StartedAt, &e.EndedAt, &e.CO2Start, &e.CO2End, &tempDrop, &e.Source); err != nil {
+			return internalError(c, err)
+		}
+		e.DurationSeconds = int64(e.EndedAt.Sub(e.StartedAt).Seconds())
+		e.CO2Drop = e.CO2Start - e.CO2End
+		if tempDrop.Valid {
+			e.TemperatureDrop = &tempDrop.Float64
+		}
+		events = append(events, e)
+	}
+	return c.JSON(http.StatusOK, events)
+}
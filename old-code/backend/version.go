@@ -0,0 +1,70 @@
+package main
+
+import (
+	"net/http"
+	"runtime"
+	"runtime/debug"
+	"time"
+
+	"github.com/labstack/echo/v4"
+)
+
+// version and commit are set at build time, see build-backend in the
+// Makefile. Without them the commit comes from the VCS stamp Go embeds.
+var (
+	version = "dev"
+	commit  = ""
+)
+
+// schemaVersion is the level of the schema createTables applies. Bump it
+// with every schema change; each server records the level it applied in
+// schema_version.
+const schemaVersion = 25
+
+var startedAt = time.Now()
+
+type VersionInfo struct {
+	Version       string    `json:"version"`
+	Commit        string    `json:"commit"`
+	Modified      bool      `json:"modified,omitempty"` // built from a dirty tree
+	GoVersion     string    `json:"go_version"`
+	SchemaVersion int       `json:"schema_version"` // what this build applies
+	SchemaApplied int       `json:"schema_applied"` // the highest level the database has seen
+	StartedAt     time.Time `json:"started_at"`
+	UptimeSeconds int64     `json:"uptime_seconds"`
+}
+
+func recordSchemaVersion() error {
+	_, err := db.Exec(`
+		INSERT INTO schema_version (version, applied_at) VALUES ($1, $2) ON CONFLICT (version) DO NOTHING
+	`, schemaVersion, time.Now())
+	return err
+}
+
+func buildInfo() VersionInfo {
+	v := VersionInfo{Version: version, Commit: commit, GoVersion: runtime.Version(), SchemaVersion: schemaVersion}
+	if info, ok := debug.ReadBuildInfo(); ok {
+		for _, s := range info.Settings {
+			switch s.Key {
+			case "vcs.revision":
+				if v.Commit == "" {
+					v.Commit = s.Value
+				}
+			case "vcs.modified":
+				v.Modified = s.Value == "true"
+			}
+		}
+	}
+	return v
+}
+
+func getVersion(c echo.Context) error {
+	v := buildInfo()
+	err := db.QueryRowContext(c.Request().Context(), "SELECT COALESCE(MAX(version), 0) FROM schema_version").Scan(&v.SchemaApplied)
+	if err != nil {
+		return internalError(c, err)
+	}
+	v.StartedAt = startedAt
+	v.UptimeSeconds = int64(time.Since(startedAt).Seconds())
+	return c.JSON(http.StatusOK, v)
+}
@@ -0,0 +1,147 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/labstack/echo/v4"
+)
+
+// Wake-up statistics are computed from alarm_rings. Rings that start within
+// WAKEUP_SNOOZE_WINDOW of the previous ring's end belong to the same
+// morning, and every ring after the first is a snooze. The time to get up
+// is from the first ring to the end of the last one. A morning counts for
+// the streak when the alarm was turned off on the first ring.
+
+type WakeupMorning struct {
+	Date           string    `json:"date"`
+	FirstRing      time.Time `json:"first_ring"`
+	Rings          int       `json:"rings"`
+	Snoozes        int       `json:"snoozes"`
+	SecondsToUp    *int64    `json:"seconds_to_up,omitempty"` // nil while still ringing
+	Unattended     bool      `json:"unattended"`
+	SnoozeFree     bool      `json:"snooze_free"`
+	lastRingEnd    time.Time
+	lastRingActive bool
+}
+
+type WakeupStats struct {
+	From             time.Time       `json:"from"`
+	To               time.Time       `json:"to"`
+	Mornings         int             `json:"mornings"`
+	AvgSecondsToUp   float64         `json:"avg_seconds_to_up"`
+	Snoozes          int             `json:"snoozes"`
+	SnoozeFree       int             `json:"snooze_free_mornings"`
+	Unattended       int             `json:"unattended_mornings"`
+	CurrentStreak    int             `json:"current_streak"` // snooze-free mornings in a row, up to the latest
+	BestStreak       int             `json:"best_streak"`    // within the last year
+	MorningBreakdown []WakeupMorning `json:"mornings_detail"`
+}
+
+// loadMornings groups the rings since a time into mornings, oldest first.
+func loadMornings(ctx context.Context, since time.Time) ([]WakeupMorning, error) {
+	rows, err := db.QueryContext(ctx, `
+		SELECT started_at, ended_at, outcome FROM alarm_rings WHERE started_at >= $1 ORDER BY started_at
+	`, since)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	window := envDuration("WAKEUP_SNOOZE_WINDOW", 30*time.Minute)
+	var mornings []WakeupMorning
+	for rows.Next() {
+		var started time.Time
+		var ended sql.NullTime
+		var outcome string
+		if err := rows.Scan(&started, &ended, &outcome); err != nil {
+			return nil, err
+		}
+		n := len(mornings)
+		if n == 0 || mornings[n-1].lastRingActive || started.Sub(mornings[n-1].lastRingEnd) > window {
+			mornings = append(mornings, WakeupMorning{Date: started.Format("2006-01-02"), FirstRing: started})
+			n++
+		}
+		m := &mornings[n-1]
+		m.Rings++
+		m.lastRingActive = !ended.Valid
+		if ended.Valid {
+			m.lastRingEnd = ended.Time
+		}
+		m.Unattended = m.Unattended || outcome == "unattended"
+	}
+	for i := range mornings {
+		m := &mornings[i]
+		m.Snoozes = m.Rings - 1
+		m.SnoozeFree = m.Snoozes == 0 && !m.Unattended
+		if !m.lastRingActive {
+			seconds := int64(m.lastRingEnd.Sub(m.FirstRing).Seconds())
+			m.SecondsToUp = &seconds
+		}
+	}
+	return mornings, rows.Err()
+}
+
+func computeWakeupStats(ctx context.Context, from, to time.Time) (WakeupStats, error) {
+	s := WakeupStats{From: from, To: to, MorningBreakdown: []WakeupMorning{}}
+	mornings, err := loadMornings(ctx, to.AddDate(-1, 0, 0))
+	if err != nil {
+		return s, err
+	}
+
+	streak, timed := 0, 0
+	var total int64
+	for _, m := range mornings {
+		if !m.FirstRing.Before(to) {
+			break
+		}
+		if m.SnoozeFree {
+			streak++
+		} else if m.SecondsToUp != nil {
+			streak = 0
+		}
+		s.BestStreak = max(s.BestStreak, streak)
+		if m.FirstRing.Before(from) {
+			continue
+		}
+		s.Mornings++
+		s.Snoozes += m.Snoozes
+		if m.SnoozeFree {
+			s.SnoozeFree++
+		}
+		if m.Unattended {
+			s.Unattended++
+		}
+		if m.SecondsToUp != nil {
+			total += *m.SecondsToUp
+			timed++
+		}
+		s.MorningBreakdown = append(s.MorningBreakdown, m)
+	}
+	s.CurrentStreak = streak
+	if timed > 0 {
+		s.AvgSecondsToUp = float64(total) / float64(timed)
+	}
+	return s, nil
+}
+
+// getWakeupStats returns the statistics of the last ?days (default 30).
+func getWakeupStats(c echo.Context) error {
+	days := 30
+	if v := c.QueryParam("days"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 1 || n > 365 {
+			return apiError(c, http.StatusBadRequest, "days must be between 1 and 365")
+		}
+		days = n
+	}
+	now := time.Now()
+	s, err := computeWakeupStats(c.Request().Context(), now.AddDate(0, 0, -days), now)
+	if err != nil {
+		return internalError(c, err)
+	}
+	return c.JSON(http.StatusOK, s)
+}
@@ -0,0 +1,413 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/ecdh"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"math/big"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/labstack/echo/v4"
+)
+
+// Web Push lets the dashboard notify by itself: the SPA registers
+// push-sw.js, subscribes with the server's VAPID public key (GET
+// /api/push/key) and stores the subscription with POST /api/push/subscribe.
+// Notifications then go to every subscribed browser like to any other
+// channel ("webpush", from WEBPUSH_MIN_PRIORITY), encrypted as RFC 8291
+// requires. Subscriptions the push service reports as gone are deleted.
+//
+// The VAPID key pair is generated on first use and kept in web_push_keys,
+// so every replica signs with the same key; VAPID_PRIVATE_KEY (base64url
+// P-256 scalar) overrides it. POST /api/push/key/rotate replaces the stored
+// key, which drops every subscription: browsers have to subscribe again.
+
+const webPushTTL = 12 * time.Hour
+
+var webPushClient = &http.Client{Timeout: 15 * time.Second}
+
+type PushSubscription struct {
+	Endpoint string `json:"endpoint"`
+	Keys     struct {
+		P256dh string `json:"p256dh"`
+		Auth   string `json:"auth"`
+	} `json:"keys"`
+}
+
+type vapidKey struct {
+	private *ecdsa.PrivateKey
+	public  []byte // uncompressed point
+}
+
+func vapidKeyFromScalar(d []byte) (*vapidKey, error) {
+	k, err := ecdh.P256().NewPrivateKey(d)
+	if err != nil {
+		return nil, err
+	}
+	pub := k.PublicKey().Bytes()
+	return &vapidKey{
+		private: &ecdsa.PrivateKey{
+			PublicKey: ecdsa.PublicKey{Curve: elliptic.P256(), X: new(big.Int).SetBytes(pub[1:33]), Y: new(big.Int).SetBytes(pub[33:])},
+			D:         new(big.Int).SetBytes(d),
+		},
+		public: pub,
+	}, nil
+}
+
+func newVAPIDScalar() (string, error) {
+	k, err := ecdh.P256().GenerateKey(rand.Reader)
+	if err != nil {
+		return "", err
+	}
+	return base64.RawURLEncoding.EncodeToString(k.Bytes()), nil
+}
+
+// loadVAPIDKey returns VAPID_PRIVATE_KEY or the stored key, storing a new
+// one the first time.
+func loadVAPIDKey(ctx context.Context) (*vapidKey, error) {
+	encoded := envString("VAPID_PRIVATE_KEY", "")
+	if encoded == "" {
+		fresh, err := newVAPIDScalar()
+		if err != nil {
+			return nil, err
+		}
+		// Replicas starting together agree on whichever key was inserted first.
+		if _, err := db.ExecContext(ctx, `
+			INSERT INTO web_push_keys (id, private_key) VALUES (1, $1) ON CONFLICT (id) DO NOTHING
+		`, fresh); err != nil {
+			return nil, err
+		}
+		if err := db.QueryRowContext(ctx, "SELECT private_key FROM web_push_keys WHERE id = 1").Scan(&encoded); err != nil {
+			return nil, err
+		}
+	}
+	d, err := base64.RawURLEncoding.DecodeString(strings.TrimRight(encoded, "="))
+	if err != nil {
+		return nil, fmt.Errorf("VAPID private key: %w", err)
+	}
+	return vapidKeyFromScalar(d)
+}
+
+// authorization is the VAPID Authorization header for a push endpoint.
+func (k *vapidKey) authorization(endpoint string) (string, error) {
+	u, err := url.Parse(endpoint)
+	if err != nil {
+		return "", err
+	}
+	header, _ := json.Marshal(map[string]string{"typ": "JWT", "alg": "ES256"})
+	claims, _ := json.Marshal(map[string]interface{}{
+		"aud": u.Scheme + "://" + u.Host,
+		"exp": time.Now().Add(webPushTTL).Unix(),
+		"sub": envString("VAPID_SUBJECT", "mailto:home-server@localhost"),
+	})
+	unsigned := base64.RawURLEncoding.EncodeToString(header) + "." + base64.RawURLEncoding.EncodeToString(claims)
+	digest := sha256.Sum256([]byte(unsigned))
+	r, s, err := ecdsa.Sign(rand.Reader, k.private, digest[:])
+	if err != nil {
+		return "", err
+	}
+	sig := make([]byte, 64)
+	r.FillBytes(sig[:32])
+	s.FillBytes(sig[32:])
+	return fmt.Sprintf("vapid t=%s.%s, k=%s", unsigned, base64.RawURLEncoding.EncodeToString(sig),
+		base64.RawURLEncoding.EncodeToString(k.public)), nil
+}
+
+// hkdf is HKDF-SHA256 for outputs of at most one block.
+func hkdf(salt, ikm, info []byte, length int) []byte {
+	mac := hmac.New(sha256.New, salt)
+	mac.Write(ikm)
+	prk := mac.Sum(nil)
+	mac = hmac.New(sha256.New, prk)
+	mac.Write(info)
+	mac.Write([]byte{1})
+	return mac.Sum(nil)[:length]
+}
+
+// encryptWebPush encrypts payload for a subscription with aes128gcm in a
+// single record (RFC 8291).
+func encryptWebPush(sub PushSubscription, payload []byte) ([]byte, error) {
+	uaPublic, err := base64.RawURLEncoding.DecodeString(strings.TrimRight(sub.Keys.P256dh, "="))
+	if err != nil {
+		return nil, fmt.Errorf("p256dh: %w", err)
+	}
+	authSecret, err := base64.RawURLEncoding.DecodeString(strings.TrimRight(sub.Keys.Auth, "="))
+	if err != nil {
+		return nil, fmt.Errorf("auth: %w", err)
+	}
+	uaKey, err := ecdh.P256().NewPublicKey(uaPublic)
+	if err != nil {
+		return nil, fmt.Errorf("p256dh: %w", err)
+	}
+	asKey, err := ecdh.P256().GenerateKey(rand.Reader)
+	if err != nil {
+		return nil, err
+	}
+	secret, err := asKey.ECDH(uaKey)
+	if err != nil {
+		return nil, err
+	}
+	asPublic := asKey.PublicKey().Bytes()
+
+	keyInfo := append(append([]byte("WebPush: info\x00"), uaPublic...), asPublic...)
+	ikm := hkdf(authSecret, secret, keyInfo, 32)
+	salt := make([]byte, 16)
+	if _, err := rand.Read(salt); err != nil {
+		return nil, err
+	}
+	cek := hkdf(salt, ikm, []byte("Content-Encoding: aes128gcm\x00"), 16)
+	nonce := hkdf(salt, ikm, []byte("Content-Encoding: nonce\x00"), 12)
+
+	block, err := aes.NewCipher(cek)
+	if err != nil {
+		return nil, err
+	}
+	gcm, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, err
+	}
+	// The header: salt, record size, key id length and key id.
+	body := append([]byte{}, salt...)
+	body = binary.BigEndian.AppendUint32(body, 4096)
+	body = append(body, byte(len(asPublic)))
+	body = append(body, asPublic...)
+	plaintext := append(append([]byte{}, payload...), 2) // the last record's delimiter
+	return gcm.Seal(body, nonce, plaintext, nil), nil
+}
+
+var errSubscriptionGone = errors.New("subscription expired")
+
+func sendWebPushTo(key *vapidKey, sub PushSubscription, payload []byte, urgency string) error {
+	body, err := encryptWebPush(sub, payload)
+	if err != nil {
+		return err
+	}
+	auth, err := key.authorization(sub.Endpoint)
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequest(http.MethodPost, sub.Endpoint, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Authorization", auth)
+	req.Header.Set("Content-Encoding", "aes128gcm")
+	req.Header.Set("Content-Type", "application/octet-stream")
+	req.Header.Set("TTL", fmt.Sprint(int(webPushTTL.Seconds())))
+	req.Header.Set("Urgency", urgency)
+	resp, err := webPushClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode == http.StatusNotFound || resp.StatusCode == http.StatusGone {
+		return errSubscriptionGone
+	}
+	if resp.StatusCode >= 300 {
+		return fmt.Errorf("push service returned %s", resp.Status)
+	}
+	return nil
+}
+
+// webPushUrgency maps a notification priority onto the Urgency header.
+func webPushUrgency(priority int) string {
+	switch {
+	case priority >= 4:
+		return "high"
+	case priority > 0 && priority <= 2:
+		return "low"
+	}
+	return "normal"
+}
+
+// sendWebPush delivers a notification to every subscribed browser. It is
+// the send function of the "webpush" channel.
+func sendWebPush(n Notification) error {
+	ctx := context.Background()
+	rows, err := db.QueryContext(ctx, "SELECT id, endpoint, p256dh, auth FROM push_subscriptions")
+	if err != nil {
+		return err
+	}
+	type stored struct {
+		id  int
+		sub PushSubscription
+	}
+	var subs []stored
+	for rows.Next() {
+		var s stored
+		if err := rows.Scan(&s.id, &s.sub.Endpoint, &s.sub.Keys.P256dh, &s.sub.Keys.Auth); err != nil {
+			rows.Close()
+			return err
+		}
+		subs = append(subs, s)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil || len(subs) == 0 {
+		return err
+	}
+
+	key, err := loadVAPIDKey(ctx)
+	if err != nil {
+		return err
+	}
+	actions := []map[string]string{}
+	for _, a := range n.Actions {
+		actions = append(actions, map[string]string{"label": a.Label, "url": a.URL, "method": a.Method})
+	}
+	payload, _ := json.Marshal(map[string]interface{}{
+		"title":    n.Title,
+		"body":     n.Message,
+		"priority": n.Priority,
+		"tags":     n.Tags,
+		"actions":  actions,
+	})
+
+	var failed []string
+	for _, s := range subs {
+		err := sendWebPushTo(key, s.sub, payload, webPushUrgency(n.Priority))
+		switch {
+		case errors.Is(err, errSubscriptionGone):
+			if _, err := db.ExecContext(ctx, "DELETE FROM push_subscriptions WHERE id = $1", s.id); err != nil {
+				log.Printf("Failed to delete expired push subscription %d: %v", s.id, err)
+			}
+		case err != nil:
+			failed = append(failed, fmt.Sprintf("subscription %d: %v", s.id, err))
+		default:
+			if _, err := db.ExecContext(ctx, "UPDATE push_subscriptions SET last_sent = $2 WHERE id = $1", s.id, time.Now()); err != nil {
+				log.Printf("Failed to update push subscription %d: %v", s.id, err)
+			}
+		}
+	}
+	if len(failed) > 0 {
+		return errors.New(strings.Join(failed, "; "))
+	}
+	return nil
+}
+
+// getPushKey returns the VAPID public key as applicationServerKey for
+// PushManager.subscribe.
+func getPushKey(c echo.Context) error {
+	key, err := loadVAPIDKey(c.Request().Context())
+	if err != nil {
+		return internalError(c, err)
+	}
+	return c.JSON(http.StatusOK, map[string]string{"public_key": base64.RawURLEncoding.EncodeToString(key.public)})
+}
+
+// rotatePushKey replaces the stored VAPID key and drops the subscriptions
+// made with the old one.
+func rotatePushKey(c echo.Context) error {
+	if envString("VAPID_PRIVATE_KEY", "") != "" {
+		return apiError(c, http.StatusConflict, "the key comes from VAPID_PRIVATE_KEY, change it there")
+	}
+	fresh, err := newVAPIDScalar()
+	if err != nil {
+		return internalError(c, err)
+	}
+	ctx := c.Request().Context()
+	tx, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		return internalError(c, err)
+	}
+	defer tx.Rollback()
+	if _, err := tx.ExecContext(ctx, `
+		INSERT INTO web_push_keys (id, private_key) VALUES (1, $1)
+		ON CONFLICT (id) DO UPDATE SET private_key = EXCLUDED.private_key, created_at = NOW()
+	`, fresh); err != nil {
+		return internalError(c, err)
+	}
+	res, err := tx.ExecContext(ctx, "DELETE FROM push_subscriptions")
+	if err != nil {
+		return internalError(c, err)
+	}
+	if err := tx.Commit(); err != nil {
+		return internalError(c, err)
+	}
+	dropped, _ := res.RowsAffected()
+	key, err := loadVAPIDKey(ctx)
+	if err != nil {
+		return internalError(c, err)
+	}
+	return c.JSON(http.StatusOK, map[string]interface{}{
+		"public_key":            base64.RawURLEncoding.EncodeToString(key.public),
+		"dropped_subscriptions": dropped,
+	})
+}
+
+// subscribePush stores a PushSubscription as the browser serializes it:
+// {"endpoint": "https://...", "keys": {"p256dh": "...", "auth": "..."}}.
+// Subscribing again with the same endpoint updates its keys.
+func subscribePush(c echo.Context) error {
+	var sub PushSubscription
+	if err := c.Bind(&sub); err != nil {
+		return invalidBody(c, err)
+	}
+	if u, err := url.Parse(sub.Endpoint); err != nil || u.Scheme != "https" || u.Host == "" {
+		return apiError(c, http.StatusBadRequest, "endpoint must be an https URL")
+	}
+	if sub.Keys.P256dh == "" || sub.Keys.Auth == "" {
+		return apiError(c, http.StatusBadRequest, "keys.p256dh and keys.auth are required")
+	}
+	if _, err := encryptWebPush(sub, nil); err != nil {
+		return apiError(c, http.StatusBadRequest, fmt.Sprintf("invalid subscription keys: %v", err))
+	}
+	var subject sql.NullString
+	if s := currentSession(c); s != nil {
+		subject = sql.NullString{String: s.Subject, Valid: true}
+	}
+	var id int
+	err := db.QueryRowContext(c.Request().Context(), `
+		INSERT INTO push_subscriptions (endpoint, p256dh, auth, subject, user_agent) VALUES ($1, $2, $3, $4, $5)
+		ON CONFLICT (endpoint) DO UPDATE SET p256dh = EXCLUDED.p256dh, auth = EXCLUDED.auth,
+			subject = EXCLUDED.subject, user_agent = EXCLUDED.user_agent
+		RETURNING id
+	`, sub.Endpoint, sub.Keys.P256dh, sub.Keys.Auth, subject, c.Request().UserAgent()).Scan(&id)
+	if err != nil {
+		return internalError(c, err)
+	}
+	return c.JSON(http.StatusCreated, map[string]interface{}{"id": id, "endpoint": sub.Endpoint})
+}
+
+// unsubscribePush deletes the subscription of {"endpoint": "..."}.
+func unsubscribePush(c echo.Context) error {
+	var req struct {
+		Endpoint string `json:"endpoint"`
+	}
+	if err := c.Bind(&req); err != nil {
+		return invalidBody(c, err)
+	}
+	res, err := db.ExecContext(c.Request().Context(), "DELETE FROM push_subscriptions WHERE endpoint = $1", req.Endpoint)
+	if err != nil {
+		return internalError(c, err)
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		return apiError(c, http.StatusNotFound, "no such subscription")
+	}
+	return c.NoContent(http.StatusNoContent)
+}
+
+// testPush sends a test notification to the subscribed browsers.
+func testPush(c echo.Context) error {
+	err := sendWebPush(Notification{Title: "Test notification", Message: "Web Push works.", Tags: []string{"white_check_mark"}})
+	if err != nil {
+		return upstreamError(c, "sending the test notification failed", err)
+	}
+	return c.JSON(http.StatusOK, map[string]bool{"sent": true})
+}
@@ -0,0 +1,223 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"log"
+	"maps"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+)
+
+// The Zigbee2MQTT bridge subscribes to the broker at ZIGBEE2MQTT_URL and
+// records the sensors listed in ZIGBEE2MQTT_SENSORS as friendly_name=room
+// pairs, e.g.
+//
+//	ZIGBEE2MQTT_SENSORS=bedroom_window=bedroom,hall_motion=hall
+//
+// Each sensor is a device named after it, in its room, whose fields become
+// metrics: temperature and humidity as they are, contact as open (1 while
+// the window or door is open) and occupancy as motion (1 or 0). Zigbee
+// sensors only report on change, so they never count as offline.
+//
+// A change of contact or occupancy is also published as a contact.changed
+// or motion.detected event. Rules see the latest state of the sensors in the
+// room of every reading, so a rule on co2 can require "open" to be 1.
+
+const (
+	EventContactChanged = "contact.changed"
+	EventMotionDetected = "motion.detected"
+)
+
+type zigbeeBridge struct {
+	topic   string
+	sensors map[string]string // friendly name -> room
+
+	mu     sync.Mutex
+	states map[string]map[string]float64 // sensor -> metric -> latest value
+}
+
+var zigbee *zigbeeBridge
+
+func initZigbee() {
+	broker := envString("ZIGBEE2MQTT_URL", "")
+	sensors := parsePairs(envString("ZIGBEE2MQTT_SENSORS", ""))
+	if broker == "" {
+		return
+	}
+	if len(sensors) == 0 {
+		log.Printf("ZIGBEE2MQTT_SENSORS is not set, the Zigbee2MQTT bridge is disabled")
+		return
+	}
+	zigbee = &zigbeeBridge{
+		topic:   strings.TrimRight(envString("ZIGBEE2MQTT_TOPIC", "zigbee2mqtt"), "/"),
+		sensors: sensors,
+		states:  make(map[string]map[string]float64),
+	}
+	go zigbee.subscribe(broker)
+}
+
+// subscribe keeps the broker connection open, reconnecting with backoff.
+func (z *zigbeeBridge) subscribe(broker string) {
+	backoff := 5 * time.Second
+	for {
+		start := time.Now()
+		err := z.stream(broker)
+		if time.Since(start) > time.Minute {
+			backoff = 5 * time.Second
+		}
+		log.Printf("Zigbee2MQTT broker disconnected: %v, retrying in %s", err, backoff)
+		time.Sleep(backoff)
+		backoff = min(backoff*2, 5*time.Minute)
+	}
+}
+
+func (z *zigbeeBridge) stream(broker string) error {
+	conn, err := mqttDial(broker, "home-server-"+randomHex(4))
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	topics := make([]string, 0, len(z.sensors))
+	for name := range z.sensors {
+		topics = append(topics, z.topic+"/"+name)
+	}
+	if err := conn.subscribe(topics...); err != nil {
+		return err
+	}
+	log.Printf("Zigbee2MQTT bridge connected, %d sensors", len(topics))
+	return conn.receive(func(topic string, payload []byte) {
+		name := strings.TrimPrefix(topic, z.topic+"/")
+		if room, ok := z.sensors[name]; ok {
+			z.observe(name, room, payload)
+		}
+	})
+}
+
+// zigbeeMetrics converts a sensor's state message; fields it does not know
+// are ignored.
+func zigbeeMetrics(payload []byte) map[string]float64 {
+	var state struct {
+		Temperature *float64 `json:"temperature"`
+		Humidity    *float64 `json:"humidity"`
+		Contact     *bool    `json:"contact"`
+		Occupancy   *bool    `json:"occupancy"`
+	}
+	values := make(map[string]float64)
+	if json.Unmarshal(payload, &state) != nil {
+		return values
+	}
+	if state.Temperature != nil {
+		values["temperature"] = *state.Temperature
+	}
+	if state.Humidity != nil {
+		values["humidity"] = *state.Humidity
+	}
+	if state.Contact != nil {
+		values["open"] = boolFloat(!*state.Contact)
+	}
+	if state.Occupancy != nil {
+		values["motion"] = boolFloat(*state.Occupancy)
+	}
+	return values
+}
+
+// zigbeeMetric reports whether the bridge records a metric, so rules can
+// use it before the first message.
+func zigbeeMetric(name string) bool {
+	return zigbee != nil && slices.Contains([]string{"temperature", "humidity", "open", "motion"}, name)
+}
+
+func boolFloat(b bool) float64 {
+	if b {
+		return 1
+	}
+	return 0
+}
+
+func (z *zigbeeBridge) observe(name, room string, payload []byte) {
+	values := zigbeeMetrics(payload)
+	if len(values) == 0 {
+		return
+	}
+
+	z.mu.Lock()
+	previous := z.states[name]
+	if previous == nil {
+		previous = make(map[string]float64)
+		z.states[name] = previous
+	}
+	changed := make(map[string]bool)
+	for metric, v := range values {
+		old, seen := previous[metric]
+		changed[metric] = !seen || old != v
+		previous[metric] = v
+	}
+	z.mu.Unlock()
+	if !isLeader() {
+		// Kept for withRoomSensors, stored by the leader
+		return
+	}
+
+	ctx := context.Background()
+	now := time.Now()
+	deviceID, err := sensorDevice(ctx, name, room)
+	if err == nil {
+		err = storeMetricSamples(ctx, deviceID, values, now)
+	}
+	if err != nil {
+		log.Printf("Zigbee sensor %s: storing readings failed: %v", name, err)
+		return
+	}
+
+	publish(EventSensorUpdate, map[string]interface{}{"device": name, "room": room, "metrics": values})
+	if open, ok := values["open"]; ok && changed["open"] {
+		publish(EventContactChanged, map[string]interface{}{"sensor": name, "room": room, "open": open == 1})
+	}
+	if values["motion"] == 1 && changed["motion"] {
+		publish(EventMotionDetected, map[string]interface{}{"sensor": name, "room": room})
+	}
+	go evaluateRules(room, withRoomSensors(room, maps.Clone(values)))
+}
+
+// sensorDevice returns the ID of a bridged sensor's device. It never gets a
+// last_seen, which keeps it out of the liveness check.
+func sensorDevice(ctx context.Context, name, room string) (int, error) {
+	var id int
+	err := db.QueryRowContext(ctx, `
+		INSERT INTO devices (name, room) VALUES ($1, $2)
+		ON CONFLICT (name) DO UPDATE SET room = EXCLUDED.room
+		RETURNING id
+	`, name, room).Scan(&id)
+	return id, err
+}
+
+// withRoomSensors adds the latest Zigbee sensor states of a room to
+// readings that do not have them. With several sensors of a kind in a room
+// the highest value counts: open if any window is.
+func withRoomSensors(room string, readings map[string]float64) map[string]float64 {
+	if zigbee == nil {
+		return readings
+	}
+	zigbee.mu.Lock()
+	defer zigbee.mu.Unlock()
+	states := make(map[string]float64)
+	for name, values := range zigbee.states {
+		if zigbee.sensors[name] != room {
+			continue
+		}
+		for metric, v := range values {
+			if old, ok := states[metric]; !ok || v > old {
+				states[metric] = v
+			}
+		}
+	}
+	for metric, v := range states {
+		if _, ok := readings[metric]; !ok {
+			readings[metric] = v
+		}
+	}
+	return readings
+}
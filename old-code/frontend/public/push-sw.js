@@ -0,0 +1,30 @@
+// Service worker for Web Push: shows the notifications the backend sends and
+// runs their buttons, e.g. snoozing the ringing alarm.
+
+self.addEventListener('push', (event) => {
+  const data = event.data ? event.data.json() : {};
+  const actions = data.actions || [];
+  event.waitUntil(
+    self.registration.showNotification(data.title || 'Home Server', {
+      body: data.body,
+      icon: 'logo192.png',
+      requireInteraction: (data.priority || 3) >= 4,
+      actions: actions.map((a, i) => ({ action: String(i), title: a.label })),
+      data: { actions },
+    })
+  );
+});
+
+self.addEventListener('notificationclick', (event) => {
+  event.notification.close();
+  const action = (event.notification.data.actions || [])[Number(event.action)];
+  if (!event.action || !action) {
+    event.waitUntil(self.clients.openWindow('/'));
+    return;
+  }
+  if (action.method) {
+    event.waitUntil(fetch(action.url, { method: action.method }));
+  } else {
+    event.waitUntil(self.clients.openWindow(action.url));
+  }
+});
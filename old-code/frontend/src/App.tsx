@@ -164,8 +164,24 @@ interface DeviceStatus {
   alarm_enabled: boolean;
 }
 
+interface ThermostatState {
+  room: string;
+  temperature: number | null;
+  target: number | null;
+  heating: boolean | null;
+  boost_until?: string;
+}
+
 interface AlarmTime {
   time: string;
+  armed: boolean;
+  configured: boolean;
+}
+
+interface AlarmWarning {
+  code: 'duplicate' | 'soon' | 'skipped';
+  message: string;
+  needs_confirmation: boolean;
 }
 
 interface SensorData {
@@ -190,6 +206,12 @@ const isDeviceConnected = (lastSeen: string | null): boolean => {
   return !isNaN(lastSeenDate.getTime()) && lastSeenDate.getFullYear() >= 2000;
 };
 
+// PushManager.subscribe wants the VAPID key as bytes, the API sends base64url
+const urlBase64ToUint8Array = (base64: string): Uint8Array => {
+  const padded = (base64 + '='.repeat((4 - (base64.length % 4)) % 4)).replace(/-/g, '+').replace(/_/g, '/');
+  return Uint8Array.from(atob(padded), (c) => c.charCodeAt(0));
+};
+
 function getCO2Color(level: number): string {
   if (level <= CO2_THRESHOLDS.GOOD) return '#4CAF50';
   if (level <= CO2_THRESHOLDS.MODERATE) return '#FFC107';
@@ -199,6 +221,7 @@ function getCO2Color(level: number): string {
 
 function App() {
   const [deviceStatus, setDeviceStatus] = useState<DeviceStatus | null>(null);
+  const [thermostat, setThermostat] = useState<ThermostatState[]>([]);
   const [alarmTime, setAlarmTime] = useState<AlarmTime | null>(null);
   const [sensorData, setSensorData] = useState<SensorData[]>([]);
   const [progress, setProgress] = useState(100);
@@ -207,6 +230,8 @@ function App() {
     alarmTime?.time ? dayjs(alarmTime.time, 'HH:mm') : dayjs('10:30', 'HH:mm')
   );
   const [collapsed, setCollapsed] = useState(false);
+  const [pushSubscribed, setPushSubscribed] = useState(false);
+  const pushSupported = 'serviceWorker' in navigator && 'PushManager' in window;
 
   const fetchDeviceStatus = async () => {
     try {
@@ -214,10 +239,29 @@ function App() {
       setDeviceStatus(response.data);
       setLastUpdateTime(new Date(response.data.last_seen));
     } catch (error) {
+      // 404: no device has reported yet
+      if (axios.isAxiosError(error) && error.response?.status === 404) {
+        setDeviceStatus(null);
+        return;
+      }
       console.error('Error fetching device status:', error);
     }
   };
 
+  const fetchThermostat = async () => {
+    try {
+      const response = await axios.get(`${API_URL}/api/thermostat`);
+      setThermostat(response.data);
+    } catch (error) {
+      // 404: no heating controller configured
+      if (axios.isAxiosError(error) && error.response?.status === 404) {
+        setThermostat([]);
+        return;
+      }
+      console.error('Error fetching thermostat:', error);
+    }
+  };
+
   const fetchAlarmTime = async () => {
     try {
       const response = await axios.get(`${API_URL}/api/alarm`);
@@ -236,12 +280,24 @@ function App() {
     }
   };
 
-  const updateAlarmTime = async (timeToSet: string) => {
+  const updateAlarmTime = async (timeToSet: string, confirm = false) => {
     try {
-      await axios.post(`${API_URL}/api/alarm`, { time: timeToSet });
+      const response = await axios.post(`${API_URL}/api/alarm`, { time: timeToSet, confirm });
       await fetchAlarmTime();
-      window.alert('Alarm time updated successfully');
+      const warnings: AlarmWarning[] = response.data?.warnings ?? [];
+      window.alert(['Alarm time updated successfully', ...warnings.map((w) => w.message)].join('\n'));
     } catch (error) {
+      // Ringing soon or on a skipped day needs confirmation
+      if (!confirm && axios.isAxiosError(error) && error.response?.status === 428) {
+        const warnings: AlarmWarning[] = error.response.data.warnings ?? [];
+        if (window.confirm([...warnings.map((w) => w.message), 'Set the alarm anyway?'].join('\n'))) {
+          return updateAlarmTime(timeToSet, true);
+        }
+        if (alarmTime?.time) {
+          setTimePickerValue(dayjs(alarmTime.time, 'HH:mm'));
+        }
+        return;
+      }
       console.error('Error updating alarm time:', error);
       window.alert('Failed to update alarm time');
       // Reset the time picker value to the previous valid state
@@ -273,13 +329,40 @@ function App() {
     }
   };
 
+  const handleEnablePush = async () => {
+    try {
+      const registration = await navigator.serviceWorker.register('/push-sw.js');
+      const { data } = await axios.get(`${API_URL}/api/push/key`);
+      const subscription = await registration.pushManager.subscribe({
+        userVisibleOnly: true,
+        applicationServerKey: urlBase64ToUint8Array(data.public_key),
+      });
+      await axios.post(`${API_URL}/api/push/subscribe`, subscription.toJSON());
+      setPushSubscribed(true);
+      Message.success('Notifications enabled on this browser');
+    } catch (error) {
+      console.error('Error enabling notifications:', error);
+      Message.error('Failed to enable notifications');
+    }
+  };
+
+  useEffect(() => {
+    if (!pushSupported) return;
+    navigator.serviceWorker.getRegistration('/push-sw.js')
+      .then((registration) => registration?.pushManager.getSubscription())
+      .then((subscription) => setPushSubscribed(!!subscription))
+      .catch(() => setPushSubscribed(false));
+  }, [pushSupported]);
+
   useEffect(() => {
     fetchDeviceStatus();
+    fetchThermostat();
     fetchAlarmTime();
     fetchSensorData();
 
     const interval = setInterval(() => {
       fetchDeviceStatus();
+      fetchThermostat();
       fetchSensorData();
     }, 30000); // Refresh every 30 seconds
 
@@ -471,6 +554,16 @@ function App() {
                                 )}
                               </Space>
                             </motion.div>
+                            {thermostat.map((t) => (
+                              <motion.div key={t.room} variants={itemVariants}>
+                                <Text>
+                                  {t.room}: {t.temperature !== null ? `${t.temperature.toFixed(1)} °C` : '–'}
+                                  {t.target !== null && ` → ${t.target.toFixed(1)} °C`}
+                                  {t.heating && ', heating'}
+                                  {t.boost_until && ` (boost until ${new Date(t.boost_until).toLocaleTimeString()})`}
+                                </Text>
+                              </motion.div>
+                            ))}
                           </Space>
                         </Space>
                       </motion.div>
@@ -481,7 +574,7 @@ function App() {
                         animate={{ opacity: 1 }}
                         exit={{ opacity: 0 }}
                       >
-                        <Text>No device status available</Text>
+                        <Text>No device has reported yet</Text>
                       </motion.div>
                     )}
                   </AnimatePresence>
@@ -569,6 +662,14 @@ function App() {
                             }}
                             popupStyle={{ zIndex: 1000 }}
                           />
+                          {alarmTime && !alarmTime.configured && (
+                            <Text type="secondary">No alarm set yet</Text>
+                          )}
+                          {pushSupported && !pushSubscribed && (
+                            <Button type="outline" onClick={handleEnablePush}>
+                              Enable notifications
+                            </Button>
+                          )}
                         </Space>
                       </div>
                     </motion.div>